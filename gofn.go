@@ -30,7 +30,7 @@ func ProvideMachine(ctx context.Context, service iaas.Iaas) (client *docker.Clie
 	if machine.Port == 0 {
 		machine.Port = dockerPort
 	}
-	addr := fmt.Sprintf("%s:%d", machine.IP, machine.Port)
+	addr := fmt.Sprintf("%s:%d", machine.Address(), machine.Port)
 	client, err = provision.FnClient(addr, machine.CertsDir)
 	return
 }
@@ -52,11 +52,12 @@ func PrepareContainer(ctx context.Context, client *docker.Client, buildOpts *pro
 		image = buildOpts.GetImageName()
 	}
 
-	if containerOpts == nil {
-		containerOpts = &provision.ContainerOptions{}
+	var opts provision.ContainerOptions
+	if containerOpts != nil {
+		opts = *containerOpts
 	}
-	containerOpts.Image = image
-	container, err = provision.FnContainer(client, *containerOpts)
+	opts.Image = image
+	container, err = provision.FnContainer(client, opts)
 	return
 }
 
@@ -66,7 +67,7 @@ func RunWait(ctx context.Context, client *docker.Client, container *docker.Conta
 	if err != nil {
 		return
 	}
-	errors = provision.FnWaitContainer(client, container.ID)
+	errors = provision.FnWaitContainerWithContext(ctx, client, container.ID)
 	return
 }
 
@@ -94,6 +95,12 @@ func Run(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *
 				done <- struct{}{}
 				return
 			}
+			if containerOpts != nil {
+				// a copy so the options of the caller are kept for its next runs
+				opts := *containerOpts
+				opts.Machine = machine
+				containerOpts = &opts
+			}
 		}
 
 		container, err = PrepareContainer(ctx, client, buildOpts, containerOpts)
@@ -105,7 +112,12 @@ func Run(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *
 		var buffout *bytes.Buffer
 		var bufferr *bytes.Buffer
 
-		buffout, bufferr, err = provision.FnRun(client, container.ID, buildOpts.StdIN)
+		var runOpts provision.RunOptions
+		if containerOpts != nil {
+			runOpts.Timeout = containerOpts.ExecutionTimeout
+			runOpts.MaskSecrets = provision.SecretValues(containerOpts.Secrets)
+		}
+		buffout, bufferr, err = provision.FnRunWithOptions(ctx, client, container.ID, buildOpts.StdIN, runOpts)
 		stdout = buffout.String()
 		stderr = bufferr.String()
 		done <- struct{}{}
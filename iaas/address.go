@@ -0,0 +1,35 @@
+package iaas
+
+import "net"
+
+// interfaceAddrs returns the addresses of this host, tests replace it
+var interfaceAddrs = net.InterfaceAddrs
+
+// Address returns the address this host reaches the machine at: its private IP when
+// PreferPrivateIP is set and an interface of this host is on the same private network,
+// e.g. the orchestrator runs in the VPC of the droplets, its public IP otherwise
+func (m *Machine) Address() string {
+	if m.PreferPrivateIP && m.PrivateIP != "" && onLocalNetwork(m.PrivateIP) {
+		return m.PrivateIP
+	}
+	return m.IP
+}
+
+// onLocalNetwork reports whether ip is in the network of an interface of this host
+func onLocalNetwork(ip string) bool {
+	target := net.ParseIP(ip)
+	if target == nil {
+		return false
+	}
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		network, ok := addr.(*net.IPNet)
+		if ok && !network.IP.IsLoopback() && network.Contains(target) {
+			return true
+		}
+	}
+	return false
+}
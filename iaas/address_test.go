@@ -0,0 +1,43 @@
+package iaas
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestMachineAddress(t *testing.T) {
+	previous := interfaceAddrs
+	defer func() { interfaceAddrs = previous }()
+	vpc := func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("10.116.0.7"), Mask: net.CIDRMask(20, 32)},
+		}, nil
+	}
+	outside := func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("192.168.1.20"), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+	failing := func() ([]net.Addr, error) { return nil, errors.New("no interfaces") }
+
+	tests := []struct {
+		name    string
+		machine Machine
+		addrs   func() ([]net.Addr, error)
+		want    string
+	}{
+		{"same vpc", Machine{IP: "203.0.113.10", PrivateIP: "10.116.0.2", PreferPrivateIP: true}, vpc, "10.116.0.2"},
+		{"not preferred", Machine{IP: "203.0.113.10", PrivateIP: "10.116.0.2"}, vpc, "203.0.113.10"},
+		{"outside the vpc", Machine{IP: "203.0.113.10", PrivateIP: "10.116.0.2", PreferPrivateIP: true}, outside, "203.0.113.10"},
+		{"other private network", Machine{IP: "203.0.113.10", PrivateIP: "10.120.0.2", PreferPrivateIP: true}, vpc, "203.0.113.10"},
+		{"no private ip", Machine{IP: "203.0.113.10", PreferPrivateIP: true}, vpc, "203.0.113.10"},
+		{"loopback only", Machine{IP: "203.0.113.10", PrivateIP: "127.0.0.2", PreferPrivateIP: true}, vpc, "203.0.113.10"},
+		{"no interfaces", Machine{IP: "203.0.113.10", PrivateIP: "10.116.0.2", PreferPrivateIP: true}, failing, "203.0.113.10"},
+	}
+	for _, tt := range tests {
+		interfaceAddrs = tt.addrs
+		if addr := tt.machine.Address(); addr != tt.want {
+			t.Errorf("%s: expected %s but found %s", tt.name, tt.want, addr)
+		}
+	}
+}
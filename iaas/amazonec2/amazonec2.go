@@ -3,13 +3,13 @@ package amazonec2
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"time"
 
 	"github.com/docker/machine/drivers/amazonec2"
 	"github.com/docker/machine/libmachine"
 	"github.com/docker/machine/libmachine/drivers/rpc"
 	"github.com/gofn/gofn/iaas"
-	"github.com/gofrs/uuid"
+	"github.com/gofn/gofn/internal/names"
 )
 
 // Provider definition, represents a concrete implementation of an iaas
@@ -28,15 +28,20 @@ type driverConfig struct {
 	} `json:"Driver"`
 }
 
-func getConfig(machineDir, hostName string) (config *driverConfig, err error) {
-	configPath := fmt.Sprintf("%s/%s/config.json", machineDir, hostName)
-	raw, err := ioutil.ReadFile(configPath)
-	if err != nil {
+// loadConfig waits for the config.json of the created instance to have its ID and its IP
+func loadConfig(machineDir, hostName string, wait time.Duration) (config *driverConfig, err error) {
+	config = &driverConfig{}
+	err = iaas.LoadMachineConfig(machineDir, hostName, wait, config, func() (missing []string) {
+		if config.Driver.InstanceID == "" {
+			missing = append(missing, "InstanceID")
+		}
+		if config.Driver.IPAddress == "" {
+			missing = append(missing, "IPAddress")
+		}
 		return
-	}
-	err = json.Unmarshal(raw, &config)
+	})
 	if err != nil {
-		return
+		config = nil
 	}
 	return
 }
@@ -80,13 +85,7 @@ func New(accessKey, secretKey string, opts ...iaas.ProviderOpts) (p *Provider, e
 			return
 		}
 	}
-	var uid uuid.UUID
-	uid, err = uuid.NewV4()
-	if err != nil {
-		p = nil
-		return
-	}
-	name := fmt.Sprintf("gofn-%s", uid.String())
+	name := fmt.Sprintf("gofn-%s", names.ID())
 	if p.Name == "" {
 		p.Name = name
 	}
@@ -113,6 +112,9 @@ func New(accessKey, secretKey string, opts ...iaas.ProviderOpts) (p *Provider, e
 	if p.DiskSize != 0 {
 		driver.RootSize = int64(p.DiskSize)
 	}
+	if p.SSHKeyPath != "" {
+		driver.SSHPrivateKeyPath = p.SSHKeyPath
+	}
 	err = setFlags(driver)
 	if err != nil {
 		p = nil
@@ -133,11 +135,17 @@ func New(accessKey, secretKey string, opts ...iaas.ProviderOpts) (p *Provider, e
 
 // CreateMachine on digitalocean
 func (p *Provider) CreateMachine() (machine *iaas.Machine, err error) {
+	if p.SSHKeyPath != "" {
+		err = iaas.CheckSSHKeys(p.SSHKeyPath)
+		if err != nil {
+			return
+		}
+	}
 	err = p.Client.Create(p.Host)
 	if err != nil {
 		return
 	}
-	config, err := getConfig(p.Client.GetMachinesDir(), p.Name)
+	config, err := loadConfig(p.Client.GetMachinesDir(), p.Name, p.ConfigWait)
 	if err != nil {
 		return
 	}
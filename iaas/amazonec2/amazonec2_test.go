@@ -5,6 +5,7 @@ import (
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/docker/machine/drivers/fakedriver"
 	"github.com/docker/machine/libmachine"
@@ -13,7 +14,7 @@ import (
 	"github.com/gofn/gofn/iaas"
 )
 
-func Test_getConfig(t *testing.T) {
+func Test_loadConfig(t *testing.T) {
 	type args struct {
 		machineDir string
 		hostName   string
@@ -45,13 +46,13 @@ func Test_getConfig(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotConfig, err := getConfig(tt.args.machineDir, tt.args.hostName)
+			gotConfig, err := loadConfig(tt.args.machineDir, tt.args.hostName, time.Millisecond)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("getConfig() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("loadConfig() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if !reflect.DeepEqual(gotConfig, tt.wantConfig) {
-				t.Errorf("getConfig() = %#v, want %v", gotConfig, tt.wantConfig)
+				t.Errorf("loadConfig() = %#v, want %v", gotConfig, tt.wantConfig)
 			}
 		})
 	}
@@ -101,7 +102,8 @@ func TestCreateMachine(t *testing.T) {
 	// error on get config
 	p = Provider{
 		iaas.Provider{
-			Client: &libmachinetest.FakeAPI{},
+			Client:     &libmachinetest.FakeAPI{},
+			ConfigWait: time.Millisecond,
 		},
 	}
 	driver2 := &fakedriver.Driver{}
@@ -0,0 +1,93 @@
+package iaas
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrImageNotInCatalog is raised when no image offered by the provider matches a logical name
+var ErrImageNotInCatalog = errors.New("iaas: no image matches the logical name")
+
+// Image is a machine image offered by a provider
+type Image struct {
+	Slug    string    `json:"slug"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// ImageLister lists the images a provider currently offers
+type ImageLister interface {
+	ListImages() ([]Image, error)
+}
+
+// ImageCatalog resolves logical image names like "ubuntu-lts" to the current slug of a provider.
+// Names without a rule are explicit slugs and are returned untouched.
+type ImageCatalog struct {
+	Lister ImageLister
+	// Rules maps a logical name to the pattern its slugs match
+	Rules map[string]*regexp.Regexp
+	// TTL bounds how long a resolution is cached, zero caches it for the catalog lifetime
+	TTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]resolution
+}
+
+type resolution struct {
+	slug string
+	at   time.Time
+}
+
+// NewImageCatalog returns a catalog resolving rules with the images listed by lister
+func NewImageCatalog(lister ImageLister, rules map[string]*regexp.Regexp) *ImageCatalog {
+	return &ImageCatalog{
+		Lister: lister,
+		Rules:  rules,
+		cache:  make(map[string]resolution),
+	}
+}
+
+// Resolve returns the provider slug for image, when image is a logical name
+// the newest listed image whose slug matches the rule is chosen
+func (c *ImageCatalog) Resolve(image string) (slug string, err error) {
+	rule, ok := c.Rules[image]
+	if !ok {
+		slug = image
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = make(map[string]resolution)
+	}
+	if r, ok := c.cache[image]; ok && (c.TTL == 0 || time.Since(r.at) < c.TTL) {
+		slug = r.slug
+		return
+	}
+	images, err := c.Lister.ListImages()
+	if err != nil {
+		return
+	}
+	var matches []Image
+	for _, img := range images {
+		if rule.MatchString(img.Slug) {
+			matches = append(matches, img)
+		}
+	}
+	if len(matches) == 0 {
+		err = ErrImageNotInCatalog
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].Created.Equal(matches[j].Created) {
+			return matches[i].Created.After(matches[j].Created)
+		}
+		return matches[i].Slug > matches[j].Slug
+	})
+	slug = matches[0].Slug
+	c.cache[image] = resolution{slug: slug, at: time.Now()}
+	return
+}
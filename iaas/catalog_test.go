@@ -0,0 +1,110 @@
+package iaas
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type fakeLister struct {
+	images []Image
+	err    error
+	calls  int
+}
+
+func (f *fakeLister) ListImages() ([]Image, error) {
+	f.calls++
+	return f.images, f.err
+}
+
+var testRules = map[string]*regexp.Regexp{
+	"ubuntu-lts": regexp.MustCompile(`^ubuntu-\d[02468]-04-x64$`),
+}
+
+func day(d int) time.Time {
+	return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestImageCatalogResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		images   []Image
+		listErr  error
+		wantSlug string
+		wantErr  error
+	}{
+		{
+			name:     "explicit slug",
+			image:    "ubuntu-16-04-x64",
+			wantSlug: "ubuntu-16-04-x64",
+		},
+		{
+			name:  "newest lts",
+			image: "ubuntu-lts",
+			images: []Image{
+				{Slug: "ubuntu-20-04-x64", Created: day(1)},
+				{Slug: "ubuntu-22-04-x64", Created: day(3)},
+				{Slug: "ubuntu-23-10-x64", Created: day(5)},
+				{Slug: "debian-12-x64", Created: day(6)},
+			},
+			wantSlug: "ubuntu-22-04-x64",
+		},
+		{
+			name:  "retired image",
+			image: "ubuntu-lts",
+			images: []Image{
+				{Slug: "ubuntu-18-04-x64", Created: day(2)},
+				{Slug: "ubuntu-24-04-x64", Created: day(2)},
+			},
+			wantSlug: "ubuntu-24-04-x64",
+		},
+		{
+			name:    "no match",
+			image:   "ubuntu-lts",
+			images:  []Image{{Slug: "debian-12-x64"}},
+			wantErr: ErrImageNotInCatalog,
+		},
+		{
+			name:    "list error",
+			image:   "ubuntu-lts",
+			listErr: errors.New("api down"),
+			wantErr: errors.New("api down"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewImageCatalog(&fakeLister{images: tt.images, err: tt.listErr}, testRules)
+			slug, err := c.Resolve(tt.image)
+			if (err != nil || tt.wantErr != nil) && (err == nil || tt.wantErr == nil || err.Error() != tt.wantErr.Error()) {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if slug != tt.wantSlug {
+				t.Errorf("Resolve() = %q, want %q", slug, tt.wantSlug)
+			}
+		})
+	}
+}
+
+func TestImageCatalogCache(t *testing.T) {
+	lister := &fakeLister{images: []Image{{Slug: "ubuntu-22-04-x64"}}}
+	c := NewImageCatalog(lister, testRules)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Resolve("ubuntu-lts"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lister.calls != 1 {
+		t.Errorf("expected the image list to be queried once but was queried %d times", lister.calls)
+	}
+
+	c.TTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, err := c.Resolve("ubuntu-lts"); err != nil {
+		t.Fatal(err)
+	}
+	if lister.calls != 2 {
+		t.Errorf("expected the expired resolution to query the image list again, queried %d times", lister.calls)
+	}
+}
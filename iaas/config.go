@@ -0,0 +1,79 @@
+package iaas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMachineConfigIncomplete is raised when the config.json of a machine still misses
+	// required fields once the wait is over
+	ErrMachineConfigIncomplete = errors.New("iaas: machine config incomplete")
+)
+
+// DefaultConfigWait bounds the wait for the config.json of a created machine
+const DefaultConfigWait = 30 * time.Second
+
+// configBackoff is the first delay between the reads of a config.json, doubled up to a second
+var configBackoff = 50 * time.Millisecond
+
+// MachineConfigError names the fields missing in the config.json of a machine
+type MachineConfigError struct {
+	Path    string
+	Missing []string
+}
+
+func (e *MachineConfigError) Error() string {
+	return fmt.Sprintf("%v: %s misses %s", ErrMachineConfigIncomplete, e.Path, strings.Join(e.Missing, ", "))
+}
+
+// Unwrap returns ErrMachineConfigIncomplete
+func (e *MachineConfigError) Unwrap() error {
+	return ErrMachineConfigIncomplete
+}
+
+// WithConfigWait func
+func WithConfigWait(wait time.Duration) ProviderOpts {
+	return func(p *Provider) error {
+		p.ConfigWait = wait
+		return nil
+	}
+}
+
+// LoadMachineConfig decodes the docker-machine config.json of hostName in machineDir into config.
+// The driver may write the file after the machine is created, so a missing or partially written
+// file and a file for which missing returns the names of required fields are read again with a
+// backoff until wait, DefaultConfigWait when zero, is over. The last read error is returned
+// then, or a MachineConfigError naming the fields still missing.
+func LoadMachineConfig(machineDir, hostName string, wait time.Duration, config interface{}, missing func() []string) (err error) {
+	if wait == 0 {
+		wait = DefaultConfigWait
+	}
+	path := filepath.Join(machineDir, hostName, "config.json")
+	deadline := time.Now().Add(wait)
+	backoff := configBackoff
+	for {
+		var raw []byte
+		raw, err = ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(raw, config)
+		}
+		if err == nil {
+			if fields := missing(); len(fields) > 0 {
+				err = &MachineConfigError{Path: path, Missing: fields}
+			}
+		}
+		if err == nil || time.Now().Add(backoff).After(deadline) {
+			return
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package iaas
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testDriverConfig struct {
+	Driver struct {
+		IPAddress string `json:"IPAddress"`
+		SSHUser   string `json:"SSHUser"`
+	} `json:"Driver"`
+}
+
+func loadTestConfig(machineDir string, wait time.Duration) (config *testDriverConfig, err error) {
+	config = &testDriverConfig{}
+	err = LoadMachineConfig(machineDir, "gofn-test", wait, config, func() (missing []string) {
+		if config.Driver.IPAddress == "" {
+			missing = append(missing, "IPAddress")
+		}
+		return
+	})
+	return
+}
+
+// writeConfigLater writes the config.json of gofn-test in dir after delay
+func writeConfigLater(t *testing.T, dir, content string, delay time.Duration) chan struct{} {
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		time.Sleep(delay)
+		if err := os.MkdirAll(filepath.Join(dir, "gofn-test"), 0700); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "gofn-test", "config.json"), []byte(content), 0600); err != nil {
+			t.Error(err)
+		}
+	}()
+	return written
+}
+
+func TestLoadMachineConfig(t *testing.T) {
+	defer func(backoff time.Duration) { configBackoff = backoff }(configBackoff)
+	configBackoff = time.Millisecond
+	const complete = `{"Driver": {"IPAddress": "111.222.333.444", "SSHUser": "root"}}`
+	tests := []struct {
+		name    string
+		initial string
+		later   string
+	}{
+		{name: "missing file then appears", later: complete},
+		{name: "partially written file", initial: `{"Driver": {"IPAdd`, later: complete},
+		{name: "IP populated later", initial: `{"Driver": {"SSHUser": "root"}}`, later: complete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "gofn-machines")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if tt.initial != "" {
+				<-writeConfigLater(t, dir, tt.initial, 0)
+			}
+			written := writeConfigLater(t, dir, tt.later, 20*time.Millisecond)
+			defer func() { <-written }()
+
+			config, err := loadTestConfig(dir, 5*time.Second)
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if config.Driver.IPAddress != "111.222.333.444" || config.Driver.SSHUser != "root" {
+				t.Errorf("unexpected config %+v", config.Driver)
+			}
+		})
+	}
+}
+
+func TestLoadMachineConfigIncomplete(t *testing.T) {
+	defer func(backoff time.Duration) { configBackoff = backoff }(configBackoff)
+	configBackoff = time.Millisecond
+	dir, err := ioutil.TempDir("", "gofn-machines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err = loadTestConfig(dir, 10*time.Millisecond); !os.IsNotExist(err) {
+		t.Errorf("expected the missing file to be reported but found %v", err)
+	}
+
+	<-writeConfigLater(t, dir, `{"Driver": {"SSHUser": "root"}}`, 0)
+	start := time.Now()
+	_, err = loadTestConfig(dir, 50*time.Millisecond)
+	configErr, ok := err.(*MachineConfigError)
+	if !ok || configErr.Unwrap() != ErrMachineConfigIncomplete || len(configErr.Missing) != 1 || configErr.Missing[0] != "IPAddress" {
+		t.Fatalf("expected a MachineConfigError naming IPAddress but found %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the wait to be bounded but it took %v", elapsed)
+	}
+}
@@ -0,0 +1,212 @@
+package digitalocean
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gofn/gofn/iaas"
+)
+
+// apiURL is the DigitalOcean API root, tests point it to a fake server
+var apiURL = "https://api.digitalocean.com/v2"
+
+// apiError is an unsuccessful answer of the DigitalOcean API
+type apiError struct {
+	StatusCode int
+	ID         string `json:"id"`
+	Message    string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("digitalocean: %d %s: %s", e.StatusCode, e.ID, e.Message)
+}
+
+// apiClient covers the DigitalOcean API calls libmachine does not expose
+type apiClient struct {
+	token      string
+	httpClient *http.Client
+}
+
+func newAPIClient(token string) *apiClient {
+	return &apiClient{
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *apiClient) do(method, path string, in, out interface{}) (err error) {
+	var body io.Reader
+	if in != nil {
+		var raw []byte
+		raw, err = json.Marshal(in)
+		if err != nil {
+			return
+		}
+		body = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, apiURL+path, body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode >= 300 {
+		apiErr := &apiError{StatusCode: resp.StatusCode}
+		_ = json.Unmarshal(raw, apiErr) // nolint
+		err = apiErr
+		return
+	}
+	if out == nil || len(raw) == 0 {
+		return
+	}
+	err = json.Unmarshal(raw, out)
+	return
+}
+
+// nextPage returns the path of the page following the current one of path, empty on the last page
+func nextPage(path, next string) (string, error) {
+	if next == "" {
+		return "", nil
+	}
+	u, err := url.Parse(next)
+	if err != nil {
+		return "", err
+	}
+	return path + "?" + u.RawQuery, nil
+}
+
+type imagesPage struct {
+	Images []struct {
+		Slug      string    `json:"slug"`
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"created_at"`
+	} `json:"images"`
+	Links struct {
+		Pages struct {
+			Next string `json:"next"`
+		} `json:"pages"`
+	} `json:"links"`
+}
+
+// ListImages lists the distribution images, it implements iaas.ImageLister
+func (c *apiClient) ListImages() (images []iaas.Image, err error) {
+	path := "/images?type=distribution&per_page=200"
+	for path != "" {
+		var page imagesPage
+		err = c.do(http.MethodGet, path, nil, &page)
+		if err != nil {
+			return
+		}
+		for _, img := range page.Images {
+			if img.Slug == "" {
+				continue
+			}
+			images = append(images, iaas.Image{Slug: img.Slug, Name: img.Name, Created: img.CreatedAt})
+		}
+		path, err = nextPage("/images", page.Links.Pages.Next)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+type sizesPage struct {
+	Sizes []struct {
+		Slug string `json:"slug"`
+		// Memory is in megabytes
+		Memory       int64   `json:"memory"`
+		VCPUs        int     `json:"vcpus"`
+		PriceMonthly float64 `json:"price_monthly"`
+		Available    bool    `json:"available"`
+	} `json:"sizes"`
+	Links struct {
+		Pages struct {
+			Next string `json:"next"`
+		} `json:"pages"`
+	} `json:"links"`
+}
+
+// ListSizes lists the available droplet sizes, it implements iaas.SizeLister
+func (c *apiClient) ListSizes() (sizes []iaas.Size, err error) {
+	path := "/sizes?per_page=200"
+	for path != "" {
+		var page sizesPage
+		err = c.do(http.MethodGet, path, nil, &page)
+		if err != nil {
+			return
+		}
+		for _, size := range page.Sizes {
+			if !size.Available {
+				continue
+			}
+			sizes = append(sizes, iaas.Size{
+				Slug:         size.Slug,
+				Memory:       size.Memory << 20,
+				VCPUs:        size.VCPUs,
+				PriceMonthly: size.PriceMonthly,
+			})
+		}
+		path, err = nextPage("/sizes", page.Links.Pages.Next)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// droplet returns the droplet of id
+func (c *apiClient) droplet(id string) (d droplet, err error) {
+	var answer struct {
+		Droplet droplet `json:"droplet"`
+	}
+	err = c.do(http.MethodGet, "/droplets/"+url.PathEscape(id), nil, &answer)
+	d = answer.Droplet
+	return
+}
+
+// dropletNames returns the names of the droplets of the account
+func (c *apiClient) dropletNames() (names map[string]bool, err error) {
+	names = make(map[string]bool)
+	path := "/droplets?per_page=200"
+	for path != "" {
+		var page dropletsPage
+		err = c.do(http.MethodGet, path, nil, &page)
+		if err != nil {
+			return
+		}
+		for _, d := range page.Droplets {
+			names[d.Name] = true
+		}
+		path, err = nextPage("/droplets", page.Links.Pages.Next)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// privateIP returns the address of the private interface of the droplet, empty without one
+func (d droplet) privateIP() string {
+	for _, network := range d.Networks.V4 {
+		if network.Type == "private" {
+			return network.IPAddress
+		}
+	}
+	return ""
+}
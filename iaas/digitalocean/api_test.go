@@ -0,0 +1,104 @@
+package digitalocean
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofn/gofn/iaas"
+)
+
+func fakeAPI(t *testing.T, handler http.HandlerFunc) func() {
+	server := httptest.NewServer(handler)
+	previous := apiURL
+	apiURL = server.URL
+	return func() {
+		apiURL = previous
+		server.Close()
+	}
+}
+
+func TestListImages(t *testing.T) {
+	defer fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"id":"unauthorized","message":"Unable to authenticate you."}`)
+			return
+		}
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `{"images":[{"slug":"ubuntu-24-04-x64","created_at":"2024-04-25T00:00:00Z"}]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"images":[{"slug":"ubuntu-22-04-x64","created_at":"2022-04-21T00:00:00Z"},{"slug":""}],
+			"links":{"pages":{"next":"https://api.digitalocean.com/v2/images?page=2&type=distribution"}}}`)
+	})()
+
+	images, err := newAPIClient("token").ListImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].Slug != "ubuntu-22-04-x64" || images[1].Slug != "ubuntu-24-04-x64" {
+		t.Errorf("unexpected images %v", images)
+	}
+
+	_, err = newAPIClient("wrong").ListImages()
+	if apiErr, ok := err.(*apiError); !ok || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected an unauthorized api error but found %v", err)
+	}
+}
+
+func TestCatalogRetiredDefaultImage(t *testing.T) {
+	// ubuntu-16-04-x64 was retired, the default must resolve to the newest LTS left
+	defer fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"images":[
+			{"slug":"ubuntu-20-04-x64","created_at":"2023-01-10T00:00:00Z"},
+			{"slug":"ubuntu-22-04-x64","created_at":"2023-06-10T00:00:00Z"},
+			{"slug":"ubuntu-23-10-x64","created_at":"2023-10-12T00:00:00Z"},
+			{"slug":"debian-11-x64","created_at":"2023-02-10T00:00:00Z"},
+			{"slug":"debian-12-x64","created_at":"2023-06-11T00:00:00Z"}]}`)
+	})()
+
+	c := catalog("retired")
+	tests := map[string]string{
+		DefaultImage:       "ubuntu-22-04-x64",
+		"debian-stable":    "debian-12-x64",
+		"ubuntu-16-04-x64": "ubuntu-16-04-x64",
+	}
+	for image, want := range tests {
+		slug, err := c.Resolve(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slug != want {
+			t.Errorf("Resolve(%q) = %q, want %q", image, slug, want)
+		}
+	}
+	if catalog("retired") != c {
+		t.Error("expected providers sharing a token to share the catalog")
+	}
+}
+
+func TestListSizes(t *testing.T) {
+	defer fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `{"sizes":[{"slug":"s-2vcpu-4gb","memory":4096,"vcpus":2,"price_monthly":24,"available":true}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"sizes":[{"slug":"s-1vcpu-1gb","memory":1024,"vcpus":1,"price_monthly":6,"available":true},
+			{"slug":"retired-size","memory":512,"vcpus":1,"price_monthly":5,"available":false}],
+			"links":{"pages":{"next":"https://api.digitalocean.com/v2/sizes?page=2&per_page=200"}}}`)
+	})()
+
+	sizes, err := SizeCatalog("token").ListSizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []iaas.Size{
+		{Slug: "s-1vcpu-1gb", Memory: 1 << 30, VCPUs: 1, PriceMonthly: 6},
+		{Slug: "s-2vcpu-4gb", Memory: 4 << 30, VCPUs: 2, PriceMonthly: 24},
+	}
+	if len(sizes) != len(want) || sizes[0] != want[0] || sizes[1] != want[1] {
+		t.Errorf("expected the available sizes %v but found %v", want, sizes)
+	}
+}
@@ -4,17 +4,77 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/machine/drivers/digitalocean"
 	"github.com/docker/machine/libmachine"
 	"github.com/gofn/gofn/iaas"
-	"github.com/gofrs/uuid"
+	"github.com/gofn/gofn/internal/names"
 )
 
+// DefaultImage is the logical image used when no image slug is given
+const DefaultImage = "ubuntu-lts"
+
+// ImageRules are the logical image names understood by the DigitalOcean image catalog
+var ImageRules = map[string]*regexp.Regexp{
+	"ubuntu-lts":    regexp.MustCompile(`^ubuntu-\d[02468]-04-x64$`),
+	"debian-stable": regexp.MustCompile(`^debian-\d+-x64$`),
+}
+
+// BasicSizes are the basic droplet sizes with their list prices, a static catalog for
+// iaas.RecommendSizes without an API token, SizeCatalog lists the current ones
+var BasicSizes = iaas.SizeTable{
+	{Slug: "s-1vcpu-512mb-10gb", Memory: 512 << 20, VCPUs: 1, PriceMonthly: 4},
+	{Slug: "s-1vcpu-1gb", Memory: 1 << 30, VCPUs: 1, PriceMonthly: 6},
+	{Slug: "s-1vcpu-2gb", Memory: 2 << 30, VCPUs: 1, PriceMonthly: 12},
+	{Slug: "s-2vcpu-2gb", Memory: 2 << 30, VCPUs: 2, PriceMonthly: 18},
+	{Slug: "s-2vcpu-4gb", Memory: 4 << 30, VCPUs: 2, PriceMonthly: 24},
+	{Slug: "s-4vcpu-8gb", Memory: 8 << 30, VCPUs: 4, PriceMonthly: 48},
+	{Slug: "s-8vcpu-16gb", Memory: 16 << 30, VCPUs: 8, PriceMonthly: 96},
+}
+
+// SizeCatalog returns the droplet sizes currently available to the account of token
+func SizeCatalog(token string) iaas.SizeLister {
+	return newAPIClient(token)
+}
+
+var (
+	catalogsMu sync.Mutex
+	catalogs   = make(map[string]*iaas.ImageCatalog)
+)
+
+// catalog returns the image catalog shared by the providers using the same token
+func catalog(token string) *iaas.ImageCatalog {
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	c, ok := catalogs[token]
+	if !ok {
+		c = iaas.NewImageCatalog(newAPIClient(token), ImageRules)
+		catalogs[token] = c
+	}
+	return c
+}
+
 // Provider definition, represents a concrete implementation of an iaas
 type Provider struct {
 	iaas.Provider
+	// token reaches the API for the private IP of the droplets
+	token string
+	// ownsKey is set when the SSH key of the droplet is uploaded for it alone, it is then
+	// deleted with the droplet, unlike an account key given by KeyID or the shared key
+	ownsKey  bool
+	deleteMu sync.Mutex
+	deleted  bool
+	// pendingKeyID is the SSH key of the deleted droplet whose deletion failed, it is retried
+	// by the next Delete
+	pendingKeyID int
+	// driver is the configuration of the droplet, its logical image is resolved by CreateMachine
+	driver *digitalocean.Driver
 }
 
 type driverConfig struct {
@@ -24,6 +84,11 @@ type driverConfig struct {
 		IPAddress   string `json:"IPAddress"`
 		Image       string `json:"Image"`
 		SSHKeyID    int    `json:"SSHKeyID"`
+		SSHUser     string `json:"SSHUser"`
+		SSHPort     int    `json:"SSHPort"`
+		SSHKeyPath  string `json:"SSHKeyPath"`
+		// PrivateIPAddress is only saved by the drivers recording the private interface
+		PrivateIPAddress string `json:"PrivateIPAddress"`
 	} `json:"Driver"`
 }
 
@@ -40,21 +105,38 @@ func getConfig(machineDir, hostName string) (config *driverConfig, err error) {
 	return
 }
 
+// loadConfig waits for the config.json of the created droplet to have its ID and its IP
+func loadConfig(machineDir, hostName string, wait time.Duration) (config *driverConfig, err error) {
+	config = &driverConfig{}
+	err = iaas.LoadMachineConfig(machineDir, hostName, wait, config, func() (missing []string) {
+		if config.Driver.DropletID == 0 {
+			missing = append(missing, "DropletID")
+		}
+		if config.Driver.IPAddress == "" {
+			missing = append(missing, "IPAddress")
+		}
+		return
+	})
+	if err != nil {
+		config = nil
+	}
+	return
+}
+
+// New creates a DigitalOcean provider, logical image names like DefaultImage are
+// resolved to the newest matching slug offered by DigitalOcean when the machine is
+// created, so New does not reach the API for them. With an SSH key path
+// and no key ID the public key is shared under SharedKeyName and never deleted, without
+// both a key is uploaded for the machine and deleted with it.
 func New(token string, opts ...iaas.ProviderOpts) (p *Provider, err error) {
-	p = &Provider{}
+	p = &Provider{token: token}
 	for _, opt := range opts {
 		if err = opt(&p.Provider); err != nil {
 			p = nil
 			return
 		}
 	}
-	var uid uuid.UUID
-	uid, err = uuid.NewV4()
-	if err != nil {
-		p = nil
-		return
-	}
-	name := fmt.Sprintf("gofn-%s", uid.String())
+	name := fmt.Sprintf("gofn-%s", names.ID())
 	if p.Name == "" {
 		p.Name = name
 	}
@@ -65,8 +147,9 @@ func New(token string, opts ...iaas.ProviderOpts) (p *Provider, err error) {
 	p.Client = libmachine.NewClient(p.ClientPath, p.ClientPath+"/certs")
 	driver := digitalocean.NewDriver(p.Name, clientPath)
 	driver.AccessToken = token
-	if p.ImageSlug != "" {
-		driver.Image = p.ImageSlug
+	driver.Image = p.ImageSlug
+	if driver.Image == "" {
+		driver.Image = DefaultImage
 	}
 	if p.Region != "" {
 		driver.Region = p.Region
@@ -77,48 +160,155 @@ func New(token string, opts ...iaas.ProviderOpts) (p *Provider, err error) {
 	if p.KeyID != 0 {
 		driver.SSHKeyID = p.KeyID
 	}
-	data, err := json.Marshal(driver)
+	driver.PrivateNetworking = p.PrivateNetworking
+	p.ownsKey = p.KeyID == 0 && p.SSHKeyPath == ""
+	if p.SSHKeyPath != "" {
+		driver.SSHKey = p.SSHKeyPath
+		if p.KeyID == 0 {
+			err = useSharedKey(newAPIClient(token), driver, p.SSHKeyPath)
+			if err != nil {
+				p = nil
+				return
+			}
+		}
+	}
+	p.driver = driver
+	err = p.newHost()
 	if err != nil {
 		p = nil
 		return
 	}
-	p.Host, err = p.Client.NewHost(driver.DriverName(), data)
+	return
+}
+
+// newHost creates the host of the machine from its driver configuration
+func (do *Provider) newHost() (err error) {
+	data, err := json.Marshal(do.driver)
 	if err != nil {
-		p = nil
 		return
 	}
+	do.Host, err = do.Client.NewHost(do.driver.DriverName(), data)
+	return
+}
+
+// resolveImage resolves the logical image of the droplet to the slug DigitalOcean offers
+func (do *Provider) resolveImage() (err error) {
+	imageCatalog := do.Catalog
+	if imageCatalog == nil {
+		imageCatalog = catalog(do.token)
+	}
+	slug, err := imageCatalog.Resolve(do.driver.Image)
+	if err != nil || slug == do.driver.Image {
+		return
+	}
+	do.driver.Image = slug
+	err = do.newHost()
 	return
 }
 
 // CreateMachine on digitalocean
 func (do *Provider) CreateMachine() (machine *iaas.Machine, err error) {
+	if do.SSHKeyPath != "" {
+		err = iaas.CheckSSHKeys(do.SSHKeyPath)
+		if err != nil {
+			return
+		}
+	}
+	if do.driver != nil {
+		err = do.resolveImage()
+		if err != nil {
+			return
+		}
+	}
 	err = do.Client.Create(do.Host)
 	if err != nil {
 		return
 	}
-	config, err := getConfig(do.Client.GetMachinesDir(), do.Name)
+	config, err := loadConfig(do.Client.GetMachinesDir(), do.Name, do.ConfigWait)
 	if err != nil {
 		return
 	}
 
 	machine = &iaas.Machine{
-		ID:        strconv.Itoa(config.Driver.DropletID),
-		IP:        config.Driver.IPAddress,
-		Image:     config.Driver.Image,
-		Kind:      "digitalocean",
-		Name:      config.Driver.DropletName,
-		SSHKeysID: []int{config.Driver.SSHKeyID},
-		CertsDir:  do.ClientPath + "/certs",
+		ID:         strconv.Itoa(config.Driver.DropletID),
+		IP:         config.Driver.IPAddress,
+		Image:      config.Driver.Image,
+		Kind:       "digitalocean",
+		Name:       config.Driver.DropletName,
+		SSHKeysID:  []int{config.Driver.SSHKeyID},
+		CertsDir:   do.ClientPath + "/certs",
+		SSHUser:    config.Driver.SSHUser,
+		SSHPort:    config.Driver.SSHPort,
+		SSHKeyPath: config.Driver.SSHKeyPath,
+		PrivateIP:  config.Driver.PrivateIPAddress,
+	}
+	if do.PrivateNetworking && machine.PrivateIP == "" {
+		var d droplet
+		d, err = newAPIClient(do.token).droplet(machine.ID)
+		if err != nil {
+			return
+		}
+		machine.PrivateIP = d.privateIP()
 	}
+	machine.PreferPrivateIP = do.PreferPrivateIP
 	return
 }
 
-// DeleteMachine Shutdown and Delete a droplet
+// DeleteMachine Shutdown and Delete a droplet, deleting a droplet that is already gone succeeds.
+// The SSH key uploaded for the droplet is deleted with it.
 func (do *Provider) DeleteMachine() (err error) {
-	err = do.Host.Driver.Remove()
-	defer do.Client.Close()
-	if err != nil {
-		return
+	_, err = do.Delete()
+	return
+}
+
+// Delete shutdowns and deletes the droplet reporting whether this call deleted it,
+// it is safe for concurrent use and the machine state is released only once. The SSH key of
+// the droplet is deleted after it, a failed key deletion is retried by the next call.
+func (do *Provider) Delete() (deleted bool, err error) {
+	do.deleteMu.Lock()
+	defer do.deleteMu.Unlock()
+	if !do.deleted {
+		// read before the store forgets the host
+		keyID := do.machineKeyID()
+		err = do.Host.Driver.Remove()
+		if err != nil && !isNotFound(err) {
+			return
+		}
+		deleted = err == nil
+		err = nil
+		do.deleted = true
+		do.pendingKeyID = keyID
+		// the store may not know the host when it was never created
+		_ = do.Client.Remove(do.Name)
+		_ = do.Client.Close()
+	}
+	if do.pendingKeyID != 0 {
+		err = newAPIClient(do.token).deleteKey(do.pendingKeyID)
+		if err == nil {
+			do.pendingKeyID = 0
+		}
 	}
 	return
 }
+
+// machineKeyID returns the ID of the SSH key uploaded for the droplet, 0 when the key is not
+// owned by the droplet or the droplet was never created
+func (do *Provider) machineKeyID() int {
+	if !do.ownsKey {
+		return 0
+	}
+	config, err := getConfig(do.Client.GetMachinesDir(), do.Name)
+	if err != nil {
+		return 0
+	}
+	return config.Driver.SSHKeyID
+}
+
+// isNotFound reports whether err means the droplet does not exist
+func isNotFound(err error) bool {
+	if apiErr, ok := err.(*apiError); ok {
+		return apiErr.StatusCode == http.StatusNotFound
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "404") || strings.Contains(msg, "not found")
+}
@@ -4,13 +4,21 @@ import (
 	"github.com/gofn/gofn/iaas"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"reflect"
+	"regexp"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/docker/machine/drivers/digitalocean"
 	"github.com/docker/machine/drivers/fakedriver"
 	"github.com/docker/machine/libmachine"
 	"github.com/docker/machine/libmachine/host"
 	"github.com/docker/machine/libmachine/libmachinetest"
+	"github.com/gofn/gofn/internal/names"
 )
 
 func Test_getConfig(t *testing.T) {
@@ -28,17 +36,24 @@ func Test_getConfig(t *testing.T) {
 		{name: "problem to parse json", args: args{machineDir: "./testdata/", hostName: "unparseable"}, wantErr: true},
 		{name: "correct parser", args: args{machineDir: "./testdata/", hostName: "testconfig"}, wantConfig: &driverConfig{
 			Driver: struct {
-				DropletID   int    "json:\"DropletID\""
-				DropletName string "json:\"DropletName\""
-				IPAddress   string "json:\"IPAddress\""
-				Image       string "json:\"Image\""
-				SSHKeyID    int    "json:\"SSHKeyID\""
+				DropletID        int    "json:\"DropletID\""
+				DropletName      string "json:\"DropletName\""
+				IPAddress        string "json:\"IPAddress\""
+				Image            string "json:\"Image\""
+				SSHKeyID         int    "json:\"SSHKeyID\""
+				SSHUser          string "json:\"SSHUser\""
+				SSHPort          int    "json:\"SSHPort\""
+				SSHKeyPath       string "json:\"SSHKeyPath\""
+				PrivateIPAddress string "json:\"PrivateIPAddress\""
 			}{
 				DropletID:   100293178,
 				DropletName: "",
 				IPAddress:   "111.222.333.444",
 				Image:       "ubuntu-16-04-x64",
 				SSHKeyID:    21927446,
+				SSHUser:     "root",
+				SSHPort:     22,
+				SSHKeyPath:  "/root/.docker/machine/machines/gofn-016a970f-74b3-4e3d-acfa-839a82f34385/id_rsa",
 			},
 		}},
 	}
@@ -79,7 +94,7 @@ func (m *myAPI) GetMachinesDir() string {
 func TestCreateMachine(t *testing.T) {
 	// error on create machine
 	p := Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: libmachine.NewClient("", ""),
 		},
 	}
@@ -99,8 +114,9 @@ func TestCreateMachine(t *testing.T) {
 	}
 	// error on get config
 	p = Provider{
-		iaas.Provider{
-			Client: &libmachinetest.FakeAPI{},
+		Provider: iaas.Provider{
+			Client:     &libmachinetest.FakeAPI{},
+			ConfigWait: time.Millisecond,
 		},
 	}
 	driver2 := &fakedriver.Driver{}
@@ -112,7 +128,7 @@ func TestCreateMachine(t *testing.T) {
 	}
 	// sucess test
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &myAPI{},
 		},
 	}
@@ -124,9 +140,116 @@ func TestCreateMachine(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// unusable ssh key fails before any api call
+	p = Provider{
+		Provider: iaas.Provider{
+			SSHKeyPath: "./testdata/missing_id_rsa",
+		},
+	}
+	_, err = p.CreateMachine()
+	if keyErr, ok := err.(*iaas.SSHKeyError); !ok || keyErr.Err != iaas.ErrSSHKeyMissing {
+		t.Fatalf("expected ErrSSHKeyMissing, got %v", err)
+	}
+	// valid ssh key
+	p = Provider{
+		Provider: iaas.Provider{
+			Client:     &myAPI{},
+			SSHKeyPath: "./testdata/fake_id_rsa",
+		},
+	}
+	p.Name = "testconfig"
+	p.Host = &host.Host{}
+	p.Host.Driver = &fakedriver.Driver{}
+	_, err = p.CreateMachine()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 }
 
+func TestCreateMachinePrivateIP(t *testing.T) {
+	var lookups []string
+	defer fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		lookups = append(lookups, r.URL.Path)
+		fmt.Fprint(w, `{"droplet":{"id":100293178,"networks":{"v4":[
+			{"ip_address":"111.222.333.444","type":"public"},
+			{"ip_address":"10.116.0.3","type":"private"}]}}}`)
+	})()
+	create := func(name string, opts iaas.Provider) *iaas.Machine {
+		opts.Client = &myAPI{}
+		p := Provider{Provider: opts, token: "token"}
+		p.Name = name
+		p.Host = &host.Host{Driver: &fakedriver.Driver{}}
+		machine, err := p.CreateMachine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return machine
+	}
+
+	// recorded by the driver in config.json
+	machine := create("private", iaas.Provider{PrivateNetworking: true, PreferPrivateIP: true})
+	if machine.IP != "203.0.113.10" || machine.PrivateIP != "10.116.0.2" || !machine.PreferPrivateIP {
+		t.Errorf("unexpected machine %+v", machine)
+	}
+	if len(lookups) != 0 {
+		t.Errorf("expected the private IP of config.json but the api was called %v", lookups)
+	}
+
+	// looked up on the api otherwise
+	machine = create("testconfig", iaas.Provider{PrivateNetworking: true})
+	if machine.PrivateIP != "10.116.0.3" || machine.PreferPrivateIP {
+		t.Errorf("unexpected machine %+v", machine)
+	}
+	if !reflect.DeepEqual(lookups, []string{"/droplets/100293178"}) {
+		t.Errorf("expected the droplet lookup but found %v", lookups)
+	}
+
+	machine = create("testconfig", iaas.Provider{})
+	if machine.PrivateIP != "" || len(lookups) != 1 {
+		t.Errorf("expected no private IP without private networking but found %+v", machine)
+	}
+}
+
+func TestCreateMachineResolvesImage(t *testing.T) {
+	listed := 0
+	status := http.StatusOK
+	defer fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		listed++
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"images":[
+			{"slug":"ubuntu-20-04-x64","created_at":"2023-01-10T00:00:00Z"},
+			{"slug":"ubuntu-22-04-x64","created_at":"2023-06-10T00:00:00Z"}]}`)
+	})()
+	newProvider := func() *Provider {
+		p := &Provider{
+			Provider: iaas.Provider{
+				Client:  &myAPI{},
+				Name:    "testconfig",
+				Catalog: iaas.NewImageCatalog(newAPIClient("token"), ImageRules),
+			},
+			token:  "token",
+			driver: digitalocean.NewDriver("testconfig", "/tmp/testconfig"),
+		}
+		p.driver.Image = DefaultImage
+		p.Host = &host.Host{Driver: &fakedriver.Driver{}}
+		return p
+	}
+
+	p := newProvider()
+	if _, err := p.CreateMachine(); err != nil {
+		t.Fatal(err)
+	}
+	if p.driver.Image != "ubuntu-22-04-x64" || listed != 1 {
+		t.Errorf("expected the default image to be resolved once but found %q after %d listings", p.driver.Image, listed)
+	}
+
+	status = http.StatusUnauthorized
+	if _, err := newProvider().CreateMachine(); err == nil {
+		t.Error("expected the failed resolution to fail the creation")
+	}
+}
+
 type deleteAPI struct {
 	libmachinetest.FakeAPI
 }
@@ -146,7 +269,7 @@ func (r removeDriver) Remove() error {
 func TestDeleteMachine(t *testing.T) {
 	// success
 	p := Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 		},
 	}
@@ -159,7 +282,7 @@ func TestDeleteMachine(t *testing.T) {
 	}
 	// error on close will be ignored
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &deleteAPI{},
 		},
 	}
@@ -171,7 +294,7 @@ func TestDeleteMachine(t *testing.T) {
 	}
 	// error on remove
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 		},
 	}
@@ -183,3 +306,168 @@ func TestDeleteMachine(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+type countingDriver struct {
+	fakedriver.Driver
+	mu      sync.Mutex
+	removes int
+	err     error
+}
+
+func (d *countingDriver) Remove() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removes++
+	if d.removes > 1 {
+		return errors.New("DELETE https://api.digitalocean.com/v2/droplets/1: 404 The resource you were accessing could not be found.")
+	}
+	return d.err
+}
+
+type countingAPI struct {
+	libmachinetest.FakeAPI
+	mu      sync.Mutex
+	closes  int
+	removed []string
+}
+
+func (c *countingAPI) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closes++
+	return nil
+}
+
+func (c *countingAPI) Remove(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removed = append(c.removed, name)
+	return nil
+}
+
+func newCountingProvider(driver *countingDriver) (*Provider, *countingAPI) {
+	api := &countingAPI{}
+	p := &Provider{
+		Provider: iaas.Provider{
+			Client: api,
+			Name:   "gofn-test",
+			Host:   &host.Host{Driver: driver},
+		},
+	}
+	return p, api
+}
+
+func TestDeleteConcurrent(t *testing.T) {
+	driver := &countingDriver{}
+	p, api := newCountingProvider(driver)
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		deletes int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deleted, err := p.Delete()
+			if err != nil {
+				t.Error(err)
+			}
+			if deleted {
+				mu.Lock()
+				deletes++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if deletes != 1 {
+		t.Errorf("expected exactly one call to delete the droplet, got %d", deletes)
+	}
+	if driver.removes != 1 {
+		t.Errorf("expected the driver to be called once, got %d", driver.removes)
+	}
+	if api.closes != 1 || len(api.removed) != 1 || api.removed[0] != "gofn-test" {
+		t.Errorf("expected the machine state to be released once, got %d closes and removed %v", api.closes, api.removed)
+	}
+}
+
+func TestDeleteRepeated(t *testing.T) {
+	driver := &countingDriver{}
+	p, api := newCountingProvider(driver)
+	deleted, err := p.Delete()
+	if err != nil || !deleted {
+		t.Fatalf("expected the first call to delete the droplet, got %v, %v", deleted, err)
+	}
+	for i := 0; i < 3; i++ {
+		err = p.DeleteMachine()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if driver.removes != 1 || api.closes != 1 {
+		t.Errorf("expected one remove and one close, got %d and %d", driver.removes, api.closes)
+	}
+}
+
+func TestDeleteAlreadyGone(t *testing.T) {
+	driver := &countingDriver{removes: 1}
+	p, api := newCountingProvider(driver)
+	deleted, err := p.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Error("expected a missing droplet not to be reported as deleted")
+	}
+	if api.closes != 1 {
+		t.Errorf("expected the client to be closed, got %d closes", api.closes)
+	}
+}
+
+func TestDeleteRetryAfterFailure(t *testing.T) {
+	driver := &countingDriver{err: errors.New("500 internal error")}
+	p, api := newCountingProvider(driver)
+	_, err := p.Delete()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if api.closes != 0 {
+		t.Error("expected the client to be kept open for a retry")
+	}
+	driver.err = nil
+	driver.removes = 0
+	deleted, err := p.Delete()
+	if err != nil || !deleted {
+		t.Fatalf("expected the retry to delete the droplet, got %v, %v", deleted, err)
+	}
+}
+
+type failingEntropy struct{}
+
+func (failingEntropy) Read(p []byte) (int, error) {
+	return 0, errors.New("entropy exhausted")
+}
+
+func TestNewUUIDFallback(t *testing.T) {
+	defer func(entropy io.Reader, warn func(string, ...interface{})) {
+		names.Default.Entropy, names.Default.Warn = entropy, warn
+	}(names.Default.Entropy, names.Default.Warn)
+	var warnings []string
+	names.Default.Entropy = failingEntropy{}
+	names.Default.Warn = func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	p, err := New("token")
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	// the droplet names are host names
+	if !regexp.MustCompile(`^gofn-[a-z0-9-]{1,58}$`).MatchString(p.Name) {
+		t.Errorf("expected a valid droplet name but found %q", p.Name)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("expected the fallback to be reported but found %v", warnings)
+	}
+}
@@ -0,0 +1,185 @@
+package digitalocean
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/drivers/digitalocean"
+	"golang.org/x/crypto/ssh"
+)
+
+// SharedKeyName is the name of the SSH key shared by the machines created with the same key path
+const SharedKeyName = "gofnssh"
+
+// machineKeyPrefix starts the name of the keys uploaded for a single machine, they are named
+// after the machine
+const machineKeyPrefix = "gofn-"
+
+var (
+	// keyAttempts bounds the lookups and uploads of a shared key racing with other machines
+	keyAttempts = 5
+	// keyBackoff is the wait before the second attempt, it doubles at each attempt
+	keyBackoff = 250 * time.Millisecond
+	// orphanKeyGrace is the time CleanupOrphanKeys gives a machine being created to create
+	// its droplet after uploading its key
+	orphanKeyGrace = time.Minute
+)
+
+type key struct {
+	ID          int    `json:"id"`
+	Fingerprint string `json:"fingerprint"`
+	Name        string `json:"name"`
+	PublicKey   string `json:"public_key,omitempty"`
+}
+
+type keyAnswer struct {
+	SSHKey key `json:"ssh_key"`
+}
+
+// keyByFingerprint returns the ID of the key of the account with fingerprint, 0 when there is none
+func (c *apiClient) keyByFingerprint(fingerprint string) (id int, err error) {
+	var answer keyAnswer
+	err = c.do(http.MethodGet, "/account/keys/"+fingerprint, nil, &answer)
+	if apiErr, ok := err.(*apiError); ok && apiErr.StatusCode == http.StatusNotFound {
+		err = nil
+		return
+	}
+	id = answer.SSHKey.ID
+	return
+}
+
+func (c *apiClient) createKey(name, publicKey string) (id int, err error) {
+	var answer keyAnswer
+	err = c.do(http.MethodPost, "/account/keys", key{Name: name, PublicKey: publicKey}, &answer)
+	id = answer.SSHKey.ID
+	return
+}
+
+// isKeyInUse reports whether err is the answer to the upload of a key already in the account
+func isKeyInUse(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusUnprocessableEntity &&
+		strings.Contains(strings.ToLower(apiErr.Message), "already in use")
+}
+
+// sharedKey returns the ID and the fingerprint of the account key holding the public key of
+// keyPath, uploading it when missing. Machines created concurrently race to upload the key,
+// the losers are refused since the key is already in use and look it up again.
+func sharedKey(c *apiClient, keyPath string) (id int, fingerprint string, err error) {
+	raw, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(raw)
+	if err != nil {
+		return
+	}
+	fingerprint = ssh.FingerprintLegacyMD5(publicKey)
+	backoff := keyBackoff
+	for attempt := 1; ; attempt++ {
+		id, err = c.keyByFingerprint(fingerprint)
+		if err != nil || id != 0 {
+			return
+		}
+		id, err = c.createKey(SharedKeyName, strings.TrimSpace(string(raw)))
+		if !isKeyInUse(err) {
+			return
+		}
+		if attempt == keyAttempts {
+			err = fmt.Errorf("digitalocean: key %s still in use after %d attempts: %v", fingerprint, attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// useSharedKey makes driver use the shared key of keyPath, the driver then neither uploads
+// nor deletes it, so tearing down a machine does not break the others using the key
+func useSharedKey(c *apiClient, driver *digitalocean.Driver, keyPath string) (err error) {
+	driver.SSHKeyID, driver.SSHKeyFingerprint, err = sharedKey(c, keyPath)
+	return
+}
+
+// deleteKey deletes the account key of id, a key that is already gone is not an error
+func (c *apiClient) deleteKey(id int) (err error) {
+	err = c.do(http.MethodDelete, "/account/keys/"+strconv.Itoa(id), nil, nil)
+	if apiErr, ok := err.(*apiError); ok && apiErr.StatusCode == http.StatusNotFound {
+		err = nil
+	}
+	return
+}
+
+type keysPage struct {
+	SSHKeys []key `json:"ssh_keys"`
+	Links   struct {
+		Pages struct {
+			Next string `json:"next"`
+		} `json:"pages"`
+	} `json:"links"`
+}
+
+// listKeys returns the keys of the account
+func (c *apiClient) listKeys() (keys []key, err error) {
+	path := "/account/keys?per_page=200"
+	for path != "" {
+		var page keysPage
+		err = c.do(http.MethodGet, path, nil, &page)
+		if err != nil {
+			return
+		}
+		keys = append(keys, page.SSHKeys...)
+		path, err = nextPage("/account/keys", page.Links.Pages.Next)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// CleanupOrphanKeys deletes the keys gofn uploaded for a single machine, named after it, whose
+// droplet no longer exists, e.g. left behind by a process killed before deleting its machine.
+// The keys of the account and the shared key are never deleted. A machine being created
+// uploads its key before creating its droplet, so the keys without a droplet are only deleted
+// when they still have none a minute later, CleanupOrphanKeys then blocks for that minute.
+// It returns the deleted key IDs.
+func CleanupOrphanKeys(token string) (deleted []int, err error) {
+	c := newAPIClient(token)
+	keys, err := c.listKeys()
+	if err != nil {
+		return
+	}
+	droplets, err := c.dropletNames()
+	if err != nil {
+		return
+	}
+	var candidates []key
+	for _, k := range keys {
+		if strings.HasPrefix(k.Name, machineKeyPrefix) && !droplets[k.Name] {
+			candidates = append(candidates, k)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	time.Sleep(orphanKeyGrace)
+	droplets, err = c.dropletNames()
+	if err != nil {
+		return
+	}
+	for _, k := range candidates {
+		if droplets[k.Name] {
+			continue
+		}
+		err = c.deleteKey(k.ID)
+		if err != nil {
+			return
+		}
+		deleted = append(deleted, k.ID)
+	}
+	return
+}
@@ -0,0 +1,248 @@
+package digitalocean
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/drivers/digitalocean"
+	"github.com/docker/machine/drivers/fakedriver"
+	"github.com/docker/machine/libmachine/host"
+	"github.com/gofn/gofn/iaas"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeKeys is the key endpoints of the DigitalOcean API, the first lookups are held
+// until all the machines looked the key up so they all race to upload it
+type fakeKeys struct {
+	mu      sync.Mutex
+	keys    map[string]key
+	lookups sync.WaitGroup
+	uploads int
+	deletes int
+}
+
+func newFakeKeys(machines int) *fakeKeys {
+	f := &fakeKeys{keys: make(map[string]key)}
+	f.lookups.Add(machines)
+	return f
+}
+
+func (f *fakeKeys) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/account/keys/"):
+		f.mu.Lock()
+		k, ok := f.keys[strings.TrimPrefix(r.URL.Path, "/account/keys/")]
+		f.mu.Unlock()
+		if !ok {
+			f.lookups.Done()
+			f.lookups.Wait()
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"id":"not_found","message":"The resource you were accessing could not be found."}`)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(keyAnswer{SSHKey: k})
+	case r.Method == http.MethodPost && r.URL.Path == "/account/keys":
+		var k key
+		_ = json.NewDecoder(r.Body).Decode(&k)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.uploads++
+		for _, existing := range f.keys {
+			if existing.PublicKey == k.PublicKey {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				fmt.Fprint(w, `{"id":"unprocessable_entity","message":"SSH Key is already in use on your account"}`)
+				return
+			}
+		}
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		k.ID = 512190 + len(f.keys)
+		k.Fingerprint = ssh.FingerprintLegacyMD5(publicKey)
+		f.keys[k.Fingerprint] = k
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(keyAnswer{SSHKey: k})
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		f.deletes++
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestSharedKeyConcurrentCreate(t *testing.T) {
+	keyBackoff = time.Millisecond
+	defer func() { keyBackoff = 250 * time.Millisecond }()
+	const machines = 4
+	keys := newFakeKeys(machines)
+	defer fakeAPI(t, keys.serveHTTP)()
+
+	drivers := make([]*digitalocean.Driver, machines)
+	errs := make([]error, machines)
+	var wg sync.WaitGroup
+	for i := range drivers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			drivers[i] = digitalocean.NewDriver(fmt.Sprintf("gofn-%d", i), "")
+			errs[i] = useSharedKey(newAPIClient("token"), drivers[i], "testdata/fake_id_rsa")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, driver := range drivers {
+		if errs[i] != nil {
+			t.Fatalf("machine %d: expected no errors but %q found", i, errs[i])
+		}
+		if driver.SSHKeyID != 512190 {
+			t.Errorf("machine %d: expected the shared key 512190 but found %d", i, driver.SSHKeyID)
+		}
+		// the driver neither uploads nor deletes a key given by fingerprint
+		if _, ok := keys.keys[driver.SSHKeyFingerprint]; !ok {
+			t.Errorf("machine %d: unexpected fingerprint %q", i, driver.SSHKeyFingerprint)
+		}
+	}
+	if keys.uploads != machines || len(keys.keys) != 1 || keys.deletes != 0 {
+		t.Errorf("expected %d racing uploads of a single key and no deletion but found %d uploads, %d keys and %d deletions",
+			machines, keys.uploads, len(keys.keys), keys.deletes)
+	}
+}
+
+func TestSharedKeyStillInUse(t *testing.T) {
+	keyBackoff = time.Millisecond
+	defer func() { keyBackoff = 250 * time.Millisecond }()
+	attempts := 0
+	defer fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			attempts++
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, `{"id":"unprocessable_entity","message":"SSH Key is already in use on your account"}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})()
+
+	_, _, err := sharedKey(newAPIClient("token"), "testdata/fake_id_rsa")
+	if err == nil || !strings.Contains(err.Error(), "still in use") {
+		t.Errorf("expected the key to be refused but found %v", err)
+	}
+	if attempts != keyAttempts {
+		t.Errorf("expected %d attempts but found %d", keyAttempts, attempts)
+	}
+
+	if _, _, err = sharedKey(newAPIClient("token"), "testdata/missing"); err == nil {
+		t.Error("expected a missing key to fail")
+	}
+}
+
+func TestDeleteMachineKey(t *testing.T) {
+	var deletes []string
+	status := http.StatusNoContent
+	defer fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("unexpected call %s %s", r.Method, r.URL.Path)
+		}
+		deletes = append(deletes, r.URL.Path)
+		w.WriteHeader(status)
+	})()
+	newProvider := func(ownsKey bool) *Provider {
+		p := &Provider{
+			Provider: iaas.Provider{Client: &myAPI{}, Name: "testconfig", Host: &host.Host{Driver: &fakedriver.Driver{}}},
+			token:    "token",
+			ownsKey:  ownsKey,
+		}
+		return p
+	}
+
+	// uploaded for the droplet
+	if err := newProvider(true).DeleteMachine(); err != nil {
+		t.Fatal(err)
+	}
+	if len(deletes) != 1 || deletes[0] != "/account/keys/21927446" {
+		t.Errorf("expected the key of the droplet to be deleted but found %v", deletes)
+	}
+
+	// an account key or the shared key
+	deletes = nil
+	if err := newProvider(false).DeleteMachine(); err != nil {
+		t.Fatal(err)
+	}
+	if len(deletes) != 0 {
+		t.Errorf("expected the shared key to be kept but found %v", deletes)
+	}
+
+	// already gone
+	status = http.StatusNotFound
+	if err := newProvider(true).DeleteMachine(); err != nil {
+		t.Errorf("expected a missing key to be ignored but found %v", err)
+	}
+	status = http.StatusInternalServerError
+	p := newProvider(true)
+	if err := p.DeleteMachine(); err == nil {
+		t.Error("expected the failed key deletion to be reported")
+	}
+
+	// retried by the next deletion
+	deletes = nil
+	status = http.StatusNoContent
+	if err := p.DeleteMachine(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteMachine(); err != nil {
+		t.Fatal(err)
+	}
+	if len(deletes) != 1 || deletes[0] != "/account/keys/21927446" {
+		t.Errorf("expected the failed key deletion to be retried once but found %v", deletes)
+	}
+}
+
+func TestCleanupOrphanKeys(t *testing.T) {
+	defer func(grace time.Duration) { orphanKeyGrace = grace }(orphanKeyGrace)
+	orphanKeyGrace = 0
+	var deletes []string
+	dropletScans := 0
+	defer fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			deletes = append(deletes, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == "/account/keys" && r.URL.Query().Get("page") == "2":
+			fmt.Fprint(w, `{"ssh_keys":[{"id":5,"name":"gofn-ccc"},{"id":6,"name":"gofn-ddd"}]}`)
+		case r.URL.Path == "/account/keys":
+			fmt.Fprint(w, `{"ssh_keys":[{"id":1,"name":"gofnssh"},{"id":2,"name":"gofn-aaa"},{"id":3,"name":"gofn-bbb"},{"id":4,"name":"laptop"}],
+				"links":{"pages":{"next":"https://api.digitalocean.com/v2/account/keys?page=2&per_page=200"}}}`)
+		case r.URL.Path == "/droplets" && dropletScans == 0:
+			dropletScans++
+			fmt.Fprint(w, `{"droplets":[{"id":10,"name":"gofn-aaa"},{"id":11,"name":"web"}]}`)
+		case r.URL.Path == "/droplets":
+			// gofn-ddd created its droplet after uploading its key
+			dropletScans++
+			fmt.Fprint(w, `{"droplets":[{"id":10,"name":"gofn-aaa"},{"id":11,"name":"web"},{"id":12,"name":"gofn-ddd"}]}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})()
+
+	deleted, err := CleanupOrphanKeys("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0] != 3 || deleted[1] != 5 {
+		t.Errorf("expected the orphan keys 3 and 5 to be deleted but found %v", deleted)
+	}
+	if len(deletes) != 2 || deletes[0] != "/account/keys/3" || deletes[1] != "/account/keys/5" {
+		t.Errorf("unexpected deletions %v", deletes)
+	}
+	if dropletScans != 2 {
+		t.Errorf("expected the droplets to be listed again after the grace period but found %d scans", dropletScans)
+	}
+}
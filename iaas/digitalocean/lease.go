@@ -0,0 +1,155 @@
+package digitalocean
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// LeasedTag marks the droplets created through an iaas.LeaseManager
+	LeasedTag = "gofn-leased"
+	// leaseTagPrefix starts the tag holding the lease expiry as unix seconds
+	leaseTagPrefix = "gofn-lease-expiry:"
+)
+
+// Leaser stores the leases of droplets as tags, it implements iaas.Leaser
+type Leaser struct {
+	api *apiClient
+}
+
+// NewLeaser returns the leaser of the droplets of the account of token
+func NewLeaser(token string) *Leaser {
+	return &Leaser{api: newAPIClient(token)}
+}
+
+type droplet struct {
+	ID       int      `json:"id"`
+	Name     string   `json:"name"`
+	Tags     []string `json:"tags"`
+	Networks struct {
+		V4 []struct {
+			IPAddress string `json:"ip_address"`
+			Type      string `json:"type"`
+		} `json:"v4"`
+	} `json:"networks"`
+}
+
+type dropletsPage struct {
+	Droplets []droplet `json:"droplets"`
+	Links    struct {
+		Pages struct {
+			Next string `json:"next"`
+		} `json:"pages"`
+	} `json:"links"`
+}
+
+type tagResources struct {
+	Resources []tagResource `json:"resources"`
+}
+
+type tagResource struct {
+	ID   string `json:"resource_id"`
+	Type string `json:"resource_type"`
+}
+
+func leaseTag(expiry time.Time) string {
+	return leaseTagPrefix + strconv.FormatInt(expiry.Unix(), 10)
+}
+
+// leaseExpiry returns the latest expiry of tags, a droplet being renewed briefly has two
+func leaseExpiry(tags []string) (expiry time.Time, ok bool) {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, leaseTagPrefix) {
+			continue
+		}
+		sec, err := strconv.ParseInt(strings.TrimPrefix(tag, leaseTagPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		if t := time.Unix(sec, 0); !ok || t.After(expiry) {
+			expiry, ok = t, true
+		}
+	}
+	return
+}
+
+// tag adds the tag to the droplet, creating the tag when needed
+func (l *Leaser) tag(name, dropletID string) (err error) {
+	err = l.api.do(http.MethodPost, "/tags", map[string]string{"name": name}, nil)
+	if apiErr, ok := err.(*apiError); ok && apiErr.StatusCode == http.StatusUnprocessableEntity {
+		// the tag already exists
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	err = l.api.do(http.MethodPost, "/tags/"+url.PathEscape(name)+"/resources",
+		tagResources{[]tagResource{{ID: dropletID, Type: "droplet"}}}, nil)
+	return
+}
+
+// SetLease tags the droplet with the new expiry before untagging the previous ones,
+// so the droplet is never seen without a lease
+func (l *Leaser) SetLease(machineID string, expiry time.Time) (err error) {
+	current := leaseTag(expiry)
+	for _, name := range []string{LeasedTag, current} {
+		err = l.tag(name, machineID)
+		if err != nil {
+			return
+		}
+	}
+	d, err := l.api.droplet(machineID)
+	if err != nil {
+		return
+	}
+	for _, name := range d.Tags {
+		if name == current || !strings.HasPrefix(name, leaseTagPrefix) {
+			continue
+		}
+		err = l.api.do(http.MethodDelete, "/tags/"+url.PathEscape(name)+"/resources",
+			tagResources{[]tagResource{{ID: machineID, Type: "droplet"}}}, nil)
+		if err != nil && !isNotFound(err) {
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+// Leases lists the droplets tagged LeasedTag with their expiry
+func (l *Leaser) Leases() (leases map[string]time.Time, err error) {
+	leases = make(map[string]time.Time)
+	path := "/droplets?per_page=200&tag_name=" + url.QueryEscape(LeasedTag)
+	for path != "" {
+		var page dropletsPage
+		err = l.api.do(http.MethodGet, path, nil, &page)
+		if err != nil {
+			return
+		}
+		for _, d := range page.Droplets {
+			expiry, ok := leaseExpiry(d.Tags)
+			if !ok {
+				// a droplet tagged by hand without an expiry is not ours to delete
+				continue
+			}
+			leases[strconv.Itoa(d.ID)] = expiry
+		}
+		path, err = nextPage("/droplets", page.Links.Pages.Next)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// DeleteLeased deletes a leased droplet
+func (l *Leaser) DeleteLeased(machineID string) (err error) {
+	err = l.api.do(http.MethodDelete, "/droplets/"+url.PathEscape(machineID), nil, nil)
+	if err != nil && isNotFound(err) {
+		err = nil
+	}
+	return
+}
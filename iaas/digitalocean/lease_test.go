@@ -0,0 +1,186 @@
+package digitalocean
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofn/gofn/iaas"
+)
+
+// fakeDroplets serves the droplet and tag endpoints of the DigitalOcean API
+type fakeDroplets struct {
+	mu       sync.Mutex
+	droplets map[int]*droplet
+	deleted  []int
+}
+
+func newFakeDroplets(t *testing.T, droplets ...*droplet) (*fakeDroplets, func()) {
+	f := &fakeDroplets{droplets: make(map[int]*droplet)}
+	for _, d := range droplets {
+		f.droplets[d.ID] = d
+	}
+	return f, fakeAPI(t, f.serveHTTP)
+}
+
+func (f *fakeDroplets) tags(id int) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tags := append([]string{}, f.droplets[id].Tags...)
+	sort.Strings(tags)
+	return tags
+}
+
+func (f *fakeDroplets) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "tags":
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{}`))
+	case len(parts) == 3 && parts[0] == "tags" && parts[2] == "resources":
+		name, _ := url.PathUnescape(parts[1])
+		var body tagResources
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		for _, res := range body.Resources {
+			id, _ := strconv.Atoi(res.ID)
+			d, ok := f.droplets[id]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"id":"not_found","message":"The resource you were accessing could not be found."}`))
+				return
+			}
+			var tags []string
+			for _, tag := range d.Tags {
+				if tag != name {
+					tags = append(tags, tag)
+				}
+			}
+			if r.Method == http.MethodPost {
+				tags = append(tags, name)
+			}
+			d.Tags = tags
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "droplets":
+		page := dropletsPage{Droplets: []droplet{}}
+		for _, d := range f.droplets {
+			for _, tag := range d.Tags {
+				if tag == r.URL.Query().Get("tag_name") {
+					page.Droplets = append(page.Droplets, *d)
+				}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	case len(parts) == 2 && parts[0] == "droplets":
+		id, _ := strconv.Atoi(parts[1])
+		d, ok := f.droplets[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"id":"not_found","message":"The resource you were accessing could not be found."}`))
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.droplets, id)
+			f.deleted = append(f.deleted, id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"droplet": d})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestLeaserRenewal(t *testing.T) {
+	fake, stop := newFakeDroplets(t, &droplet{ID: 1, Tags: []string{"web"}})
+	defer stop()
+	leaser := NewLeaser("token")
+
+	first := time.Unix(1600000000, 0)
+	if err := leaser.SetLease("1", first); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := []string{"gofn-lease-expiry:1600000000", LeasedTag, "web"}
+	if tags := fake.tags(1); !reflect.DeepEqual(tags, want) {
+		t.Errorf("expected tags %v but found %v", want, tags)
+	}
+	if err := leaser.SetLease("1", first.Add(time.Hour)); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want = []string{"gofn-lease-expiry:1600003600", LeasedTag, "web"}
+	if tags := fake.tags(1); !reflect.DeepEqual(tags, want) {
+		t.Errorf("expected the previous expiry to be untagged, want %v but found %v", want, tags)
+	}
+	leases, err := leaser.Leases()
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !leases["1"].Equal(first.Add(time.Hour)) {
+		t.Errorf("unexpected leases %v", leases)
+	}
+}
+
+func TestLeaserLeasesLatestExpiry(t *testing.T) {
+	_, stop := newFakeDroplets(t,
+		// interrupted while renewing
+		&droplet{ID: 1, Tags: []string{LeasedTag, "gofn-lease-expiry:1600003600", "gofn-lease-expiry:1600000000"}},
+		&droplet{ID: 2, Tags: []string{LeasedTag}},
+		&droplet{ID: 3, Tags: []string{"gofn-lease-expiry:1600000000"}},
+	)
+	defer stop()
+
+	leases, err := NewLeaser("token").Leases()
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := map[string]time.Time{"1": time.Unix(1600003600, 0)}
+	if !reflect.DeepEqual(leases, want) {
+		t.Errorf("expected leases %v but found %v", want, leases)
+	}
+}
+
+func TestReapExpiredDroplets(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	expiry := func(d time.Duration) string {
+		return "gofn-lease-expiry:" + strconv.FormatInt(now.Add(d).Unix(), 10)
+	}
+	fake, stop := newFakeDroplets(t,
+		&droplet{ID: 1, Tags: []string{LeasedTag, expiry(-time.Hour)}},
+		// expired by less than the grace, the renewer clock may be behind
+		&droplet{ID: 2, Tags: []string{LeasedTag, expiry(-time.Minute)}},
+		&droplet{ID: 3, Tags: []string{LeasedTag, expiry(time.Hour)}},
+		// created without the manager
+		&droplet{ID: 4, Tags: []string{"web"}},
+		&droplet{ID: 5},
+	)
+	defer stop()
+
+	reaped, err := iaas.ReapExpired(NewLeaser("token"), now, iaas.DefaultLeaseGrace)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if want := []string{"1"}; !reflect.DeepEqual(reaped, want) {
+		t.Errorf("expected %v to be reaped but found %v", want, reaped)
+	}
+	if want := []int{1}; !reflect.DeepEqual(fake.deleted, want) {
+		t.Errorf("expected only droplet 1 to be deleted but found %v", fake.deleted)
+	}
+
+	// without grace the skewed lease expires too
+	reaped, err = iaas.ReapExpired(NewLeaser("token"), now, 0)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if want := []string{"2"}; !reflect.DeepEqual(reaped, want) {
+		t.Errorf("expected %v to be reaped but found %v", want, reaped)
+	}
+}
@@ -4,14 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/docker/machine/drivers/google"
 	"github.com/docker/machine/libmachine"
 	"github.com/gofn/gofn/iaas"
-	"github.com/gofrs/uuid"
+	"github.com/gofn/gofn/internal/names"
 )
 
 // Provider definition, represents a concrete implementation of an iaas
@@ -28,15 +28,17 @@ type driverConfig struct {
 	} `json:"Driver"`
 }
 
-func getConfig(machineDir, hostName string) (config *driverConfig, err error) {
-	configPath := fmt.Sprintf("%s/%s/config.json", machineDir, hostName)
-	raw, err := ioutil.ReadFile(configPath)
-	if err != nil {
+// loadConfig waits for the config.json of the created machine to have its IP
+func loadConfig(machineDir, hostName string, wait time.Duration) (config *driverConfig, err error) {
+	config = &driverConfig{}
+	err = iaas.LoadMachineConfig(machineDir, hostName, wait, config, func() (missing []string) {
+		if config.Driver.IPAddress == "" {
+			missing = append(missing, "IPAddress")
+		}
 		return
-	}
-	err = json.Unmarshal(raw, &config)
+	})
 	if err != nil {
-		return
+		config = nil
 	}
 	return
 }
@@ -54,13 +56,7 @@ func New(projectID string, opts ...iaas.ProviderOpts) (p *Provider, err error) {
 			return
 		}
 	}
-	var uid uuid.UUID
-	uid, err = uuid.NewV4()
-	if err != nil {
-		p = nil
-		return
-	}
-	name := fmt.Sprintf("gofn-%s", uid.String())
+	name := fmt.Sprintf("gofn-%s", names.ID())
 	if p.Name == "" {
 		p.Name = name
 	}
@@ -104,7 +100,7 @@ func (p *Provider) CreateMachine() (machine *iaas.Machine, err error) {
 	if err != nil {
 		return
 	}
-	config, err := getConfig(p.Client.GetMachinesDir(), p.Name)
+	config, err := loadConfig(p.Client.GetMachinesDir(), p.Name, p.ConfigWait)
 	if err != nil {
 		return
 	}
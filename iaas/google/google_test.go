@@ -6,6 +6,7 @@ import (
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/docker/machine/drivers/fakedriver"
 	"github.com/docker/machine/libmachine"
@@ -13,7 +14,7 @@ import (
 	"github.com/docker/machine/libmachine/libmachinetest"
 )
 
-func Test_getConfig(t *testing.T) {
+func Test_loadConfig(t *testing.T) {
 	type args struct {
 		machineDir string
 		hostName   string
@@ -41,13 +42,13 @@ func Test_getConfig(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotConfig, err := getConfig(tt.args.machineDir, tt.args.hostName)
+			gotConfig, err := loadConfig(tt.args.machineDir, tt.args.hostName, time.Millisecond)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("getConfig() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("loadConfig() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if !reflect.DeepEqual(gotConfig, tt.wantConfig) {
-				t.Errorf("getConfig() = %#v, want %v", gotConfig, tt.wantConfig)
+				t.Errorf("loadConfig() = %#v, want %v", gotConfig, tt.wantConfig)
 			}
 		})
 	}
@@ -113,6 +114,7 @@ func TestCreateMachine(t *testing.T) {
 			Host:   &host.Host{
 				Driver: &fakedriver.Driver{},
 			},
+			ConfigWait: time.Millisecond,
 		},
 	}
 	_, err = p.CreateMachine()
@@ -1,6 +1,8 @@
 package iaas
 
 import (
+	"time"
+
 	"github.com/docker/machine/libmachine"
 	"github.com/docker/machine/libmachine/host"
 )
@@ -21,6 +23,14 @@ type Machine struct {
 	Kind      string `json:"kind"`
 	SSHKeysID []int  `json:"ssh_keys_id"`
 	CertsDir  string `json:"certs_dir"`
+	// SSHUser, SSHPort and SSHKeyPath give access to the machine over SSH
+	SSHUser    string `json:"ssh_user,omitempty"`
+	SSHPort    int    `json:"ssh_port,omitempty"`
+	SSHKeyPath string `json:"ssh_key_path,omitempty"`
+	// PrivateIP is the address of the machine on the private network of its datacenter, e.g. a VPC
+	PrivateIP string `json:"private_ip,omitempty"`
+	// PreferPrivateIP makes Address return PrivateIP when this host shares the private network
+	PreferPrivateIP bool `json:"prefer_private_ip,omitempty"`
 }
 
 // Provider for gofn
@@ -35,6 +45,14 @@ type Provider struct {
 	KeyID      int
 	DiskSize   int
 	Reused     bool
+	Catalog    *ImageCatalog
+	SSHKeyPath string
+	// PrivateNetworking enables the private interface of the machines
+	PrivateNetworking bool
+	// PreferPrivateIP reaches the machines at their private IP when this host shares their private network
+	PreferPrivateIP bool
+	// ConfigWait bounds the wait for the config.json of a created machine, DefaultConfigWait when zero
+	ConfigWait time.Duration
 }
 
 // ProviderOpts override defaults
@@ -96,6 +114,38 @@ func WithClientPath(path string) ProviderOpts {
 	}
 }
 
+// WithImageCatalog func
+func WithImageCatalog(catalog *ImageCatalog) ProviderOpts {
+	return func(p *Provider) error {
+		p.Catalog = catalog
+		return nil
+	}
+}
+
+// WithSSHKeyPath func
+func WithSSHKeyPath(path string) ProviderOpts {
+	return func(p *Provider) error {
+		p.SSHKeyPath = path
+		return nil
+	}
+}
+
+// WithPrivateNetworking func
+func WithPrivateNetworking() ProviderOpts {
+	return func(p *Provider) error {
+		p.PrivateNetworking = true
+		return nil
+	}
+}
+
+// WithPreferPrivateIP func
+func WithPreferPrivateIP() ProviderOpts {
+	return func(p *Provider) error {
+		p.PreferPrivateIP = true
+		return nil
+	}
+}
+
 // IsReused func
 func IsReused(reused bool) ProviderOpts {
 	return func(p *Provider) error {
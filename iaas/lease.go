@@ -0,0 +1,236 @@
+package iaas
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultLeaseGrace is the clock skew tolerated between the machines renewing and reaping leases
+const DefaultLeaseGrace = 5 * time.Minute
+
+// ErrLeaseManagerStopped is raised when a machine is created through a stopped LeaseManager
+var ErrLeaseManagerStopped = errors.New("iaas: lease manager stopped")
+
+// Leaser stores the leases of machines in the provider, e.g. as tags, so they
+// outlive the process that created them
+type Leaser interface {
+	// SetLease makes the lease of a machine expire at expiry, marking it as leased
+	SetLease(machineID string, expiry time.Time) error
+	// Leases returns the expiry of the leased machines, machines never leased are not listed
+	Leases() (map[string]time.Time, error)
+	// DeleteLeased deletes a leased machine, deleting a machine that is already gone succeeds
+	DeleteLeased(machineID string) error
+}
+
+// LeaseManager keeps alive the leases of the machines it creates, when the process
+// dies the leases expire and ReapExpired deletes the machines
+type LeaseManager struct {
+	Leaser Leaser
+	// TTL is how long a lease lasts without renewal
+	TTL time.Duration
+	// OnError receives the renewal errors of the background loop
+	OnError func(machineID string, err error)
+
+	now     func() time.Time
+	mu      sync.Mutex
+	leases  map[string]time.Time
+	stop    chan struct{}
+	done    chan struct{}
+	stopped bool
+	// renewErr and renewedAt are the outcome of the last Renew
+	renewErr  error
+	renewedAt time.Time
+}
+
+// LeaseStats is a snapshot of the machines of a LeaseManager, see LeaseManager.Stats
+type LeaseStats struct {
+	// Leased is the number of managed machines
+	Leased int
+	// NextExpiry is the earliest expiry of their leases, zero without machines
+	NextExpiry time.Time
+	// LastRenewError is the first error of the last Renew, empty when it succeeded
+	LastRenewError string
+	// LastRenewAt is when the last Renew ended, zero before the first one
+	LastRenewAt time.Time
+}
+
+// NewLeaseManager returns a manager of leases lasting ttl stored by leaser
+func NewLeaseManager(leaser Leaser, ttl time.Duration) *LeaseManager {
+	return &LeaseManager{
+		Leaser: leaser,
+		TTL:    ttl,
+		now:    time.Now,
+		leases: make(map[string]time.Time),
+	}
+}
+
+// CreateMachine creates a machine with service and leases it, a machine that can not
+// be leased is deleted so no machine is left without a lease
+func (m *LeaseManager) CreateMachine(service Iaas) (machine *Machine, err error) {
+	m.mu.Lock()
+	stopped := m.stopped
+	m.mu.Unlock()
+	if stopped {
+		err = ErrLeaseManagerStopped
+		return
+	}
+	machine, err = service.CreateMachine()
+	if err != nil {
+		return
+	}
+	err = m.renew(machine.ID)
+	if err != nil {
+		_ = service.DeleteMachine()
+		machine = nil
+	}
+	return
+}
+
+// Release stops renewing the lease of a machine, e.g. once it was deleted
+func (m *LeaseManager) Release(machineID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.leases, machineID)
+}
+
+// Leased returns the expiry of the leases of the managed machines as last renewed
+func (m *LeaseManager) Leased() map[string]time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	leased := make(map[string]time.Time, len(m.leases))
+	for id, expiry := range m.leases {
+		leased[id] = expiry
+	}
+	return leased
+}
+
+// Stats returns the state of the managed machines, taken under the lock of the manager
+func (m *LeaseManager) Stats() (stats LeaseStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats.Leased = len(m.leases)
+	for _, expiry := range m.leases {
+		if stats.NextExpiry.IsZero() || expiry.Before(stats.NextExpiry) {
+			stats.NextExpiry = expiry
+		}
+	}
+	if m.renewErr != nil {
+		stats.LastRenewError = m.renewErr.Error()
+	}
+	stats.LastRenewAt = m.renewedAt
+	return
+}
+
+// Renew extends the leases of all the managed machines by TTL, it returns the first error
+// after trying every machine
+func (m *LeaseManager) Renew() (err error) {
+	m.mu.Lock()
+	ids := make([]string, 0, len(m.leases))
+	for id := range m.leases {
+		ids = append(ids, id)
+	}
+	m.mu.Unlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		if renewErr := m.renew(id); renewErr != nil {
+			if m.OnError != nil {
+				m.OnError(id, renewErr)
+			}
+			if err == nil {
+				err = renewErr
+			}
+		}
+	}
+	m.mu.Lock()
+	m.renewErr, m.renewedAt = err, m.now()
+	m.mu.Unlock()
+	return
+}
+
+// renew extends a lease, a lease is never shortened even when the clock went backwards
+func (m *LeaseManager) renew(machineID string) (err error) {
+	expiry := m.now().Add(m.TTL)
+	m.mu.Lock()
+	if previous, ok := m.leases[machineID]; ok && previous.After(expiry) {
+		expiry = previous
+	}
+	m.mu.Unlock()
+	err = m.Leaser.SetLease(machineID, expiry)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	m.leases[machineID] = expiry
+	m.mu.Unlock()
+	return
+}
+
+// Start renews the leases every interval until Stop, TTL/3 when interval is zero
+func (m *LeaseManager) Start(interval time.Duration) {
+	if interval <= 0 {
+		interval = m.TTL / 3
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil || m.stopped {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_ = m.Renew()
+			}
+		}
+	}(m.stop, m.done)
+}
+
+// Stop ends the renewals, the leases of the machines left expire after TTL
+func (m *LeaseManager) Stop() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop = nil
+	m.stopped = true
+	m.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// ReapExpired deletes the leased machines whose lease expired more than grace before now,
+// it returns the IDs of the deleted machines and the first error after trying every machine.
+// Machines that were never leased are not touched.
+func ReapExpired(leaser Leaser, now time.Time, grace time.Duration) (reaped []string, err error) {
+	leases, err := leaser.Leases()
+	if err != nil {
+		return
+	}
+	ids := make([]string, 0, len(leases))
+	for id := range leases {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if !now.After(leases[id].Add(grace)) {
+			continue
+		}
+		if deleteErr := leaser.DeleteLeased(id); deleteErr != nil {
+			if err == nil {
+				err = deleteErr
+			}
+			continue
+		}
+		reaped = append(reaped, id)
+	}
+	return
+}
@@ -0,0 +1,247 @@
+package iaas
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memLeaser keeps the leases of machines in memory
+type memLeaser struct {
+	mu       sync.Mutex
+	machines map[string]bool
+	leases   map[string]time.Time
+	deleted  []string
+	setErr   error
+}
+
+func newMemLeaser(machines ...string) *memLeaser {
+	l := &memLeaser{machines: make(map[string]bool), leases: make(map[string]time.Time)}
+	for _, id := range machines {
+		l.machines[id] = true
+	}
+	return l
+}
+
+func (l *memLeaser) SetLease(machineID string, expiry time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.setErr != nil {
+		return l.setErr
+	}
+	l.leases[machineID] = expiry
+	return nil
+}
+
+func (l *memLeaser) Leases() (map[string]time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	leases := make(map[string]time.Time)
+	for id, expiry := range l.leases {
+		leases[id] = expiry
+	}
+	return leases, nil
+}
+
+func (l *memLeaser) DeleteLeased(machineID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.machines, machineID)
+	delete(l.leases, machineID)
+	l.deleted = append(l.deleted, machineID)
+	return nil
+}
+
+func (l *memLeaser) lease(machineID string) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leases[machineID]
+}
+
+type fakeIaas struct {
+	leaser  *memLeaser
+	id      string
+	deleted bool
+}
+
+func (f *fakeIaas) CreateMachine() (*Machine, error) {
+	f.leaser.mu.Lock()
+	f.leaser.machines[f.id] = true
+	f.leaser.mu.Unlock()
+	return &Machine{ID: f.id}, nil
+}
+
+func (f *fakeIaas) DeleteMachine() error {
+	f.deleted = true
+	return nil
+}
+
+// fakeClock is a clock moved by the tests
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
+
+func TestLeaseManagerRenewal(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clock := &fakeClock{t: start}
+	leaser := newMemLeaser()
+	m := NewLeaseManager(leaser, time.Hour)
+	m.now = clock.now
+
+	machine, err := m.CreateMachine(&fakeIaas{leaser: leaser, id: "1"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if expiry := leaser.lease(machine.ID); !expiry.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected the lease to expire at %v but found %v", start.Add(time.Hour), expiry)
+	}
+
+	clock.set(start.Add(20 * time.Minute))
+	if err = m.Renew(); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if expiry := leaser.lease("1"); !expiry.Equal(start.Add(80 * time.Minute)) {
+		t.Errorf("expected the lease to be renewed to %v but found %v", start.Add(80*time.Minute), expiry)
+	}
+
+	// a clock going backwards does not shorten the lease
+	clock.set(start)
+	if err = m.Renew(); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if expiry := leaser.lease("1"); !expiry.Equal(start.Add(80 * time.Minute)) {
+		t.Errorf("expected the lease to be kept at %v but found %v", start.Add(80*time.Minute), expiry)
+	}
+	if leased := m.Leased(); len(leased) != 1 || !leased["1"].Equal(start.Add(80*time.Minute)) {
+		t.Errorf("unexpected leased machines %v", leased)
+	}
+
+	m.Release("1")
+	clock.set(start.Add(time.Hour))
+	_ = m.Renew()
+	if expiry := leaser.lease("1"); !expiry.Equal(start.Add(80 * time.Minute)) {
+		t.Errorf("expected a released lease not to be renewed but found %v", expiry)
+	}
+}
+
+func TestLeaseManagerBackgroundRenewal(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clock := &fakeClock{t: start}
+	leaser := newMemLeaser()
+	m := NewLeaseManager(leaser, time.Hour)
+	m.now = clock.now
+	if _, err := m.CreateMachine(&fakeIaas{leaser: leaser, id: "1"}); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	clock.set(start.Add(time.Minute))
+	m.Start(time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for !leaser.lease("1").Equal(start.Add(61*time.Minute)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	m.Stop()
+	if expiry := leaser.lease("1"); !expiry.Equal(start.Add(61 * time.Minute)) {
+		t.Errorf("expected the lease to be renewed in background but found %v", expiry)
+	}
+	if _, err := m.CreateMachine(&fakeIaas{leaser: leaser, id: "2"}); err != ErrLeaseManagerStopped {
+		t.Errorf("expected ErrLeaseManagerStopped but found %v", err)
+	}
+}
+
+func TestLeaseManagerDeletesUnleasedMachine(t *testing.T) {
+	leaser := newMemLeaser()
+	leaser.setErr = errors.New("tags unavailable")
+	service := &fakeIaas{leaser: leaser, id: "1"}
+
+	machine, err := NewLeaseManager(leaser, time.Hour).CreateMachine(service)
+	if err != leaser.setErr {
+		t.Errorf("expected the lease error but found %v", err)
+	}
+	if machine != nil || !service.deleted {
+		t.Error("expected the machine without lease to be deleted")
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	leaser := newMemLeaser("expired", "skewed", "alive", "unmanaged")
+	leaser.leases["expired"] = now.Add(-time.Hour)
+	leaser.leases["skewed"] = now.Add(-time.Minute)
+	leaser.leases["alive"] = now.Add(time.Minute)
+
+	reaped, err := ReapExpired(leaser, now, DefaultLeaseGrace)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if want := []string{"expired"}; !reflect.DeepEqual(reaped, want) {
+		t.Errorf("expected %v to be reaped but found %v", want, reaped)
+	}
+
+	reaped, err = ReapExpired(leaser, now.Add(time.Hour), DefaultLeaseGrace)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if want := []string{"alive", "skewed"}; !reflect.DeepEqual(reaped, want) {
+		t.Errorf("expected %v to be reaped but found %v", want, reaped)
+	}
+	if !leaser.machines["unmanaged"] {
+		t.Error("expected the machine created without the manager to be kept")
+	}
+}
+
+func TestLeaseManagerStats(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clock := &fakeClock{t: start}
+	leaser := newMemLeaser()
+	m := NewLeaseManager(leaser, time.Hour)
+	m.now = clock.now
+	if stats := m.Stats(); stats != (LeaseStats{}) {
+		t.Errorf("expected no machines but found %+v", stats)
+	}
+
+	for i, id := range []string{"1", "2"} {
+		clock.set(start.Add(time.Duration(i) * time.Minute))
+		if _, err := m.CreateMachine(&fakeIaas{leaser: leaser, id: id}); err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+	}
+	want := LeaseStats{Leased: 2, NextExpiry: start.Add(time.Hour)}
+	if stats := m.Stats(); stats != want {
+		t.Errorf("expected %+v but found %+v", want, stats)
+	}
+
+	clock.set(start.Add(10 * time.Minute))
+	leaser.mu.Lock()
+	leaser.setErr = errors.New("rate limited")
+	leaser.mu.Unlock()
+	_ = m.Renew()
+	want = LeaseStats{Leased: 2, NextExpiry: start.Add(time.Hour), LastRenewError: "rate limited", LastRenewAt: start.Add(10 * time.Minute)}
+	if stats := m.Stats(); stats != want {
+		t.Errorf("expected %+v but found %+v", want, stats)
+	}
+
+	leaser.mu.Lock()
+	leaser.setErr = nil
+	leaser.mu.Unlock()
+	_ = m.Renew()
+	m.Release("2")
+	want = LeaseStats{Leased: 1, NextExpiry: start.Add(70 * time.Minute), LastRenewAt: start.Add(10 * time.Minute)}
+	if stats := m.Stats(); stats != want {
+		t.Errorf("expected %+v but found %+v", want, stats)
+	}
+}
@@ -0,0 +1,220 @@
+package iaas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+// DefaultPercentile is the percentile of the usage a recommended size must hold
+const DefaultPercentile = 0.95
+
+// ErrSizeNotInCatalog is raised when the current size of RecommendOptions is not offered by the provider
+var ErrSizeNotInCatalog = errors.New("iaas: the current size is not in the size catalog")
+
+// Size is a machine size offered by a provider
+type Size struct {
+	Slug string `json:"slug"`
+	// Memory is in bytes
+	Memory       int64   `json:"memory"`
+	VCPUs        int     `json:"vcpus"`
+	PriceMonthly float64 `json:"price_monthly"`
+}
+
+// SizeLister lists the sizes a provider currently offers
+type SizeLister interface {
+	ListSizes() ([]Size, error)
+}
+
+// SizeTable is a SizeLister of a static list of sizes
+type SizeTable []Size
+
+// ListSizes implements SizeLister
+func (t SizeTable) ListSizes() ([]Size, error) {
+	return t, nil
+}
+
+// UsageSample is the resource usage of a run of a function image
+type UsageSample struct {
+	Image string
+	// PeakMemory is in bytes
+	PeakMemory int64
+	CPUTime    time.Duration
+	Duration   time.Duration
+}
+
+// UsageSource lists the usage samples recommendations are based on, e.g. provision.HistoryUsage
+type UsageSource interface {
+	Usage() ([]UsageSample, error)
+}
+
+// UsageSourceFunc is a function used as a UsageSource
+type UsageSourceFunc func() ([]UsageSample, error)
+
+// Usage implements UsageSource
+func (f UsageSourceFunc) Usage() ([]UsageSample, error) {
+	return f()
+}
+
+// RecommendOptions tune RecommendSizes
+type RecommendOptions struct {
+	// CurrentSize is the slug of the size the functions run on, the savings are estimated
+	// against its price. No savings are estimated when empty.
+	CurrentSize string
+	// Headroom is the fraction of the usage added on top of it, e.g. 0.2 for 20%, none when zero
+	Headroom float64
+	// Percentile is the fraction of the runs whose usage fits the recommended size, DefaultPercentile when zero
+	Percentile float64
+}
+
+// SizeRecommendation is the size recommended for the runs of an image
+type SizeRecommendation struct {
+	Image string `json:"image"`
+	Runs  int    `json:"runs"`
+	// PeakMemory is the percentile of the peak memory of the runs, in bytes
+	PeakMemory int64 `json:"peak_memory"`
+	// RequiredMemory is PeakMemory with the headroom, in bytes
+	RequiredMemory int64 `json:"required_memory"`
+	// CPUCores is the percentile of the average cores used by the runs, with the headroom
+	CPUCores float64 `json:"cpu_cores"`
+	// Size is the cheapest size holding the required memory and cores, empty when no size fits
+	Size string `json:"size"`
+	// MonthlySavings is the price of the current size minus the one of Size, it is negative
+	// when the current size is too small
+	MonthlySavings float64 `json:"monthly_savings"`
+}
+
+// SizeReport is the outcome of RecommendSizes
+type SizeReport struct {
+	CurrentSize     string               `json:"current_size,omitempty"`
+	Percentile      float64              `json:"percentile"`
+	Headroom        float64              `json:"headroom"`
+	Recommendations []SizeRecommendation `json:"recommendations"`
+}
+
+// WriteJSON writes the report as indented JSON
+func (r SizeReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteTable writes the report as an aligned table, one image per line
+func (r SizeReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "IMAGE\tRUNS\tP%g MEMORY\tREQUIRED\tCPU\tSIZE\tMONTHLY SAVINGS\n", r.Percentile*100)
+	for _, rec := range r.Recommendations {
+		size := rec.Size
+		if size == "" {
+			size = "none fits"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%.2f\t%s\t%.2f\n", rec.Image, rec.Runs,
+			units.BytesSize(float64(rec.PeakMemory)), units.BytesSize(float64(rec.RequiredMemory)),
+			rec.CPUCores, size, rec.MonthlySavings)
+	}
+	return tw.Flush()
+}
+
+// RecommendSizes recommends for each image of history the cheapest size of catalog holding the
+// percentile of its peak memory and CPU usage with the headroom of opts
+func RecommendSizes(history UsageSource, catalog SizeLister, opts RecommendOptions) (report SizeReport, err error) {
+	p := opts.Percentile
+	if p <= 0 {
+		p = DefaultPercentile
+	}
+	report = SizeReport{CurrentSize: opts.CurrentSize, Percentile: p, Headroom: opts.Headroom}
+	sizes, err := catalog.ListSizes()
+	if err != nil {
+		return
+	}
+	var current *Size
+	if opts.CurrentSize != "" {
+		for i := range sizes {
+			if sizes[i].Slug == opts.CurrentSize {
+				current = &sizes[i]
+				break
+			}
+		}
+		if current == nil {
+			err = ErrSizeNotInCatalog
+			return
+		}
+	}
+	samples, err := history.Usage()
+	if err != nil {
+		return
+	}
+	memory := make(map[string][]float64)
+	cores := make(map[string][]float64)
+	for _, sample := range samples {
+		memory[sample.Image] = append(memory[sample.Image], float64(sample.PeakMemory))
+		var used float64
+		if sample.Duration > 0 {
+			used = float64(sample.CPUTime) / float64(sample.Duration)
+		}
+		cores[sample.Image] = append(cores[sample.Image], used)
+	}
+	for image := range memory {
+		peak := int64(percentile(memory[image], p))
+		rec := SizeRecommendation{
+			Image:          image,
+			Runs:           len(memory[image]),
+			PeakMemory:     peak,
+			RequiredMemory: int64(math.Ceil(float64(peak) * (1 + opts.Headroom))),
+			CPUCores:       percentile(cores[image], p) * (1 + opts.Headroom),
+		}
+		if size := smallestSize(sizes, rec.RequiredMemory, rec.CPUCores); size != nil {
+			rec.Size = size.Slug
+			if current != nil {
+				rec.MonthlySavings = current.PriceMonthly - size.PriceMonthly
+			}
+		}
+		report.Recommendations = append(report.Recommendations, rec)
+	}
+	sort.Slice(report.Recommendations, func(i, j int) bool {
+		return report.Recommendations[i].Image < report.Recommendations[j].Image
+	})
+	return
+}
+
+// smallestSize returns the cheapest of sizes holding memory and cores, the one with the least
+// memory among the same price, nil when none does
+func smallestSize(sizes []Size, memory int64, cores float64) (best *Size) {
+	for i := range sizes {
+		size := &sizes[i]
+		if size.Memory < memory || float64(size.VCPUs) < cores {
+			continue
+		}
+		if best == nil || size.PriceMonthly < best.PriceMonthly ||
+			(size.PriceMonthly == best.PriceMonthly && size.Memory < best.Memory) {
+			best = size
+		}
+	}
+	return
+}
+
+// percentile returns the nearest-rank percentile p of values, the smallest value greater than
+// or equal to the fraction p of them, 0 without values
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	// the epsilon keeps a rank like 0.95*20 from being rounded up by the float error
+	rank := int(math.Ceil(p*float64(len(sorted))-1e-9)) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,150 @@
+package iaas
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mb = 1 << 20
+
+var testSizes = SizeTable{
+	{Slug: "small", Memory: 512 * mb, VCPUs: 1, PriceMonthly: 4},
+	{Slug: "medium", Memory: 1024 * mb, VCPUs: 1, PriceMonthly: 6},
+	{Slug: "medium-cpu", Memory: 1024 * mb, VCPUs: 2, PriceMonthly: 9},
+	{Slug: "large", Memory: 2048 * mb, VCPUs: 2, PriceMonthly: 18},
+}
+
+// samples returns a run of image for each peak memory in megabytes, each using half a core
+func samples(image string, peaks ...int64) (usage []UsageSample) {
+	for _, peak := range peaks {
+		usage = append(usage, UsageSample{Image: image, PeakMemory: peak * mb, CPUTime: time.Second, Duration: 2 * time.Second})
+	}
+	return
+}
+
+func TestPercentile(t *testing.T) {
+	hundred := make([]float64, 100)
+	for i := range hundred {
+		// in reverse order, the percentile sorts them
+		hundred[i] = float64(100 - i)
+	}
+	tests := []struct {
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 0.95, 0},
+		{[]float64{7}, 0.95, 7},
+		{hundred, 0.95, 95},
+		{hundred, 0.5, 50},
+		{hundred, 1, 100},
+		{[]float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}, 0.95, 19},
+		{[]float64{1, 2, 3}, 0.95, 3},
+		{[]float64{1, 2, 3}, 0.01, 1},
+	}
+	for _, test := range tests {
+		if got := percentile(test.values, test.p); got != test.want {
+			t.Errorf("percentile(%v, %g) = %g, want %g", test.values, test.p, got, test.want)
+		}
+	}
+}
+
+func TestRecommendSizes(t *testing.T) {
+	// 19 runs of 300MB and an outlier of 1500MB, the p95 is 300MB
+	bursty := samples("gofn/bursty", 1500)
+	for i := 0; i < 19; i++ {
+		bursty = append(bursty, samples("gofn/bursty", 300)...)
+	}
+	history := append(bursty, samples("gofn/steady", 400, 450, 460)...)
+	history = append(history, samples("gofn/huge", 4096)...)
+	history = append(history, UsageSample{Image: "gofn/busy", PeakMemory: 100 * mb, CPUTime: 3 * time.Second, Duration: 2 * time.Second})
+
+	report, err := RecommendSizes(UsageSourceFunc(func() ([]UsageSample, error) {
+		return history, nil
+	}), testSizes, RecommendOptions{CurrentSize: "large", Headroom: 0.2})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := []SizeRecommendation{
+		{Image: "gofn/bursty", Runs: 20, PeakMemory: 300 * mb, RequiredMemory: 360 * mb, CPUCores: 0.6, Size: "small", MonthlySavings: 14},
+		// 1.5 cores with the headroom need 2 vCPUs
+		{Image: "gofn/busy", Runs: 1, PeakMemory: 100 * mb, RequiredMemory: 120 * mb, CPUCores: 1.8, Size: "medium-cpu", MonthlySavings: 9},
+		{Image: "gofn/huge", Runs: 1, PeakMemory: 4096 * mb, RequiredMemory: 5153960756, CPUCores: 0.6},
+		// 460MB with the headroom no longer fits the small size
+		{Image: "gofn/steady", Runs: 3, PeakMemory: 460 * mb, RequiredMemory: 552 * mb, CPUCores: 0.6, Size: "medium", MonthlySavings: 12},
+	}
+	if len(report.Recommendations) != len(want) {
+		t.Fatalf("expected %d recommendations but found %+v", len(want), report.Recommendations)
+	}
+	for i, rec := range report.Recommendations {
+		// the cores are compared rounded, they are computed in floats
+		if rec.CPUCores-want[i].CPUCores > 1e-9 || want[i].CPUCores-rec.CPUCores > 1e-9 {
+			t.Errorf("%s: expected %g cores but found %g", rec.Image, want[i].CPUCores, rec.CPUCores)
+		}
+		rec.CPUCores = want[i].CPUCores
+		if rec != want[i] {
+			t.Errorf("expected %+v but found %+v", want[i], rec)
+		}
+	}
+
+	var table bytes.Buffer
+	if err = report.WriteTable(&table); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "IMAGE") || !strings.Contains(lines[0], "P95 MEMORY") ||
+		!strings.Contains(lines[3], "none fits") || !strings.Contains(lines[1], "300MiB") || !strings.HasSuffix(lines[1], "14.00") {
+		t.Errorf("unexpected table\n%s", table.String())
+	}
+	var encoded bytes.Buffer
+	if err = report.WriteJSON(&encoded); err != nil {
+		t.Fatal(err)
+	}
+	var decoded SizeReport
+	if err = json.Unmarshal(encoded.Bytes(), &decoded); err != nil || decoded.CurrentSize != "large" || decoded.Percentile != DefaultPercentile || decoded.Recommendations[2].Size != "" {
+		t.Errorf("unexpected JSON report %s: %v", encoded.String(), err)
+	}
+}
+
+func TestRecommendSizesEdgeCases(t *testing.T) {
+	history := UsageSourceFunc(func() ([]UsageSample, error) {
+		return samples("gofn/a", 512), nil
+	})
+	// a peak of exactly the memory of a size fits it, the headroom then pushes it out
+	report, err := RecommendSizes(history, testSizes, RecommendOptions{})
+	if err != nil || report.Recommendations[0].Size != "small" || report.Recommendations[0].MonthlySavings != 0 {
+		t.Errorf("expected the small size without savings but found %+v and %v", report, err)
+	}
+	report, err = RecommendSizes(history, testSizes, RecommendOptions{Headroom: 0.01, CurrentSize: "small"})
+	if err != nil || report.Recommendations[0].Size != "medium" || report.Recommendations[0].MonthlySavings != -2 {
+		t.Errorf("expected the medium size to cost 2 more but found %+v and %v", report, err)
+	}
+	// no size at all
+	report, err = RecommendSizes(history, SizeTable{}, RecommendOptions{})
+	if err != nil || len(report.Recommendations) != 1 || report.Recommendations[0].Size != "" {
+		t.Errorf("expected no size to fit but found %+v and %v", report, err)
+	}
+	// no runs
+	report, err = RecommendSizes(UsageSourceFunc(func() ([]UsageSample, error) {
+		return nil, nil
+	}), testSizes, RecommendOptions{})
+	if err != nil || len(report.Recommendations) != 0 {
+		t.Errorf("expected no recommendations but found %+v and %v", report, err)
+	}
+
+	_, err = RecommendSizes(history, testSizes, RecommendOptions{CurrentSize: "retired"})
+	if err != ErrSizeNotInCatalog {
+		t.Errorf("expected %q but found %v", ErrSizeNotInCatalog, err)
+	}
+	failure := errors.New("history unavailable")
+	_, err = RecommendSizes(UsageSourceFunc(func() ([]UsageSample, error) {
+		return nil, failure
+	}), testSizes, RecommendOptions{})
+	if err != failure {
+		t.Errorf("expected %q but found %v", failure, err)
+	}
+}
@@ -0,0 +1,123 @@
+package iaas
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrSSHKeyMissing is returned when a key file does not exist or can not be read
+	ErrSSHKeyMissing = errors.New("iaas: ssh key missing")
+	// ErrSSHKeyMalformed is returned when a key file can not be parsed
+	ErrSSHKeyMalformed = errors.New("iaas: ssh key malformed")
+	// ErrSSHKeyMismatch is returned when the public key does not belong to the private key
+	ErrSSHKeyMismatch = errors.New("iaas: ssh public key does not match the private key")
+)
+
+// sshKeyBits is the size of the keys generated by EnsureKeys
+const sshKeyBits = 2048
+
+// SSHKeyError reports an unusable key file, Err is one of the ErrSSHKey* errors
+type SSHKeyError struct {
+	Path  string
+	Err   error
+	Cause error
+}
+
+func (e *SSHKeyError) Error() string {
+	msg := fmt.Sprintf("%v: %s", e.Err, e.Path)
+	if e.Cause != nil {
+		msg += fmt.Sprintf(" (%v)", e.Cause)
+	}
+	return msg + "; remove the key pair and call iaas.EnsureKeys to generate a new one"
+}
+
+// Unwrap returns the ErrSSHKey* error
+func (e *SSHKeyError) Unwrap() error {
+	return e.Err
+}
+
+// GetSSHPublicKeyPath returns the public key paired with SSHKeyPath
+func (p *Provider) GetSSHPublicKeyPath() string {
+	return p.SSHKeyPath + ".pub"
+}
+
+// CheckSSHKeys verifies that the public key next to privateKeyPath is readable,
+// in authorized_keys format and, when the private key exists, belongs to it
+func CheckSSHKeys(privateKeyPath string) (err error) {
+	publicKeyPath := privateKeyPath + ".pub"
+	raw, err := ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		err = &SSHKeyError{Path: publicKeyPath, Err: ErrSSHKeyMissing, Cause: err}
+		return
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(raw)
+	if err != nil {
+		err = &SSHKeyError{Path: publicKeyPath, Err: ErrSSHKeyMalformed, Cause: err}
+		return
+	}
+	raw, err = ioutil.ReadFile(privateKeyPath)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		err = &SSHKeyError{Path: privateKeyPath, Err: ErrSSHKeyMissing, Cause: err}
+		return
+	}
+	signer, err := ssh.ParsePrivateKey(raw)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		// encrypted keys can not be matched without the passphrase
+		err = nil
+		return
+	}
+	if err != nil {
+		err = &SSHKeyError{Path: privateKeyPath, Err: ErrSSHKeyMalformed, Cause: err}
+		return
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), publicKey.Marshal()) {
+		err = &SSHKeyError{Path: publicKeyPath, Err: ErrSSHKeyMismatch}
+	}
+	return
+}
+
+// EnsureKeys generates a RSA key pair at privateKeyPath when neither key exists
+func EnsureKeys(privateKeyPath string) (err error) {
+	_, privateErr := os.Stat(privateKeyPath)
+	_, publicErr := os.Stat(privateKeyPath + ".pub")
+	if !os.IsNotExist(privateErr) || !os.IsNotExist(publicErr) {
+		return
+	}
+	key, err := rsa.GenerateKey(rand.Reader, sshKeyBits)
+	if err != nil {
+		return
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(privateKeyPath), 0700)
+	if err != nil {
+		return
+	}
+	privatePEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	err = ioutil.WriteFile(privateKeyPath, privatePEM, 0600)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(privateKeyPath+".pub", ssh.MarshalAuthorizedKey(publicKey), 0644)
+	return
+}
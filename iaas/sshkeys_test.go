@@ -0,0 +1,90 @@
+package iaas
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSSHKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		keyPath  string
+		wantErr  error
+		wantPath string
+	}{
+		{name: "valid pair", keyPath: "testdata/fake_id_rsa"},
+		{name: "missing", keyPath: "testdata/missing_id_rsa", wantErr: ErrSSHKeyMissing, wantPath: "testdata/missing_id_rsa.pub"},
+		{name: "truncated", keyPath: "testdata/truncated_id_rsa", wantErr: ErrSSHKeyMalformed, wantPath: "testdata/truncated_id_rsa.pub"},
+		{name: "mismatched pair", keyPath: "testdata/mismatched_id_rsa", wantErr: ErrSSHKeyMismatch, wantPath: "testdata/mismatched_id_rsa.pub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckSSHKeys(tt.keyPath)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("CheckSSHKeys() error = %v", err)
+				}
+				return
+			}
+			keyErr, ok := err.(*SSHKeyError)
+			if !ok {
+				t.Fatalf("CheckSSHKeys() error = %#v, want *SSHKeyError", err)
+			}
+			if keyErr.Unwrap() != tt.wantErr {
+				t.Errorf("CheckSSHKeys() error = %v, want %v", keyErr.Err, tt.wantErr)
+			}
+			if keyErr.Path != tt.wantPath {
+				t.Errorf("CheckSSHKeys() path = %q, want %q", keyErr.Path, tt.wantPath)
+			}
+			if !strings.Contains(err.Error(), "EnsureKeys") {
+				t.Errorf("CheckSSHKeys() error %q does not offer EnsureKeys", err)
+			}
+		})
+	}
+}
+
+func TestEnsureKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "machine", "id_rsa")
+	err = EnsureKeys(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckSSHKeys(keyPath)
+	if err != nil {
+		t.Fatalf("generated keys are invalid: %v", err)
+	}
+	before, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = EnsureKeys(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Error("EnsureKeys replaced existing keys")
+	}
+}
+
+func TestGetSSHPublicKeyPath(t *testing.T) {
+	p := &Provider{}
+	err := WithSSHKeyPath("/keys/id_rsa")(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.GetSSHPublicKeyPath(); got != "/keys/id_rsa.pub" {
+		t.Errorf("GetSSHPublicKeyPath() = %q", got)
+	}
+}
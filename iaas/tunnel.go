@@ -0,0 +1,278 @@
+package iaas
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	// ErrTunnelClosed is returned by the operations on a closed tunnel
+	ErrTunnelClosed = errors.New("iaas: tunnel closed")
+	// ErrHostKeyRequired is returned by OpenTunnel when no option says how to verify the machine host key
+	ErrHostKeyRequired = errors.New("iaas: tunnel requires a host key callback, known hosts or the insecure mode")
+)
+
+const (
+	// DefaultReconnectInterval is the delay between the reconnection attempts of a tunnel
+	DefaultReconnectInterval = time.Second
+	// DefaultKeepAliveInterval is the delay between the keepalives detecting a dropped tunnel
+	DefaultKeepAliveInterval = 15 * time.Second
+)
+
+// SSHTunnel is a reverse tunnel over SSH: the connections accepted on the machine
+// at the remote bind address are forwarded to a target on this side
+type SSHTunnel struct {
+	machine           *Machine
+	remoteBind        string
+	target            string
+	config            *ssh.ClientConfig
+	reconnectInterval time.Duration
+	keepAliveInterval time.Duration
+
+	mu       sync.Mutex
+	client   *ssh.Client
+	listener net.Listener
+	closed   chan struct{}
+	done     chan struct{}
+	close    sync.Once
+}
+
+// TunnelOpts override the tunnel defaults
+type TunnelOpts func(*SSHTunnel) error
+
+// WithHostKeyCallback verifies the machine host key with callback
+func WithHostKeyCallback(callback ssh.HostKeyCallback) TunnelOpts {
+	return func(t *SSHTunnel) error {
+		t.config.HostKeyCallback = callback
+		return nil
+	}
+}
+
+// WithKnownHosts verifies the machine host key against the given known_hosts files
+func WithKnownHosts(files ...string) TunnelOpts {
+	return func(t *SSHTunnel) (err error) {
+		t.config.HostKeyCallback, err = knownhosts.New(files...)
+		return
+	}
+}
+
+// WithInsecureIgnoreHostKey accepts any machine host key as docker-machine does, the tunnel
+// is then open to a man in the middle
+func WithInsecureIgnoreHostKey() TunnelOpts {
+	return func(t *SSHTunnel) error {
+		t.config.HostKeyCallback = ssh.InsecureIgnoreHostKey() // nolint: gosec
+		return nil
+	}
+}
+
+// WithReconnectInterval func
+func WithReconnectInterval(interval time.Duration) TunnelOpts {
+	return func(t *SSHTunnel) error {
+		t.reconnectInterval = interval
+		return nil
+	}
+}
+
+// WithKeepAliveInterval func
+func WithKeepAliveInterval(interval time.Duration) TunnelOpts {
+	return func(t *SSHTunnel) error {
+		t.keepAliveInterval = interval
+		return nil
+	}
+}
+
+// OpenTunnel connects to machine over SSH and listens on remoteBind on the machine, e.g.
+// 172.17.0.1:5432 to be reachable from its containers, forwarding every connection to
+// localTarget. The tunnel reconnects when the SSH connection drops until it is closed;
+// remoteBind should have a fixed port so the machine side address survives reconnections.
+// The SSH server only binds the addresses other than loopback, like the docker bridge, when
+// GatewayPorts is set to yes or clientspecified in its sshd_config, otherwise it silently
+// listens on loopback and the containers can not reach the tunnel.
+// One of WithHostKeyCallback, WithKnownHosts or WithInsecureIgnoreHostKey is required,
+// ErrHostKeyRequired is returned without them.
+func OpenTunnel(machine *Machine, remoteBind, localTarget string, opts ...TunnelOpts) (t *SSHTunnel, err error) {
+	key, err := ioutil.ReadFile(machine.SSHKeyPath)
+	if err != nil {
+		err = &SSHKeyError{Path: machine.SSHKeyPath, Err: ErrSSHKeyMissing, Cause: err}
+		return
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		err = &SSHKeyError{Path: machine.SSHKeyPath, Err: ErrSSHKeyMalformed, Cause: err}
+		return
+	}
+	user := machine.SSHUser
+	if user == "" {
+		user = "root"
+	}
+	t = &SSHTunnel{
+		machine:    machine,
+		remoteBind: remoteBind,
+		target:     localTarget,
+		config: &ssh.ClientConfig{
+			User:    user,
+			Auth:    []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			Timeout: 30 * time.Second,
+		},
+		reconnectInterval: DefaultReconnectInterval,
+		keepAliveInterval: DefaultKeepAliveInterval,
+		closed:            make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+	for _, opt := range opts {
+		err = opt(t)
+		if err != nil {
+			t = nil
+			return
+		}
+	}
+	if t.config.HostKeyCallback == nil {
+		t, err = nil, ErrHostKeyRequired
+		return
+	}
+	err = t.connect()
+	if err != nil {
+		t = nil
+		return
+	}
+	go t.serve()
+	return
+}
+
+// Addr returns the machine side address of the tunnel, to be given to the containers
+func (t *SSHTunnel) Addr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listener == nil {
+		return t.remoteBind
+	}
+	return t.listener.Addr().String()
+}
+
+// Close stops forwarding and closes the SSH connection
+func (t *SSHTunnel) Close() (err error) {
+	t.close.Do(func() {
+		close(t.closed)
+		t.mu.Lock()
+		t.disconnect()
+		t.mu.Unlock()
+		<-t.done
+	})
+	return
+}
+
+func (t *SSHTunnel) connect() (err error) {
+	port := t.machine.SSHPort
+	if port == 0 {
+		port = 22
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(t.machine.Address(), strconv.Itoa(port)), t.config)
+	if err != nil {
+		return
+	}
+	listener, err := client.Listen("tcp", t.remoteBind)
+	if err != nil {
+		client.Close()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.closed:
+		listener.Close()
+		client.Close()
+		return ErrTunnelClosed
+	default:
+	}
+	t.client, t.listener = client, listener
+	return
+}
+
+// disconnect closes the current connection, t.mu must be held
+func (t *SSHTunnel) disconnect() {
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	if t.client != nil {
+		t.client.Close()
+	}
+}
+
+// serve forwards the accepted connections and reconnects once the connection drops
+func (t *SSHTunnel) serve() {
+	defer close(t.done)
+	for {
+		t.mu.Lock()
+		client, listener := t.client, t.listener
+		t.mu.Unlock()
+		stopKeepAlive := make(chan struct{})
+		go t.keepAlive(client, stopKeepAlive)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			go t.forward(conn)
+		}
+		close(stopKeepAlive)
+		t.mu.Lock()
+		t.disconnect()
+		t.mu.Unlock()
+		for {
+			select {
+			case <-t.closed:
+				return
+			case <-time.After(t.reconnectInterval):
+			}
+			if err := t.connect(); err == nil {
+				break
+			} else if err == ErrTunnelClosed {
+				return
+			}
+		}
+	}
+}
+
+// keepAlive closes client when it stops answering, which ends the accept loop
+func (t *SSHTunnel) keepAlive(client *ssh.Client, stop chan struct{}) {
+	ticker := time.NewTicker(t.keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+func (t *SSHTunnel) forward(remote net.Conn) {
+	defer remote.Close()
+	local, err := net.DialTimeout("tcp", t.target, t.config.Timeout)
+	if err != nil {
+		return
+	}
+	defer local.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,351 @@
+package iaas
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshServer is an in-process SSH server accepting remote forwards for one key
+type sshServer struct {
+	t        *testing.T
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+
+	mu        sync.Mutex
+	conns     []ssh.Conn
+	forwards  []net.Listener
+	accepting bool
+}
+
+func newSSHServer(t *testing.T, authorizedKey string) *sshServer {
+	raw, err := ioutil.ReadFile(authorizedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, _, _, _, err := ssh.ParseAuthorizedKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sshServer{t: t, hostKey: signer.PublicKey(), accepting: true}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == "root" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	s.config.AddHostKey(signer)
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve()
+	return s
+}
+
+func (s *sshServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *sshServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *sshServer) handle(nConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
+	if err != nil {
+		nConn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+	go ssh.DiscardRequests(nil)
+	go func() {
+		for ch := range chans {
+			_ = ch.Reject(ssh.Prohibited, "only remote forwards")
+		}
+	}()
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			s.forward(conn, req)
+		default:
+			if req.WantReply {
+				_ = req.Reply(req.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}
+}
+
+type forwardRequest struct {
+	Addr string
+	Port uint32
+}
+
+type forwardedChannel struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+func (s *sshServer) forward(conn ssh.Conn, req *ssh.Request) {
+	var fwd forwardRequest
+	if err := ssh.Unmarshal(req.Payload, &fwd); err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(fwd.Addr, strconv.Itoa(int(fwd.Port))))
+	if err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+	s.mu.Lock()
+	s.forwards = append(s.forwards, listener)
+	s.mu.Unlock()
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	_ = req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+	go func() {
+		defer listener.Close()
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer local.Close()
+				payload := ssh.Marshal(forwardedChannel{Addr: fwd.Addr, Port: port, OriginAddr: "127.0.0.1", OriginPort: 1})
+				ch, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+				if err != nil {
+					return
+				}
+				defer ch.Close()
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					_, _ = io.Copy(ch, local)
+					_ = ch.CloseWrite()
+				}()
+				_, _ = io.Copy(local, ch)
+			}()
+		}
+	}()
+}
+
+// drop closes every connection and forward as a network failure would
+func (s *sshServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, listener := range s.forwards {
+		listener.Close()
+	}
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.forwards, s.conns = nil, nil
+}
+
+func (s *sshServer) close() {
+	s.listener.Close()
+	s.drop()
+}
+
+// echoServer answers each line it receives
+func echoServer(t *testing.T) (addr string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func echoThrough(addr, message string) (reply string, err error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Write([]byte(message)); err != nil {
+		return
+	}
+	buf := make([]byte, len(message))
+	_, err = io.ReadFull(conn, buf)
+	reply = string(buf)
+	return
+}
+
+func TestOpenTunnel(t *testing.T) {
+	server := newSSHServer(t, "testdata/fake_id_rsa.pub")
+	defer server.close()
+	target, stop := echoServer(t)
+	defer stop()
+
+	machine := &Machine{IP: "127.0.0.1", SSHPort: server.port(), SSHUser: "root", SSHKeyPath: "testdata/fake_id_rsa"}
+	remoteBind := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	tunnel, err := OpenTunnel(machine, remoteBind, target, WithHostKeyCallback(ssh.FixedHostKey(server.hostKey)),
+		WithReconnectInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if tunnel.Addr() != remoteBind {
+		t.Errorf("expected the tunnel on %s but found %s", remoteBind, tunnel.Addr())
+	}
+	reply, err := echoThrough(tunnel.Addr(), "ping")
+	if err != nil || reply != "ping" {
+		t.Fatalf("expected ping through the tunnel but found %q, %v", reply, err)
+	}
+
+	server.drop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reply, err = echoThrough(tunnel.Addr(), "pong")
+		if err == nil && reply == "pong" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the tunnel to reconnect but found %q, %v", reply, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = tunnel.Close(); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	if err = tunnel.Close(); err != nil {
+		t.Errorf("expected a second Close to succeed but found %v", err)
+	}
+	if _, err = echoThrough(tunnel.Addr(), "gone"); err == nil {
+		t.Error("expected the tunnel to be closed")
+	}
+}
+
+func TestOpenTunnelKeepAlive(t *testing.T) {
+	server := newSSHServer(t, "testdata/fake_id_rsa.pub")
+	defer server.close()
+	target, stop := echoServer(t)
+	defer stop()
+
+	machine := &Machine{IP: "127.0.0.1", SSHPort: server.port(), SSHKeyPath: "testdata/fake_id_rsa"}
+	tunnel, err := OpenTunnel(machine, "127.0.0.1:0", target, WithInsecureIgnoreHostKey(), WithKeepAliveInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer tunnel.Close()
+	time.Sleep(30 * time.Millisecond)
+	if reply, err := echoThrough(tunnel.Addr(), "ping"); err != nil || reply != "ping" {
+		t.Errorf("expected the keepalives to keep the tunnel up but found %q, %v", reply, err)
+	}
+}
+
+func TestOpenTunnelErrors(t *testing.T) {
+	server := newSSHServer(t, "testdata/fake_id_rsa.pub")
+	defer server.close()
+
+	_, err := OpenTunnel(&Machine{IP: "127.0.0.1", SSHPort: server.port(), SSHKeyPath: "testdata/missing"}, "127.0.0.1:0", "127.0.0.1:1")
+	if keyErr, ok := err.(*SSHKeyError); !ok || keyErr.Unwrap() != ErrSSHKeyMissing {
+		t.Errorf("expected ErrSSHKeyMissing but found %v", err)
+	}
+	_, err = OpenTunnel(&Machine{IP: "127.0.0.1", SSHPort: server.port(), SSHKeyPath: "testdata/mismatched_id_rsa"}, "127.0.0.1:0", "127.0.0.1:1",
+		WithInsecureIgnoreHostKey())
+	if err == nil {
+		t.Error("expected the unauthorized key to be refused")
+	}
+
+	machine := &Machine{IP: "127.0.0.1", SSHPort: server.port(), SSHKeyPath: "testdata/fake_id_rsa"}
+	if _, err = OpenTunnel(machine, "127.0.0.1:0", "127.0.0.1:1"); err != ErrHostKeyRequired {
+		t.Errorf("expected ErrHostKeyRequired but found %v", err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(&other.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenTunnel(machine, "127.0.0.1:0", "127.0.0.1:1", WithHostKeyCallback(ssh.FixedHostKey(otherKey))); err == nil {
+		t.Error("expected the unknown host key to be refused")
+	}
+}
+
+func TestOpenTunnelKnownHosts(t *testing.T) {
+	server := newSSHServer(t, "testdata/fake_id_rsa.pub")
+	defer server.close()
+	target, stop := echoServer(t)
+	defer stop()
+
+	knownHosts, err := ioutil.TempFile("", "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(knownHosts.Name())
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(server.port()))
+	if _, err = knownHosts.WriteString(knownhosts.Line([]string{address}, server.hostKey) + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	knownHosts.Close()
+
+	machine := &Machine{IP: "127.0.0.1", SSHPort: server.port(), SSHKeyPath: "testdata/fake_id_rsa"}
+	tunnel, err := OpenTunnel(machine, "127.0.0.1:0", target, WithKnownHosts(knownHosts.Name()))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer tunnel.Close()
+	if reply, err := echoThrough(tunnel.Addr(), "ping"); err != nil || reply != "ping" {
+		t.Errorf("expected ping through the tunnel but found %q, %v", reply, err)
+	}
+
+	if _, err = OpenTunnel(machine, "127.0.0.1:0", target, WithKnownHosts("testdata/missing")); err == nil {
+		t.Error("expected a missing known_hosts file to fail")
+	}
+}
@@ -0,0 +1,84 @@
+// Package names generates the unique part of the names of the containers, networks and machines
+package names
+
+import (
+	"crypto/rand"
+	"io"
+	mathrand "math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/nuveo/log"
+)
+
+// suffixAlphabet are the characters of the random suffix of the fallback IDs, valid in the
+// names of docker and in the host names of the providers
+const suffixAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Generator makes the unique IDs, a random uuid or when the entropy source fails a fallback
+// made of the time, a counter of the process and a short pseudo-random suffix
+type Generator struct {
+	// Entropy is the source of the uuids, crypto/rand when nil
+	Entropy io.Reader
+	// Warn receives the failures of Entropy, the warnings of github.com/nuveo/log when nil
+	Warn func(format string, args ...interface{})
+
+	counter uint64
+	once    sync.Once
+	mu      sync.Mutex
+	rand    *mathrand.Rand
+}
+
+// Default is the Generator of ID
+var Default = &Generator{}
+
+// ID returns a unique ID from Default
+func ID() string {
+	return Default.ID()
+}
+
+// ID returns a random uuid, or the fallback ID when Entropy fails
+func (g *Generator) ID() string {
+	entropy := g.Entropy
+	if entropy == nil {
+		entropy = rand.Reader
+	}
+	var u uuid.UUID
+	_, err := io.ReadFull(entropy, u[:])
+	if err == nil {
+		u.SetVersion(uuid.V4)
+		u.SetVariant(uuid.VariantRFC4122)
+		return u.String()
+	}
+	id := g.fallback()
+	warn := g.Warn
+	if warn == nil {
+		warn = warnf
+	}
+	warn("gofn: unable to generate a uuid, using %s instead: %v", id, err)
+	return id
+}
+
+// warnf logs a warning with github.com/nuveo/log, the logger of gofn
+func warnf(format string, args ...interface{}) {
+	log.Warningf(format+"\n", args...)
+}
+
+// fallback returns <time>-<counter>-<suffix> in base 36, unique within the process by
+// its counter and between processes by its time and suffix
+func (g *Generator) fallback() string {
+	g.once.Do(func() {
+		g.rand = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+	})
+	n := atomic.AddUint64(&g.counter, 1)
+	suffix := make([]byte, 6)
+	g.mu.Lock()
+	for i := range suffix {
+		suffix[i] = suffixAlphabet[g.rand.Intn(len(suffixAlphabet))]
+	}
+	g.mu.Unlock()
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(n, 36) + "-" + string(suffix)
+}
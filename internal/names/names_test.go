@@ -0,0 +1,61 @@
+package names
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+var (
+	uuidPattern     = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	fallbackPattern = regexp.MustCompile(`^[a-z0-9]+-[a-z0-9]+-[a-z0-9]{6}$`)
+)
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("entropy exhausted")
+}
+
+func TestID(t *testing.T) {
+	if id := (&Generator{}).ID(); !uuidPattern.MatchString(id) {
+		t.Errorf("expected a uuid v4 but found %q", id)
+	}
+}
+
+func TestIDFallback(t *testing.T) {
+	var mu sync.Mutex
+	var warnings []string
+	g := &Generator{Entropy: failingReader{}, Warn: func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}}
+	const n = 1000
+	ids := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids <- g.ID()
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	seen := make(map[string]bool, n)
+	for id := range ids {
+		if !fallbackPattern.MatchString(id) || len("gofn-"+id) > 63 {
+			t.Errorf("expected a fallback ID valid in the names of docker and the providers but found %q", id)
+		}
+		if seen[id] {
+			t.Errorf("expected unique IDs but %q was generated twice", id)
+		}
+		seen[id] = true
+	}
+	if len(warnings) != n {
+		t.Errorf("expected a warning per fallback ID but found %d", len(warnings))
+	}
+}
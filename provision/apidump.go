@@ -0,0 +1,432 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DumpBodyLimit is the number of bytes of each body written by the API dump
+const DumpBodyLimit = 2048
+
+const redacted = "[REDACTED]"
+
+var (
+	dumpMu sync.Mutex
+	dumpW  io.Writer
+
+	// redactedHeaders are the request headers carrying credentials
+	redactedHeaders = map[string]bool{
+		"Authorization":     true,
+		"X-Registry-Auth":   true,
+		"X-Registry-Config": true,
+	}
+	// redactedKeys are the JSON keys, in lower case, holding credentials
+	redactedKeys = map[string]bool{
+		"password":      true,
+		"auth":          true,
+		"identitytoken": true,
+		"registrytoken": true,
+	}
+)
+
+// EnableAPIDump makes the clients returned by FnClient write every docker API call to w,
+// a nil w disables the dump for the clients created afterwards
+func EnableAPIDump(w io.Writer) {
+	dumpMu.Lock()
+	defer dumpMu.Unlock()
+	dumpW = w
+}
+
+func apiDumpWriter() io.Writer {
+	dumpMu.Lock()
+	defer dumpMu.Unlock()
+	return dumpW
+}
+
+// DumpAPI makes client write every docker API call to w. Requests and responses are
+// written with their credentials redacted and bodies truncated to DumpBodyLimit,
+// hijacked and streamed connections are summarized when they are closed.
+// Hijacked connections of TLS clients are not dumped.
+func DumpAPI(client *docker.Client, w io.Writer) {
+	d := &apiDumper{w: w}
+	interceptClient(client, func(next http.RoundTripper) http.RoundTripper {
+		return &dumpTransport{dumper: d, next: next}
+	}, func(next docker.Dialer) docker.Dialer {
+		return &dumpDialer{dumper: d, next: next}
+	})
+}
+
+// interceptClient wraps the transport of the requests of client and the dialer of its
+// hijacked connections, the dialer is left alone for TLS clients which do not use it
+func interceptClient(client *docker.Client, transport func(next http.RoundTripper) http.RoundTripper, dialer func(next docker.Dialer) docker.Dialer) {
+	original := client.Dialer
+	if tr, ok := client.HTTPClient.Transport.(*http.Transport); ok && strings.HasPrefix(client.Endpoint(), "unix://") {
+		// the unix transport dials through client.Dialer, keep it on the original dialer
+		// so its connections are not intercepted twice
+		socket := strings.TrimPrefix(client.Endpoint(), "unix://")
+		tr.DialContext = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return original.Dial("unix", socket)
+		}
+	}
+	next := client.HTTPClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	client.HTTPClient.Transport = transport(next)
+	if client.TLSConfig == nil {
+		client.Dialer = dialer(original)
+	}
+}
+
+type apiDumper struct {
+	mu  sync.Mutex
+	w   io.Writer
+	seq uint64
+}
+
+func (d *apiDumper) next() uint64 {
+	return atomic.AddUint64(&d.seq, 1)
+}
+
+func (d *apiDumper) write(entry string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, _ = io.WriteString(d.w, entry)
+}
+
+type dumpTransport struct {
+	dumper *apiDumper
+	next   http.RoundTripper
+}
+
+func (t *dumpTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	id := t.dumper.next()
+	var entry bytes.Buffer
+	fmt.Fprintf(&entry, "--> #%d %s %s\n", id, req.Method, req.URL.RequestURI())
+	writeHeaders(&entry, req.Header)
+	if req.Body != nil && req.Body != http.NoBody {
+		if isJSON(req.Header.Get("Content-Type")) {
+			var body []byte
+			body, err = ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			writeBody(&entry, body, len(body))
+		} else {
+			fmt.Fprintf(&entry, "    [%s body not shown]\n", req.Header.Get("Content-Type"))
+		}
+	}
+	t.dumper.write(entry.String())
+
+	start := time.Now()
+	resp, err = t.next.RoundTrip(req)
+	if err != nil {
+		t.dumper.write(fmt.Sprintf("<-- #%d error: %v\n", id, err))
+		return
+	}
+	resp.Body = &dumpBody{
+		ReadCloser: resp.Body,
+		dumper:     t.dumper,
+		header:     fmt.Sprintf("<-- #%d %s (%s)", id, resp.Status, time.Since(start).Round(time.Microsecond)),
+		show:       isJSON(resp.Header.Get("Content-Type")) || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/"),
+	}
+	return
+}
+
+// dumpBody writes the response entry once the body is drained or closed,
+// so streamed responses are summarized with their total size
+type dumpBody struct {
+	io.ReadCloser
+	dumper *apiDumper
+	header string
+	show   bool
+	head   []byte
+	size   int
+	once   sync.Once
+}
+
+func (b *dumpBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.size += n
+	if missing := DumpBodyLimit - len(b.head); missing > 0 {
+		if missing > n {
+			missing = n
+		}
+		b.head = append(b.head, p[:missing]...)
+	}
+	if err != nil {
+		b.flush()
+	}
+	return
+}
+
+func (b *dumpBody) Close() error {
+	b.flush()
+	return b.ReadCloser.Close()
+}
+
+func (b *dumpBody) flush() {
+	b.once.Do(func() {
+		var entry bytes.Buffer
+		fmt.Fprintf(&entry, "%s %d bytes\n", b.header, b.size)
+		if b.show && b.size > 0 {
+			writeBody(&entry, b.head, b.size)
+		}
+		b.dumper.write(entry.String())
+	})
+}
+
+type dumpDialer struct {
+	dumper *apiDumper
+	next   docker.Dialer
+}
+
+func (d *dumpDialer) Dial(network, address string) (conn net.Conn, err error) {
+	conn, err = d.next.Dial(network, address)
+	if err != nil {
+		return
+	}
+	conn = &dumpConn{Conn: conn, dumper: d.dumper, id: d.dumper.next()}
+	return
+}
+
+// dumpConn summarizes a hijacked or streamed connection: its request line when
+// the request is sent and the bytes exchanged when it is closed
+type dumpConn struct {
+	net.Conn
+	dumper   *apiDumper
+	id       uint64
+	sent     int64
+	received int64
+	started  sync.Once
+	closed   sync.Once
+}
+
+func (c *dumpConn) Write(p []byte) (n int, err error) {
+	c.started.Do(func() {
+		line := string(p)
+		if i := strings.Index(line, "\r\n"); i >= 0 {
+			line = line[:i]
+		}
+		c.dumper.write(fmt.Sprintf("--> #%d %s (stream)\n", c.id, strings.TrimSuffix(line, " HTTP/1.1")))
+	})
+	n, err = c.Conn.Write(p)
+	atomic.AddInt64(&c.sent, int64(n))
+	return
+}
+
+func (c *dumpConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	atomic.AddInt64(&c.received, int64(n))
+	return
+}
+
+// CloseWrite half closes the connection as the attach of stdin expects
+func (c *dumpConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *dumpConn) Close() error {
+	c.closed.Do(func() {
+		c.dumper.write(fmt.Sprintf("<-- #%d stream closed, sent %d bytes, received %d bytes\n",
+			c.id, atomic.LoadInt64(&c.sent), atomic.LoadInt64(&c.received)))
+	})
+	return c.Conn.Close()
+}
+
+func isJSON(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json")
+}
+
+func writeHeaders(w io.Writer, header http.Header) {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value := strings.Join(header[k], ", ")
+		if redactedHeaders[http.CanonicalHeaderKey(k)] {
+			value = redacted
+		}
+		fmt.Fprintf(w, "    %s: %s\n", k, value)
+	}
+}
+
+// writeBody writes the redacted head of a body of size bytes
+func writeBody(w io.Writer, body []byte, size int) {
+	if len(body) > DumpBodyLimit {
+		body = body[:DumpBodyLimit]
+	}
+	fmt.Fprintf(w, "    %s\n", bytes.TrimSpace(redactJSON(body)))
+	if size > len(body) {
+		fmt.Fprintf(w, "    [truncated, %d bytes total]\n", size)
+	}
+}
+
+// redactJSON replaces the credentials of a JSON document, a document that can not be
+// parsed, e.g. a truncated one, has the values of the credential keys replaced in place
+func redactJSON(body []byte) []byte {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err == nil {
+		out, err := json.Marshal(redactValue(doc))
+		if err == nil {
+			return out
+		}
+	}
+	return redactRaw(body)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		redactSecretEnv(v)
+		for k, child := range v {
+			if redactedKeys[strings.ToLower(k)] {
+				v[k] = redacted
+				continue
+			}
+			v[k] = redactValue(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactValue(child)
+		}
+	}
+	return v
+}
+
+// redactSecretEnv redacts the Env entries of a container config named by its LabelSecrets, it
+// reports whether one was redacted
+func redactSecretEnv(config map[string]interface{}) (changed bool) {
+	labels, _ := config["Labels"].(map[string]interface{})
+	names, _ := labels[LabelSecrets].(string)
+	env, _ := config["Env"].([]interface{})
+	if names == "" || len(env) == 0 {
+		return
+	}
+	secret := make(map[string]bool)
+	for _, name := range strings.Fields(names) {
+		secret[name] = true
+	}
+	for i, entry := range env {
+		s, ok := entry.(string)
+		if name := envName(s); ok && secret[name] && s != name+"="+redacted {
+			env[i] = name + "=" + redacted
+			changed = true
+		}
+	}
+	return
+}
+
+// redactSecretsJSON redacts the secret variables of the container configs of a JSON document,
+// the document is returned as is when it has none
+func redactSecretsJSON(body []byte) []byte {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil || !redactSecretConfigs(doc) {
+		return body
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+func redactSecretConfigs(v interface{}) (changed bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		changed = redactSecretEnv(v)
+		for _, child := range v {
+			changed = redactSecretConfigs(child) || changed
+		}
+	case []interface{}:
+		for _, child := range v {
+			changed = redactSecretConfigs(child) || changed
+		}
+	}
+	return
+}
+
+func redactRaw(body []byte) []byte {
+	s := redactRawEnv(string(body))
+	for key := range redactedKeys {
+		lower := strings.ToLower(s)
+		needle := `"` + key + `"`
+		for from := 0; ; {
+			i := strings.Index(lower[from:], needle)
+			if i < 0 {
+				break
+			}
+			start := from + i + len(needle)
+			rest := strings.TrimLeft(s[start:], " :")
+			valueStart := len(s) - len(rest)
+			if !strings.HasPrefix(rest, `"`) {
+				from = valueStart
+				continue
+			}
+			end := strings.Index(rest[1:], `"`)
+			valueEnd := len(s)
+			if end >= 0 {
+				valueEnd = valueStart + end + 2
+			}
+			s = s[:valueStart] + `"` + redacted + `"` + s[valueEnd:]
+			lower = strings.ToLower(s)
+			from = valueStart + len(redacted) + 2
+		}
+	}
+	return []byte(s)
+}
+
+// redactRawEnv redacts the values of the Env entries of a document that can not be parsed,
+// all of them since the LabelSecrets naming the secret ones may be cut off
+func redactRawEnv(s string) string {
+	const key = `"Env":[`
+	for from := 0; ; {
+		i := strings.Index(s[from:], key)
+		if i < 0 {
+			return s
+		}
+		pos := from + i + len(key)
+		for pos < len(s) && s[pos] == '"' {
+			end := pos + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end > len(s) {
+				end = len(s)
+			}
+			entry := `"` + envName(s[pos+1:end]) + "=" + redacted + `"`
+			if end == len(s) {
+				return s[:pos] + entry
+			}
+			s = s[:pos] + entry + s[end+1:]
+			pos += len(entry)
+			if pos < len(s) && s[pos] == ',' {
+				pos++
+			}
+		}
+		from = pos
+	}
+}
@@ -0,0 +1,148 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// syncBuffer is a buffer safe for the concurrent writes of the dump
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDumpAPIScriptedRun(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+
+	var dump syncBuffer
+	client := NewTestClient(server.URL(), t)
+	DumpAPI(client, &dump)
+	r := NewRunner(client)
+	r.OutputStrategy = OutputAttach
+	_, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	out := dump.String()
+	for _, call := range []string{
+		"/build?",
+		"POST /containers/create?name=gofn-",
+		"<-- #",
+		"/start",
+		"/attach?",
+		"(stream)",
+		"stream closed",
+		"/wait",
+		"DELETE /containers/",
+	} {
+		if !strings.Contains(out, call) {
+			t.Errorf("expected the dump to contain %q\n%s", call, out)
+		}
+	}
+	if !strings.Contains(out, "[application/tar body not shown]") {
+		t.Errorf("expected the build context to be summarized\n%s", out)
+	}
+}
+
+func TestDumpAPIRedactsCredentials(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	var dump syncBuffer
+	client := NewTestClient(server.URL(), t)
+	DumpAPI(client, &dump)
+	auth := docker.AuthConfiguration{Username: "gofn", Password: "hunter2", ServerAddress: "registry.example.com"}
+	_, _ = client.AuthCheck(&auth)
+	_ = client.PullImage(docker.PullImageOptions{Repository: "registry.example.com/gofn/test"}, auth)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL()+"version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	out := dump.String()
+	for _, secret := range []string{"hunter2", "s3cret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("expected %q to be redacted\n%s", secret, out)
+		}
+	}
+	for _, line := range []string{"POST /auth", `"password":"[REDACTED]"`, "X-Registry-Auth: [REDACTED]", "Authorization: [REDACTED]"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("expected the dump to contain %q\n%s", line, out)
+		}
+	}
+}
+
+func TestRedactJSONTruncated(t *testing.T) {
+	body := `{"Username":"gofn","Password" : "hunter2","auths":{"r":{"auth":"Z29mbjpodW50ZXIy"`
+	out := string(redactJSON([]byte(body)))
+	if strings.Contains(out, "hunter2") || strings.Contains(out, "Z29mbjpodW50ZXIy") {
+		t.Errorf("expected the credentials to be redacted but found %s", out)
+	}
+	if !strings.Contains(out, `"Username":"gofn"`) {
+		t.Errorf("expected the other values to be kept but found %s", out)
+	}
+	// the label naming the secret variables comes after them
+	body = `{"Image":"gofn/python","Env":["MODE=prod","API_TOKEN=s3cr\"3t"],"Labels":{"io.gofn.se`
+	if out = string(redactJSON([]byte(body))); out != `{"Image":"gofn/python","Env":["MODE=[REDACTED]","API_TOKEN=[REDACTED]"],"Labels":{"io.gofn.se` {
+		t.Errorf("expected the variables to be redacted but found %s", out)
+	}
+	body = `{"Env":["API_TOKEN=s3c`
+	if out = string(redactJSON([]byte(body))); out != `{"Env":["API_TOKEN=[REDACTED]"` {
+		t.Errorf("expected the cut variable to be redacted but found %s", out)
+	}
+}
+
+func TestFnClientAPIDump(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	var dump syncBuffer
+	EnableAPIDump(&dump)
+	defer EnableAPIDump(nil)
+	client, err := FnClient(server.URL(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = FnListContainers(client); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dump.String(), "GET /containers/json") {
+		t.Errorf("expected the dump to contain the list call\n%s", dump.String())
+	}
+
+	EnableAPIDump(nil)
+	client, err = FnClient(server.URL(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.HTTPClient.Transport.(*dumpTransport); ok {
+		t.Error("expected the dump to be disabled")
+	}
+}
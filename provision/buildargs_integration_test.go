@@ -0,0 +1,47 @@
+package provision
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFnImageBuildArgsIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	client, err := FnClient("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gofn-buildargs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dockerfile := "FROM alpine:3.20\nARG VERSION\nENV APP_VERSION=$VERSION\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	name, _, err := FnImageBuild(client, &BuildOptions{ContextDir: dir, ImageName: "buildargs", BuildArgs: map[string]string{"VERSION": "1.2"}})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer client.RemoveImage(name)
+	if name != "gofn/buildargs" {
+		t.Errorf("expected gofn/buildargs but found %q", name)
+	}
+	image, err := client.InspectImage(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, env := range image.Config.Env {
+		found = found || env == "APP_VERSION=1.2"
+	}
+	if !found {
+		t.Errorf("expected the build arg in the image env %v", image.Config.Env)
+	}
+}
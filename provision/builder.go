@@ -0,0 +1,118 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	// ErrBuildNetworkNotSupported is raised when the build backend can not apply the
+	// NetworkMode or the ExtraHosts of the build options
+	ErrBuildNetworkNotSupported = errors.New("provision: build-time network settings are not supported")
+
+	// first API versions forwarding the network settings of the builds
+	buildNetworkModeAPIVersion = docker.APIVersion{1, 25}
+	buildExtraHostsAPIVersion  = docker.APIVersion{1, 28}
+)
+
+// BuildNetworkError is raised when the build backend can not apply Setting, NetworkMode or ExtraHosts
+type BuildNetworkError struct {
+	Setting string
+	Reason  string
+}
+
+func (e *BuildNetworkError) Error() string {
+	return fmt.Sprintf("%v: %s %s", ErrBuildNetworkNotSupported, e.Setting, e.Reason)
+}
+
+// Unwrap returns ErrBuildNetworkNotSupported
+func (e *BuildNetworkError) Unwrap() error {
+	return ErrBuildNetworkNotSupported
+}
+
+// Builder builds the image described by BuildOptions, it is selected by BuildOptions.Backend
+type Builder interface {
+	// Build builds opts as the image name writing the build output to stdout, which already
+	// forwards to opts.OutputStream, opts defaults are already applied and the registry auth
+	// already checked.
+	// A Dockerfile missing from the context is reported with a DockerfileNotFoundError.
+	Build(ctx context.Context, client *docker.Client, name string, opts *BuildOptions, stdout io.Writer) error
+}
+
+// DaemonBuilder builds through the docker daemon, it is the default Builder
+type DaemonBuilder struct{}
+
+// Build implements Builder
+func (DaemonBuilder) Build(ctx context.Context, client *docker.Client, name string, opts *BuildOptions, stdout io.Writer) error {
+	if err := checkBuildNetwork(ctx, client, opts); err != nil {
+		return err
+	}
+	if opts.RemoteURI == "" {
+		dockerfile := filepath.Join(opts.ContextDir, opts.Dockerfile)
+		if _, err := os.Stat(dockerfile); os.IsNotExist(err) {
+			return &DockerfileNotFoundError{Path: dockerfile}
+		}
+	}
+	return client.BuildImage(docker.BuildImageOptions{
+		Name:           name,
+		Dockerfile:     opts.Dockerfile,
+		Target:         opts.Target,
+		Platform:       opts.Platform,
+		NetworkMode:    opts.NetworkMode,
+		ExtraHosts:     strings.Join(opts.ExtraHosts, ","),
+		Pull:           opts.ForcePull,
+		BuildArgs:      buildArgs(opts),
+		NoCache:        opts.NoCache,
+		CacheFrom:      opts.CacheFrom,
+		SuppressOutput: opts.OutputStream == nil,
+		OutputStream:   stdout,
+		ContextDir:     opts.ContextDir,
+		Remote:         opts.RemoteURI,
+		Auth:           opts.Auth,
+		AuthConfigs:    opts.BuildAuthConfigs(),
+		Labels:         map[string]string{LabelOwner: ownerGofn},
+		Context:        ctx,
+	})
+}
+
+// checkBuildNetwork refuses the network settings of opts the daemon can not apply
+func checkBuildNetwork(ctx context.Context, client *docker.Client, opts *BuildOptions) (err error) {
+	if opts.NetworkMode == "" && len(opts.ExtraHosts) == 0 {
+		return
+	}
+	if len(opts.ExtraHosts) > 1 {
+		// the daemon reads each extrahosts parameter as a single entry
+		err = &BuildNetworkError{Setting: "ExtraHosts", Reason: "is limited to a single entry by the daemon builder"}
+		return
+	}
+	caps, err := hostCapabilities(ctx, client)
+	if err != nil {
+		return
+	}
+	version, err := docker.NewAPIVersion(caps.APIVersion)
+	if err != nil {
+		return
+	}
+	if opts.NetworkMode != "" && version.LessThan(buildNetworkModeAPIVersion) {
+		err = &BuildNetworkError{Setting: "NetworkMode", Reason: "needs the API " + buildNetworkModeAPIVersion.String() + ", the daemon has " + version.String()}
+		return
+	}
+	if len(opts.ExtraHosts) > 0 && version.LessThan(buildExtraHostsAPIVersion) {
+		err = &BuildNetworkError{Setting: "ExtraHosts", Reason: "needs the API " + buildExtraHostsAPIVersion.String() + ", the daemon has " + version.String()}
+	}
+	return
+}
+
+func (opts *BuildOptions) builder() Builder {
+	if opts.Backend == nil {
+		return DaemonBuilder{}
+	}
+	return opts.Backend
+}
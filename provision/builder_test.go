@@ -0,0 +1,350 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeBuildQuery makes the fake docker api report apiVersion and keeps the query of its builds
+func fakeBuildQuery(server *fake.DockerServer, apiVersion string) *[]url.Values {
+	var queries []url.Values
+	server.CustomHandler("/version", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ApiVersion":"` + apiVersion + `"}`))
+	}))
+	server.CustomHandler("/build", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	return &queries
+}
+
+func TestDaemonBuilderNetwork(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	queries := fakeBuildQuery(server, "1.41")
+	client := NewTestClient(server.URL(), t)
+
+	opts := testBuildOptions()
+	opts.NetworkMode = "host"
+	opts.ExtraHosts = []string{"mirror:10.0.0.5"}
+	if _, _, err := FnImageBuild(client, opts); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(*queries) != 1 {
+		t.Fatalf("expected a build but found %v", *queries)
+	}
+	query := (*queries)[0]
+	if query.Get("networkmode") != "host" || query.Get("extrahosts") != "mirror:10.0.0.5" {
+		t.Errorf("expected the network settings to be forwarded but found %v", query)
+	}
+
+	opts.ExtraHosts = []string{"mirror:10.0.0.5", "cache:10.0.0.6"}
+	_, _, err := FnImageBuild(client, opts)
+	if networkErr, ok := err.(*BuildNetworkError); !ok || networkErr.Setting != "ExtraHosts" || networkErr.Unwrap() != ErrBuildNetworkNotSupported {
+		t.Errorf("expected the second extra host to be refused but found %v", err)
+	}
+	if len(*queries) != 1 {
+		t.Errorf("expected no build but found %v", *queries)
+	}
+}
+
+func TestDaemonBuilderNetworkOldDaemon(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiVersion string
+		opts       func(*BuildOptions)
+		setting    string
+	}{
+		{"network mode", "1.24", func(opts *BuildOptions) { opts.NetworkMode = "host" }, "NetworkMode"},
+		{"extra hosts", "1.27", func(opts *BuildOptions) { opts.ExtraHosts = []string{"mirror:10.0.0.5"} }, "ExtraHosts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			queries := fakeBuildQuery(server, tt.apiVersion)
+			client := NewTestClient(server.URL(), t)
+
+			opts := testBuildOptions()
+			tt.opts(opts)
+			_, _, err := FnImageBuild(client, opts)
+			if networkErr, ok := err.(*BuildNetworkError); !ok || networkErr.Setting != tt.setting {
+				t.Errorf("expected %s to be refused but found %v", tt.setting, err)
+			}
+			if len(*queries) != 0 {
+				t.Errorf("expected no build but found %v", *queries)
+			}
+		})
+	}
+}
+
+func TestDaemonBuilderWithoutNetwork(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	// the version is only asked for the builds with network settings
+	queries := fakeBuildQuery(server, "1.12")
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(*queries) != 1 || (*queries)[0].Get("networkmode") != "" {
+		t.Errorf("expected a build without network settings but found %v", *queries)
+	}
+}
+
+// failingBuilder fails every build with err
+type failingBuilder struct {
+	err error
+}
+
+func (b failingBuilder) Build(ctx context.Context, client *docker.Client, name string, opts *BuildOptions, stdout io.Writer) error {
+	return b.err
+}
+
+func TestDaemonBuilderMissingDockerfile(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	queries := fakeBuildQuery(server, "1.41")
+	fakePull(server, readPullFixture(t, "fresh.jsonl"))
+	client := NewTestClient(server.URL(), t)
+
+	opts := &BuildOptions{ContextDir: "./testing_data", Dockerfile: "Missing.Dockerfile", ImageName: "python"}
+	_, _, err := FnImageBuild(client, opts)
+	if notFound, ok := err.(*DockerfileNotFoundError); !ok || notFound.Unwrap() != ErrDockerfileNotFound || notFound.Path != filepath.Join("testing_data", "Missing.Dockerfile") {
+		t.Fatalf("expected a DockerfileNotFoundError but found %v", err)
+	}
+
+	opts.FallbackToPull = true
+	name, stdout, err := FnImageBuild(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if name != "gofn/python" || stdout == nil || !strings.Contains(stdout.String(), "Pull complete") {
+		t.Errorf("expected gofn/python to be pulled but found %q", stdout)
+	}
+	if len(*queries) != 0 {
+		t.Errorf("expected no build but found %v", *queries)
+	}
+}
+
+func TestFallbackToPullKeepsBuildFailures(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	pulls := 0
+	server.CustomHandler("/images/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pulls++
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	// the message of the daemon is no longer a reason to pull
+	buildErr := errors.New("Cannot locate specified Dockerfile: Dockerfile")
+	opts := testBuildOptions()
+	opts.FallbackToPull = true
+	opts.Backend = failingBuilder{err: buildErr}
+	if _, _, err := FnImageBuild(client, opts); err != buildErr {
+		t.Errorf("expected the build failure but found %v", err)
+	}
+	if pulls != 0 {
+		t.Errorf("expected no pull but found %d", pulls)
+	}
+}
+
+func TestDaemonBuilderAuthConfigs(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	var configs []map[string]docker.AuthConfiguration
+	server.CustomHandler("/build", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var config map[string]docker.AuthConfiguration
+		data, _ := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Config"))
+		_ = json.Unmarshal(data, &config)
+		configs = append(configs, config)
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	server.CustomHandler("/auth", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"Status":"Login Succeeded"}`))
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	// the base image comes from GCR, the function image from Docker Hub
+	opts := testBuildOptions()
+	opts.Auth = docker.AuthConfiguration{Username: "gofn", Password: "hub"}
+	opts.AuthConfigs = RegistryAuth{"gcr.io": {Username: "_json_key", Password: "key"}}
+	if _, _, err := FnImageBuild(client, opts); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := map[string]docker.AuthConfiguration{
+		"gcr.io":                      {Username: "_json_key", Password: "key", ServerAddress: "gcr.io"},
+		"https://index.docker.io/v1/": {Username: "gofn", Password: "hub", ServerAddress: "https://index.docker.io/v1/"},
+	}
+	if len(configs) != 1 || !reflect.DeepEqual(configs[0], want) {
+		t.Errorf("expected the credentials %v but found %v", want, configs)
+	}
+
+	// an entry of the registry wins over Auth
+	opts.AuthConfigs["docker.io"] = docker.AuthConfiguration{Username: "ci", Password: "token"}
+	if _, _, err := FnImageBuild(client, opts); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if hub := configs[1]["https://index.docker.io/v1/"]; hub.Username != "ci" {
+		t.Errorf("expected the Docker Hub entry of AuthConfigs but found %+v", hub)
+	}
+}
+
+func TestFnPullAuthConfigs(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	sent := make(map[string]docker.AuthConfiguration)
+	server.CustomHandler("/images/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var auth docker.AuthConfiguration
+		data, _ := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+		_ = json.Unmarshal(data, &auth)
+		sent[r.URL.Query().Get("fromImage")] = auth
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	auths := RegistryAuth{"gcr.io": {Username: "_json_key", Password: "key"}}
+	hub := docker.AuthConfiguration{Username: "gofn", Password: "hub"}
+	for _, image := range []string{"gcr.io/distroless/static", "gofn/app"} {
+		if err := FnPull(client, &BuildOptions{ImageName: image, DoNotUsePrefixImageName: true, Auth: hub, AuthConfigs: auths}); err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+	}
+	if got := sent["gcr.io/distroless/static"]; got != (docker.AuthConfiguration{Username: "_json_key", Password: "key", ServerAddress: "gcr.io"}) {
+		t.Errorf("expected the GCR entry but found %+v", got)
+	}
+	if got := sent["gofn/app"]; got != hub {
+		t.Errorf("expected the default entry but found %+v", got)
+	}
+}
+
+func TestDaemonBuilderBuildArgs(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	queries := fakeBuildQuery(server, "1.41")
+	client := NewTestClient(server.URL(), t)
+
+	opts := testBuildOptions()
+	opts.BuildArgs = map[string]string{"VERSION": "1.2", "HTTP_PROXY": ""}
+	name, _, err := FnImageBuild(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if name != "gofn/test" || len(*queries) != 1 {
+		t.Fatalf("expected gofn/test to be built once but found %q and %v", name, *queries)
+	}
+	var args map[string]string
+	if err = json.Unmarshal([]byte((*queries)[0].Get("buildargs")), &args); err != nil {
+		t.Fatal(err)
+	}
+	if want := opts.BuildArgs; !reflect.DeepEqual(args, want) {
+		t.Errorf("expected the build args %v, the empty one included, but found %v", want, args)
+	}
+}
+
+func TestDaemonBuilderCache(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	queries := fakeBuildQuery(server, "1.41")
+	client := NewTestClient(server.URL(), t)
+
+	opts := testBuildOptions()
+	if _, _, err := FnImageBuild(client, opts); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	opts.NoCache = true
+	opts.CacheFrom = []string{"gofn/test:previous", "gofn/base"}
+	if _, _, err := FnImageBuild(client, opts); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(*queries) != 2 {
+		t.Fatalf("expected 2 builds but found %v", *queries)
+	}
+	if query := (*queries)[0]; query.Get("nocache") != "" || query.Get("cachefrom") != "" {
+		t.Errorf("expected the default cache behavior but found %v", query)
+	}
+	var cacheFrom []string
+	if err := json.Unmarshal([]byte((*queries)[1].Get("cachefrom")), &cacheFrom); err != nil {
+		t.Fatal(err)
+	}
+	if (*queries)[1].Get("nocache") != "1" || !reflect.DeepEqual(cacheFrom, opts.CacheFrom) {
+		t.Errorf("expected nocache and the cache images %v but found %v", opts.CacheFrom, (*queries)[1])
+	}
+}
+
+// signalWriter closes first on its first write
+type signalWriter struct {
+	bytes.Buffer
+	first chan struct{}
+	once  sync.Once
+}
+
+func (w *signalWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.first) })
+	return w.Buffer.Write(p)
+}
+
+func TestFnImageBuildOutputStream(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	out := &signalWriter{first: make(chan struct{})}
+	var queries []url.Values
+	server.CustomHandler("/build", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		_, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"stream":"Step 1/2 : FROM alpine\n"}`))
+		w.(http.Flusher).Flush()
+		if r.URL.Query().Get("q") == "" {
+			// the second step is only sent once the first one was streamed
+			select {
+			case <-out.first:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		_, _ = w.Write([]byte(`{"stream":"Step 2/2 : RUN make\n"}`))
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	_, stdout, err := FnImageBuild(client, testBuildOptions())
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if queries[0].Get("q") != "1" || out.Len() != 0 {
+		t.Errorf("expected the output to be suppressed by default but found %v", queries[0])
+	}
+
+	opts := testBuildOptions()
+	opts.OutputStream = out
+	_, stdout, err = FnImageBuild(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	select {
+	case <-out.first:
+	default:
+		t.Fatal("expected the output to be streamed")
+	}
+	want := "Step 1/2 : FROM alpine\nStep 2/2 : RUN make\n"
+	if queries[1].Get("q") != "" || out.String() != want || stdout.String() != want {
+		t.Errorf("expected %q to be streamed and returned but found %q and %q", want, out.String(), stdout.String())
+	}
+}
@@ -0,0 +1,200 @@
+// Package buildkit builds gofn images on a remote BuildKit daemon through buildctl
+package buildkit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/provision"
+)
+
+var (
+	// ErrNoAddr is raised when the Builder has no buildkitd address
+	ErrNoAddr = errors.New("buildkit: buildkitd address is required")
+)
+
+// Builder is a provision.Builder running buildctl against the buildkitd listening at Addr,
+// e.g. tcp://buildkitd:1234
+type Builder struct {
+	Addr string
+	// Push exports the image to its registry instead of loading it in the docker daemon
+	Push bool
+	// Buildctl is the buildctl binary, looked up in PATH when empty
+	Buildctl string
+}
+
+// New returns a Builder loading the images it builds in the docker daemon
+func New(addr string) *Builder {
+	return &Builder{Addr: addr}
+}
+
+// Build implements provision.Builder
+func (b *Builder) Build(ctx context.Context, client *docker.Client, name string, opts *provision.BuildOptions, stdout io.Writer) (err error) {
+	if b.Addr == "" {
+		err = ErrNoAddr
+		return
+	}
+	args, err := b.args(name, opts)
+	if err != nil {
+		return
+	}
+	buildctl := b.Buildctl
+	if buildctl == "" {
+		buildctl = "buildctl"
+	}
+	cmd := exec.CommandContext(ctx, buildctl, args...)
+	cmd.Stderr = stdout
+	if auths := opts.BuildAuthConfigs(); len(auths.Configs) > 0 {
+		var dir string
+		dir, err = dockerConfig(auths)
+		if err != nil {
+			return
+		}
+		defer os.RemoveAll(dir)
+		cmd.Env = append(os.Environ(), "DOCKER_CONFIG="+dir)
+	}
+	if b.Push {
+		cmd.Stdout = stdout
+		err = wrap(cmd.Run())
+		return
+	}
+
+	archive, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		err = wrap(err)
+		return
+	}
+	loadErr := client.LoadImage(docker.LoadImageOptions{
+		InputStream:  archive,
+		OutputStream: stdout,
+		Context:      ctx,
+	})
+	// buildctl blocks until its whole output is read
+	_, _ = io.Copy(ioutil.Discard, archive)
+	// the build error explains a failed load
+	err = wrap(cmd.Wait())
+	if err == nil {
+		err = loadErr
+	}
+	return
+}
+
+// args returns the buildctl arguments building opts as name
+func (b *Builder) args(name string, opts *provision.BuildOptions) (args []string, err error) {
+	args = []string{"--addr", b.Addr, "build", "--progress", "plain", "--frontend", "dockerfile.v0"}
+	if opts.RemoteURI != "" {
+		args = append(args, "--opt", "context="+opts.RemoteURI, "--opt", "filename="+opts.Dockerfile)
+	} else {
+		dockerfile := filepath.Join(opts.ContextDir, opts.Dockerfile)
+		if _, err = os.Stat(dockerfile); err != nil {
+			if os.IsNotExist(err) {
+				err = &provision.DockerfileNotFoundError{Path: dockerfile}
+			}
+			return
+		}
+		args = append(args,
+			"--local", "context="+opts.ContextDir,
+			"--local", "dockerfile="+filepath.Dir(dockerfile),
+			"--opt", "filename="+filepath.Base(dockerfile))
+	}
+	if opts.Target != "" {
+		args = append(args, "--opt", "target="+opts.Target)
+	}
+	if opts.Platform != "" {
+		args = append(args, "--opt", "platform="+opts.Platform)
+	}
+	if opts.ForcePull {
+		args = append(args, "--opt", "image-resolve-mode=pull")
+	}
+	if opts.NoCache {
+		args = append(args, "--no-cache")
+	}
+	for _, image := range opts.CacheFrom {
+		// buildkit reads the cache of the image from its registry, it needs not be pulled
+		args = append(args, "--import-cache", "type=registry,ref="+image)
+	}
+	names := make([]string, 0, len(opts.BuildArgs))
+	for name := range opts.BuildArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "--opt", "build-arg:"+name+"="+opts.BuildArgs[name])
+	}
+	switch opts.NetworkMode {
+	case "", "default":
+	case "host":
+		// buildkitd must grant the network.host entitlement
+		args = append(args, "--opt", "force-network-mode=host", "--allow", "network.host")
+	case "none":
+		args = append(args, "--opt", "force-network-mode=none")
+	default:
+		err = &provision.BuildNetworkError{Setting: "NetworkMode", Reason: "can only be host or none with BuildKit"}
+		return
+	}
+	if len(opts.ExtraHosts) > 0 {
+		args = append(args, "--opt", "add-hosts="+strings.Join(opts.ExtraHosts, ","))
+	}
+	if b.Push {
+		args = append(args, "--output", "type=image,name="+name+",push=true")
+	} else {
+		args = append(args, "--output", "type=docker,name="+name)
+	}
+	return
+}
+
+// dockerConfig writes a docker config holding auths in a temporary directory, buildctl
+// reads the registry credentials from it
+func dockerConfig(auths docker.AuthConfigurations) (dir string, err error) {
+	entries := make(map[string]interface{}, len(auths.Configs))
+	for server, auth := range auths.Configs {
+		entry := map[string]string{}
+		if auth.Username != "" {
+			entry["auth"] = base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		}
+		if auth.IdentityToken != "" {
+			entry["identitytoken"] = auth.IdentityToken
+		}
+		if len(entry) > 0 {
+			entries[server] = entry
+		}
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"auths": entries,
+	})
+	if err != nil {
+		return
+	}
+	dir, err = ioutil.TempDir("", "gofn-buildkit")
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "config.json"), config, 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		dir = ""
+	}
+	return
+}
+
+func wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("buildkit: buildctl failed: %v", err)
+}
@@ -0,0 +1,345 @@
+package buildkit
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+	"github.com/gofn/gofn/provision"
+)
+
+// the test binary acts as buildctl when GOFN_FAKE_BUILDCTL names the file recording the call
+func TestMain(m *testing.M) {
+	if record := os.Getenv("GOFN_FAKE_BUILDCTL"); record != "" {
+		os.Exit(fakeBuildctl(record))
+	}
+	os.Exit(m.Run())
+}
+
+type buildctlCall struct {
+	Args         []string
+	DockerConfig string
+}
+
+func fakeBuildctl(record string) int {
+	call := buildctlCall{Args: os.Args[1:]}
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		config, _ := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+		call.DockerConfig = string(config)
+	}
+	data, _ := json.Marshal(call)
+	_ = ioutil.WriteFile(record, data, 0600)
+	fmt.Fprintln(os.Stderr, "#1 [internal] load build definition from Dockerfile")
+	if os.Getenv("GOFN_FAKE_BUILDCTL_FAIL") != "" {
+		fmt.Fprintln(os.Stderr, "error: failed to solve")
+		return 1
+	}
+	output := call.Args[len(call.Args)-1]
+	if strings.HasPrefix(output, "type=docker,name=") {
+		writeArchive(os.Stdout, strings.TrimPrefix(output, "type=docker,name="))
+	}
+	return 0
+}
+
+// writeArchive writes a docker archive tagging name
+func writeArchive(w *os.File, name string) {
+	manifest, _ := json.Marshal([]map[string][]string{{"RepoTags": {name}}})
+	tw := tar.NewWriter(w)
+	_ = tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest))})
+	_, _ = tw.Write(manifest)
+	_ = tw.Close()
+}
+
+// fakeBuilder returns a Builder running the fake buildctl and a function returning its last call
+func fakeBuilder(t *testing.T) (b *Builder, lastCall func() buildctlCall, cleanup func()) {
+	dir, err := ioutil.TempDir("", "gofn-buildctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := filepath.Join(dir, "call.json")
+	os.Setenv("GOFN_FAKE_BUILDCTL", record)
+	b = &Builder{Addr: "tcp://buildkitd:1234", Buildctl: os.Args[0]}
+	lastCall = func() (call buildctlCall) {
+		data, err := ioutil.ReadFile(record)
+		if err != nil {
+			t.Fatalf("expected buildctl to be called: %v", err)
+		}
+		if err = json.Unmarshal(data, &call); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	return b, lastCall, func() {
+		os.Unsetenv("GOFN_FAKE_BUILDCTL")
+		os.RemoveAll(dir)
+	}
+}
+
+// fakeDaemon returns a fake docker daemon registering the images of the loaded archives,
+// which its /images/load ignores
+func fakeDaemon(t *testing.T) (server *fake.DockerServer, client *docker.Client, loaded func() []string) {
+	server, err := fake.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu   sync.Mutex
+		tags []string
+	)
+	server.CustomHandler("/images/load", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr := tar.NewReader(r.Body)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if header.Name != "manifest.json" {
+				continue
+			}
+			var manifest []struct{ RepoTags []string }
+			_ = json.NewDecoder(tr).Decode(&manifest)
+			for _, m := range manifest {
+				for _, tag := range m.RepoTags {
+					// a pull is the only way to add an image to the fake daemon
+					_ = client.PullImage(docker.PullImageOptions{Repository: tag}, docker.AuthConfiguration{})
+					mu.Lock()
+					tags = append(tags, tag)
+					mu.Unlock()
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return server, client, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), tags...)
+	}
+}
+
+func containsSeq(args []string, seq ...string) bool {
+	return strings.Contains(" "+strings.Join(args, " ")+" ", " "+strings.Join(seq, " ")+" ")
+}
+
+func TestBuildLoadsIntoDaemon(t *testing.T) {
+	server, client, loaded := fakeDaemon(t)
+	defer server.Stop()
+	b, lastCall, cleanup := fakeBuilder(t)
+	defer cleanup()
+
+	name, stdout, err := provision.FnImageBuild(client, &provision.BuildOptions{
+		ContextDir: "testdata",
+		Dockerfile: "sub/Dockerfile",
+		ImageName:  "test",
+		Target:     "final",
+		Platform:   "linux/arm64",
+		Backend:    b,
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if name != "gofn/test" {
+		t.Errorf("expected image gofn/test but found %q", name)
+	}
+	args := lastCall().Args
+	for _, seq := range [][]string{
+		{"--addr", "tcp://buildkitd:1234", "build"},
+		{"--local", "context=testdata"},
+		{"--local", "dockerfile=" + filepath.Join("testdata", "sub")},
+		{"--opt", "filename=Dockerfile"},
+		{"--opt", "target=final"},
+		{"--opt", "platform=linux/arm64"},
+		{"--output", "type=docker,name=gofn/test"},
+	} {
+		if !containsSeq(args, seq...) {
+			t.Errorf("expected %v in the buildctl arguments %v", seq, args)
+		}
+	}
+	if tags := loaded(); len(tags) != 1 || tags[0] != "gofn/test" {
+		t.Errorf("expected gofn/test to be loaded but found %v", tags)
+	}
+	if _, err = client.InspectImage("gofn/test"); err != nil {
+		t.Errorf("expected the image to be in the daemon: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "load build definition") {
+		t.Errorf("expected the build progress in the output but found %q", stdout.String())
+	}
+}
+
+func TestBuildPush(t *testing.T) {
+	server, client, loaded := fakeDaemon(t)
+	defer server.Stop()
+	b, lastCall, cleanup := fakeBuilder(t)
+	defer cleanup()
+	b.Push = true
+
+	opts := &provision.BuildOptions{RemoteURI: "https://github.com/gofn/gofn.git#master", Dockerfile: "Dockerfile"}
+	err := b.Build(context.Background(), client, "registry.example.com/gofn/test", opts, new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	args := lastCall().Args
+	for _, seq := range [][]string{
+		{"--opt", "context=https://github.com/gofn/gofn.git#master"},
+		{"--output", "type=image,name=registry.example.com/gofn/test,push=true"},
+	} {
+		if !containsSeq(args, seq...) {
+			t.Errorf("expected %v in the buildctl arguments %v", seq, args)
+		}
+	}
+	if containsSeq(args, "--local") {
+		t.Errorf("expected no local context in %v", args)
+	}
+	if tags := loaded(); len(tags) != 0 {
+		t.Errorf("expected nothing to be loaded but found %v", tags)
+	}
+}
+
+func TestBuildAuth(t *testing.T) {
+	server, client, _ := fakeDaemon(t)
+	defer server.Stop()
+	b, lastCall, cleanup := fakeBuilder(t)
+	defer cleanup()
+
+	opts := &provision.BuildOptions{
+		ContextDir: "testdata",
+		Dockerfile: "Dockerfile",
+		Auth:       docker.AuthConfiguration{Username: "gofn", Password: "secret", ServerAddress: "registry.example.com"},
+	}
+	err := b.Build(context.Background(), client, "gofn/test", opts, new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	var config struct {
+		Auths map[string]map[string]string
+	}
+	if err = json.Unmarshal([]byte(lastCall().DockerConfig), &config); err != nil {
+		t.Fatalf("expected a docker config: %v", err)
+	}
+	want := base64.StdEncoding.EncodeToString([]byte("gofn:secret"))
+	if got := config.Auths["registry.example.com"]["auth"]; got != want {
+		t.Errorf("expected auth %q but found %q", want, got)
+	}
+
+	// the credentials of every registry are written
+	opts.AuthConfigs = provision.RegistryAuth{"gcr.io": {Username: "_json_key", Password: "key"}}
+	err = b.Build(context.Background(), client, "gofn/test", opts, new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err = json.Unmarshal([]byte(lastCall().DockerConfig), &config); err != nil {
+		t.Fatalf("expected a docker config: %v", err)
+	}
+	gcr := base64.StdEncoding.EncodeToString([]byte("_json_key:key"))
+	if len(config.Auths) != 2 || config.Auths["gcr.io"]["auth"] != gcr || config.Auths["registry.example.com"]["auth"] != want {
+		t.Errorf("unexpected credentials %v", config.Auths)
+	}
+}
+
+func TestBuildMissingDockerfileFallsBackToPull(t *testing.T) {
+	server, client, _ := fakeDaemon(t)
+	defer server.Stop()
+	b, _, cleanup := fakeBuilder(t)
+	defer cleanup()
+
+	opts := &provision.BuildOptions{
+		ContextDir: "testdata",
+		Dockerfile: "Missing.Dockerfile",
+		ImageName:  "python",
+		Backend:    b,
+	}
+	_, _, err := provision.FnImageBuild(client, opts)
+	if notFound, ok := err.(*provision.DockerfileNotFoundError); !ok || notFound.Unwrap() != provision.ErrDockerfileNotFound {
+		t.Fatalf("expected a DockerfileNotFoundError but found %v", err)
+	}
+
+	opts.FallbackToPull = true
+	name, _, err := provision.FnImageBuild(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, err = client.InspectImage(name + ":latest"); err != nil {
+		t.Errorf("expected %s to be pulled: %v", name, err)
+	}
+}
+
+func TestBuildFailure(t *testing.T) {
+	server, client, _ := fakeDaemon(t)
+	defer server.Stop()
+	b, _, cleanup := fakeBuilder(t)
+	defer cleanup()
+	os.Setenv("GOFN_FAKE_BUILDCTL_FAIL", "1")
+	defer os.Unsetenv("GOFN_FAKE_BUILDCTL_FAIL")
+
+	stdout := new(bytes.Buffer)
+	opts := &provision.BuildOptions{ContextDir: "testdata", Dockerfile: "Dockerfile"}
+	err := b.Build(context.Background(), client, "gofn/test", opts, stdout)
+	if err == nil || !strings.HasPrefix(err.Error(), "buildkit:") {
+		t.Errorf("expected a buildkit error but found %v", err)
+	}
+	if !strings.Contains(stdout.String(), "failed to solve") {
+		t.Errorf("expected the buildctl error in the output but found %q", stdout.String())
+	}
+}
+
+func TestBuildWithoutAddr(t *testing.T) {
+	err := New("").Build(context.Background(), nil, "gofn/test", &provision.BuildOptions{}, new(bytes.Buffer))
+	if err != ErrNoAddr {
+		t.Errorf("expected ErrNoAddr but found %v", err)
+	}
+}
+
+func TestBuildNetwork(t *testing.T) {
+	server, client, _ := fakeDaemon(t)
+	defer server.Stop()
+	b, lastCall, cleanup := fakeBuilder(t)
+	defer cleanup()
+
+	opts := &provision.BuildOptions{
+		ContextDir:  "testdata",
+		Dockerfile:  "Dockerfile",
+		NetworkMode: "host",
+		ExtraHosts:  []string{"mirror:10.0.0.5", "cache:10.0.0.6"},
+		BuildArgs:   map[string]string{"VERSION": "1.2", "HTTP_PROXY": ""},
+		NoCache:     true,
+		CacheFrom:   []string{"registry.example.com/gofn/test:cache"},
+	}
+	err := b.Build(context.Background(), client, "gofn/test", opts, new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	args := lastCall().Args
+	for _, seq := range [][]string{
+		{"--opt", "force-network-mode=host", "--allow", "network.host"},
+		{"--opt", "add-hosts=mirror:10.0.0.5,cache:10.0.0.6"},
+		{"--opt", "build-arg:HTTP_PROXY=", "--opt", "build-arg:VERSION=1.2"},
+		{"--no-cache"},
+		{"--import-cache", "type=registry,ref=registry.example.com/gofn/test:cache"},
+	} {
+		if !containsSeq(args, seq...) {
+			t.Errorf("expected %v in the buildctl arguments %v", seq, args)
+		}
+	}
+
+	opts.NetworkMode = "artifacts"
+	err = b.Build(context.Background(), client, "gofn/test", opts, new(bytes.Buffer))
+	if networkErr, ok := err.(*provision.BuildNetworkError); !ok || networkErr.Unwrap() != provision.ErrBuildNetworkNotSupported {
+		t.Errorf("expected a named network to be refused but found %v", err)
+	}
+}
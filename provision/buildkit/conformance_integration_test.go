@@ -0,0 +1,30 @@
+package buildkit
+
+import (
+	"os"
+	"testing"
+
+	"github.com/gofn/gofn/provision"
+)
+
+// TestConformanceIntegration needs a docker daemon, the buildkit backend also
+// needs buildctl and the buildkitd address in GOFN_BUILDKIT_ADDR
+func TestConformanceIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	client, err := provision.FnClient("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("daemon", func(t *testing.T) {
+		runConformance(t, client, nil)
+	})
+	t.Run("buildkit", func(t *testing.T) {
+		addr := os.Getenv("GOFN_BUILDKIT_ADDR")
+		if addr == "" {
+			t.Skip("GOFN_BUILDKIT_ADDR is not set")
+		}
+		runConformance(t, client, New(addr))
+	})
+}
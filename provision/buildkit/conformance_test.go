@@ -0,0 +1,55 @@
+package buildkit
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/provision"
+)
+
+// conformanceCases are the build options every backend must honour
+var conformanceCases = []struct {
+	name string
+	opts provision.BuildOptions
+}{
+	{"defaults", provision.BuildOptions{}},
+	{"dockerfile", provision.BuildOptions{Dockerfile: "sub/Dockerfile"}},
+	{"target", provision.BuildOptions{Target: "base"}},
+	{"platform", provision.BuildOptions{Platform: "linux/amd64"}},
+}
+
+// runConformance builds each case with backend and checks the image reached the daemon
+func runConformance(t *testing.T, client *docker.Client, backend provision.Builder) {
+	for _, c := range conformanceCases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := c.opts
+			opts.ContextDir = "testdata"
+			opts.ImageName = "conformance-" + c.name
+			opts.Backend = backend
+			name, _, err := provision.FnImageBuild(client, &opts)
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if name != "gofn/conformance-"+c.name {
+				t.Errorf("expected image gofn/conformance-%s but found %q", c.name, name)
+			}
+			if _, err = client.InspectImage(name); err != nil {
+				t.Errorf("expected %s in the daemon: %v", name, err)
+			}
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	server, client, _ := fakeDaemon(t)
+	defer server.Stop()
+	b, _, cleanup := fakeBuilder(t)
+	defer cleanup()
+
+	t.Run("daemon", func(t *testing.T) {
+		runConformance(t, client, nil)
+	})
+	t.Run("buildkit", func(t *testing.T) {
+		runConformance(t, client, b)
+	})
+}
@@ -0,0 +1,108 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// HostCallbackEnv is the variable giving EnableHostCallback containers the address of the daemon host
+	HostCallbackEnv = "GOFN_HOST_ADDR"
+
+	// HostCallbackName is the name of the daemon host in the containers of Docker
+	HostCallbackName = "host.docker.internal"
+
+	// podmanHostName is the name Podman gives to its host in the containers
+	podmanHostName = "host.containers.internal"
+
+	// defaultBridge is the network of the containers without one
+	defaultBridge = "bridge"
+)
+
+// HostCallbackMechanism is how a container of EnableHostCallback reaches the daemon host
+type HostCallbackMechanism string
+
+const (
+	// CallbackBuiltin is used with Docker Desktop, which resolves HostCallbackName by itself
+	CallbackBuiltin HostCallbackMechanism = "builtin"
+	// CallbackPodman is used with Podman, which resolves host.containers.internal by itself,
+	// including behind slirp4netns
+	CallbackPodman HostCallbackMechanism = "podman"
+	// CallbackHostGateway maps HostCallbackName to the special host-gateway address of the daemon
+	CallbackHostGateway HostCallbackMechanism = "host-gateway"
+	// CallbackHostNetwork is used by the containers sharing the network of the host
+	CallbackHostNetwork HostCallbackMechanism = "host-network"
+	// CallbackBridgeGateway maps HostCallbackName to the gateway of the network of the container,
+	// for the daemons predating host-gateway
+	CallbackBridgeGateway HostCallbackMechanism = "bridge-gateway"
+)
+
+// ErrHostCallbackUnavailable is raised when the daemon host address can not be found for EnableHostCallback
+var ErrHostCallbackUnavailable = errors.New("provision: the daemon host address is unavailable to the container")
+
+// hostGatewayAPIVersion is the API of Docker 20.10, the first one mapping host-gateway in the extra hosts
+var hostGatewayAPIVersion = docker.APIVersion{1, 41}
+
+// HostCallback is how the containers on a network of a daemon reach its host
+type HostCallback struct {
+	Mechanism HostCallbackMechanism
+	// Addr is the name or the IP of the host in the containers, given to them as HostCallbackEnv
+	Addr string
+	// ExtraHosts are the entries added to /etc/hosts of the containers
+	ExtraHosts []string
+}
+
+// ResolveHostCallback detects how the containers on network, the default bridge when empty,
+// reach the host of the daemon of client, so the orchestrator can serve them callbacks
+func ResolveHostCallback(ctx context.Context, client *docker.Client, network string) (callback HostCallback, err error) {
+	if network == "host" {
+		callback = HostCallback{Mechanism: CallbackHostNetwork, Addr: "127.0.0.1"}
+		return
+	}
+	caps, err := hostCapabilities(ctx, client)
+	if err != nil {
+		return
+	}
+	if caps.Podman {
+		callback = HostCallback{Mechanism: CallbackPodman, Addr: podmanHostName}
+		return
+	}
+	if strings.Contains(caps.OperatingSystem, "Docker Desktop") {
+		callback = HostCallback{Mechanism: CallbackBuiltin, Addr: HostCallbackName}
+		return
+	}
+	version, err := docker.NewAPIVersion(caps.APIVersion)
+	if err != nil {
+		return
+	}
+	if version.GreaterThanOrEqualTo(hostGatewayAPIVersion) {
+		callback = HostCallback{
+			Mechanism:  CallbackHostGateway,
+			Addr:       HostCallbackName,
+			ExtraHosts: []string{HostCallbackName + ":host-gateway"},
+		}
+		return
+	}
+	if network == "" {
+		network = defaultBridge
+	}
+	bridge, err := client.NetworkInfo(network)
+	if err != nil {
+		return
+	}
+	for _, config := range bridge.IPAM.Config {
+		if config.Gateway != "" && !strings.Contains(config.Gateway, ":") {
+			callback = HostCallback{
+				Mechanism:  CallbackBridgeGateway,
+				Addr:       config.Gateway,
+				ExtraHosts: []string{HostCallbackName + ":" + config.Gateway},
+			}
+			return
+		}
+	}
+	err = ErrHostCallbackUnavailable
+	return
+}
@@ -0,0 +1,106 @@
+package provision
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeVersion makes the fake docker api answer /version with body
+func fakeVersion(server *fake.DockerServer, body string) {
+	server.CustomHandler("/version", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func TestResolveHostCallback(t *testing.T) {
+	bridge := &docker.Network{ID: "bridge", Name: "bridge", IPAM: docker.IPAMOptions{Config: []docker.IPAMConfig{
+		{Subnet: "fd00::/64", Gateway: "fd00::1"},
+		{Subnet: "172.17.0.0/16", Gateway: "172.17.0.1"},
+	}}}
+	functions := &docker.Network{ID: "functions", Name: "functions", IPAM: docker.IPAMOptions{Config: []docker.IPAMConfig{
+		{Subnet: "10.10.0.0/24", Gateway: "10.10.0.1"},
+	}}}
+	tests := []struct {
+		name     string
+		version  string
+		os       string
+		network  string
+		expected HostCallback
+		err      error
+	}{
+		{"docker desktop", `{"ApiVersion":"1.43"}`, "Docker Desktop", "", HostCallback{Mechanism: CallbackBuiltin, Addr: "host.docker.internal"}, nil},
+		{"podman", `{"ApiVersion":"1.41","Components":[{"Name":"Podman Engine","Version":"4.9.3"}]}`, "fedora", "",
+			HostCallback{Mechanism: CallbackPodman, Addr: "host.containers.internal"}, nil},
+		{"linux docker", `{"ApiVersion":"1.43","Components":[{"Name":"Engine","Version":"24.0.7"}]}`, "Ubuntu 22.04.3 LTS", "",
+			HostCallback{Mechanism: CallbackHostGateway, Addr: "host.docker.internal", ExtraHosts: []string{"host.docker.internal:host-gateway"}}, nil},
+		{"old linux docker", `{"ApiVersion":"1.40"}`, "Ubuntu 18.04.6 LTS", "",
+			HostCallback{Mechanism: CallbackBridgeGateway, Addr: "172.17.0.1", ExtraHosts: []string{"host.docker.internal:172.17.0.1"}}, nil},
+		{"old linux docker on a network", `{"ApiVersion":"1.40"}`, "Ubuntu 18.04.6 LTS", "functions",
+			HostCallback{Mechanism: CallbackBridgeGateway, Addr: "10.10.0.1", ExtraHosts: []string{"host.docker.internal:10.10.0.1"}}, nil},
+		{"old linux docker without gateway", `{"ApiVersion":"1.40"}`, "Ubuntu 18.04.6 LTS", "ipv6", HostCallback{}, ErrHostCallbackUnavailable},
+		{"host network", `{"ApiVersion":"1.40"}`, "Ubuntu 18.04.6 LTS", "host", HostCallback{Mechanism: CallbackHostNetwork, Addr: "127.0.0.1"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			fakeVersion(server, tt.version)
+			fakeInfo(server, map[string]interface{}{"OperatingSystem": tt.os})
+			networks := newFakeNetworks(server)
+			networks.add(bridge)
+			networks.add(functions)
+			networks.add(&docker.Network{ID: "ipv6", Name: "ipv6", IPAM: docker.IPAMOptions{Config: []docker.IPAMConfig{{Gateway: "fd01::1"}}}})
+			client := NewTestClient(server.URL(), t)
+
+			callback, err := ResolveHostCallback(context.Background(), client, tt.network)
+			if err != tt.err {
+				t.Fatalf("expected the error %v but found %v", tt.err, err)
+			}
+			if !reflect.DeepEqual(callback, tt.expected) {
+				t.Errorf("expected the callback %+v but found %+v", tt.expected, callback)
+			}
+		})
+	}
+}
+
+func TestFnContainerHostCallback(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeVersion(server, `{"ApiVersion":"1.43"}`)
+	fakeInfo(server, map[string]interface{}{"OperatingSystem": "Debian GNU/Linux 12 (bookworm)"})
+	hostConfigs := recordCreate(server)
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	opts := ContainerOptions{Image: image, Env: []string{"GO=fn"}, EnableHostCallback: true}
+	container, err := FnContainer(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if extraHosts := string((*hostConfigs)[0]["ExtraHosts"]); extraHosts != `["host.docker.internal:host-gateway"]` {
+		t.Errorf("expected the host-gateway entry but found %s", extraHosts)
+	}
+	container, err = client.InspectContainer(container.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := []string{"GO=fn", "GOFN_HOST_ADDR=host.docker.internal"}; !reflect.DeepEqual(container.Config.Env, env) {
+		t.Errorf("expected the env %v but found %v", env, container.Config.Env)
+	}
+	if len(opts.Env) != 1 {
+		t.Errorf("expected the options to be left untouched but found %v", opts.Env)
+	}
+
+	if _, err = FnContainer(client, ContainerOptions{Image: image}); err != nil {
+		t.Fatal(err)
+	}
+	if extraHosts, ok := (*hostConfigs)[1]["ExtraHosts"]; ok && string(extraHosts) != "null" {
+		t.Errorf("expected no extra hosts without the callback but found %s", extraHosts)
+	}
+}
@@ -0,0 +1,223 @@
+package provision
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	units "github.com/docker/go-units"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DefaultCapabilitiesTTL is how long HostCapabilities reuses the capabilities of a client by default
+const DefaultCapabilitiesTTL = time.Minute
+
+// Capabilities describes what the docker daemon behind a client supports
+type Capabilities struct {
+	UsernsRemap     bool     `json:"userns_remap"`
+	SecurityOptions []string `json:"security_options"`
+	// DefaultRuntime is the runtime of the containers without one, empty on daemons predating runtimes
+	DefaultRuntime string `json:"default_runtime,omitempty"`
+	// Runtimes are the names of the runtimes the daemon accepts, sorted, empty on daemons predating runtimes
+	Runtimes []string `json:"runtimes,omitempty"`
+	// ServerVersion is the version of the daemon and APIVersion the version of its API, e.g. 1.41
+	ServerVersion string `json:"server_version"`
+	APIVersion    string `json:"api_version"`
+	// Podman is set for the Podman docker compatible API
+	Podman          bool   `json:"podman"`
+	OperatingSystem string `json:"operating_system"`
+	// OSType and Architecture are the platform of the containers, e.g. linux and amd64
+	OSType       string `json:"os_type"`
+	Architecture string `json:"architecture"`
+	// CgroupVersion is 1 or 2, 0 when unknown, CgroupDriver is cgroupfs or systemd
+	CgroupVersion int    `json:"cgroup_version,omitempty"`
+	CgroupDriver  string `json:"cgroup_driver,omitempty"`
+	// MemoryLimit and CPUQuota tell whether ContainerOptions Memory and NanoCPUs are enforced
+	MemoryLimit bool `json:"memory_limit"`
+	CPUQuota    bool `json:"cpu_quota"`
+	// Init tells whether the daemon has an init binary to run as the first process of the containers
+	Init bool `json:"init"`
+	// Checkpoint tells whether the daemon enables the experimental checkpoints of the containers,
+	// they also need CRIU on the host which the daemon does not report
+	Checkpoint    bool   `json:"checkpoint"`
+	StorageDriver string `json:"storage_driver"`
+	// StorageQuota tells whether the storage driver can limit the size of the container filesystems,
+	// overlay2 also needs its xfs backing filesystem to be mounted with pquota
+	StorageQuota bool `json:"storage_quota"`
+	// AvailableDisk is the free space reported by the storage driver, 0 when it does not report it
+	AvailableDisk int64 `json:"available_disk,omitempty"`
+	// LayersSize is the space used by the image layers, LayersSizeKnown is false when the daemon
+	// predates the disk usage API
+	LayersSize      int64 `json:"layers_size"`
+	LayersSizeKnown bool  `json:"layers_size_known"`
+	// FetchedAt is when the daemon was inspected
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// Platform returns the platform of the containers of the daemon, e.g. linux/amd64
+func (caps Capabilities) Platform() string {
+	osType, arch := caps.OSType, caps.Architecture
+	if osType == "" {
+		osType = "linux"
+	}
+	if arch == "" {
+		arch = "amd64"
+	}
+	return osType + "/" + arch
+}
+
+// architectures maps the machine names reported by the daemon to the platform architectures
+var architectures = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"armv7l":  "arm",
+	"i686":    "386",
+}
+
+// quotaDrivers are the storage drivers limiting the size of the container filesystems
+var quotaDrivers = map[string]bool{
+	"devicemapper":  true,
+	"btrfs":         true,
+	"zfs":           true,
+	"windowsfilter": true,
+}
+
+// cachedCapabilities are the capabilities of a client inspected at
+type cachedCapabilities struct {
+	caps Capabilities
+	at   time.Time
+}
+
+var (
+	capabilitiesMu    sync.Mutex
+	capabilitiesTTL   = DefaultCapabilitiesTTL
+	capabilitiesCache = make(map[*docker.Client]cachedCapabilities)
+)
+
+// SetCapabilitiesTTL sets how long HostCapabilities reuses the capabilities of a client, zero
+// inspects the daemon on every call
+func SetCapabilitiesTTL(ttl time.Duration) {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	capabilitiesTTL = ttl
+}
+
+// InvalidateCapabilities makes the next HostCapabilities of client inspect the daemon, e.g. after
+// its configuration changed
+func InvalidateCapabilities(client *docker.Client) {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	delete(capabilitiesCache, client)
+}
+
+// HostCapabilities inspects the daemon and reports its capabilities, they are cached per client
+// for the TTL set by SetCapabilitiesTTL
+func HostCapabilities(client *docker.Client) (caps Capabilities, err error) {
+	return hostCapabilities(context.Background(), client)
+}
+
+func hostCapabilities(ctx context.Context, client *docker.Client) (caps Capabilities, err error) {
+	now := time.Now()
+	capabilitiesMu.Lock()
+	cached, ok := capabilitiesCache[client]
+	fresh := ok && now.Before(cached.at.Add(capabilitiesTTL))
+	capabilitiesMu.Unlock()
+	if fresh {
+		caps = cached.caps.copy()
+		return
+	}
+	caps, err = inspectCapabilities(ctx, client)
+	if err != nil {
+		return
+	}
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	// the expired entries are dropped so the cache does not keep the discarded clients
+	for c, cached := range capabilitiesCache {
+		if !now.Before(cached.at.Add(capabilitiesTTL)) {
+			delete(capabilitiesCache, c)
+		}
+	}
+	if capabilitiesTTL > 0 {
+		capabilitiesCache[client] = cachedCapabilities{caps: caps.copy(), at: now}
+	}
+	return
+}
+
+// inspectCapabilities gathers the capabilities from the info, the version and the disk usage of the daemon
+func inspectCapabilities(ctx context.Context, client *docker.Client) (caps Capabilities, err error) {
+	info, err := client.Info()
+	if err != nil {
+		return
+	}
+	env, err := client.VersionWithContext(ctx)
+	if err != nil {
+		return
+	}
+	caps.FetchedAt = time.Now()
+	caps.SecurityOptions = info.SecurityOptions
+	caps.DefaultRuntime = info.DefaultRuntime
+	for name := range info.Runtimes {
+		caps.Runtimes = append(caps.Runtimes, name)
+	}
+	sort.Strings(caps.Runtimes)
+	for _, opt := range info.SecurityOptions {
+		// older daemons report the bare option name, newer ones use "name=userns"
+		if opt == "userns" || strings.HasPrefix(opt, "name=userns") {
+			caps.UsernsRemap = true
+		}
+		// the daemons on a cgroup v2 host run the containers in their own cgroup namespace
+		if strings.HasPrefix(opt, "name=cgroupns") {
+			caps.CgroupVersion = 2
+		}
+	}
+	caps.ServerVersion = info.ServerVersion
+	caps.APIVersion = env.Get("ApiVersion")
+	caps.Podman = strings.Contains(env.Get("Components"), "Podman")
+	caps.OperatingSystem = info.OperatingSystem
+	caps.OSType = info.OSType
+	caps.Architecture = info.Architecture
+	if arch, ok := architectures[info.Architecture]; ok {
+		caps.Architecture = arch
+	}
+	caps.CgroupDriver = info.CgroupDriver
+	if caps.CgroupVersion == 0 && caps.CgroupDriver != "" && caps.CgroupDriver != "none" {
+		caps.CgroupVersion = 1
+	}
+	caps.MemoryLimit = info.MemoryLimit
+	caps.CPUQuota = info.CPUCfsQuota
+	caps.Init = info.InitBinary != ""
+	caps.Checkpoint = info.ExperimentalBuild && caps.OSType != "windows"
+	caps.StorageDriver = info.Driver
+	caps.StorageQuota = quotaDrivers[info.Driver]
+	for _, status := range info.DriverStatus {
+		switch status[0] {
+		case "Backing Filesystem":
+			if info.Driver == "overlay2" && status[1] == "xfs" {
+				caps.StorageQuota = true
+			}
+		case "Data Space Available":
+			if available, parseErr := units.FromHumanSize(status[1]); parseErr == nil {
+				caps.AvailableDisk = available
+			}
+		}
+	}
+	// the daemons predating the disk usage API only lack the layers size
+	usage, usageErr := client.DiskUsage(docker.DiskUsageOptions{Context: ctx})
+	if usageErr == nil {
+		caps.LayersSize = usage.LayersSize
+		caps.LayersSizeKnown = true
+	} else if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+// copy returns caps with its own slices so the cached ones are not shared with the callers
+func (caps Capabilities) copy() Capabilities {
+	caps.SecurityOptions = append([]string(nil), caps.SecurityOptions...)
+	caps.Runtimes = append([]string(nil), caps.Runtimes...)
+	return caps
+}
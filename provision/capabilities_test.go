@@ -0,0 +1,240 @@
+package provision
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeInfo replaces the /info answer of the fake docker api
+func fakeInfo(server *fake.DockerServer, info map[string]interface{}) {
+	server.CustomHandler("/info", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(info)
+	}))
+}
+
+func TestHostCapabilities(t *testing.T) {
+	tests := []struct {
+		name            string
+		securityOptions []string
+		wantRemap       bool
+	}{
+		{"no security options", nil, false},
+		{"apparmor only", []string{"name=apparmor", "name=seccomp,profile=default"}, false},
+		{"userns", []string{"name=seccomp,profile=default", "name=userns"}, true},
+		{"legacy userns", []string{"apparmor", "userns"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			fakeInfo(server, map[string]interface{}{"SecurityOptions": tt.securityOptions})
+
+			client := NewTestClient(server.URL(), t)
+			caps, err := HostCapabilities(client)
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if caps.UsernsRemap != tt.wantRemap {
+				t.Errorf("UsernsRemap expected %v but found %v", tt.wantRemap, caps.UsernsRemap)
+			}
+		})
+	}
+}
+
+func TestHostCapabilitiesRuntimes(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeInfo(server, map[string]interface{}{
+		"DefaultRuntime": "runc",
+		"Runtimes":       map[string]interface{}{"runsc": map[string]string{"path": "/usr/bin/runsc"}, "runc": map[string]string{"path": "runc"}},
+	})
+
+	client := NewTestClient(server.URL(), t)
+	caps, err := HostCapabilities(client)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if caps.DefaultRuntime != "runc" || !reflect.DeepEqual(caps.Runtimes, []string{"runc", "runsc"}) {
+		t.Errorf("unexpected runtimes %q %q", caps.DefaultRuntime, caps.Runtimes)
+	}
+}
+
+func TestHostCapabilitiesServerError(t *testing.T) {
+	client := NewTestClient("wrong", t)
+
+	if _, err := HostCapabilities(client); err == nil {
+		t.Error("expected errors but no errors found")
+	}
+}
+
+func TestHostCapabilitiesDaemons(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    map[string]interface{}
+		version string
+		df      bool
+		want    Capabilities
+	}{
+		{
+			name: "docker 24 cgroup v2",
+			info: map[string]interface{}{
+				"ServerVersion": "24.0.7", "OperatingSystem": "Ubuntu 22.04.3 LTS", "OSType": "linux", "Architecture": "x86_64",
+				"Driver": "overlay2", "DriverStatus": [][2]string{{"Backing Filesystem", "extfs"}, {"Supports d_type", "true"}},
+				"CgroupDriver": "systemd", "SecurityOptions": []string{"name=apparmor", "name=seccomp,profile=builtin", "name=cgroupns"},
+				"MemoryLimit": true, "CpuCfsQuota": true, "InitBinary": "docker-init", "DefaultRuntime": "runc",
+				"Runtimes": map[string]interface{}{"runc": map[string]string{"path": "runc"}, "nvidia": map[string]string{"path": "nvidia-container-runtime"}},
+			},
+			version: `{"Version":"24.0.7","ApiVersion":"1.43","Os":"linux","Arch":"amd64"}`,
+			df:      true,
+			want: Capabilities{
+				SecurityOptions: []string{"name=apparmor", "name=seccomp,profile=builtin", "name=cgroupns"},
+				DefaultRuntime:  "runc", Runtimes: []string{"nvidia", "runc"},
+				ServerVersion: "24.0.7", APIVersion: "1.43", OperatingSystem: "Ubuntu 22.04.3 LTS",
+				OSType: "linux", Architecture: "amd64", CgroupVersion: 2, CgroupDriver: "systemd",
+				MemoryLimit: true, CPUQuota: true, Init: true, StorageDriver: "overlay2",
+				LayersSize: 3 << 30, LayersSizeKnown: true,
+			},
+		},
+		{
+			name: "docker 19.03 devicemapper userns",
+			info: map[string]interface{}{
+				"ServerVersion": "19.03.15", "OperatingSystem": "CentOS Linux 7 (Core)", "OSType": "linux", "Architecture": "aarch64",
+				"Driver": "devicemapper", "DriverStatus": [][2]string{{"Pool Name", "docker-thinpool"}, {"Data Space Available", "5 GB"}},
+				"CgroupDriver": "cgroupfs", "SecurityOptions": []string{"name=seccomp,profile=default", "name=userns"},
+				"MemoryLimit": true, "CpuCfsQuota": true, "InitBinary": "docker-init", "DefaultRuntime": "runc",
+				"Runtimes": map[string]interface{}{"runc": map[string]string{"path": "runc"}, "runsc": map[string]string{"path": "/usr/local/bin/runsc"}},
+			},
+			version: `{"Version":"19.03.15","ApiVersion":"1.40","Os":"linux","Arch":"arm64"}`,
+			df:      true,
+			want: Capabilities{
+				UsernsRemap: true, SecurityOptions: []string{"name=seccomp,profile=default", "name=userns"},
+				DefaultRuntime: "runc", Runtimes: []string{"runc", "runsc"},
+				ServerVersion: "19.03.15", APIVersion: "1.40", OperatingSystem: "CentOS Linux 7 (Core)",
+				OSType: "linux", Architecture: "arm64", CgroupVersion: 1, CgroupDriver: "cgroupfs",
+				MemoryLimit: true, CPUQuota: true, Init: true, StorageDriver: "devicemapper", StorageQuota: true,
+				AvailableDisk: 5e9, LayersSize: 3 << 30, LayersSizeKnown: true,
+			},
+		},
+		{
+			name: "overlay2 on xfs without disk usage",
+			info: map[string]interface{}{
+				"ServerVersion": "17.03.2-ce", "OSType": "linux", "Architecture": "x86_64",
+				"Driver": "overlay2", "DriverStatus": [][2]string{{"Backing Filesystem", "xfs"}},
+				"CgroupDriver": "cgroupfs", "MemoryLimit": true,
+			},
+			version: `{"Version":"17.03.2-ce","ApiVersion":"1.26"}`,
+			want: Capabilities{
+				ServerVersion: "17.03.2-ce", APIVersion: "1.26", OSType: "linux", Architecture: "amd64",
+				CgroupVersion: 1, CgroupDriver: "cgroupfs", MemoryLimit: true, StorageDriver: "overlay2", StorageQuota: true,
+			},
+		},
+		{
+			name: "podman rootless",
+			info: map[string]interface{}{
+				"ServerVersion": "4.9.3", "OperatingSystem": "fedora", "OSType": "linux", "Architecture": "amd64",
+				"Driver": "overlay", "CgroupDriver": "systemd", "SecurityOptions": []string{"name=seccomp,profile=default", "name=rootless"},
+				"MemoryLimit": true, "CpuCfsQuota": true,
+			},
+			version: `{"Version":"4.9.3","ApiVersion":"1.41","Components":[{"Name":"Podman Engine","Version":"4.9.3"}]}`,
+			want: Capabilities{
+				SecurityOptions: []string{"name=seccomp,profile=default", "name=rootless"},
+				ServerVersion:   "4.9.3", APIVersion: "1.41", Podman: true, OperatingSystem: "fedora",
+				OSType: "linux", Architecture: "amd64", CgroupVersion: 1, CgroupDriver: "systemd",
+				MemoryLimit: true, CPUQuota: true, StorageDriver: "overlay",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			fakeInfo(server, tt.info)
+			fakeVersion(server, tt.version)
+			if tt.df {
+				fakeDiskUsage(server, 3<<30)
+			}
+
+			client := NewTestClient(server.URL(), t)
+			caps, err := HostCapabilities(client)
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if caps.FetchedAt.IsZero() {
+				t.Error("expected the inspection time to be set")
+			}
+			caps.FetchedAt = time.Time{}
+			if !reflect.DeepEqual(caps, tt.want) {
+				t.Errorf("expected\n%+v\nbut found\n%+v", tt.want, caps)
+			}
+
+			raw, err := json.Marshal(caps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded Capabilities
+			if err = json.Unmarshal(raw, &decoded); err != nil || !reflect.DeepEqual(decoded, caps) {
+				t.Errorf("expected the capabilities to survive a JSON round trip but found %+v, %v", decoded, err)
+			}
+		})
+	}
+}
+
+func TestHostCapabilitiesCache(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	infos := 0
+	server.CustomHandler("/info", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infos++
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+	r := NewRunner(client)
+	image := createFakeImage(client)
+
+	caps, err := HostCapabilities(client)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	caps.Runtimes = append(caps.Runtimes, "mutated")
+	// the validation points of the runner reuse the cached capabilities
+	if _, err = r.FnContainer(ContainerOptions{Image: image, Memory: 256 << 20, NanoCPUs: 5e8}); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	cached, _ := HostCapabilities(client)
+	if infos != 1 || len(cached.Runtimes) != 0 {
+		t.Errorf("expected a single inspection of the daemon but found %d, %v", infos, cached.Runtimes)
+	}
+
+	InvalidateCapabilities(client)
+	HostCapabilities(client)
+	SetCapabilitiesTTL(0)
+	defer SetCapabilitiesTTL(DefaultCapabilitiesTTL)
+	HostCapabilities(client)
+	HostCapabilities(client)
+	if infos != 4 {
+		t.Errorf("expected the invalidated and the uncached capabilities to be inspected but found %d inspections", infos)
+	}
+}
+
+func TestRunnerFnContainerResourceLimits(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeInfo(server, map[string]interface{}{"MemoryLimit": true})
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+	r := NewRunner(client)
+
+	if _, err := r.FnContainer(ContainerOptions{Image: image, Memory: 256 << 20}); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	_, err := r.FnContainer(ContainerOptions{Image: image, Memory: 256 << 20, NanoCPUs: 5e8})
+	if limitErr, ok := err.(*ResourceLimitError); !ok || limitErr.Option != "NanoCPUs" || limitErr.Unwrap() != ErrResourceLimitNotSupported {
+		t.Errorf("expected the CPU limit to be refused but found %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package provision
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// StreamKind names the stream a chunk of output was written to
+type StreamKind string
+
+const (
+	// StreamStdout is the container stdout
+	StreamStdout StreamKind = "stdout"
+	// StreamStderr is the container stderr
+	StreamStderr StreamKind = "stderr"
+)
+
+// OutputChunk is a frame of output as sent by the daemon
+type OutputChunk struct {
+	Stream StreamKind `json:"stream"`
+	Time   time.Time  `json:"time"`
+	Data   []byte     `json:"data"`
+}
+
+// chunkRecorder keeps the demultiplexed frames of both streams in arrival order,
+// the daemon frames are written one at a time so each write is a whole frame
+type chunkRecorder struct {
+	mu       sync.Mutex
+	chunks   []OutputChunk
+	keep     bool
+	onOutput func(stream StreamKind, chunk []byte)
+}
+
+// writer returns a writer recording the chunks of stream before copying them to w
+func (c *chunkRecorder) writer(stream StreamKind, w io.Writer) io.Writer {
+	return &chunkWriter{recorder: c, stream: stream, w: w}
+}
+
+func (c *chunkRecorder) record(stream StreamKind, p []byte) {
+	c.mu.Lock()
+	// the lock is held while the callback runs so a slow callback delays
+	// the next frame instead of reordering it
+	defer c.mu.Unlock()
+	data := append([]byte(nil), p...)
+	if c.keep {
+		c.chunks = append(c.chunks, OutputChunk{Stream: stream, Time: time.Now(), Data: data})
+	}
+	if c.onOutput != nil {
+		c.onOutput(stream, data)
+	}
+}
+
+// recorded returns the chunks kept so far
+func (c *chunkRecorder) recorded() []OutputChunk {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]OutputChunk(nil), c.chunks...)
+}
+
+type chunkWriter struct {
+	recorder *chunkRecorder
+	stream   StreamKind
+	w        io.Writer
+}
+
+func (cw *chunkWriter) Write(p []byte) (n int, err error) {
+	cw.recorder.record(cw.stream, p)
+	return cw.w.Write(p)
+}
@@ -0,0 +1,139 @@
+package provision
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+type frame struct {
+	stream StreamKind
+	data   string
+}
+
+// interleavedFrames alternates writes to stdout and stderr
+func interleavedFrames(n int) (frames []frame) {
+	for i := 0; i < n; i++ {
+		stream := StreamStdout
+		if i%3 == 1 {
+			stream = StreamStderr
+		}
+		frames = append(frames, frame{stream: stream, data: fmt.Sprintf("%s line %d\n", stream, i)})
+	}
+	return
+}
+
+func encodeFrames(w io.Writer, frames []frame) {
+	for _, f := range frames {
+		header := make([]byte, 8)
+		header[0] = 1
+		if f.stream == StreamStderr {
+			header[0] = 2
+		}
+		binary.BigEndian.PutUint32(header[4:], uint32(len(f.data)))
+		_, _ = w.Write(append(header, f.data...))
+	}
+}
+
+// fakeFrames makes the logs and the attach stream of every container answer frames
+func fakeFrames(server *fake.DockerServer, frames []frame) {
+	server.CustomHandler("/containers/.*/logs", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		encodeFrames(w, frames)
+	}))
+	server.CustomHandler("/containers/.*/attach", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n"))
+		encodeFrames(conn, frames)
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}))
+}
+
+func TestRunnerRunCombinedOutput(t *testing.T) {
+	frames := interleavedFrames(100)
+	for _, strategy := range []OutputStrategy{OutputLogs, OutputAttach} {
+		t.Run(string(strategy), func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			fakeExit(server, 0, 0)
+			fakeFrames(server, frames)
+
+			var (
+				mu       sync.Mutex
+				received []frame
+			)
+			r := NewRunner(NewTestClient(server.URL(), t))
+			r.OutputStrategy = strategy
+			r.CombinedOutput = true
+			r.OnOutput = func(stream StreamKind, chunk []byte) {
+				mu.Lock()
+				defer mu.Unlock()
+				if len(received)%10 == 0 {
+					// a slow consumer must not reorder the frames
+					time.Sleep(time.Millisecond)
+				}
+				received = append(received, frame{stream, string(chunk)})
+			}
+			result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if len(result.Chunks) != len(frames) {
+				t.Fatalf("expected %d chunks but found %d", len(frames), len(result.Chunks))
+			}
+			var stdout, stderr string
+			for i, f := range frames {
+				chunk := result.Chunks[i]
+				if chunk.Stream != f.stream || string(chunk.Data) != f.data {
+					t.Fatalf("chunk %d: expected %s %q but found %s %q", i, f.stream, f.data, chunk.Stream, chunk.Data)
+				}
+				if chunk.Time.IsZero() {
+					t.Errorf("chunk %d has no timestamp", i)
+				}
+				if i > 0 && chunk.Time.Before(result.Chunks[i-1].Time) {
+					t.Errorf("chunk %d arrived before chunk %d", i, i-1)
+				}
+				if received[i] != f {
+					t.Fatalf("callback %d: expected %v but found %v", i, f, received[i])
+				}
+				if f.stream == StreamStdout {
+					stdout += f.data
+				} else {
+					stderr += f.data
+				}
+			}
+			if result.Stdout.String() != stdout || result.Stderr.String() != stderr {
+				t.Error("expected the separated streams to be kept")
+			}
+		})
+	}
+}
+
+func TestRunnerRunWithoutCombinedOutput(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeFrames(server, interleavedFrames(4))
+
+	r := NewRunner(NewTestClient(server.URL(), t))
+	r.OutputStrategy = OutputLogs
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Chunks != nil {
+		t.Errorf("expected no chunks but found %d", len(result.Chunks))
+	}
+}
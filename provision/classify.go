@@ -0,0 +1,194 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ErrorCategory is the kind of problem behind a daemon error, see DaemonError
+type ErrorCategory string
+
+const (
+	// CategoryPermissionDenied is an access to the daemon socket or to a file refused to the user
+	CategoryPermissionDenied ErrorCategory = "permission denied"
+	// CategoryRateLimited is a registry refusing the pulls beyond its rate limit
+	CategoryRateLimited ErrorCategory = "rate limited"
+	// CategoryDiskFull is a daemon host out of disk space
+	CategoryDiskFull ErrorCategory = "disk full"
+	// CategoryNetworkUnreachable is a daemon or a registry that can not be reached
+	CategoryNetworkUnreachable ErrorCategory = "network unreachable"
+	// CategoryAuthFailed is a registry refusing the credentials
+	CategoryAuthFailed ErrorCategory = "auth failed"
+	// CategoryNotFound is an image, a container or a network missing on the daemon
+	CategoryNotFound ErrorCategory = "not found"
+	// CategoryUnknown is a daemon error none of the other categories matches
+	CategoryUnknown ErrorCategory = "unknown"
+)
+
+// DaemonError is an error of the daemon, or of the way to it, classified with a short hint on
+// what to do about it. Err is the original error, errors.Is and errors.As see it through Unwrap
+// so the callers checking for the errors of the docker client keep working with them, e.g.
+// errors.As(err, &noSuchContainer) rather than err.(*docker.NoSuchContainer).
+type DaemonError struct {
+	Category ErrorCategory
+	Hint     string
+	Err      error
+}
+
+func (e *DaemonError) Error() string {
+	if e.Hint == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (%s: %s)", e.Err, e.Category, e.Hint)
+}
+
+// Unwrap returns the original error
+func (e *DaemonError) Unwrap() error {
+	return e.Err
+}
+
+// errorClass matches the errors of a category by their type, their status or their message
+type errorClass struct {
+	category ErrorCategory
+	hint     string
+	match    func(err error) bool
+	statuses []int
+	// patterns are lower case parts of the messages of the category
+	patterns []string
+}
+
+// errorClasses classify the daemon errors, the first matching class wins so the more
+// specific ones come first, e.g. a connection refused for its permissions is a permission problem
+var errorClasses = []errorClass{
+	{
+		category: CategoryPermissionDenied,
+		hint:     "the user lacks access to the docker socket or to a file, e.g. it is not in the docker group",
+		patterns: []string{"permission denied", "operation not permitted", "access is denied"},
+	},
+	{
+		category: CategoryRateLimited,
+		hint:     "the registry limits the pulls, authenticate with BuildOptions.Auth, use a mirror or retry later",
+		statuses: []int{http.StatusTooManyRequests},
+		patterns: []string{"toomanyrequests", "rate limit", "too many requests"},
+	},
+	{
+		category: CategoryDiskFull,
+		hint:     "the daemon host is out of disk space, remove the unused images and containers",
+		patterns: []string{"no space left on device", "disk quota exceeded", "not enough free disk"},
+	},
+	{
+		category: CategoryAuthFailed,
+		hint:     "the registry refused the credentials, check BuildOptions.Auth and the image name",
+		statuses: []int{http.StatusUnauthorized},
+		patterns: []string{
+			"unauthorized",
+			"authentication required",
+			"incorrect username or password",
+			"pull access denied",
+			"requested access to the resource is denied",
+		},
+	},
+	{
+		category: CategoryNetworkUnreachable,
+		hint:     "the daemon or the registry can not be reached, check that it runs and the endpoint, proxy and DNS",
+		match: func(err error) bool {
+			switch err.(type) {
+			case net.Error, *url.Error, *os.SyscallError:
+				return true
+			}
+			return err == docker.ErrConnectionRefused || err == docker.ErrInactivityTimeout
+		},
+		patterns: []string{
+			"cannot connect to the docker daemon",
+			"connection refused",
+			"connection reset by peer",
+			"no such host",
+			"network is unreachable",
+			"no route to host",
+			"i/o timeout",
+			"tls handshake timeout",
+			"dial unix",
+			"dial tcp",
+		},
+	},
+	{
+		category: CategoryNotFound,
+		hint:     "the image, container or network does not exist on the daemon",
+		match: func(err error) bool {
+			switch err.(type) {
+			case *docker.NoSuchContainer, *docker.NoSuchNetwork, *docker.NoSuchNetworkOrContainer, *docker.NoSuchExec:
+				return true
+			}
+			return err == docker.ErrNoSuchImage || err == docker.ErrNoSuchVolume
+		},
+		statuses: []int{http.StatusNotFound},
+		patterns: []string{"no such image", "no such container", "manifest unknown", "not found"},
+	},
+}
+
+// daemonError reports whether err comes from the docker client, as opposed to a plain error
+// that is only classified when its message matches a category
+func daemonError(err error) bool {
+	switch err.(type) {
+	case *docker.Error, *docker.NoSuchContainer, *docker.NoSuchNetwork, *docker.NoSuchNetworkOrContainer,
+		*docker.NoSuchExec, *docker.ContainerAlreadyRunning, *docker.ContainerNotRunning,
+		net.Error, *url.Error, *os.SyscallError:
+		return true
+	}
+	return err == docker.ErrConnectionRefused || err == docker.ErrInactivityTimeout ||
+		err == docker.ErrNoSuchImage || err == docker.ErrNoSuchVolume || err == docker.ErrContainerAlreadyExists
+}
+
+// ClassifyError wraps a daemon error into a DaemonError of the category it matches, CategoryUnknown
+// for the errors of the docker client matching none. The other errors are returned as is: nil,
+// the ends of a context, the errors of this package and those whose message matches no category.
+func ClassifyError(err error) error {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	if _, ok := err.(*DaemonError); ok {
+		return err
+	}
+	msg := err.Error()
+	if strings.HasPrefix(msg, "provision: ") {
+		return err
+	}
+	status := 0
+	if e, ok := err.(*docker.Error); ok {
+		status = e.Status
+	}
+	msg = strings.ToLower(msg)
+	for _, class := range errorClasses {
+		if class.matches(err, status, msg) {
+			return &DaemonError{Category: class.category, Hint: class.hint, Err: err}
+		}
+	}
+	if daemonError(err) {
+		return &DaemonError{Category: CategoryUnknown, Err: err}
+	}
+	return err
+}
+
+func (class errorClass) matches(err error, status int, msg string) bool {
+	if class.match != nil && class.match(err) {
+		return true
+	}
+	for _, s := range class.statuses {
+		if status == s {
+			return true
+		}
+	}
+	for _, pattern := range class.patterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestClassifyError(t *testing.T) {
+	// messages captured from daemons, registries and the docker client
+	tests := []struct {
+		err  error
+		want ErrorCategory
+	}{
+		{errors.New(`Get "http://unix.sock/images/json": dial unix /var/run/docker.sock: connect: permission denied`), CategoryPermissionDenied},
+		{&url.Error{Op: "Get", URL: "http://unix.sock/_ping", Err: &net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.EACCES)}}, CategoryPermissionDenied},
+		{&docker.Error{Status: 500, Message: "OCI runtime create failed: container_linux.go:380: starting container process caused: exec: \"/run.sh\": permission denied: unknown"}, CategoryPermissionDenied},
+		{errors.New("open //./pipe/docker_engine: Access is denied."), CategoryPermissionDenied},
+
+		{errors.New("toomanyrequests: You have reached your pull rate limit. You may increase the limit by authenticating and upgrading: https://www.docker.com/increase-rate-limit"), CategoryRateLimited},
+		{&docker.Error{Status: 429, Message: "Too Many Requests (HAP429)."}, CategoryRateLimited},
+		{errors.New("error parsing HTTP 429 response body: invalid character 'T' looking for beginning of value: \"Too Many Requests (HAP429).\\n\""), CategoryRateLimited},
+
+		{errors.New("write /var/lib/docker/tmp/GetImageBlob348612543: no space left on device"), CategoryDiskFull},
+		{errors.New("failed to register layer: Error processing tar file(exit status 1): write /usr/lib/x86_64-linux-gnu/libLLVM-11.so.1: no space left on device"), CategoryDiskFull},
+		{&docker.Error{Status: 500, Message: "mkdir /var/lib/docker/overlay2/1f0c/merged: disk quota exceeded"}, CategoryDiskFull},
+
+		{errors.New("unauthorized: authentication required"), CategoryAuthFailed},
+		{errors.New("Get \"https://registry-1.docker.io/v2/\": unauthorized: incorrect username or password"), CategoryAuthFailed},
+		{errors.New("pull access denied for gofn/missing, repository does not exist or may require 'docker login': denied: requested access to the resource is denied"), CategoryAuthFailed},
+		{&docker.Error{Status: 401, Message: "login attempt to https://ghcr.io/v2/ failed with status: 401 Unauthorized"}, CategoryAuthFailed},
+
+		{docker.ErrConnectionRefused, CategoryNetworkUnreachable},
+		{errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?"), CategoryNetworkUnreachable},
+		{errors.New("dial unix /var/run/docker.sock: connect: no such file or directory"), CategoryNetworkUnreachable},
+		{errors.New("Get \"https://registry-1.docker.io/v2/\": dial tcp: lookup registry-1.docker.io on 127.0.0.53:53: no such host"), CategoryNetworkUnreachable},
+		{errors.New("Get \"https://gcr.io/v2/\": net/http: TLS handshake timeout"), CategoryNetworkUnreachable},
+		{errors.New("dial tcp 10.0.0.5:2376: connect: no route to host"), CategoryNetworkUnreachable},
+		{errors.New("read tcp 172.17.0.1:51234->104.18.124.25:443: read: connection reset by peer"), CategoryNetworkUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, CategoryNetworkUnreachable},
+
+		{docker.ErrNoSuchImage, CategoryNotFound},
+		{&docker.NoSuchContainer{ID: "4fa6e0f0c678"}, CategoryNotFound},
+		{&docker.NoSuchNetwork{ID: "gofn-egress"}, CategoryNotFound},
+		{&docker.Error{Status: 404, Message: "no such image"}, CategoryNotFound},
+		{errors.New("manifest for gofn/app:v9 not found: manifest unknown: manifest unknown"), CategoryNotFound},
+
+		{&docker.Error{Status: 500, Message: "driver failed programming external connectivity on endpoint gofn: Bind for 0.0.0.0:8080 failed: port is already allocated"}, CategoryUnknown},
+		{&docker.ContainerNotRunning{ID: "4fa6e0f0c678"}, CategoryUnknown},
+	}
+	for _, tt := range tests {
+		err := ClassifyError(tt.err)
+		daemonErr, ok := err.(*DaemonError)
+		if !ok {
+			t.Errorf("expected a DaemonError for %q but found %v", tt.err, err)
+			continue
+		}
+		if daemonErr.Category != tt.want || daemonErr.Unwrap() != tt.err {
+			t.Errorf("expected %s for %q but found %s", tt.want, tt.err, daemonErr.Category)
+		}
+		if (daemonErr.Hint == "") != (tt.want == CategoryUnknown) || !strings.HasPrefix(err.Error(), tt.err.Error()) {
+			t.Errorf("unexpected message %q for %q", err, tt.err)
+		}
+		if ClassifyError(err) != err {
+			t.Errorf("expected a classified error to be left as is but found %v", ClassifyError(err))
+		}
+	}
+
+	// not from the daemon: the errors of the package, of contexts and those matching no category
+	for _, err := range []error{
+		nil,
+		ErrImageNotFound,
+		ErrContainerNotFound,
+		&HostFileNotFoundError{File: "CA bundle", Paths: []string{CACertsPath}},
+		ValidationErrors{{Field: "Image", Code: CodeRequired, Message: "the image is required"}},
+		context.Canceled,
+		context.DeadlineExceeded,
+		errors.New("boom"),
+	} {
+		if classified := ClassifyError(err); !reflect.DeepEqual(classified, err) {
+			t.Errorf("expected %v to be left as is but found %v", err, classified)
+		}
+	}
+}
+
+func TestFnStartClassifiesErrors(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+
+	err := FnStart(client, "missing")
+	daemonErr, ok := err.(*DaemonError)
+	if !ok || daemonErr.Category != CategoryNotFound {
+		t.Fatalf("expected a missing container but found %v", err)
+	}
+	if _, ok := daemonErr.Unwrap().(*docker.NoSuchContainer); !ok {
+		t.Errorf("expected the original error but found %v", daemonErr.Unwrap())
+	}
+	var noSuchContainer *docker.NoSuchContainer
+	if !errors.As(err, &noSuchContainer) || noSuchContainer.ID != "missing" {
+		t.Errorf("expected errors.As to reach the original error but found %v", err)
+	}
+}
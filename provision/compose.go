@@ -0,0 +1,457 @@
+package provision
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrUnsupportedCompose is raised in strict mode when a compose file uses unsupported settings
+	ErrUnsupportedCompose = errors.New("provision: unsupported compose settings")
+
+	// ErrComposeDependencyCycle is raised when the depends_on of the services form a cycle
+	ErrComposeDependencyCycle = errors.New("provision: compose services depend on each other")
+)
+
+// UnsupportedComposeError lists the settings of a compose file LoadComposeEnvironment can not honour
+type UnsupportedComposeError struct {
+	Path string
+	Keys []string
+}
+
+func (e *UnsupportedComposeError) Error() string {
+	return fmt.Sprintf("%v in %s: %s", ErrUnsupportedCompose, e.Path, strings.Join(e.Keys, ", "))
+}
+
+// Unwrap returns ErrUnsupportedCompose
+func (e *UnsupportedComposeError) Unwrap() error {
+	return ErrUnsupportedCompose
+}
+
+// supportedServiceKeys are the service settings translated into ServiceOptions
+var supportedServiceKeys = map[string]bool{
+	"image":       true,
+	"command":     true,
+	"environment": true,
+	"volumes":     true,
+	"ports":       true,
+	"depends_on":  true,
+}
+
+type composeConfig struct {
+	strict bool
+}
+
+// ComposeOption changes how LoadComposeEnvironment reads a compose file
+type ComposeOption func(*composeConfig)
+
+// WithStrictCompose makes LoadComposeEnvironment fail with an UnsupportedComposeError
+// instead of listing the unsupported settings in EnvironmentOptions.Ignored
+func WithStrictCompose() ComposeOption {
+	return func(c *composeConfig) {
+		c.strict = true
+	}
+}
+
+// LoadComposeEnvironment reads the services of a docker-compose v2/v3 file: their image, command,
+// environment, volumes, ports and depends_on. The services are ordered so each one starts after its
+// dependencies, relative bind sources are resolved from the directory of the file, and the other
+// settings are listed in Ignored, extension keys starting with x- are skipped silently.
+func LoadComposeEnvironment(path string, opts ...ComposeOption) (env EnvironmentOptions, err error) {
+	var config composeConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var doc map[string]interface{}
+	err = yaml.Unmarshal(raw, &doc)
+	if err != nil {
+		err = fmt.Errorf("provision: parsing %s: %v", path, err)
+		return
+	}
+	l := &composeLoader{dir: filepath.Dir(path)}
+	services := make(map[string]*ServiceOptions)
+	for key, value := range doc {
+		switch {
+		case key == "version" || strings.HasPrefix(key, "x-"):
+		case key == "services":
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("provision: %s: services must be a mapping", path)
+				return
+			}
+			for name, def := range m {
+				var service *ServiceOptions
+				service, err = l.service(name, def)
+				if err != nil {
+					err = fmt.Errorf("provision: %s: %v", path, err)
+					return
+				}
+				services[name] = service
+			}
+		default:
+			l.ignore(key)
+		}
+	}
+	if len(services) == 0 {
+		err = fmt.Errorf("provision: %s: no services", path)
+		return
+	}
+	env.Services, err = startOrder(services)
+	if err != nil {
+		return
+	}
+	sort.Strings(l.ignored)
+	if config.strict && len(l.ignored) > 0 {
+		err = &UnsupportedComposeError{Path: path, Keys: l.ignored}
+		return
+	}
+	env.Ignored = l.ignored
+	return
+}
+
+type composeLoader struct {
+	dir     string
+	ignored []string
+}
+
+func (l *composeLoader) ignore(key string) {
+	l.ignored = append(l.ignored, key)
+}
+
+func (l *composeLoader) service(name string, def interface{}) (service *ServiceOptions, err error) {
+	m, ok := def.(map[string]interface{})
+	if !ok {
+		err = fmt.Errorf("service %s must be a mapping", name)
+		return
+	}
+	service = &ServiceOptions{Name: name}
+	prefix := "services." + name + "."
+	for key, value := range m {
+		if !supportedServiceKeys[key] {
+			if !strings.HasPrefix(key, "x-") {
+				l.ignore(prefix + key)
+			}
+			continue
+		}
+		switch key {
+		case "image":
+			service.Container.Image, err = scalar(value)
+		case "command":
+			service.Container.Cmd, err = command(value)
+		case "environment":
+			service.Container.Env, err = environment(value)
+		case "volumes":
+			service.Container.Volumes, err = l.volumes(prefix+key, value)
+		case "ports":
+			service.Ports, err = l.ports(prefix+key, value)
+		case "depends_on":
+			service.DependsOn, err = l.dependsOn(prefix+key, value)
+		}
+		if err != nil {
+			err = fmt.Errorf("service %s: %s: %v", name, key, err)
+			return
+		}
+	}
+	if service.Container.Image == "" {
+		err = fmt.Errorf("service %s has no image, building images from compose files is not supported", name)
+	}
+	return
+}
+
+// scalar returns a string, number or boolean value as a string
+func scalar(value interface{}) (s string, err error) {
+	switch v := value.(type) {
+	case string:
+		s = v
+	case int, int64, uint64, float64, bool:
+		s = fmt.Sprint(v)
+	case nil:
+	default:
+		err = fmt.Errorf("expected a scalar but found %T", value)
+	}
+	return
+}
+
+func stringList(value interface{}) (list []string, err error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		err = fmt.Errorf("expected a list but found %T", value)
+		return
+	}
+	for _, item := range items {
+		var s string
+		s, err = scalar(item)
+		if err != nil {
+			return
+		}
+		list = append(list, s)
+	}
+	return
+}
+
+// command accepts the list form or a string split as a shell would
+func command(value interface{}) (cmd []string, err error) {
+	if s, ok := value.(string); ok {
+		return splitCommand(s)
+	}
+	return stringList(value)
+}
+
+// splitCommand splits s on blanks honouring single and double quotes and backslash escapes
+func splitCommand(s string) (args []string, err error) {
+	var current bytes.Buffer
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		err = fmt.Errorf("unterminated quote in %q", s)
+		return
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return
+}
+
+// environment accepts the list of KEY=VALUE and the mapping forms, a key without value
+// is passed as is so the daemon leaves the variable unset
+func environment(value interface{}) (env []string, err error) {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return stringList(value)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if m[k] == nil {
+			env = append(env, k)
+			continue
+		}
+		var v string
+		v, err = scalar(m[k])
+		if err != nil {
+			return
+		}
+		env = append(env, k+"="+v)
+	}
+	return
+}
+
+// volumes returns the binds of the short and long syntaxes, anonymous volumes and
+// other volume types are ignored
+func (l *composeLoader) volumes(key string, value interface{}) (binds []string, err error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		err = fmt.Errorf("expected a list but found %T", value)
+		return
+	}
+	for i, item := range items {
+		var source, target, mode string
+		switch v := item.(type) {
+		case string:
+			parts := strings.SplitN(v, ":", 3)
+			if len(parts) == 1 {
+				l.ignore(fmt.Sprintf("%s[%d]", key, i))
+				continue
+			}
+			source, target = parts[0], parts[1]
+			if len(parts) == 3 {
+				mode = parts[2]
+			}
+		case map[string]interface{}:
+			kind, _ := scalar(v["type"])
+			source, _ = scalar(v["source"])
+			target, _ = scalar(v["target"])
+			if (kind != "bind" && kind != "volume") || source == "" || target == "" {
+				l.ignore(fmt.Sprintf("%s[%d]", key, i))
+				continue
+			}
+			if readOnly, _ := v["read_only"].(bool); readOnly {
+				mode = "ro"
+			}
+			for option := range v {
+				if option != "type" && option != "source" && option != "target" && option != "read_only" {
+					l.ignore(fmt.Sprintf("%s[%d].%s", key, i, option))
+				}
+			}
+		default:
+			err = fmt.Errorf("unexpected volume %v", item)
+			return
+		}
+		if strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~") {
+			source = l.resolve(source)
+		}
+		bind := source + ":" + target
+		if mode != "" {
+			bind += ":" + mode
+		}
+		binds = append(binds, bind)
+	}
+	return
+}
+
+// resolve returns the absolute path of a bind source relative to the compose file
+func (l *composeLoader) resolve(source string) string {
+	if strings.HasPrefix(source, "~") {
+		return source
+	}
+	abs, err := filepath.Abs(filepath.Join(l.dir, source))
+	if err != nil {
+		return filepath.Join(l.dir, source)
+	}
+	return abs
+}
+
+// ports returns the short syntax of the published ports
+func (l *composeLoader) ports(key string, value interface{}) (ports []string, err error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		err = fmt.Errorf("expected a list but found %T", value)
+		return
+	}
+	for i, item := range items {
+		switch v := item.(type) {
+		case map[string]interface{}:
+			target, _ := scalar(v["target"])
+			if target == "" {
+				err = fmt.Errorf("port %d has no target", i)
+				return
+			}
+			port := target
+			if published, _ := scalar(v["published"]); published != "" {
+				port = published + ":" + port
+				if hostIP, _ := scalar(v["host_ip"]); hostIP != "" {
+					port = hostIP + ":" + port
+				}
+			}
+			if protocol, _ := scalar(v["protocol"]); protocol != "" {
+				port += "/" + protocol
+			}
+			for option := range v {
+				if option != "target" && option != "published" && option != "host_ip" && option != "protocol" {
+					l.ignore(fmt.Sprintf("%s[%d].%s", key, i, option))
+				}
+			}
+			ports = append(ports, port)
+		default:
+			var port string
+			port, err = scalar(item)
+			if err != nil {
+				return
+			}
+			ports = append(ports, port)
+		}
+	}
+	return
+}
+
+// dependsOn accepts the list form and the mapping form, only the service_started condition is supported
+func (l *composeLoader) dependsOn(key string, value interface{}) (deps []string, err error) {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		deps, err = stringList(value)
+		sort.Strings(deps)
+		return
+	}
+	for name, def := range m {
+		deps = append(deps, name)
+		conditions, _ := def.(map[string]interface{})
+		for option, v := range conditions {
+			if condition, _ := scalar(v); option == "condition" && condition == "service_started" {
+				continue
+			}
+			l.ignore(key + "." + name + "." + option)
+		}
+	}
+	sort.Strings(deps)
+	return
+}
+
+// startOrder sorts the services so each one comes after its dependencies, services
+// that can start at the same point are sorted by name
+func startOrder(services map[string]*ServiceOptions) (ordered []ServiceOptions, err error) {
+	pending := make(map[string]int, len(services))
+	dependents := make(map[string][]string)
+	for name, service := range services {
+		pending[name] = len(service.DependsOn)
+		for _, dep := range service.DependsOn {
+			if _, ok := services[dep]; !ok {
+				err = fmt.Errorf("provision: service %s depends on unknown service %s", name, dep)
+				return
+			}
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+	var ready []string
+	for name, n := range pending {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, *services[name])
+		for _, dependent := range dependents[name] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(ordered) < len(services) {
+		var cycle []string
+		for name, n := range pending {
+			if n > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		sort.Strings(cycle)
+		err = fmt.Errorf("%v: %s", ErrComposeDependencyCycle, strings.Join(cycle, ", "))
+		ordered = nil
+	}
+	return
+}
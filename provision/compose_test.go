@@ -0,0 +1,148 @@
+package provision
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// composeGolden is the part of a loaded environment compared with the golden files,
+// the directory of the fixtures is replaced by $DIR
+type composeGolden struct {
+	Services []composeGoldenService `json:"services"`
+	Ignored  []string               `json:"ignored"`
+}
+
+type composeGoldenService struct {
+	Name      string   `json:"name"`
+	Image     string   `json:"image"`
+	Cmd       []string `json:"cmd,omitempty"`
+	Env       []string `json:"env,omitempty"`
+	Volumes   []string `json:"volumes,omitempty"`
+	Ports     []string `json:"ports,omitempty"`
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+func TestLoadComposeEnvironmentGolden(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Join("testdata", "compose"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"basic", "v2"} {
+		t.Run(name, func(t *testing.T) {
+			env, err := LoadComposeEnvironment(filepath.Join("testdata", "compose", name+".yml"))
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			golden := composeGolden{Ignored: env.Ignored}
+			for _, s := range env.Services {
+				var volumes []string
+				for _, v := range s.Container.Volumes {
+					volumes = append(volumes, strings.Replace(v, dir, "$DIR", 1))
+				}
+				golden.Services = append(golden.Services, composeGoldenService{
+					Name:      s.Name,
+					Image:     s.Container.Image,
+					Cmd:       s.Container.Cmd,
+					Env:       s.Container.Env,
+					Volumes:   volumes,
+					Ports:     s.Ports,
+					DependsOn: s.DependsOn,
+				})
+			}
+			got, err := json.MarshalIndent(golden, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", "compose", name+".golden.json")
+			if *updateGolden {
+				if err = ioutil.WriteFile(path, append(got, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(want)) != string(got) {
+				t.Errorf("%s does not match the golden file\nwant:\n%s\ngot:\n%s", name, want, got)
+			}
+		})
+	}
+}
+
+func TestLoadComposeEnvironmentStrict(t *testing.T) {
+	_, err := LoadComposeEnvironment(filepath.Join("testdata", "compose", "v2.yml"), WithStrictCompose())
+	composeErr, ok := err.(*UnsupportedComposeError)
+	if !ok || composeErr.Unwrap() != ErrUnsupportedCompose {
+		t.Fatalf("expected an UnsupportedComposeError but found %v", err)
+	}
+	want := []string{
+		"networks",
+		"services.app.build",
+		"services.app.depends_on.db.condition",
+		"services.app.ports[0].mode",
+		"services.app.restart",
+		"services.app.volumes[1]",
+		"services.app.volumes[2].consistency",
+		"services.db.healthcheck",
+	}
+	if !reflect.DeepEqual(composeErr.Keys, want) {
+		t.Errorf("expected the unsupported keys %v but found %v", want, composeErr.Keys)
+	}
+
+	// a file with only supported settings passes the strict check and reaches the ordering
+	env, err := LoadComposeEnvironment(filepath.Join("testdata", "compose", "cycle.yml"), WithStrictCompose())
+	if err == nil || !strings.Contains(err.Error(), ErrComposeDependencyCycle.Error()) {
+		t.Errorf("expected a dependency cycle but found %v, %v", env, err)
+	}
+}
+
+func TestLoadComposeEnvironmentErrors(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    string
+	}{
+		{"cycle.yml", "depend on each other: a, b, c"},
+		{"build.yml", "service app has no image"},
+		{"unknown.yml", "depends on unknown service db"},
+		{"missing.yml", "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			_, err := LoadComposeEnvironment(filepath.Join("testdata", "compose", tt.fixture))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error containing %q but found %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := map[string][]string{
+		`python -m http.server`:      {"python", "-m", "http.server"},
+		`sh -c "echo 'hello world'"`: {"sh", "-c", "echo 'hello world'"},
+		`echo it\'s  ''`:             {"echo", "it's", ""},
+		"  spaced\targs \n":          {"spaced", "args"},
+		`printf "a\"b"`:              {"printf", `a"b`},
+	}
+	for cmd, want := range tests {
+		got, err := splitCommand(cmd)
+		if err != nil {
+			t.Errorf("splitCommand(%q) failed: %v", cmd, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("splitCommand(%q) = %q, want %q", cmd, got, want)
+		}
+	}
+	if _, err := splitCommand(`echo "open`); err == nil {
+		t.Error("expected an unterminated quote error")
+	}
+}
@@ -0,0 +1,555 @@
+// Package config loads the settings of gofn from a YAML or JSON file and applies them to
+// the runner and the options of the provision package
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/iaas"
+	"github.com/gofn/gofn/provision"
+	yaml "gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrUnknownField is raised for a field of the file Config does not have
+	ErrUnknownField = errors.New("config: unknown field")
+
+	// ErrUnsetVariable is raised when a value references an environment variable that is not set
+	ErrUnsetVariable = errors.New("config: environment variable not set")
+
+	// ErrInvalidField is raised for a value of the wrong type or rejected by the validation
+	ErrInvalidField = errors.New("config: invalid field")
+)
+
+// Config is the content of a configuration file, see LoadConfig
+type Config struct {
+	Conventions Conventions `yaml:"conventions"`
+	Limits      Limits      `yaml:"limits"`
+	Pull        Pull        `yaml:"pull"`
+	// Registries are the credentials of the registries keyed by host, e.g. ghcr.io, the
+	// images of Docker Hub use the docker.io entry
+	Registries map[string]Registry `yaml:"registries"`
+	Iaas       Iaas                `yaml:"iaas"`
+	Prune      Prune               `yaml:"prune"`
+}
+
+// Conventions are the defaults of the images and containers of the deployment
+type Conventions struct {
+	// PrefixImageName prefixes the built images with gofn/, the default when unset
+	PrefixImageName *bool  `yaml:"prefix_image_name"`
+	Dockerfile      string `yaml:"dockerfile"`
+	Network         string `yaml:"network"`
+	Runtime         string `yaml:"runtime"`
+	RunAsNonRoot    bool   `yaml:"run_as_non_root"`
+	NonRootUser     string `yaml:"non_root_user"`
+	InjectCACerts   bool   `yaml:"inject_ca_certs"`
+	Timezone        string `yaml:"timezone"`
+	AutoRemove      bool   `yaml:"auto_remove"`
+	PinToImageID    bool   `yaml:"pin_to_image_id"`
+	// OutputStrategy is attach or logs, the runner picks one when empty
+	OutputStrategy string `yaml:"output_strategy"`
+}
+
+// Limits bound the runs and the disk used by the images
+type Limits struct {
+	Timeouts Timeouts `yaml:"timeouts"`
+	// SizeMargin and HostDiskSize are sizes in bytes or human ones, e.g. 2GB
+	SizeMargin   Size `yaml:"size_margin"`
+	HostDiskSize Size `yaml:"host_disk_size"`
+}
+
+// Timeouts are the budgets of the phases of Runner.Run, e.g. 30s
+type Timeouts struct {
+	EnsureImage     time.Duration `yaml:"ensure_image"`
+	ContainerCreate time.Duration `yaml:"container_create"`
+	Start           time.Duration `yaml:"start"`
+	Execution       time.Duration `yaml:"execution"`
+	LogCollection   time.Duration `yaml:"log_collection"`
+}
+
+// Pull is how the images are pulled
+type Pull struct {
+	Force bool `yaml:"force"`
+	// Policy is always, if_not_present or never, see provision.PullPolicy
+	Policy        string `yaml:"policy"`
+	SkipSizeCheck bool   `yaml:"skip_size_check"`
+}
+
+// Registry are the credentials of a registry, a username and a password or an identity token
+type Registry struct {
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	Email         string `yaml:"email"`
+	IdentityToken string `yaml:"identity_token"`
+}
+
+// Iaas are the defaults of the machines created by the iaas providers
+type Iaas struct {
+	// Provider is digitalocean, google, amazonec2 or tcp
+	Provider   string `yaml:"provider"`
+	Region     string `yaml:"region"`
+	Size       string `yaml:"size"`
+	Image      string `yaml:"image"`
+	DiskSize   int    `yaml:"disk_size"`
+	KeyID      int    `yaml:"key_id"`
+	SSHKeyPath string `yaml:"ssh_key_path"`
+}
+
+// Prune are the schedules removing the unused images and containers
+type Prune struct {
+	Images     PruneSchedule `yaml:"images"`
+	Containers PruneSchedule `yaml:"containers"`
+}
+
+// PruneSchedule removes the resources unused for OlderThan every Every, zero disables it
+type PruneSchedule struct {
+	Every     time.Duration `yaml:"every"`
+	OlderThan time.Duration `yaml:"older_than"`
+}
+
+// Size is a number of bytes, written in the file as a number or a human size, e.g. 512MB
+type Size int64
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (s *Size) UnmarshalYAML(node *yaml.Node) (err error) {
+	var n int64
+	if node.Decode(&n) == nil {
+		*s = Size(n)
+		return
+	}
+	n, err = units.FromHumanSize(node.Value)
+	if err != nil {
+		return fmt.Errorf("%q is not a size", node.Value)
+	}
+	*s = Size(n)
+	return
+}
+
+// FieldError is a problem of a field of a configuration file
+type FieldError struct {
+	File string
+	// Path is the YAML path of the field, e.g. limits.timeouts.execution
+	Path string
+	// Line is the line of the field in the file, 0 when it is not in the file
+	Line    int
+	Message string
+	// Err is ErrUnknownField, ErrUnsetVariable or ErrInvalidField
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("config: %s:%d: %s: %s", e.File, e.Line, e.Path, e.Message)
+	}
+	return fmt.Sprintf("config: %s: %s: %s", e.File, e.Path, e.Message)
+}
+
+// Unwrap returns the kind of the problem
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Errors are the problems of a configuration file, returned by LoadConfig
+type Errors []*FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// LoadConfig reads the configuration file at path, YAML or JSON. The values may reference
+// environment variables as ${VAR}, or ${VAR:-default} when it may be unset, $$ is a literal $.
+// The fields Config does not have are errors, as are the values failing the validation:
+// all the problems are returned together as Errors.
+func LoadConfig(path string) (c *Config, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	return parse(path, raw, os.LookupEnv)
+}
+
+func parse(file string, raw []byte, lookup func(string) (string, bool)) (c *Config, err error) {
+	var doc yaml.Node
+	err = yaml.Unmarshal(raw, &doc)
+	if err != nil {
+		err = fmt.Errorf("config: parsing %s: %v", file, err)
+		return
+	}
+	d := &decoder{file: file, lookup: lookup, lines: map[string]int{}}
+	c = &Config{}
+	if len(doc.Content) > 0 {
+		d.decode(doc.Content[0], "", reflect.ValueOf(c).Elem())
+	}
+	c.validate(d)
+	if len(d.errs) > 0 {
+		c, err = nil, d.errs
+	}
+	return
+}
+
+// decoder fills a Config from the nodes of the file, reporting the problems with their path
+type decoder struct {
+	file   string
+	lookup func(string) (string, bool)
+	// lines are the lines of the decoded fields by path
+	lines map[string]int
+	errs  Errors
+}
+
+func (d *decoder) fail(path string, line int, kind error, format string, args ...interface{}) {
+	d.errs = append(d.errs, &FieldError{File: d.file, Path: path, Line: line, Message: fmt.Sprintf(format, args...), Err: kind})
+}
+
+func (d *decoder) decode(node *yaml.Node, path string, v reflect.Value) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	d.lines[path] = node.Line
+	if node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null" {
+		return
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if _, ok := v.Addr().Interface().(yaml.Unmarshaler); ok {
+		d.scalar(node, path, v)
+		return
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			d.fail(path, node.Line, ErrInvalidField, "must be a mapping")
+			return
+		}
+		fields := yamlFields(v.Type())
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			index, ok := fields[key]
+			if !ok {
+				d.fail(join(path, key), node.Content[i].Line, ErrUnknownField, "unknown field %q", key)
+				continue
+			}
+			d.decode(value, join(path, key), v.Field(index))
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			d.fail(path, node.Line, ErrInvalidField, "must be a mapping")
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			elem := reflect.New(v.Type().Elem()).Elem()
+			d.decode(node.Content[i+1], join(path, key), elem)
+			v.SetMapIndex(reflect.ValueOf(key), elem)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			d.fail(path, node.Line, ErrInvalidField, "must be a sequence")
+			return
+		}
+		slice := reflect.MakeSlice(v.Type(), len(node.Content), len(node.Content))
+		for i, item := range node.Content {
+			d.decode(item, fmt.Sprintf("%s[%d]", path, i), slice.Index(i))
+		}
+		v.Set(slice)
+	default:
+		d.scalar(node, path, v)
+	}
+}
+
+// scalar decodes node into v once its environment variables are replaced
+func (d *decoder) scalar(node *yaml.Node, path string, v reflect.Value) {
+	if node.Kind != yaml.ScalarNode {
+		d.fail(path, node.Line, ErrInvalidField, "must be a scalar")
+		return
+	}
+	value, missing, err := interpolate(node.Value, d.lookup)
+	if err != nil {
+		d.fail(path, node.Line, ErrInvalidField, "%v", err)
+		return
+	}
+	for _, name := range missing {
+		d.fail(path, node.Line, ErrUnsetVariable, "${%s} is not set", name)
+	}
+	if len(missing) > 0 {
+		return
+	}
+	n := *node
+	n.Value = value
+	if node.Style == 0 {
+		// the type of a plain value is the one of its interpolated text, e.g. an int
+		n.Tag = ""
+	}
+	if err = n.Decode(v.Addr().Interface()); err != nil {
+		msg := err.Error()
+		if e, ok := err.(*yaml.TypeError); ok && len(e.Errors) > 0 {
+			msg = e.Errors[0]
+			if i := strings.Index(msg, ": "); strings.HasPrefix(msg, "line ") && i >= 0 {
+				msg = msg[i+2:]
+			}
+		}
+		d.fail(path, node.Line, ErrInvalidField, "%s", msg)
+	}
+}
+
+// interpolate replaces ${VAR} and ${VAR:-default} in s, missing lists the unset variables without a default
+func interpolate(s string, lookup func(string) (string, bool)) (value string, missing []string, err error) {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				err = fmt.Errorf("unterminated variable in %q", s)
+				return
+			}
+			ref := s[i+2 : i+end]
+			name, def, hasDefault := ref, "", false
+			if j := strings.Index(ref, ":-"); j >= 0 {
+				name, def, hasDefault = ref[:j], ref[j+2:], true
+			}
+			if name == "" {
+				err = fmt.Errorf("empty variable name in %q", s)
+				return
+			}
+			if env, ok := lookup(name); ok && (env != "" || !hasDefault) {
+				b.WriteString(env)
+			} else if hasDefault {
+				b.WriteString(def)
+			} else {
+				missing = append(missing, name)
+			}
+			i += end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	value = b.String()
+	return
+}
+
+// yamlFields returns the index of the fields of t by their yaml name
+func yamlFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+	return fields
+}
+
+// join appends key to path, the keys containing a dot, e.g. a registry host, are quoted
+func join(path, key string) string {
+	if strings.Contains(key, ".") {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// containerFields are the paths of the fields of ContainerOptions validated by the provision package
+var containerFields = map[string]string{
+	"Network":        "conventions.network",
+	"Runtime":        "conventions.runtime",
+	"NonRootUser":    "conventions.non_root_user",
+	"InjectTimezone": "conventions.timezone",
+}
+
+// iaasProviders are the known values of iaas.provider
+var iaasProviders = map[string]bool{"": true, "digitalocean": true, "google": true, "amazonec2": true, "tcp": true}
+
+func (c *Config) validate(d *decoder) {
+	invalid := func(path, format string, args ...interface{}) {
+		d.fail(path, d.lines[path], ErrInvalidField, format, args...)
+	}
+	var container provision.ContainerOptions
+	c.ApplyToContainer(&container)
+	for _, e := range provision.ValidateContainerOptions(container) {
+		if path, ok := containerFields[e.Field]; ok {
+			invalid(path, "%s", e.Message)
+		}
+	}
+	switch provision.OutputStrategy(c.Conventions.OutputStrategy) {
+	case provision.OutputAuto, provision.OutputAttach, provision.OutputLogs:
+	default:
+		invalid("conventions.output_strategy", "unknown output strategy %q, expected attach or logs", c.Conventions.OutputStrategy)
+	}
+	switch provision.PullPolicy(c.Pull.Policy) {
+	case provision.PullDefault, provision.PullAlways, provision.PullIfNotPresent, provision.PullNever:
+	default:
+		invalid("pull.policy", "unknown pull policy %q, expected always, if_not_present or never", c.Pull.Policy)
+	}
+	quantities := []struct {
+		path  string
+		value int64
+	}{
+		{"limits.timeouts.ensure_image", int64(c.Limits.Timeouts.EnsureImage)},
+		{"limits.timeouts.container_create", int64(c.Limits.Timeouts.ContainerCreate)},
+		{"limits.timeouts.start", int64(c.Limits.Timeouts.Start)},
+		{"limits.timeouts.execution", int64(c.Limits.Timeouts.Execution)},
+		{"limits.timeouts.log_collection", int64(c.Limits.Timeouts.LogCollection)},
+		{"prune.images.every", int64(c.Prune.Images.Every)},
+		{"prune.images.older_than", int64(c.Prune.Images.OlderThan)},
+		{"prune.containers.every", int64(c.Prune.Containers.Every)},
+		{"prune.containers.older_than", int64(c.Prune.Containers.OlderThan)},
+		{"limits.size_margin", int64(c.Limits.SizeMargin)},
+		{"limits.host_disk_size", int64(c.Limits.HostDiskSize)},
+		{"iaas.disk_size", int64(c.Iaas.DiskSize)},
+	}
+	for _, q := range quantities {
+		if q.value < 0 {
+			invalid(q.path, "can not be negative")
+		}
+	}
+	hosts := make([]string, 0, len(c.Registries))
+	for host := range c.Registries {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		registry := c.Registries[host]
+		if registry.IdentityToken == "" && (registry.Username == "" || registry.Password == "") {
+			invalid(join("registries", host), "needs a username and a password or an identity token")
+		}
+	}
+	if !iaasProviders[c.Iaas.Provider] {
+		invalid("iaas.provider", "unknown provider %q", c.Iaas.Provider)
+	}
+}
+
+// RegistryAuth returns the credentials of Registries as an AuthProvider
+func (c *Config) RegistryAuth() provision.RegistryAuth {
+	auth := make(provision.RegistryAuth, len(c.Registries))
+	for host, registry := range c.Registries {
+		auth[host] = docker.AuthConfiguration{
+			Username:      registry.Username,
+			Password:      registry.Password,
+			Email:         registry.Email,
+			IdentityToken: registry.IdentityToken,
+			ServerAddress: host,
+		}
+	}
+	return auth
+}
+
+// ProviderOpts returns the options of the iaas providers for the Iaas defaults
+func (c *Config) ProviderOpts() (opts []iaas.ProviderOpts) {
+	if c.Iaas.Region != "" {
+		opts = append(opts, iaas.WithRegion(c.Iaas.Region))
+	}
+	if c.Iaas.Size != "" {
+		opts = append(opts, iaas.WithSize(c.Iaas.Size))
+	}
+	if c.Iaas.Image != "" {
+		opts = append(opts, iaas.WithSO(c.Iaas.Image))
+	}
+	if c.Iaas.DiskSize != 0 {
+		opts = append(opts, iaas.WithDiskSize(c.Iaas.DiskSize))
+	}
+	if c.Iaas.KeyID != 0 {
+		opts = append(opts, iaas.WithKeyID(c.Iaas.KeyID))
+	}
+	if c.Iaas.SSHKeyPath != "" {
+		opts = append(opts, iaas.WithSSHKeyPath(c.Iaas.SSHKeyPath))
+	}
+	return
+}
+
+// The ApplyTo methods merge the file values under the ones set by the code: a field is only
+// set from the file when it has its zero value, so a false flag is always taken from the file.
+
+// ApplyToRunner sets the timeouts, output strategy and pull checks of r
+func (c *Config) ApplyToRunner(r *provision.Runner) {
+	t, limits := &r.Timeouts, c.Limits.Timeouts
+	setDuration(&t.EnsureImage, limits.EnsureImage)
+	setDuration(&t.ContainerCreate, limits.ContainerCreate)
+	setDuration(&t.Start, limits.Start)
+	setDuration(&t.Execution, limits.Execution)
+	setDuration(&t.LogCollection, limits.LogCollection)
+	if r.OutputStrategy == provision.OutputAuto {
+		r.OutputStrategy = provision.OutputStrategy(c.Conventions.OutputStrategy)
+	}
+	r.SkipSizeCheck = r.SkipSizeCheck || c.Pull.SkipSizeCheck
+	if r.SizeMargin == 0 {
+		r.SizeMargin = int64(c.Limits.SizeMargin)
+	}
+	if r.HostDiskSize == 0 {
+		r.HostDiskSize = int64(c.Limits.HostDiskSize)
+	}
+}
+
+// ApplyToBuild sets the Dockerfile, the image prefix, the pull policy, the credentials of the
+// registry of the image of opts and those of the registries of its base images
+func (c *Config) ApplyToBuild(opts *provision.BuildOptions) {
+	setString(&opts.Dockerfile, c.Conventions.Dockerfile)
+	if prefix := c.Conventions.PrefixImageName; prefix != nil && !*prefix {
+		opts.DoNotUsePrefixImageName = true
+	}
+	opts.ForcePull = opts.ForcePull || c.Pull.Force
+	if opts.PullPolicy == provision.PullDefault {
+		opts.PullPolicy = provision.PullPolicy(c.Pull.Policy)
+	}
+	if opts.Auth == (docker.AuthConfiguration{}) && opts.ImageName != "" {
+		opts.Auth, _ = c.RegistryAuth().Auth(context.Background(), opts.GetImageName())
+	}
+	if opts.AuthConfigs == nil && len(c.Registries) > 0 {
+		opts.AuthConfigs = c.RegistryAuth()
+	}
+}
+
+// ApplyToContainer sets the network, runtime, user and injected files of opts
+func (c *Config) ApplyToContainer(opts *provision.ContainerOptions) {
+	conventions := c.Conventions
+	setString(&opts.Network, conventions.Network)
+	setString(&opts.Runtime, conventions.Runtime)
+	setString(&opts.NonRootUser, conventions.NonRootUser)
+	setString(&opts.InjectTimezone, conventions.Timezone)
+	opts.RunAsNonRoot = opts.RunAsNonRoot || conventions.RunAsNonRoot
+	opts.InjectCACerts = opts.InjectCACerts || conventions.InjectCACerts
+	opts.AutoRemove = opts.AutoRemove || conventions.AutoRemove
+	opts.PinToImageID = opts.PinToImageID || conventions.PinToImageID
+}
+
+func setString(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+func setDuration(field *time.Duration, value time.Duration) {
+	if *field == 0 {
+		*field = value
+	}
+}
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/provision"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// fixtureEnv are the environment variables referenced by the fixtures
+var fixtureEnv = map[string]string{
+	"GOFN_NETWORK":           "backend",
+	"GOFN_TZ":                "",
+	"GOFN_EXECUTION_TIMEOUT": "2m30s",
+	"DOCKER_PASSWORD":        "hunter2",
+	"GHCR_TOKEN":             "ghcr-token",
+	"GOFN_DISK_SIZE":         "50",
+	"GOFN_KEY_ID":            "key-1234",
+}
+
+func lookupFixture(name string) (value string, ok bool) {
+	value, ok = fixtureEnv[name]
+	return
+}
+
+// golden compares got with the golden file name of testdata, rewritten with -update
+func golden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, append(got, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(want)) != string(got) {
+		t.Errorf("%s does not match the golden file\nwant:\n%s\ngot:\n%s", name, want, got)
+	}
+}
+
+func TestLoadConfigGolden(t *testing.T) {
+	for name, value := range fixtureEnv {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	c, err := LoadConfig(filepath.Join("testdata", "full.yml"))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	got, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "full.golden.json", got)
+	if c.Limits.Timeouts.Execution != 150*time.Second || c.Limits.SizeMargin != 2000000000 || c.Conventions.Timezone != "Europe/Paris" {
+		t.Errorf("unexpected values %+v", c.Limits)
+	}
+	if password := c.Registries["docker.io"].Password; password != "p$ss-hunter2" {
+		t.Errorf("expected the interpolated password but found %q", password)
+	}
+
+	fromJSON, err := LoadConfig(filepath.Join("testdata", "full.json"))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !reflect.DeepEqual(fromJSON, c) {
+		t.Errorf("expected the JSON file to match the YAML one but found %+v", fromJSON)
+	}
+}
+
+func TestLoadConfigErrorsGolden(t *testing.T) {
+	for _, name := range []string{"unknown", "interpolation", "invalid"} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join("testdata", name+".yml")
+			raw, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := parse(name+".yml", raw, lookupFixture)
+			errs, ok := err.(Errors)
+			if !ok || c != nil {
+				t.Fatalf("expected Errors but found %v, %+v", err, c)
+			}
+			lines := make([]string, len(errs))
+			for i, e := range errs {
+				lines[i] = e.Error()
+			}
+			golden(t, name+".golden.txt", []byte(strings.Join(lines, "\n")))
+		})
+	}
+}
+
+func TestLoadConfigErrorKinds(t *testing.T) {
+	kinds := func(raw string) (found []error) {
+		_, err := parse("gofn.yml", []byte(raw), lookupFixture)
+		errs, _ := err.(Errors)
+		for _, e := range errs {
+			found = append(found, e.Unwrap())
+		}
+		return
+	}
+	tests := []struct {
+		raw  string
+		want []error
+	}{
+		{"pull:\n  forse: true\n", []error{ErrUnknownField}},
+		{"iaas:\n  region: ${GOFN_REGION}\n", []error{ErrUnsetVariable}},
+		{"iaas:\n  region: ${GOFN_REGION:-nyc3}\n  size: ${GOFN_SIZE}\n", []error{ErrUnsetVariable}},
+		{"pull: [force]\niaas:\n  provider: aws\n", []error{ErrInvalidField, ErrInvalidField}},
+		{"pull:\n  policy: sometimes\n", []error{ErrInvalidField}},
+		{"iaas:\n  region: nyc3\n", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if found := kinds(tt.raw); !reflect.DeepEqual(found, tt.want) {
+			t.Errorf("expected %v for %q but found %v", tt.want, tt.raw, found)
+		}
+	}
+
+	if _, err := parse("gofn.yml", []byte("pull: [force"), lookupFixture); err == nil || !strings.Contains(err.Error(), "parsing gofn.yml") {
+		t.Errorf("expected a parsing error but found %v", err)
+	}
+	if _, err := LoadConfig(filepath.Join("testdata", "missing.yml")); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file but found %v", err)
+	}
+}
+
+func TestApplyTo(t *testing.T) {
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "full.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parse("full.yml", raw, lookupFixture)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+
+	r := provision.NewRunner(nil)
+	r.Timeouts.Start = time.Second
+	c.ApplyToRunner(r)
+	timeouts := provision.Timeouts{
+		EnsureImage:     5 * time.Minute,
+		ContainerCreate: 30 * time.Second,
+		Start:           time.Second,
+		Execution:       150 * time.Second,
+		LogCollection:   15 * time.Second,
+	}
+	if r.Timeouts != timeouts || r.OutputStrategy != provision.OutputLogs || r.SizeMargin != 2000000000 || r.HostDiskSize != 107374182400 {
+		t.Errorf("unexpected runner %+v", r)
+	}
+
+	build := provision.BuildOptions{ImageName: "ghcr.io/gofn/app", Dockerfile: "Dockerfile"}
+	c.ApplyToBuild(&build)
+	auth := docker.AuthConfiguration{IdentityToken: "ghcr-token", ServerAddress: "ghcr.io"}
+	if build.Dockerfile != "Dockerfile" || !build.DoNotUsePrefixImageName || !build.ForcePull || build.PullPolicy != provision.PullIfNotPresent || build.Auth != auth {
+		t.Errorf("unexpected build options %+v", build)
+	}
+	hub := provision.BuildOptions{ImageName: "gofn/app", DoNotUsePrefixImageName: true}
+	c.ApplyToBuild(&hub)
+	if hub.Auth.Username != "gofn" || hub.Auth.Password != "p$ss-hunter2" || hub.Dockerfile != "Dockerfile.gofn" {
+		t.Errorf("expected the Docker Hub credentials but found %+v", hub)
+	}
+	if len(hub.AuthConfigs) != 2 || hub.AuthConfigs["ghcr.io"] != auth {
+		t.Errorf("expected the credentials of every registry but found %v", hub.AuthConfigs)
+	}
+
+	container := provision.ContainerOptions{Image: "gofn/app", Network: "frontend"}
+	c.ApplyToContainer(&container)
+	want := provision.ContainerOptions{
+		Image:          "gofn/app",
+		Network:        "frontend",
+		Runtime:        "runsc",
+		RunAsNonRoot:   true,
+		NonRootUser:    "65534:65534",
+		InjectCACerts:  true,
+		InjectTimezone: "Europe/Paris",
+		PinToImageID:   true,
+	}
+	if !reflect.DeepEqual(container, want) {
+		t.Errorf("expected %+v but found %+v", want, container)
+	}
+
+	if opts := c.ProviderOpts(); len(opts) != 6 {
+		t.Errorf("expected the options of the iaas defaults but found %d", len(opts))
+	}
+}
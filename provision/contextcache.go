@@ -0,0 +1,261 @@
+package provision
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	units "github.com/docker/go-units"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DefaultManifestDir is the directory of the manifests of a ContextCache without a Store
+var DefaultManifestDir = filepath.Join(os.TempDir(), "gofn", "manifests")
+
+// ManifestEntry describes a file of a build context
+type ManifestEntry struct {
+	Size int64       `json:"size"`
+	Mode os.FileMode `json:"mode"`
+	// Hash is the sha256 of the content of the file, or of the target of a symlink
+	Hash string `json:"hash"`
+}
+
+// ContextManifest describes the build context of the last successful build of an image
+type ContextManifest struct {
+	// Params is the hash of the options changing the result of the build whatever the context,
+	// a manifest with other params is stale
+	Params string `json:"params"`
+	// ImageID is the ID of the image built from the context
+	ImageID string `json:"image_id"`
+	// Files are the files of the context by their slash separated path
+	Files map[string]ManifestEntry `json:"files"`
+}
+
+// ContextDelta are the files of a build context that changed since the previous build
+type ContextDelta struct {
+	Added, Changed, Removed []string
+	// ContextSize is the size of the whole context and DeltaSize the size of the added and changed files
+	ContextSize, DeltaSize int64
+}
+
+// ManifestStore stores the manifests of the build contexts
+type ManifestStore interface {
+	// Load returns the manifest stored as key, nil when there is none
+	Load(key string) (*ContextManifest, error)
+	// Save stores m as key, replacing the previous manifest
+	Save(key string, m *ContextManifest) error
+}
+
+// FileManifestStore stores the manifests as JSON files of Dir
+type FileManifestStore struct {
+	Dir string
+}
+
+func (s FileManifestStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Load returns the manifest stored as key, a missing file is no manifest
+func (s FileManifestStore) Load(key string) (m *ContextManifest, err error) {
+	raw, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	m = &ContextManifest{}
+	err = json.Unmarshal(raw, m)
+	if err != nil {
+		m = nil
+	}
+	return
+}
+
+// Save replaces the manifest stored as key atomically
+func (s FileManifestStore) Save(key string, m *ContextManifest) (err error) {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(s.Dir, 0700)
+	if err != nil {
+		return
+	}
+	path := s.path(key)
+	tmp, err := ioutil.TempFile(s.Dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(raw)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), path)
+	return
+}
+
+// ContextCache skips the upload of a build context unchanged since the previous build of the
+// image on the same daemon, the image built then is reused as long as the daemon still has it.
+// A context with changed files is uploaded whole, the size of the changes is written to the
+// output of the build. The manifests are invalidated by a change of the Dockerfile or of the
+// options of the build. The .dockerignore file is not honored, an ignored file that changed
+// makes the image be rebuilt.
+type ContextCache struct {
+	// Store stores the manifests, a FileManifestStore in DefaultManifestDir when nil
+	Store ManifestStore
+	// OnDelta is called with the changes of a context that was already built with the same options
+	OnDelta func(ContextDelta)
+}
+
+func (c *ContextCache) store() ManifestStore {
+	if c.Store == nil {
+		return FileManifestStore{Dir: DefaultManifestDir}
+	}
+	return c.Store
+}
+
+// build builds the image name with the builder of opts unless its context is unchanged
+func (c *ContextCache) build(ctx context.Context, client *docker.Client, name string, opts *BuildOptions, stdout io.Writer) (err error) {
+	manifest, err := contextManifest(opts)
+	if err != nil {
+		return
+	}
+	store := c.store()
+	key := client.Endpoint() + "|" + name
+	// an unreadable manifest is a cold cache
+	previous, _ := store.Load(key)
+	if previous != nil && previous.Params == manifest.Params {
+		delta := diffManifests(previous, manifest)
+		unchanged := len(delta.Added)+len(delta.Changed)+len(delta.Removed) == 0
+		// NoCache builds the image again from the same context
+		if unchanged && !opts.NoCache {
+			image, inspectErr := client.InspectImage(name)
+			if inspectErr == nil && image.ID == previous.ImageID {
+				fmt.Fprintf(stdout, "build context unchanged, reusing image %s\n", image.ID)
+				return
+			}
+		} else if !unchanged {
+			fmt.Fprintf(stdout, "build context changed: %d added, %d changed, %d removed, %s of %s\n",
+				len(delta.Added), len(delta.Changed), len(delta.Removed),
+				units.HumanSize(float64(delta.DeltaSize)), units.HumanSize(float64(delta.ContextSize)))
+			if c.OnDelta != nil {
+				c.OnDelta(delta)
+			}
+		}
+	}
+	err = opts.builder().Build(ctx, client, name, opts, stdout)
+	if err != nil {
+		return
+	}
+	image, inspectErr := client.InspectImage(name)
+	if inspectErr != nil {
+		return
+	}
+	manifest.ImageID = image.ID
+	// the image is built, a manifest that cannot be stored only costs the next upload
+	store.Save(key, manifest)
+	return
+}
+
+// contextManifest describes the context directory of opts
+func contextManifest(opts *BuildOptions) (m *ContextManifest, err error) {
+	m = &ContextManifest{Files: make(map[string]ManifestEntry)}
+	root := filepath.Clean(opts.ContextDir)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+		hash, hashErr := hashFile(path, info)
+		if hashErr != nil {
+			return hashErr
+		}
+		m.Files[filepath.ToSlash(rel)] = ManifestEntry{Size: info.Size(), Mode: info.Mode(), Hash: hash}
+		return nil
+	})
+	if err != nil {
+		m = nil
+		return
+	}
+	params := sha256.New()
+	fmt.Fprintf(params, "dockerfile=%s\x00%s\x00", opts.Dockerfile, m.Files[filepath.ToSlash(opts.Dockerfile)].Hash)
+	fmt.Fprintf(params, "target=%s\x00platform=%s\x00network=%s\x00", opts.Target, opts.Platform, opts.NetworkMode)
+	fmt.Fprintf(params, "hosts=%s\x00", strings.Join(opts.ExtraHosts, ","))
+	for _, arg := range buildArgs(opts) {
+		fmt.Fprintf(params, "arg=%s=%s\x00", arg.Name, arg.Value)
+	}
+	m.Params = hex.EncodeToString(params.Sum(nil))
+	return
+}
+
+// hashFile returns the sha256 of the content of the file at path, or of the target of a symlink
+func hashFile(path string, info os.FileInfo) (hash string, err error) {
+	h := sha256.New()
+	if info.Mode()&os.ModeSymlink != 0 {
+		var target string
+		target, err = os.Readlink(path)
+		if err != nil {
+			return
+		}
+		io.WriteString(h, target)
+	} else {
+		var f *os.File
+		f, err = os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return
+		}
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// diffManifests returns the files of current that changed since previous, the paths are sorted
+func diffManifests(previous, current *ContextManifest) (delta ContextDelta) {
+	for path, entry := range current.Files {
+		delta.ContextSize += entry.Size
+		old, ok := previous.Files[path]
+		switch {
+		case !ok:
+			delta.Added = append(delta.Added, path)
+			delta.DeltaSize += entry.Size
+		case old != entry:
+			delta.Changed = append(delta.Changed, path)
+			delta.DeltaSize += entry.Size
+		}
+	}
+	for path := range previous.Files {
+		if _, ok := current.Files[path]; !ok {
+			delta.Removed = append(delta.Removed, path)
+		}
+	}
+	sort.Strings(delta.Added)
+	sort.Strings(delta.Changed)
+	sort.Strings(delta.Removed)
+	return
+}
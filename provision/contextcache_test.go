@@ -0,0 +1,130 @@
+package provision
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// syntheticContext writes files to a new build context directory
+func syntheticContext(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "gofn-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeContext(t, dir, files)
+	return dir
+}
+
+func writeContext(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestContextCache(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	builds := fakeBuildQuery(server, "1.41")
+	client := NewTestClient(server.URL(), t)
+
+	dir := syntheticContext(t, map[string]string{
+		"Dockerfile":  "FROM alpine\nCOPY . /app\n",
+		"main.sh":     "echo hello",
+		"lib/util.sh": "echo util",
+	})
+	defer os.RemoveAll(dir)
+	manifests, err := ioutil.TempDir("", "gofn-manifests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(manifests)
+	var deltas []ContextDelta
+	cache := &ContextCache{
+		Store:   FileManifestStore{Dir: manifests},
+		OnDelta: func(delta ContextDelta) { deltas = append(deltas, delta) },
+	}
+	build := func(opts *BuildOptions) string {
+		_, stdout, err := FnImageBuild(client, opts)
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		return stdout.String()
+	}
+	opts := func() *BuildOptions {
+		return &BuildOptions{ContextDir: dir, ImageName: "cached", ContextCache: cache}
+	}
+
+	build(opts())
+	if len(*builds) != 1 {
+		t.Fatalf("expected the first build to upload the context but found %d builds", len(*builds))
+	}
+
+	// unchanged
+	stdout := build(opts())
+	if len(*builds) != 1 || !strings.Contains(stdout, "build context unchanged") {
+		t.Errorf("expected the unchanged context to reuse the image but found %d builds, %q", len(*builds), stdout)
+	}
+
+	// partially changed
+	writeContext(t, dir, map[string]string{"main.sh": "echo hello world", "lib/new.sh": "echo new"})
+	stdout = build(opts())
+	if len(*builds) != 2 || !strings.Contains(stdout, "1 added, 1 changed, 0 removed") {
+		t.Errorf("expected the changed context to be uploaded but found %d builds, %q", len(*builds), stdout)
+	}
+	want := ContextDelta{Added: []string{"lib/new.sh"}, Changed: []string{"main.sh"}, DeltaSize: 24, ContextSize: 24 + 9 + 24}
+	if len(deltas) != 1 || !reflect.DeepEqual(deltas[0], want) {
+		t.Errorf("expected %+v but found %+v", want, deltas)
+	}
+	build(opts())
+	if len(*builds) != 2 {
+		t.Errorf("expected the rebuilt context to be cached but found %d builds", len(*builds))
+	}
+
+	// invalidated by the options and the Dockerfile
+	target := opts()
+	target.Target = "runtime"
+	build(target)
+	withArgs := opts()
+	withArgs.BuildArgs = map[string]string{"VERSION": "1.2"}
+	build(withArgs)
+	writeContext(t, dir, map[string]string{"Dockerfile": "FROM alpine\nCOPY . /srv\n"})
+	build(opts())
+	if len(*builds) != 5 || len(deltas) != 1 {
+		t.Errorf("expected the invalidated manifests to be rebuilt without a delta but found %d builds, %+v", len(*builds), deltas)
+	}
+
+	// removed image
+	image, err := client.InspectImage(opts().GetImageName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.RemoveImage(image.ID); err != nil {
+		t.Fatal(err)
+	}
+	build(opts())
+	if len(*builds) != 6 {
+		t.Errorf("expected the removed image to be rebuilt but found %d builds", len(*builds))
+	}
+
+	// NoCache
+	noCache := opts()
+	noCache.NoCache = true
+	build(noCache)
+	if len(*builds) != 7 || (*builds)[6].Get("nocache") != "1" {
+		t.Errorf("expected NoCache to build the unchanged context again but found %d builds", len(*builds))
+	}
+	build(opts())
+	if len(*builds) != 7 {
+		t.Errorf("expected the image built without cache to be reused but found %d builds", len(*builds))
+	}
+}
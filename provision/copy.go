@@ -0,0 +1,415 @@
+package provision
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	// ErrPathNotFound is raised when the path copied from or to a container does not exist in it
+	ErrPathNotFound = errors.New("provision: path not found in the container")
+
+	// ErrNotAFile is raised when FnCopyFromContainer is given a directory or a special file,
+	// FnCopyDirFromContainer copies directories
+	ErrNotAFile = errors.New("provision: the path is not a regular file")
+
+	// ErrNotADirectory is raised when the directory copied from or to a container is a file
+	ErrNotADirectory = errors.New("provision: the path is not a directory")
+
+	// ErrUnsafeArchivePath is raised when an entry copied from a container would be written
+	// outside of the destination directory
+	ErrUnsafeArchivePath = errors.New("provision: archive entry outside of the destination")
+)
+
+// FnCopyToContainer writes content to the file destPath of the container, replacing it. The
+// directory of destPath must exist in the container. content is read in memory, the archive
+// the daemon expects needs its size upfront.
+func FnCopyToContainer(client *docker.Client, containerID, destPath string, content io.Reader) (err error) {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return
+	}
+	archive := new(bytes.Buffer)
+	tw := tar.NewWriter(archive)
+	err = tw.WriteHeader(&tar.Header{
+		Name:     path.Base(destPath),
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return
+	}
+	_, err = tw.Write(data)
+	if err != nil {
+		return
+	}
+	err = tw.Close()
+	if err != nil {
+		return
+	}
+	return upload(client, containerID, path.Dir(destPath), archive)
+}
+
+// FnCopyDirToContainer copies the local directory srcDir to destPath in the container, with
+// its subdirectories, modes and symbolic links. The directory of destPath must exist in the
+// container, destPath is created or merged with the existing one.
+func FnCopyDirToContainer(client *docker.Client, containerID, srcDir, destPath string) (err error) {
+	info, err := os.Stat(srcDir)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		err = ErrNotADirectory
+		return
+	}
+	// the archive is streamed to the daemon while the directory is walked
+	pr, pw := io.Pipe()
+	goSafe("copy archive", func() error {
+		return archiveDir(pw, srcDir, path.Base(destPath))
+	}, func(err error) {
+		_ = pw.CloseWithError(err)
+	})
+	err = upload(client, containerID, path.Dir(destPath), pr)
+	// unblocks the walk when the upload failed before reading the whole archive
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	return
+}
+
+// archiveDir writes to w the tar of the directory dir with its entries under root
+func archiveDir(w io.Writer, dir, root string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(root, filepath.ToSlash(rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func upload(client *docker.Client, containerID, dir string, archive io.Reader) error {
+	err := client.UploadToContainer(containerID, docker.UploadToContainerOptions{
+		InputStream: archive,
+		Path:        dir,
+	})
+	return archiveError(containerID, err)
+}
+
+// FnCopyFromContainer returns the content of the file srcPath of the container, the caller
+// must close it. The file is streamed from the daemon while it is read.
+func FnCopyFromContainer(client *docker.Client, containerID, srcPath string) (content io.ReadCloser, err error) {
+	pr, pw := io.Pipe()
+	goSafe("copy download", func() error {
+		return download(context.Background(), client, containerID, srcPath, pw)
+	}, func(err error) {
+		_ = pw.CloseWithError(err)
+	})
+	tr := tar.NewReader(pr)
+	header, err := tr.Next()
+	if err != nil {
+		_ = pr.Close()
+		if err == io.EOF {
+			err = ErrPathNotFound
+		}
+		return
+	}
+	if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+		_ = pr.Close()
+		err = ErrNotAFile
+		return
+	}
+	content = &archiveFile{Reader: tr, pipe: pr}
+	return
+}
+
+// archiveFile is the content of the first entry of a downloaded archive
+type archiveFile struct {
+	io.Reader
+	pipe *io.PipeReader
+}
+
+// Close stops the download
+func (f *archiveFile) Close() error {
+	return f.pipe.Close()
+}
+
+// FnCopyDirFromContainer copies the directory srcPath of the container into the local
+// directory destDir, created when missing: the file srcPath/a/b is written to destDir/a/b.
+// The entries reaching outside of destDir, through .. or a symbolic link, fail with
+// ErrUnsafeArchivePath.
+func FnCopyDirFromContainer(client *docker.Client, containerID, srcPath, destDir string) (err error) {
+	err = os.MkdirAll(destDir, 0755)
+	if err != nil {
+		return
+	}
+	pr, pw := io.Pipe()
+	goSafe("copy download", func() error {
+		return download(context.Background(), client, containerID, srcPath, pw)
+	}, func(err error) {
+		_ = pw.CloseWithError(err)
+	})
+	defer pr.Close()
+	err = extractArchive(tar.NewReader(pr), destDir)
+	return
+}
+
+// extractArchive writes the entries of tr to dir without the directory they are rooted at. The
+// symbolic links are written as is and never followed, so an absolute link, e.g. to
+// /etc/alternatives, is kept, while an entry written through a link must stay under dir.
+func extractArchive(tr *tar.Reader, dir string) (err error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return
+	}
+	for {
+		var header *tar.Header
+		header, err = tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		name, ok := archiveEntryName(header.Name)
+		if !ok && header.Typeflag != tar.TypeDir {
+			return ErrNotADirectory
+		} else if !ok {
+			// the directory copied itself
+			continue
+		}
+		target := filepath.Join(root, filepath.FromSlash(name))
+		// a parent replaced by a symbolic link of the archive must stay under root
+		var parent string
+		parent, err = resolveExisting(filepath.Dir(target))
+		if err != nil {
+			return
+		}
+		if !withinDir(root, parent) {
+			return ErrUnsafeArchivePath
+		}
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = removeSymlink(target)
+			if err == nil {
+				err = writeArchiveFile(tr, target, mode)
+			}
+		case tar.TypeSymlink:
+			link := header.Linkname
+			if !filepath.IsAbs(link) && !withinDir(root, filepath.Join(filepath.Dir(target), link)) {
+				return ErrUnsafeArchivePath
+			}
+			_ = os.Remove(target)
+			err = os.Symlink(header.Linkname, target)
+		case tar.TypeLink:
+			err = extractHardLink(root, target, header.Linkname)
+		}
+		// the other entries, devices or fifos, are skipped
+		if err != nil {
+			return
+		}
+	}
+}
+
+// archiveEntryName returns the path of the archive entry name under the directory it is rooted
+// at, false for that directory itself
+func archiveEntryName(name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return "", false
+	}
+	return name[i+1:], true
+}
+
+// extractHardLink links target to the entry linkname of the archive, already extracted under
+// root, the file is copied when the file system does not link it
+func extractHardLink(root, target, linkname string) (err error) {
+	name, ok := archiveEntryName(linkname)
+	if !ok {
+		return ErrUnsafeArchivePath
+	}
+	source, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return
+	}
+	if !withinDir(root, source) {
+		return ErrUnsafeArchivePath
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return
+	}
+	if !info.Mode().IsRegular() {
+		return ErrNotAFile
+	}
+	_ = os.Remove(target)
+	if os.Link(source, target) == nil {
+		return nil
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return writeArchiveFile(f, target, info.Mode().Perm())
+}
+
+// removeSymlink removes the symbolic link target so it is replaced instead of written through
+func removeSymlink(target string) error {
+	if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return os.Remove(target)
+	}
+	return nil
+}
+
+func writeArchiveFile(r io.Reader, target string, mode os.FileMode) (err error) {
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// resolveExisting returns the real path of the nearest existing ancestor of p, p included
+func resolveExisting(p string) (string, error) {
+	for {
+		if _, err := os.Lstat(p); err == nil || !os.IsNotExist(err) || filepath.Dir(p) == p {
+			return filepath.EvalSymlinks(p)
+		}
+		p = filepath.Dir(p)
+	}
+}
+
+// withinDir reports whether the clean path p is dir or under it
+func withinDir(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+func download(ctx context.Context, client *docker.Client, containerID, srcPath string, w io.Writer) error {
+	err := client.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
+		Path:         srcPath,
+		OutputStream: w,
+		Context:      ctx,
+	})
+	return archiveError(containerID, err)
+}
+
+// collectArtifacts copies the paths of the exited container into result.Artifacts, the paths
+// that could not be copied are reported in result.ArtifactErrors
+func (r *Runner) collectArtifacts(ctx context.Context, containerID string, paths []string, result *RunResult) {
+	for _, p := range paths {
+		var data []byte
+		err := withPhaseTimeout(ctx, PhaseLogCollection, r.Timeouts.LogCollection, func(ctx context.Context) (err error) {
+			data, err = artifact(ctx, r.Client, containerID, p)
+			return
+		})
+		if err != nil {
+			if result.ArtifactErrors == nil {
+				result.ArtifactErrors = make(map[string]error)
+			}
+			result.ArtifactErrors[p] = err
+			continue
+		}
+		if result.Artifacts == nil {
+			result.Artifacts = make(map[string][]byte)
+		}
+		result.Artifacts[p] = data
+	}
+}
+
+// artifact returns the content of the file p of the container, or the tar archive of the
+// directory p as the daemon sends it
+func artifact(ctx context.Context, client *docker.Client, containerID, p string) (data []byte, err error) {
+	var archive bytes.Buffer
+	err = download(ctx, client, containerID, p, &archive)
+	if err != nil {
+		return
+	}
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	header, err := tr.Next()
+	if err == io.EOF {
+		err = ErrPathNotFound
+	}
+	if err != nil {
+		return
+	}
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return ioutil.ReadAll(tr)
+	case tar.TypeDir:
+		return archive.Bytes(), nil
+	}
+	err = ErrNotAFile
+	return
+}
+
+// archiveError returns ErrPathNotFound for a missing path and a *docker.NoSuchContainer for a
+// missing container, the daemon answers both with a 404
+func archiveError(containerID string, err error) error {
+	e, ok := err.(*docker.Error)
+	if !ok || e.Status != http.StatusNotFound {
+		return err
+	}
+	if strings.Contains(strings.ToLower(e.Message), "no such container") {
+		return &docker.NoSuchContainer{ID: containerID, Err: err}
+	}
+	return ErrPathNotFound
+}
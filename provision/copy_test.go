@@ -0,0 +1,307 @@
+package provision
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeFiles makes the archives of the fake docker api read and write an in-memory file tree
+// shared by the containers, whose directories are the entries ending with a slash. Only the
+// directory / exists at first.
+func fakeFiles(server *fake.DockerServer) (files func() map[string]string) {
+	var mu sync.Mutex
+	tree := map[string]*tar.Header{"/": {Name: "/", Typeflag: tar.TypeDir, Mode: 0755}}
+	contents := map[string]string{}
+	server.CustomHandler("/containers/.*/archive", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m == nil || m[1] == "missing" {
+			http.Error(w, "No such container: missing", http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		dir := r.URL.Query().Get("path")
+		if r.Method == http.MethodPut {
+			if _, ok := tree[dir+"/"]; !ok && dir != "/" {
+				http.Error(w, "Could not find the file "+dir, http.StatusNotFound)
+				return
+			}
+			tr := tar.NewReader(r.Body)
+			for {
+				header, err := tr.Next()
+				if err != nil {
+					break
+				}
+				name := path.Join(dir, header.Name)
+				if header.Typeflag == tar.TypeDir {
+					name += "/"
+				}
+				tree[name] = header
+				data, _ := ioutil.ReadAll(tr)
+				contents[name] = string(data)
+			}
+			return
+		}
+		var names []string
+		for name := range tree {
+			if name == dir || name == dir+"/" || strings.HasPrefix(name, dir+"/") {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			http.Error(w, "Could not find the file "+dir, http.StatusNotFound)
+			return
+		}
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "application/x-tar")
+		tw := tar.NewWriter(w)
+		for _, name := range names {
+			header := *tree[name]
+			header.Name = path.Base(dir) + strings.TrimPrefix(name, dir)
+			_ = tw.WriteHeader(&header)
+			_, _ = tw.Write([]byte(contents[name]))
+		}
+		_ = tw.Close()
+	}))
+	return func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		copied := map[string]string{}
+		for name, data := range contents {
+			copied[name] = data
+		}
+		return copied
+	}
+}
+
+func TestFnCopyFile(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	files := fakeFiles(server)
+	client := NewTestClient(server.URL(), t)
+
+	err := FnCopyToContainer(client, "fn", "/input.json", strings.NewReader(`{"ping":true}`))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if files()["/input.json"] != `{"ping":true}` {
+		t.Errorf("expected the file to be uploaded but found %v", files())
+	}
+	content, err := FnCopyFromContainer(client, "fn", "/input.json")
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	data, err := ioutil.ReadAll(content)
+	_ = content.Close()
+	if err != nil || string(data) != `{"ping":true}` {
+		t.Errorf("expected the content of the file but found %q and %v", data, err)
+	}
+
+	if err = FnCopyToContainer(client, "fn", "/out/result", strings.NewReader("")); err != ErrPathNotFound {
+		t.Errorf("expected %q without the directory but found %v", ErrPathNotFound, err)
+	}
+	if _, err = FnCopyFromContainer(client, "fn", "/result"); err != ErrPathNotFound {
+		t.Errorf("expected %q but found %v", ErrPathNotFound, err)
+	}
+	if _, err = FnCopyFromContainer(client, "fn", "/"); err != ErrNotAFile {
+		t.Errorf("expected %q for a directory but found %v", ErrNotAFile, err)
+	}
+	_, err = FnCopyFromContainer(client, "missing", "/input.json")
+	var noSuchContainer *docker.NoSuchContainer
+	if !errors.As(err, &noSuchContainer) {
+		t.Errorf("expected the container not to be found but found %v", err)
+	}
+}
+
+func TestFnCopyDir(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	files := fakeFiles(server)
+	client := NewTestClient(server.URL(), t)
+	src, err := ioutil.TempDir("", "gofn-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	if err = os.MkdirAll(filepath.Join(src, "reports", "daily"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_ = ioutil.WriteFile(filepath.Join(src, "summary.txt"), []byte("ok"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(src, "reports", "daily", "run.csv"), []byte("a,b"), 0600)
+
+	if err = FnCopyDirToContainer(client, "fn", src, "/artifacts"); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	uploaded := files()
+	if uploaded["/artifacts/summary.txt"] != "ok" || uploaded["/artifacts/reports/daily/run.csv"] != "a,b" {
+		t.Errorf("expected the directory to be uploaded but found %v", uploaded)
+	}
+
+	dest, err := ioutil.TempDir("", "gofn-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if err = FnCopyDirFromContainer(client, "fn", "/artifacts", filepath.Join(dest, "out")); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dest, "out", "reports", "daily", "run.csv"))
+	if err != nil || string(data) != "a,b" {
+		t.Errorf("expected the directory to be downloaded but found %q and %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "out", "reports", "daily", "run.csv")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the mode of the file to be kept but found %v", info)
+	}
+
+	if err = FnCopyDirFromContainer(client, "fn", "/artifacts/summary.txt", dest); err != ErrNotADirectory {
+		t.Errorf("expected %q for a file but found %v", ErrNotADirectory, err)
+	}
+	if err = FnCopyDirToContainer(client, "fn", filepath.Join(src, "summary.txt"), "/summary"); err != ErrNotADirectory {
+		t.Errorf("expected %q for a file but found %v", ErrNotADirectory, err)
+	}
+}
+
+func TestExtractArchiveUnsafe(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tar.Header
+	}{
+		{"file through an absolute link", []tar.Header{
+			{Name: "out/", Typeflag: tar.TypeDir},
+			{Name: "out/etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+			{Name: "out/etc/passwd", Typeflag: tar.TypeReg},
+		}},
+		{"hard link through an absolute link", []tar.Header{
+			{Name: "out/", Typeflag: tar.TypeDir},
+			{Name: "out/etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+			{Name: "out/passwd", Typeflag: tar.TypeLink, Linkname: "out/etc/passwd"},
+		}},
+		{"relative link", []tar.Header{
+			{Name: "out/", Typeflag: tar.TypeDir},
+			{Name: "out/up", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		}},
+	}
+	for _, test := range tests {
+		dest, err := ioutil.TempDir("", "gofn-extract")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dest)
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		for i := range test.entries {
+			_ = tw.WriteHeader(&test.entries[i])
+		}
+		_ = tw.Close()
+		err = extractArchive(tar.NewReader(&archive), dest)
+		if err != ErrUnsafeArchivePath {
+			t.Errorf("%s: expected %q but found %v", test.name, ErrUnsafeArchivePath, err)
+		}
+	}
+}
+
+func TestExtractArchiveLinks(t *testing.T) {
+	dest, err := ioutil.TempDir("", "gofn-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	outside := filepath.Join(dest, "outside")
+	_ = ioutil.WriteFile(outside, []byte("kept"), 0644)
+	root := filepath.Join(dest, "root")
+	_ = os.Mkdir(root, 0755)
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	entries := []struct {
+		header tar.Header
+		data   string
+	}{
+		{tar.Header{Name: "out/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "out/python", Typeflag: tar.TypeSymlink, Linkname: "/etc/alternatives/python"}, ""},
+		{tar.Header{Name: "out/run.csv", Typeflag: tar.TypeReg, Mode: 0600, Size: 3}, "a,b"},
+		{tar.Header{Name: "out/copy.csv", Typeflag: tar.TypeLink, Linkname: "out/run.csv"}, ""},
+		{tar.Header{Name: "out/outside", Typeflag: tar.TypeSymlink, Linkname: outside}, ""},
+		{tar.Header{Name: "out/outside", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "new"},
+	}
+	for _, entry := range entries {
+		_ = tw.WriteHeader(&entry.header)
+		_, _ = tw.Write([]byte(entry.data))
+	}
+	_ = tw.Close()
+
+	if err = extractArchive(tar.NewReader(&archive), root); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if link, err := os.Readlink(filepath.Join(root, "python")); link != "/etc/alternatives/python" {
+		t.Errorf("expected the absolute link to be kept but found %q, %v", link, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "copy.csv")); string(data) != "a,b" {
+		t.Errorf("expected the hard link to be extracted but found %q, %v", data, err)
+	}
+	if data, _ := ioutil.ReadFile(outside); string(data) != "kept" {
+		t.Errorf("expected the file behind the link to be kept but found %q", data)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "outside")); string(data) != "new" {
+		t.Errorf("expected the link to be replaced by the file but found %q, %v", data, err)
+	}
+}
+
+func TestRunnerOutputPaths(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "ok", "")
+	fakeFiles(server)
+	client := NewTestClient(server.URL(), t)
+	// the fake file tree is shared by the containers, the function wrote these files
+	if err := FnCopyToContainer(client, "fn", "/result.json", strings.NewReader(`{"sum":3}`)); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gofn-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, "chart.svg"), []byte("<svg/>"), 0644)
+	if err = FnCopyDirToContainer(client, "fn", dir, "/reports"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(client)
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{OutputPaths: []string{"/result.json", "/reports", "/missing.json"}})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if string(result.Artifacts["/result.json"]) != `{"sum":3}` {
+		t.Errorf("expected the result file but found %q", result.Artifacts["/result.json"])
+	}
+	tr := tar.NewReader(bytes.NewReader(result.Artifacts["/reports"]))
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"reports/", "reports/chart.svg"}) {
+		t.Errorf("expected the archive of the directory but found %v", names)
+	}
+	if len(result.ArtifactErrors) != 1 || result.ArtifactErrors["/missing.json"] != ErrPathNotFound {
+		t.Errorf("expected the missing path to be reported but found %v", result.ArtifactErrors)
+	}
+}
@@ -1,32 +1,122 @@
+// Package provision builds the images of the functions and runs them in containers.
+//
+// The functions and methods of the package never modify the BuildOptions and ContainerOptions
+// they are given, nor the slices and maps they hold: the defaults are resolved on copies and
+// what the caller may need is returned instead, e.g. BuildReport.Auth. A single value of the
+// options can thus be shared by concurrent goroutines.
 package provision
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/gofn/gofn/iaas"
-	"github.com/gofrs/uuid"
+	"github.com/gofn/gofn/internal/names"
 )
 
 var (
 	// ErrImageNotFound is raised when image is not found
 	ErrImageNotFound = errors.New("provision: image not found")
 
+	// ErrDockerfileNotFound is raised when the Dockerfile is missing from the build context
+	ErrDockerfileNotFound = errors.New("provision: Dockerfile not found")
+
 	// ErrContainerNotFound is raised when image is not found
 	ErrContainerNotFound = errors.New("provision: container not found")
 
+	// ErrContainerIDAmbiguous is raised when a container ID prefix matches several containers
+	ErrContainerIDAmbiguous = errors.New("provision: ambiguous container ID")
+
 	// ErrContainerExecutionFailed is raised if container exited with status different of zero
 	ErrContainerExecutionFailed = errors.New("provision: container exited with failure")
 
-	// Input receives a string that will be written to the stdin of the container in function FnRun
+	// ErrExecutionTimeout is raised when the container runs longer than RunOptions.Timeout
+	ErrExecutionTimeout = errors.New("provision: container execution timed out")
+
+	// Input is not read by the package, the stdin of the container is the input parameter of FnRun
+	// so concurrent runs each get their own.
+	//
+	// Deprecated: pass the stdin to FnRun.
 	Input string
 )
 
+// DefaultStopGracePeriod is the time a timed out container has to exit after its stop signal
+// when RunOptions.StopGracePeriod and ContainerOptions.StopTimeout are zero
+const DefaultStopGracePeriod = 10 * time.Second
+
+// RunOptions bound the execution of FnRunWithOptions
+type RunOptions struct {
+	// Timeout stops the container when it runs longer, no timeout when zero
+	Timeout time.Duration
+	// StopGracePeriod is the time the timed out container has to exit after its stop signal
+	// before it is killed, its ContainerOptions.StopTimeout when zero
+	StopGracePeriod time.Duration
+	// Stdout and Stderr receive the output while the container runs, e.g. to relay it to the
+	// user watching the run, the output is still returned once the container exited. A writer
+	// that fails is no longer written to and the failure is reported in RunResult.Warnings.
+	Stdout io.Writer
+	Stderr io.Writer
+	// StreamOnly only writes the output to Stdout and Stderr, the buffers of the result stay
+	// empty so a long run does not hold its whole output in memory
+	StreamOnly bool
+	// MaxOutputBytes bounds each of the stdout and stderr buffers of the result, only their last
+	// MaxOutputBytes bytes are kept so the end of the output, e.g. a crash message, is not lost
+	// and RunResult.Truncated is set. The output is not bounded when zero.
+	MaxOutputBytes int64
+	// MaskSecrets are values replaced with SecretMask in the output, before it is relayed to
+	// Stdout and Stderr, e.g. the SecretValues of ContainerOptions.Secrets
+	MaskSecrets []string
+}
+
+// ExecutionError is returned by FnRun for a container exiting with a non-zero status
+type ExecutionError struct {
+	ExitCode int
+	// OOMKilled is set when the kernel killed the container for exceeding its memory limit
+	OOMKilled bool
+	// Stderr is the error output of the container
+	Stderr string
+}
+
+func (e *ExecutionError) Error() string {
+	if e.OOMKilled {
+		return fmt.Sprintf("%v: exit code %d, out of memory", ErrContainerExecutionFailed, e.ExitCode)
+	}
+	return fmt.Sprintf("%v: exit code %d", ErrContainerExecutionFailed, e.ExitCode)
+}
+
+// Unwrap returns ErrContainerExecutionFailed
+func (e *ExecutionError) Unwrap() error {
+	return ErrContainerExecutionFailed
+}
+
+// PullPolicy tells whether an image existing locally is built or pulled again
+type PullPolicy string
+
+const (
+	// PullDefault, the zero value, keeps the behavior of the call: a Runner reuses the local
+	// image while FnImageBuild builds or pulls it again
+	PullDefault PullPolicy = ""
+	// PullAlways builds or pulls the image even when it exists locally
+	PullAlways PullPolicy = "always"
+	// PullIfNotPresent reuses the local image, it is only built or pulled when missing
+	PullIfNotPresent PullPolicy = "if_not_present"
+	// PullNever reuses the local image and fails with ErrImageNotFound when it is missing, the
+	// image is neither built nor pulled, e.g. on air-gapped hosts
+	PullNever PullPolicy = "never"
+)
+
 // BuildOptions are options used in the image build
 type BuildOptions struct {
 	ContextDir              string
@@ -37,7 +127,55 @@ type BuildOptions struct {
 	StdIN                   string
 	Iaas                    iaas.Iaas
 	Auth                    docker.AuthConfiguration
-	ForcePull               bool
+	// AuthConfigs are the credentials of the registries keyed by host, e.g. gcr.io, docker.io for
+	// Docker Hub. A build passes them all to the daemon for the base images and a pull picks the
+	// entry of the registry of the image, Auth is the entry of the other registries.
+	AuthConfigs RegistryAuth
+	// AuthFromDockerConfig reads the credentials of the registry of the image from the Docker
+	// config file of the user when Auth is empty, see DockerConfigAuth
+	AuthFromDockerConfig bool
+	// PullPolicy tells whether the image is built or pulled when it exists locally, see PullDefault
+	PullPolicy PullPolicy
+	// ForcePull pulls the latest version of the base images before building ContextDir or
+	// RemoteURI, without them there is nothing to build and the image itself is pulled
+	ForcePull bool
+	// FallbackToPull pulls the image instead of failing with a DockerfileNotFoundError when the
+	// Dockerfile is missing from ContextDir, the other build failures are always returned
+	FallbackToPull bool
+	// Target is the stage of a multi-stage Dockerfile to build
+	Target string
+	// Platform is the platform to build for, e.g. linux/arm64
+	Platform string
+	// Backend builds the image, DaemonBuilder when nil
+	Backend Builder
+	// NetworkMode is the network of the RUN steps, e.g. host or none, the daemon default when empty.
+	// The host network gives the RUN steps the network of the machine, including the services only
+	// listening on its loopback and the credentials of its metadata endpoints, only use it with
+	// trusted Dockerfiles.
+	NetworkMode string
+	// ExtraHosts are host:ip entries added to /etc/hosts of the RUN steps, e.g. mirror:10.0.0.5
+	ExtraHosts []string
+	// BuildArgs are the values of the ARG instructions of the Dockerfile, an empty value is
+	// sent as is like docker build --build-arg NAME
+	BuildArgs map[string]string
+	// NoCache builds every step again, e.g. when the source of a remote ADD changed but
+	// not the Dockerfile
+	NoCache bool
+	// CacheFrom are images whose layers the build may reuse, they must be pulled beforehand
+	// to be used by the daemon builder
+	CacheFrom []string
+	// OutputStream receives the build output as it arrives, the output of the steps is then
+	// no longer suppressed. The Stdout returned by FnImageBuild still holds the whole output.
+	OutputStream io.Writer
+	// ContextCache skips the upload of a ContextDir unchanged since the previous build, nil
+	// uploads it on every build
+	ContextCache *ContextCache
+	// Tags are extra names given to the image once it was built or pulled, e.g.
+	// gofn/myfunc:3f2a1c9 next to gofn/myfunc:latest, see BuildReport.Names
+	Tags []string
+	// OnPullProgress receives the progress messages of the pulls of the image, with the overall
+	// percentage of its layers, e.g. LogPullProgress. A Runner also emits them as EventPullProgress.
+	OnPullProgress func(ProgressUpdate)
 }
 
 // ContainerOptions are options used in container
@@ -46,7 +184,108 @@ type ContainerOptions struct {
 	Volumes []string
 	Image   string
 	Env     []string
+	// Entrypoint replaces the entrypoint of the image when not nil, an empty non-nil slice
+	// clears it so Cmd runs on its own
+	Entrypoint []string
+	// WorkingDir is the absolute directory Cmd runs in, the one of the image when empty
+	WorkingDir string
+	// User is the user[:group] the container runs as instead of the one of the image, it
+	// replaces NonRootUser and a root User fails with ErrRunningAsRoot under RunAsNonRoot
+	// unless AllowRoot
+	User string
+	// EnvFiles are files of variables read like docker --env-file when the container is
+	// created, the variables of a later file replace those of an earlier one and Env wins over them
+	EnvFiles []string
+	// EnvPassthrough are the names of the variables copied from the environment of the process
+	// when the container is created, the unset ones are skipped and Env and EnvFiles win over them
+	EnvPassthrough []string
+	// Runtime is the OCI runtime of the container, the daemon default when empty. The field is
+	// only sent when set, so daemons predating runtimes accept the containers without one
 	Runtime string
+	// UsernsMode "host" opts the container out of the daemon user namespace remapping
+	UsernsMode string
+	// Secrets are values given to the container by name, as variables or as files according to
+	// SecretMode. They are redacted from the ResolvedConfig, RunOptions.MaskSecrets keeps them
+	// out of the output.
+	Secrets    map[string]string
+	SecretMode SecretMode
+	// EnvTemplate values are text/template strings rendered with TemplateData and added to Env
+	EnvTemplate map[string]string
+	// TemplateVars are the caller values available to EnvTemplate as {{.Vars.key}}
+	TemplateVars map[string]string
+	// StrictTemplate fails the container creation when EnvTemplate references a missing key
+	StrictTemplate bool
+	// Machine is the machine running the daemon, nil when it is not provided by an iaas
+	Machine *iaas.Machine
+	// RunAsNonRoot runs the containers of images with a root or empty user as NonRootUser,
+	// Runner.Run also fails with ErrRunningAsRoot when the started container runs as root
+	RunAsNonRoot bool
+	// NonRootUser is the UID:GID used by RunAsNonRoot, DefaultNonRootUser when empty
+	NonRootUser string
+	// AllowRoot keeps the root user of an image that needs it despite RunAsNonRoot
+	AllowRoot bool
+	// Network is the network the container joins, the daemon default one when empty
+	Network string
+	// Egress restricts what the container reaches, EgressAllowList is only available through Runner.Run
+	Egress EgressPolicy
+	// PinToImageID creates the container from the ID of Image instead of its name, so a retag
+	// of the name after the image was resolved does not change what runs
+	PinToImageID bool
+	// AutoRemove makes the daemon remove the container once it exited, Runner.Run then
+	// attaches its output whatever the output strategy since its logs are gone with it
+	AutoRemove bool
+	// ExclusiveKey keeps Runner.Run from running the container while another run with the same
+	// key is going on, ExclusivePolicy selects whether it waits or fails
+	ExclusiveKey    string
+	ExclusivePolicy ExclusivePolicy
+	// InjectCACerts gives the containers of scratch or distroless images the CA bundle of the
+	// daemon host, bound read-only at CACertsPath and CACertsAltPath
+	InjectCACerts bool
+	// InjectTimezone is the IANA timezone set as TZ, e.g. Europe/Paris, with the timezone data
+	// of the daemon host bound read-only at ZoneinfoPath. The files of a remote daemon are
+	// copied from HostFilesImage instead since its host layout is unknown.
+	InjectTimezone string
+	// EnableHostCallback lets the container reach the daemon host, e.g. to call back the
+	// orchestrator, at the address given as HostCallbackEnv, see ResolveHostCallback
+	EnableHostCallback bool
+	// Memory limits the memory of the container in bytes and NanoCPUs its CPU time in
+	// billionths of a CPU, they are unlimited when zero
+	Memory   int64
+	NanoCPUs int64
+	// ReadOnlyRootfs mounts the root filesystem of the container read-only
+	ReadOnlyRootfs bool
+	// SeccompAllowlist restricts the container to these syscalls and a baseline needed to start
+	// a process, the others fail with EPERM, see SeccompProfile and SeccompRuntimeSyscalls
+	SeccompAllowlist []string
+	// ExecutionTimeout bounds the execution of the container by Runner.Run and Runner.Execute
+	// instead of Runner.Timeouts.Execution when set, and by gofn.Run as RunOptions.Timeout
+	ExecutionTimeout time.Duration
+	// StopSignal is the signal stopping the container, e.g. SIGINT for an image trapping it
+	// rather than SIGTERM, the one of the image when empty
+	StopSignal string
+	// StopTimeout is the time the container has to exit after its stop signal before it is
+	// killed, when its execution times out, its context ends or it is stopped by the daemon,
+	// DefaultStopGracePeriod when zero. It is rounded up to the second.
+	StopTimeout time.Duration
+	// LogSinks receive the output lines while the container runs, by Runner.Run and
+	// Runner.Execute, a failing sink is disabled and reported in RunResult.Warnings. They are
+	// not part of a ResolvedConfig nor of the token of a RunSession.
+	LogSinks []LogSink `json:"-"`
+	// MaxLogLine is the length beyond which a line given to LogSinks is truncated and ends with
+	// TruncatedLogLine, DefaultMaxLogLine when zero
+	MaxLogLine int
+	// LogSinkBuffer is the number of lines held for a sink slower than the output, the lines
+	// beyond are dropped for that sink, DefaultLogSinkBuffer when zero
+	LogSinkBuffer int
+	// OutputPaths are the absolute paths of the files or directories Runner.Run and
+	// Runner.Execute copy from the container once it exited, before its removal, into
+	// RunResult.Artifacts. They can not be collected from an AutoRemove container.
+	OutputPaths []string
+
+	// labels are set on the container by the runner, e.g. LabelConfig
+	labels map[string]string
+	// hostFilesImage replaces HostFilesImage, once rewritten by the runner
+	hostFilesImage string
 }
 
 // GetImageName sets prefix gofn when needed
@@ -63,90 +302,376 @@ func FnRemove(client *docker.Client, containerID string) (err error) {
 	return
 }
 
-// FnContainer create container
+// FnContainer create container, labeled with LabelManaged, LabelImage and LabelCreatedBy
 func FnContainer(client *docker.Client, opts ContainerOptions) (container *docker.Container, err error) {
-	config := &docker.Config{
-		Image:     opts.Image,
-		Cmd:       opts.Cmd,
-		Env:       opts.Env,
-		StdinOnce: true,
-		OpenStdin: true,
-	}
-	var uid uuid.UUID
-	uid, err = uuid.NewV4()
+	container, err = createContainer(context.Background(), client, opts)
+	err = ClassifyError(err)
+	return
+}
+
+func createContainer(ctx context.Context, client *docker.Client, opts ContainerOptions) (container *docker.Container, err error) {
+	labels := managedLabels(opts.labels, opts.Image)
+	if opts.PinToImageID {
+		opts.Image, _, err = imageIdentity(client, opts.Image)
+		if err != nil {
+			return
+		}
+	}
+	uid := names.ID()
+	env, err := containerEnv(opts)
 	if err != nil {
 		return
 	}
+	if len(opts.EnvTemplate) > 0 {
+		var data TemplateData
+		data, err = templateData(client, opts, uid)
+		if err != nil {
+			return
+		}
+		var rendered []string
+		rendered, err = renderEnv(opts, data)
+		if err != nil {
+			return
+		}
+		env = append(append([]string{}, env...), rendered...)
+	}
+	networkMode := opts.Network
+	switch opts.Egress.Mode {
+	case EgressNone:
+		networkMode = "none"
+	case EgressAllowList:
+		// the runner places the container on the network of its proxy
+		if opts.Network == "" {
+			err = ErrEgressRequiresRunner
+			return
+		}
+	}
+	binds := opts.Volumes
+	local := localDaemon(client, opts)
+	if injectsHostFiles(opts) {
+		env = append(append([]string{}, env...), hostFilesEnv(opts)...)
+		if local {
+			var hostBinds []string
+			hostBinds, err = hostFileBinds(opts)
+			if err != nil {
+				return
+			}
+			binds = append(append([]string{}, opts.Volumes...), hostBinds...)
+		}
+	}
+	var extraHosts []string
+	if opts.EnableHostCallback {
+		var callback HostCallback
+		callback, err = ResolveHostCallback(ctx, client, networkMode)
+		if err != nil {
+			return
+		}
+		extraHosts = callback.ExtraHosts
+		env = append(append([]string{}, env...), HostCallbackEnv+"="+callback.Addr)
+	}
+	if len(opts.Secrets) > 0 && opts.SecretMode == SecretEnv {
+		env = withSecretsEnv(env, opts.Secrets)
+		labels[LabelSecrets] = strings.Join(secretNames(opts.Secrets), " ")
+	}
+	user, err := containerUser(client, opts)
+	if err != nil {
+		return
+	}
+	securityOpt, err := seccompSecurityOpt(opts.SeccompAllowlist)
+	if err != nil {
+		return
+	}
+	config := &docker.Config{
+		Image:       opts.Image,
+		User:        user,
+		Cmd:         opts.Cmd,
+		Entrypoint:  opts.Entrypoint,
+		WorkingDir:  opts.WorkingDir,
+		Env:         env,
+		Labels:      labels,
+		StopSignal:  opts.StopSignal,
+		StopTimeout: stopSeconds(opts.StopTimeout),
+		StdinOnce:   true,
+		OpenStdin:   true,
+	}
 	container, err = client.CreateContainer(docker.CreateContainerOptions{
-		Name:       fmt.Sprintf("gofn-%s", uid.String()),
-		HostConfig: &docker.HostConfig{Binds: opts.Volumes, Runtime: opts.Runtime},
-		Config:     config,
+		Name: fmt.Sprintf("gofn-%s", uid),
+		HostConfig: &docker.HostConfig{
+			Binds:          binds,
+			Runtime:        opts.Runtime,
+			UsernsMode:     opts.UsernsMode,
+			NetworkMode:    networkMode,
+			AutoRemove:     opts.AutoRemove,
+			ExtraHosts:     extraHosts,
+			Memory:         opts.Memory,
+			NanoCPUs:       opts.NanoCPUs,
+			ReadonlyRootfs: opts.ReadOnlyRootfs,
+			SecurityOpt:    securityOpt,
+		},
+		Config:  config,
+		Context: ctx,
 	})
+	if err == nil && injectsHostFiles(opts) && !local {
+		// the host layout of a remote daemon is unknown, the files come from the helper image
+		err = copyHostFiles(ctx, client, container.ID, opts)
+		if err != nil {
+			_ = FnRemove(client, container.ID)
+			container = nil
+		}
+	}
+	if err == nil && len(opts.Secrets) > 0 && opts.SecretMode == SecretFile {
+		err = copySecrets(ctx, client, container.ID, opts.Secrets)
+		if err != nil {
+			_ = FnRemove(client, container.ID)
+			container = nil
+		}
+	}
 	return
 }
 
 // FnImageBuild builds an image
 func FnImageBuild(client *docker.Client, opts *BuildOptions) (Name string, Stdout *bytes.Buffer, err error) {
+	Name, Stdout, err = imageBuild(context.Background(), client, opts)
+	err = ClassifyError(err)
+	return
+}
+
+func imageBuild(ctx context.Context, client *docker.Client, opts *BuildOptions) (Name string, Stdout *bytes.Buffer, err error) {
+	report, err := buildImage(ctx, client, opts)
+	Name = report.Name
+	if err == nil {
+		Stdout = report.Stdout
+	}
+	return
+}
+
+// buildImage builds or pulls the image of opts and tags it, the report has no identity. opts
+// is not modified, its defaults are resolved on a copy.
+func buildImage(ctx context.Context, client *docker.Client, opts *BuildOptions) (report BuildReport, err error) {
+	resolved := *opts
+	opts = &resolved
+	report.Name = opts.GetImageName()
+	report.Names = append([]string{report.Name}, opts.Tags...)
+	if opts.PullPolicy == PullIfNotPresent || opts.PullPolicy == PullNever {
+		var present bool
+		present, err = localImage(ctx, client, report.Name, opts.PullPolicy)
+		if err != nil {
+			return
+		}
+		if present {
+			// nothing was built nor pulled, the local image still gets the extra names
+			report.Stdout = new(bytes.Buffer)
+			err = tagImage(ctx, client, report.Name, opts.Tags)
+			return
+		}
+	}
+	pullOnly := opts.ForcePull && opts.ContextDir == "" && opts.RemoteURI == ""
 	if opts.Dockerfile == "" {
 		opts.Dockerfile = "Dockerfile"
 	}
 	if opts.ContextDir == "" && opts.RemoteURI == "" {
 		opts.ContextDir = "./"
 	}
-	err = auth(client, opts)
+	opts.Auth, err = auth(ctx, client, opts)
 	if err != nil {
 		return
 	}
+	report.Auth = opts.Auth
 	stdout := new(bytes.Buffer)
-	Name = opts.GetImageName()
-	if opts.ForcePull {
-		err = FnPull(client, opts)
+	var out io.Writer = stdout
+	if opts.OutputStream != nil {
+		out = io.MultiWriter(stdout, opts.OutputStream)
+	}
+	switch {
+	case pullOnly:
+		err = pullTo(ctx, client, opts, out)
+	case opts.ContextCache != nil && opts.RemoteURI == "":
+		err = opts.ContextCache.build(ctx, client, report.Name, opts, out)
+	default:
+		err = opts.builder().Build(ctx, client, report.Name, opts, out)
+	}
+	if _, missing := err.(*DockerfileNotFoundError); missing && opts.FallbackToPull && !pullOnly {
+		err = pullTo(ctx, client, opts, out)
+	}
+	if err != nil {
 		return
 	}
-	err = client.BuildImage(docker.BuildImageOptions{
-		Name:           Name,
-		Dockerfile:     opts.Dockerfile,
-		SuppressOutput: true,
-		OutputStream:   stdout,
-		ContextDir:     opts.ContextDir,
-		Remote:         opts.RemoteURI,
-		Auth:           opts.Auth,
-	})
+	err = tagImage(ctx, client, report.Name, opts.Tags)
 	if err != nil {
-		if !strings.Contains(err.Error(), "Cannot locate specified Dockerfile:") { // the error is not exported so we need to verify using the message
+		return
+	}
+	report.Stdout = stdout
+	return
+}
+
+// localImage reports whether the daemon of client has the image name, it fails with
+// ErrImageNotFound when it is missing under PullNever
+func localImage(ctx context.Context, client *docker.Client, name string, policy PullPolicy) (present bool, err error) {
+	_, err = findImage(ctx, client, name)
+	switch {
+	case err == nil:
+		present = true
+	case err == ErrImageNotFound && policy != PullNever:
+		err = nil
+	}
+	return
+}
+
+// tagImage gives the image name the extra names tags, see BuildOptions.Tags
+func tagImage(ctx context.Context, client *docker.Client, name string, tags []string) (err error) {
+	for _, tag := range tags {
+		repo, t := parseDockerImage(tag)
+		err = client.TagImage(name, docker.TagImageOptions{Repo: repo, Tag: t, Force: true, Context: ctx})
+		if err != nil {
 			return
 		}
-		err = FnPull(client, opts)
-		if err != nil {
+	}
+	return
+}
+
+// buildArgs returns the BuildArgs of opts sorted by name
+func buildArgs(opts *BuildOptions) (args []docker.BuildArg) {
+	if len(opts.BuildArgs) == 0 {
+		return
+	}
+	args = make([]docker.BuildArg, 0, len(opts.BuildArgs))
+	for name, value := range opts.BuildArgs {
+		args = append(args, docker.BuildArg{Name: name, Value: value})
+	}
+	sort.Slice(args, func(i, j int) bool {
+		return args[i].Name < args[j].Name
+	})
+	return
+}
+
+// DockerfileNotFoundError is raised by the builders when Path, the Dockerfile, is missing from
+// the build context, see BuildOptions.FallbackToPull
+type DockerfileNotFoundError struct {
+	Path string
+}
+
+func (e *DockerfileNotFoundError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrDockerfileNotFound, e.Path)
+}
+
+// Unwrap returns ErrDockerfileNotFound
+func (e *DockerfileNotFoundError) Unwrap() error {
+	return ErrDockerfileNotFound
+}
+
+// pullTo pulls the image of opts writing its progress messages to stdout, one per line
+func pullTo(ctx context.Context, client *docker.Client, opts *BuildOptions, stdout io.Writer) (err error) {
+	_, err = pullWithProgress(ctx, client, opts, func(update ProgressUpdate) {
+		if update.ID != "" {
+			fmt.Fprintf(stdout, "%s: %s\n", update.ID, update.Status)
+			return
+		}
+		fmt.Fprintln(stdout, update.Status)
+	})
+	return
+}
+
+// BuildReport identifies the image built or pulled by FnImageBuildReport
+type BuildReport struct {
+	Name string
+	// Names are Name followed by the BuildOptions.Tags the image was tagged with
+	Names []string
+	// ID is the immutable ID of the image, it is not affected by a later retag of Name
+	ID string
+	// Digest is the repository digest of Name, empty for an image that was built and not pushed
+	Digest string
+	Stdout *bytes.Buffer
+	// Auth are the credentials the image was pulled with, with the identity token returned by
+	// the registry, BuildOptions.Auth is left as is
+	Auth docker.AuthConfiguration
+}
+
+// FnImageBuildReport builds an image like FnImageBuild and inspects it to return its ID and digest
+func FnImageBuildReport(client *docker.Client, opts *BuildOptions) (report BuildReport, err error) {
+	report, err = imageBuildReport(context.Background(), client, opts)
+	err = ClassifyError(err)
+	return
+}
+
+func imageBuildReport(ctx context.Context, client *docker.Client, opts *BuildOptions) (report BuildReport, err error) {
+	report, err = buildImage(ctx, client, opts)
+	if err != nil {
+		return
+	}
+	report.ID, report.Digest, err = imageIdentity(client, report.Name)
+	return
+}
+
+// imageIdentity returns the ID of the image and its repository digest matching the repository of name
+func imageIdentity(client *docker.Client, name string) (id, digest string, err error) {
+	image, err := client.InspectImage(name)
+	if err != nil {
+		return
+	}
+	id = image.ID
+	repo, _ := parseDockerImage(name)
+	for _, repoDigest := range image.RepoDigests {
+		if repoDigest == name || strings.HasPrefix(repoDigest, repo+"@") {
+			digest = repoDigest
 			return
 		}
 	}
-	Stdout = stdout
 	return
 }
 
-func auth(client *docker.Client, opts *BuildOptions) (err error) {
-	if (opts.Auth.Email != "" || opts.Auth.Username != "") && opts.Auth.Password != "" {
-		if opts.Auth.ServerAddress == "" {
-			opts.Auth.ServerAddress = "https://index.docker.io/v1/"
+// auth returns the credentials of opts checked against the registry, with the identity token
+// it returned
+func auth(ctx context.Context, client *docker.Client, opts *BuildOptions) (credentials docker.AuthConfiguration, err error) {
+	credentials, err = registryAuth(ctx, opts)
+	if err != nil {
+		return
+	}
+	if (credentials.Email != "" || credentials.Username != "") && credentials.Password != "" {
+		if credentials.ServerAddress == "" {
+			credentials.ServerAddress = dockerHubServer
 		}
 		var status docker.AuthStatus
-		status, err = client.AuthCheck(&opts.Auth)
+		status, err = client.AuthCheckWithContext(&credentials, ctx)
 		if err != nil {
 			return
 		}
-		opts.Auth.IdentityToken = status.IdentityToken
+		credentials.IdentityToken = status.IdentityToken
+	}
+	return
+}
+
+// BuildAuthConfigs returns the credentials a build passes to the daemon for its base images,
+// keyed by server address: the AuthConfigs and Auth, as the entry of its server address or of
+// Docker Hub, unless AuthConfigs has one
+func (opts BuildOptions) BuildAuthConfigs() (configs docker.AuthConfigurations) {
+	configs.Configs = make(map[string]docker.AuthConfiguration, len(opts.AuthConfigs)+1)
+	for host, entry := range opts.AuthConfigs {
+		server := registryServer(host)
+		if entry.ServerAddress == "" {
+			entry.ServerAddress = server
+		}
+		configs.Configs[server] = entry
+	}
+	if opts.Auth != (docker.AuthConfiguration{}) {
+		server := registryServer(opts.Auth.ServerAddress)
+		if _, ok := configs.Configs[server]; !ok {
+			entry := opts.Auth
+			if entry.ServerAddress == "" {
+				entry.ServerAddress = server
+			}
+			configs.Configs[server] = entry
+		}
 	}
 	return
 }
 
 // FnPull pull image from registry
 func FnPull(client *docker.Client, opts *BuildOptions) (err error) {
-	repo, tag := parseDockerImage(opts.GetImageName())
-	err = client.PullImage(docker.PullImageOptions{
-		Repository: repo,
-		Tag:        tag,
-	}, opts.Auth)
+	return ClassifyError(pull(context.Background(), client, opts))
+}
+
+func pull(ctx context.Context, client *docker.Client, opts *BuildOptions) (err error) {
+	_, err = pullWithProgress(ctx, client, opts, nil)
 	return
 }
 
@@ -165,10 +690,15 @@ func parseDockerImage(image string) (repo, tag string) {
 	return repo, tag
 }
 
-// FnFindImage returns image data by name
+// FnFindImage returns image data by name, the image tagged or pinned by a digest with name,
+// an image merely matching the name filter of the daemon is only returned when none is
 func FnFindImage(client *docker.Client, imageName string) (image docker.APIImages, err error) {
+	return findImage(context.Background(), client, imageName)
+}
+
+func findImage(ctx context.Context, client *docker.Client, imageName string) (image docker.APIImages, err error) {
 	var imgs []docker.APIImages
-	imgs, err = client.ListImages(docker.ListImagesOptions{Filter: imageName})
+	imgs, err = client.ListImages(docker.ListImagesOptions{Filter: imageName, Context: ctx})
 	if err != nil {
 		return
 	}
@@ -176,60 +706,214 @@ func FnFindImage(client *docker.Client, imageName string) (image docker.APIImage
 		err = ErrImageNotFound
 		return
 	}
+	// the filter also matches the names sharing the prefix, e.g. gofn/report-v2 for gofn/report
+	ref := normalizeImageRef(imageName)
+	for _, img := range imgs {
+		if img.ID == imageName {
+			image = img
+			return
+		}
+		names := img.RepoTags
+		if strings.Contains(ref, "@") {
+			names = img.RepoDigests
+		}
+		for _, name := range names {
+			if normalizeImageRef(name) == ref {
+				image = img
+				return
+			}
+		}
+	}
 	image = imgs[0]
 	return
 }
 
-// FnFindContainerByID return container by ID
+// normalizeImageRef returns name with its implicit latest tag, a reference pinned by a digest
+// is returned without its tag, as the daemon lists it in RepoDigests
+func normalizeImageRef(name string) string {
+	if i := strings.Index(name, "@"); i > -1 {
+		repo, _ := docker.ParseRepositoryTag(name[:i])
+		return repo + name[i:]
+	}
+	repo, tag := parseDockerImage(name)
+	return repo + ":" + tag
+}
+
+// FnFindContainerByID returns the container whose ID is ID or starts with it, e.g. the short
+// ID of 12 characters, with a single call to the daemon. A prefix shared by several containers
+// fails with ErrContainerIDAmbiguous.
 func FnFindContainerByID(client *docker.Client, ID string) (container docker.APIContainers, err error) {
-	var containers []docker.APIContainers
-	containers, err = client.ListContainers(docker.ListContainersOptions{All: true})
+	return findContainerByID(context.Background(), client, ID)
+}
+
+func findContainerByID(ctx context.Context, client *docker.Client, id string) (container docker.APIContainers, err error) {
+	if id == "" {
+		err = ErrContainerNotFound
+		return
+	}
+	// the daemon filters the IDs by prefix
+	containers, err := client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"id": {id}},
+		Context: ctx,
+	})
 	if err != nil {
 		return
 	}
-	for _, v := range containers {
-		if v.ID == ID {
-			container = v
+	matches := 0
+	for _, c := range containers {
+		if c.ID == id {
+			container = c
 			return
 		}
+		if strings.HasPrefix(c.ID, id) {
+			container = c
+			matches++
+		}
+	}
+	switch matches {
+	case 0:
+		err = ErrContainerNotFound
+	case 1:
+	default:
+		container = docker.APIContainers{}
+		err = ErrContainerIDAmbiguous
 	}
-	err = ErrContainerNotFound
 	return
 }
 
-// FnFindContainer return container by image name
+// FindOptions are the options of FnFindContainers
+type FindOptions struct {
+	// States selects the containers in one of the states, e.g. "running" or "exited", the
+	// containers in any state are selected when empty
+	States []string
+	// Limit is the maximum number of containers returned, the newest ones, they are all
+	// returned when zero
+	Limit int
+}
+
+// FnFindContainer return container by image name, the newest one, see FnFindContainers
 func FnFindContainer(client *docker.Client, imageName string) (container docker.APIContainers, err error) {
-	var containers []docker.APIContainers
-	containers, err = client.ListContainers(docker.ListContainersOptions{All: true})
+	containers, err := FnFindContainers(client, imageName, FindOptions{Limit: 1})
 	if err != nil {
 		return
 	}
+	if len(containers) == 0 {
+		err = ErrContainerNotFound
+		return
+	}
+	container = containers[0]
+	return
+}
 
+// FnFindContainers returns the containers of an image selected by opts, the newest first. The
+// image is the one given to FnContainer, or the one prefixed with gofn when no container of
+// the given one is selected.
+func FnFindContainers(client *docker.Client, imageName string, opts FindOptions) (containers []docker.APIContainers, err error) {
+	images := []string{imageName}
 	if !strings.HasPrefix(imageName, "gofn") {
-		imageName = "gofn/" + imageName
+		images = append(images, "gofn/"+imageName)
 	}
-
-	for _, v := range containers {
-		if v.Image == imageName {
-			container = v
+	filters := make(map[string][]string)
+	if len(opts.States) > 0 {
+		filters["status"] = opts.States
+	}
+	for i, image := range images {
+		filters["label"] = []string{LabelManaged + "=true", LabelImage + "=" + image}
+		containers, err = client.ListContainers(docker.ListContainersOptions{
+			All:     true,
+			Filters: filters,
+		})
+		if err != nil {
 			return
 		}
+		if i == len(images)-1 {
+			var legacy []docker.APIContainers
+			legacy, err = legacyContainers(client)
+			if err != nil {
+				return
+			}
+			for _, container := range legacy {
+				if container.Image == image {
+					containers = append(containers, container)
+				}
+			}
+		}
+		// the legacy containers are not filtered by the daemon
+		containers = inStates(containers, opts.States)
+		if len(containers) > 0 {
+			break
+		}
+	}
+	SortContainers(containers, OrderCreatedDesc)
+	if opts.Limit > 0 && len(containers) > opts.Limit {
+		containers = containers[:opts.Limit]
 	}
-	err = ErrContainerNotFound
 	return
 }
 
+// inStates returns the containers in one of states, all of them without states
+func inStates(containers []docker.APIContainers, states []string) []docker.APIContainers {
+	if len(states) == 0 {
+		return containers
+	}
+	var selected []docker.APIContainers
+	for _, container := range containers {
+		for _, state := range states {
+			if container.State == state {
+				selected = append(selected, container)
+				break
+			}
+		}
+	}
+	return selected
+}
+
 // FnKillContainer kill the container
 func FnKillContainer(client *docker.Client, containerID string) (err error) {
 	err = client.KillContainer(docker.KillContainerOptions{ID: containerID})
 	return
 }
 
-//FnAttach attach into a running container
+// FnStop stops the container with its stop signal, SIGTERM unless ContainerOptions.StopSignal,
+// so it can flush its work, the daemon kills it once timeout ends. timeout is rounded up to the
+// second, and stopping a container that is not running succeeds.
+func FnStop(client *docker.Client, containerID string, timeout time.Duration) (err error) {
+	err = client.StopContainer(containerID, uint(stopSeconds(timeout)))
+	if _, ok := err.(*docker.ContainerNotRunning); ok {
+		err = nil
+	}
+	return
+}
+
+// stopSeconds rounds timeout up to the second
+func stopSeconds(timeout time.Duration) int {
+	return int((timeout + time.Second - 1) / time.Second)
+}
+
+//FnAttach attach into a running container, the errors of the daemon are DaemonErrors and
+// errors.As reaches the original error of the docker client, e.g. a *docker.NoSuchContainer
 func FnAttach(client *docker.Client, containerID string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (w docker.CloseWaiter, err error) {
-	return client.AttachToContainerNonBlocking(docker.AttachToContainerOptions{
+	w, err = attach(context.Background(), client, containerID, stdin, stdout, stderr)
+	err = ClassifyError(err)
+	return
+}
+
+func attach(ctx context.Context, client *docker.Client, containerID string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (w docker.CloseWaiter, err error) {
+	// the output of a container without TTY multiplexes stdout and stderr and is demultiplexed
+	// into them, the output of a TTY is a single raw stream written to stdout
+	rawTerminal := false
+	if stdout != nil || stderr != nil {
+		var container *docker.Container
+		container, err = client.InspectContainerWithContext(containerID, ctx)
+		if err != nil {
+			return
+		}
+		rawTerminal = container.Config != nil && container.Config.Tty
+	}
+	w, err = attachStream(ctx, client, docker.AttachToContainerOptions{
 		Container:    containerID,
-		RawTerminal:  true,
+		RawTerminal:  rawTerminal,
 		Stream:       true,
 		Stdin:        true,
 		Stderr:       true,
@@ -239,81 +923,434 @@ func FnAttach(client *docker.Client, containerID string, stdin io.Reader, stdout
 		ErrorStream:  stderr,
 		OutputStream: stdout,
 	})
+	return
 }
 
-// FnStart start the container
+// FnStart start the container, the errors of the daemon are DaemonErrors and errors.As
+// reaches the original error of the docker client, e.g. a *docker.ContainerAlreadyRunning
 func FnStart(client *docker.Client, containerID string) error {
-	return client.StartContainer(containerID, nil)
+	return ClassifyError(client.StartContainer(containerID, nil))
 }
 
-// FnRun runs the container
+// FnRun runs the container, a non-zero exit of the container is returned as an ExecutionError
 func FnRun(client *docker.Client, containerID, input string) (Stdout *bytes.Buffer, Stderr *bytes.Buffer, err error) {
-	err = FnStart(client, containerID)
+	return FnRunWithContext(context.Background(), client, containerID, input)
+}
+
+// FnRunWithContext runs the container like FnRun, when ctx ends before the container exited
+// the container is stopped with FnStop within its stop timeout and ctx.Err() is returned
+func FnRunWithContext(ctx context.Context, client *docker.Client, containerID, input string) (Stdout *bytes.Buffer, Stderr *bytes.Buffer, err error) {
+	return FnRunWithOptions(ctx, client, containerID, input, RunOptions{})
+}
+
+// FnRunWithOptions runs the container like FnRunWithContext, a container running longer than
+// opts.Timeout is stopped, killed if it is still running after opts.StopGracePeriod, and
+// ErrExecutionTimeout is returned with the output it wrote until then. The output of a container
+// created with ContainerOptions.AutoRemove is attached since its logs are removed with it.
+func FnRunWithOptions(ctx context.Context, client *docker.Client, containerID, input string, opts RunOptions) (Stdout *bytes.Buffer, Stderr *bytes.Buffer, err error) {
+	return FnRunReaderWithOptions(ctx, client, containerID, strings.NewReader(input), opts)
+}
+
+// FnRunReader runs the container like FnRun streaming input to its stdin as it is read, so
+// large or binary payloads are not loaded in memory, a nil input is an empty stdin. It returns
+// once the whole input was written to the container, or the container exited without reading it.
+func FnRunReader(client *docker.Client, containerID string, input io.Reader) (Stdout *bytes.Buffer, Stderr *bytes.Buffer, err error) {
+	return FnRunReaderWithOptions(context.Background(), client, containerID, input, RunOptions{})
+}
+
+// FnRunReaderWithOptions runs the container like FnRunWithOptions streaming input to its stdin
+// like FnRunReader
+func FnRunReaderWithOptions(ctx context.Context, client *docker.Client, containerID string, input io.Reader, opts RunOptions) (Stdout *bytes.Buffer, Stderr *bytes.Buffer, err error) {
+	result, err := FnRunResult(ctx, client, containerID, input, opts)
+	return result.Stdout, result.Stderr, err
+}
+
+// FnRunResult runs the container like FnRunReaderWithOptions and describes the run in result:
+// its exit code, -1 when it did not exit, its output, whether it was killed out of memory and
+// the instants it started and finished at according to the daemon. The output is set whenever
+// the container was started, whatever err.
+func FnRunResult(ctx context.Context, client *docker.Client, containerID string, input io.Reader, opts RunOptions) (result RunResult, err error) {
+	result.ContainerID = containerID
+	result.ExitCode = -1
+	if input == nil {
+		input = strings.NewReader("")
+	}
+	container, err := client.InspectContainerWithContext(containerID, ctx)
 	if err != nil {
+		err = ClassifyError(err)
 		return
 	}
-
-	// attach to write input
-	_, err = FnAttach(client, containerID, strings.NewReader(input), nil, nil)
+	if container.Config != nil {
+		result.Image = container.Config.Image
+	}
+	stdout := &tailBuffer{max: opts.MaxOutputBytes}
+	stderr := &tailBuffer{max: opts.MaxOutputBytes}
+	streaming := opts.Stdout != nil || opts.Stderr != nil
+	var outStream, errStream io.Writer = stdout, stderr
+	if streaming {
+		relayOut, relayErr := relayOutput("stdout", stdout, opts.Stdout, opts.StreamOnly), relayOutput("stderr", stderr, opts.Stderr, opts.StreamOnly)
+		outStream, errStream = relayOut, relayErr
+		defer func() {
+			result.Warnings = append(result.Warnings, relayOut.warnings()...)
+			result.Warnings = append(result.Warnings, relayErr.warnings()...)
+		}()
+	}
+	// the secrets are masked before the output reaches the relays and the buffers
+	outStream, errStream = maskSecrets(outStream, opts.MaskSecrets), maskSecrets(errStream, opts.MaskSecrets)
+	// an auto removed container is gone with its logs once it exited, so its exit is subscribed
+	// to and its output attached before it is started
+	var stream, stdin docker.CloseWaiter
+	var exit <-chan containerExit
+	if container.HostConfig != nil && container.HostConfig.AutoRemove {
+		waitCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		exit, err = waitNextExit(waitCtx, client, containerID)
+		if err == nil {
+			stream, err = attachStream(ctx, client, docker.AttachToContainerOptions{
+				Container:    containerID,
+				InputStream:  input,
+				OutputStream: outStream,
+				ErrorStream:  errStream,
+				Stdin:        true,
+				Stdout:       true,
+				Stderr:       true,
+				Stream:       true,
+			})
+		}
+		if err == nil {
+			defer stream.Close()
+			err = client.StartContainerWithContext(containerID, nil, ctx)
+		}
+	} else {
+		err = client.StartContainerWithContext(containerID, nil, ctx)
+		if err == nil && streaming {
+			// the output is attached from the start of the container, its logs included
+			stream, err = attach(ctx, client, containerID, input, outStream, errStream)
+			if err == nil {
+				defer stream.Close()
+			}
+		} else if err == nil {
+			// attach to write input, the stream ends once the whole input was written and the
+			// stdin of the container closed
+			stdin, err = attach(ctx, client, containerID, input, nil, nil)
+			if err == nil {
+				defer stdin.Close()
+			}
+		}
+	}
 	if err != nil {
+		err = ClassifyError(err)
 		return
 	}
+	result.StartedAt = time.Now()
 
-	e := FnWaitContainer(client, containerID)
-	err = <-e
-
-	stdout := new(bytes.Buffer)
-	stderr := new(bytes.Buffer)
+	var timedOut int32
+	var timer *time.Timer
+	if opts.Timeout > 0 {
+		grace := stopGrace(container, opts.StopGracePeriod)
+		// the stopped container exits, which ends the wait
+		timer = time.AfterFunc(opts.Timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			_ = safely("execution timeout", func() error {
+				return stopContainer(client, containerID, grace)
+			})
+		})
+	}
+	code := -1
+	if exit != nil {
+		code, err = awaitExit(ctx, exit)
+		if ctx.Err() != nil {
+			_ = stopContainer(client, containerID, stopGrace(container, opts.StopGracePeriod))
+			err = ctx.Err()
+		}
+	} else {
+		code, err = waitContainer(ctx, client, containerID, stopGrace(container, opts.StopGracePeriod))
+	}
+	// a container exiting on its own just before the timeout stops the timer in time
+	if timer != nil && !timer.Stop() && atomic.LoadInt32(&timedOut) == 1 && ctx.Err() == nil {
+		err = ErrExecutionTimeout
+	}
+	err = ClassifyError(err)
+	if stdin != nil {
+		// the stream of a container exiting without reading its whole input fails, which is
+		// not an error of the run
+		_ = waitStream(ctx, stdin)
+	}
 
-	// omit logs because execution error is more important
-	_ = FnLogs(client, containerID, stdout, stderr) // nolint
+	// omit logs because execution error is more important, they are read even when ctx ended
+	// so the output written until then is returned
+	if stream != nil {
+		// the attached stream ends with the exited container
+		_ = stream.Wait()
+	} else {
+		_ = client.Logs(docker.LogsOptions{ // nolint
+			Context:      context.Background(),
+			Container:    containerID,
+			Stdout:       true,
+			Stderr:       true,
+			ErrorStream:  errStream,
+			OutputStream: outStream,
+		})
+	}
+	flushMasks(outStream, errStream)
+	var truncatedOut, truncatedErr bool
+	result.Stdout, truncatedOut = stdout.buffer()
+	result.Stderr, truncatedErr = stderr.buffer()
+	result.Truncated = truncatedOut || truncatedErr
 
-	Stdout = stdout
-	Stderr = stderr
+	result.FinishedAt = time.Now()
+	if err == nil {
+		result.ExitCode = code
+	}
+	// the instants of the daemon replace the local ones, an auto removed container is gone
+	if container, inspectErr := client.InspectContainerWithContext(containerID, context.Background()); inspectErr == nil {
+		result.OOMKilled = container.State.OOMKilled
+		if !container.State.StartedAt.IsZero() {
+			result.StartedAt = container.State.StartedAt
+		}
+		if !container.State.FinishedAt.IsZero() && !container.State.Running {
+			result.FinishedAt = container.State.FinishedAt
+		}
+	}
+	if err == nil && code != 0 {
+		err = &ExecutionError{ExitCode: code, OOMKilled: result.OOMKilled, Stderr: result.Stderr.String()}
+	}
 	return
 }
 
 // FnLogs logs all container activity
 func FnLogs(client *docker.Client, containerID string, stdout io.Writer, stderr io.Writer) error {
-	return client.Logs(docker.LogsOptions{
+	return ClassifyError(client.Logs(docker.LogsOptions{
 		Container:    containerID,
 		Stdout:       true,
 		Stderr:       true,
 		ErrorStream:  stderr,
 		OutputStream: stdout,
+	}))
+}
+
+// LogsOptions select the output read by FnLogsWithOptions
+type LogsOptions struct {
+	// Tail is the number of lines read from the end of the output, the whole output when zero
+	Tail int
+	// Since skips the output written before, rounded down to the second, none is skipped when zero
+	Since time.Time
+	// Timestamps prefixes each line with the RFC3339Nano instant it was written at
+	Timestamps bool
+	// Follow keeps writing the output of the running container until it exits or ctx ends
+	Follow bool
+	// MaskSecrets are values replaced with SecretMask in the output
+	MaskSecrets []string
+}
+
+// FnLogsWithOptions writes the output of the container selected by opts to stdout and stderr,
+// the output of a container with a TTY is written to stdout only. A followed output ends with
+// ctx.Err() when ctx ends before the container exited.
+func FnLogsWithOptions(ctx context.Context, client *docker.Client, containerID string, stdout, stderr io.Writer, opts LogsOptions) (err error) {
+	container, err := client.InspectContainerWithContext(containerID, ctx)
+	if err != nil {
+		err = ClassifyError(err)
+		return
+	}
+	tail := "all"
+	if opts.Tail > 0 {
+		tail = strconv.Itoa(opts.Tail)
+	}
+	var since int64
+	if !opts.Since.IsZero() {
+		since = opts.Since.Unix()
+	}
+	stdout, stderr = maskSecrets(stdout, opts.MaskSecrets), maskSecrets(stderr, opts.MaskSecrets)
+	err = client.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    containerID,
+		Stdout:       true,
+		Stderr:       true,
+		Tail:         tail,
+		Since:        since,
+		Timestamps:   opts.Timestamps,
+		Follow:       opts.Follow,
+		RawTerminal:  container.Config != nil && container.Config.Tty,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
 	})
+	flushMasks(stdout, stderr)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	err = ClassifyError(err)
+	return
 }
 
 // FnWaitContainer wait until container finnish your processing
 func FnWaitContainer(client *docker.Client, containerID string) chan error {
-	errs := make(chan error)
-	go func() {
-		code, err := client.WaitContainer(containerID)
+	return FnWaitContainerWithContext(context.Background(), client, containerID)
+}
+
+// FnWaitContainerWithContext waits the container like FnWaitContainer, when ctx ends before
+// the container exited the container is stopped with FnStop within its stop timeout and
+// ctx.Err() is sent. The channel receives a single value, ErrContainerExecutionFailed for a
+// non-zero exit, and is buffered so the goroutine waiting the container never outlives the
+// wait even when the channel is not read. FnWaitExit also tells the exit code.
+func FnWaitContainerWithContext(ctx context.Context, client *docker.Client, containerID string) chan error {
+	errs := make(chan error, 1)
+	goSafe("wait container", func() error {
+		code, err := waitContainer(ctx, client, containerID, 0)
+		if err == nil && code != 0 {
+			err = ErrContainerExecutionFailed
+		}
+		return err
+	}, func(err error) {
+		errs <- err
+	})
+	return errs
+}
+
+// WaitResult is the exit of a container waited by FnWaitExit
+type WaitResult struct {
+	// ExitCode is the exit code of the container, -1 when it did not exit
+	ExitCode int
+	// Err is the error of the wait, ctx.Err() when ctx ended before the container exited
+	Err error
+}
+
+// FnWaitExit waits the container like FnWaitContainerWithContext and sends its exit code, a
+// non-zero exit is not an error. The channel receives a single value and is buffered like the
+// one of FnWaitContainerWithContext.
+func FnWaitExit(ctx context.Context, client *docker.Client, containerID string) <-chan WaitResult {
+	exits := make(chan WaitResult, 1)
+	var exit WaitResult
+	goSafe("wait exit", func() (err error) {
+		exit.ExitCode, err = waitContainer(ctx, client, containerID, 0)
+		return
+	}, func(err error) {
 		if err != nil {
-			errs <- err
+			exit = WaitResult{ExitCode: -1, Err: err}
 		}
-		if code != 0 {
-			errs <- ErrContainerExecutionFailed
+		exits <- exit
+	})
+	return exits
+}
+
+// waitContainer returns the exit code of the container, when ctx ends before the container
+// exited the container is stopped within grace and ctx.Err() is returned, grace is the stop
+// timeout of the container when zero
+func waitContainer(ctx context.Context, client *docker.Client, containerID string, grace time.Duration) (code int, err error) {
+	code, err = exitCode(ctx, client, containerID)
+	if ctx.Err() != nil {
+		// the container hangs, it is stopped so it does not keep running unattended
+		if grace == 0 {
+			grace = containerStopGrace(client, containerID)
 		}
-		errs <- nil
-	}()
-	return errs
+		_ = stopContainer(client, containerID, grace)
+		err = ctx.Err()
+	}
+	return
 }
 
-// FnListContainers lists all the containers created by the gofn.
+// stopContainer stops the container with FnStop and kills it when the stop fails
+func stopContainer(client *docker.Client, containerID string, grace time.Duration) (err error) {
+	// the daemon kills the container once the grace period ends
+	err = FnStop(client, containerID, grace)
+	if err != nil {
+		err = FnKillContainer(client, containerID)
+	}
+	return
+}
+
+// stopGrace returns grace, or the stop timeout of container when zero
+func stopGrace(container *docker.Container, grace time.Duration) time.Duration {
+	if grace > 0 {
+		return grace
+	}
+	if container.Config != nil && container.Config.StopTimeout > 0 {
+		return time.Duration(container.Config.StopTimeout) * time.Second
+	}
+	return DefaultStopGracePeriod
+}
+
+// containerStopGrace returns the stop timeout of the container, DefaultStopGracePeriod when it
+// can not be inspected
+func containerStopGrace(client *docker.Client, containerID string) time.Duration {
+	container, err := client.InspectContainer(containerID)
+	if err != nil {
+		return DefaultStopGracePeriod
+	}
+	return stopGrace(container, 0)
+}
+
+// FnListContainers lists all the containers created by the gofn, selected by their LabelManaged.
 // It returns the APIContainers from the API, but have to be formatted for pretty printing
 func FnListContainers(client *docker.Client) (containers []docker.APIContainers, err error) {
-	hostContainers, err := client.ListContainers(docker.ListContainersOptions{
-		All: true,
+	containers, err = client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {LabelManaged + "=true"}},
 	})
 	if err != nil {
 		containers = nil
 		return
 	}
-	for _, container := range hostContainers {
-		if strings.HasPrefix(container.Image, "gofn/") {
+	legacy, err := legacyContainers(client)
+	if err != nil {
+		containers = nil
+		return
+	}
+	containers = append(containers, legacy...)
+	return
+}
+
+// legacyContainers lists the containers created before LabelManaged, recognized by the gofn-
+// prefix of their name and selected by the daemon. The containers gofn labels itself, e.g. the
+// locks of a DaemonFence, are not function containers. They are listed until the next release,
+// the containers left by then are listed by docker only.
+func legacyContainers(client *docker.Client) (containers []docker.APIContainers, err error) {
+	named, err := client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"name": {"^/gofn-"}},
+	})
+	if err != nil {
+		return
+	}
+	for _, container := range named {
+		// the name filter of the daemon is a regular expression on any of the names
+		if hasNamePrefix(container, "/gofn-") && !hasGofnLabel(container.Labels) {
 			containers = append(containers, container)
 		}
 	}
 	return
 }
+
+func hasNamePrefix(container docker.APIContainers, prefix string) bool {
+	for _, name := range container.Names {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasGofnLabel reports whether one of labels is an io.gofn label
+func hasGofnLabel(labels map[string]string) bool {
+	for label := range labels {
+		if strings.HasPrefix(label, "io.gofn.") {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatedBy is the value of the LabelCreatedBy of the function containers, the name of the
+// program by default, set it to tell apart the containers of programs sharing a host
+var CreatedBy = filepath.Base(os.Args[0])
+
+// managedLabels returns a copy of labels with the labels of a function container of image
+func managedLabels(labels map[string]string, image string) map[string]string {
+	managed := make(map[string]string, len(labels)+3)
+	for k, v := range labels {
+		managed[k] = v
+	}
+	managed[LabelManaged] = "true"
+	managed[LabelImage] = image
+	managed[LabelCreatedBy] = CreatedBy
+	return managed
+}
@@ -18,6 +18,7 @@ func TestFnImageBuildIntegration(t *testing.T) {
 		ImageName:               "nuveo/testprivategofn",
 		DoNotUsePrefixImageName: true,
 		ContextDir:              "./",
+		FallbackToPull:          true,
 		Auth: docker.AuthConfiguration{
 			Username: os.Getenv("DOCKER_LOGIN"),
 			Password: os.Getenv("DOCKER_PASSWORD"),
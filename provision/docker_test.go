@@ -1,11 +1,28 @@
 package provision
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 	fake "github.com/fsouza/go-dockerclient/testing"
+	"github.com/gofn/gofn/internal/names"
 )
 
 func createFakeDockerAPI(t *testing.T) *fake.DockerServer {
@@ -104,6 +121,42 @@ func TestFnContainerCreatedSuccessfully(t *testing.T) {
 
 }
 
+type failingEntropy struct{}
+
+func (failingEntropy) Read(p []byte) (int, error) {
+	return 0, errors.New("entropy exhausted")
+}
+
+func TestFnContainerUUIDFallback(t *testing.T) {
+	defer func(entropy io.Reader, warn func(string, ...interface{})) {
+		names.Default.Entropy, names.Default.Warn = entropy, warn
+	}(names.Default.Entropy, names.Default.Warn)
+	var warnings []string
+	names.Default.Entropy = failingEntropy{}
+	names.Default.Warn = func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	created := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		container, err := FnContainer(client, ContainerOptions{Image: image})
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		if !regexp.MustCompile(`^/?gofn-[a-z0-9]+-[a-z0-9]+-[a-z0-9]{6}$`).MatchString(container.Name) || created[container.Name] {
+			t.Errorf("expected a unique fallback name but found %q", container.Name)
+		}
+		created[container.Name] = true
+	}
+	if len(warnings) != 2 {
+		t.Errorf("expected the fallbacks to be reported but found %v", warnings)
+	}
+}
+
 func TestFnContainerInvalidImage(t *testing.T) {
 
 	server := createFakeDockerAPI(t)
@@ -169,13 +222,43 @@ func TestFnContainerCreatedWithEnvVars(t *testing.T) {
 
 }
 
+func TestFnContainerEntrypoint(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	bodies := recordCreateBodies(server)
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	tests := []struct {
+		name       string
+		entrypoint []string
+		body       string
+	}{
+		{"image entrypoint", nil, `"Entrypoint":null`},
+		{"cleared entrypoint", []string{}, `"Entrypoint":[]`},
+		{"entrypoint", []string{"/bin/sh", "-c"}, `"Entrypoint":["/bin/sh","-c"]`},
+	}
+	for i, test := range tests {
+		container, err := FnContainer(client, ContainerOptions{Image: image, Entrypoint: test.entrypoint, Cmd: []string{"run"}, WorkingDir: "/app"})
+		if err != nil {
+			t.Fatalf("%s: expected no errors but %q found", test.name, err)
+		}
+		if !strings.Contains((*bodies)[i], test.body) {
+			t.Errorf("%s: expected %s in the creation of the container but found %s", test.name, test.body, (*bodies)[i])
+		}
+		if container.Config.WorkingDir != "/app" || !reflect.DeepEqual(container.Config.Entrypoint, test.entrypoint) {
+			t.Errorf("%s: unexpected config %+v", test.name, container.Config)
+		}
+	}
+}
+
 func TestFnBuildImageSuccessfully(t *testing.T) {
 	server := createFakeDockerAPI(t)
 	defer server.Stop()
 
 	// Instantiate a client
 	client := NewTestClient(server.URL(), t)
-	name, _, err := FnImageBuild(client, &BuildOptions{"./testing_data", "", false, "test", "", "", nil, docker.AuthConfiguration{}, false})
+	name, _, err := FnImageBuild(client, &BuildOptions{ContextDir: "./testing_data", ImageName: "test"})
 	if err != nil {
 		t.Errorf("FnImageBuild expected nil but found %q, %q", name, err)
 	}
@@ -192,7 +275,7 @@ func TestFnBuildImageRemoteSuccessfully(t *testing.T) {
 
 	// Instantiate a client
 	client := NewTestClient(server.URL(), t)
-	name, _, err := FnImageBuild(client, &BuildOptions{"./testing_data", "", false, "test", "https://github.com/gofn/dockerfile-python-exampl://github.com/gofn/dockerfile-python-example.git", "", nil, docker.AuthConfiguration{}, false})
+	name, _, err := FnImageBuild(client, &BuildOptions{ContextDir: "./testing_data", ImageName: "test", RemoteURI: "https://github.com/gofn/dockerfile-python-exampl://github.com/gofn/dockerfile-python-example.git"})
 	if err != nil {
 		t.Errorf("FnImageBuild expected nil but found %q, %q", name, err)
 	}
@@ -210,7 +293,7 @@ func TestFnBuildImageDoNotUsePrefixImageName(t *testing.T) {
 	// Instantiate a client
 	client := NewTestClient(server.URL(), t)
 	imageName := "testDoNotUsePrefixImageName"
-	name, _, err := FnImageBuild(client, &BuildOptions{"./testing_data", "", true, imageName, "", "", nil, docker.AuthConfiguration{}, false})
+	name, _, err := FnImageBuild(client, &BuildOptions{ContextDir: "./testing_data", DoNotUsePrefixImageName: true, ImageName: imageName})
 	if err != nil {
 		t.Errorf("FnImageBuild expected nil but found %q, %q", name, err)
 	}
@@ -225,7 +308,7 @@ func TestFnBuildImageDockerfileNotFound(t *testing.T) {
 
 	// Instantiate a client
 	client := NewTestClient(server.URL(), t)
-	_, _, err := FnImageBuild(client, &BuildOptions{"./wrong", "Dockerfile", false, "test", "", "", nil, docker.AuthConfiguration{}, false})
+	_, _, err := FnImageBuild(client, &BuildOptions{ContextDir: "./wrong", Dockerfile: "Dockerfile", ImageName: "test"})
 	if err == nil {
 		t.Errorf("FnImageBuild expected error but returned nil")
 	}
@@ -267,6 +350,47 @@ func TestFnFindImageServerError(t *testing.T) {
 	}
 }
 
+func TestFnFindImageExactName(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	// the daemon filter matches the names sharing the prefix, listed first
+	server.CustomHandler("/images/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[
+			{"Id": "sha256:v2", "RepoTags": ["gofn/report-v2:latest"], "RepoDigests": ["gofn/report-v2@sha256:d2"]},
+			{"Id": "sha256:v1", "RepoTags": ["gofn/report:v1"], "RepoDigests": ["gofn/report@sha256:d1"]},
+			{"Id": "sha256:latest", "RepoTags": ["gofn/report:latest"], "RepoDigests": ["gofn/report@sha256:d0"]}
+		]`))
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"gofn/report", "sha256:latest"},
+		{"gofn/report:latest", "sha256:latest"},
+		{"gofn/report:v1", "sha256:v1"},
+		{"gofn/report-v2", "sha256:v2"},
+		{"gofn/report@sha256:d1", "sha256:v1"},
+		{"gofn/report:v1@sha256:d0", "sha256:latest"},
+		{"sha256:v1", "sha256:v1"},
+		// nothing matches exactly, the first image of the filter is kept
+		{"gofn/report:v3", "sha256:v2"},
+		{"gofn/report@sha256:d3", "sha256:v2"},
+	}
+	for _, test := range tests {
+		image, err := FnFindImage(client, test.name)
+		if err != nil {
+			t.Errorf("%s: expected no errors but found %q", test.name, err)
+			continue
+		}
+		if image.ID != test.want {
+			t.Errorf("%s: expected the image %s but found %s", test.name, test.want, image.ID)
+		}
+	}
+}
+
 func TestFnFindContainerSuccessfully(t *testing.T) {
 	server := createFakeDockerAPI(t)
 	defer server.Stop()
@@ -325,6 +449,123 @@ func TestFnListContainers(t *testing.T) {
 	}
 }
 
+func TestFnListContainersLabels(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	var filters []string
+	server.CustomHandler("/containers/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = append(filters, r.URL.Query().Get("filters"))
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+	_ = client.PullImage(docker.PullImageOptions{Repository: "python"}, docker.AuthConfiguration{})
+
+	prefixed, err := FnContainer(client, ContainerOptions{Image: createFakeImage(client)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unprefixed, err := FnContainer(client, ContainerOptions{Image: "python"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := createFakeContainer(client, t)
+	// a container of another program is not listed, even of a gofn image, nor the lock of a run
+	if _, err = client.CreateContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: "python"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.CreateContainer(docker.CreateContainerOptions{Name: "builder", Config: &docker.Config{Image: "gofn/python"}}); err != nil {
+		t.Fatal(err)
+	}
+	release, err := (&DaemonFence{Client: client}).Acquire(context.Background(), "nightly", "gofn/python", ExclusiveFailFast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if labels := unprefixed.Config.Labels; labels[LabelManaged] != "true" || labels[LabelImage] != "python" || labels[LabelCreatedBy] != CreatedBy || CreatedBy == "" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+
+	filters = nil
+	containers, err := FnListContainers(client)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	listed := map[string]bool{}
+	for _, container := range containers {
+		listed[container.ID] = true
+	}
+	if len(containers) != 3 || !listed[prefixed.ID] || !listed[unprefixed.ID] || !listed[legacy.ID] {
+		t.Errorf("expected the labeled and the legacy containers but found %+v", containers)
+	}
+	if len(filters) != 2 || !strings.Contains(filters[0], LabelManaged+"=true") || !strings.Contains(filters[1], `"name":["^/gofn-"]`) {
+		t.Errorf("expected the containers to be filtered by label and by name but found the filters %q", filters)
+	}
+
+	container, err := FnFindContainer(client, "python")
+	if err != nil || container.ID != unprefixed.ID {
+		t.Errorf("expected the container of the unprefixed image but found %s and %v", container.ID, err)
+	}
+	found, err := FnFindContainers(client, "gofn/python", FindOptions{})
+	if err != nil || len(found) != 2 || found[0].ID == unprefixed.ID || found[1].ID == unprefixed.ID {
+		t.Errorf("expected the labeled and the legacy containers of the prefixed image but found %+v and %v", found, err)
+	}
+}
+
+func TestFnFindContainers(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	// the same function ran three times, one still running, and a container of another image
+	states := map[string]string{}
+	for _, state := range []string{"exited", "exited", "running", "created"} {
+		container, err := FnContainer(client, ContainerOptions{Image: image})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != "created" {
+			runFakeContainer(client, container.ID, t)
+		}
+		if state == "exited" {
+			if err = client.StopContainer(container.ID, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		states[container.ID] = state
+	}
+	legacy := createFakeContainer(client, t)
+	states[legacy.ID] = "created"
+
+	tests := []struct {
+		name string
+		opts FindOptions
+		want map[string]int
+	}{
+		{"all", FindOptions{}, map[string]int{"exited": 2, "running": 1, "created": 2}},
+		{"exited", FindOptions{States: []string{"exited"}}, map[string]int{"exited": 2}},
+		{"running or created", FindOptions{States: []string{"running", "created"}}, map[string]int{"running": 1, "created": 2}},
+		{"paused", FindOptions{States: []string{"paused"}}, map[string]int{}},
+		{"limit", FindOptions{States: []string{"exited"}, Limit: 1}, map[string]int{"exited": 1}},
+	}
+	for _, test := range tests {
+		containers, err := FnFindContainers(client, "python", test.opts)
+		if err != nil {
+			t.Fatalf("%s: Expected no errors but %q found", test.name, err)
+		}
+		found := map[string]int{}
+		for _, container := range containers {
+			found[states[container.ID]]++
+		}
+		if !reflect.DeepEqual(found, test.want) {
+			t.Errorf("%s: expected the states %v but found %v", test.name, test.want, found)
+		}
+	}
+	if _, err := FnFindContainer(client, "python"); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+}
+
 func TestFnFindContainerByIDServerError(t *testing.T) {
 	client := NewTestClient("wrong", t)
 
@@ -350,6 +591,47 @@ func TestFnFindContainerByIDSuccessfully(t *testing.T) {
 	}
 }
 
+func TestFnFindContainerByIDPrefix(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	var filters []string
+	server.CustomHandler("/containers/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = append(filters, r.URL.Query().Get("filters"))
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	found, err := FnFindContainerByID(client, container.ID[:12])
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if found.ID != container.ID {
+		t.Errorf("expected the container %s but found %s", container.ID, found.ID)
+	}
+	if len(filters) != 1 || filters[0] != `{"id":["`+container.ID[:12]+`"]}` {
+		t.Errorf("expected a single listing filtered by ID but found %q", filters)
+	}
+
+	// the daemon answers the containers sharing the prefix
+	server.CustomHandler("/containers/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[{"Id": "abc123"}, {"Id": "abc456"}, {"Id": "abc"}]`))
+	}))
+	if _, err = FnFindContainerByID(client, "abc1"); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	if _, err = FnFindContainerByID(client, "ab"); err != ErrContainerIDAmbiguous {
+		t.Errorf("expected %q but found %v", ErrContainerIDAmbiguous, err)
+	}
+	if found, err = FnFindContainerByID(client, "abc"); err != nil || found.ID != "abc" {
+		t.Errorf("expected the exact ID to win over the prefixes but found %q and %v", found.ID, err)
+	}
+	if _, err = FnFindContainerByID(client, ""); err != ErrContainerNotFound {
+		t.Errorf("expected %q for an empty ID but found %v", ErrContainerNotFound, err)
+	}
+}
+
 func TestFnFindContainerContainerNotFound(t *testing.T) {
 	server := createFakeDockerAPI(t)
 	defer server.Stop()
@@ -423,3 +705,836 @@ func TestFnKilContainerNotFound(t *testing.T) {
 		t.Errorf("expecting errors, but nothing found")
 	}
 }
+
+// fakeHangingWait makes the waits of the fake docker api hang until the client gives up,
+// it returns the stop requests received, with their timeout, and the number of containers killed
+func fakeHangingWait(server *fake.DockerServer) (stops func() []string, kills func() int) {
+	var mu sync.Mutex
+	killed := 0
+	var stopped []string
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	server.CustomHandler("/containers/.*/stop", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		stopped = append(stopped, "t="+r.URL.Query().Get("t"))
+		mu.Unlock()
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	server.CustomHandler("/containers/.*/kill", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		killed++
+		mu.Unlock()
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	stops = func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), stopped...)
+	}
+	kills = func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return killed
+	}
+	return
+}
+
+func TestFnWaitContainerWithContext(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	stops, kills := fakeHangingWait(server)
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+	runFakeContainer(client, container.ID, t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	select {
+	case err := <-FnWaitContainerWithContext(ctx, client, container.ID):
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected %v but found %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the wait to end with the context")
+	}
+	if got := stops(); len(got) != 1 || got[0] != "t=10" || kills() != 0 {
+		t.Errorf("expected the hanging container to be stopped once within the default timeout but found the stops %v and %d kills", got, kills())
+	}
+}
+
+func TestFnRunWithContext(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	stops, kills := fakeHangingWait(server)
+	fakeLogs(server, "partial", "")
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	stdout, _, err := FnRunWithContext(ctx, client, container.ID, "input")
+	if err != context.Canceled {
+		t.Errorf("expected %v but found %v", context.Canceled, err)
+	}
+	if stdout.String() != "partial" {
+		t.Errorf("expected the output written before the cancellation but found %q", stdout)
+	}
+	if len(stops()) != 1 || kills() != 0 {
+		t.Errorf("expected the hanging container to be stopped once but found the stops %v and %d kills", stops(), kills())
+	}
+
+	// the container exits on its own before the context ends
+	server = createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 3, 0)
+	client = NewTestClient(server.URL(), t)
+	container = createFakeContainer(client, t)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err = FnRunWithContext(ctx, client, container.ID, "input")
+	if execErr, ok := err.(*ExecutionError); !ok || execErr.Unwrap() != ErrContainerExecutionFailed || execErr.ExitCode != 3 {
+		t.Errorf("expected the exit code of the container but found %v", err)
+	}
+}
+
+// fakeStoppableWait makes the containers of the fake docker api run until they are stopped,
+// they then exit with 143 after writing their last words
+func fakeStoppableWait(server *fake.DockerServer) (stops func() []string) {
+	var mu sync.Mutex
+	var queries []string
+	stopped := make(chan struct{})
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stopped:
+		case <-r.Context().Done():
+			return
+		}
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			_ = server.MutateContainer(m[1], docker.State{ExitCode: 143, StartedAt: time.Now()})
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	server.CustomHandler("/containers/.*/stop", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		close(stopped)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), queries...)
+	}
+}
+
+func TestFnRunWithOptionsTimeout(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	stops := fakeStoppableWait(server)
+	fakeLogs(server, "partial", "terminated")
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	start := time.Now()
+	stdout, stderr, err := FnRunWithOptions(context.Background(), client, container.ID, "", RunOptions{Timeout: 50 * time.Millisecond, StopGracePeriod: 2500 * time.Millisecond})
+	if err != ErrExecutionTimeout {
+		t.Fatalf("expected %v but found %v", ErrExecutionTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected the run to end once the container was stopped but it took %v", elapsed)
+	}
+	if stdout.String() != "partial" || stderr.String() != "terminated" {
+		t.Errorf("expected the output written before the timeout but found %q, %q", stdout, stderr)
+	}
+	if queries := stops(); len(queries) != 1 || queries[0] != "t=3" {
+		t.Errorf("expected a single stop with the grace period but found %v", queries)
+	}
+
+	// the container exits before the timeout
+	server = createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	client = NewTestClient(server.URL(), t)
+	container = createFakeContainer(client, t)
+	if _, _, err = FnRunWithOptions(context.Background(), client, container.ID, "", RunOptions{Timeout: time.Minute}); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+}
+
+func TestFnRunExecutionError(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeLogs(server, "", "killed")
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			_ = server.MutateContainer(m[1], docker.State{ExitCode: 137, OOMKilled: true, StartedAt: time.Now()})
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	_, stderr, err := FnRun(client, container.ID, "")
+	execErr, ok := err.(*ExecutionError)
+	if !ok || execErr.ExitCode != 137 || !execErr.OOMKilled || execErr.Stderr != "killed" || stderr.String() != "killed" {
+		t.Fatalf("expected the container to be reported as killed out of memory but found %#v", err)
+	}
+	if !strings.Contains(execErr.Error(), "exit code 137, out of memory") {
+		t.Errorf("unexpected message %q", execErr.Error())
+	}
+}
+
+func TestFnRunResult(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeLogs(server, "out", "killed")
+	started := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			_ = server.MutateContainer(m[1], docker.State{ExitCode: 137, OOMKilled: true, StartedAt: started, FinishedAt: started.Add(3 * time.Second)})
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	result, err := FnRunResult(context.Background(), client, container.ID, strings.NewReader("in"), RunOptions{})
+	if execErr, ok := err.(*ExecutionError); !ok || !execErr.OOMKilled {
+		t.Errorf("expected an execution error out of memory but found %v", err)
+	}
+	if result.ContainerID != container.ID || result.ExitCode != 137 || !result.OOMKilled || result.Image != "gofn/python" {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if result.Stdout.String() != "out" || result.Stderr.String() != "killed" {
+		t.Errorf("unexpected output %q and %q", result.Stdout, result.Stderr)
+	}
+	if !result.StartedAt.Equal(started) || result.FinishedAt.Sub(result.StartedAt) != 3*time.Second {
+		t.Errorf("expected the instants of the daemon but found %v and %v", result.StartedAt, result.FinishedAt)
+	}
+
+	result, err = FnRunResult(context.Background(), client, "missing", nil, RunOptions{})
+	if err == nil || result.ExitCode != -1 || result.Stdout != nil {
+		t.Errorf("expected a missing container to fail without output but found %+v and %v", result, err)
+	}
+}
+
+// relayRecorder records what a running container relays to it, failing with err when set,
+// its first write is notified to received
+type relayRecorder struct {
+	mu       sync.Mutex
+	relayed  bytes.Buffer
+	err      error
+	received chan struct{}
+}
+
+func (r *relayRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.relayed.Len() == 0 && r.received != nil {
+		r.received <- struct{}{}
+	}
+	return r.relayed.Write(p)
+}
+
+func (r *relayRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.relayed.String()
+}
+
+func TestFnRunResultStreaming(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeLogs(server, "from logs", "")
+	received := make(chan struct{}, 1)
+	// the container only exits once its output was relayed
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+		}
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			_ = server.MutateContainer(m[1], docker.State{StartedAt: time.Now()})
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	server.CustomHandler("/containers/.*/attach", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n"))
+		encodeFrames(conn, []frame{{StreamStdout, "progress\n"}, {StreamStderr, "warn\n"}})
+	}))
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	stdout := &relayRecorder{received: received}
+	stderr := &relayRecorder{err: errors.New("websocket closed")}
+	result, err := FnRunResult(context.Background(), client, container.ID, nil, RunOptions{Stdout: stdout, Stderr: stderr})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if stdout.String() != "progress\n" {
+		t.Errorf("expected the output to be relayed but found %q", stdout.String())
+	}
+	if result.Stdout.String() != "progress\n" || result.Stderr.String() != "warn\n" {
+		t.Errorf("expected the whole output in the result but found %q and %q", result.Stdout, result.Stderr)
+	}
+	if len(result.Warnings) != 1 || result.Warnings[0] != "stderr writer disabled: websocket closed" {
+		t.Errorf("expected the failed writer to be reported but found %v", result.Warnings)
+	}
+
+	container, err = client.CreateContainer(docker.CreateContainerOptions{Name: "gofn-stream-only", Config: &docker.Config{Image: createFakeImage(client)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout = &relayRecorder{received: received}
+	result, err = FnRunResult(context.Background(), client, container.ID, nil, RunOptions{Stdout: stdout, StreamOnly: true})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if stdout.String() != "progress\n" || result.Stdout.Len() != 0 || result.Stderr.Len() != 0 {
+		t.Errorf("expected the output to be only relayed but found %q and %q", stdout.String(), result.Stdout)
+	}
+}
+
+func TestFnLogsWithOptions(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	queries := make(chan url.Values, 2)
+	server.CustomHandler("/containers/.*/logs", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		writeFrame(w, 1, "line 99\nline 100\n")
+		if r.URL.Query().Get("follow") == "1" {
+			// the container keeps running
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	var stdout bytes.Buffer
+	since := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	err := FnLogsWithOptions(context.Background(), client, container.ID, &stdout, nil, LogsOptions{Tail: 2, Since: since, Timestamps: true})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if stdout.String() != "line 99\nline 100\n" {
+		t.Errorf("unexpected logs %q", stdout.String())
+	}
+	query := <-queries
+	if query.Get("tail") != "2" || query.Get("since") != strconv.FormatInt(since.Unix(), 10) || query.Get("timestamps") != "1" || query.Get("follow") != "" {
+		t.Errorf("unexpected logs query %v", query)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = FnLogsWithOptions(ctx, client, container.ID, ioutil.Discard, ioutil.Discard, LogsOptions{Follow: true})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the followed logs to end with the context but found %v", err)
+	}
+	if query = <-queries; query.Get("tail") != "all" || query.Get("follow") != "1" {
+		t.Errorf("unexpected logs query %v", query)
+	}
+}
+
+func TestFnImageBuildReport(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+
+	report, err := FnImageBuildReport(client, testBuildOptions())
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	image, err := client.InspectImage("gofn/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Name != "gofn/test" || report.ID != image.ID || report.Digest != "" || report.Stdout == nil {
+		t.Errorf("unexpected report %+v of the image %s", report, image.ID)
+	}
+
+	// the digest of the pulled repository is picked among the digests of the image
+	server.CustomHandler("/images/.*/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(docker.Image{ID: "sha256:0123", RepoDigests: []string{
+			"mirror.example.com/gofn/test@sha256:aaaa",
+			"gofn/test@sha256:bbbb",
+		}})
+	}))
+	report, err = FnImageBuildReport(client, testBuildOptions())
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if report.ID != "sha256:0123" || report.Digest != "gofn/test@sha256:bbbb" {
+		t.Errorf("unexpected identity %s %s", report.ID, report.Digest)
+	}
+}
+
+func TestFnImageBuildTags(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+
+	opts := testBuildOptions()
+	opts.Tags = []string{"gofn/test:3f2a1c9", "mirror.internal/gofn/test:v1"}
+	report, err := FnImageBuildReport(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if want := []string{"gofn/test", "gofn/test:3f2a1c9", "mirror.internal/gofn/test:v1"}; !reflect.DeepEqual(report.Names, want) {
+		t.Errorf("expected the names %v but found %v", want, report.Names)
+	}
+	for _, name := range report.Names {
+		image, err := client.InspectImage(name)
+		if err != nil || image.ID != report.ID {
+			t.Errorf("expected %s to name the image %s but found %v %v", name, report.ID, image, err)
+		}
+	}
+
+	// the pulled image is tagged as well
+	opts = &BuildOptions{ImageName: "python:3.12", ForcePull: true, Tags: []string{"gofn/python:stable"}}
+	report, err = FnImageBuildReport(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	pulled, err := client.InspectImage("gofn/python:stable")
+	if err != nil || pulled.ID != report.ID {
+		t.Errorf("expected the pulled image %s to be tagged but found %v %v", report.ID, pulled, err)
+	}
+
+	// a tag the daemon refuses fails the build
+	server.CustomHandler("/images/.*/tag", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid reference format", http.StatusBadRequest)
+	}))
+	if _, _, err = FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Errorf("expected no tag without Tags but found %v", err)
+	}
+	opts = testBuildOptions()
+	opts.Tags = []string{"gofn/test:Invalid Tag"}
+	if _, _, err = FnImageBuild(client, opts); err == nil {
+		t.Error("expected the tag failure")
+	}
+}
+
+func TestRunnerPinToImageID(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "ok", "")
+	client := NewTestClient(server.URL(), t)
+	other := createFakeImage(client)
+	report, err := FnImageBuildReport(client, testBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gofn/test is retagged to another image as soon as it was inspected
+	var retag sync.Once
+	server.CustomHandler("/images/.*/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.DefaultHandler().ServeHTTP(w, r)
+		if strings.Contains(r.URL.Path, "/gofn/test/") {
+			retag.Do(func() {
+				tag := httptest.NewRequest(http.MethodPost, "/images/"+other+"/tag?repo=gofn/test", nil)
+				server.DefaultHandler().ServeHTTP(httptest.NewRecorder(), tag)
+			})
+		}
+	}))
+	var mu sync.Mutex
+	var images []string
+	server.CustomHandler("/containers/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var config docker.Config
+		body, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &config)
+		mu.Lock()
+		images = append(images, config.Image)
+		mu.Unlock()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	if _, err = r.Run(context.Background(), testBuildOptions(), ContainerOptions{PinToImageID: true}); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, err = r.Run(context.Background(), testBuildOptions(), ContainerOptions{}); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(images) != 2 || images[0] != report.ID || images[1] != "gofn/test" {
+		t.Errorf("expected the pinned run to use %s and the other one the name but found %v", report.ID, images)
+	}
+	retagged, err := client.InspectImage("gofn/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retagged.ID == report.ID {
+		t.Error("expected gofn/test to be retagged")
+	}
+}
+
+// fakeEcho makes every container of the fake docker api wait for its whole stdin and write it
+// back as its output
+func fakeEcho(server *fake.DockerServer) {
+	var mu sync.Mutex
+	inputs := make(map[string]string)
+	received := make(map[string]chan struct{})
+	receivedChan := func(id string) chan struct{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if received[id] == nil {
+			received[id] = make(chan struct{})
+		}
+		return received[id]
+	}
+	server.CustomHandler("/containers/.*/attach", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := containerPathRegexp.FindStringSubmatch(r.URL.Path)
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil || m == nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n"))
+		input, _ := ioutil.ReadAll(rw)
+		mu.Lock()
+		inputs[m[1]] = string(input)
+		mu.Unlock()
+		close(receivedChan(m[1]))
+	}))
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			select {
+			case <-receivedChan(m[1]):
+			case <-r.Context().Done():
+				return
+			}
+			_ = server.MutateContainer(m[1], docker.State{StartedAt: time.Now()})
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	server.CustomHandler("/containers/.*/logs", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			mu.Lock()
+			input := inputs[m[1]]
+			mu.Unlock()
+			writeFrame(w, 1, input)
+		}
+	}))
+}
+
+func TestFnRunConcurrentInputs(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeEcho(server)
+	client := NewTestClient(server.URL(), t)
+	// the client checks the API version of the daemon on its first start, which is not safe
+	// for concurrent starts
+	runFakeContainer(client, createFakeContainer(client, t).ID, t)
+
+	image := createFakeImage(client)
+	inputs := []string{"first payload", "second payload"}
+	outputs := make([]string, len(inputs))
+	errs := make([]error, len(inputs))
+	var wg sync.WaitGroup
+	for n, input := range inputs {
+		container, err := client.CreateContainer(docker.CreateContainerOptions{
+			Name:   fmt.Sprintf("gofn-input-%d", n),
+			Config: &docker.Config{Image: image, StdinOnce: true, OpenStdin: true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(n int, id, input string) {
+			defer wg.Done()
+			stdout, _, err := FnRun(client, id, input)
+			errs[n] = err
+			if stdout != nil {
+				outputs[n] = stdout.String()
+			}
+		}(n, container.ID, input)
+	}
+	wg.Wait()
+	for n, input := range inputs {
+		if errs[n] != nil {
+			t.Fatalf("Expected no errors but %q found", errs[n])
+		}
+		if outputs[n] != input {
+			t.Errorf("expected run %d to receive %q but found %q", n, input, outputs[n])
+		}
+	}
+}
+
+func TestFnRunReaderBinaryInput(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeEcho(server)
+	client := NewTestClient(server.URL(), t)
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: createFakeImage(client), StdinOnce: true, OpenStdin: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an invalid UTF-8 payload of a few megabytes
+	payload := bytes.Repeat([]byte{0xff, 0x00, 0xfe, 'x'}, 1<<19)
+	stdout, _, err := FnRunReader(client, container.ID, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !bytes.Equal(stdout.Bytes(), payload) {
+		t.Errorf("expected the container to receive the %d bytes of the payload but found %d", len(payload), stdout.Len())
+	}
+}
+
+// eofReader tells whether its reader was read until its end
+type eofReader struct {
+	io.Reader
+	eof int32
+}
+
+func (r *eofReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if err == io.EOF {
+		atomic.StoreInt32(&r.eof, 1)
+	}
+	return
+}
+
+func TestFnRunReaderDrainsInput(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeEcho(server)
+	client := NewTestClient(server.URL(), t)
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: createFakeImage(client), Cmd: []string{"cat"}, StdinOnce: true, OpenStdin: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<18)
+	input := &eofReader{Reader: bytes.NewReader(payload)}
+	stdout, _, err := FnRunReader(client, container.ID, input)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !bytes.Equal(stdout.Bytes(), payload) {
+		t.Errorf("expected the %d bytes of the payload to round-trip but found %d", len(payload), stdout.Len())
+	}
+	// the input and its stream are done with once the run returned
+	if atomic.LoadInt32(&input.eof) != 1 {
+		t.Error("expected the input to be read until its end")
+	}
+	if open := ClientStreamMetrics(client).Open; open != 0 {
+		t.Errorf("expected the attached stream to be closed but found %d open", open)
+	}
+}
+
+func TestFnAttachSeparatesStreams(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeFrames(server, []frame{{StreamStdout, "out\n"}, {StreamStderr, "err\n"}, {StreamStdout, "more out\n"}})
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	var stdout, stderr bytes.Buffer
+	w, err := FnAttach(client, container.ID, nil, &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out\nmore out\n" || stderr.String() != "err\n" {
+		t.Errorf("expected the streams to be demultiplexed but found stdout %q and stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestFnRunSeparatesStreams(t *testing.T) {
+	for _, autoRemove := range []bool{false, true} {
+		server := createFakeDockerAPI(t)
+		defer server.Stop()
+		fakeFrames(server, []frame{{StreamStdout, "out\n"}, {StreamStderr, "err\n"}})
+		fakeFastExit(t, server, 0, autoRemove)
+		client := NewTestClient(server.URL(), t)
+		container, err := client.CreateContainer(docker.CreateContainerOptions{
+			Config:     &docker.Config{Image: createFakeImage(client), OpenStdin: true, StdinOnce: true},
+			HostConfig: &docker.HostConfig{AutoRemove: autoRemove},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout, stderr, err := FnRun(client, container.ID, "")
+		if err != nil {
+			t.Fatalf("autoRemove %v: expected no errors but %q found", autoRemove, err)
+		}
+		if stdout.String() != "out\n" || stderr.String() != "err\n" {
+			t.Errorf("autoRemove %v: expected distinct streams but found stdout %q and stderr %q", autoRemove, stdout, stderr)
+		}
+	}
+}
+
+func TestFnImageBuildForcePull(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakePull(server, readPullFixture(t, "fresh.jsonl"))
+	var pulls []string
+	server.CustomHandler("/build", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pulls = append(pulls, r.URL.Query().Get("pull"))
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	// without context the image itself is pulled
+	name, stdout, err := FnImageBuild(client, &BuildOptions{ImageName: "alpine:3.8", DoNotUsePrefixImageName: true, ForcePull: true})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if name != "alpine:3.8" || len(pulls) != 0 {
+		t.Errorf("expected alpine:3.8 to be pulled without build but found %q and %d builds", name, len(pulls))
+	}
+	if stdout == nil || !strings.Contains(stdout.String(), "Pull complete") {
+		t.Errorf("expected the pull progress in stdout but found %q", stdout)
+	}
+
+	// with a context the base images are pulled by the build
+	name, stdout, err = FnImageBuild(client, &BuildOptions{ContextDir: "./testing_data", ImageName: "python", ForcePull: true})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if name != "gofn/python" || len(pulls) != 1 || pulls[0] != "1" {
+		t.Errorf("expected gofn/python to be built pulling its base images but found %q and %v", name, pulls)
+	}
+	if stdout == nil {
+		t.Error("expected the build output")
+	}
+}
+
+func TestPullPolicy(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "ok", "")
+	var builds, pulls int
+	server.CustomHandler("/build", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		builds++
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	server.CustomHandler("/images/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pulls++
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+	r := NewRunner(client)
+	r.SkipSizeCheck = true
+
+	// the missing image is neither built nor pulled
+	never := &BuildOptions{ContextDir: "./testing_data", ImageName: "python", PullPolicy: PullNever, FallbackToPull: true}
+	if _, _, err := FnImageBuild(client, never); err != ErrImageNotFound {
+		t.Errorf("expected %q but found %v", ErrImageNotFound, err)
+	}
+	if _, err := r.Run(context.Background(), never, ContainerOptions{}); err != ErrImageNotFound {
+		t.Errorf("expected %q from the runner but found %v", ErrImageNotFound, err)
+	}
+	if builds != 0 || pulls != 0 {
+		t.Errorf("expected no network access but found %d builds and %d pulls", builds, pulls)
+	}
+
+	// the missing image is built once
+	ifNotPresent := &BuildOptions{ContextDir: "./testing_data", ImageName: "python", PullPolicy: PullIfNotPresent}
+	for i := 0; i < 2; i++ {
+		name, stdout, err := FnImageBuild(client, ifNotPresent)
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		if name != "gofn/python" || stdout == nil {
+			t.Errorf("unexpected image %q", name)
+		}
+	}
+	if builds != 1 {
+		t.Errorf("expected the image to be built once but found %d builds", builds)
+	}
+	if _, err := r.Run(context.Background(), never, ContainerOptions{}); err != nil {
+		t.Errorf("Expected no errors with the local image but %q found", err)
+	}
+
+	// the local image is built again
+	always := &BuildOptions{ContextDir: "./testing_data", ImageName: "python", PullPolicy: PullAlways}
+	if _, err := r.Run(context.Background(), always, ContainerOptions{}); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if builds != 2 || pulls != 0 {
+		t.Errorf("expected the image to be built again but found %d builds and %d pulls", builds, pulls)
+	}
+
+	if errs := ValidateBuildOptions(BuildOptions{ImageName: "python", PullPolicy: "sometimes"}); len(errs) != 1 || errs[0].Field != "PullPolicy" {
+		t.Errorf("expected the unknown policy to be refused but found %v", errs)
+	}
+}
+
+func TestFnStop(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	stops := fakeStoppableWait(server)
+	fakeLogs(server, "flushed", "")
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	container, err := FnContainer(client, ContainerOptions{Image: image, StopSignal: "SIGINT", StopTimeout: 1500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.Config.StopSignal != "SIGINT" || container.Config.StopTimeout != 2 {
+		t.Errorf("expected the stop settings on the container but found %q and %d", container.Config.StopSignal, container.Config.StopTimeout)
+	}
+	// the timed out container is given its own stop timeout
+	stdout, _, err := FnRunWithOptions(context.Background(), client, container.ID, "", RunOptions{Timeout: 50 * time.Millisecond})
+	if err != ErrExecutionTimeout || stdout.String() != "flushed" {
+		t.Errorf("expected %q with the output but found %v and %q", ErrExecutionTimeout, err, stdout)
+	}
+	if got := stops(); len(got) != 1 || got[0] != "t=2" {
+		t.Errorf("expected the container to be stopped within 2 seconds but found %v", got)
+	}
+
+	// a container that is not running is stopped already
+	server = createFakeDockerAPI(t)
+	defer server.Stop()
+	server.CustomHandler("/containers/.*/stop", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	client = NewTestClient(server.URL(), t)
+	created := createFakeContainer(client, t)
+	if err = FnStop(client, created.ID, time.Second); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+}
+
+func TestRunnerStopsTimedOutContainer(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	stops := fakeStoppableWait(server)
+	fakeLogs(server, "flushed", "")
+	r := NewRunner(NewTestClient(server.URL(), t))
+	r.OutputStrategy = OutputLogs
+
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{ExecutionTimeout: 50 * time.Millisecond, StopTimeout: 3 * time.Second})
+	if !isPhaseTimeout(err, PhaseExecution) {
+		t.Errorf("expected the execution to time out but found %v", err)
+	}
+	if got := stops(); len(got) != 1 || got[0] != "t=3" {
+		t.Errorf("expected the container to be stopped within its stop timeout but found %v", got)
+	}
+	if result.Stdout.String() != "flushed" {
+		t.Errorf("expected the output written until the stop but found %q", result.Stdout)
+	}
+}
@@ -17,8 +17,11 @@ func FnClient(endPoint, certsDir string) (client *docker.Client, err error) {
 	}
 	if certsDir != "" {
 		client, err = docker.NewTLSClient(endPoint, filepath.Join(certsDir, "cert.pem"), filepath.Join(certsDir, "key.pem"), filepath.Join(certsDir, "ca.pem"))
-		return
+	} else {
+		client, err = docker.NewClient(endPoint)
+	}
+	if w := apiDumpWriter(); err == nil && w != nil {
+		DumpAPI(client, w)
 	}
-	client, err = docker.NewClient(endPoint)
 	return
 }
@@ -0,0 +1,210 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// dockerHubServer is the server address of Docker Hub in the Docker config file
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// dockerConfigFile is the part of ~/.docker/config.json holding the registry credentials
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		Email         string `json:"email"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// DockerConfigAuth is an AuthProvider reading the credentials of the registries from a Docker
+// config file like docker login does, including those kept by credential helpers, e.g.
+// docker-credential-ecr-login
+type DockerConfigAuth struct {
+	// Path is the config file, $DOCKER_CONFIG/config.json or ~/.docker/config.json when empty
+	Path string
+}
+
+// AuthFromDockerConfig returns the credentials of registry, e.g. ghcr.io or docker.io, from the
+// Docker config file. The zero value is returned for a registry without credentials.
+func AuthFromDockerConfig(registry string) (docker.AuthConfiguration, error) {
+	return DockerConfigAuth{}.registryAuth(context.Background(), registry)
+}
+
+// Auth implements AuthProvider
+func (a DockerConfigAuth) Auth(ctx context.Context, ref string) (docker.AuthConfiguration, error) {
+	host, _, _ := registryRef(ref)
+	return a.registryAuth(ctx, host)
+}
+
+func (a DockerConfigAuth) registryAuth(ctx context.Context, registry string) (auth docker.AuthConfiguration, err error) {
+	path := a.Path
+	if path == "" {
+		path = dockerConfigPath()
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return auth, nil
+	}
+	if err != nil {
+		return
+	}
+	var config dockerConfigFile
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		err = fmt.Errorf("provision: invalid docker config %s: %v", path, err)
+		return
+	}
+	host := configHost(registry)
+	server := registryServer(host)
+	helper := config.CredsStore
+	for key, name := range config.CredHelpers {
+		if configHost(key) == host {
+			helper = name
+		}
+	}
+	if helper != "" {
+		var found bool
+		auth, found, err = helperAuth(ctx, helper, server)
+		if err != nil || found {
+			return
+		}
+	}
+	for key, entry := range config.Auths {
+		if configHost(key) != host {
+			continue
+		}
+		auth = docker.AuthConfiguration{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			Email:         entry.Email,
+			IdentityToken: entry.IdentityToken,
+			ServerAddress: server,
+		}
+		if entry.Auth != "" {
+			var decoded []byte
+			decoded, err = base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				err = fmt.Errorf("provision: invalid auth of %s in the docker config: %v", key, err)
+				return
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				err = fmt.Errorf("provision: invalid auth of %s in the docker config", key)
+				return
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		return
+	}
+	return
+}
+
+// helperAuth returns the credentials of server kept by the credential helper
+// docker-credential-<helper>, found is false when it has none
+func helperAuth(ctx context.Context, helper, server string) (auth docker.AuthConfiguration, found bool, err error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err = cmd.Run(); err != nil {
+		// the helpers write this message to stdout, see the docker-credential-helpers protocol
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return auth, false, nil
+		}
+		err = fmt.Errorf("provision: credential helper %s: %v: %s", helper, err, strings.TrimSpace(stdout.String()+stderr.String()))
+		return
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &creds)
+	if err != nil {
+		err = fmt.Errorf("provision: credential helper %s: %v", helper, err)
+		return
+	}
+	auth.ServerAddress = server
+	// an identity token is returned with the <token> user name
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+	return auth, true, nil
+}
+
+// dockerConfigPath returns the path of the Docker config file of the user
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = os.Getenv("USERPROFILE")
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// configHost returns the registry host of a key of the Docker config file, which may be a URL,
+// the aliases of Docker Hub are all index.docker.io
+func configHost(key string) string {
+	host := key
+	if i := strings.Index(host, "://"); i > -1 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexRune(host, '/'); i > -1 {
+		host = host[:i]
+	}
+	switch host {
+	case "", dockerHub, defaultRegistry:
+		host = "index.docker.io"
+	}
+	return host
+}
+
+// registryServer returns the server address of the credentials of a registry given by host or
+// URL, Docker Hub ones are keyed by its legacy URL
+func registryServer(registry string) string {
+	host := configHost(registry)
+	if host == configHost(dockerHubServer) {
+		return dockerHubServer
+	}
+	return host
+}
+
+// registryAuth returns the credentials pulling the image of opts: the entry of its registry in
+// opts.AuthConfigs, opts.Auth otherwise, read from the Docker config file when
+// opts.AuthFromDockerConfig is set and opts.Auth is empty
+func registryAuth(ctx context.Context, opts *BuildOptions) (auth docker.AuthConfiguration, err error) {
+	if len(opts.AuthConfigs) > 0 {
+		host, _, _ := registryRef(opts.GetImageName())
+		for key, entry := range opts.AuthConfigs {
+			if configHost(key) == configHost(host) {
+				if entry.ServerAddress == "" {
+					entry.ServerAddress = registryServer(host)
+				}
+				return entry, nil
+			}
+		}
+	}
+	auth = opts.Auth
+	if !opts.AuthFromDockerConfig || auth != (docker.AuthConfiguration{}) {
+		return
+	}
+	return DockerConfigAuth{}.Auth(ctx, opts.GetImageName())
+}
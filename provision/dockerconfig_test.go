@@ -0,0 +1,196 @@
+package provision
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestMain(m *testing.M) {
+	if creds := os.Getenv("GOFN_FAKE_CREDENTIAL_HELPER"); creds != "" {
+		os.Exit(fakeCredentialHelper(creds))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeCredentialHelper answers a get of the credential helper protocol from the JSON file creds,
+// the credentials keyed by server
+func fakeCredentialHelper(creds string) int {
+	if len(os.Args) != 2 || os.Args[1] != "get" {
+		fmt.Println("unknown action")
+		return 1
+	}
+	server, _ := ioutil.ReadAll(os.Stdin)
+	data, _ := ioutil.ReadFile(creds)
+	var all map[string]map[string]string
+	_ = json.Unmarshal(data, &all)
+	entry, ok := all[string(server)]
+	if !ok {
+		fmt.Println("credentials not found in native keychain")
+		return 1
+	}
+	if entry["fail"] != "" {
+		fmt.Fprintln(os.Stderr, entry["fail"])
+		return 1
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]string{"ServerURL": string(server), "Username": entry["username"], "Secret": entry["secret"]})
+	return 0
+}
+
+// fakeDockerConfig writes config to a config.json of a temporary DOCKER_CONFIG and installs the
+// test binary as the credential helpers names answering with creds
+func fakeDockerConfig(t *testing.T, config string, creds map[string]map[string]string, names ...string) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "gofn-docker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(creds)
+	credsFile := filepath.Join(dir, "creds.json")
+	if err = ioutil.WriteFile(credsFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	binary, err := ioutil.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		helper := filepath.Join(dir, "docker-credential-"+name)
+		if runtime.GOOS == "windows" {
+			helper += ".exe"
+		}
+		if err = ioutil.WriteFile(helper, binary, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, dockerConfig := os.Getenv("PATH"), os.Getenv("DOCKER_CONFIG")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	os.Setenv("DOCKER_CONFIG", dir)
+	os.Setenv("GOFN_FAKE_CREDENTIAL_HELPER", credsFile)
+	return func() {
+		os.Setenv("PATH", path)
+		os.Setenv("DOCKER_CONFIG", dockerConfig)
+		os.Unsetenv("GOFN_FAKE_CREDENTIAL_HELPER")
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAuthFromDockerConfig(t *testing.T) {
+	basic := base64.StdEncoding.EncodeToString([]byte("gofn:s3cr3t:with:colons"))
+	config := `{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "` + basic + `"},
+			"https://registry.example.com/v2/": {"identitytoken": "id-token"},
+			"ghcr.io": {"auth": "` + basic + `"}
+		},
+		"credHelpers": {
+			"123456789012.dkr.ecr.us-east-1.amazonaws.com": "ecr-login",
+			"broken.example.com": "ecr-login"
+		}
+	}`
+	defer fakeDockerConfig(t, config, map[string]map[string]string{
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com": {"username": "AWS", "secret": "ecr-token"},
+		"broken.example.com":                           {"fail": "no AWS credentials"},
+	}, "ecr-login")()
+
+	for _, test := range []struct {
+		registry string
+		want     docker.AuthConfiguration
+	}{
+		{"docker.io", docker.AuthConfiguration{Username: "gofn", Password: "s3cr3t:with:colons", ServerAddress: "https://index.docker.io/v1/"}},
+		{"", docker.AuthConfiguration{Username: "gofn", Password: "s3cr3t:with:colons", ServerAddress: "https://index.docker.io/v1/"}},
+		{"ghcr.io", docker.AuthConfiguration{Username: "gofn", Password: "s3cr3t:with:colons", ServerAddress: "ghcr.io"}},
+		{"registry.example.com", docker.AuthConfiguration{IdentityToken: "id-token", ServerAddress: "registry.example.com"}},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com", docker.AuthConfiguration{Username: "AWS", Password: "ecr-token", ServerAddress: "123456789012.dkr.ecr.us-east-1.amazonaws.com"}},
+		{"quay.io", docker.AuthConfiguration{}},
+	} {
+		auth, err := AuthFromDockerConfig(test.registry)
+		if err != nil {
+			t.Errorf("%s: expected no errors but %q found", test.registry, err)
+		}
+		if auth != test.want {
+			t.Errorf("%s: expected %+v but found %+v", test.registry, test.want, auth)
+		}
+	}
+
+	// the failures of the helper are returned
+	_, err := AuthFromDockerConfig("broken.example.com")
+	if err == nil || !strings.Contains(err.Error(), "no AWS credentials") {
+		t.Errorf("expected the failure of the helper but found %v", err)
+	}
+
+	// the images of a registry resolve to its credentials
+	auth, err := DockerConfigAuth{}.Auth(context.Background(), "ghcr.io/gofn/app:v1")
+	if err != nil || auth.Username != "gofn" {
+		t.Errorf("expected the credentials of ghcr.io but found %+v %v", auth, err)
+	}
+	auth, err = DockerConfigAuth{Path: filepath.Join(os.TempDir(), "gofn-missing", "config.json")}.Auth(context.Background(), "python")
+	if err != nil || auth != (docker.AuthConfiguration{}) {
+		t.Errorf("expected no credentials without a config but found %+v %v", auth, err)
+	}
+}
+
+func TestAuthFromDockerConfigStore(t *testing.T) {
+	// the store keeps the Docker Hub identity token, the other registries fall back to auths
+	config := `{
+		"auths": {"ghcr.io": {"username": "gofn", "password": "pat"}},
+		"credsStore": "desktop"
+	}`
+	defer fakeDockerConfig(t, config, map[string]map[string]string{
+		"https://index.docker.io/v1/": {"username": "<token>", "secret": "hub-token"},
+	}, "desktop")()
+
+	auth, err := AuthFromDockerConfig("docker.io")
+	if err != nil || auth != (docker.AuthConfiguration{IdentityToken: "hub-token", ServerAddress: "https://index.docker.io/v1/"}) {
+		t.Errorf("expected the identity token of the store but found %+v %v", auth, err)
+	}
+	auth, err = AuthFromDockerConfig("ghcr.io")
+	if err != nil || auth.Username != "gofn" || auth.Password != "pat" {
+		t.Errorf("expected the credentials of ghcr.io but found %+v %v", auth, err)
+	}
+}
+
+func TestFnPullAuthFromDockerConfig(t *testing.T) {
+	defer fakeDockerConfig(t, `{"credHelpers": {"123456789012.dkr.ecr.us-east-1.amazonaws.com": "ecr-login"}}`, map[string]map[string]string{
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com": {"username": "AWS", "secret": "ecr-token"},
+	}, "ecr-login")()
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	var sent []docker.AuthConfiguration
+	server.CustomHandler("/images/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var auth docker.AuthConfiguration
+		data, _ := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+		_ = json.Unmarshal(data, &auth)
+		sent = append(sent, auth)
+		_, _ = io.WriteString(w, `{"status":"Status: Downloaded newer image"}`)
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	image := "123456789012.dkr.ecr.us-east-1.amazonaws.com/gofn/app:v1"
+	opts := &BuildOptions{ImageName: image, DoNotUsePrefixImageName: true, AuthFromDockerConfig: true}
+	if err := FnPull(client, opts); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	// the explicit credentials win over the config
+	explicit := docker.AuthConfiguration{Username: "ci", Password: "token"}
+	opts = &BuildOptions{ImageName: image, DoNotUsePrefixImageName: true, AuthFromDockerConfig: true, Auth: explicit}
+	if err := FnPull(client, opts); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(sent) != 2 || sent[0].Username != "AWS" || sent[0].Password != "ecr-token" || sent[1].Username != "ci" {
+		t.Errorf("unexpected credentials %+v", sent)
+	}
+}
@@ -0,0 +1,478 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// DefaultDrainThreshold is the running time beyond which DrainHost moves a run rather than
+	// waiting for it
+	DefaultDrainThreshold = time.Minute
+	// DefaultDrainStopTimeout is the time a run of the drained host is given to stop before it is
+	// killed and run again on the destination
+	DefaultDrainStopTimeout = 10 * time.Second
+)
+
+var (
+	// ErrHostDraining is raised when a run is started on a host being drained, see DrainHost
+	ErrHostDraining = errors.New("provision: host is being drained")
+
+	// ErrRunNotReplayable is raised when a run to move has no snapshot to run again from,
+	// see Runner.CaptureResolvedConfig
+	ErrRunNotReplayable = errors.New("provision: run has no resolved config to run again")
+
+	// drainPollInterval is how often DrainHost checks the runs of the drained host
+	drainPollInterval = 100 * time.Millisecond
+)
+
+// HostRef designates a host of DrainHost, Name identifies it in the report
+type HostRef struct {
+	Name   string
+	Client *docker.Client
+}
+
+// DrainOutcome is what DrainHost did with a run of the drained host
+type DrainOutcome string
+
+const (
+	// DrainFinished is a run that ended on the drained host before reaching the threshold
+	DrainFinished DrainOutcome = "finished"
+	// DrainMigrated is a run whose container was checkpointed and restored on the destination
+	DrainMigrated DrainOutcome = "migrated"
+	// DrainRerun is a run stopped on the drained host and run again on the destination from
+	// its snapshot
+	DrainRerun DrainOutcome = "rerun"
+	// DrainAbandoned is a run that could not be moved, DrainedRun.Error tells why
+	DrainAbandoned DrainOutcome = "abandoned"
+)
+
+// Checkpointer moves a running container between hosts through a checkpoint of its
+// processes, see CRIUCheckpointer
+type Checkpointer interface {
+	// Migrate checkpoints the container of src, restores it on dst and returns its ID there
+	Migrate(ctx context.Context, src, dst HostRef, containerID string) (restoredID string, err error)
+}
+
+// DrainPolicy tells DrainHost how to move the runs of the drained host
+type DrainPolicy struct {
+	// Threshold is the running time beyond which a run is moved rather than waited for,
+	// DefaultDrainThreshold when zero
+	Threshold time.Duration
+	// Checkpointer migrates the runs when both hosts support the checkpoints, see
+	// Capabilities.Checkpoint, the runs are run again from their snapshot otherwise
+	Checkpointer Checkpointer
+	// StopTimeout is the time a run is given to stop on the drained host before it is killed
+	// and run again, DefaultDrainStopTimeout when zero
+	StopTimeout time.Duration
+	// Auth gives the credentials of the images pulled on the destination, they are pulled
+	// anonymously when nil
+	Auth AuthProvider
+	// Resume is the report of an interrupted drain of the same host, its runs are not
+	// handled again and are kept in the new report
+	Resume *DrainReport
+}
+
+// DrainedRun is a run of the drained host handled by DrainHost
+type DrainedRun struct {
+	ContainerID  string       `json:"container_id"`
+	InvocationID string       `json:"invocation_id,omitempty"`
+	Image        string       `json:"image,omitempty"`
+	Outcome      DrainOutcome `json:"outcome"`
+	// Destination is the container of a migrated or re-run run on the destination
+	Destination string `json:"destination,omitempty"`
+	// Error tells why the run was abandoned
+	Error string `json:"error,omitempty"`
+}
+
+// DrainReport is the outcome of DrainHost, it can be encoded as JSON to resume an
+// interrupted drain from another call, see DrainPolicy.Resume
+type DrainReport struct {
+	Source      string       `json:"source"`
+	Destination string       `json:"destination"`
+	Runs        []DrainedRun `json:"runs"`
+	// Complete is set once every run of the drained host was handled, the abandoned ones included
+	Complete bool `json:"complete"`
+}
+
+// Outcome returns the runs of the report with outcome, in the order they were handled
+func (report DrainReport) Outcome(outcome DrainOutcome) (runs []DrainedRun) {
+	for _, run := range report.Runs {
+		if run.Outcome == outcome {
+			runs = append(runs, run)
+		}
+	}
+	return
+}
+
+// drainableRun is a run of the runner DrainHost can move
+type drainableRun struct {
+	client       *docker.Client
+	invocationID string
+	image        string
+	startedAt    time.Time
+	// snapshot is the ResolvedConfig of the run with its redacted values, nil without one
+	snapshot *ResolvedConfig
+}
+
+// drainSnapshot returns the snapshot of a run with the values redacted from resolved given back
+func drainSnapshot(resolved *ResolvedConfig, containerOpts ContainerOptions) *ResolvedConfig {
+	snapshot := *resolved
+	snapshot.Container = containerOpts
+	snapshot.Container.labels = nil
+	return &snapshot
+}
+
+// trackDrainable records the run of containerID as movable by DrainHost until the returned
+// function is called
+func (r *Runner) trackDrainable(containerID string, run drainableRun) (done func()) {
+	s := r.state()
+	s.mu.Lock()
+	if s.drainable == nil {
+		s.drainable = make(map[string]drainableRun)
+	}
+	s.drainable[containerID] = run
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.drainable, containerID)
+		s.mu.Unlock()
+	}
+}
+
+// draining reports whether the host of r.Client is being drained
+func (r *Runner) draining() bool {
+	s := r.state()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining[r.Client]
+}
+
+// UndrainHost accepts the runs on a host drained by DrainHost again
+func (r *Runner) UndrainHost(host HostRef) {
+	s := r.state()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.draining, host.Client)
+}
+
+// drainableRuns returns the runs of client, by container
+func (r *Runner) drainableRuns(client *docker.Client) map[string]drainableRun {
+	s := r.state()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs := make(map[string]drainableRun)
+	for id, run := range s.drainable {
+		if run.client == client {
+			runs[id] = run
+		}
+	}
+	return runs
+}
+
+// DrainHost empties src, e.g. before its machine is retired: the runs of r and of its copies
+// are refused on src with ErrHostDraining, the runs of src are waited for until they run for
+// policy.Threshold and are then moved to dst. A run is migrated when policy.Checkpointer is set
+// and both hosts support the checkpoints, it is stopped and run again on dst from its snapshot
+// otherwise, which needs Runner.CaptureResolvedConfig, and abandoned without one. The run
+// stopped on src ends with the exit code of the stopped container, its run on dst goes on in
+// the background and is recorded in History. The runs of other processes are not seen.
+//
+// An interrupted drain returns the runs handled so far with the error of ctx, it is resumed by
+// a call with the report as policy.Resume. src refuses the runs until UndrainHost.
+func (r *Runner) DrainHost(ctx context.Context, src, dst HostRef, policy DrainPolicy) (report DrainReport, err error) {
+	if policy.Threshold == 0 {
+		policy.Threshold = DefaultDrainThreshold
+	}
+	if policy.StopTimeout == 0 {
+		policy.StopTimeout = DefaultDrainStopTimeout
+	}
+	report = DrainReport{Source: src.Name, Destination: dst.Name}
+	handled := make(map[string]bool)
+	if policy.Resume != nil {
+		for _, run := range policy.Resume.Runs {
+			report.Runs = append(report.Runs, run)
+			handled[run.ContainerID] = true
+		}
+	}
+	s := r.state()
+	s.mu.Lock()
+	if s.draining == nil {
+		s.draining = make(map[*docker.Client]bool)
+	}
+	s.draining[src.Client] = true
+	s.mu.Unlock()
+
+	seen := make(map[string]drainableRun)
+	for {
+		runs := r.drainableRuns(src.Client)
+		// the runs gone since the previous check finished on src
+		for _, id := range sortedRuns(seen) {
+			if _, running := runs[id]; !running && !handled[id] {
+				handled[id] = true
+				report.Runs = append(report.Runs, drainedRun(id, seen[id], DrainFinished))
+			}
+		}
+		waiting := false
+		for _, id := range sortedRuns(runs) {
+			run := runs[id]
+			seen[id] = run
+			if handled[id] {
+				continue
+			}
+			if time.Since(run.startedAt) < policy.Threshold {
+				waiting = true
+				continue
+			}
+			handled[id] = true
+			report.Runs = append(report.Runs, r.drainRun(ctx, src, dst, policy, id, run))
+		}
+		if !waiting {
+			report.Complete = true
+			return
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
+
+// sortedRuns returns the containers of runs, the oldest run first
+func sortedRuns(runs map[string]drainableRun) []string {
+	ids := make([]string, 0, len(runs))
+	for id := range runs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return runs[ids[i]].startedAt.Before(runs[ids[j]].startedAt)
+	})
+	return ids
+}
+
+func drainedRun(containerID string, run drainableRun, outcome DrainOutcome) DrainedRun {
+	return DrainedRun{ContainerID: containerID, InvocationID: run.invocationID, Image: run.image, Outcome: outcome}
+}
+
+// drainDecision picks how a run of src is moved to dst, the hosts being described by
+// srcCaps and dstCaps
+func drainDecision(replayable, checkpointer bool, srcCaps, dstCaps Capabilities) DrainOutcome {
+	switch {
+	case checkpointer && srcCaps.Checkpoint && dstCaps.Checkpoint && srcCaps.Platform() == dstCaps.Platform():
+		return DrainMigrated
+	case replayable:
+		return DrainRerun
+	}
+	return DrainAbandoned
+}
+
+// drainRun moves the run of containerID from src to dst
+func (r *Runner) drainRun(ctx context.Context, src, dst HostRef, policy DrainPolicy, containerID string, run drainableRun) (drained DrainedRun) {
+	var srcCaps, dstCaps Capabilities
+	if policy.Checkpointer != nil {
+		// a host that can not be inspected is not trusted with a checkpoint
+		caps, srcErr := hostCapabilities(ctx, src.Client)
+		if srcErr == nil {
+			srcCaps = caps
+		}
+		caps, dstErr := hostCapabilities(ctx, dst.Client)
+		if dstErr == nil {
+			dstCaps = caps
+		}
+	}
+	outcome := drainDecision(run.snapshot != nil, policy.Checkpointer != nil, srcCaps, dstCaps)
+	drained = drainedRun(containerID, run, outcome)
+	var err error
+	switch outcome {
+	case DrainMigrated:
+		drained.Destination, err = policy.Checkpointer.Migrate(ctx, src, dst, containerID)
+		if err != nil && run.snapshot != nil {
+			drained.Outcome = DrainRerun
+			drained.Destination, err = r.rerun(ctx, src, dst, policy, containerID, run.snapshot)
+		}
+	case DrainRerun:
+		drained.Destination, err = r.rerun(ctx, src, dst, policy, containerID, run.snapshot)
+	case DrainAbandoned:
+		err = ErrRunNotReplayable
+	}
+	if err == errRunEnded {
+		drained.Outcome, drained.Destination, err = DrainFinished, "", nil
+	}
+	if err != nil {
+		drained.Outcome, drained.Destination, drained.Error = DrainAbandoned, "", err.Error()
+	}
+	return
+}
+
+// errRunEnded is raised by rerun when the run ended on src before it was stopped
+var errRunEnded = errors.New("provision: run ended")
+
+// rerun stops the container of src and runs snapshot again on dst, it returns once the
+// container of dst is created
+func (r *Runner) rerun(ctx context.Context, src, dst HostRef, policy DrainPolicy, containerID string, snapshot *ResolvedConfig) (restoredID string, err error) {
+	resolved := *snapshot
+	resolved.ImageID, resolved.Container.Image, err = drainImage(ctx, dst.Client, snapshot, policy.Auth)
+	if err != nil {
+		return
+	}
+	err = src.Client.StopContainerWithContext(containerID, uint(policy.StopTimeout/time.Second), ctx)
+	if _, ok := err.(*docker.ContainerNotRunning); ok || isNoSuchContainer(err) {
+		err = errRunEnded
+	}
+	if err != nil {
+		return
+	}
+	rerunner := *r
+	rerunner.Client = dst.Client
+	rerunner.replay = &resolved
+	buildOpts := &BuildOptions{ImageName: resolved.Build.ImageName, DoNotUsePrefixImageName: true, StdIN: resolved.Build.StdIN}
+	created, failed := make(chan string, 1), make(chan error, 1)
+	goSafe("drain rerun", func() error {
+		// the run outlives the drain, like the run it replaces
+		_, err := rerunner.run(context.Background(), buildOpts, resolved.Container, strings.NewReader(resolved.Build.StdIN), func(ctx context.Context, containerID string) error {
+			created <- containerID
+			return nil
+		})
+		return err
+	}, func(err error) {
+		failed <- err
+	})
+	select {
+	case restoredID = <-created:
+	case err = <-failed:
+		select {
+		case restoredID = <-created:
+			err = nil
+		default:
+		}
+	}
+	return
+}
+
+// drainImage returns the image of dst running snapshot: its ImageID when dst has it, the
+// reference of the snapshot otherwise, pulled when missing. A tag moved since the run started
+// pulls the new image, pin the runs to a digest to run them again with the same image.
+func drainImage(ctx context.Context, client *docker.Client, snapshot *ResolvedConfig, auth AuthProvider) (id, image string, err error) {
+	image = snapshot.Container.Image
+	if _, _, inspectErr := imageIdentity(client, snapshot.ImageID); inspectErr == nil {
+		return snapshot.ImageID, image, nil
+	}
+	if strings.HasPrefix(image, "sha256:") {
+		// pinned with PinToImageID, the reference is that of the build
+		image = snapshot.Build.ImageName
+	}
+	if repo, tag := parseDockerImage(image); tag != "" {
+		image = repo + ":" + tag
+	}
+	err = ensureImageOn(ctx, client, image, auth)
+	if err != nil {
+		return
+	}
+	id, _, err = imageIdentity(client, image)
+	return
+}
+
+// ensureImageOn pulls ref on the daemon of client when missing
+func ensureImageOn(ctx context.Context, client *docker.Client, ref string, auth AuthProvider) (err error) {
+	present, err := hasImage(ctx, client, ref)
+	if err != nil || present {
+		return
+	}
+	opts := &BuildOptions{ImageName: ref, DoNotUsePrefixImageName: true}
+	if auth != nil {
+		opts.Auth, err = auth.Auth(ctx, ref)
+		if err != nil {
+			return
+		}
+	}
+	_, err = pullWithProgress(ctx, client, opts, nil)
+	return
+}
+
+// CRIUCheckpointer is a Checkpointer using the experimental checkpoints of the daemons, CRIU
+// must be installed on both hosts. The checkpoints are written to Dir, which must be shared
+// by the hosts, e.g. an NFS mount. The restored container is not followed by the runner: its
+// output is only in its logs and it is not removed once it exited.
+type CRIUCheckpointer struct {
+	Dir string
+	// Auth gives the credentials of the images pulled on the destination, they are pulled
+	// anonymously when nil
+	Auth AuthProvider
+}
+
+// Migrate implements Checkpointer, the container of src exits once checkpointed
+func (c CRIUCheckpointer) Migrate(ctx context.Context, src, dst HostRef, containerID string) (restoredID string, err error) {
+	container, err := src.Client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: containerID, Context: ctx})
+	if err != nil {
+		return
+	}
+	err = ensureImageOn(ctx, dst.Client, container.Config.Image, c.Auth)
+	if err != nil {
+		return
+	}
+	checkpoint := "gofn-" + shortID(container.ID)
+	err = daemonCall(ctx, src.Client, http.MethodPost, "/containers/"+container.ID+"/checkpoints", map[string]interface{}{
+		"CheckpointID":  checkpoint,
+		"CheckpointDir": c.Dir,
+		"Exit":          true,
+	})
+	if err != nil {
+		return
+	}
+	restored, err := dst.Client.CreateContainer(docker.CreateContainerOptions{
+		Name:       strings.TrimPrefix(container.Name, "/"),
+		Config:     container.Config,
+		HostConfig: container.HostConfig,
+		Context:    ctx,
+	})
+	if err != nil {
+		return
+	}
+	query := url.Values{"checkpoint": {checkpoint}, "checkpoint-dir": {c.Dir}}
+	err = daemonCall(ctx, dst.Client, http.MethodPost, "/containers/"+restored.ID+"/start?"+query.Encode(), nil)
+	if err != nil {
+		return
+	}
+	restoredID = restored.ID
+	return
+}
+
+// daemonCall sends a request the docker client has no method for to the daemon of client,
+// body is sent as JSON when not nil
+func daemonCall(ctx context.Context, client *docker.Client, method, path string, body interface{}) (err error) {
+	var payload bytes.Buffer
+	if body != nil {
+		if err = json.NewEncoder(&payload).Encode(body); err != nil {
+			return
+		}
+	}
+	req, err := http.NewRequest(method, backendURL(client)+path, &payload)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		message, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("provision: %s %s: %d %s", method, path, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return
+}
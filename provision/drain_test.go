@@ -0,0 +1,258 @@
+package provision
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeLongRuns makes the containers of the fake docker api running "long" wait until they are
+// stopped, the others exit after a short while
+func fakeLongRuns(server *fake.DockerServer, client *docker.Client) {
+	var (
+		mu      sync.Mutex
+		stopped = make(map[string]chan struct{})
+	)
+	stop := func(id string) chan struct{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped[id] == nil {
+			stopped[id] = make(chan struct{})
+		}
+		return stopped[id]
+	}
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			container, err := client.InspectContainer(m[1])
+			if err == nil && len(container.Config.Cmd) > 0 && container.Config.Cmd[0] == "long" {
+				<-stop(container.ID)
+				_ = server.MutateContainer(m[1], docker.State{ExitCode: 137, StartedAt: time.Now()})
+			} else {
+				time.Sleep(100 * time.Millisecond)
+				_ = server.MutateContainer(m[1], docker.State{ExitCode: 0, StartedAt: time.Now()})
+			}
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	server.CustomHandler("/containers/.*/stop", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			if container, err := client.InspectContainer(m[1]); err == nil {
+				close(stop(container.ID))
+			}
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+}
+
+// waitDrainable waits until n runs of client are movable by DrainHost
+func waitDrainable(t *testing.T, r *Runner, client *docker.Client, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.drainableRuns(client)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d runs to be started but found %d", n, len(r.drainableRuns(client)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunnerDrainHostRerun(t *testing.T) {
+	srcServer := createFakeDockerAPI(t)
+	defer srcServer.Stop()
+	fakeLogs(srcServer, "ok", "")
+	srcClient := NewTestClient(srcServer.URL(), t)
+	fakeLongRuns(srcServer, srcClient)
+	dstServer := createFakeDockerAPI(t)
+	defer dstServer.Stop()
+	fakeExit(dstServer, 0, 0)
+	fakeLogs(dstServer, "ok", "")
+	bodies := recordCreateBodies(dstServer)
+	dstClient := NewTestClient(dstServer.URL(), t)
+
+	// built once so the concurrent runs find the image
+	if _, _, err := FnImageBuild(srcClient, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+	history := NewMemoryRunHistory(0)
+	r := NewRunner(srcClient)
+	r.CaptureResolvedConfig = true
+	r.History = history
+	ctx := context.Background()
+	results := make(chan RunResult, 2)
+	for _, cmd := range []string{"long", "short"} {
+		containerOpts := ContainerOptions{Cmd: []string{cmd}, Env: []string{"API_TOKEN=s3cr3t"}}
+		go func() {
+			// the stopped run fails with the exit code of its container
+			result, _ := r.Run(ctx, testBuildOptions(), containerOpts)
+			results <- result
+		}()
+	}
+	waitDrainable(t, r, srcClient, 2)
+
+	src, dst := HostRef{Name: "src", Client: srcClient}, HostRef{Name: "dst", Client: dstClient}
+	report, err := r.DrainHost(ctx, src, dst, DrainPolicy{Threshold: 500 * time.Millisecond, StopTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !report.Complete || len(report.Outcome(DrainFinished)) != 1 || len(report.Outcome(DrainRerun)) != 1 {
+		t.Fatalf("expected a finished run and a re-run one but found %+v", report)
+	}
+	rerun := report.Outcome(DrainRerun)[0]
+	if rerun.Destination == "" || rerun.Image != "gofn/test" || rerun.Error != "" {
+		t.Errorf("unexpected re-run %+v", rerun)
+	}
+	exits := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		exits[(<-results).ExitCode] = true
+	}
+	if !exits[0] || !exits[137] {
+		t.Errorf("expected the stopped run to exit with 137 but found the exit codes %v", exits)
+	}
+
+	// the re-run goes on in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runs, err := history.Query(RunFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the re-run in the history but found %+v", runs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(*bodies) != 1 || !strings.Contains((*bodies)[0], "API_TOKEN=s3cr3t") || !strings.Contains((*bodies)[0], `"long"`) {
+		t.Errorf("expected the run to be created again with its secret but found %v", *bodies)
+	}
+
+	_, err = r.Run(ctx, testBuildOptions(), ContainerOptions{})
+	if err != ErrHostDraining {
+		t.Errorf("expected %q but found %v", ErrHostDraining, err)
+	}
+	r.UndrainHost(src)
+	_, err = r.Run(ctx, testBuildOptions(), ContainerOptions{})
+	if err != nil {
+		t.Errorf("Expected no errors once undrained but %q found", err)
+	}
+}
+
+func TestRunnerDrainHostResume(t *testing.T) {
+	srcServer := createFakeDockerAPI(t)
+	defer srcServer.Stop()
+	fakeLogs(srcServer, "ok", "")
+	srcClient := NewTestClient(srcServer.URL(), t)
+	fakeLongRuns(srcServer, srcClient)
+	dstServer := createFakeDockerAPI(t)
+	defer dstServer.Stop()
+	dstClient := NewTestClient(dstServer.URL(), t)
+
+	// without a snapshot the run can only be abandoned
+	r := NewRunner(srcClient)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = r.Run(context.Background(), testBuildOptions(), ContainerOptions{Cmd: []string{"long"}})
+	}()
+	waitDrainable(t, r, srcClient, 1)
+	src, dst := HostRef{Name: "src", Client: srcClient}, HostRef{Name: "dst", Client: dstClient}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	report, err := r.DrainHost(ctx, src, dst, DrainPolicy{Threshold: time.Hour})
+	if err != context.DeadlineExceeded || report.Complete || len(report.Runs) != 0 {
+		t.Fatalf("expected an interrupted drain but found %+v and %v", report, err)
+	}
+
+	report, err = r.DrainHost(context.Background(), src, dst, DrainPolicy{
+		Threshold: time.Millisecond,
+		Resume:    &DrainReport{Runs: []DrainedRun{{ContainerID: "earlier", Outcome: DrainRerun}}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	abandoned := report.Outcome(DrainAbandoned)
+	if !report.Complete || len(report.Runs) != 2 || report.Runs[0].ContainerID != "earlier" || len(abandoned) != 1 || abandoned[0].Error != ErrRunNotReplayable.Error() {
+		t.Errorf("expected the resumed drain to abandon the run but found %+v", report)
+	}
+	// the abandoned run is left running on the drained host
+	select {
+	case <-done:
+		t.Error("expected the abandoned run to go on")
+	default:
+	}
+	_ = srcClient.StopContainer(abandoned[0].ContainerID, 0)
+	<-done
+}
+
+// stubCheckpointer migrates the containers to the same ID suffixed by "-restored"
+type stubCheckpointer struct{}
+
+func (stubCheckpointer) Migrate(ctx context.Context, src, dst HostRef, containerID string) (string, error) {
+	return containerID + "-restored", src.Client.StopContainer(containerID, 0)
+}
+
+func TestRunnerDrainHostMigrate(t *testing.T) {
+	info := map[string]interface{}{"OSType": "linux", "Architecture": "x86_64", "ExperimentalBuild": true}
+	srcServer := createFakeDockerAPI(t)
+	defer srcServer.Stop()
+	fakeLogs(srcServer, "ok", "")
+	fakeInfo(srcServer, info)
+	srcClient := NewTestClient(srcServer.URL(), t)
+	fakeLongRuns(srcServer, srcClient)
+	dstServer := createFakeDockerAPI(t)
+	defer dstServer.Stop()
+	fakeInfo(dstServer, info)
+	dstClient := NewTestClient(dstServer.URL(), t)
+
+	r := NewRunner(srcClient)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = r.Run(context.Background(), testBuildOptions(), ContainerOptions{Cmd: []string{"long"}})
+	}()
+	waitDrainable(t, r, srcClient, 1)
+
+	src, dst := HostRef{Name: "src", Client: srcClient}, HostRef{Name: "dst", Client: dstClient}
+	report, err := r.DrainHost(context.Background(), src, dst, DrainPolicy{Threshold: time.Millisecond, Checkpointer: stubCheckpointer{}})
+	<-done
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	migrated := report.Outcome(DrainMigrated)
+	if len(migrated) != 1 || migrated[0].Destination != migrated[0].ContainerID+"-restored" {
+		t.Errorf("expected the run to be migrated but found %+v", report)
+	}
+}
+
+func TestDrainDecision(t *testing.T) {
+	linux := Capabilities{OSType: "linux", Architecture: "x86_64", Checkpoint: true}
+	arm := Capabilities{OSType: "linux", Architecture: "aarch64", Checkpoint: true}
+	tests := []struct {
+		name         string
+		replayable   bool
+		checkpointer bool
+		src, dst     Capabilities
+		want         DrainOutcome
+	}{
+		{"checkpoints", true, true, linux, linux, DrainMigrated},
+		{"checkpoints without snapshot", false, true, linux, linux, DrainMigrated},
+		{"no checkpointer", true, false, linux, linux, DrainRerun},
+		{"destination without checkpoints", true, true, linux, Capabilities{OSType: "linux", Architecture: "x86_64"}, DrainRerun},
+		{"other platform", true, true, linux, arm, DrainRerun},
+		{"nothing to run again", false, true, linux, arm, DrainAbandoned},
+		{"nothing at all", false, false, Capabilities{}, Capabilities{}, DrainAbandoned},
+	}
+	for _, test := range tests {
+		if got := drainDecision(test.replayable, test.checkpointer, test.src, test.dst); got != test.want {
+			t.Errorf("%s: expected %s but found %s", test.name, test.want, got)
+		}
+	}
+}
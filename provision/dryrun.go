@@ -0,0 +1,371 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// The actions of the calls recorded by RecordingClient
+const (
+	ActionCreate  = "create"
+	ActionStart   = "start"
+	ActionKill    = "kill"
+	ActionRemove  = "remove"
+	ActionBuild   = "build"
+	ActionPull    = "pull"
+	ActionTag     = "tag"
+	ActionPush    = "push"
+	ActionUpload  = "upload"
+	ActionExec    = "exec"
+	ActionConnect = "connect"
+	ActionPrune   = "prune"
+	// ActionOther is a call changing the daemon RecordingClient does not know
+	ActionOther = "other"
+)
+
+// dryRunID prefixes the IDs of the objects created by a RecordingClient
+const dryRunID = "dryrun-"
+
+// mutations classifies the calls changing the daemon, the first match wins
+var mutations = []struct {
+	method string
+	path   *regexp.Regexp
+	action string
+}{
+	{http.MethodPost, regexp.MustCompile(`^/build$`), ActionBuild},
+	{http.MethodPost, regexp.MustCompile(`^/images/create$`), ActionPull},
+	{http.MethodPost, regexp.MustCompile(`^/images/.+/tag$`), ActionTag},
+	{http.MethodPost, regexp.MustCompile(`^/images/.+/push$`), ActionPush},
+	{http.MethodPost, regexp.MustCompile(`^/(containers|networks|volumes)/create$`), ActionCreate},
+	{http.MethodPost, regexp.MustCompile(`^/containers/[^/]+/start$`), ActionStart},
+	{http.MethodPost, regexp.MustCompile(`^/containers/[^/]+/(kill|stop)$`), ActionKill},
+	{http.MethodPost, regexp.MustCompile(`^/containers/[^/]+/exec$`), ActionExec},
+	{http.MethodPost, regexp.MustCompile(`^/networks/[^/]+/(connect|disconnect)$`), ActionConnect},
+	{http.MethodPost, regexp.MustCompile(`^/[a-z]+/prune$`), ActionPrune},
+	{http.MethodPut, regexp.MustCompile(`^/containers/[^/]+/archive$`), ActionUpload},
+	{http.MethodDelete, regexp.MustCompile(`.`), ActionRemove},
+}
+
+// readOnlyPosts are the POST calls leaving the daemon as is, they are passed to the backend
+var readOnlyPosts = regexp.MustCompile(`^/(auth|containers/[^/]+/(wait|attach|resize)|exec/[^/]+/(start|resize))$`)
+
+// RecordedCall is a call changing the daemon recorded instead of being made, Path is without
+// the API version and the JSON Body has its credentials redacted
+type RecordedCall struct {
+	Action string          `json:"action"`
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Query  url.Values      `json:"query,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+func (c RecordedCall) String() string {
+	call := c.Action + " " + c.Method + " " + c.Path
+	if len(c.Query) > 0 {
+		call += "?" + c.Query.Encode()
+	}
+	return call
+}
+
+// RecordingClient is a dry-run docker daemon: the calls changing the daemon, e.g. a build,
+// the creation, the start or the removal of a container, are recorded and answered as if
+// they succeeded, the read-only calls are passed to the backend daemon. The containers, execs,
+// networks and images of the dry run are simulated so the flows using them, e.g. Runner.Run,
+// complete their decisions without side effects. A simulated container exits with code 0
+// without any output.
+type RecordingClient struct {
+	backend *docker.Client
+	server  *httptest.Server
+
+	mu      sync.Mutex
+	calls   []RecordedCall
+	seq     int
+	objects map[string]interface{}
+	images  map[string]bool
+}
+
+// NewRecordingClient returns a dry-run daemon passing the read-only calls to backend, which
+// may be nil for a daemon without any image nor container
+func NewRecordingClient(backend *docker.Client) *RecordingClient {
+	c := &RecordingClient{backend: backend, objects: make(map[string]interface{}), images: make(map[string]bool)}
+	c.server = httptest.NewServer(http.HandlerFunc(c.serveHTTP))
+	return c
+}
+
+// DryRun runs fn with a client of a RecordingClient passing the read-only calls to backend
+// and returns the calls fn would have made to change the daemon
+func DryRun(ctx context.Context, backend *docker.Client, fn func(ctx context.Context, client *docker.Client) error) (transcript []RecordedCall, err error) {
+	recorder := NewRecordingClient(backend)
+	defer recorder.Close()
+	client, err := recorder.Client()
+	if err != nil {
+		return
+	}
+	err = fn(ctx, client)
+	transcript = recorder.Transcript()
+	return
+}
+
+// Client returns a client of the dry-run daemon
+func (c *RecordingClient) Client() (*docker.Client, error) {
+	return docker.NewClient(c.server.URL)
+}
+
+// Transcript returns the calls recorded so far, in the order they were made
+func (c *RecordingClient) Transcript() []RecordedCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]RecordedCall(nil), c.calls...)
+}
+
+// Close stops the dry-run daemon
+func (c *RecordingClient) Close() {
+	c.server.CloseClientConnections()
+	c.server.Close()
+}
+
+func (c *RecordingClient) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := "/" + strings.TrimPrefix(apiVersionPrefix.ReplaceAllString(r.URL.Path, "/"), "/")
+	if id := simulatedID(path); id != "" {
+		c.serveSimulated(w, r, path, id)
+		return
+	}
+	action := mutation(r.Method, path)
+	if action == "" {
+		c.forward(w, r)
+		return
+	}
+	c.answer(w, r, c.record(r, action, path))
+}
+
+// record records the call r changing the daemon
+func (c *RecordingClient) record(r *http.Request, action, path string) (call RecordedCall) {
+	call = RecordedCall{Action: action, Method: r.Method, Path: path}
+	if query := r.URL.Query(); len(query) > 0 {
+		call.Query = query
+	}
+	if isJSON(r.Header.Get("Content-Type")) {
+		body, _ := ioutil.ReadAll(r.Body)
+		call.Body = requestBody(r.Header.Get("Content-Type"), body)
+	} else {
+		// the build context and the uploaded archives are not kept
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, call)
+	return
+}
+
+// mutation returns the action of a call changing the daemon, empty for a read-only call
+func mutation(method, path string) string {
+	if method == http.MethodGet || method == http.MethodHead || (method == http.MethodPost && readOnlyPosts.MatchString(path)) {
+		return ""
+	}
+	for _, m := range mutations {
+		if m.method == method && m.path.MatchString(path) {
+			return m.action
+		}
+	}
+	return ActionOther
+}
+
+// simulatedID returns the ID of the object of the dry run path is about, if any
+func simulatedID(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 && strings.HasPrefix(parts[2], dryRunID) {
+		return parts[2]
+	}
+	return ""
+}
+
+// newID returns the ID of a new object of the dry run
+func (c *RecordingClient) newID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	return fmt.Sprintf("%s%d", dryRunID, c.seq)
+}
+
+// answer writes the answer of a successful call
+func (c *RecordingClient) answer(w http.ResponseWriter, r *http.Request, call RecordedCall) {
+	w.Header().Set("Content-Type", "application/json")
+	switch call.Action {
+	case ActionBuild:
+		c.addImage(r.URL.Query().Get("t"))
+		_ = json.NewEncoder(w).Encode(map[string]string{"stream": "dry run: build recorded\n"})
+	case ActionPull:
+		image := r.URL.Query().Get("fromImage")
+		if tag := r.URL.Query().Get("tag"); tag != "" {
+			image += ":" + tag
+		}
+		c.addImage(image)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "dry run: pull recorded"})
+	case ActionTag:
+		image := r.URL.Query().Get("repo")
+		if tag := r.URL.Query().Get("tag"); tag != "" {
+			image += ":" + tag
+		}
+		c.addImage(image)
+		w.WriteHeader(http.StatusCreated)
+	case ActionCreate:
+		id := c.newID()
+		var created interface{}
+		switch call.Path {
+		case "/containers/create":
+			var config docker.Config
+			_ = json.Unmarshal(call.Body, &config)
+			created = &docker.Container{ID: id, Name: "/" + r.URL.Query().Get("name"), Config: &config, Image: config.Image, State: docker.State{Status: "created"}}
+		case "/networks/create":
+			var network docker.CreateNetworkOptions
+			_ = json.Unmarshal(call.Body, &network)
+			created = &docker.Network{ID: id, Name: network.Name, Driver: network.Driver, Labels: network.Labels}
+		default:
+			created = map[string]string{"Name": id}
+		}
+		c.mu.Lock()
+		c.objects[id] = created
+		c.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"Id": id, "Name": id})
+	case ActionExec:
+		id := c.newID()
+		c.mu.Lock()
+		c.objects[id] = &docker.ExecInspect{ID: id, ContainerID: strings.Split(call.Path, "/")[2]}
+		c.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"Id": id})
+	case ActionRemove:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		_, _ = io.WriteString(w, "{}")
+	}
+}
+
+// serveSimulated answers the calls about the object id of the dry run, the calls changing
+// it are recorded
+func (c *RecordingClient) serveSimulated(w http.ResponseWriter, r *http.Request, path, id string) {
+	c.mu.Lock()
+	object, ok := c.objects[id]
+	c.mu.Unlock()
+	if !ok {
+		http.Error(w, `{"message":"no such object: `+id+`"}`, http.StatusNotFound)
+		return
+	}
+	action := mutation(r.Method, path)
+	if action != "" {
+		call := c.record(r, action, path)
+		c.mu.Lock()
+		if container, ok := object.(*docker.Container); ok && action == ActionStart {
+			container.State = docker.State{Status: "exited"}
+		}
+		if action == ActionRemove {
+			delete(c.objects, id)
+		}
+		c.mu.Unlock()
+		if action == ActionExec {
+			c.answer(w, r, call)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	switch {
+	case strings.HasSuffix(path, "/attach") || strings.HasSuffix(path, "/start"):
+		// the simulated container or exec has no output
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n"))
+	case strings.HasSuffix(path, "/wait"):
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"StatusCode":0}`)
+	case strings.HasSuffix(path, "/logs"):
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	case strings.HasSuffix(path, "/json") || strings.Count(path, "/") == 2:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(object)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (c *RecordingClient) addImage(name string) {
+	if name == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.images[name] = true
+}
+
+// forward passes a read-only call to the backend, the images built, pulled or tagged by the
+// dry run are answered from the simulation
+func (c *RecordingClient) forward(w http.ResponseWriter, r *http.Request) {
+	path := "/" + strings.TrimPrefix(apiVersionPrefix.ReplaceAllString(r.URL.Path, "/"), "/")
+	if strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json") {
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")
+		c.mu.Lock()
+		simulated := c.images[name] || c.images[name+":latest"]
+		c.mu.Unlock()
+		if simulated {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(docker.Image{ID: dryRunID + name, RepoTags: []string{name}})
+			return
+		}
+	}
+	if c.backend == nil {
+		http.Error(w, `{"message":"dry run without a backend"}`, http.StatusNotFound)
+		return
+	}
+	req, err := http.NewRequest(r.Method, backendURL(c.backend)+r.URL.RequestURI(), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	req = req.WithContext(r.Context())
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	resp, err := c.backend.HTTPClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// backendURL returns the base URL of the requests to the daemon of client
+func backendURL(client *docker.Client) string {
+	endpoint := client.Endpoint()
+	switch {
+	case strings.HasPrefix(endpoint, "unix://"), strings.HasPrefix(endpoint, "npipe://"):
+		// the transport of the client dials the socket whatever the host
+		return "http://unix.sock"
+	case strings.HasPrefix(endpoint, "tcp://") && client.TLSConfig != nil:
+		return "https://" + strings.TrimPrefix(endpoint, "tcp://")
+	case strings.HasPrefix(endpoint, "tcp://"):
+		return "http://" + strings.TrimPrefix(endpoint, "tcp://")
+	}
+	return strings.TrimSuffix(endpoint, "/")
+}
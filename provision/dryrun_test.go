@@ -0,0 +1,151 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// actions returns the actions and paths of transcript, the generated container IDs kept as is
+func actions(transcript []RecordedCall) (calls []string) {
+	for _, call := range transcript {
+		calls = append(calls, call.Action+" "+call.Path)
+	}
+	return
+}
+
+// readOnlyBackend returns a fake daemon with the fake image when withImage is set, failing
+// every call changing it, and the calls it received
+func readOnlyBackend(t *testing.T, withImage bool) (client *docker.Client, received func() []string, stop func()) {
+	server := createFakeDockerAPI(t)
+	client = NewTestClient(server.URL(), t)
+	if withImage {
+		createFakeImage(client)
+	}
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	server.SetHook(func(r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			t.Errorf("unexpected call %s %s to the backend", r.Method, r.URL.Path)
+		}
+	})
+	return client, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), calls...)
+	}, server.Stop
+}
+
+func TestDryRunRunner(t *testing.T) {
+	backend, received, stop := readOnlyBackend(t, false)
+	defer stop()
+
+	opts := testBuildOptions()
+	opts.Tags = []string{"gofn/test:v1"}
+	transcript, err := DryRun(context.Background(), backend, func(ctx context.Context, client *docker.Client) error {
+		result, err := NewRunner(client).Run(ctx, opts, ContainerOptions{Env: []string{"A=1"}})
+		if err == nil && result.ExitCode != 0 {
+			t.Errorf("expected the simulated container to succeed but found %d", result.ExitCode)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	got := actions(transcript)
+	if len(got) != 5 {
+		t.Fatalf("unexpected transcript %v", got)
+	}
+	id := strings.Split(transcript[3].Path, "/")[2]
+	want := []string{
+		"build /build",
+		"tag /images/gofn/test/tag",
+		"create /containers/create",
+		"start /containers/" + id + "/start",
+		"remove /containers/" + id,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the calls %v but found %v", want, got)
+	}
+	if transcript[0].Query.Get("t") != "gofn/test" || transcript[1].Query.Get("tag") != "v1" {
+		t.Errorf("unexpected parameters %v %v", transcript[0].Query, transcript[1].Query)
+	}
+	var config docker.Config
+	if err = json.Unmarshal(transcript[2].Body, &config); err != nil || config.Image != "gofn/test" || !reflect.DeepEqual(config.Env, []string{"A=1"}) {
+		t.Errorf("unexpected container %s: %v", transcript[2].Body, err)
+	}
+	// the image was looked up on the backend
+	if calls := received(); len(calls) == 0 || calls[0] != "GET /images/json" {
+		t.Errorf("expected the image to be looked up on the backend but found %v", calls)
+	}
+	if containers, _ := backend.ListContainers(docker.ListContainersOptions{All: true}); len(containers) != 0 {
+		t.Errorf("expected no container on the backend but found %v", containers)
+	}
+}
+
+func TestDryRunExistingImage(t *testing.T) {
+	backend, _, stop := readOnlyBackend(t, true)
+	defer stop()
+	image := "gofn/python"
+
+	// the image of the backend is not built again
+	transcript, err := DryRun(context.Background(), backend, func(ctx context.Context, client *docker.Client) error {
+		_, err := NewRunner(client).Run(ctx, &BuildOptions{ImageName: image, DoNotUsePrefixImageName: true}, ContainerOptions{})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	got := actions(transcript)
+	if len(got) != 3 || got[0] != "create /containers/create" || !strings.HasPrefix(got[1], "start ") || !strings.HasPrefix(got[2], "remove ") {
+		t.Errorf("unexpected transcript %v", got)
+	}
+}
+
+func TestRecordingClientWithoutBackend(t *testing.T) {
+	recorder := NewRecordingClient(nil)
+	defer recorder.Close()
+	client, err := recorder.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = FnPull(client, &BuildOptions{ImageName: "python:3.12", DoNotUsePrefixImageName: true}); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	// the pulled image is simulated, the others are missing
+	if _, err = client.InspectImage("python:3.12"); err != nil {
+		t.Errorf("expected the pulled image to be found but found %v", err)
+	}
+	if _, err = client.InspectImage("gofn/python"); err != docker.ErrNoSuchImage {
+		t.Errorf("expected no image but found %v", err)
+	}
+	network, err := client.CreateNetwork(docker.CreateNetworkOptions{Name: "gofn-dry", Driver: "bridge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspected, err := client.NetworkInfo(network.ID); err != nil || inspected.Name != "gofn-dry" {
+		t.Errorf("expected the simulated network but found %v %v", inspected, err)
+	}
+	if err = client.RemoveNetwork(network.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.NetworkInfo(network.ID); err == nil {
+		t.Error("expected the removed network to be gone")
+	}
+	got := actions(recorder.Transcript())
+	want := []string{"pull /images/create", "create /networks/create", "remove /networks/" + network.ID}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the calls %v but found %v", want, got)
+	}
+}
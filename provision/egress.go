@@ -0,0 +1,295 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/internal/names"
+)
+
+// EgressMode selects what a container can reach outside the daemon host
+type EgressMode int
+
+const (
+	// EgressUnrestricted leaves the container on the daemon default network
+	EgressUnrestricted EgressMode = iota
+	// EgressNone disables the container network
+	EgressNone
+	// EgressAllowList places the container on an internal network whose only way out
+	// is a proxy sidecar reaching the hosts of EgressPolicy.Allow.
+	//
+	// The proxy is announced through HTTP_PROXY and HTTPS_PROXY, clients ignoring them
+	// reach nothing since the network has no route outside, so the policy fails closed.
+	// Only HTTP and the HTTPS CONNECT of ports 80 and 443 go through the proxy, and the
+	// names are resolved by the proxy. Per container iptables rules would filter any
+	// protocol but need a privileged helper on the daemon host, which remote daemons
+	// provisioned by an iaas do not offer, so they are not used.
+	EgressAllowList
+)
+
+// EgressReadyMarker is printed by the proxy sidecar once it accepts connections
+const EgressReadyMarker = "gofn-egress-ready"
+
+// egressProxyAlias is the name of the proxy on the internal network
+const egressProxyAlias = "gofn-egress-proxy"
+
+var (
+	// ErrEgressRequiresRunner is raised when a container with EgressAllowList is created outside Runner.Run
+	ErrEgressRequiresRunner = errors.New("provision: allow list egress requires Runner.Run")
+
+	// ErrEgressProxyNotReady is raised when the proxy sidecar did not print EgressReadyMarker in time
+	ErrEgressProxyNotReady = errors.New("provision: egress proxy not ready")
+
+	egressDenied = regexp.MustCompile(`refused on filtered (?:domain|url) "([^"]+)"`)
+)
+
+// EgressPolicy restricts the network of a container
+type EgressPolicy struct {
+	Mode EgressMode
+	// Allow lists the hosts reachable with EgressAllowList: names like example.com, wildcards
+	// like *.example.com matching the subdomains, IP addresses and CIDRs aligned on an
+	// octet like 10.0.0.0/8, which match the requests made to IP addresses
+	Allow []string
+}
+
+// EgressProxy is the sidecar enforcing EgressAllowList, it reads the allowed host patterns,
+// one extended regular expression per line, from GOFN_EGRESS_FILTER, listens on Port and
+// prints EgressReadyMarker when it accepts connections
+type EgressProxy struct {
+	Image string
+	Cmd   []string
+	Port  int
+	// ReadyTimeout bounds the wait for EgressReadyMarker
+	ReadyTimeout time.Duration
+}
+
+// DefaultEgressProxy runs tinyproxy, it is installed when the sidecar starts so the
+// daemon host needs access to the alpine mirrors, use an image with tinyproxy to avoid it
+var DefaultEgressProxy = EgressProxy{
+	Image:        "alpine:3.20",
+	Port:         3128,
+	ReadyTimeout: time.Minute,
+	Cmd: []string{"sh", "-c", `set -e
+command -v tinyproxy >/dev/null || apk add --no-cache tinyproxy >/dev/null
+mkdir -p /etc/tinyproxy
+printf '%s\n' "$GOFN_EGRESS_FILTER" > /etc/tinyproxy/gofn.filter
+cat > /etc/tinyproxy/gofn.conf <<EOF
+Port 3128
+Listen 0.0.0.0
+Timeout 600
+LogLevel Connect
+FilterDefaultDeny Yes
+FilterType ere
+Filter "/etc/tinyproxy/gofn.filter"
+ConnectPort 443
+ConnectPort 80
+EOF
+tinyproxy -d -c /etc/tinyproxy/gofn.conf &
+until nc -z 127.0.0.1 3128; do sleep 0.1; done
+echo ` + EgressReadyMarker + `
+wait`},
+}
+
+// egressFilter returns the proxy pattern matching an entry of EgressPolicy.Allow
+func egressFilter(entry string) (pattern string, err error) {
+	if strings.Contains(entry, "/") {
+		var ip net.IP
+		var network *net.IPNet
+		ip, network, err = net.ParseCIDR(entry)
+		if err != nil || ip.To4() == nil {
+			err = fmt.Errorf("%q is not an IPv4 CIDR", entry)
+			return
+		}
+		ones, _ := network.Mask.Size()
+		if ones%8 != 0 {
+			err = fmt.Errorf("%q is not aligned on an octet", entry)
+			return
+		}
+		octets := strings.Split(network.IP.To4().String(), ".")[:ones/8]
+		pattern = "^" + strings.Join(octets, `\.`)
+		for i := ones / 8; i < 4; i++ {
+			if i > 0 {
+				pattern += `\.`
+			}
+			pattern += "[0-9]+"
+		}
+		pattern += "$"
+		return
+	}
+	if net.ParseIP(entry) != nil {
+		pattern = "^" + regexp.QuoteMeta(entry) + "$"
+		return
+	}
+	wildcard := strings.HasPrefix(entry, "*.")
+	host := strings.TrimPrefix(entry, "*.")
+	if host == "" || strings.ContainsAny(host, "*/:@ ") {
+		err = fmt.Errorf("%q is not a host name", entry)
+		return
+	}
+	if wildcard {
+		pattern = `^.+\.` + regexp.QuoteMeta(host) + "$"
+		return
+	}
+	pattern = "^" + regexp.QuoteMeta(host) + "$"
+	return
+}
+
+// egressSidecar is the internal network and the proxy of a container with EgressAllowList
+type egressSidecar struct {
+	client  *docker.Client
+	network *docker.Network
+	proxyID string
+}
+
+// startEgress creates the internal network and starts the proxy enforcing policy on it
+func (r *Runner) startEgress(ctx context.Context, policy EgressPolicy) (sidecar *egressSidecar, err error) {
+	proxy := r.EgressProxy
+	if proxy.Image == "" {
+		proxy = DefaultEgressProxy
+	}
+	var filters []string
+	for _, entry := range policy.Allow {
+		var pattern string
+		pattern, err = egressFilter(entry)
+		if err != nil {
+			return
+		}
+		filters = append(filters, pattern)
+	}
+	uid := names.ID()
+	network, err := FnCreateNetwork(r.Client, NetworkOptions{InvocationID: uid, Internal: true})
+	if err != nil {
+		return
+	}
+	sidecar = &egressSidecar{client: r.Client, network: network}
+	defer func() {
+		if err != nil {
+			sidecar.remove()
+			sidecar = nil
+		}
+	}()
+	image := r.rewrite(proxy.Image)
+	labels := map[string]string{LabelOwner: ownerGofn, LabelInvocation: uid}
+	if image != proxy.Image {
+		labels[LabelImageReference] = proxy.Image
+	}
+	_, err = findImage(ctx, r.Client, image)
+	if err == ErrImageNotFound {
+		err = pull(ctx, r.Client, &BuildOptions{ImageName: image, DoNotUsePrefixImageName: true})
+	}
+	if err != nil {
+		return
+	}
+	container, err := r.Client.CreateContainer(docker.CreateContainerOptions{
+		Name: fmt.Sprintf("gofn-egress-%s", uid),
+		Config: &docker.Config{
+			Image:  image,
+			Cmd:    proxy.Cmd,
+			Env:    []string{"GOFN_EGRESS_FILTER=" + strings.Join(filters, "\n")},
+			Labels: labels,
+		},
+		HostConfig: &docker.HostConfig{},
+		Context:    ctx,
+	})
+	if err != nil {
+		return
+	}
+	sidecar.proxyID = container.ID
+	err = r.Client.ConnectNetwork(network.ID, docker.NetworkConnectionOptions{
+		Container:      container.ID,
+		EndpointConfig: &docker.EndpointConfig{Aliases: []string{egressProxyAlias}},
+		Context:        ctx,
+	})
+	if err != nil {
+		return
+	}
+	err = r.Client.StartContainerWithContext(container.ID, nil, ctx)
+	if err != nil {
+		return
+	}
+	timeout := proxy.ReadyTimeout
+	if timeout == 0 {
+		timeout = DefaultEgressProxy.ReadyTimeout
+	}
+	err = sidecar.waitReady(ctx, timeout)
+	return
+}
+
+// env returns the variables pointing the clients of the container to the proxy
+func (s *egressSidecar) env(port int) []string {
+	proxy := fmt.Sprintf("http://%s:%d", egressProxyAlias, port)
+	return []string{
+		"HTTP_PROXY=" + proxy,
+		"HTTPS_PROXY=" + proxy,
+		"http_proxy=" + proxy,
+		"https_proxy=" + proxy,
+		"NO_PROXY=localhost,127.0.0.1",
+		"no_proxy=localhost,127.0.0.1",
+	}
+}
+
+func (s *egressSidecar) logs(ctx context.Context) (out string, err error) {
+	var buf bytes.Buffer
+	err = s.client.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    s.proxyID,
+		Stdout:       true,
+		Stderr:       true,
+		OutputStream: &buf,
+		ErrorStream:  &buf,
+	})
+	out = buf.String()
+	return
+}
+
+func (s *egressSidecar) waitReady(ctx context.Context, timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var out string
+		out, err = s.logs(ctx)
+		if err != nil {
+			return
+		}
+		if strings.Contains(out, EgressReadyMarker) {
+			return
+		}
+		if time.Now().After(deadline) {
+			return ErrEgressProxyNotReady
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// violations returns the hosts the proxy refused, in the order of the requests
+func (s *egressSidecar) violations(ctx context.Context) (hosts []string, err error) {
+	out, err := s.logs(ctx)
+	if err != nil {
+		return
+	}
+	for _, m := range egressDenied.FindAllStringSubmatch(out, -1) {
+		hosts = append(hosts, m[1])
+	}
+	return
+}
+
+// remove removes the proxy and the network, it must be called after the container left the network
+func (s *egressSidecar) remove() (err error) {
+	if s.proxyID != "" {
+		err = FnRemove(s.client, s.proxyID)
+	}
+	if removeErr := FnRemoveNetwork(s.client, s.network.ID); err == nil {
+		err = removeErr
+	}
+	return
+}
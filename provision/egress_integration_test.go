@@ -0,0 +1,44 @@
+package provision
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestEgressAllowListIntegration needs a docker daemon with access to the internet,
+// it runs when GOFN_EGRESS_INTEGRATION is set
+func TestEgressAllowListIntegration(t *testing.T) {
+	if testing.Short() || os.Getenv("GOFN_EGRESS_INTEGRATION") == "" {
+		t.Skip("set GOFN_EGRESS_INTEGRATION to run the egress integration test")
+	}
+	client, err := FnClient("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	buildOpts := &BuildOptions{ImageName: "curlimages/curl:8.10.1", DoNotUsePrefixImageName: true}
+	containerOpts := ContainerOptions{
+		Cmd: []string{"sh", "-c", `for url in https://example.com http://example.org; do
+	curl -fsS -o /dev/null --max-time 20 "$url" && echo "allowed $url" || echo "refused $url"
+done`},
+		Egress: EgressPolicy{Mode: EgressAllowList, Allow: []string{"example.com"}},
+	}
+	result, err := r.Run(context.Background(), buildOpts, containerOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := result.Stdout.String()
+	if !strings.Contains(out, "allowed https://example.com") {
+		t.Errorf("expected example.com to be reachable but found %q", out)
+	}
+	if !strings.Contains(out, "refused http://example.org") {
+		t.Errorf("expected example.org to be refused but found %q", out)
+	}
+	if want := []string{"example.org"}; !reflect.DeepEqual(result.EgressViolations, want) {
+		t.Errorf("expected the violations %v but found %v", want, result.EgressViolations)
+	}
+}
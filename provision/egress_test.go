@@ -0,0 +1,199 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+func TestEgressFilter(t *testing.T) {
+	tests := []struct {
+		entry   string
+		pattern string
+		matches []string
+		misses  []string
+	}{
+		{"example.com", `^example\.com$`, []string{"example.com"}, []string{"api.example.com", "example.com.evil.io"}},
+		{"*.example.com", `^.+\.example\.com$`, []string{"api.example.com"}, []string{"example.com", "evilexample.com"}},
+		{"10.0.0.0/8", `^10\.[0-9]+\.[0-9]+\.[0-9]+$`, []string{"10.1.2.3"}, []string{"110.1.2.3", "11.0.0.1"}},
+		{"192.168.1.0/24", `^192\.168\.1\.[0-9]+$`, []string{"192.168.1.20"}, []string{"192.168.10.2"}},
+		{"1.2.3.4", `^1\.2\.3\.4$`, []string{"1.2.3.4"}, []string{"1.2.3.45"}},
+	}
+	for _, tt := range tests {
+		pattern, err := egressFilter(tt.entry)
+		if err != nil {
+			t.Errorf("egressFilter(%q) failed: %v", tt.entry, err)
+			continue
+		}
+		if pattern != tt.pattern {
+			t.Errorf("egressFilter(%q) = %q, want %q", tt.entry, pattern, tt.pattern)
+		}
+		for _, host := range tt.matches {
+			if !regexp.MustCompile(pattern).MatchString(host) {
+				t.Errorf("expected %q to allow %q", tt.entry, host)
+			}
+		}
+		for _, host := range tt.misses {
+			if regexp.MustCompile(pattern).MatchString(host) {
+				t.Errorf("expected %q to refuse %q", tt.entry, host)
+			}
+		}
+	}
+	for _, entry := range []string{"10.0.0.0/12", "fd00::/8", "*", "http://example.com", ""} {
+		if _, err := egressFilter(entry); err == nil {
+			t.Errorf("expected %q to be refused", entry)
+		}
+	}
+}
+
+func TestFnContainerEgressNone(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	container, err := FnContainer(client, ContainerOptions{Image: image, Egress: EgressPolicy{Mode: EgressNone}})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if container.HostConfig.NetworkMode != "none" {
+		t.Errorf("expected the network to be disabled but found %q", container.HostConfig.NetworkMode)
+	}
+
+	_, err = FnContainer(client, ContainerOptions{Image: image, Egress: EgressPolicy{Mode: EgressAllowList, Allow: []string{"example.com"}}})
+	if err != ErrEgressRequiresRunner {
+		t.Errorf("expected ErrEgressRequiresRunner but found %v", err)
+	}
+}
+
+// fakeEgress records the containers created next to the fake networks and answers
+// the logs of the proxy with its readiness and a refused request
+type fakeEgress struct {
+	mu      sync.Mutex
+	created []docker.CreateContainerOptions
+}
+
+func newFakeEgress(server *fake.DockerServer, networks *fakeNetworks) *fakeEgress {
+	f := &fakeEgress{}
+	server.CustomHandler("/containers/[^/]+$", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/create"):
+			body, _ := ioutil.ReadAll(r.Body)
+			var opts struct {
+				docker.Config
+				HostConfig *docker.HostConfig
+			}
+			_ = json.Unmarshal(body, &opts)
+			f.mu.Lock()
+			f.created = append(f.created, docker.CreateContainerOptions{
+				Name:       r.URL.Query().Get("name"),
+				Config:     &opts.Config,
+				HostConfig: opts.HostConfig,
+			})
+			f.mu.Unlock()
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		case r.Method == http.MethodDelete:
+			// removing a container removes its endpoints
+			id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+			networks.mu.Lock()
+			for _, network := range networks.networks {
+				delete(network.Containers, id)
+			}
+			networks.mu.Unlock()
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	server.CustomHandler("/containers/.*/logs", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		writeFrame(w, 2, "NOTICE: Initializing tinyproxy ...\n")
+		writeFrame(w, 1, EgressReadyMarker+"\n")
+		writeFrame(w, 2, `NOTICE: Proxying refused on filtered domain "evil.example.org"`+"\n")
+	}))
+	return f
+}
+
+func TestRunnerEgressAllowList(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	networks := newFakeNetworks(server)
+	egress := newFakeEgress(server, networks)
+	client := NewTestClient(server.URL(), t)
+	// the fake daemon ignores the filter of the image list, so both images are created upfront
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+	err := client.PullImage(docker.PullImageOptions{Repository: "alpine", Tag: "3.20"}, docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{
+		Env:    []string{"GO=fn"},
+		Egress: EgressPolicy{Mode: EgressAllowList, Allow: []string{"example.com", "10.0.0.0/8"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if want := []string{"evil.example.org"}; !reflect.DeepEqual(result.EgressViolations, want) {
+		t.Errorf("expected the violations %v but found %v", want, result.EgressViolations)
+	}
+	if len(egress.created) != 2 {
+		t.Fatalf("expected the proxy and the function containers but found %d", len(egress.created))
+	}
+	proxy, function := egress.created[0], egress.created[1]
+	if proxy.Config.Image != DefaultEgressProxy.Image || !strings.HasPrefix(proxy.Name, "gofn-egress-") {
+		t.Errorf("unexpected proxy %s running %s", proxy.Name, proxy.Config.Image)
+	}
+	wantFilter := "GOFN_EGRESS_FILTER=^example\\.com$\n^10\\.[0-9]+\\.[0-9]+\\.[0-9]+$"
+	if !reflect.DeepEqual(proxy.Config.Env, []string{wantFilter}) {
+		t.Errorf("expected the proxy filter %q but found %q", wantFilter, proxy.Config.Env)
+	}
+	if !strings.HasPrefix(function.HostConfig.NetworkMode, "gofn-") {
+		t.Errorf("expected the function on the internal network but found %q", function.HostConfig.NetworkMode)
+	}
+	env := strings.Join(function.Config.Env, " ")
+	if !strings.Contains(env, "GO=fn") || !strings.Contains(env, "HTTPS_PROXY=http://gofn-egress-proxy:3128") {
+		t.Errorf("expected the proxy variables next to the caller ones but found %v", function.Config.Env)
+	}
+	if len(networks.networks) != 0 {
+		t.Errorf("expected the internal network to be removed but found %v", networks.networks)
+	}
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 0 {
+		t.Errorf("expected the proxy to be removed but found %d containers", len(containers))
+	}
+}
+
+func TestRunnerEgressAllowListInvalid(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	networks := newFakeNetworks(server)
+	client := NewTestClient(server.URL(), t)
+
+	_, err := NewRunner(client).Run(context.Background(), testBuildOptions(), ContainerOptions{
+		Egress: EgressPolicy{Mode: EgressAllowList, Allow: []string{"10.0.0.0/12"}},
+	})
+	verr, ok := err.(ValidationErrors)
+	if !ok || len(verr) != 1 || verr[0].Field != "Egress.Allow[0]" {
+		t.Errorf("expected a validation error on the allow list but found %v", err)
+	}
+	if len(networks.networks) != 0 {
+		t.Error("expected no network to be created")
+	}
+}
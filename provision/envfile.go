@@ -0,0 +1,108 @@
+package provision
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// containerEnv returns the environment of the container: opts.Env followed by the variables of
+// opts.EnvFiles and of opts.EnvPassthrough it does not set. A variable of a later env file
+// replaces the one of an earlier file, and the env files win over the passthrough.
+func containerEnv(opts ContainerOptions) (env []string, err error) {
+	if len(opts.EnvFiles) == 0 && len(opts.EnvPassthrough) == 0 {
+		return opts.Env, nil
+	}
+	var fromFiles []string
+	for _, name := range opts.EnvFiles {
+		var vars []string
+		vars, err = readEnvFile(name)
+		if err != nil {
+			return
+		}
+		fromFiles = append(fromFiles, vars...)
+	}
+	var passed []string
+	for _, name := range opts.EnvPassthrough {
+		if value, ok := os.LookupEnv(name); ok {
+			passed = append(passed, name+"="+value)
+		}
+	}
+	env = append([]string{}, opts.Env...)
+	set := make(map[string]bool, len(env))
+	for _, entry := range env {
+		set[envName(entry)] = true
+	}
+	for _, vars := range [][]string{fromFiles, passed} {
+		// the last entry of a name wins within vars
+		last := make(map[string]int, len(vars))
+		for i, entry := range vars {
+			last[envName(entry)] = i
+		}
+		for i, entry := range vars {
+			if name := envName(entry); !set[name] && last[name] == i {
+				env = append(env, entry)
+			}
+		}
+		for name := range last {
+			set[name] = true
+		}
+	}
+	return
+}
+
+// envName returns the name of the KEY=value variable entry
+func envName(entry string) string {
+	return strings.SplitN(entry, "=", 2)[0]
+}
+
+func readEnvFile(name string) (env []string, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		err = fmt.Errorf("provision: env file %s: %v", name, err)
+		return
+	}
+	defer f.Close()
+	env, err = parseEnvFile(f)
+	if err != nil {
+		err = fmt.Errorf("provision: env file %s: %v", name, err)
+	}
+	return
+}
+
+// parseEnvFile reads the variables of r like docker --env-file: the blank lines and the lines
+// starting with # are skipped, the value of KEY=value is taken as is, quotes and spaces
+// included, and a line holding a single name takes its value from the environment of the
+// process, it is skipped when the variable is not set
+func parseEnvFile(r io.Reader) (env []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if n == 1 {
+			// the byte order mark of an editor
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 1 {
+			parts[0] = strings.TrimRightFunc(parts[0], unicode.IsSpace)
+		}
+		if !envNamePattern.MatchString(parts[0]) {
+			err = fmt.Errorf("line %d: %q is not a valid variable name", n, parts[0])
+			return
+		}
+		if len(parts) == 2 {
+			env = append(env, line)
+		} else if value, ok := os.LookupEnv(parts[0]); ok {
+			env = append(env, parts[0]+"="+value)
+		}
+	}
+	err = scanner.Err()
+	return
+}
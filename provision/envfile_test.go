@@ -0,0 +1,79 @@
+package provision
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	_ = os.Setenv("GOFN_TEST_HOST", "from host")
+	defer os.Unsetenv("GOFN_TEST_HOST")
+	file := "\ufeff# the settings of the function\n" +
+		"MODE=check\r\n" +
+		"\n" +
+		"   DSN=postgres://db?sslmode=disable\n" +
+		"QUOTED=\"kept\"  \n" +
+		"GOFN_TEST_HOST\n" +
+		"GOFN_TEST_UNSET\n" +
+		"EMPTY=\n"
+	env, err := parseEnvFile(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := []string{"MODE=check", "DSN=postgres://db?sslmode=disable", `QUOTED="kept"  `, "GOFN_TEST_HOST=from host", "EMPTY="}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("expected %q but found %q", want, env)
+	}
+	_, err = parseEnvFile(strings.NewReader("MODE=check\nMY MODE=check\n"))
+	if err == nil || err.Error() != `line 2: "MY MODE" is not a valid variable name` {
+		t.Errorf("expected the invalid name to be reported but found %v", err)
+	}
+}
+
+func TestFnContainerEnvFiles(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	dir, err := ioutil.TempDir("", "gofn-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defaults, local := filepath.Join(dir, "defaults.env"), filepath.Join(dir, "local.env")
+	_ = ioutil.WriteFile(defaults, []byte("MODE=prod\nLEVEL=info\nTOKEN=file\n"), 0600)
+	_ = ioutil.WriteFile(local, []byte("# overrides\nLEVEL=debug\nQUERY=a=1&b=2\n"), 0600)
+	_ = os.Setenv("GOFN_TEST_TOKEN", "host")
+	_ = os.Setenv("GOFN_TEST_PEM", "-----BEGIN KEY-----\nabc=\n-----END KEY-----")
+	defer os.Unsetenv("GOFN_TEST_TOKEN")
+	defer os.Unsetenv("GOFN_TEST_PEM")
+
+	container, err := FnContainer(client, ContainerOptions{
+		Image:          createFakeImage(client),
+		Env:            []string{"MODE=test"},
+		EnvFiles:       []string{defaults, local},
+		EnvPassthrough: []string{"GOFN_TEST_PEM", "GOFN_TEST_TOKEN", "GOFN_TEST_UNSET", "TOKEN"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := []string{
+		"MODE=test",
+		"TOKEN=file",
+		"LEVEL=debug",
+		"QUERY=a=1&b=2",
+		"GOFN_TEST_PEM=-----BEGIN KEY-----\nabc=\n-----END KEY-----",
+		"GOFN_TEST_TOKEN=host",
+	}
+	if !reflect.DeepEqual(container.Config.Env, want) {
+		t.Errorf("expected %q but found %q", want, container.Config.Env)
+	}
+
+	_, err = FnContainer(client, ContainerOptions{Image: createFakeImage(client), EnvFiles: []string{filepath.Join(dir, "missing.env")}})
+	if err == nil || !strings.HasPrefix(err.Error(), "provision: env file ") {
+		t.Errorf("expected the missing env file to be reported but found %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+package provision
+
+// EnvironmentOptions describe the containers started together for an invocation, e.g. a function and its sidecars
+type EnvironmentOptions struct {
+	// Services are in start order, each one after the services it depends on
+	Services []ServiceOptions `json:"services"`
+	// Ignored lists the unsupported settings left out when the environment was loaded, e.g. services.db.healthcheck
+	Ignored []string `json:"ignored,omitempty"`
+}
+
+// ServiceOptions describe a container of an environment
+type ServiceOptions struct {
+	Name      string           `json:"name"`
+	Container ContainerOptions `json:"container"`
+	// Ports are the published ports in the docker run -p syntax, e.g. 127.0.0.1:8080:80/tcp
+	Ports     []string `json:"ports,omitempty"`
+	DependsOn []string `json:"depends_on,omitempty"`
+}
@@ -0,0 +1,82 @@
+package provision
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"text/template"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/iaas"
+)
+
+// TemplateData is the invocation metadata available to ContainerOptions.EnvTemplate
+type TemplateData struct {
+	InvocationID string
+	Image        string
+	ImageDigest  string
+	Host         string
+	Machine      *iaas.Machine
+	Vars         map[string]string
+}
+
+// templateData collects the metadata of the container about to be created
+func templateData(client *docker.Client, opts ContainerOptions, invocationID string) (data TemplateData, err error) {
+	data = TemplateData{
+		InvocationID: invocationID,
+		Image:        opts.Image,
+		Machine:      opts.Machine,
+		Vars:         opts.TemplateVars,
+	}
+	image, err := client.InspectImage(opts.Image)
+	if err != nil {
+		return
+	}
+	data.ImageDigest = image.ID
+	if len(image.RepoDigests) > 0 {
+		data.ImageDigest = image.RepoDigests[0]
+	}
+	if opts.Machine != nil {
+		data.Host = opts.Machine.Address()
+	} else if endpoint, parseErr := url.Parse(client.Endpoint()); parseErr == nil {
+		data.Host = endpoint.Hostname()
+	}
+	if data.Machine == nil && !opts.StrictTemplate {
+		data.Machine = &iaas.Machine{}
+	}
+	if data.Vars == nil {
+		data.Vars = map[string]string{}
+	}
+	return
+}
+
+// renderEnv renders opts.EnvTemplate into KEY=value pairs sorted by key,
+// in strict mode a reference to a missing key is an error instead of an empty value
+func renderEnv(opts ContainerOptions, data TemplateData) (env []string, err error) {
+	keys := make([]string, 0, len(opts.EnvTemplate))
+	for key := range opts.EnvTemplate {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	missingKey := "missingkey=zero"
+	if opts.StrictTemplate {
+		missingKey = "missingkey=error"
+	}
+	for _, key := range keys {
+		var tmpl *template.Template
+		tmpl, err = template.New(key).Option(missingKey).Parse(opts.EnvTemplate[key])
+		if err != nil {
+			err = fmt.Errorf("provision: env template %s: %v", key, err)
+			return
+		}
+		var value bytes.Buffer
+		err = tmpl.Execute(&value, data)
+		if err != nil {
+			err = fmt.Errorf("provision: env template %s: %v", key, err)
+			return
+		}
+		env = append(env, key+"="+value.String())
+	}
+	return
+}
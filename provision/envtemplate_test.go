@@ -0,0 +1,118 @@
+package provision
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gofn/gofn/iaas"
+)
+
+func TestFnContainerEnvTemplate(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	container, err := FnContainer(client, ContainerOptions{
+		Image: image,
+		Env:   []string{"GO=fn"},
+		EnvTemplate: map[string]string{
+			"GOFN_INVOCATION_ID": "{{.InvocationID}}",
+			"GOFN_IMAGE":         "{{.Image}}",
+			"GOFN_IMAGE_DIGEST":  "{{.ImageDigest}}",
+			"GOFN_HOST":          "{{.Host}}",
+			"GOFN_MACHINE_IP":    "{{.Machine.IP}}",
+			"GOFN_FUNCTION_NAME": "{{.Vars.function}}-v{{.Vars.version}}",
+		},
+		TemplateVars: map[string]string{"function": "resize", "version": "2"},
+		Machine:      &iaas.Machine{IP: "10.0.0.7"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	env := map[string]string{}
+	for _, kv := range container.Config.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	want := map[string]string{
+		"GO":                 "fn",
+		"GOFN_INVOCATION_ID": strings.TrimPrefix(container.Name, "gofn-"),
+		"GOFN_IMAGE":         image,
+		"GOFN_HOST":          "10.0.0.7",
+		"GOFN_MACHINE_IP":    "10.0.0.7",
+		"GOFN_FUNCTION_NAME": "resize-v2",
+	}
+	for key, value := range want {
+		if env[key] != value {
+			t.Errorf("expected %s=%q but found %q", key, value, env[key])
+		}
+	}
+	if env["GOFN_IMAGE_DIGEST"] == "" {
+		t.Error("expected GOFN_IMAGE_DIGEST to be set")
+	}
+}
+
+func TestFnContainerEnvTemplateMissingKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		strict   bool
+		wantErr  bool
+		want     string
+	}{
+		{name: "lax missing var", template: "{{.Vars.missing}}", want: "X="},
+		{name: "lax missing machine", template: "{{.Machine.IP}}", want: "X="},
+		{name: "strict missing var", template: "{{.Vars.missing}}", strict: true, wantErr: true},
+		{name: "strict missing machine", template: "{{.Machine.IP}}", strict: true, wantErr: true},
+		{name: "invalid template", template: "{{.Vars", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			client := NewTestClient(server.URL(), t)
+			image := createFakeImage(client)
+
+			container, err := FnContainer(client, ContainerOptions{
+				Image:          image,
+				EnvTemplate:    map[string]string{"X": tt.template},
+				StrictTemplate: tt.strict,
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error but none found")
+				}
+				containers, err := FnListContainers(client)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(containers) != 0 {
+					t.Errorf("Expected no container to be created but %d found", len(containers))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if len(container.Config.Env) != 1 || container.Config.Env[0] != tt.want {
+				t.Errorf("Expected env [%s] but %v found", tt.want, container.Config.Env)
+			}
+		})
+	}
+}
+
+func TestFnContainerEmptyEnvTemplate(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	container, err := FnContainer(client, ContainerOptions{Image: image, Env: []string{"GO=fn"}, EnvTemplate: map[string]string{}})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(container.Config.Env) != 1 || container.Config.Env[0] != "GO=fn" {
+		t.Errorf("Expected env to be untouched but %v found", container.Config.Env)
+	}
+}
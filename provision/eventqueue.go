@@ -0,0 +1,198 @@
+package provision
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEventQueueSize is the number of pending events an EventQueue holds
+	DefaultEventQueueSize = 256
+	// DefaultLifecycleTimeout bounds the wait of a lifecycle event for room in a full EventQueue
+	DefaultLifecycleTimeout = time.Second
+)
+
+// EventQueueOptions size an EventQueue
+type EventQueueOptions struct {
+	// Size is the number of pending events held by the queue, DefaultEventQueueSize when zero
+	Size int
+	// HighWater is the number of pending events above which the frequent events, pull progress
+	// and stats samples, are coalesced, three quarters of Size when zero
+	HighWater int
+	// LifecycleTimeout bounds the wait of a lifecycle event while the queue is full, the event
+	// is then queued beyond Size, DefaultLifecycleTimeout when zero
+	LifecycleTimeout time.Duration
+}
+
+// EventQueueStats are the counters of an EventQueue
+type EventQueueStats struct {
+	// Pending is the number of events waiting for the consumer
+	Pending int
+	// Delivered is the number of events given to the consumer
+	Delivered uint64
+	// Dropped is the number of events discarded while the queue was full, lifecycle ones excepted
+	Dropped uint64
+	// Coalesced is the number of frequent events merged into a pending one
+	Coalesced uint64
+	// Overflowed is the number of lifecycle events queued beyond Size once their wait timed out
+	Overflowed uint64
+	// Panicked is the number of events whose consumer panicked, the panic is recovered and
+	// reported to the PanicHandler and the next events are delivered
+	Panicked uint64
+}
+
+// EventQueue hands the events of a Runner to a consumer from a goroutine of its own, so a slow
+// consumer does not slow the runs down, e.g. runner.OnEvent = NewEventQueue(consume, options).Emit.
+// The queue is bounded: above its high-water mark a frequent event replaces the pending event of
+// the same kind and container, see Event.Coalesced, and once full the events are dropped. The
+// lifecycle events, created and exited, are never dropped: they wait for room, at most
+// LifecycleTimeout, and are queued beyond the bound afterwards.
+type EventQueue struct {
+	consumer func(Event)
+	options  EventQueueOptions
+
+	mu      sync.Mutex
+	pending []Event
+	stats   EventQueueStats
+	// changed is closed and replaced when an event is queued or taken by the consumer
+	changed chan struct{}
+	closed  bool
+	done    chan struct{}
+}
+
+// NewEventQueue returns a queue delivering its events to consumer, Close stops it
+func NewEventQueue(consumer func(Event), options EventQueueOptions) *EventQueue {
+	if options.Size <= 0 {
+		options.Size = DefaultEventQueueSize
+	}
+	if options.HighWater <= 0 || options.HighWater > options.Size {
+		options.HighWater = options.Size * 3 / 4
+	}
+	if options.LifecycleTimeout == 0 {
+		options.LifecycleTimeout = DefaultLifecycleTimeout
+	}
+	q := &EventQueue{
+		consumer: consumer,
+		options:  options,
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	goSafe("event queue", func() error {
+		q.deliver()
+		return nil
+	}, nil)
+	return q
+}
+
+// Emit queues e, it only blocks for a lifecycle event while the queue is full. The events
+// emitted once the queue is closed are dropped.
+func (q *EventQueue) Emit(e Event) {
+	var (
+		timeout  <-chan time.Time
+		overflow bool
+	)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		switch {
+		case q.closed:
+			q.stats.Dropped++
+			return
+		case e.Kind.frequent() && len(q.pending) >= q.options.HighWater && q.coalesce(e):
+			return
+		case len(q.pending) < q.options.Size || overflow:
+			if len(q.pending) >= q.options.Size {
+				q.stats.Overflowed++
+			}
+			q.pending = append(q.pending, e)
+			q.signal()
+			return
+		case !e.Kind.lifecycle():
+			q.stats.Dropped++
+			return
+		}
+		if timeout == nil {
+			timer := time.NewTimer(q.options.LifecycleTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			overflow = true
+		}
+		q.mu.Lock()
+	}
+}
+
+// coalesce replaces the latest pending event of the kind and container of e with e
+func (q *EventQueue) coalesce(e Event) bool {
+	for i := len(q.pending) - 1; i >= 0; i-- {
+		previous := q.pending[i]
+		if previous.Kind == e.Kind && previous.ContainerID == e.ContainerID {
+			e.Coalesced += previous.Coalesced + 1
+			q.pending[i] = e
+			q.stats.Coalesced++
+			return true
+		}
+	}
+	return false
+}
+
+func (q *EventQueue) signal() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+func (q *EventQueue) deliver() {
+	defer close(q.done)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for len(q.pending) == 0 {
+			if q.closed {
+				return
+			}
+			changed := q.changed
+			q.mu.Unlock()
+			<-changed
+			q.mu.Lock()
+		}
+		e := q.pending[0]
+		q.pending[0] = Event{}
+		q.pending = q.pending[1:]
+		q.signal()
+		q.mu.Unlock()
+		err := safely("event consumer", func() error {
+			q.consumer(e)
+			return nil
+		})
+		q.mu.Lock()
+		q.stats.Delivered++
+		if err != nil {
+			q.stats.Panicked++
+		}
+	}
+}
+
+// Stats returns the counters of the queue, e.g. to expose them as metrics
+func (q *EventQueue) Stats() EventQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Pending = len(q.pending)
+	return stats
+}
+
+// Close delivers the pending events and stops the queue
+func (q *EventQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		q.signal()
+	}
+	q.mu.Unlock()
+	<-q.done
+}
@@ -0,0 +1,187 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventQueueLoad(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "ok", "")
+	// 10 layers downloaded in 5 steps each before the image is pulled
+	updates := 10*5 + 1
+	server.CustomHandler("/images/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for step := 1; step <= 5; step++ {
+			for layer := 0; layer < 10; layer++ {
+				fmt.Fprintf(w, `{"status":"Downloading","id":"layer%d","progressDetail":{"current":%d,"total":5}}`+"\n", layer, step)
+			}
+		}
+		fmt.Fprintln(w, `{"status":"Status: Downloaded newer image for gofn/pulled"}`)
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	// the consumer is stuck until the runs are over
+	var (
+		mu        sync.Mutex
+		delivered []Event
+	)
+	release := make(chan struct{})
+	q := NewEventQueue(func(e Event) {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, e)
+	}, EventQueueOptions{Size: 8, HighWater: 4, LifecycleTimeout: 5 * time.Millisecond})
+	r := NewRunner(client)
+	r.SkipSizeCheck = true
+	r.OnEvent = q.Emit
+
+	// the first run pulls the image, the others find it
+	ctx := context.Background()
+	opts := &BuildOptions{ImageName: "gofn/pulled:latest", DoNotUsePrefixImageName: true, ForcePull: true}
+	result, err := r.Run(ctx, opts, ContainerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	containers := map[string]bool{result.ContainerID: true}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				result, err := r.Run(ctx, opts, ContainerOptions{})
+				if err != nil {
+					t.Errorf("Expected no errors but %q found", err)
+					return
+				}
+				mu.Lock()
+				containers[result.ContainerID] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+	q.Close()
+
+	stats := q.Stats()
+	if stats.Dropped != 0 || stats.Overflowed == 0 {
+		t.Errorf("expected the lifecycle events to overflow the full queue without drops but found %+v", stats)
+	}
+	created, exited := make(map[string]bool), make(map[string]bool)
+	var progress []Event
+	merged := 0
+	for _, e := range delivered {
+		switch e.Kind {
+		case EventCreated:
+			created[e.ContainerID] = true
+		case EventExited:
+			exited[e.ContainerID] = true
+		case EventPullProgress:
+			progress = append(progress, e)
+			merged += e.Coalesced + 1
+		}
+	}
+	if len(created) != len(containers) || len(exited) != len(containers) {
+		t.Errorf("expected the creation and the exit of %d containers but found %d and %d", len(containers), len(created), len(exited))
+	}
+	for id := range containers {
+		if !created[id] || !exited[id] {
+			t.Errorf("missing lifecycle events of %s", id)
+		}
+	}
+	// the pull progress beyond the high-water mark is merged into a pending event
+	if len(progress) > 5 || merged != updates || uint64(updates-len(progress)) != stats.Coalesced {
+		t.Errorf("expected %d updates coalesced into at most 5 events but found %d events for %d updates", updates, len(progress), merged)
+	}
+	if last := progress[len(progress)-1]; last.Message != "pulling gofn/pulled:latest: 100%" {
+		t.Errorf("expected the latest progress to be delivered but found %q", last.Message)
+	}
+}
+
+func TestEventQueueCoalescing(t *testing.T) {
+	taken, release := make(chan struct{}, 16), make(chan struct{})
+	var delivered []Event
+	q := NewEventQueue(func(e Event) {
+		taken <- struct{}{}
+		<-release
+		delivered = append(delivered, e)
+	}, EventQueueOptions{Size: 4, HighWater: 2, LifecycleTimeout: time.Millisecond})
+
+	q.Emit(Event{Kind: EventWarning, Message: "held"})
+	<-taken
+	// below the high-water mark the samples are queued as is
+	q.Emit(Event{Kind: EventStats, ContainerID: "a", Message: "1"})
+	q.Emit(Event{Kind: EventStats, ContainerID: "b", Message: "1"})
+	// above it they replace the pending sample of their container
+	q.Emit(Event{Kind: EventStats, ContainerID: "a", Message: "2"})
+	q.Emit(Event{Kind: EventStats, ContainerID: "a", Message: "3"})
+	q.Emit(Event{Kind: EventStats, ContainerID: "c", Message: "1"})
+	q.Emit(Event{Kind: EventWarning, Message: "fits"})
+	// the queue is full
+	q.Emit(Event{Kind: EventStats, ContainerID: "d", Message: "1"})
+	q.Emit(Event{Kind: EventWarning, Message: "dropped"})
+	q.Emit(Event{Kind: EventExited, ContainerID: "a", Message: "exit code 0"})
+	close(release)
+	q.Close()
+
+	got := make([]string, len(delivered))
+	for i, e := range delivered {
+		got[i] = fmt.Sprintf("%s %s %s %d", e.Kind, e.ContainerID, e.Message, e.Coalesced)
+	}
+	want := []string{
+		"warning  held 0",
+		"stats a 3 2",
+		"stats b 1 0",
+		"stats c 1 0",
+		"warning  fits 0",
+		"exited a exit code 0 0",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected the events %q but found %q", want, got)
+	}
+	stats := q.Stats()
+	if stats.Delivered != 6 || stats.Coalesced != 2 || stats.Dropped != 2 || stats.Overflowed != 1 {
+		t.Errorf("unexpected counters %+v", stats)
+	}
+	// the closed queue drops the events
+	q.Emit(Event{Kind: EventCreated})
+	if q.Stats().Dropped != 3 {
+		t.Errorf("expected the event to be dropped but found %+v", q.Stats())
+	}
+}
+
+func TestEventQueueConsumerPanic(t *testing.T) {
+	captured, restore := capturePanics()
+	defer restore()
+	var delivered []string
+	q := NewEventQueue(func(e Event) {
+		if e.Message == "boom" {
+			panic("consumer exploded")
+		}
+		delivered = append(delivered, e.Message)
+	}, EventQueueOptions{})
+	for _, message := range []string{"before", "boom", "after", "boom", "last"} {
+		q.Emit(Event{Kind: EventWarning, Message: message})
+	}
+	q.Close()
+
+	if fmt.Sprint(delivered) != "[before after last]" {
+		t.Errorf("expected the delivery to go on after the panics but found %q", delivered)
+	}
+	if stats := q.Stats(); stats.Delivered != 5 || stats.Panicked != 2 {
+		t.Errorf("unexpected counters %+v", stats)
+	}
+	panics := captured()
+	if len(panics) != 2 || panics[0].Goroutine != "event consumer" {
+		t.Errorf("expected the panics of the consumer to be reported but found %v", panics)
+	}
+}
@@ -0,0 +1,40 @@
+package provision
+
+import "time"
+
+// EventKind identifies what an Event is about
+type EventKind string
+
+const (
+	// EventWarning reports a condition that does not stop the run but may surprise the caller
+	EventWarning EventKind = "warning"
+	// EventCreated reports the creation of a container, its message is the image
+	EventCreated EventKind = "created"
+	// EventExited reports the exit of a container, its message holds the exit code
+	EventExited EventKind = "exited"
+	// EventPullProgress reports the progress of the pull of an image, e.g. "pulling python: 43%"
+	EventPullProgress EventKind = "pull_progress"
+	// EventStats reports a resource usage sample of a container
+	EventStats EventKind = "stats"
+)
+
+// Event is emitted by a Runner while it handles a container
+type Event struct {
+	Kind        EventKind `json:"kind"`
+	ContainerID string    `json:"container_id,omitempty"`
+	Message     string    `json:"message"`
+	Time        time.Time `json:"time"`
+	// Coalesced is the number of earlier events of the same kind and container this one
+	// replaced in a filling EventQueue, only the latest of them is delivered
+	Coalesced int `json:"coalesced,omitempty"`
+}
+
+// lifecycle tells the kinds an EventQueue never drops
+func (k EventKind) lifecycle() bool {
+	return k == EventCreated || k == EventExited
+}
+
+// frequent tells the kinds an EventQueue coalesces above its high-water mark
+func (k EventKind) frequent() bool {
+	return k == EventPullProgress || k == EventStats
+}
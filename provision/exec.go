@@ -0,0 +1,80 @@
+package provision
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ExecOptions tune a command executed in a running container by FnExecWithOptions
+type ExecOptions struct {
+	// Env are the KEY=value variables added to the environment of the container for the command
+	Env []string
+	// WorkingDir is the directory the command runs in, the working directory of the container when empty
+	WorkingDir string
+}
+
+// FnExec executes cmd in the running container and returns its exit code, a non-zero exit is
+// not an error. stdin is the input of the command when not nil, its output is written to
+// stdout and stderr, which may be nil to discard it.
+func FnExec(client *docker.Client, containerID string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (exitCode int, err error) {
+	return FnExecWithOptions(context.Background(), client, containerID, cmd, stdin, stdout, stderr, ExecOptions{})
+}
+
+// FnExecWithOptions is FnExec with the environment and working directory of opts. Once ctx is
+// done the stream of the command is closed and ctx.Err() is returned with the exit code -1,
+// the daemon has no way to stop an exec so the command keeps running until it exits or the
+// container stops. The errors of the daemon are DaemonErrors.
+func FnExecWithOptions(ctx context.Context, client *docker.Client, containerID string, cmd []string, stdin io.Reader, stdout, stderr io.Writer, opts ExecOptions) (exitCode int, err error) {
+	exitCode, err = execCommand(ctx, client, containerID, cmd, stdin, stdout, stderr, opts)
+	err = ClassifyError(err)
+	return
+}
+
+func execCommand(ctx context.Context, client *docker.Client, containerID string, cmd []string, stdin io.Reader, stdout, stderr io.Writer, opts ExecOptions) (exitCode int, err error) {
+	exitCode = -1
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    containerID,
+		Cmd:          cmd,
+		Env:          opts.Env,
+		WorkingDir:   opts.WorkingDir,
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+		Context:      ctx,
+	})
+	if err != nil {
+		return
+	}
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	stream, err := client.StartExecNonBlocking(exec.ID, docker.StartExecOptions{
+		InputStream:  stdin,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Context:      ctx,
+	})
+	if err != nil {
+		return
+	}
+	// the attached stream ignores the context, it is closed once the context is done
+	err = waitStream(ctx, stream)
+	if ctx.Err() != nil {
+		_ = stream.Close()
+	}
+	if err != nil {
+		return
+	}
+	inspect, err := client.InspectExec(exec.ID)
+	if err != nil {
+		return
+	}
+	exitCode = inspect.ExitCode
+	return
+}
@@ -0,0 +1,144 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeExecs makes the execs of the fake docker api echo their input to stdout and write their
+// command to stderr. The command fail exits with 3 and hang runs until its stream is closed.
+// It returns the options the execs were created with.
+func fakeExecs(server *fake.DockerServer) (created func() []docker.CreateExecOptions) {
+	var mu sync.Mutex
+	var ordered []docker.CreateExecOptions
+	execs := make(map[string]docker.CreateExecOptions)
+	server.CustomHandler("/containers/.*/exec", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var opts docker.CreateExecOptions
+		_ = json.Unmarshal(body, &opts)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		recorder := httptest.NewRecorder()
+		server.DefaultHandler().ServeHTTP(recorder, r)
+		var exec docker.Exec
+		_ = json.Unmarshal(recorder.Body.Bytes(), &exec)
+		mu.Lock()
+		ordered = append(ordered, opts)
+		execs[exec.ID] = opts
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(recorder.Code)
+		_, _ = w.Write(recorder.Body.Bytes())
+	}))
+	server.CustomHandler("/exec/.*/start", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		opts := execs[strings.Split(r.URL.Path, "/")[2]]
+		mu.Unlock()
+		// the input follows the options of the start on the hijacked connection
+		_, _ = ioutil.ReadAll(r.Body)
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n"))
+		if opts.Cmd[0] == "hang" {
+			// the closed stream is only noticed by a failed write
+			for {
+				if _, err = conn.Write([]byte{1, 0, 0, 0, 0, 0, 0, 1, '.'}); err != nil {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		var input []byte
+		if opts.AttachStdin {
+			input, _ = ioutil.ReadAll(rw)
+		}
+		encodeFrames(conn, []frame{{StreamStdout, string(input)}, {StreamStderr, strings.Join(opts.Cmd, " ")}})
+	}))
+	server.CustomHandler("/exec/.*/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Split(r.URL.Path, "/")[2]
+		mu.Lock()
+		opts := execs[id]
+		mu.Unlock()
+		code := 0
+		if opts.Cmd[0] == "fail" {
+			code = 3
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(docker.ExecInspect{ID: id, ExitCode: code})
+	}))
+	return func() []docker.CreateExecOptions {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]docker.CreateExecOptions(nil), ordered...)
+	}
+}
+
+func TestFnExec(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	created := fakeExecs(server)
+	// the environment and working directory of an exec need the API 1.35
+	fakeVersion(server, `{"ApiVersion":"1.41"}`)
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+	runFakeContainer(client, container.ID, t)
+
+	var stdout, stderr bytes.Buffer
+	opts := ExecOptions{Env: []string{"MODE=check"}, WorkingDir: "/app"}
+	code, err := FnExecWithOptions(context.Background(), client, container.ID, []string{"cat", "-"}, strings.NewReader("ping"), &stdout, &stderr, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if code != 0 || stdout.String() != "ping" || stderr.String() != "cat -" {
+		t.Errorf("unexpected exec: exit code %d, stdout %q and stderr %q", code, stdout.String(), stderr.String())
+	}
+	execs := created()
+	if len(execs) != 1 || execs[0].Env[0] != "MODE=check" || execs[0].WorkingDir != "/app" || !execs[0].AttachStdin {
+		t.Errorf("expected the exec to be created with its options but found %+v", execs)
+	}
+
+	// a non-zero exit is not an error, the output is discarded
+	code, err = FnExec(client, container.ID, []string{"fail"}, nil, nil, nil)
+	if err != nil || code != 3 {
+		t.Errorf("expected the exit code 3 but found %d and %v", code, err)
+	}
+	if execs = created(); execs[1].AttachStdin {
+		t.Errorf("expected no stdin to be attached without input but found %+v", execs[1])
+	}
+
+	_, err = FnExec(client, "missing", []string{"true"}, nil, nil, nil)
+	var noSuchContainer *docker.NoSuchContainer
+	if !errors.As(err, &noSuchContainer) {
+		t.Errorf("expected the container not to be found but found %v", err)
+	}
+}
+
+func TestFnExecWithContext(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExecs(server)
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+	runFakeContainer(client, container.ID, t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	code, err := FnExecWithOptions(ctx, client, container.ID, []string{"hang"}, nil, nil, nil, ExecOptions{})
+	if err != context.DeadlineExceeded || code != -1 {
+		t.Errorf("expected the exec to time out but found %d and %v", code, err)
+	}
+}
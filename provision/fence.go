@@ -0,0 +1,186 @@
+package provision
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ExclusivePolicy selects what a run does when its ExclusiveKey is held by another run
+type ExclusivePolicy string
+
+const (
+	// ExclusiveWait waits for the key to be released, bounded by the run context
+	ExclusiveWait ExclusivePolicy = ""
+	// ExclusiveFailFast fails the run with ErrExclusiveKeyHeld
+	ExclusiveFailFast ExclusivePolicy = "fail-fast"
+
+	// LabelLock holds the exclusive key claimed by a lock sentinel
+	LabelLock = "io.gofn.lock"
+
+	// DefaultFencePollInterval is the interval of the daemon fence checks of a held key
+	DefaultFencePollInterval = 250 * time.Millisecond
+)
+
+var (
+	// ErrExclusiveKeyHeld is raised when the ExclusiveKey of a fail fast run is held by another run
+	ErrExclusiveKeyHeld = errors.New("provision: the exclusive key is held by another run")
+
+	lockNameCleaner = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+	// localFence fences the runners without a Fence
+	localFence = &LocalFence{}
+)
+
+// Fence serializes the runs sharing an exclusive key
+type Fence interface {
+	// Acquire takes the lock of key and returns the function releasing it, which can be called
+	// more than once. image is available on the daemon, a fence may use it for its own resources.
+	Acquire(ctx context.Context, key, image string, policy ExclusivePolicy) (release func(), err error)
+}
+
+// LocalFence fences the runs of the process, it is the Fence of the runners without one
+type LocalFence struct {
+	mu   sync.Mutex
+	held map[string]chan struct{}
+}
+
+// Acquire implements Fence
+func (f *LocalFence) Acquire(ctx context.Context, key, image string, policy ExclusivePolicy) (release func(), err error) {
+	for {
+		f.mu.Lock()
+		if f.held == nil {
+			f.held = make(map[string]chan struct{})
+		}
+		released, held := f.held[key]
+		if !held {
+			released = make(chan struct{})
+			f.held[key] = released
+			f.mu.Unlock()
+			var once sync.Once
+			release = func() {
+				once.Do(func() {
+					f.mu.Lock()
+					delete(f.held, key)
+					f.mu.Unlock()
+					close(released)
+				})
+			}
+			return
+		}
+		f.mu.Unlock()
+		if policy == ExclusiveFailFast {
+			err = ErrExclusiveKeyHeld
+			return
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
+
+// DaemonFence fences the runs of every process using the same daemon. The lock of a key is a
+// sentinel container, created from the image of the run and never started, whose name is derived
+// from the key: the daemon refuses a second container with the same name, so a single process
+// holds it. The sentinel of a process that died holding the lock is left behind, Stale breaks it.
+type DaemonFence struct {
+	Client *docker.Client
+	// PollInterval is the interval of the checks of a held key, DefaultFencePollInterval when zero
+	PollInterval time.Duration
+	// Stale breaks the locks held for longer, they are never broken when zero
+	Stale time.Duration
+}
+
+// lockName returns the name of the sentinel of key, the readable part of the key is
+// kept for the operators and a hash makes it unique
+func lockName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	readable := lockNameCleaner.ReplaceAllString(key, "-")
+	if len(readable) > 32 {
+		readable = readable[:32]
+	}
+	return "gofn-lock-" + readable + "-" + hex.EncodeToString(sum[:8])
+}
+
+// Acquire implements Fence
+func (f *DaemonFence) Acquire(ctx context.Context, key, image string, policy ExclusivePolicy) (release func(), err error) {
+	interval := f.PollInterval
+	if interval <= 0 {
+		interval = DefaultFencePollInterval
+	}
+	name := lockName(key)
+	for {
+		var sentinel *docker.Container
+		sentinel, err = f.Client.CreateContainer(docker.CreateContainerOptions{
+			Name: name,
+			Config: &docker.Config{
+				Image: image,
+				Cmd:   []string{"gofn-lock"},
+				Labels: map[string]string{
+					LabelOwner:   ownerGofn,
+					LabelLock:    key,
+					LabelCreated: time.Now().UTC().Format(time.RFC3339Nano),
+				},
+			},
+			Context: ctx,
+		})
+		if err == nil {
+			var once sync.Once
+			release = func() {
+				once.Do(func() {
+					_ = FnRemove(f.Client, sentinel.ID)
+				})
+			}
+			return
+		}
+		if err != docker.ErrContainerAlreadyExists {
+			return
+		}
+		if f.breakStale(ctx, name) {
+			continue
+		}
+		if policy == ExclusiveFailFast {
+			err = ErrExclusiveKeyHeld
+			return
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
+
+// breakStale removes the sentinel name when it is older than f.Stale, it reports whether it did
+func (f *DaemonFence) breakStale(ctx context.Context, name string) bool {
+	if f.Stale <= 0 {
+		return false
+	}
+	sentinel, err := f.Client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: name, Context: ctx})
+	if err != nil || sentinel.Config == nil {
+		return false
+	}
+	acquired, err := time.Parse(time.RFC3339Nano, sentinel.Config.Labels[LabelCreated])
+	if err != nil || time.Since(acquired) < f.Stale {
+		return false
+	}
+	err = f.Client.RemoveContainer(docker.RemoveContainerOptions{ID: sentinel.ID, Force: true, Context: ctx})
+	return err == nil || isNoSuchContainer(err)
+}
+
+func (r *Runner) fence() Fence {
+	if r.Fence == nil {
+		return localFence
+	}
+	return r.Fence
+}
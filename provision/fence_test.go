@@ -0,0 +1,172 @@
+package provision
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// acquireAsync acquires key from fence in the background, the acquisition is sent to the returned channel
+func acquireAsync(fence Fence, ctx context.Context, key, image string) <-chan error {
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := fence.Acquire(ctx, key, image, ExclusiveWait)
+		if err == nil {
+			defer release()
+		}
+		acquired <- err
+	}()
+	return acquired
+}
+
+func TestLocalFence(t *testing.T) {
+	fence := &LocalFence{}
+	release, err := fence.Acquire(context.Background(), "billing", "", ExclusiveWait)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, err = fence.Acquire(context.Background(), "billing", "", ExclusiveFailFast); err != ErrExclusiveKeyHeld {
+		t.Errorf("expected ErrExclusiveKeyHeld but found %v", err)
+	}
+	other, err := fence.Acquire(context.Background(), "reports", "", ExclusiveFailFast)
+	if err != nil {
+		t.Errorf("expected another key to be free but found %v", err)
+	} else {
+		other()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err = <-acquireAsync(fence, ctx, "billing", ""); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to end with the context but found %v", err)
+	}
+
+	acquired := acquireAsync(fence, context.Background(), "billing", "")
+	select {
+	case err = <-acquired:
+		t.Fatalf("expected the held key to be waited for but found %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	release()
+	select {
+	case err = <-acquired:
+		if err != nil {
+			t.Errorf("Expected no errors but %q found", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the released key to be acquired")
+	}
+}
+
+func TestDaemonFenceAcrossProcesses(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	// each orchestrator has its own client and fence, only the daemon is shared
+	first := &DaemonFence{Client: NewTestClient(server.URL(), t), PollInterval: 5 * time.Millisecond}
+	second := &DaemonFence{Client: NewTestClient(server.URL(), t), PollInterval: 5 * time.Millisecond}
+	image := createFakeImage(first.Client)
+
+	release, err := first.Acquire(context.Background(), "billing/invoices", image, ExclusiveWait)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, err = second.Acquire(context.Background(), "billing/invoices", image, ExclusiveFailFast); err != ErrExclusiveKeyHeld {
+		t.Errorf("expected ErrExclusiveKeyHeld but found %v", err)
+	}
+	sentinel, err := first.Client.InspectContainer(lockName("billing/invoices"))
+	if err != nil {
+		t.Fatalf("expected the lock sentinel but found %v", err)
+	}
+	if sentinel.State.Running || sentinel.Config.Labels[LabelLock] != "billing/invoices" {
+		t.Errorf("unexpected sentinel %+v", sentinel)
+	}
+
+	acquired := acquireAsync(second, context.Background(), "billing/invoices", image)
+	select {
+	case err = <-acquired:
+		t.Fatalf("expected the held key to be waited for but found %v", err)
+	case <-time.After(30 * time.Millisecond):
+	}
+	release()
+	select {
+	case err = <-acquired:
+		if err != nil {
+			t.Errorf("Expected no errors but %q found", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the released key to be acquired")
+	}
+}
+
+func TestDaemonFenceStale(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	// the process holding the lock died without releasing it
+	crashed := &DaemonFence{Client: client}
+	if _, err := crashed.Acquire(context.Background(), "billing", image, ExclusiveWait); err != nil {
+		t.Fatal(err)
+	}
+	fence := &DaemonFence{Client: client, Stale: time.Hour}
+	if _, err := fence.Acquire(context.Background(), "billing", image, ExclusiveFailFast); err != ErrExclusiveKeyHeld {
+		t.Errorf("expected a recent lock to be kept but found %v", err)
+	}
+	fence.Stale = time.Nanosecond
+	release, err := fence.Acquire(context.Background(), "billing", image, ExclusiveFailFast)
+	if err != nil {
+		t.Fatalf("expected the stale lock to be broken but found %v", err)
+	}
+	release()
+}
+
+func TestRunnerExclusiveKey(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 1, 100*time.Millisecond)
+	fakeLogs(server, "out", "")
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(client)
+	r.Fence = &LocalFence{}
+	r.OutputStrategy = OutputLogs
+	failed := make(chan error, 1)
+	go func() {
+		_, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{ExclusiveKey: "billing"})
+		failed <- err
+	}()
+	time.Sleep(30 * time.Millisecond)
+	opts := ContainerOptions{ExclusiveKey: "billing", ExclusivePolicy: ExclusiveFailFast}
+	if _, err := r.Run(context.Background(), testBuildOptions(), opts); err != ErrExclusiveKeyHeld {
+		t.Errorf("expected the overlapping run to fail fast but found %v", err)
+	}
+	if err := <-failed; err != ErrContainerExecutionFailed {
+		t.Fatalf("expected the first run to fail but found %v", err)
+	}
+	release, err := r.Fence.Acquire(context.Background(), "billing", "", ExclusiveFailFast)
+	if err != nil {
+		t.Fatalf("expected the failed run to release the key but found %v", err)
+	}
+	release()
+
+	r.OnOutput = func(StreamKind, []byte) {
+		panic("output handler")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic of the output handler")
+			}
+		}()
+		_, _ = r.Run(context.Background(), testBuildOptions(), opts)
+	}()
+	if release, err = r.Fence.Acquire(context.Background(), "billing", "", ExclusiveFailFast); err != nil {
+		t.Fatalf("expected the panicking run to release the key but found %v", err)
+	}
+	release()
+}
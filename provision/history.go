@@ -0,0 +1,143 @@
+package provision
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// missingLayerID is the ID the daemon reports for the layers built on another host
+const missingLayerID = "<missing>"
+
+// ImageLayer is an entry of the history of an image
+type ImageLayer struct {
+	// ID is "<missing>" for the layers built on another host or squashed
+	ID        string    `json:"id"`
+	CreatedBy string    `json:"created_by"`
+	Size      int64     `json:"size"`
+	Created   time.Time `json:"created"`
+	// EmptyLayer is set for the instructions changing only the image config, e.g. ENV or CMD
+	EmptyLayer bool     `json:"empty_layer"`
+	Tags       []string `json:"tags,omitempty"`
+	Comment    string   `json:"comment,omitempty"`
+}
+
+// ImageHistory is the history of an image, the newest layer first
+type ImageHistory []ImageLayer
+
+// HistoryDiff holds the layers found in only one of two images
+type HistoryDiff struct {
+	OnlyA []ImageLayer `json:"only_a"`
+	OnlyB []ImageLayer `json:"only_b"`
+	// Common is the number of layers found in both images
+	Common int `json:"common"`
+}
+
+// FnImageHistory returns the layers of image and the commands that created them
+func FnImageHistory(client *docker.Client, image string) (history ImageHistory, err error) {
+	entries, err := client.ImageHistory(image)
+	if err == docker.ErrNoSuchImage {
+		err = ErrImageNotFound
+	}
+	if err != nil {
+		return
+	}
+	history = make(ImageHistory, 0, len(entries))
+	for _, entry := range entries {
+		history = append(history, ImageLayer{
+			ID:         entry.ID,
+			CreatedBy:  entry.CreatedBy,
+			Size:       entry.Size,
+			Created:    time.Unix(entry.Created, 0).UTC(),
+			EmptyLayer: entry.Size == 0,
+			Tags:       entry.Tags,
+			Comment:    entry.Comment,
+		})
+	}
+	return
+}
+
+// FnImageDiff compares the histories of imageA and imageB
+func FnImageDiff(client *docker.Client, imageA, imageB string) (diff HistoryDiff, err error) {
+	a, err := FnImageHistory(client, imageA)
+	if err != nil {
+		return
+	}
+	b, err := FnImageHistory(client, imageB)
+	if err != nil {
+		return
+	}
+	diff = DiffHistory(a, b)
+	return
+}
+
+// DiffHistory returns the layers of a missing from b and the other way around. The layer IDs
+// differ between hosts, so two layers are the same when their command and size match.
+func DiffHistory(a, b ImageHistory) (diff HistoryDiff) {
+	inB := make(map[string]int, len(b))
+	for _, layer := range b {
+		inB[layer.key()]++
+	}
+	matched := make(map[string]int, len(a))
+	for _, layer := range a {
+		key := layer.key()
+		if inB[key] > 0 {
+			inB[key]--
+			matched[key]++
+			diff.Common++
+			continue
+		}
+		diff.OnlyA = append(diff.OnlyA, layer)
+	}
+	for _, layer := range b {
+		key := layer.key()
+		if matched[key] > 0 {
+			matched[key]--
+			continue
+		}
+		diff.OnlyB = append(diff.OnlyB, layer)
+	}
+	return
+}
+
+func (l ImageLayer) key() string {
+	return strings.TrimSpace(l.CreatedBy) + "\x00" + strconv.FormatInt(l.Size, 10)
+}
+
+// WriteTable writes the history as the docker history command does, without truncating the commands
+func (h ImageHistory) WriteTable(w io.Writer) error {
+	rows := make([][]string, 0, len(h))
+	for _, layer := range h {
+		id := layer.ID
+		if id != missingLayerID {
+			id = shortID(id)
+		}
+		rows = append(rows, []string{id, layer.Created.Format("2006-01-02 15:04:05"), layer.CreatedBy, units.HumanSize(float64(layer.Size)), layer.Comment})
+	}
+	return writeTable(w, []string{"IMAGE", "CREATED", "CREATED BY", "SIZE", "COMMENT"}, rows)
+}
+
+// WriteTable writes the layers found in a single image, marked with - for A and + for B
+func (d HistoryDiff) WriteTable(w io.Writer) error {
+	rows := make([][]string, 0, len(d.OnlyA)+len(d.OnlyB))
+	for _, layer := range d.OnlyA {
+		rows = append(rows, []string{"-", layer.CreatedBy, units.HumanSize(float64(layer.Size))})
+	}
+	for _, layer := range d.OnlyB {
+		rows = append(rows, []string{"+", layer.CreatedBy, units.HumanSize(float64(layer.Size))})
+	}
+	return writeTable(w, []string{"", "CREATED BY", "SIZE"}, rows)
+}
+
+// shortID returns the 12 first hex digits of a sha256 ID
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
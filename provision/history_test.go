@@ -0,0 +1,163 @@
+package provision
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeHistory serves the history fixtures of testdata/history by image name
+func fakeHistory(server *fake.DockerServer, fixtures map[string]string) {
+	server.CustomHandler("/images/.*/history", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/history")
+		fixture, ok := fixtures[name]
+		if !ok {
+			http.Error(w, "No such image: "+name, http.StatusNotFound)
+			return
+		}
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "history", fixture))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}))
+}
+
+var historyFixtures = map[string]string{
+	"gofn/python:latest":   "base.json",
+	"gofn/app:latest":      "multistage.json",
+	"gofn/python:squashed": "squashed.json",
+}
+
+func TestFnImageHistory(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeHistory(server, historyFixtures)
+	client := NewTestClient(server.URL(), t)
+
+	history, err := FnImageHistory(client, "gofn/app:latest")
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(history) != 4 {
+		t.Fatalf("expected 4 layers but found %d", len(history))
+	}
+	top := history[0]
+	if top.CreatedBy != `ENTRYPOINT ["/app"]` || !top.EmptyLayer || top.Comment != "buildkit.dockerfile.v0" {
+		t.Errorf("unexpected top layer %+v", top)
+	}
+	if !top.Created.Equal(time.Unix(1718100100, 0)) {
+		t.Errorf("unexpected creation time %v", top.Created)
+	}
+	if copied := history[1]; copied.ID != "<missing>" || copied.Size != 9200000 || copied.EmptyLayer {
+		t.Errorf("unexpected copied layer %+v", copied)
+	}
+
+	_, err = FnImageHistory(client, "gofn/unknown")
+	if err != ErrImageNotFound {
+		t.Errorf("expected ErrImageNotFound but found %v", err)
+	}
+}
+
+func createdBy(layers []ImageLayer) (commands []string) {
+	for _, layer := range layers {
+		commands = append(commands, layer.CreatedBy)
+	}
+	return
+}
+
+func TestFnImageDiffMultiStage(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeHistory(server, historyFixtures)
+	client := NewTestClient(server.URL(), t)
+
+	diff, err := FnImageDiff(client, "gofn/python:latest", "gofn/app:latest")
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if diff.Common != 2 {
+		t.Errorf("expected the 2 base layers in common but found %d", diff.Common)
+	}
+	onlyA, onlyB := strings.Join(createdBy(diff.OnlyA), "|"), strings.Join(createdBy(diff.OnlyB), "|")
+	if onlyA != `/bin/sh -c #(nop)  CMD ["python3"]|/bin/sh -c apk add --no-cache python3` {
+		t.Errorf("unexpected layers only in A: %s", onlyA)
+	}
+	if onlyB != `ENTRYPOINT ["/app"]|COPY /out/app /app # buildkit` {
+		t.Errorf("unexpected layers only in B: %s", onlyB)
+	}
+}
+
+func TestFnImageDiffSquashed(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeHistory(server, historyFixtures)
+	client := NewTestClient(server.URL(), t)
+
+	diff, err := FnImageDiff(client, "gofn/python:latest", "gofn/python:squashed")
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	// the squashed layers keep their commands but lose their size to the merge layer
+	if diff.Common != 2 || len(diff.OnlyA) != 2 || len(diff.OnlyB) != 3 {
+		t.Errorf("unexpected diff %d common, %d only in A, %d only in B", diff.Common, len(diff.OnlyA), len(diff.OnlyB))
+	}
+	if merge := diff.OnlyB[0]; !strings.HasPrefix(merge.Comment, "merge ") || merge.Size != 55800000 {
+		t.Errorf("expected the merge layer only in B but found %+v", merge)
+	}
+
+	if same := DiffHistory(diff.OnlyA, diff.OnlyA); len(same.OnlyA) != 0 || len(same.OnlyB) != 0 || same.Common != 2 {
+		t.Errorf("expected a history to equal itself but found %+v", same)
+	}
+}
+
+func TestImageHistoryWriteTable(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeHistory(server, historyFixtures)
+	client := NewTestClient(server.URL(), t)
+
+	history, err := FnImageHistory(client, "gofn/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = history.WriteTable(&out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected a header and 4 rows but found\n%s", out.String())
+	}
+	for _, want := range []string{"IMAGE", "CREATED BY", "SIZE", "COMMENT"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("expected the header to contain %q: %s", want, lines[0])
+		}
+	}
+	if !strings.HasPrefix(lines[1], "bbbbbbbbbbbb ") || !strings.HasPrefix(lines[2], "<missing> ") {
+		t.Errorf("expected short and missing IDs\n%s", out.String())
+	}
+	if !strings.Contains(lines[2], "COPY /out/app /app # buildkit") || !strings.Contains(lines[2], "9.2MB") {
+		t.Errorf("unexpected row %q", lines[2])
+	}
+
+	base, err := FnImageHistory(client, "gofn/python:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err = DiffHistory(base, history).WriteTable(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "-   /bin/sh -c apk add --no-cache python3") || !strings.Contains(out.String(), "+   COPY /out/app /app") {
+		t.Errorf("unexpected diff table\n%s", out.String())
+	}
+}
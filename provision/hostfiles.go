@@ -0,0 +1,276 @@
+package provision
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// CACertsPath is where InjectCACerts places the CA bundle, the path of Debian, Alpine and
+	// distroless, it is also placed at CACertsAltPath for the Red Hat family
+	CACertsPath    = "/etc/ssl/certs/ca-certificates.crt"
+	CACertsAltPath = "/etc/pki/tls/certs/ca-bundle.crt"
+
+	// ZoneinfoPath is where InjectTimezone places the timezone data
+	ZoneinfoPath = "/usr/share/zoneinfo"
+
+	// maxHostFileLinks bounds the symbolic links followed when copying a file of the helper image
+	maxHostFileLinks = 8
+)
+
+var (
+	// ErrHostFileNotFound is raised when a file injected into a container can not be found
+	ErrHostFileNotFound = errors.New("provision: host file not found")
+
+	// HostFilesImage is the helper image the CA bundle and the timezone data are copied from
+	// for remote daemons, whose file layout is unknown. It must contain them at CACertsPath
+	// and ZoneinfoPath, it is pulled when missing.
+	HostFilesImage = "gcr.io/distroless/static-debian12:latest"
+
+	// caBundlePaths are the locations of the CA bundle across distributions, the first one found is used
+	caBundlePaths = []string{
+		"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu, Alpine, Arch
+		"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora, RHEL
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS, RHEL 7
+		"/etc/ssl/ca-bundle.pem",                            // openSUSE
+		"/etc/pki/tls/cacert.pem",                           // OpenELEC
+		"/etc/ssl/cert.pem",                                 // Alpine, macOS
+	}
+
+	// zoneinfoDirs are the locations of the timezone data across distributions
+	zoneinfoDirs = []string{
+		"/usr/share/zoneinfo",
+		"/usr/lib/zoneinfo",
+		"/usr/share/lib/zoneinfo",
+	}
+)
+
+// HostFileNotFoundError is raised when the CA bundle or the timezone data is missing, Image
+// is the helper image searched for a remote daemon, the host is searched otherwise
+type HostFileNotFoundError struct {
+	File  string
+	Image string
+	Paths []string
+}
+
+func (e *HostFileNotFoundError) Error() string {
+	where := "the host"
+	if e.Image != "" {
+		where = "the image " + e.Image
+	}
+	return fmt.Sprintf("%v: %s in %s, searched %s", ErrHostFileNotFound, e.File, where, strings.Join(e.Paths, ", "))
+}
+
+// Unwrap returns ErrHostFileNotFound
+func (e *HostFileNotFoundError) Unwrap() error {
+	return ErrHostFileNotFound
+}
+
+// localDaemon reports whether the daemon of client runs on this host, so its files are the host ones
+func localDaemon(client *docker.Client, opts ContainerOptions) bool {
+	return opts.Machine == nil && isLocalEndpoint(client.Endpoint())
+}
+
+// injectsHostFiles reports whether opts needs the CA bundle or the timezone data
+func injectsHostFiles(opts ContainerOptions) bool {
+	return opts.InjectCACerts || opts.InjectTimezone != ""
+}
+
+// hostFilesEnv returns the environment of the injected files
+func hostFilesEnv(opts ContainerOptions) (env []string) {
+	if opts.InjectCACerts {
+		env = append(env, "SSL_CERT_FILE="+CACertsPath)
+	}
+	if opts.InjectTimezone != "" {
+		env = append(env, "TZ="+opts.InjectTimezone)
+	}
+	return
+}
+
+// hostFileBinds returns the read-only binds of the host CA bundle and timezone data
+func hostFileBinds(opts ContainerOptions) (binds []string, err error) {
+	if opts.InjectCACerts {
+		bundle := firstExisting(caBundlePaths, func(info os.FileInfo) bool { return !info.IsDir() })
+		if bundle == "" {
+			err = &HostFileNotFoundError{File: "CA bundle", Paths: caBundlePaths}
+			return
+		}
+		binds = append(binds, bundle+":"+CACertsPath+":ro", bundle+":"+CACertsAltPath+":ro")
+	}
+	if opts.InjectTimezone != "" {
+		dir := firstExisting(zoneinfoDirs, func(info os.FileInfo) bool { return info.IsDir() })
+		if dir == "" {
+			err = &HostFileNotFoundError{File: "zoneinfo", Paths: zoneinfoDirs}
+			return
+		}
+		zone := filepath.Join(dir, filepath.FromSlash(opts.InjectTimezone))
+		if _, statErr := os.Stat(zone); statErr != nil {
+			err = &HostFileNotFoundError{File: "timezone " + opts.InjectTimezone, Paths: []string{zone}}
+			return
+		}
+		binds = append(binds, dir+":"+ZoneinfoPath+":ro")
+	}
+	return
+}
+
+// firstExisting returns the first of paths whose file is accepted by ok
+func firstExisting(paths []string, ok func(os.FileInfo) bool) string {
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && ok(info) {
+			return p
+		}
+	}
+	return ""
+}
+
+// copyHostFiles copies the CA bundle and the timezone data of HostFilesImage into the created
+// container, for a daemon whose host is not the local one
+func copyHostFiles(ctx context.Context, client *docker.Client, containerID string, opts ContainerOptions) (err error) {
+	image := opts.hostFilesImage
+	if image == "" {
+		image = HostFilesImage
+	}
+	helper, err := createHelper(ctx, client, image)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = client.RemoveContainer(docker.RemoveContainerOptions{ID: helper, Force: true, Context: context.Background()})
+	}()
+	archive := new(bytes.Buffer)
+	tw := tar.NewWriter(archive)
+	dirs := map[string]bool{}
+	if opts.InjectCACerts {
+		var bundle []byte
+		bundle, err = helperFile(ctx, client, helper, image, CACertsPath, "CA bundle")
+		if err != nil {
+			return
+		}
+		for _, p := range []string{CACertsPath, CACertsAltPath} {
+			err = addArchiveFile(tw, dirs, p, bundle, 0644)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if opts.InjectTimezone != "" {
+		zone := path.Join(ZoneinfoPath, opts.InjectTimezone)
+		var data []byte
+		data, err = helperFile(ctx, client, helper, image, zone, "timezone "+opts.InjectTimezone)
+		if err != nil {
+			return
+		}
+		err = addArchiveFile(tw, dirs, zone, data, 0644)
+		if err != nil {
+			return
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return
+	}
+	return client.UploadToContainer(containerID, docker.UploadToContainerOptions{
+		InputStream: archive,
+		Path:        "/",
+		Context:     ctx,
+	})
+}
+
+// createHelper creates a container of the helper image to copy files from, it is never started
+func createHelper(ctx context.Context, client *docker.Client, image string) (id string, err error) {
+	create := func() (*docker.Container, error) {
+		return client.CreateContainer(docker.CreateContainerOptions{
+			Config:  &docker.Config{Image: image, Cmd: []string{"gofn-host-files"}},
+			Context: ctx,
+		})
+	}
+	helper, err := create()
+	if e, ok := err.(*docker.Error); err == docker.ErrNoSuchImage || ok && e.Status == http.StatusNotFound {
+		err = pull(ctx, client, &BuildOptions{ImageName: image, DoNotUsePrefixImageName: true})
+		if err != nil {
+			return
+		}
+		helper, err = create()
+	}
+	if err != nil {
+		return
+	}
+	id = helper.ID
+	return
+}
+
+// helperFile returns the content of the file p of the helper container of image, following its
+// symbolic links
+func helperFile(ctx context.Context, client *docker.Client, helper, image, p, file string) (data []byte, err error) {
+	for i := 0; i < maxHostFileLinks; i++ {
+		var archive bytes.Buffer
+		err = client.DownloadFromContainer(helper, docker.DownloadFromContainerOptions{
+			Path:         p,
+			OutputStream: &archive,
+			Context:      ctx,
+		})
+		if err != nil {
+			if e, ok := err.(*docker.Error); ok && e.Status == http.StatusNotFound {
+				err = &HostFileNotFoundError{File: file, Image: image, Paths: []string{p}}
+			}
+			return
+		}
+		tr := tar.NewReader(&archive)
+		var header *tar.Header
+		header, err = tr.Next()
+		if err != nil {
+			err = &HostFileNotFoundError{File: file, Image: image, Paths: []string{p}}
+			return
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			if path.IsAbs(header.Linkname) {
+				p = header.Linkname
+			} else {
+				p = path.Join(path.Dir(p), header.Linkname)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			return ioutil.ReadAll(tr)
+		default:
+			err = &HostFileNotFoundError{File: file, Image: image, Paths: []string{p}}
+			return
+		}
+	}
+	err = &HostFileNotFoundError{File: file, Image: image, Paths: []string{p}}
+	return
+}
+
+// addArchiveFile writes the file p of the given mode and its missing parent directories to tw,
+// the archive is rooted at / so the directories absent from the image are created
+func addArchiveFile(tw *tar.Writer, dirs map[string]bool, p string, data []byte, mode int64) (err error) {
+	name := strings.TrimPrefix(p, "/")
+	var parents []string
+	for dir := path.Dir(name); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+		dirs[dir] = true
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		err = tw.WriteHeader(&tar.Header{Name: parents[i] + "/", Mode: 0755, Typeflag: tar.TypeDir})
+		if err != nil {
+			return
+		}
+	}
+	err = tw.WriteHeader(&tar.Header{Name: name, Mode: mode, Size: int64(len(data)), Typeflag: tar.TypeReg})
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(tw, bytes.NewReader(data))
+	return
+}
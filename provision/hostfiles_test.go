@@ -0,0 +1,236 @@
+package provision
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeHostFiles replaces the host locations of the CA bundle and the timezone data by
+// files of dir, the returned function restores them
+func fakeHostFiles(t *testing.T, dir string) (restore func()) {
+	bundle := filepath.Join(dir, "pki", "ca-bundle.crt")
+	zoneinfo := filepath.Join(dir, "zoneinfo")
+	for _, p := range []string{bundle, filepath.Join(zoneinfo, "Europe", "Paris")} {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	caPaths, zoneDirs := caBundlePaths, zoneinfoDirs
+	caBundlePaths = []string{filepath.Join(dir, "ssl", "missing.crt"), bundle}
+	zoneinfoDirs = []string{filepath.Join(dir, "missing"), zoneinfo}
+	return func() {
+		caBundlePaths, zoneinfoDirs = caPaths, zoneDirs
+	}
+}
+
+// serveUnix serves the fake docker api on a unix socket of dir so the client sees a local daemon
+func serveUnix(t *testing.T, server *fake.DockerServer, dir string) (client *docker.Client, stop func()) {
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = http.Serve(listener, server)
+	}()
+	client, err = docker.NewClient("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() { listener.Close() }
+}
+
+func TestHostFileBinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn-hostfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer fakeHostFiles(t, dir)()
+
+	binds, err := hostFileBinds(ContainerOptions{InjectCACerts: true, InjectTimezone: "Europe/Paris"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	bundle := filepath.Join(dir, "pki", "ca-bundle.crt")
+	expected := []string{
+		bundle + ":" + CACertsPath + ":ro",
+		bundle + ":" + CACertsAltPath + ":ro",
+		filepath.Join(dir, "zoneinfo") + ":" + ZoneinfoPath + ":ro",
+	}
+	if !reflect.DeepEqual(binds, expected) {
+		t.Errorf("expected the binds %v but found %v", expected, binds)
+	}
+
+	_, err = hostFileBinds(ContainerOptions{InjectTimezone: "Mars/Olympus_Mons"})
+	if e, ok := err.(*HostFileNotFoundError); !ok || e.Unwrap() != ErrHostFileNotFound || e.Image != "" {
+		t.Errorf("expected a HostFileNotFoundError for the unknown timezone but found %v", err)
+	}
+	caBundlePaths = caBundlePaths[:1]
+	_, err = hostFileBinds(ContainerOptions{InjectCACerts: true})
+	if e, ok := err.(*HostFileNotFoundError); !ok || e.File != "CA bundle" || !strings.Contains(e.Error(), "missing.crt") {
+		t.Errorf("expected a HostFileNotFoundError listing the searched paths but found %v", err)
+	}
+}
+
+func TestFnContainerInjectHostFilesLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn-hostfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer fakeHostFiles(t, dir)()
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client, stop := serveUnix(t, server, dir)
+	defer stop()
+	image := createFakeImage(client)
+
+	opts := ContainerOptions{Image: image, Env: []string{"GO=fn"}, Volumes: []string{"/data:/data"}, InjectCACerts: true, InjectTimezone: "Europe/Paris"}
+	container, err := FnContainer(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	container, err = client.InspectContainer(container.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(dir, "pki", "ca-bundle.crt")
+	binds := []string{
+		"/data:/data",
+		bundle + ":" + CACertsPath + ":ro",
+		bundle + ":" + CACertsAltPath + ":ro",
+		filepath.Join(dir, "zoneinfo") + ":" + ZoneinfoPath + ":ro",
+	}
+	if !reflect.DeepEqual(container.HostConfig.Binds, binds) {
+		t.Errorf("expected the binds %v but found %v", binds, container.HostConfig.Binds)
+	}
+	env := []string{"GO=fn", "SSL_CERT_FILE=" + CACertsPath, "TZ=Europe/Paris"}
+	if !reflect.DeepEqual(container.Config.Env, env) {
+		t.Errorf("expected the env %v but found %v", env, container.Config.Env)
+	}
+	if len(opts.Volumes) != 1 || len(opts.Env) != 1 {
+		t.Errorf("expected the options to be left untouched but found %+v", opts)
+	}
+}
+
+// fakeArchives makes the fake docker api serve files of the helper image, given by path with
+// "->" prefixing the target of a symbolic link, and returns the files uploaded to containers
+func fakeArchives(server *fake.DockerServer, files map[string]string) (uploaded func() map[string]string) {
+	var mu sync.Mutex
+	received := map[string]string{}
+	server.CustomHandler("/containers/.*/archive", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			tr := tar.NewReader(r.Body)
+			for {
+				header, err := tr.Next()
+				if err != nil {
+					break
+				}
+				data, _ := ioutil.ReadAll(tr)
+				mu.Lock()
+				received[r.URL.Query().Get("path")+header.Name] = string(data)
+				mu.Unlock()
+			}
+			return
+		}
+		p := r.URL.Query().Get("path")
+		content, ok := files[p]
+		if !ok {
+			http.Error(w, "Could not find the file "+p, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		tw := tar.NewWriter(w)
+		name := filepath.Base(p)
+		if strings.HasPrefix(content, "->") {
+			_ = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: strings.TrimPrefix(content, "->")})
+		} else {
+			_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+			_, _ = tw.Write([]byte(content))
+		}
+		_ = tw.Close()
+	}))
+	return func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		copied := map[string]string{}
+		for name, data := range received {
+			copied[name] = data
+		}
+		return copied
+	}
+}
+
+func TestFnContainerInjectHostFilesRemote(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	uploaded := fakeArchives(server, map[string]string{
+		CACertsPath:                        "bundle",
+		ZoneinfoPath + "/Europe/Paris":     "->../Etc/Paris",
+		ZoneinfoPath + "/Etc/Paris":        "paris",
+		ZoneinfoPath + "/Europe/Lisbon":    "->/usr/share/zoneinfo/Europe/Lisbon",
+		ZoneinfoPath + "/America/Santarem": "->Santarem",
+	})
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	container, err := FnContainer(client, ContainerOptions{Image: image, InjectCACerts: true, InjectTimezone: "Europe/Paris"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	expected := map[string]string{
+		"/etc/":                              "",
+		"/etc/ssl/":                          "",
+		"/etc/ssl/certs/":                    "",
+		"/etc/ssl/certs/ca-certificates.crt": "bundle",
+		"/etc/pki/":                          "",
+		"/etc/pki/tls/":                      "",
+		"/etc/pki/tls/certs/":                "",
+		"/etc/pki/tls/certs/ca-bundle.crt":   "bundle",
+		"/usr/":                              "",
+		"/usr/share/":                        "",
+		"/usr/share/zoneinfo/":               "",
+		"/usr/share/zoneinfo/Europe/":        "",
+		"/usr/share/zoneinfo/Europe/Paris":   "paris",
+	}
+	if files := uploaded(); !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected the files of the helper image %v but found %v", expected, files)
+	}
+	container, err = client.InspectContainer(container.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(container.HostConfig.Binds) != 0 || !reflect.DeepEqual(container.Config.Env, []string{"SSL_CERT_FILE=" + CACertsPath, "TZ=Europe/Paris"}) {
+		t.Errorf("expected no bind of the remote host but found %v %v", container.HostConfig.Binds, container.Config.Env)
+	}
+	containers, _ := client.ListContainers(docker.ListContainersOptions{All: true})
+	if len(containers) != 1 {
+		t.Errorf("expected the helper container to be removed but found %d containers", len(containers))
+	}
+
+	for _, zone := range []string{"Europe/Lisbon", "America/Santarem", "Europe/Berlin"} {
+		_, err = FnContainer(client, ContainerOptions{Image: image, InjectTimezone: zone})
+		if e, ok := err.(*HostFileNotFoundError); !ok || e.Image != HostFilesImage {
+			t.Errorf("expected a HostFileNotFoundError for %s but found %v", zone, err)
+		}
+	}
+	containers, _ = client.ListContainers(docker.ListContainersOptions{All: true})
+	if len(containers) != 1 {
+		t.Errorf("expected the containers missing their files to be removed but found %d containers", len(containers))
+	}
+}
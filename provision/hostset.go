@@ -0,0 +1,43 @@
+package provision
+
+import (
+	"context"
+	"sort"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// dockerHub is the RegistryAuth key of the images of Docker Hub
+const dockerHub = "docker.io"
+
+// HostSet is a set of docker hosts addressed by name
+type HostSet map[string]*docker.Client
+
+// Names returns the names of the hosts, sorted
+func (hosts HostSet) Names() []string {
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AuthProvider returns the credentials pulling an image
+type AuthProvider interface {
+	// Auth returns the credentials for the registry of ref, the zero value pulls anonymously
+	Auth(ctx context.Context, ref string) (docker.AuthConfiguration, error)
+}
+
+// RegistryAuth is an AuthProvider keyed by registry host, e.g. gcr.io, the references
+// without a registry host are Docker Hub ones keyed by docker.io
+type RegistryAuth map[string]docker.AuthConfiguration
+
+// Auth implements AuthProvider
+func (a RegistryAuth) Auth(ctx context.Context, ref string) (docker.AuthConfiguration, error) {
+	host, _, _ := registryRef(ref)
+	if host == defaultRegistry {
+		host = dockerHub
+	}
+	return a[host], nil
+}
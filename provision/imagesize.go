@@ -0,0 +1,119 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	units "github.com/docker/go-units"
+)
+
+var (
+	// ErrImageTooLargeForHost is raised when the image to pull does not fit in the daemon disk
+	ErrImageTooLargeForHost = errors.New("provision: image too large for host")
+)
+
+// DefaultSizeMargin is the disk space kept free after a pull when Runner.SizeMargin is zero
+const DefaultSizeMargin int64 = 1 << 30
+
+// ImageSizeError reports an image that does not fit in the daemon disk
+type ImageSizeError struct {
+	Image     string
+	Size      int64
+	Layers    int
+	Available int64
+	Margin    int64
+}
+
+func (e *ImageSizeError) Error() string {
+	return fmt.Sprintf("%v: %s needs %s in %d layers plus a margin of %s, host has %s available",
+		ErrImageTooLargeForHost, e.Image,
+		units.HumanSize(float64(e.Size)), e.Layers,
+		units.HumanSize(float64(e.Margin)),
+		units.HumanSize(float64(e.Available)))
+}
+
+// Unwrap returns ErrImageTooLargeForHost
+func (e *ImageSizeError) Unwrap() error {
+	return ErrImageTooLargeForHost
+}
+
+// willPull reports whether building opts falls back to pulling the image
+func willPull(opts *BuildOptions) bool {
+	if opts.ForcePull && opts.ContextDir == "" && opts.RemoteURI == "" {
+		return true
+	}
+	if opts.RemoteURI != "" || !opts.FallbackToPull {
+		return false
+	}
+	dockerfile := opts.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	_, err := os.Stat(filepath.Join(opts.ContextDir, dockerfile))
+	return os.IsNotExist(err)
+}
+
+// checkImageSize fails with an ImageSizeError when the image described by opts can not
+// be pulled into the daemon disk, the check is skipped when the available space or the
+// image size are unknown
+func (r *Runner) checkImageSize(ctx context.Context, opts *BuildOptions) (err error) {
+	if r.SkipSizeCheck {
+		return
+	}
+	caps, err := hostCapabilities(ctx, r.Client)
+	if err != nil {
+		return
+	}
+	available, known := r.availableDisk(caps)
+	if !known {
+		return
+	}
+	image := opts.GetImageName()
+	target := opts.Platform
+	if target == "" {
+		target = caps.Platform()
+	}
+	credentials, err := registryAuth(ctx, opts)
+	if err != nil {
+		return
+	}
+	size, layers, err := manifestSize(ctx, image, target, credentials)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+		r.emit(EventWarning, "", fmt.Sprintf("skipping size check of %s: %v", image, err))
+		err = nil
+		return
+	}
+	margin := r.SizeMargin
+	if margin == 0 {
+		margin = DefaultSizeMargin
+	}
+	if size+margin > available {
+		err = &ImageSizeError{
+			Image:     image,
+			Size:      size,
+			Layers:    layers,
+			Available: available,
+			Margin:    margin,
+		}
+	}
+	return
+}
+
+// availableDisk returns the free space of the daemon storage, devicemapper reports it
+// directly, otherwise it is derived from HostDiskSize and the space used by the layers
+func (r *Runner) availableDisk(caps Capabilities) (available int64, known bool) {
+	if caps.AvailableDisk > 0 {
+		return caps.AvailableDisk, true
+	}
+	if r.HostDiskSize <= 0 || !caps.LayersSizeKnown {
+		return
+	}
+	return r.HostDiskSize - caps.LayersSize, true
+}
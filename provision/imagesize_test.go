@@ -0,0 +1,195 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+const gb = int64(1000 * 1000 * 1000)
+
+// fakeRegistry serves the given manifests by repository:reference, when token is set
+// the manifests require the bearer token flow
+func fakeRegistry(t *testing.T, token string, manifests map[string]manifest) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			_ = json.NewEncoder(w).Encode(map[string]string{"token": token})
+			return
+		}
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/", 2)
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		m, ok := manifests[parts[0]+":"+parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", m.MediaType)
+		_ = json.NewEncoder(w).Encode(m)
+	}))
+	return server
+}
+
+func imageManifest(layerSizes ...int64) manifest {
+	m := manifest{MediaType: mediaTypeManifest, Config: descriptor{Size: 1000}}
+	for _, size := range layerSizes {
+		m.Layers = append(m.Layers, descriptor{Size: size})
+	}
+	return m
+}
+
+// fakeDiskUsage replaces the /system/df answer of the fake docker api
+func fakeDiskUsage(server *fake.DockerServer, layersSize int64) {
+	server.CustomHandler("/system/df", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"LayersSize": layersSize})
+	}))
+}
+
+func TestRegistryRef(t *testing.T) {
+	tests := []struct {
+		image, host, repo, ref string
+	}{
+		{"python", defaultRegistry, "library/python", "latest"},
+		{"gofn/python:3", defaultRegistry, "gofn/python", "3"},
+		{"localhost:5000/app", "localhost:5000", "app", "latest"},
+		{"registry.example.com/team/app:v1", "registry.example.com", "team/app", "v1"},
+		{"app@sha256:abc", defaultRegistry, "library/app", "sha256:abc"},
+		{"docker.io/python:3", defaultRegistry, "library/python", "3"},
+		{"index.docker.io/gofn/python", defaultRegistry, "gofn/python", "latest"},
+		{"docker.io/library/python", defaultRegistry, "library/python", "latest"},
+	}
+	for _, tt := range tests {
+		host, repo, ref := registryRef(tt.image)
+		if host != tt.host || repo != tt.repo || ref != tt.ref {
+			t.Errorf("registryRef(%q) = %q, %q, %q", tt.image, host, repo, ref)
+		}
+	}
+}
+
+func TestRunnerCheckImageSize(t *testing.T) {
+	registry := fakeRegistry(t, "", map[string]manifest{
+		"small:latest": imageManifest(gb/2, gb/2),
+		"large:latest": imageManifest(3*gb, 2*gb, gb),
+		"multi:latest": {
+			MediaType: mediaTypeManifestList,
+			Manifests: []descriptor{
+				{Digest: "arm", Platform: &platform{Architecture: "arm64", OS: "linux"}},
+				{Digest: "amd", Platform: &platform{Architecture: "amd64", OS: "linux"}},
+			},
+		},
+		"multi:arm": imageManifest(gb),
+		"multi:amd": imageManifest(8 * gb),
+	})
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	tests := []struct {
+		name          string
+		image         string
+		info          map[string]interface{}
+		layersSize    int64
+		hostDiskSize  int64
+		skipSizeCheck bool
+		wantErr       bool
+	}{
+		{name: "fits devicemapper", image: "small", info: map[string]interface{}{"DriverStatus": [][2]string{{"Data Space Available", "5 GB"}}}},
+		{name: "too large for devicemapper", image: "large", info: map[string]interface{}{"DriverStatus": [][2]string{{"Data Space Available", "5 GB"}}}, wantErr: true},
+		{name: "fits host disk", image: "large", hostDiskSize: 25 * gb, layersSize: 10 * gb},
+		{name: "host disk almost full", image: "large", hostDiskSize: 25 * gb, layersSize: 18 * gb, wantErr: true},
+		{name: "multi platform", image: "multi", hostDiskSize: 25 * gb, layersSize: 18 * gb, wantErr: true},
+		{name: "multi platform arm64 host", image: "multi", info: map[string]interface{}{"OSType": "linux", "Architecture": "aarch64"}, hostDiskSize: 25 * gb, layersSize: 18 * gb},
+		{name: "unknown free space", image: "large"},
+		{name: "unsupported registry", image: "missing", hostDiskSize: 25 * gb, layersSize: 24 * gb},
+		{name: "skipped", image: "large", hostDiskSize: 25 * gb, layersSize: 24 * gb, skipSizeCheck: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			if tt.info != nil {
+				fakeInfo(server, tt.info)
+			}
+			fakeDiskUsage(server, tt.layersSize)
+
+			r := NewRunner(NewTestClient(server.URL(), t))
+			r.HostDiskSize = tt.hostDiskSize
+			r.SkipSizeCheck = tt.skipSizeCheck
+			opts := &BuildOptions{ImageName: host + "/" + tt.image, DoNotUsePrefixImageName: true}
+			err := r.checkImageSize(context.Background(), opts)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Expected no errors but %q found", err)
+				}
+				return
+			}
+			sizeErr, ok := err.(*ImageSizeError)
+			if !ok {
+				t.Fatalf("Expected ImageSizeError but %#v found", err)
+			}
+			if sizeErr.Unwrap() != ErrImageTooLargeForHost {
+				t.Errorf("Expected ErrImageTooLargeForHost but %q found", sizeErr.Unwrap())
+			}
+			if sizeErr.Size == 0 || sizeErr.Available == 0 || sizeErr.Layers == 0 {
+				t.Errorf("Expected size, layers and available space to be reported, got %+v", sizeErr)
+			}
+		})
+	}
+}
+
+func TestRunnerCheckImageSizeBearerToken(t *testing.T) {
+	registry := fakeRegistry(t, "s3cr3t", map[string]manifest{
+		"large:latest": imageManifest(3*gb, 2*gb, gb),
+	})
+	defer registry.Close()
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeDiskUsage(server, 20*gb)
+
+	r := NewRunner(NewTestClient(server.URL(), t))
+	r.HostDiskSize = 25 * gb
+	opts := &BuildOptions{ImageName: strings.TrimPrefix(registry.URL, "http://") + "/large", DoNotUsePrefixImageName: true}
+	err := r.checkImageSize(context.Background(), opts)
+	if _, ok := err.(*ImageSizeError); !ok {
+		t.Fatalf("Expected ImageSizeError but %#v found", err)
+	}
+}
+
+func TestRunnerRunImageTooLarge(t *testing.T) {
+	registry := fakeRegistry(t, "", map[string]manifest{
+		"large:latest": imageManifest(3*gb, 2*gb, gb),
+	})
+	defer registry.Close()
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeInfo(server, map[string]interface{}{"DriverStatus": [][2]string{{"Data Space Available", "2 GB"}}})
+	pulled := false
+	server.CustomHandler("/images/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pulled = true
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+
+	r := NewRunner(NewTestClient(server.URL(), t))
+	opts := &BuildOptions{ImageName: strings.TrimPrefix(registry.URL, "http://") + "/large", DoNotUsePrefixImageName: true, ForcePull: true}
+	_, err := r.Run(context.Background(), opts, ContainerOptions{})
+	if _, ok := err.(*ImageSizeError); !ok {
+		t.Fatalf("Expected ImageSizeError but %#v found", err)
+	}
+	if pulled {
+		t.Error("Expected the image not to be pulled")
+	}
+}
@@ -0,0 +1,190 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// snapshot returns a copy of v sharing none of its slices and maps, the pointers and the
+// interfaces, e.g. Machine or OutputStream, are shared since the options only reference them
+func snapshot(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Struct:
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if copied.Field(i).CanSet() {
+				copied.Field(i).Set(snapshot(v.Field(i)))
+			}
+		}
+		return copied
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(snapshot(v.Index(i)))
+		}
+		return copied
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			copied.SetMapIndex(key, snapshot(v.MapIndex(key)))
+		}
+		return copied
+	}
+	return v
+}
+
+// fullBuildOptions returns BuildOptions with every field a build reads set
+func fullBuildOptions() *BuildOptions {
+	return &BuildOptions{
+		ContextDir:           "./testing_data",
+		Dockerfile:           "Dockerfile",
+		ImageName:            "test",
+		StdIN:                "input",
+		Auth:                 docker.AuthConfiguration{Username: "gofn", Password: "s3cr3t", Email: "gofn@example.com", ServerAddress: "registry.example.com"},
+		AuthConfigs:          RegistryAuth{"gcr.io": {Username: "_json_key", Password: "key"}},
+		AuthFromDockerConfig: true,
+		FallbackToPull:       true,
+		BuildArgs:            map[string]string{"VERSION": "1.2"},
+		NoCache:              true,
+		CacheFrom:            []string{"gofn/test:cache"},
+		OutputStream:         new(bytes.Buffer),
+		Tags:                 []string{"gofn/test:v1"},
+	}
+}
+
+// sparseBuildOptions returns BuildOptions relying on the defaults, the credentials without a
+// server address nor an identity token
+func sparseBuildOptions() *BuildOptions {
+	return &BuildOptions{
+		ImageName: "test",
+		Auth:      docker.AuthConfiguration{Username: "gofn", Password: "s3cr3t"},
+	}
+}
+
+// fullContainerOptions returns ContainerOptions with the fields a fake daemon can honor set
+func fullContainerOptions() ContainerOptions {
+	return ContainerOptions{
+		Cmd:              []string{"sh", "-c", "echo ok"},
+		Image:            "gofn/test",
+		Env:              []string{"A=1"},
+		EnvTemplate:      map[string]string{"INVOCATION": "{{.InvocationID}}", "VAR": "{{.Vars.name}}"},
+		TemplateVars:     map[string]string{"name": "value"},
+		StrictTemplate:   true,
+		RunAsNonRoot:     true,
+		NonRootUser:      "1000:1000",
+		Egress:           EgressPolicy{Mode: EgressNone, Allow: []string{"example.com"}},
+		ExclusiveKey:     "immutable",
+		ReadOnlyRootfs:   true,
+		SeccompAllowlist: []string{"read", "write"},
+		ExecutionTimeout: 10 * time.Second,
+	}
+}
+
+func TestOptionsNotModified(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "ok", "")
+	server.CustomHandler("/auth", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"Status":"Login Succeeded","IdentityToken":"id-token"}`))
+	}))
+	client := NewTestClient(server.URL(), t)
+	r := NewRunner(client)
+	ctx := context.Background()
+
+	calls := []struct {
+		name string
+		call func(buildOpts *BuildOptions, containerOpts ContainerOptions)
+	}{
+		{"FnImageBuild", func(buildOpts *BuildOptions, _ ContainerOptions) {
+			_, _, _ = FnImageBuild(client, buildOpts)
+		}},
+		{"FnImageBuildReport", func(buildOpts *BuildOptions, _ ContainerOptions) {
+			_, _ = FnImageBuildReport(client, buildOpts)
+		}},
+		{"FnPull", func(buildOpts *BuildOptions, _ ContainerOptions) {
+			_ = FnPull(client, buildOpts)
+		}},
+		{"FnPullWithProgress", func(buildOpts *BuildOptions, _ ContainerOptions) {
+			_, _ = FnPullWithProgress(client, buildOpts, nil)
+		}},
+		{"FnContainer", func(_ *BuildOptions, containerOpts ContainerOptions) {
+			_, _ = FnContainer(client, containerOpts)
+		}},
+		{"Runner.FnContainer", func(_ *BuildOptions, containerOpts ContainerOptions) {
+			_, _ = r.FnContainer(containerOpts)
+		}},
+		{"Runner.Run", func(buildOpts *BuildOptions, containerOpts ContainerOptions) {
+			_, _ = r.Run(ctx, buildOpts, containerOpts)
+		}},
+		{"Runner.Prepare", func(buildOpts *BuildOptions, containerOpts ContainerOptions) {
+			session, err := r.Prepare(ctx, buildOpts, containerOpts, RemoveAlways)
+			if err == nil {
+				_, _ = r.Execute(ctx, session, nil)
+			}
+		}},
+		{"ValidateBuildOptions", func(buildOpts *BuildOptions, _ ContainerOptions) {
+			_ = ValidateBuildOptions(*buildOpts)
+		}},
+		{"ValidateContainerOptions", func(_ *BuildOptions, containerOpts ContainerOptions) {
+			_ = ValidateContainerOptions(containerOpts)
+		}},
+	}
+	fixtures := []struct {
+		name          string
+		buildOpts     *BuildOptions
+		containerOpts ContainerOptions
+	}{
+		{"full", fullBuildOptions(), fullContainerOptions()},
+		{"sparse", sparseBuildOptions(), ContainerOptions{Image: "gofn/test"}},
+	}
+	for _, fixture := range fixtures {
+		for _, c := range calls {
+			buildOpts := snapshot(reflect.ValueOf(*fixture.buildOpts)).Interface().(BuildOptions)
+			containerOpts := snapshot(reflect.ValueOf(fixture.containerOpts)).Interface().(ContainerOptions)
+			c.call(fixture.buildOpts, fixture.containerOpts)
+			if !reflect.DeepEqual(*fixture.buildOpts, buildOpts) {
+				t.Errorf("%s %s: the build options changed from %+v to %+v", fixture.name, c.name, buildOpts, *fixture.buildOpts)
+			}
+			if !reflect.DeepEqual(fixture.containerOpts, containerOpts) {
+				t.Errorf("%s %s: the container options changed from %+v to %+v", fixture.name, c.name, containerOpts, fixture.containerOpts)
+			}
+		}
+	}
+}
+
+func TestFnImageBuildReportAuth(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	server.CustomHandler("/auth", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"Status":"Login Succeeded","IdentityToken":"id-token"}`))
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	opts := testBuildOptions()
+	opts.Auth = docker.AuthConfiguration{Username: "gofn", Password: "s3cr3t"}
+	report, err := FnImageBuildReport(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := docker.AuthConfiguration{Username: "gofn", Password: "s3cr3t", ServerAddress: "https://index.docker.io/v1/", IdentityToken: "id-token"}
+	if report.Auth != want {
+		t.Errorf("expected the checked credentials %+v but found %+v", want, report.Auth)
+	}
+	if opts.Auth.IdentityToken != "" || opts.Auth.ServerAddress != "" {
+		t.Errorf("expected the credentials of the options to be left as is but found %+v", opts.Auth)
+	}
+}
@@ -0,0 +1,160 @@
+package provision
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// RunState is the stage reached by the container of a run, see RunResult.State
+type RunState string
+
+const (
+	// RunCreated is a run whose container is created and not started
+	RunCreated RunState = "created"
+	// RunStarted is a run whose container is started
+	RunStarted RunState = "started"
+	// RunExited is a run whose container exited, its exit code is known
+	RunExited RunState = "exited"
+	// RunCollected is a run whose output collection completed or timed out
+	RunCollected RunState = "collected"
+	// RunRemoved is a run whose container is removed
+	RunRemoved RunState = "removed"
+)
+
+// runStates orders the states, a run only moves forward
+var runStates = map[RunState]int{RunCreated: 1, RunStarted: 2, RunExited: 3, RunCollected: 4, RunRemoved: 5}
+
+// RunTransition is a state reached by a run and when it was reached
+type RunTransition struct {
+	State RunState
+	At    time.Time
+}
+
+// runLifecycle is the state machine of the container of a run. It orders the cleanup of a
+// run whatever the path triggering it: the output collection, attach drain or logs fetch,
+// completes or times out before the container removal is initiated, and once collected the
+// output is sealed so a late frame of the daemon is dropped instead of written to the result.
+type runLifecycle struct {
+	mu          sync.Mutex
+	state       RunState
+	transitions []RunTransition
+	collecting  bool
+	// idle is closed when the collection in progress ends
+	idle chan struct{}
+	// writing holds a token while a frame is written, so sealing waits for it
+	writing chan struct{}
+	sealed  bool
+}
+
+func newRunLifecycle() *runLifecycle {
+	l := &runLifecycle{writing: make(chan struct{}, 1)}
+	l.advance(RunCreated)
+	return l
+}
+
+// advance moves the run to state, a state behind the current one is ignored,
+// e.g. the exit of a container seen once it was removed
+func (l *runLifecycle) advance(state RunState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advanceLocked(state)
+}
+
+func (l *runLifecycle) advanceLocked(state RunState) {
+	if runStates[state] <= runStates[l.state] {
+		return
+	}
+	l.state = state
+	l.transitions = append(l.transitions, RunTransition{State: state, At: time.Now()})
+}
+
+// collect runs the output collection fn, the container is not removed until it returned.
+// The run is collected afterwards even when fn failed or timed out: its partial output is
+// kept and the frames still in flight, e.g. of an attach stream that was not drained, are
+// dropped. A frame being written is waited for, bounded by ctx.
+func (l *runLifecycle) collect(ctx context.Context, fn func() error) error {
+	l.mu.Lock()
+	l.collecting = true
+	idle := make(chan struct{})
+	l.idle = idle
+	l.mu.Unlock()
+	defer func() {
+		l.seal(ctx)
+		l.mu.Lock()
+		l.collecting = false
+		l.advanceLocked(RunCollected)
+		close(idle)
+		l.mu.Unlock()
+	}()
+	return fn()
+}
+
+// seal drops the frames written from now on, once the frame being written, if any, is copied
+func (l *runLifecycle) seal(ctx context.Context) {
+	select {
+	case l.writing <- struct{}{}:
+		defer func() { <-l.writing }()
+	case <-ctx.Done():
+		// a writer that is not read, e.g. a pipe, must not block the cleanup
+	}
+	l.mu.Lock()
+	l.sealed = true
+	l.mu.Unlock()
+}
+
+// remove removes the container once no collection is in progress, a container already
+// removed, e.g. by the daemon when autoRemove is set, is reported removed without error
+func (l *runLifecycle) remove(client *docker.Client, containerID string, autoRemove bool) (err error) {
+	l.mu.Lock()
+	for l.collecting {
+		idle := l.idle
+		l.mu.Unlock()
+		<-idle
+		l.mu.Lock()
+	}
+	l.mu.Unlock()
+	err = FnRemove(client, containerID)
+	if autoRemove && isNoSuchContainer(err) {
+		err = nil
+	}
+	if err == nil {
+		l.advance(RunRemoved)
+	}
+	return
+}
+
+// writer returns a writer copying the output to w until the run is collected
+func (l *runLifecycle) writer(w io.Writer) io.Writer {
+	return &lifecycleWriter{lifecycle: l, w: w}
+}
+
+// record copies the state of the run to result
+func (l *runLifecycle) record(result *RunResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result.State = l.state
+	result.Transitions = append([]RunTransition(nil), l.transitions...)
+}
+
+type lifecycleWriter struct {
+	lifecycle *runLifecycle
+	w         io.Writer
+}
+
+func (lw *lifecycleWriter) Write(p []byte) (n int, err error) {
+	l := lw.lifecycle
+	l.writing <- struct{}{}
+	defer func() { <-l.writing }()
+	l.mu.Lock()
+	sealed := l.sealed
+	l.mu.Unlock()
+	if sealed {
+		// the collection is over, the frame would race with the reader of the result
+		return len(p), nil
+	}
+	return lw.w.Write(p)
+}
@@ -0,0 +1,221 @@
+package provision
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// lifecycleDelays are the delays the fake daemon injects before each transition of a run
+type lifecycleDelays struct {
+	create, start, exit, logs, drain, remove time.Duration
+}
+
+// timeline records the order in which the fake daemon served the requests of a run
+type timeline struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (tl *timeline) add(event string) {
+	tl.mu.Lock()
+	tl.events = append(tl.events, event)
+	tl.mu.Unlock()
+}
+
+func (tl *timeline) index(event string) int {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	for i, e := range tl.events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+// fakeLifecycle serves the containers of the fake docker api with delays: the logs are answered
+// once delays.logs passed, the attach stream sends "early" right away and "late" once the
+// container exited and delays.drain passed
+func fakeLifecycle(server *fake.DockerServer, delays lifecycleDelays) *timeline {
+	tl := &timeline{}
+	exited := make(chan struct{})
+	var exitOnce sync.Once
+	server.CustomHandler("/containers/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		switch {
+		case strings.HasSuffix(path, "/create"):
+			time.Sleep(delays.create)
+		case strings.HasSuffix(path, "/start"):
+			time.Sleep(delays.start)
+		case strings.HasSuffix(path, "/wait"):
+			time.Sleep(delays.exit)
+			if m := containerPathRegexp.FindStringSubmatch(path); m != nil {
+				_ = server.MutateContainer(m[1], docker.State{ExitCode: 0, StartedAt: time.Now()})
+			}
+			exitOnce.Do(func() { close(exited) })
+		case strings.HasSuffix(path, "/logs"):
+			time.Sleep(delays.logs)
+			w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+			writeFrame(w, 1, "out")
+			tl.add("logs")
+			return
+		case strings.HasSuffix(path, "/attach"):
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n"))
+			encodeFrames(conn, []frame{{StreamStdout, "early "}})
+			<-exited
+			time.Sleep(delays.drain)
+			encodeFrames(conn, []frame{{StreamStdout, "late"}})
+			tl.add("drained")
+			return
+		case r.Method == http.MethodDelete:
+			tl.add("remove")
+			time.Sleep(delays.remove)
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	return tl
+}
+
+func TestRunnerRunLifecycleDelays(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	tests := []struct {
+		name       string
+		strategy   OutputStrategy
+		delays     lifecycleDelays
+		wantStdout string
+		collected  string
+	}{
+		{"slow create", OutputLogs, lifecycleDelays{create: delay}, "out", "logs"},
+		{"slow start", OutputLogs, lifecycleDelays{start: delay}, "out", "logs"},
+		{"slow exit", OutputLogs, lifecycleDelays{exit: delay}, "out", "logs"},
+		{"slow logs", OutputLogs, lifecycleDelays{logs: delay}, "out", "logs"},
+		{"slow removal", OutputLogs, lifecycleDelays{remove: delay}, "out", "logs"},
+		{"slow attached exit", OutputAttach, lifecycleDelays{exit: delay}, "early late", "drained"},
+		{"slow drain", OutputAttach, lifecycleDelays{drain: delay}, "early late", "drained"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			client := NewTestClient(server.URL(), t)
+			if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+				t.Fatal(err)
+			}
+			tl := fakeLifecycle(server, tt.delays)
+
+			r := NewRunner(client)
+			r.OutputStrategy = tt.strategy
+			result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if result.Stdout.String() != tt.wantStdout {
+				t.Errorf("expected stdout %q but found %q", tt.wantStdout, result.Stdout)
+			}
+			collected, removed := tl.index(tt.collected), tl.index("remove")
+			if collected == -1 || removed < collected {
+				t.Errorf("expected the removal after the collection but found %v", tl.events)
+			}
+			var states []RunState
+			for _, transition := range result.Transitions {
+				states = append(states, transition.State)
+			}
+			want := []RunState{RunCreated, RunStarted, RunExited, RunCollected, RunRemoved}
+			if result.State != RunRemoved || !reflect.DeepEqual(states, want) {
+				t.Errorf("expected the transitions %v but found %v, %s", want, states, result.State)
+			}
+		})
+	}
+}
+
+func TestRunnerRunLifecycleCollectionTimeout(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+	const drain = 300 * time.Millisecond
+	tl := fakeLifecycle(server, lifecycleDelays{drain: drain})
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputAttach
+	r.Timeouts.LogCollection = 20 * time.Millisecond
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if timeoutErr, ok := err.(*PhaseTimeoutError); !ok || timeoutErr.Phase != PhaseLogCollection {
+		t.Fatalf("expected the log collection to time out but found %v", err)
+	}
+	if result.State != RunRemoved || tl.index("remove") == -1 {
+		t.Errorf("expected the container to be removed once the collection timed out but found %s", result.State)
+	}
+
+	// the frame sent after the collection timed out is dropped instead of written to the result
+	time.Sleep(drain + 100*time.Millisecond)
+	if result.Stdout.String() != "early " {
+		t.Errorf("expected the partial output but found %q", result.Stdout)
+	}
+}
+
+func TestRunLifecycleRemovalWaitsForCollection(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+	tl := fakeLifecycle(server, lifecycleDelays{})
+
+	life := newRunLifecycle()
+	life.advance(RunStarted)
+	collecting := make(chan struct{})
+	release := make(chan struct{})
+	collected := make(chan error, 1)
+	go func() {
+		collected <- life.collect(context.Background(), func() error {
+			close(collecting)
+			<-release
+			tl.add("collected")
+			return nil
+		})
+	}()
+	<-collecting
+	removed := make(chan error, 1)
+	go func() {
+		removed <- life.remove(client, container.ID, false)
+	}()
+
+	select {
+	case err := <-removed:
+		t.Fatalf("expected the removal to wait for the collection but found %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-collected; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-removed; err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if tl.index("remove") < tl.index("collected") {
+		t.Errorf("expected the removal after the collection but found %v", tl.events)
+	}
+
+	// a late exit does not move the removed run back
+	life.advance(RunExited)
+	var result RunResult
+	life.record(&result)
+	if result.State != RunRemoved || len(result.Transitions) != 4 {
+		t.Errorf("unexpected transitions %+v", result.Transitions)
+	}
+}
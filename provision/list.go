@@ -0,0 +1,176 @@
+package provision
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	// ErrInvalidCursor is raised when a page cursor is malformed or was made for another order
+	ErrInvalidCursor = errors.New("provision: invalid page cursor")
+)
+
+// ContainerOrder is the order of the listed containers, the ties are broken by ID so the
+// order is the same at each call
+type ContainerOrder string
+
+const (
+	// OrderCreatedDesc lists the newest containers first, it is the default order
+	OrderCreatedDesc ContainerOrder = "created-desc"
+	// OrderName lists the containers by name
+	OrderName ContainerOrder = "name"
+	// OrderStatus lists the running containers first, then the paused, restarting, created,
+	// exited and dead ones, the newest first for each status
+	OrderStatus ContainerOrder = "status"
+)
+
+// ListOptions are the options of FnListContainersWithOptions and FnListContainersPage
+type ListOptions struct {
+	// Order is the order of the containers, OrderCreatedDesc when empty
+	Order ContainerOrder
+}
+
+// statusRanks orders the states of the containers for OrderStatus, unknown states come last
+var statusRanks = map[string]int{"running": 0, "paused": 1, "restarting": 2, "created": 3, "exited": 4, "dead": 5}
+
+// containerKey is the position of a container in the orders, it is what a cursor records
+type containerKey struct {
+	Order   ContainerOrder `json:"o"`
+	Created int64          `json:"c"`
+	Name    string         `json:"n,omitempty"`
+	Rank    int            `json:"r,omitempty"`
+	ID      string         `json:"i"`
+}
+
+func keyOf(order ContainerOrder, container docker.APIContainers) containerKey {
+	key := containerKey{Order: order, Created: container.Created, ID: container.ID}
+	if len(container.Names) > 0 {
+		key.Name = strings.TrimPrefix(container.Names[0], "/")
+	}
+	rank, ok := statusRanks[container.State]
+	if !ok {
+		rank = len(statusRanks)
+	}
+	key.Rank = rank
+	return key
+}
+
+// compare returns a negative number when a comes before b in their order, a positive one
+// when it comes after and zero for the same container
+func (a containerKey) compare(b containerKey) int {
+	switch a.Order {
+	case OrderName:
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+	case OrderStatus:
+		if a.Rank != b.Rank {
+			return a.Rank - b.Rank
+		}
+	}
+	if a.Created != b.Created {
+		if a.Created > b.Created {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+func (opts ListOptions) order() ContainerOrder {
+	if opts.Order == "" {
+		return OrderCreatedDesc
+	}
+	return opts.Order
+}
+
+// SortContainers sorts containers in order, OrderCreatedDesc when empty
+func SortContainers(containers []docker.APIContainers, order ContainerOrder) {
+	if order == "" {
+		order = OrderCreatedDesc
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return keyOf(order, containers[i]).compare(keyOf(order, containers[j])) < 0
+	})
+}
+
+// FnListContainersWithOptions lists the containers created by the gofn like FnListContainers
+// in the order of opts
+func FnListContainersWithOptions(client *docker.Client, opts ListOptions) (containers []docker.APIContainers, err error) {
+	containers, err = FnListContainers(client)
+	if err != nil {
+		return
+	}
+	SortContainers(containers, opts.order())
+	return
+}
+
+// FnListContainersPage returns up to limit containers created by the gofn in the order of opts,
+// starting after cursor, the first page for an empty cursor. next is the cursor of the next page,
+// empty after the last one. A cursor records the position of the last container of its page
+// rather than its index, so the containers created or removed between the calls do not shift
+// the pages and a removed last container resumes at the container that followed it.
+func FnListContainersPage(client *docker.Client, opts ListOptions, cursor string, limit int) (page []docker.APIContainers, next string, err error) {
+	containers, err := FnListContainersWithOptions(client, opts)
+	if err != nil {
+		return
+	}
+	return listPage(containers, opts.order(), cursor, limit)
+}
+
+// listPage pages the containers sorted in order
+func listPage(containers []docker.APIContainers, order ContainerOrder, cursor string, limit int) (page []docker.APIContainers, next string, err error) {
+	if limit <= 0 {
+		err = fmt.Errorf("provision: the page limit must be positive, found %d", limit)
+		return
+	}
+	start := 0
+	if cursor != "" {
+		var anchor containerKey
+		anchor, err = decodeCursor(cursor)
+		if err != nil {
+			return
+		}
+		if anchor.Order != order {
+			err = ErrInvalidCursor
+			return
+		}
+		start = sort.Search(len(containers), func(i int) bool {
+			return keyOf(order, containers[i]).compare(anchor) > 0
+		})
+	}
+	end := start + limit
+	if end >= len(containers) {
+		page = containers[start:]
+		return
+	}
+	page = containers[start:end]
+	next, err = encodeCursor(keyOf(order, page[len(page)-1]))
+	return
+}
+
+func encodeCursor(key containerKey) (cursor string, err error) {
+	raw, err := json.Marshal(key)
+	if err != nil {
+		return
+	}
+	cursor = base64.RawURLEncoding.EncodeToString(raw)
+	return
+}
+
+func decodeCursor(cursor string) (key containerKey, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(raw, &key)
+	}
+	if err != nil {
+		err = ErrInvalidCursor
+	}
+	return
+}
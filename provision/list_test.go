@@ -0,0 +1,149 @@
+package provision
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func listFixture() []docker.APIContainers {
+	return []docker.APIContainers{
+		{ID: "a", Names: []string{"/gofn-c"}, Created: 100, State: "exited"},
+		{ID: "b", Names: []string{"/gofn-a"}, Created: 300, State: "running"},
+		{ID: "c", Names: []string{"/gofn-b"}, Created: 200, State: "running"},
+		{ID: "d", Names: []string{"/gofn-e"}, Created: 200, State: "created"},
+		{ID: "e", Names: []string{"/gofn-d"}, Created: 400, State: "dead"},
+	}
+}
+
+func containerIDs(containers []docker.APIContainers) (ids []string) {
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	return
+}
+
+func TestSortContainers(t *testing.T) {
+	tests := []struct {
+		order ContainerOrder
+		want  []string
+	}{
+		{"", []string{"e", "b", "c", "d", "a"}},
+		{OrderCreatedDesc, []string{"e", "b", "c", "d", "a"}},
+		{OrderName, []string{"b", "c", "a", "e", "d"}},
+		{OrderStatus, []string{"b", "c", "d", "a", "e"}},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 10; i++ {
+			containers := listFixture()
+			rand.Shuffle(len(containers), func(i, j int) { containers[i], containers[j] = containers[j], containers[i] })
+			SortContainers(containers, tt.order)
+			if got := containerIDs(containers); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("order %q: expected %v whatever the daemon order but found %v", tt.order, tt.want, got)
+			}
+		}
+	}
+}
+
+func TestListPage(t *testing.T) {
+	containers := listFixture()
+	SortContainers(containers, OrderCreatedDesc)
+
+	var pages [][]string
+	cursor := ""
+	for {
+		page, next, err := listPage(containers, OrderCreatedDesc, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, containerIDs(page))
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if want := [][]string{{"e", "b"}, {"c", "d"}, {"a"}}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("expected the pages %v but found %v", want, pages)
+	}
+
+	// a page ending with the last container has no next page
+	page, next, err := listPage(containers, OrderCreatedDesc, "", 5)
+	if err != nil || len(page) != 5 || next != "" {
+		t.Errorf("expected a single page but found %v, %q, %v", containerIDs(page), next, err)
+	}
+
+	if _, _, err = listPage(containers, OrderCreatedDesc, "", 0); err == nil {
+		t.Error("expected a zero limit to be refused")
+	}
+	if _, _, err = listPage(containers, OrderCreatedDesc, "not a cursor", 2); err != ErrInvalidCursor {
+		t.Errorf("expected ErrInvalidCursor but found %v", err)
+	}
+	_, next, _ = listPage(containers, OrderCreatedDesc, "", 2)
+	if _, _, err = listPage(containers, OrderName, next, 2); err != ErrInvalidCursor {
+		t.Errorf("expected the cursor of another order to be refused but found %v", err)
+	}
+}
+
+func TestListPageDeletedAnchor(t *testing.T) {
+	containers := listFixture()
+	SortContainers(containers, OrderName)
+	_, next, err := listPage(containers, OrderName, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the anchor c is removed and a container sorting before it is created between the calls
+	var changed []docker.APIContainers
+	for _, c := range containers {
+		if c.ID != "c" {
+			changed = append(changed, c)
+		}
+	}
+	changed = append(changed, docker.APIContainers{ID: "f", Names: []string{"/gofn-0"}, Created: 500})
+	SortContainers(changed, OrderName)
+	page, _, err := listPage(changed, OrderName, next, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "e"}; !reflect.DeepEqual(containerIDs(page), want) {
+		t.Errorf("expected the page to resume after the removed anchor at %v but found %v", want, containerIDs(page))
+	}
+}
+
+func TestFnListContainersPage(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+	for i := 0; i < 3; i++ {
+		_, err := client.CreateContainer(docker.CreateContainerOptions{
+			Name:   fmt.Sprintf("gofn-page-%d", i),
+			Config: &docker.Config{Image: image},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	cursor := ""
+	for {
+		page, next, err := FnListContainersPage(client, ListOptions{Order: OrderName}, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range page {
+			names = append(names, c.Names[0])
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if want := []string{"/gofn-page-0", "/gofn-page-1", "/gofn-page-2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected %v but found %v", want, names)
+	}
+}
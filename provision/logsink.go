@@ -0,0 +1,376 @@
+package provision
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxLogLine is the length beyond which a line given to the LogSinks is truncated
+	DefaultMaxLogLine = 64 << 10
+	// DefaultLogSinkBuffer is the number of lines held for a LogSink slower than the output
+	DefaultLogSinkBuffer = 1024
+	// TruncatedLogLine ends the lines truncated to ContainerOptions.MaxLogLine
+	TruncatedLogLine = " [truncated]"
+)
+
+// LogSink receives the output lines of a run while it runs, e.g. to ship them to a log store,
+// see ContainerOptions.LogSinks. The calls of a run come from a goroutine of its own, a sink
+// shared by concurrent runs must guard itself. A sink failing a call is not called anymore.
+type LogSink interface {
+	// Write receives a line of stream without its newline, ts is when its first byte arrived.
+	// line is owned by the sink.
+	Write(stream StreamKind, ts time.Time, line []byte) error
+	// Flush is called once the output of the run was written
+	Flush() error
+}
+
+// logShipping are the LogSinks of a run with their limits
+type logShipping struct {
+	sinks   []LogSink
+	maxLine int
+	buffer  int
+}
+
+// shippingOf returns the LogSinks of opts with their limits, nil without sinks
+func shippingOf(opts ContainerOptions) *logShipping {
+	if len(opts.LogSinks) == 0 {
+		return nil
+	}
+	shipping := &logShipping{sinks: opts.LogSinks, maxLine: opts.MaxLogLine, buffer: opts.LogSinkBuffer}
+	if shipping.maxLine <= 0 {
+		shipping.maxLine = DefaultMaxLogLine
+	}
+	if shipping.buffer <= 0 {
+		shipping.buffer = DefaultLogSinkBuffer
+	}
+	return shipping
+}
+
+// logLine is a line queued for the sinks
+type logLine struct {
+	stream StreamKind
+	ts     time.Time
+	line   []byte
+}
+
+// logShipper splits the output of a run into lines and feeds them to the sinks, each from
+// its own goroutine through a bounded queue so a slow or failing sink does not hold the others
+type logShipper struct {
+	shipping *logShipping
+	// onFailure is called once for each disabled sink
+	onFailure func(message string)
+
+	mu       sync.Mutex
+	splitter map[StreamKind]*lineSplitter
+	queues   []chan logLine
+	dropped  []int
+	wg       sync.WaitGroup
+	warnings []string
+	// closed is set once the queues are closed, the late writes of the stream are not shipped
+	closed bool
+}
+
+func (s *logShipping) start(onFailure func(message string)) *logShipper {
+	shipper := &logShipper{
+		shipping:  s,
+		onFailure: onFailure,
+		splitter:  make(map[StreamKind]*lineSplitter),
+		queues:    make([]chan logLine, len(s.sinks)),
+		dropped:   make([]int, len(s.sinks)),
+	}
+	for i, sink := range s.sinks {
+		shipper.queues[i] = make(chan logLine, s.buffer)
+		shipper.wg.Add(1)
+		go shipper.feed(i, sink)
+	}
+	return shipper
+}
+
+// feed calls the sink i with the queued lines until the queue is closed
+func (s *logShipper) feed(i int, sink LogSink) {
+	defer s.wg.Done()
+	var err error
+	for l := range s.queues[i] {
+		if err != nil {
+			continue
+		}
+		err = safely("log sink", func() error {
+			return sink.Write(l.stream, l.ts, l.line)
+		})
+	}
+	if err == nil {
+		err = safely("log sink", sink.Flush)
+	}
+	if err != nil {
+		s.warn(fmt.Sprintf("log sink %d disabled: %v", i, err))
+	}
+}
+
+func (s *logShipper) warn(message string) {
+	s.mu.Lock()
+	s.warnings = append(s.warnings, message)
+	s.mu.Unlock()
+	if s.onFailure != nil {
+		s.onFailure(message)
+	}
+}
+
+// writer returns a writer shipping the lines of stream before copying the output to w
+func (s *logShipper) writer(stream StreamKind, w io.Writer) io.Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.splitter[stream] = &lineSplitter{max: s.shipping.maxLine}
+	return &shippingWriter{shipper: s, stream: stream, w: w}
+}
+
+// ship queues l for every sink, the line is dropped for the sinks whose queue is full
+func (s *logShipper) ship(l logLine) {
+	for i, queue := range s.queues {
+		select {
+		case queue <- l:
+		default:
+			s.dropped[i]++
+		}
+	}
+}
+
+// close ships the partial lines, waits the sinks to be flushed and returns the warnings
+func (s *logShipper) close() []string {
+	s.mu.Lock()
+	s.closed = true
+	for _, stream := range []StreamKind{StreamStdout, StreamStderr} {
+		if splitter := s.splitter[stream]; splitter != nil {
+			splitter.flush(func(ts time.Time, line []byte) {
+				s.ship(logLine{stream: stream, ts: ts, line: line})
+			})
+		}
+	}
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, dropped := range s.dropped {
+		if dropped > 0 {
+			s.warnings = append(s.warnings, fmt.Sprintf("log sink %d dropped %d lines, its buffer was full", i, dropped))
+		}
+	}
+	return s.warnings
+}
+
+type shippingWriter struct {
+	shipper *logShipper
+	stream  StreamKind
+	w       io.Writer
+}
+
+func (sw *shippingWriter) Write(p []byte) (n int, err error) {
+	s := sw.shipper
+	s.mu.Lock()
+	if !s.closed {
+		s.splitter[sw.stream].write(time.Now(), p, func(ts time.Time, line []byte) {
+			s.ship(logLine{stream: sw.stream, ts: ts, line: line})
+		})
+	}
+	s.mu.Unlock()
+	return sw.w.Write(p)
+}
+
+// lineSplitter cuts the frames of a stream into lines, a line may span frames and a line
+// longer than max is truncated and marked with TruncatedLogLine
+type lineSplitter struct {
+	max     int
+	partial []byte
+	ts      time.Time
+	// truncated is set while the rest of a truncated line is skipped
+	truncated bool
+}
+
+// write splits p, received at ts, and emits the lines it completes
+func (l *lineSplitter) write(ts time.Time, p []byte, emit func(ts time.Time, line []byte)) {
+	for len(p) > 0 {
+		if len(l.partial) == 0 && !l.truncated {
+			l.ts = ts
+		}
+		i := bytes.IndexByte(p, '\n')
+		chunk := p
+		if i >= 0 {
+			chunk = p[:i]
+		}
+		if !l.truncated {
+			if room := l.max - len(l.partial); len(chunk) > room {
+				l.partial = append(l.partial, chunk[:room]...)
+				emit(l.ts, append(l.partial, TruncatedLogLine...))
+				l.partial, l.truncated = nil, true
+			} else {
+				l.partial = append(l.partial, chunk...)
+			}
+		}
+		if i < 0 {
+			return
+		}
+		if !l.truncated {
+			emit(l.ts, l.partial)
+		}
+		l.partial, l.truncated = nil, false
+		p = p[i+1:]
+	}
+}
+
+// flush emits the line left without its newline
+func (l *lineSplitter) flush(emit func(ts time.Time, line []byte)) {
+	if len(l.partial) > 0 {
+		emit(l.ts, l.partial)
+	}
+	l.partial, l.truncated = nil, false
+}
+
+// WriterSink is a LogSink writing the lines to W, each prefixed with its time and stream,
+// e.g. 2024-05-01T10:00:00.123456789Z stdout hello. Flush flushes W when it is buffered,
+// e.g. a bufio.Writer.
+type WriterSink struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+// NewWriterSink returns a WriterSink writing to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{W: w}
+}
+
+// Write implements LogSink
+func (s *WriterSink) Write(stream StreamKind, ts time.Time, line []byte) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.W.Write(formatLogLine(stream, ts, line))
+	return
+}
+
+// Flush implements LogSink
+func (s *WriterSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if flusher, ok := s.W.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func formatLogLine(stream StreamKind, ts time.Time, line []byte) []byte {
+	formatted := make([]byte, 0, len(line)+48)
+	formatted = ts.UTC().AppendFormat(formatted, time.RFC3339Nano)
+	formatted = append(formatted, ' ')
+	formatted = append(formatted, stream...)
+	formatted = append(formatted, ' ')
+	formatted = append(formatted, line...)
+	return append(formatted, '\n')
+}
+
+// RotatingFileSink is a LogSink writing the lines to a file like WriterSink, the file is
+// renamed with the suffix .1 once it reaches MaxBytes, the previous ones shifted to .2 and so
+// on, and the files beyond Keep are removed
+type RotatingFileSink struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// NewRotatingFileSink returns a RotatingFileSink appending to path, rotated once it reaches
+// maxBytes with keep rotated files kept, Close closes the file
+func NewRotatingFileSink(path string, maxBytes int64, keep int) (sink *RotatingFileSink, err error) {
+	sink = &RotatingFileSink{path: path, maxBytes: maxBytes, keep: keep}
+	err = sink.open()
+	if err != nil {
+		sink = nil
+	}
+	return
+}
+
+func (s *RotatingFileSink) open() (err error) {
+	s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		_ = s.file.Close()
+		return
+	}
+	s.size = info.Size()
+	s.w = bufio.NewWriter(s.file)
+	return
+}
+
+// Write implements LogSink
+func (s *RotatingFileSink) Write(stream StreamKind, ts time.Time, line []byte) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	formatted := formatLogLine(stream, ts, line)
+	if s.size > 0 && s.size+int64(len(formatted)) > s.maxBytes {
+		if err = s.rotate(); err != nil {
+			return
+		}
+	}
+	n, err := s.w.Write(formatted)
+	s.size += int64(n)
+	return
+}
+
+// rotate shifts the rotated files and starts a new file
+func (s *RotatingFileSink) rotate() (err error) {
+	if err = s.w.Flush(); err != nil {
+		return
+	}
+	if err = s.file.Close(); err != nil {
+		return
+	}
+	_ = os.Remove(s.rotated(s.keep))
+	for i := s.keep - 1; i >= 1; i-- {
+		_ = os.Rename(s.rotated(i), s.rotated(i+1))
+	}
+	if s.keep > 0 {
+		err = os.Rename(s.path, s.rotated(1))
+	} else {
+		err = os.Remove(s.path)
+	}
+	if err != nil {
+		return
+	}
+	return s.open()
+}
+
+func (s *RotatingFileSink) rotated(i int) string {
+	return s.path + "." + strconv.Itoa(i)
+}
+
+// Flush implements LogSink
+func (s *RotatingFileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Flush()
+}
+
+// Close flushes and closes the file
+func (s *RotatingFileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.w.Flush()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,213 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps the lines it receives, it fails from the write failAt on when set
+type recordingSink struct {
+	mu      sync.Mutex
+	lines   []string
+	flushed bool
+	failAt  int
+}
+
+func (s *recordingSink) Write(stream StreamKind, ts time.Time, line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failAt > 0 && len(s.lines)+1 >= s.failAt {
+		return errors.New("sink unavailable")
+	}
+	if ts.IsZero() {
+		return errors.New("line without time")
+	}
+	s.lines = append(s.lines, string(stream)+" "+string(line))
+	return nil
+}
+
+func (s *recordingSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushed = true
+	return nil
+}
+
+func TestRunnerLogSinks(t *testing.T) {
+	long := strings.Repeat("x", 40)
+	frames := []frame{
+		{StreamStdout, "first line\nsecond "},
+		{StreamStderr, "warn"},
+		{StreamStdout, "line\n"},
+		{StreamStderr, "ing\n\n"},
+		{StreamStdout, long[:25]},
+		{StreamStdout, long[25:] + "\nshort\n"},
+		{StreamStderr, long + "\n"},
+		{StreamStdout, "no newline"},
+	}
+	want := []string{
+		"stdout first line",
+		"stderr warning",
+		"stdout second line",
+		"stderr ",
+		"stdout " + long[:32] + TruncatedLogLine,
+		"stdout short",
+		"stderr " + long[:32] + TruncatedLogLine,
+		"stdout no newline",
+	}
+	for _, strategy := range []OutputStrategy{OutputLogs, OutputAttach} {
+		t.Run(string(strategy), func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			fakeExit(server, 0, 0)
+			fakeFrames(server, frames)
+			r := NewRunner(NewTestClient(server.URL(), t))
+			r.OutputStrategy = strategy
+			var warnings []Event
+			r.OnEvent = func(e Event) {
+				if e.Kind == EventWarning {
+					warnings = append(warnings, e)
+				}
+			}
+
+			recorded, failing := &recordingSink{}, &recordingSink{failAt: 3}
+			var written bytes.Buffer
+			result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{
+				LogSinks:   []LogSink{recorded, failing, NewWriterSink(&written)},
+				MaxLogLine: 32,
+			})
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+
+			// the lines of each stream are in order, the streams may interleave differently
+			byStream := func(lines []string) map[string][]string {
+				streams := make(map[string][]string)
+				for _, line := range lines {
+					streams[line[:6]] = append(streams[line[:6]], line)
+				}
+				return streams
+			}
+			if got, expected := byStream(recorded.lines), byStream(want); len(recorded.lines) != len(want) || strings.Join(got["stdout"], "|") != strings.Join(expected["stdout"], "|") || strings.Join(got["stderr"], "|") != strings.Join(expected["stderr"], "|") {
+				t.Errorf("expected the lines %q but found %q", want, recorded.lines)
+			}
+			if !recorded.flushed {
+				t.Error("expected the sink to be flushed")
+			}
+			if len(failing.lines) != 2 || failing.flushed {
+				t.Errorf("expected the failing sink to be disabled after 2 lines but found %q", failing.lines)
+			}
+			if n := strings.Count(written.String(), "\n"); n != len(want) || !strings.Contains(written.String(), " stderr warning\n") {
+				t.Errorf("expected the writer sink to receive %d lines but found %q", len(want), written.String())
+			}
+			if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "log sink 1 disabled: sink unavailable") {
+				t.Errorf("expected the failing sink to be reported but found %q", result.Warnings)
+			}
+			if len(warnings) != 1 || warnings[0].ContainerID != result.ContainerID {
+				t.Errorf("expected a warning event but found %+v", warnings)
+			}
+			// the output is collected as without sinks
+			if result.Stdout.String() != "first line\nsecond line\n"+long+"\nshort\nno newline" {
+				t.Errorf("unexpected stdout %q", result.Stdout)
+			}
+		})
+	}
+}
+
+func TestLogShipperFullBuffer(t *testing.T) {
+	release := make(chan struct{})
+	blocked := &blockingSink{release: release}
+	shipper := shippingOf(ContainerOptions{LogSinks: []LogSink{blocked}, LogSinkBuffer: 2}).start(nil)
+	w := shipper.writer(StreamStdout, ioutil.Discard)
+	for i := 0; i < 10; i++ {
+		_, _ = w.Write([]byte("line\n"))
+		if i == 0 {
+			// the blocked sink holds the first line, its queue the next 2
+			<-blocked.taken()
+		}
+	}
+	close(release)
+	warnings := shipper.close()
+	if len(warnings) != 1 || warnings[0] != "log sink 0 dropped 7 lines, its buffer was full" {
+		t.Errorf("expected the lines of the blocked sink to be dropped but found %q", warnings)
+	}
+	if len(blocked.lines) != 3 {
+		t.Errorf("expected the blocked sink to receive 3 lines but found %d", len(blocked.lines))
+	}
+}
+
+// blockingSink blocks in its writes until release is closed
+type blockingSink struct {
+	release <-chan struct{}
+	once    sync.Once
+	started chan struct{}
+	lines   []string
+}
+
+func (s *blockingSink) taken() chan struct{} {
+	s.once.Do(func() {
+		s.started = make(chan struct{})
+	})
+	return s.started
+}
+
+func (s *blockingSink) Write(stream StreamKind, ts time.Time, line []byte) error {
+	if len(s.lines) == 0 {
+		close(s.taken())
+	}
+	<-s.release
+	s.lines = append(s.lines, string(line))
+	return nil
+}
+
+func (s *blockingSink) Flush() error {
+	return nil
+}
+
+func TestRotatingFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.log")
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	// each line takes 30 bytes, 2 fit in a file
+	sink, err := NewRotatingFileSink(path, 80, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err = sink.Write(StreamStdout, ts, []byte{'a' + byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		path:        "2024-05-01T10:00:00Z stdout g\n",
+		path + ".1": "2024-05-01T10:00:00Z stdout e\n2024-05-01T10:00:00Z stdout f\n",
+		path + ".2": "2024-05-01T10:00:00Z stdout c\n2024-05-01T10:00:00Z stdout d\n",
+	}
+	for name, want := range files {
+		got, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: expected %q but found %q", filepath.Base(name), want, got)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected the oldest file to be removed but found %v", err)
+	}
+}
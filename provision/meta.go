@@ -0,0 +1,58 @@
+package provision
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// DefaultMetaSentinel is the usual value of Runner.MetaSentinel
+const DefaultMetaSentinel = "--gofn-meta--"
+
+// ErrNoMeta is raised by RunResult.DecodeMeta when the run wrote no metadata trailer
+var ErrNoMeta = errors.New("provision: the run wrote no metadata")
+
+// DecodeMeta decodes the metadata trailer of the run into v
+func (result *RunResult) DecodeMeta(v interface{}) error {
+	if result.Meta == nil {
+		return ErrNoMeta
+	}
+	return json.Unmarshal(result.Meta, v)
+}
+
+// extractMeta moves the metadata trailer ending result.Stdout to result.Meta. The trailer is the
+// sentinel line followed by a single JSON line, they must be the last lines of the output so a
+// sentinel in the middle of the output is left as is. A trailer that is not valid JSON is left in
+// the output and reported in result.Warnings.
+func extractMeta(sentinel string, result *RunResult) {
+	if sentinel == "" || result.Stdout == nil {
+		return
+	}
+	out := result.Stdout.Bytes()
+	marker := []byte(sentinel + "\n")
+	start := bytes.LastIndex(out, append([]byte("\n"), marker...))
+	switch {
+	case start != -1:
+		start++
+	case bytes.HasPrefix(out, marker):
+		start = 0
+	default:
+		return
+	}
+	trailer := bytes.TrimSuffix(out[start+len(marker):], []byte("\n"))
+	if bytes.IndexByte(trailer, '\n') != -1 {
+		return
+	}
+	if !json.Valid(trailer) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("malformed metadata trailer: %q is not JSON", trailer))
+		return
+	}
+	result.Meta = json.RawMessage(append([]byte(nil), trailer...))
+	// the newline ending the output before the sentinel belongs to the trailer
+	end := start
+	if end > 0 {
+		end--
+	}
+	result.Stdout.Truncate(end)
+}
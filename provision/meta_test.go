@@ -0,0 +1,76 @@
+package provision
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunnerRunMeta(t *testing.T) {
+	tests := []struct {
+		name       string
+		sentinel   string
+		stdout     string
+		wantStdout string
+		wantMeta   string
+		wantWarn   bool
+	}{
+		{"absent", DefaultMetaSentinel, "result\n", "result\n", "", false},
+		{"disabled", "", "result\n--gofn-meta--\n{\"rows\":3}\n", "result\n--gofn-meta--\n{\"rows\":3}\n", "", false},
+		{"mid-stream", DefaultMetaSentinel, "result\n--gofn-meta--\n{\"rows\":3}\nmore output\n", "result\n--gofn-meta--\n{\"rows\":3}\nmore output\n", "", false},
+		{"at the end", DefaultMetaSentinel, "result\n--gofn-meta--\n{\"rows\":3}\n", "result", `{"rows":3}`, false},
+		{"without final newline", DefaultMetaSentinel, "line 1\nline 2\n--gofn-meta--\n{\"rows\":3}", "line 1\nline 2", `{"rows":3}`, false},
+		{"only the trailer", DefaultMetaSentinel, "--gofn-meta--\n{\"rows\":3}\n", "", `{"rows":3}`, false},
+		{"custom sentinel", "##meta", "result\n##meta\n[1,2]\n", "result", `[1,2]`, false},
+		{"malformed", DefaultMetaSentinel, "result\n--gofn-meta--\n{rows:3}\n", "result\n--gofn-meta--\n{rows:3}\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			fakeExit(server, 0, 0)
+			fakeLogs(server, tt.stdout, "")
+			client := NewTestClient(server.URL(), t)
+			r := NewRunner(client)
+			r.OutputStrategy = OutputLogs
+			r.MetaSentinel = tt.sentinel
+
+			result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if result.Stdout.String() != tt.wantStdout {
+				t.Errorf("expected stdout %q but found %q", tt.wantStdout, result.Stdout.String())
+			}
+			if string(result.Meta) != tt.wantMeta {
+				t.Errorf("expected meta %q but found %q", tt.wantMeta, result.Meta)
+			}
+			if (len(result.Warnings) > 0) != tt.wantWarn {
+				t.Errorf("unexpected warnings %q", result.Warnings)
+			}
+		})
+	}
+}
+
+func TestRunResultDecodeMeta(t *testing.T) {
+	var meta struct {
+		Rows int      `json:"rows"`
+		Next []string `json:"next"`
+	}
+	result := RunResult{}
+	if err := result.DecodeMeta(&meta); err != ErrNoMeta {
+		t.Errorf("expected ErrNoMeta but found %v", err)
+	}
+	result.Meta = []byte(`{"rows":3,"next":["notify"]}`)
+	if err := result.DecodeMeta(&meta); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if meta.Rows != 3 || !reflect.DeepEqual(meta.Next, []string{"notify"}) {
+		t.Errorf("unexpected meta %+v", meta)
+	}
+	result.Meta = []byte(`{"rows":"three"}`)
+	if err := result.DecodeMeta(&meta); err == nil || !strings.Contains(err.Error(), "rows") {
+		t.Errorf("expected the decoding error but found %v", err)
+	}
+}
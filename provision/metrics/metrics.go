@@ -0,0 +1,235 @@
+// Package metrics serves the health of the container pools, of the machine leases and of the
+// event queues as gauges in the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofn/gofn/iaas"
+	"github.com/gofn/gofn/provision"
+)
+
+// ContentType is the content type of the Prometheus text format served by Registry
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// gauge describes a metric of the exposition
+type gauge struct {
+	name string
+	help string
+}
+
+var (
+	poolTarget        = gauge{"gofn_pool_warm_target", "Number of warm containers kept by the pool."}
+	poolAvailable     = gauge{"gofn_pool_warm_available", "Number of warm containers that can be lent."}
+	poolBusy          = gauge{"gofn_pool_busy", "Number of containers lent to invocations."}
+	poolRetiring      = gauge{"gofn_pool_retiring", "Number of containers of the previous image being removed."}
+	poolUpdating      = gauge{"gofn_pool_updating", "Whether the image of the pool is being updated."}
+	poolAge           = gauge{"gofn_pool_container_age_average_seconds", "Mean time since the warm containers were started."}
+	poolReplenishErr  = gauge{"gofn_pool_replenish_error", "Whether the last replenishment of the pool failed."}
+	poolReplenishedAt = gauge{"gofn_pool_last_replenish_timestamp_seconds", "Unix time of the last replenishment of the pool."}
+	poolWarmup        = gauge{"gofn_pool_last_warmup_seconds", "Duration of the last successful warm-up of a container."}
+	poolWarmupFailed  = gauge{"gofn_pool_warmup_failures", "Number of containers discarded by a failed warm-up."}
+
+	leasesLeased     = gauge{"gofn_machine_pool_leased", "Number of machines whose lease is kept alive."}
+	leasesNextExpiry = gauge{"gofn_machine_pool_next_expiry_timestamp_seconds", "Unix time of the earliest lease expiry."}
+	leasesRenewErr   = gauge{"gofn_machine_pool_renew_error", "Whether the last renewal of the leases failed."}
+	leasesRenewedAt  = gauge{"gofn_machine_pool_last_renew_timestamp_seconds", "Unix time of the last renewal of the leases."}
+
+	eventsPending    = gauge{"gofn_events_pending", "Number of events waiting for the consumer of the runner."}
+	eventsDelivered  = gauge{"gofn_events_delivered_total", "Number of events given to the consumer of the runner."}
+	eventsDropped    = gauge{"gofn_events_dropped_total", "Number of events discarded while the queue of the runner was full."}
+	eventsCoalesced  = gauge{"gofn_events_coalesced_total", "Number of progress and stats events merged into a pending one."}
+	eventsOverflowed = gauge{"gofn_events_overflowed_total", "Number of lifecycle events queued beyond the size of the queue."}
+	eventsPanicked   = gauge{"gofn_events_panicked_total", "Number of events whose consumer panicked."}
+)
+
+// Registry serves the gauges of the pools registered with it. The gauges are computed from
+// the Stats of the pools at each scrape, so they follow every state change of the pools
+// without a background loop, and the numbers of a pool are consistent with each other.
+type Registry struct {
+	mu     sync.Mutex
+	pools  map[string]*provision.ContainerPool
+	leases map[string]*iaas.LeaseManager
+	events map[string]*provision.EventQueue
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		pools:  make(map[string]*provision.ContainerPool),
+		leases: make(map[string]*iaas.LeaseManager),
+		events: make(map[string]*provision.EventQueue),
+	}
+}
+
+// RegisterPool exposes the gauges of p labeled pool=name, replacing a pool of the same name
+func (r *Registry) RegisterPool(name string, p *provision.ContainerPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pools[name] = p
+}
+
+// UnregisterPool stops exposing the pool name, e.g. once it was closed
+func (r *Registry) UnregisterPool(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pools, name)
+}
+
+// RegisterMachinePool exposes the gauges of the machines leased by m labeled pool=name
+func (r *Registry) RegisterMachinePool(name string, m *iaas.LeaseManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.leases[name] = m
+}
+
+// UnregisterMachinePool stops exposing the machine pool name
+func (r *Registry) UnregisterMachinePool(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.leases, name)
+}
+
+// RegisterEventQueue exposes the counters of the event queue q of a runner labeled runner=name
+func (r *Registry) RegisterEventQueue(name string, q *provision.EventQueue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[name] = q
+}
+
+// UnregisterEventQueue stops exposing the event queue name, e.g. once it was closed
+func (r *Registry) UnregisterEventQueue(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.events, name)
+}
+
+// sample is a value of a gauge for a pool, or for a runner with the event gauges
+type sample struct {
+	pool  string
+	value float64
+}
+
+// Write writes the gauges in the Prometheus text format, the pools sorted by name
+func (r *Registry) Write(w io.Writer) (err error) {
+	r.mu.Lock()
+	poolNames := make([]string, 0, len(r.pools))
+	for name := range r.pools {
+		poolNames = append(poolNames, name)
+	}
+	sort.Strings(poolNames)
+	pools := make([]provision.PoolStats, len(poolNames))
+	for i, name := range poolNames {
+		pools[i] = r.pools[name].Stats()
+	}
+	leaseNames := make([]string, 0, len(r.leases))
+	for name := range r.leases {
+		leaseNames = append(leaseNames, name)
+	}
+	sort.Strings(leaseNames)
+	leases := make([]iaas.LeaseStats, len(leaseNames))
+	for i, name := range leaseNames {
+		leases[i] = r.leases[name].Stats()
+	}
+	queueNames := make([]string, 0, len(r.events))
+	for name := range r.events {
+		queueNames = append(queueNames, name)
+	}
+	sort.Strings(queueNames)
+	queues := make([]provision.EventQueueStats, len(queueNames))
+	for i, name := range queueNames {
+		queues[i] = r.events[name].Stats()
+	}
+	r.mu.Unlock()
+
+	samples := make(map[gauge][]sample)
+	for i, stats := range pools {
+		name := poolNames[i]
+		samples[poolTarget] = append(samples[poolTarget], sample{name, float64(stats.Target)})
+		samples[poolAvailable] = append(samples[poolAvailable], sample{name, float64(stats.Available)})
+		samples[poolBusy] = append(samples[poolBusy], sample{name, float64(stats.Busy)})
+		samples[poolRetiring] = append(samples[poolRetiring], sample{name, float64(stats.Retiring)})
+		samples[poolUpdating] = append(samples[poolUpdating], sample{name, boolValue(stats.Updating)})
+		samples[poolAge] = append(samples[poolAge], sample{name, stats.AverageAge.Seconds()})
+		samples[poolReplenishErr] = append(samples[poolReplenishErr], sample{name, boolValue(stats.LastReplenishError != "")})
+		samples[poolReplenishedAt] = append(samples[poolReplenishedAt], sample{name, unixSeconds(stats.LastReplenishAt)})
+		samples[poolWarmup] = append(samples[poolWarmup], sample{name, stats.LastWarmup.Seconds()})
+		samples[poolWarmupFailed] = append(samples[poolWarmupFailed], sample{name, float64(stats.WarmupFailures)})
+	}
+	for i, stats := range leases {
+		name := leaseNames[i]
+		samples[leasesLeased] = append(samples[leasesLeased], sample{name, float64(stats.Leased)})
+		samples[leasesNextExpiry] = append(samples[leasesNextExpiry], sample{name, unixSeconds(stats.NextExpiry)})
+		samples[leasesRenewErr] = append(samples[leasesRenewErr], sample{name, boolValue(stats.LastRenewError != "")})
+		samples[leasesRenewedAt] = append(samples[leasesRenewedAt], sample{name, unixSeconds(stats.LastRenewAt)})
+	}
+	for i, stats := range queues {
+		name := queueNames[i]
+		samples[eventsPending] = append(samples[eventsPending], sample{name, float64(stats.Pending)})
+		samples[eventsDelivered] = append(samples[eventsDelivered], sample{name, float64(stats.Delivered)})
+		samples[eventsDropped] = append(samples[eventsDropped], sample{name, float64(stats.Dropped)})
+		samples[eventsCoalesced] = append(samples[eventsCoalesced], sample{name, float64(stats.Coalesced)})
+		samples[eventsOverflowed] = append(samples[eventsOverflowed], sample{name, float64(stats.Overflowed)})
+		samples[eventsPanicked] = append(samples[eventsPanicked], sample{name, float64(stats.Panicked)})
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, g := range []gauge{
+		poolTarget, poolAvailable, poolBusy, poolRetiring, poolUpdating, poolAge, poolReplenishErr, poolReplenishedAt, poolWarmup, poolWarmupFailed,
+		leasesLeased, leasesNextExpiry, leasesRenewErr, leasesRenewedAt,
+		eventsPending, eventsDelivered, eventsDropped, eventsCoalesced, eventsOverflowed, eventsPanicked,
+	} {
+		if len(samples[g]) == 0 {
+			continue
+		}
+		// the totals only grow, they are counters of the text format
+		kind, label := "gauge", "pool"
+		if strings.HasSuffix(g.name, "_total") {
+			kind = "counter"
+		}
+		if strings.HasPrefix(g.name, "gofn_events_") {
+			label = "runner"
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", g.name, g.help, g.name, kind)
+		for _, s := range samples[g] {
+			fmt.Fprintf(bw, "%s{%s=\"%s\"} %g\n", g.name, label, escapeLabel(s.pool), s.value)
+		}
+	}
+	err = bw.Flush()
+	return
+}
+
+// ServeHTTP serves the gauges to a Prometheus scrape
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_ = r.Write(w)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// unixSeconds returns t as Unix seconds, 0 for the zero time
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value of the text format
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
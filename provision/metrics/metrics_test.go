@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+	"github.com/gofn/gofn/iaas"
+	"github.com/gofn/gofn/provision"
+)
+
+// memLeaser keeps the leases in memory
+type memLeaser struct {
+	mu     sync.Mutex
+	setErr error
+}
+
+func (l *memLeaser) SetLease(machineID string, expiry time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.setErr
+}
+
+func (l *memLeaser) Leases() (map[string]time.Time, error) {
+	return map[string]time.Time{}, nil
+}
+
+func (l *memLeaser) DeleteLeased(machineID string) error {
+	return nil
+}
+
+// fakeIaas creates the machine id
+type fakeIaas struct {
+	id string
+}
+
+func (f *fakeIaas) CreateMachine() (*iaas.Machine, error) {
+	return &iaas.Machine{ID: f.id}, nil
+}
+
+func (f *fakeIaas) DeleteMachine() error {
+	return nil
+}
+
+// startPool starts a pool of two warm containers on a fake docker api
+func startPool(t *testing.T) (pool *provision.ContainerPool, cleanup func()) {
+	server, err := fake.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.PullImage(docker.PullImageOptions{Repository: "gofn/metrics"}, docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = provision.NewContainerPool(provision.NewRunner(client), provision.ContainerOptions{Image: "gofn/metrics"}, provision.PoolOptions{Size: 2})
+	if err = pool.Start(context.Background()); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	return pool, func() {
+		pool.Close()
+		server.Stop()
+	}
+}
+
+func scrape(t *testing.T, r *Registry) string {
+	server := httptest.NewServer(r)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != ContentType {
+		t.Errorf("expected the content type %q but found %q", ContentType, resp.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func expectLines(t *testing.T, exposition string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("expected %q in\n%s", line, exposition)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	pool, cleanup := startPool(t)
+	defer cleanup()
+	leaser := &memLeaser{}
+	leases := iaas.NewLeaseManager(leaser, time.Hour)
+	r := NewRegistry()
+	if exposition := scrape(t, r); exposition != "" {
+		t.Errorf("expected no gauges but found\n%s", exposition)
+	}
+	r.RegisterPool(`web"1`, pool)
+	r.RegisterMachinePool("workers", leases)
+
+	exposition := scrape(t, r)
+	expectLines(t, exposition,
+		"# TYPE gofn_pool_warm_target gauge",
+		`gofn_pool_warm_target{pool="web\"1"} 2`,
+		`gofn_pool_warm_available{pool="web\"1"} 2`,
+		`gofn_pool_busy{pool="web\"1"} 0`,
+		`gofn_pool_updating{pool="web\"1"} 0`,
+		`gofn_pool_replenish_error{pool="web\"1"} 0`,
+		`gofn_pool_warmup_failures{pool="web\"1"} 0`,
+		`gofn_machine_pool_leased{pool="workers"} 0`,
+		`gofn_machine_pool_next_expiry_timestamp_seconds{pool="workers"} 0`,
+	)
+
+	container, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = leases.CreateMachine(&fakeIaas{id: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	leaser.mu.Lock()
+	leaser.setErr = errors.New("rate limited")
+	leaser.mu.Unlock()
+	_ = leases.Renew()
+	expectLines(t, scrape(t, r),
+		`gofn_pool_warm_available{pool="web\"1"} 1`,
+		`gofn_pool_busy{pool="web\"1"} 1`,
+		`gofn_machine_pool_leased{pool="workers"} 1`,
+		`gofn_machine_pool_renew_error{pool="workers"} 1`,
+	)
+
+	pool.Release(container.ID)
+	r.UnregisterMachinePool("workers")
+	exposition = scrape(t, r)
+	expectLines(t, exposition, `gofn_pool_warm_available{pool="web\"1"} 2`, `gofn_pool_busy{pool="web\"1"} 0`)
+	if strings.Contains(exposition, "gofn_machine_pool") {
+		t.Errorf("expected the machine pool to be unregistered but found\n%s", exposition)
+	}
+}
+
+func TestRegistryEventQueue(t *testing.T) {
+	taken, release := make(chan struct{}, 2), make(chan struct{})
+	q := provision.NewEventQueue(func(provision.Event) {
+		taken <- struct{}{}
+		<-release
+	}, provision.EventQueueOptions{Size: 1})
+	r := NewRegistry()
+	r.RegisterEventQueue("api", q)
+
+	// the consumer holds the first warning, the second one fills the queue
+	q.Emit(provision.Event{Kind: provision.EventWarning})
+	<-taken
+	for i := 0; i < 3; i++ {
+		q.Emit(provision.Event{Kind: provision.EventWarning})
+	}
+	exposition := scrape(t, r)
+	expectLines(t, exposition,
+		"# TYPE gofn_events_pending gauge",
+		"# TYPE gofn_events_dropped_total counter",
+		`gofn_events_dropped_total{runner="api"} 2`,
+		`gofn_events_overflowed_total{runner="api"} 0`,
+		`gofn_events_panicked_total{runner="api"} 0`,
+	)
+	close(release)
+	q.Close()
+	expectLines(t, scrape(t, r), `gofn_events_pending{runner="api"} 0`, `gofn_events_delivered_total{runner="api"} 2`)
+	r.UnregisterEventQueue("api")
+	if exposition = scrape(t, r); exposition != "" {
+		t.Errorf("expected the event queue to be unregistered but found\n%s", exposition)
+	}
+}
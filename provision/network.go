@@ -0,0 +1,140 @@
+package provision
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/internal/names"
+)
+
+const (
+	// LabelOwner marks the resources created by gofn
+	LabelOwner = "io.gofn.owner"
+	// LabelInvocation holds the invocation that created a resource
+	LabelInvocation = "io.gofn.invocation"
+	// LabelCreated holds the RFC 3339 creation time of a resource
+	LabelCreated = "io.gofn.created"
+	// LabelConfig holds the digest of the ResolvedConfig of a run container
+	LabelConfig = "io.gofn.config"
+	// LabelManaged marks the function containers created by FnContainer, FnListContainers
+	// selects them by it
+	LabelManaged = "io.gofn.managed"
+	// LabelImage holds the image a function container was created from, as given to FnContainer
+	LabelImage = "io.gofn.image"
+	// LabelCreatedBy holds the CreatedBy of the program that created a function container
+	LabelCreatedBy = "io.gofn.created-by"
+
+	ownerGofn = "gofn"
+)
+
+// NetworkOptions are options used to create a network
+type NetworkOptions struct {
+	// Name defaults to gofn-<invocation id>
+	Name string
+	// InvocationID defaults to a new uuid
+	InvocationID string
+	Driver       string
+	Internal     bool
+	Labels       map[string]string
+}
+
+// FnCreateNetwork creates a network labeled as owned by gofn
+func FnCreateNetwork(client *docker.Client, opts NetworkOptions) (network *docker.Network, err error) {
+	if opts.InvocationID == "" {
+		opts.InvocationID = names.ID()
+	}
+	if opts.Name == "" {
+		opts.Name = fmt.Sprintf("gofn-%s", opts.InvocationID)
+	}
+	labels := make(map[string]string, len(opts.Labels)+3)
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+	labels[LabelOwner] = ownerGofn
+	labels[LabelInvocation] = opts.InvocationID
+	labels[LabelCreated] = time.Now().UTC().Format(time.RFC3339)
+	network, err = client.CreateNetwork(docker.CreateNetworkOptions{
+		Name:           opts.Name,
+		Driver:         opts.Driver,
+		Internal:       opts.Internal,
+		Labels:         labels,
+		CheckDuplicate: true,
+	})
+	return
+}
+
+// FnRemoveNetwork removes a network, gofn containers still attached to it are disconnected first
+// and removing a network that does not exist succeeds
+func FnRemoveNetwork(client *docker.Client, networkID string) (err error) {
+	err = client.RemoveNetwork(networkID)
+	if err == nil || !strings.Contains(err.Error(), "active endpoints") {
+		return ignoreNoSuchNetwork(err)
+	}
+	network, err := client.NetworkInfo(networkID)
+	if err != nil {
+		return ignoreNoSuchNetwork(err)
+	}
+	for containerID, endpoint := range network.Containers {
+		if !strings.HasPrefix(strings.TrimPrefix(endpoint.Name, "/"), "gofn-") {
+			continue
+		}
+		err = client.DisconnectNetwork(networkID, docker.NetworkConnectionOptions{
+			Container: containerID,
+			Force:     true,
+		})
+		if err != nil {
+			return
+		}
+	}
+	err = ignoreNoSuchNetwork(client.RemoveNetwork(networkID))
+	return
+}
+
+func ignoreNoSuchNetwork(err error) error {
+	if _, ok := err.(*docker.NoSuchNetwork); ok {
+		return nil
+	}
+	return err
+}
+
+// FnPruneNetworks removes the gofn networks older than olderThan without containers,
+// it returns the IDs of the removed networks
+func FnPruneNetworks(client *docker.Client, olderThan time.Duration) (removed []string, err error) {
+	networks, err := client.FilteredListNetworks(docker.NetworkFilterOpts{
+		"label": {LabelOwner + "=" + ownerGofn: true},
+	})
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, listed := range networks {
+		if listed.Labels[LabelOwner] != ownerGofn {
+			continue
+		}
+		created, parseErr := time.Parse(time.RFC3339, listed.Labels[LabelCreated])
+		if parseErr != nil || now.Sub(created) < olderThan {
+			continue
+		}
+		// the list does not report the attached containers
+		var network *docker.Network
+		network, err = client.NetworkInfo(listed.ID)
+		if _, ok := err.(*docker.NoSuchNetwork); ok {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if len(network.Containers) > 0 {
+			continue
+		}
+		err = ignoreNoSuchNetwork(client.RemoveNetwork(listed.ID))
+		if err != nil {
+			return
+		}
+		removed = append(removed, listed.ID)
+	}
+	return
+}
@@ -0,0 +1,183 @@
+package provision
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeNetworks replaces the network endpoints of the fake daemon, which drops the labels,
+// has no connect and disconnect endpoints and removes networks with active endpoints
+type fakeNetworks struct {
+	mu           sync.Mutex
+	networks     map[string]*docker.Network
+	disconnected []string
+}
+
+func newFakeNetworks(server *fake.DockerServer) *fakeNetworks {
+	f := &fakeNetworks{networks: make(map[string]*docker.Network)}
+	server.CustomHandler("/networks.*", http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeNetworks) add(network *docker.Network) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.networks[network.ID] = network
+}
+
+func (f *fakeNetworks) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1:
+		var networks []*docker.Network
+		for _, network := range f.networks {
+			networks = append(networks, network)
+		}
+		_ = json.NewEncoder(w).Encode(networks)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "create":
+		var opts docker.CreateNetworkOptions
+		_ = json.NewDecoder(r.Body).Decode(&opts)
+		id := "net-" + opts.Name
+		f.networks[id] = &docker.Network{ID: id, Name: opts.Name, Driver: opts.Driver, Labels: opts.Labels, Internal: opts.Internal}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case len(parts) >= 2 && f.networks[parts[1]] == nil:
+		http.Error(w, "no such network", http.StatusNotFound)
+	case r.Method == http.MethodGet && len(parts) == 2:
+		_ = json.NewEncoder(w).Encode(f.networks[parts[1]])
+	case r.Method == http.MethodDelete && len(parts) == 2:
+		if len(f.networks[parts[1]].Containers) > 0 {
+			http.Error(w, "error while removing network: network "+parts[1]+" has active endpoints", http.StatusForbidden)
+			return
+		}
+		delete(f.networks, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "connect":
+		var opts docker.NetworkConnectionOptions
+		_ = json.NewDecoder(r.Body).Decode(&opts)
+		network := f.networks[parts[1]]
+		if network.Containers == nil {
+			network.Containers = make(map[string]docker.Endpoint)
+		}
+		network.Containers[opts.Container] = docker.Endpoint{Name: opts.Container}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "disconnect":
+		var opts docker.NetworkConnectionOptions
+		_ = json.NewDecoder(r.Body).Decode(&opts)
+		delete(f.networks[parts[1]].Containers, opts.Container)
+		f.disconnected = append(f.disconnected, opts.Container)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestFnCreateNetwork(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	networks := newFakeNetworks(server)
+	client := NewTestClient(server.URL(), t)
+
+	network, err := FnCreateNetwork(client, NetworkOptions{InvocationID: "42", Labels: map[string]string{"team": "a"}})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	created := networks.networks[network.ID]
+	if created.Name != "gofn-42" {
+		t.Errorf("expected name gofn-42 but found %q", created.Name)
+	}
+	if created.Labels[LabelOwner] != "gofn" || created.Labels[LabelInvocation] != "42" || created.Labels["team"] != "a" {
+		t.Errorf("unexpected labels %v", created.Labels)
+	}
+	if _, err = time.Parse(time.RFC3339, created.Labels[LabelCreated]); err != nil {
+		t.Errorf("expected a creation time label but found %q", created.Labels[LabelCreated])
+	}
+}
+
+func TestFnRemoveNetworkDisconnectsGofnContainers(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	networks := newFakeNetworks(server)
+	client := NewTestClient(server.URL(), t)
+	networks.add(&docker.Network{ID: "sidecars", Containers: map[string]docker.Endpoint{
+		"c1": {Name: "gofn-1"},
+		"c2": {Name: "gofn-2"},
+	}})
+
+	err := FnRemoveNetwork(client, "sidecars")
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, ok := networks.networks["sidecars"]; ok {
+		t.Error("expected the network to be removed")
+	}
+	if len(networks.disconnected) != 2 {
+		t.Errorf("expected 2 containers to be disconnected but found %v", networks.disconnected)
+	}
+	// removing it again succeeds
+	err = FnRemoveNetwork(client, "sidecars")
+	if err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+}
+
+func TestFnRemoveNetworkKeepsForeignContainers(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	networks := newFakeNetworks(server)
+	client := NewTestClient(server.URL(), t)
+	networks.add(&docker.Network{ID: "shared", Containers: map[string]docker.Endpoint{
+		"c1": {Name: "gofn-1"},
+		"c2": {Name: "database"},
+	}})
+
+	err := FnRemoveNetwork(client, "shared")
+	if err == nil || !strings.Contains(err.Error(), "active endpoints") {
+		t.Fatalf("expected an active endpoints error but found %v", err)
+	}
+	if want := []string{"c1"}; !reflect.DeepEqual(networks.disconnected, want) {
+		t.Errorf("expected %v to be disconnected but found %v", want, networks.disconnected)
+	}
+}
+
+func TestFnPruneNetworks(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	networks := newFakeNetworks(server)
+	client := NewTestClient(server.URL(), t)
+	created := func(age time.Duration) map[string]string {
+		return map[string]string{
+			LabelOwner:   "gofn",
+			LabelCreated: time.Now().Add(-age).UTC().Format(time.RFC3339),
+		}
+	}
+	networks.add(&docker.Network{ID: "old", Labels: created(2 * time.Hour)})
+	networks.add(&docker.Network{ID: "recent", Labels: created(time.Minute)})
+	networks.add(&docker.Network{ID: "in-use", Labels: created(2 * time.Hour), Containers: map[string]docker.Endpoint{
+		"c1": {Name: "gofn-1"},
+	}})
+	networks.add(&docker.Network{ID: "foreign", Labels: map[string]string{LabelCreated: created(2 * time.Hour)[LabelCreated]}})
+
+	removed, err := FnPruneNetworks(client, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if want := []string{"old"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("expected %v to be removed but found %v", want, removed)
+	}
+	for _, id := range []string{"recent", "in-use", "foreign"} {
+		if _, ok := networks.networks[id]; !ok {
+			t.Errorf("expected network %s to be kept", id)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DefaultNonRootUser is the user of the RunAsNonRoot containers, the nobody user of most distributions
+const DefaultNonRootUser = "65534:65534"
+
+var (
+	// ErrRunningAsRoot is raised when a RunAsNonRoot container runs as root
+	ErrRunningAsRoot = errors.New("provision: container runs as root")
+)
+
+// isRootUser reports whether the docker user spec user, e.g. "root:staff", runs as root
+func isRootUser(user string) bool {
+	name := strings.SplitN(user, ":", 2)[0]
+	return name == "" || name == "root" || name == "0"
+}
+
+// containerUser returns the user to set on the container of opts, empty to keep the image one
+func containerUser(client *docker.Client, opts ContainerOptions) (user string, err error) {
+	if opts.User != "" {
+		// the user of the caller replaces the one of the image, RunAsNonRoot only checks it
+		if isRootUser(opts.User) && opts.RunAsNonRoot && !opts.AllowRoot {
+			err = ErrRunningAsRoot
+			return
+		}
+		return opts.User, nil
+	}
+	if !opts.RunAsNonRoot || opts.AllowRoot {
+		return
+	}
+	image, err := client.InspectImage(opts.Image)
+	if err != nil {
+		return
+	}
+	if image.Config != nil && !isRootUser(image.Config.User) {
+		return
+	}
+	user = opts.NonRootUser
+	if user == "" {
+		user = DefaultNonRootUser
+	}
+	return
+}
+
+// verifyNonRoot checks a started RunAsNonRoot container does not run as root. The daemon
+// reports the host uid of the processes, which is not 0 under userns-remap, so the
+// configured user is checked as well.
+func verifyNonRoot(ctx context.Context, client *docker.Client, containerID string) (err error) {
+	container, err := client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: containerID, Context: ctx})
+	if err != nil {
+		return
+	}
+	if container.Config != nil && isRootUser(container.Config.User) {
+		return ErrRunningAsRoot
+	}
+	// the client does not escape the ps arguments
+	top, err := client.TopContainer(containerID, url.QueryEscape("-o uid,pid"))
+	if err != nil && strings.Contains(err.Error(), "is not running") {
+		// the container already exited, the configured user was checked
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	column := -1
+	for i, title := range top.Titles {
+		if title == "UID" {
+			column = i
+		}
+	}
+	for _, process := range top.Processes {
+		if column >= 0 && column < len(process) && isRootUser(process[column]) {
+			return ErrRunningAsRoot
+		}
+	}
+	return
+}
+
+// warnInaccessibleBinds emits a warning for each local bind mount the numeric user can not read
+func (r *Runner) warnInaccessibleBinds(opts ContainerOptions, user string) {
+	ids := strings.SplitN(user, ":", 2)
+	uid, err := strconv.Atoi(ids[0])
+	if err != nil {
+		// a user name is resolved in the image, its uid is unknown here
+		return
+	}
+	gid := -1
+	if len(ids) == 2 {
+		if gid, err = strconv.Atoi(ids[1]); err != nil {
+			gid = -1
+		}
+	}
+	for _, bind := range opts.Volumes {
+		source := strings.SplitN(bind, ":", 2)[0]
+		if !filepath.IsAbs(source) {
+			// a named volume
+			continue
+		}
+		info, err := os.Stat(source)
+		if err != nil {
+			continue
+		}
+		ownerUID, ownerGID, ok := fileOwner(info)
+		if !ok {
+			continue
+		}
+		if !readableBy(info.Mode(), uid, gid, ownerUID, ownerGID) {
+			r.emit(EventWarning, "", fmt.Sprintf("bind mount %s is owned by %d:%d with mode %v and will not be readable by the container user %s", source, ownerUID, ownerGID, info.Mode().Perm(), user))
+		}
+	}
+}
+
+// readableBy reports whether uid:gid can read a file of mode owned by ownerUID:ownerGID,
+// directories have to be searchable as well
+func readableBy(mode os.FileMode, uid, gid, ownerUID, ownerGID int) bool {
+	perm := mode.Perm()
+	switch {
+	case uid == 0:
+		return true
+	case uid == ownerUID:
+		perm >>= 6
+	case gid == ownerGID:
+		perm >>= 3
+	}
+	if mode.IsDir() {
+		return perm&05 == 05
+	}
+	return perm&04 != 0
+}
@@ -0,0 +1,149 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeImageUsers pulls an image per entry of users and makes its inspection report the user
+func fakeImageUsers(server *fake.DockerServer, client *docker.Client, users map[string]string) {
+	for image := range users {
+		_ = client.PullImage(docker.PullImageOptions{Repository: image}, docker.AuthConfiguration{})
+	}
+	server.CustomHandler("/images/.*/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")
+		user, ok := users[name]
+		if !ok {
+			server.DefaultHandler().ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(docker.Image{ID: name, Config: &docker.Config{User: user}})
+	}))
+}
+
+// fakeTopUID makes the processes of every container run as uid
+func fakeTopUID(server *fake.DockerServer, uid string) {
+	server.CustomHandler("/containers/.*/top", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(docker.TopResult{
+			Titles:    []string{"UID", "PID"},
+			Processes: [][]string{{uid, "42"}},
+		})
+	}))
+}
+
+var imageUsers = map[string]string{
+	"gofn/root":    "root",
+	"gofn/rootgid": "0:0",
+	"gofn/nouser":  "",
+	"gofn/app":     "app",
+}
+
+func TestRunAsNonRootUser(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	fakeImageUsers(server, client, imageUsers)
+
+	tests := []struct {
+		name    string
+		opts    ContainerOptions
+		want    string
+		wantErr error
+	}{
+		{"root image", ContainerOptions{Image: "gofn/root", RunAsNonRoot: true}, DefaultNonRootUser, nil},
+		{"root uid image", ContainerOptions{Image: "gofn/rootgid", RunAsNonRoot: true}, DefaultNonRootUser, nil},
+		{"image without user", ContainerOptions{Image: "gofn/nouser", RunAsNonRoot: true}, DefaultNonRootUser, nil},
+		{"custom user", ContainerOptions{Image: "gofn/root", RunAsNonRoot: true, NonRootUser: "1000:1000"}, "1000:1000", nil},
+		// the image user applies
+		{"non-root image", ContainerOptions{Image: "gofn/app", RunAsNonRoot: true}, "", nil},
+		{"allowed root", ContainerOptions{Image: "gofn/root", RunAsNonRoot: true, AllowRoot: true}, "", nil},
+		{"disabled", ContainerOptions{Image: "gofn/root"}, "", nil},
+		{"user", ContainerOptions{Image: "gofn/root", User: "1001"}, "1001", nil},
+		{"user replacing the non-root one", ContainerOptions{Image: "gofn/root", RunAsNonRoot: true, User: "app:staff"}, "app:staff", nil},
+		{"root user", ContainerOptions{Image: "gofn/app", RunAsNonRoot: true, User: "root"}, "", ErrRunningAsRoot},
+		{"root uid user", ContainerOptions{Image: "gofn/app", RunAsNonRoot: true, User: "0:0"}, "", ErrRunningAsRoot},
+		{"allowed root user", ContainerOptions{Image: "gofn/app", RunAsNonRoot: true, AllowRoot: true, User: "root"}, "root", nil},
+		{"root user without RunAsNonRoot", ContainerOptions{Image: "gofn/app", User: "root"}, "root", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created, err := FnContainer(client, tt.opts)
+			if err != tt.wantErr {
+				t.Fatalf("expected %v but found %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			container, err := client.InspectContainer(created.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if container.Config.User != tt.want {
+				t.Errorf("expected user %q but found %q", tt.want, container.Config.User)
+			}
+		})
+	}
+}
+
+func TestRunnerRunAsNonRootEnforcement(t *testing.T) {
+	tests := []struct {
+		name    string
+		topUID  string
+		opts    ContainerOptions
+		wantErr error
+	}{
+		{"non-root process", "65534", ContainerOptions{RunAsNonRoot: true}, nil},
+		{"root process", "root", ContainerOptions{RunAsNonRoot: true}, ErrRunningAsRoot},
+		{"root uid process", "0", ContainerOptions{RunAsNonRoot: true}, ErrRunningAsRoot},
+		{"allowed root process", "0", ContainerOptions{RunAsNonRoot: true, AllowRoot: true}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			fakeExit(server, 0, 0)
+			fakeTopUID(server, tt.topUID)
+
+			r := NewRunner(NewTestClient(server.URL(), t))
+			_, err := r.Run(context.Background(), testBuildOptions(), tt.opts)
+			if err != tt.wantErr {
+				t.Errorf("expected %v but found %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestReadableBy(t *testing.T) {
+	tests := []struct {
+		mode     uint32
+		dir      bool
+		uid, gid int
+		want     bool
+	}{
+		{0700, true, 65534, 65534, false},
+		{0750, true, 65534, 100, true},
+		{0740, true, 65534, 100, false},
+		{0755, true, 65534, 65534, true},
+		{0600, false, 1000, 1000, true},
+		{0600, false, 0, 0, true},
+		{0644, false, 65534, 65534, true},
+	}
+	for _, tt := range tests {
+		mode := os.FileMode(tt.mode)
+		if tt.dir {
+			mode |= os.ModeDir
+		}
+		if got := readableBy(mode, tt.uid, tt.gid, 1000, 100); got != tt.want {
+			t.Errorf("readableBy(%v, %d, %d) = %v, want %v", mode, tt.uid, tt.gid, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//+build !windows
+
+package provision
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the uid and gid owning the file described by info
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
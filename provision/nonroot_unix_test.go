@@ -0,0 +1,56 @@
+//+build !windows
+
+package provision
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunnerWarnsInaccessibleBinds(t *testing.T) {
+	if os.Getuid() == 65534 {
+		t.Skip("the test user is the non-root user")
+	}
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	fakeImageUsers(server, client, imageUsers)
+
+	private, err := ioutil.TempDir("", "gofn-private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(private)
+	shared, err := ioutil.TempDir("", "gofn-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(shared)
+	if err = os.Chmod(private, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(shared, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []string
+	r := NewRunner(client)
+	r.OnEvent = func(e Event) {
+		if e.Kind == EventWarning {
+			warnings = append(warnings, e.Message)
+		}
+	}
+	_, err = r.FnContainer(ContainerOptions{
+		Image:        "gofn/root",
+		RunAsNonRoot: true,
+		Volumes:      []string{private + ":/private", shared + ":/shared:ro", "cache:/cache"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], private) || !strings.Contains(warnings[0], DefaultNonRootUser) {
+		t.Errorf("expected a warning about %s only but found %v", private, warnings)
+	}
+}
@@ -0,0 +1,10 @@
+//+build windows
+
+package provision
+
+import "os"
+
+// fileOwner is not supported on windows, the files have no uid
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return
+}
@@ -0,0 +1,106 @@
+package provision
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// OutputStrategy selects how the output of a container is collected
+type OutputStrategy string
+
+const (
+	// OutputAuto, the zero value, attaches to remote daemons and reads the logs of local ones
+	OutputAuto OutputStrategy = ""
+	// OutputAttach streams the output through the attach connection, saving a round-trip per run
+	OutputAttach OutputStrategy = "attach"
+	// OutputLogs reads the whole output from the logs once the container exits
+	OutputLogs OutputStrategy = "logs"
+)
+
+func (r *Runner) outputStrategy() OutputStrategy {
+	if r.OutputStrategy != OutputAuto {
+		return r.OutputStrategy
+	}
+	if isLocalEndpoint(r.Client.Endpoint()) {
+		return OutputLogs
+	}
+	return OutputAttach
+}
+
+// isLocalEndpoint reports whether endpoint is a socket of the local daemon
+func isLocalEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "unix://") || strings.HasPrefix(endpoint, "npipe://")
+}
+
+// relayWriter copies the output of a container to its buffer and relays it to the writer of
+// the caller, RunOptions.Stdout or RunOptions.Stderr, until that writer fails
+type relayWriter struct {
+	name   string
+	buffer io.Writer
+	relay  io.Writer
+	err    error
+}
+
+// relayOutput returns the relayWriter of the stream name, it only writes to buffer without
+// relay and only to relay with streamOnly
+func relayOutput(name string, buffer io.Writer, relay io.Writer, streamOnly bool) *relayWriter {
+	if streamOnly {
+		buffer = ioutil.Discard
+	}
+	return &relayWriter{name: name, buffer: buffer, relay: relay}
+}
+
+func (w *relayWriter) Write(p []byte) (n int, err error) {
+	if w.relay != nil && w.err == nil {
+		w.err = safely(w.name+" writer", func() (err error) {
+			_, err = w.relay.Write(p)
+			return
+		})
+	}
+	return w.buffer.Write(p)
+}
+
+// warnings reports the failure of the relay, if any
+func (w *relayWriter) warnings() []string {
+	if w.err == nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s writer disabled: %v", w.name, w.err)}
+}
+
+// tailBuffer keeps the last max bytes written to it, so the end of an endless output with its
+// crash message is kept, all of them when max is zero
+type tailBuffer struct {
+	max     int64
+	buf     []byte
+	dropped bool
+}
+
+func (b *tailBuffer) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if b.max > 0 && int64(n) >= b.max {
+		b.dropped = b.dropped || len(b.buf) > 0 || int64(n) > b.max
+		b.buf = append(b.buf[:0], p[int64(n)-b.max:]...)
+		return
+	}
+	b.buf = append(b.buf, p...)
+	// the head is dropped once it doubled the limit, so it is not moved on every write
+	if b.max > 0 && int64(len(b.buf)) > 2*b.max {
+		b.buf = b.buf[:copy(b.buf, b.buf[int64(len(b.buf))-b.max:])]
+		b.dropped = true
+	}
+	return
+}
+
+// buffer returns the kept bytes and whether some were dropped
+func (b *tailBuffer) buffer() (buffer *bytes.Buffer, truncated bool) {
+	kept := b.buf
+	if b.max > 0 && int64(len(kept)) > b.max {
+		kept = kept[int64(len(kept))-b.max:]
+		b.dropped = true
+	}
+	return bytes.NewBuffer(kept), b.dropped
+}
@@ -0,0 +1,146 @@
+package provision
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// endpointRecorder counts the attach and logs requests received by the fake docker api
+type endpointRecorder struct {
+	mu            sync.Mutex
+	attaches      int
+	outputAttach  int
+	logs          int
+	stdoutPayload string
+}
+
+func recordEndpoints(server *fake.DockerServer, stdout string) *endpointRecorder {
+	rec := &endpointRecorder{stdoutPayload: stdout}
+	server.CustomHandler("/containers/.*/attach", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		rec.attaches++
+		if r.URL.Query().Get("stdout") == "1" {
+			rec.outputAttach++
+		}
+		rec.mu.Unlock()
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	server.CustomHandler("/containers/.*/logs", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		rec.logs++
+		rec.mu.Unlock()
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		writeFrame(w, 1, rec.stdoutPayload)
+	}))
+	return rec
+}
+
+func TestRunnerRunOutputStrategy(t *testing.T) {
+	tests := []struct {
+		strategy     OutputStrategy
+		wantStrategy OutputStrategy
+		wantLogs     int
+		wantAttached int
+		wantStdout   string
+	}{
+		{OutputAttach, OutputAttach, 0, 1, "Something happened"},
+		{OutputLogs, OutputLogs, 1, 0, "from logs"},
+		// the fake daemon is reached over tcp, so it is a remote one
+		{OutputAuto, OutputAttach, 0, 1, "Something happened"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.wantStrategy), func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			fakeExit(server, 0, 0)
+			rec := recordEndpoints(server, "from logs")
+
+			client := NewTestClient(server.URL(), t)
+			r := NewRunner(client)
+			r.OutputStrategy = tt.strategy
+			result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if result.OutputStrategy != tt.wantStrategy {
+				t.Errorf("expected strategy %q but found %q", tt.wantStrategy, result.OutputStrategy)
+			}
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			if rec.attaches != 1 {
+				t.Errorf("expected one attach for the stdin but found %d", rec.attaches)
+			}
+			if rec.logs != tt.wantLogs {
+				t.Errorf("expected %d logs requests but found %d", tt.wantLogs, rec.logs)
+			}
+			if rec.outputAttach != tt.wantAttached {
+				t.Errorf("expected %d output attaches but found %d", tt.wantAttached, rec.outputAttach)
+			}
+			if !strings.Contains(result.Stdout.String(), tt.wantStdout) {
+				t.Errorf("expected stdout to contain %q but found %q", tt.wantStdout, result.Stdout.String())
+			}
+		})
+	}
+}
+
+func TestRunnerOutputStrategyLocalDaemon(t *testing.T) {
+	client, err := docker.NewClient("unix:///var/run/docker.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := NewRunner(client).outputStrategy(); s != OutputLogs {
+		t.Errorf("expected %q for a local daemon but found %q", OutputLogs, s)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		max       int64
+		writes    []string
+		want      string
+		truncated bool
+	}{
+		{0, []string{"abc", "def"}, "abcdef", false},
+		{6, []string{"abc", "def"}, "abcdef", false},
+		{4, []string{"abc", "def"}, "cdef", true},
+		{4, []string{"abcdefgh"}, "efgh", true},
+		{4, []string{"abcd"}, "abcd", false},
+		// the head dropped once it doubled the limit
+		{2, []string{"a", "b", "c", "d", "e"}, "de", true},
+	}
+	for _, test := range tests {
+		b := &tailBuffer{max: test.max}
+		for _, w := range test.writes {
+			if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+				t.Fatalf("unexpected write %d, %v", n, err)
+			}
+		}
+		buffer, truncated := b.buffer()
+		if buffer.String() != test.want || truncated != test.truncated {
+			t.Errorf("%d %v: expected %q, %v but found %q, %v", test.max, test.writes, test.want, test.truncated, buffer.String(), truncated)
+		}
+	}
+}
+
+func TestFnRunResultMaxOutputBytes(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 1, 0)
+	fakeLogs(server, strings.Repeat("loop\n", 1000), "panic: crash\n")
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	result, err := FnRunResult(context.Background(), client, container.ID, nil, RunOptions{MaxOutputBytes: 10})
+	if execErr, ok := err.(*ExecutionError); !ok || execErr.Stderr != "ic: crash\n" {
+		t.Errorf("expected the end of the crash message in the execution error but found %#v", err)
+	}
+	if result.Stdout.String() != "loop\nloop\n" || !result.Truncated {
+		t.Errorf("expected the end of the output to be kept but found %q, truncated %v", result.Stdout, result.Truncated)
+	}
+}
@@ -0,0 +1,512 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DefaultDrainTimeout bounds the wait of an update for the invocation running in an old container
+const DefaultDrainTimeout = time.Minute
+
+var (
+	// ErrPoolClosed is raised when a closed pool is used
+	ErrPoolClosed = errors.New("provision: container pool closed")
+
+	// ErrPoolUpdating is raised when UpdateImage is called during another update
+	ErrPoolUpdating = errors.New("provision: container pool update in progress")
+
+	// ErrNotReady is raised by the default readiness check of a warm container that is not running
+	ErrNotReady = errors.New("provision: warm container not ready")
+
+	// ErrPoolRolledBack is raised when an update was rolled back to the previous image
+	ErrPoolRolledBack = errors.New("provision: container pool update rolled back")
+)
+
+// PoolUpdateError is raised when the warm containers of the new image failed and the pool kept the previous one
+type PoolUpdateError struct {
+	Image string
+	Err   error
+}
+
+func (e *PoolUpdateError) Error() string {
+	return fmt.Sprintf("%v: %s: %v", ErrPoolRolledBack, e.Image, e.Err)
+}
+
+// Unwrap returns ErrPoolRolledBack
+func (e *PoolUpdateError) Unwrap() error {
+	return ErrPoolRolledBack
+}
+
+// PoolOptions size a ContainerPool
+type PoolOptions struct {
+	// Size is the number of warm containers kept by the pool
+	Size int
+	// MinAvailable is the capacity floor kept while the image is updated, Size when zero
+	MinAvailable int
+	// DrainTimeout bounds the wait for the invocation of an old container, DefaultDrainTimeout when zero
+	DrainTimeout time.Duration
+	// Ready checks a started warm container, the container must be running when nil
+	Ready func(ctx context.Context, client *docker.Client, containerID string) error
+	// WarmupCmd is executed in each ready warm container before it can be lent, e.g. a first
+	// dummy request of a JIT runtime, with WarmupInput as its stdin. A container whose warm-up
+	// fails or runs longer than WarmupTimeout, DefaultWarmupTimeout when zero, is discarded.
+	WarmupCmd     []string
+	WarmupInput   string
+	WarmupTimeout time.Duration
+	// WarmupBudget is the number of discarded containers a Start or an UpdateImage replaces
+	// before it fails with a WarmupError, DefaultWarmupBudget when zero and none when negative
+	WarmupBudget int
+}
+
+// ContainerPool keeps started containers warm and lends them to invocations
+type ContainerPool struct {
+	Runner *Runner
+	// Build builds the image given to UpdateImage, it is pulled when nil
+	Build *BuildOptions
+
+	opts    ContainerOptions
+	options PoolOptions
+
+	mu         sync.Mutex
+	containers map[string]*warmContainer
+	changed    chan struct{}
+	updating   bool
+	closed     bool
+	// replenishErr and replenishedAt are the outcome of the last Start or UpdateImage
+	replenishErr  error
+	replenishedAt time.Time
+	// warmupFailures counts the failed warm-ups, lastWarmup is the duration of the last successful one
+	warmupFailures int
+	lastWarmup     time.Duration
+}
+
+// PoolStats is a snapshot of the health of a ContainerPool, see ContainerPool.Stats
+type PoolStats struct {
+	Image string
+	// Target is the number of warm containers kept by the pool, PoolOptions.Size
+	Target int
+	// Available are the warm containers that can be lent, Busy the lent ones and Retiring
+	// the containers of the previous image removed by an update
+	Available int
+	Busy      int
+	Retiring  int
+	Updating  bool
+	// AverageAge is the mean time since the warm containers were started, zero without containers
+	AverageAge time.Duration
+	// LastReplenishError is the error of the last Start or UpdateImage, empty when it succeeded
+	LastReplenishError string
+	// LastReplenishAt is when the last Start or UpdateImage ended, zero before the first one
+	LastReplenishAt time.Time
+	// LastWarmup is the duration of the last successful warm-up and WarmupFailures the number
+	// of discarded containers since the pool was created, see PoolOptions.WarmupCmd
+	LastWarmup     time.Duration
+	WarmupFailures int
+}
+
+type warmContainer struct {
+	container *docker.Container
+	image     string
+	busy      bool
+	retiring  bool
+	started   time.Time
+	// released is closed when a retiring container is released
+	released chan struct{}
+}
+
+// NewContainerPool returns a pool of containers created by r with opts, Start fills it
+func NewContainerPool(r *Runner, opts ContainerOptions, options PoolOptions) *ContainerPool {
+	if options.MinAvailable == 0 || options.MinAvailable > options.Size {
+		options.MinAvailable = options.Size
+	}
+	if options.DrainTimeout == 0 {
+		options.DrainTimeout = DefaultDrainTimeout
+	}
+	p := &ContainerPool{
+		Runner:     r,
+		opts:       opts,
+		options:    options,
+		containers: make(map[string]*warmContainer),
+		changed:    make(chan struct{}),
+	}
+	r.trackPool(p, true)
+	return p
+}
+
+// Image returns the image of the containers lent by the pool, as given before
+// Runner.RewriteReference
+func (p *ContainerPool) Image() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.opts.Image
+}
+
+// Stats returns the state of the pool, taken under its lock so the numbers are consistent
+func (p *ContainerPool) Stats() (stats PoolStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats = PoolStats{
+		Image:           p.opts.Image,
+		Target:          p.options.Size,
+		Updating:        p.updating,
+		LastReplenishAt: p.replenishedAt,
+		LastWarmup:      p.lastWarmup,
+		WarmupFailures:  p.warmupFailures,
+	}
+	if p.replenishErr != nil {
+		stats.LastReplenishError = p.replenishErr.Error()
+	}
+	if len(p.containers) == 0 {
+		return
+	}
+	now := time.Now()
+	var age time.Duration
+	for _, w := range p.containers {
+		switch {
+		case w.retiring:
+			stats.Retiring++
+		case w.busy:
+			stats.Busy++
+		default:
+			stats.Available++
+		}
+		age += now.Sub(w.started)
+	}
+	stats.AverageAge = age / time.Duration(len(p.containers))
+	return
+}
+
+// replenished records the outcome of a Start or an UpdateImage
+func (p *ContainerPool) replenished(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.replenishErr, p.replenishedAt = err, time.Now()
+}
+
+// signal wakes up the callers waiting for a state change, p.mu must be held
+func (p *ContainerPool) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Start starts warm containers until the pool has Size of them
+func (p *ContainerPool) Start(ctx context.Context) (err error) {
+	defer func() {
+		p.replenished(err)
+	}()
+	p.mu.Lock()
+	image := p.opts.Image
+	missing := p.options.Size - len(p.containers)
+	p.mu.Unlock()
+	budget := p.warmupBudget()
+	for i := 0; i < missing; i++ {
+		var w *warmContainer
+		w, err = p.startWarmed(ctx, image, &budget)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			err = ErrPoolClosed
+			_ = FnRemove(p.Runner.Client, w.container.ID)
+			return
+		}
+		p.containers[w.container.ID] = w
+		p.signal()
+		p.mu.Unlock()
+	}
+	return
+}
+
+// warmupBudget returns the number of failed warm-ups a Start or an UpdateImage replaces
+func (p *ContainerPool) warmupBudget() int {
+	if p.options.WarmupBudget == 0 {
+		return DefaultWarmupBudget
+	}
+	return p.options.WarmupBudget
+}
+
+// startWarmed starts a warm container of image, replacing the containers whose warm-up failed
+// while budget lasts
+func (p *ContainerPool) startWarmed(ctx context.Context, image string, budget *int) (w *warmContainer, err error) {
+	for {
+		w, err = p.startWarm(ctx, image)
+		if _, failed := err.(*WarmupError); !failed || *budget <= 0 || ctx.Err() != nil {
+			return
+		}
+		*budget--
+	}
+}
+
+// startWarm creates and starts a container of image, checks it is ready and warms it up
+func (p *ContainerPool) startWarm(ctx context.Context, image string) (w *warmContainer, err error) {
+	opts := p.opts
+	opts.Image = image
+	container, err := p.Runner.createContainer(ctx, p.Runner.rewriteContainer(opts))
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = FnRemove(p.Runner.Client, container.ID)
+		}
+	}()
+	err = p.Runner.Client.StartContainerWithContext(container.ID, nil, ctx)
+	if err != nil {
+		return
+	}
+	ready := p.options.Ready
+	if ready == nil {
+		ready = isRunning
+	}
+	err = ready(ctx, p.Runner.Client, container.ID)
+	if err != nil {
+		return
+	}
+	if len(p.options.WarmupCmd) > 0 {
+		var duration time.Duration
+		duration, err = p.warmUp(ctx, container.ID)
+		p.mu.Lock()
+		if err != nil {
+			p.warmupFailures++
+		} else {
+			p.lastWarmup = duration
+		}
+		p.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	w = &warmContainer{container: container, image: image, started: time.Now(), released: make(chan struct{})}
+	return
+}
+
+func isRunning(ctx context.Context, client *docker.Client, containerID string) (err error) {
+	container, err := client.InspectContainerWithContext(containerID, ctx)
+	if err != nil {
+		return
+	}
+	if !container.State.Running {
+		err = ErrNotReady
+	}
+	return
+}
+
+// Acquire lends a warm container of the current image, waiting for one to be released
+// when all of them are busy. The container must be given back with Release.
+func (p *ContainerPool) Acquire(ctx context.Context) (container *docker.Container, err error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			err = ErrPoolClosed
+			return
+		}
+		for _, w := range p.containers {
+			if !w.busy && !w.retiring {
+				w.busy = true
+				p.mu.Unlock()
+				container = w.container
+				return
+			}
+		}
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
+
+// Release gives back a container lent by Acquire once its invocation completed
+func (p *ContainerPool) Release(containerID string) {
+	p.mu.Lock()
+	w, ok := p.containers[containerID]
+	if !ok || !w.busy {
+		p.mu.Unlock()
+		return
+	}
+	w.busy = false
+	remove := false
+	switch {
+	case w.retiring:
+		close(w.released)
+	case p.closed:
+		delete(p.containers, containerID)
+		remove = true
+	}
+	p.signal()
+	p.mu.Unlock()
+	if remove {
+		_ = FnRemove(p.Runner.Client, containerID)
+	}
+}
+
+// available returns the number of containers that can still be lent, p.mu must be held
+func (p *ContainerPool) available() (n int) {
+	for _, w := range p.containers {
+		if !w.retiring {
+			n++
+		}
+	}
+	return
+}
+
+// UpdateImage replaces the warm containers by containers of newRef, built with Build or pulled.
+// The new containers are started and checked before any old one is retired, an old container
+// is removed once its invocation completed or DrainTimeout expired, and never while it would
+// leave the pool below MinAvailable. When a new container is not ready the pool keeps the
+// previous image and a PoolUpdateError is returned.
+func (p *ContainerPool) UpdateImage(ctx context.Context, newRef string) (err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrPoolClosed
+	}
+	if p.updating {
+		p.mu.Unlock()
+		return ErrPoolUpdating
+	}
+	p.updating = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.updating = false
+		p.mu.Unlock()
+		if err != ErrPoolClosed {
+			p.replenished(err)
+		}
+	}()
+
+	image, err := p.ensureImage(ctx, newRef)
+	if err != nil {
+		return
+	}
+	var replacements []*warmContainer
+	budget := p.warmupBudget()
+	for i := 0; i < p.options.Size; i++ {
+		var w *warmContainer
+		w, err = p.startWarmed(ctx, image, &budget)
+		if err != nil {
+			for _, started := range replacements {
+				_ = FnRemove(p.Runner.Client, started.container.ID)
+			}
+			return &PoolUpdateError{Image: image, Err: err}
+		}
+		replacements = append(replacements, w)
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		for _, w := range replacements {
+			_ = FnRemove(p.Runner.Client, w.container.ID)
+		}
+		return ErrPoolClosed
+	}
+	var old []*warmContainer
+	for _, w := range p.containers {
+		old = append(old, w)
+	}
+	for _, w := range replacements {
+		p.containers[w.container.ID] = w
+	}
+	p.opts.Image = image
+	p.signal()
+	p.mu.Unlock()
+
+	return p.retire(ctx, old)
+}
+
+// retire removes the old containers once released, keeping at least MinAvailable containers to
+// lend. An old container skipped for the floor keeps serving until the round retiring the others
+// ended, each round retires at least one so no old container is left behind when the floor can
+// not be kept.
+func (p *ContainerPool) retire(ctx context.Context, old []*warmContainer) (err error) {
+	deadline := time.NewTimer(p.options.DrainTimeout)
+	defer deadline.Stop()
+	pending := old
+	for len(pending) > 0 {
+		var batch, skipped []*warmContainer
+		p.mu.Lock()
+		for _, w := range pending {
+			if p.available()-1 < p.options.MinAvailable && len(batch) > 0 {
+				// the old container keeps serving until the pool has enough new ones
+				skipped = append(skipped, w)
+				continue
+			}
+			w.retiring = true
+			if !w.busy {
+				close(w.released)
+			}
+			batch = append(batch, w)
+		}
+		p.mu.Unlock()
+		for _, w := range batch {
+			select {
+			case <-w.released:
+			case <-deadline.C:
+				// the invocation overran the drain, later waits must not block
+				deadline.Reset(0)
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			p.mu.Lock()
+			delete(p.containers, w.container.ID)
+			p.signal()
+			p.mu.Unlock()
+			removeErr := FnRemove(p.Runner.Client, w.container.ID)
+			if err == nil {
+				err = removeErr
+			}
+		}
+		pending = skipped
+	}
+	return
+}
+
+// ensureImage builds or pulls the rewritten reference of newRef returning the image name to
+// run, the warm containers rewrite it when they are created
+func (p *ContainerPool) ensureImage(ctx context.Context, newRef string) (image string, err error) {
+	if p.Build != nil {
+		opts := *p.Build
+		opts.ImageName = newRef
+		image = opts.GetImageName()
+		_, _, err = imageBuild(ctx, p.Runner.Client, p.Runner.rewriteBuild(&opts))
+		return
+	}
+	err = pull(ctx, p.Runner.Client, p.Runner.rewriteBuild(&BuildOptions{ImageName: newRef, DoNotUsePrefixImageName: true}))
+	image = newRef
+	return
+}
+
+// Close removes the idle containers, the lent ones are removed when released
+func (p *ContainerPool) Close() (err error) {
+	p.mu.Lock()
+	p.closed = true
+	var idle []string
+	for id, w := range p.containers {
+		if !w.busy {
+			idle = append(idle, id)
+			delete(p.containers, id)
+		}
+	}
+	p.signal()
+	p.mu.Unlock()
+	p.Runner.trackPool(p, false)
+	for _, id := range idle {
+		removeErr := FnRemove(p.Runner.Client, id)
+		if err == nil {
+			err = removeErr
+		}
+	}
+	return
+}
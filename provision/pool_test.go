@@ -0,0 +1,461 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+func startTestPool(t *testing.T, client *docker.Client, options PoolOptions) *ContainerPool {
+	image := createFakeImage(client)
+	pool := NewContainerPool(NewRunner(client), ContainerOptions{Image: image}, options)
+	if err := pool.Start(context.Background()); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	return pool
+}
+
+func TestContainerPoolUpdateImage(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	pool := startTestPool(t, client, PoolOptions{Size: 3, MinAvailable: 2, DrainTimeout: 5 * time.Second})
+	defer pool.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var invocations, failures int64
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				container, err := pool.Acquire(context.Background())
+				if err != nil {
+					atomic.AddInt64(&failures, 1)
+					return
+				}
+				// the invocation must find its container before and after running
+				_, err = client.InspectContainer(container.ID)
+				time.Sleep(2 * time.Millisecond)
+				if _, inspectErr := client.InspectContainer(container.ID); err != nil || inspectErr != nil {
+					atomic.AddInt64(&failures, 1)
+				}
+				atomic.AddInt64(&invocations, 1)
+				pool.Release(container.ID)
+			}
+		}()
+	}
+	minAvailable := int64(pool.options.Size)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			pool.mu.Lock()
+			if n := int64(pool.available()); n < atomic.LoadInt64(&minAvailable) {
+				atomic.StoreInt64(&minAvailable, n)
+			}
+			pool.mu.Unlock()
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	err := pool.UpdateImage(context.Background(), "gofn/python:v2")
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if failures > 0 {
+		t.Errorf("expected every invocation to find its container but %d did not", failures)
+	}
+	if invocations == 0 {
+		t.Error("expected invocations during the update")
+	}
+	if n := atomic.LoadInt64(&minAvailable); n < 2 {
+		t.Errorf("expected the capacity to stay above 2 but it dropped to %d", n)
+	}
+	if image := pool.Image(); image != "gofn/python:v2" {
+		t.Errorf("expected the pool to use gofn/python:v2 but found %q", image)
+	}
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 3 {
+		t.Errorf("expected the 3 old containers to be removed but found %d containers", len(containers))
+	}
+	for _, c := range containers {
+		if c.Image != "gofn/python:v2" {
+			t.Errorf("expected container %s to run gofn/python:v2 but found %q", c.ID, c.Image)
+		}
+	}
+}
+
+func TestContainerPoolUpdateRollback(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	errBroken := errors.New("health check failed")
+	pool := startTestPool(t, client, PoolOptions{
+		Size: 2,
+		Ready: func(ctx context.Context, client *docker.Client, containerID string) error {
+			container, err := client.InspectContainer(containerID)
+			if err != nil {
+				return err
+			}
+			if container.Config.Image == "gofn/python:broken" {
+				return errBroken
+			}
+			return nil
+		},
+	})
+	defer pool.Close()
+	image := pool.Image()
+
+	err := pool.UpdateImage(context.Background(), "gofn/python:broken")
+	updateErr, ok := err.(*PoolUpdateError)
+	if !ok || updateErr.Unwrap() != ErrPoolRolledBack || updateErr.Err != errBroken {
+		t.Fatalf("expected a rolled back update but found %v", err)
+	}
+	if pool.Image() != image {
+		t.Errorf("expected the pool to keep %q but found %q", image, pool.Image())
+	}
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 2 {
+		t.Errorf("expected the new containers to be removed but found %d containers", len(containers))
+	}
+	for _, c := range containers {
+		if c.Image != image {
+			t.Errorf("expected container %s to run %q but found %q", c.ID, image, c.Image)
+		}
+	}
+}
+
+func TestContainerPoolDrainTimeout(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	pool := startTestPool(t, client, PoolOptions{Size: 1, DrainTimeout: 20 * time.Millisecond})
+	defer pool.Close()
+
+	stuck, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = pool.UpdateImage(context.Background(), "gofn/python:v2")
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected the update to wait for the drain but it took %v", elapsed)
+	}
+	if _, err = client.InspectContainer(stuck.ID); err == nil {
+		t.Error("expected the container to be removed after the drain timeout")
+	}
+	// releasing a removed container is harmless
+	pool.Release(stuck.ID)
+
+	container, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.ID == stuck.ID {
+		t.Error("expected a new container")
+	}
+}
+
+func TestContainerPoolClose(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	pool := startTestPool(t, client, PoolOptions{Size: 2})
+
+	lent, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pool.Close(); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, err = client.InspectContainer(lent.ID); err != nil {
+		t.Errorf("expected the lent container to survive the close but found %v", err)
+	}
+	pool.Release(lent.ID)
+	if _, err = client.InspectContainer(lent.ID); err == nil {
+		t.Error("expected the released container to be removed")
+	}
+	if _, err = pool.Acquire(context.Background()); err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed but found %v", err)
+	}
+}
+
+func TestContainerPoolRetireBelowFloor(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	pool := startTestPool(t, client, PoolOptions{Size: 2, DrainTimeout: time.Second})
+	defer pool.Close()
+
+	// the old containers are retired without replacements, e.g. once the new ones failed
+	var old []*warmContainer
+	pool.mu.Lock()
+	for _, w := range pool.containers {
+		old = append(old, w)
+	}
+	pool.mu.Unlock()
+	if err := pool.retire(context.Background(), old); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	pool.mu.Lock()
+	left := len(pool.containers)
+	pool.mu.Unlock()
+	if left != 0 {
+		t.Errorf("expected the containers skipped for the floor to be retired later but %d are left", left)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected no old container to be lent but found %v", err)
+	}
+}
+
+func TestContainerPoolStats(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	var failReady int32
+	ready := func(ctx context.Context, client *docker.Client, containerID string) error {
+		if atomic.LoadInt32(&failReady) == 1 {
+			return ErrNotReady
+		}
+		return nil
+	}
+	image := createFakeImage(client)
+	pool := NewContainerPool(NewRunner(client), ContainerOptions{Image: image}, PoolOptions{Size: 2, Ready: ready})
+	defer pool.Close()
+	check := func(step string, want PoolStats) {
+		stats := pool.Stats()
+		if stats.Image != image || stats.Target != 2 || stats.Available != want.Available || stats.Busy != want.Busy ||
+			stats.Retiring != 0 || stats.Updating || stats.LastReplenishError != want.LastReplenishError {
+			t.Errorf("%s: expected %+v but found %+v", step, want, stats)
+		}
+		if stats.LastReplenishAt.IsZero() {
+			t.Errorf("%s: expected the replenishment time", step)
+		}
+		if (stats.Available+stats.Busy > 0) != (stats.AverageAge > 0) {
+			t.Errorf("%s: unexpected average age %v", step, stats.AverageAge)
+		}
+	}
+	if stats := pool.Stats(); stats.Available != 0 || !stats.LastReplenishAt.IsZero() || stats.AverageAge != 0 {
+		t.Errorf("expected an empty pool but found %+v", stats)
+	}
+
+	atomic.StoreInt32(&failReady, 1)
+	if err := pool.Start(context.Background()); err != ErrNotReady {
+		t.Fatalf("expected the warm container not to be ready but found %v", err)
+	}
+	check("failed replenish", PoolStats{LastReplenishError: ErrNotReady.Error()})
+
+	atomic.StoreInt32(&failReady, 0)
+	if err := pool.Start(context.Background()); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	check("replenished", PoolStats{Available: 2})
+
+	first, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("one acquired", PoolStats{Available: 1, Busy: 1})
+	second, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("all acquired", PoolStats{Busy: 2})
+	pool.Release(first.ID)
+	pool.Release(second.ID)
+	check("released", PoolStats{Available: 2})
+}
+
+// fakeWarmups makes the first failing warm-ups of the fake docker api exit with 1, each
+// warm-up waits for gate when it is not nil. It returns the number of warm-ups started.
+func fakeWarmups(server *fake.DockerServer, failing int, gate chan struct{}) (started func() int) {
+	var mu sync.Mutex
+	var n int
+	exits := map[string]int{}
+	server.CustomHandler("/exec/.*/start", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Split(r.URL.Path, "/")[2]
+		mu.Lock()
+		n++
+		if n <= failing {
+			exits[id] = 1
+		}
+		mu.Unlock()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n"))
+		if gate != nil {
+			<-gate
+		}
+	}))
+	server.CustomHandler("/exec/.*/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Split(r.URL.Path, "/")[2]
+		mu.Lock()
+		code := exits[id]
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(docker.ExecInspect{ID: id, ExitCode: code})
+	}))
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+}
+
+func TestContainerPoolWarmup(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	started := fakeWarmups(server, 2, nil)
+	var execs []docker.CreateExecOptions
+	server.CustomHandler("/containers/.*/exec", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var opts docker.CreateExecOptions
+		_ = json.Unmarshal(body, &opts)
+		execs = append(execs, opts)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+	pool := startTestPool(t, client, PoolOptions{Size: 2, WarmupCmd: []string{"warm", "up"}, WarmupInput: `{"ping":true}`})
+	defer pool.Close()
+
+	if started() != 4 {
+		t.Errorf("expected the 2 failed warm-ups to be replaced but found %d warm-ups", started())
+	}
+	if !reflect.DeepEqual(execs[0].Cmd, []string{"warm", "up"}) || !execs[0].AttachStdin {
+		t.Errorf("expected the warm-up command with its input but found %+v", execs[0])
+	}
+	stats := pool.Stats()
+	if stats.Available != 2 || stats.WarmupFailures != 2 || stats.LastWarmup <= 0 || stats.LastReplenishError != "" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 2 {
+		t.Errorf("expected the containers whose warm-up failed to be discarded but found %d containers", len(containers))
+	}
+}
+
+func TestContainerPoolWarmupBudget(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	started := fakeWarmups(server, 10, nil)
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+	pool := NewContainerPool(NewRunner(client), ContainerOptions{Image: image}, PoolOptions{Size: 2, WarmupCmd: []string{"warm"}, WarmupBudget: 1})
+	defer pool.Close()
+
+	err := pool.Start(context.Background())
+	if e, ok := err.(*WarmupError); !ok || e.Unwrap() != ErrWarmupFailed || e.Err.(*ExecutionError).ExitCode != 1 {
+		t.Fatalf("expected a WarmupError once the budget is spent but found %v", err)
+	}
+	if started() != 2 {
+		t.Errorf("expected one failed warm-up to be replaced but found %d warm-ups", started())
+	}
+	if stats := pool.Stats(); stats.Available != 0 || stats.WarmupFailures != 2 || stats.LastReplenishError != err.Error() {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	containers, _ := client.ListContainers(docker.ListContainersOptions{All: true})
+	if len(containers) != 0 {
+		t.Errorf("expected the containers whose warm-up failed to be discarded but found %d containers", len(containers))
+	}
+}
+
+func TestContainerPoolWarmupGating(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	gate := make(chan struct{})
+	started := fakeWarmups(server, 0, gate)
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+	pool := NewContainerPool(NewRunner(client), ContainerOptions{Image: image}, PoolOptions{Size: 1, WarmupCmd: []string{"warm"}})
+	defer pool.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- pool.Start(context.Background())
+	}()
+	for started() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected no container to lend during its warm-up but found %v", err)
+	}
+	if stats := pool.Stats(); stats.Available != 0 {
+		t.Errorf("expected the warming container not to be available but found %+v", stats)
+	}
+	close(gate)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if stats := pool.Stats(); stats.Available != 1 {
+		t.Errorf("expected the warmed container to be available but found %+v", stats)
+	}
+}
+
+func TestContainerPoolWarmupTimeout(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	gate := make(chan struct{})
+	defer close(gate)
+	fakeWarmups(server, 0, gate)
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+	pool := NewContainerPool(NewRunner(client), ContainerOptions{Image: image}, PoolOptions{
+		Size:          1,
+		WarmupCmd:     []string{"warm"},
+		WarmupTimeout: 20 * time.Millisecond,
+		WarmupBudget:  -1,
+	})
+	defer pool.Close()
+
+	err := pool.Start(context.Background())
+	if e, ok := err.(*WarmupError); !ok || e.Err != context.DeadlineExceeded {
+		t.Fatalf("expected the warm-up to time out but found %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package provision
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Built-in annotation keys of Presets.ApplyAnnotations
+const (
+	// AnnotationTier selects the CPU and memory limits of a tier preset, e.g. tier: small
+	AnnotationTier = "tier"
+	// AnnotationTimeout is the execution timeout of the function, e.g. timeout: 60s
+	AnnotationTimeout = "timeout"
+	// AnnotationNetwork is the network policy of the function: none disables the network,
+	// default keeps the daemon default one and any other value is the network to join
+	AnnotationNetwork = "network"
+	// AnnotationReadOnly mounts the root filesystem read-only, e.g. readonly: true
+	AnnotationReadOnly = "readonly"
+)
+
+var (
+	// ErrUnknownAnnotation is raised in strict mode for an annotation matching no preset
+	ErrUnknownAnnotation = errors.New("provision: unknown annotation")
+
+	// ErrInvalidAnnotation is raised when the value of a built-in annotation is malformed
+	ErrInvalidAnnotation = errors.New("provision: invalid annotation")
+)
+
+// UnknownAnnotationsError lists the annotations matching no preset in strict mode
+type UnknownAnnotationsError struct {
+	Annotations []string
+}
+
+func (e *UnknownAnnotationsError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrUnknownAnnotation, strings.Join(e.Annotations, ", "))
+}
+
+// Unwrap returns ErrUnknownAnnotation
+func (e *UnknownAnnotationsError) Unwrap() error {
+	return ErrUnknownAnnotation
+}
+
+// InvalidAnnotationError is raised when the value of a built-in annotation is malformed
+type InvalidAnnotationError struct {
+	Key, Value string
+	Err        error
+}
+
+func (e *InvalidAnnotationError) Error() string {
+	return fmt.Sprintf("%v: %s: %q: %v", ErrInvalidAnnotation, e.Key, e.Value, e.Err)
+}
+
+// Unwrap returns ErrInvalidAnnotation
+func (e *InvalidAnnotationError) Unwrap() error {
+	return ErrInvalidAnnotation
+}
+
+// Preset mutates the options of the functions annotated with it
+type Preset func(*ContainerOptions, *BuildOptions)
+
+// AnnotationConflict is an option an annotation would have set differently than an explicitly
+// set option, or than another annotation
+type AnnotationConflict struct {
+	// Annotation is the key of the annotation whose value of Field was dropped
+	Annotation string
+	// Field is the option, e.g. Container.Memory or Container.EnvTemplate[TOKEN]
+	Field string
+	// With is the annotation whose value was kept, empty when it is the explicitly set option
+	With string
+}
+
+// AnnotationReport tells what Presets.ApplyAnnotations did with each annotation, the keys are sorted
+type AnnotationReport struct {
+	// Applied are the annotations resolved to a preset, a conflict may have dropped some of their options
+	Applied []string
+	// Unknown are the annotations matching no preset, they are errors in strict mode
+	Unknown []string
+	// Conflicts are the options of the applied annotations that were dropped
+	Conflicts []AnnotationConflict
+}
+
+// tierPresets are the built-in presets of AnnotationTier
+var tierPresets = map[string]struct {
+	nanoCPUs, memory int64
+}{
+	"small":  {5e8, 256 << 20},
+	"medium": {1e9, 512 << 20},
+	"large":  {2e9, 2 << 30},
+}
+
+// Presets translates the annotations describing functions, e.g. tier: small, into options.
+// An annotation key: value resolves to the preset registered as key=value, the built-in keys
+// with a free value, timeout, network and readonly, are resolved from their value otherwise.
+type Presets struct {
+	// Strict fails ApplyAnnotations on the annotations matching no preset
+	Strict bool
+
+	mu      sync.RWMutex
+	presets map[string]Preset
+}
+
+// NewPresets returns the registry of the built-in presets, the tiers small, medium and large
+func NewPresets() *Presets {
+	p := &Presets{presets: make(map[string]Preset)}
+	for name, tier := range tierPresets {
+		tier := tier
+		p.RegisterPreset(AnnotationTier+"="+name, func(opts *ContainerOptions, _ *BuildOptions) {
+			opts.NanoCPUs = tier.nanoCPUs
+			opts.Memory = tier.memory
+		})
+	}
+	return p
+}
+
+// RegisterPreset registers mutate as the preset name, of the form key=value, replacing any
+// preset of that name, a built-in one included
+func (p *Presets) RegisterPreset(name string, mutate func(*ContainerOptions, *BuildOptions)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.presets == nil {
+		p.presets = make(map[string]Preset)
+	}
+	p.presets[name] = mutate
+}
+
+// resolve returns the preset of the annotation key: value, nil when none matches
+func (p *Presets) resolve(key, value string) (preset Preset, err error) {
+	p.mu.RLock()
+	preset = p.presets[key+"="+value]
+	p.mu.RUnlock()
+	if preset != nil {
+		return
+	}
+	switch key {
+	case AnnotationTimeout:
+		var timeout time.Duration
+		timeout, err = time.ParseDuration(value)
+		if err == nil && timeout <= 0 {
+			err = errors.New("the timeout must be positive")
+		}
+		preset = func(opts *ContainerOptions, _ *BuildOptions) {
+			opts.ExecutionTimeout = timeout
+		}
+	case AnnotationNetwork:
+		preset = func(opts *ContainerOptions, _ *BuildOptions) {
+			switch value {
+			case "none":
+				opts.Egress.Mode = EgressNone
+			case "default":
+			default:
+				opts.Network = value
+			}
+		}
+	case AnnotationReadOnly:
+		var readOnly bool
+		readOnly, err = strconv.ParseBool(value)
+		preset = func(opts *ContainerOptions, _ *BuildOptions) {
+			opts.ReadOnlyRootfs = readOnly
+		}
+	}
+	if err != nil {
+		preset, err = nil, &InvalidAnnotationError{Key: key, Value: value, Err: err}
+	}
+	return
+}
+
+// ApplyAnnotations resolves annotations into the options of a function. The options explicitly
+// set in containerOpts and buildOpts, the non-zero ones, take precedence over the annotations:
+// the value of an annotation is only used for a zero option, a different one is reported as a
+// conflict. The annotations are applied in the order of their keys, the first one setting an
+// option wins over the next ones. Slices are appended to instead, and maps merged key by key.
+func (p *Presets) ApplyAnnotations(annotations map[string]string, containerOpts ContainerOptions, buildOpts BuildOptions) (resolvedContainer ContainerOptions, resolvedBuild BuildOptions, report AnnotationReport, err error) {
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	resolvedContainer, resolvedBuild = containerOpts, buildOpts
+	container := reflect.ValueOf(&resolvedContainer).Elem()
+	build := reflect.ValueOf(&resolvedBuild).Elem()
+	// setBy are the annotations that set an option
+	setBy := make(map[string]string)
+	for _, key := range keys {
+		var preset Preset
+		preset, err = p.resolve(key, annotations[key])
+		if err != nil {
+			return
+		}
+		if preset == nil {
+			report.Unknown = append(report.Unknown, key)
+			continue
+		}
+		var c ContainerOptions
+		var b BuildOptions
+		preset(&c, &b)
+		m := annotationMerge{key: key, setBy: setBy, report: &report}
+		m.merge("Container", container, reflect.ValueOf(c))
+		m.merge("Build", build, reflect.ValueOf(b))
+		report.Applied = append(report.Applied, key)
+	}
+	if p.Strict && len(report.Unknown) > 0 {
+		err = &UnknownAnnotationsError{Annotations: report.Unknown}
+	}
+	return
+}
+
+// annotationMerge merges the options set by the annotation key into the resolved ones
+type annotationMerge struct {
+	key    string
+	setBy  map[string]string
+	report *AnnotationReport
+}
+
+func (m annotationMerge) merge(prefix string, resolved, set reflect.Value) {
+	for i := 0; i < set.NumField(); i++ {
+		if set.Type().Field(i).PkgPath != "" {
+			// unexported fields are set by the runner, not by the presets
+			continue
+		}
+		value := set.Field(i)
+		if isZero(value) {
+			continue
+		}
+		field := prefix + "." + set.Type().Field(i).Name
+		target := resolved.Field(i)
+		switch value.Kind() {
+		case reflect.Slice:
+			// copied so the slice of the explicit options is not appended to
+			merged := reflect.MakeSlice(target.Type(), 0, target.Len()+value.Len())
+			target.Set(reflect.AppendSlice(reflect.AppendSlice(merged, target), value))
+		case reflect.Map:
+			merged := reflect.MakeMap(target.Type())
+			for _, k := range target.MapKeys() {
+				merged.SetMapIndex(k, target.MapIndex(k))
+			}
+			target.Set(merged)
+			for _, k := range value.MapKeys() {
+				name := fmt.Sprintf("%s[%v]", field, k.Interface())
+				current := target.MapIndex(k)
+				if !current.IsValid() {
+					target.SetMapIndex(k, value.MapIndex(k))
+					m.setBy[name] = m.key
+				} else if !reflect.DeepEqual(current.Interface(), value.MapIndex(k).Interface()) {
+					m.conflict(name)
+				}
+			}
+		default:
+			if isZero(target) {
+				target.Set(value)
+				m.setBy[field] = m.key
+			} else if !reflect.DeepEqual(target.Interface(), value.Interface()) {
+				m.conflict(field)
+			}
+		}
+	}
+}
+
+func (m annotationMerge) conflict(field string) {
+	m.report.Conflicts = append(m.report.Conflicts, AnnotationConflict{Annotation: m.key, Field: field, With: m.setBy[field]})
+}
+
+// isZero reports whether v is the zero value of its type
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
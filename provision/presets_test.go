@@ -0,0 +1,145 @@
+package provision
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyAnnotations(t *testing.T) {
+	presets := NewPresets()
+	annotations := map[string]string{
+		"tier":     "small",
+		"timeout":  "60s",
+		"network":  "none",
+		"readonly": "true",
+		"owner":    "payments",
+	}
+	// the memory is explicitly set, it wins over the tier
+	explicit := ContainerOptions{Image: "gofn/app", Memory: 1 << 30, Env: []string{"MODE=batch"}}
+	container, build, report, err := presets.ApplyAnnotations(annotations, explicit, BuildOptions{ImageName: "app"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := ContainerOptions{
+		Image:            "gofn/app",
+		Memory:           1 << 30,
+		NanoCPUs:         5e8,
+		Env:              []string{"MODE=batch"},
+		Egress:           EgressPolicy{Mode: EgressNone},
+		ReadOnlyRootfs:   true,
+		ExecutionTimeout: time.Minute,
+	}
+	if !reflect.DeepEqual(container, want) || build.ImageName != "app" {
+		t.Errorf("expected %+v but found %+v", want, container)
+	}
+	wantReport := AnnotationReport{
+		Applied:   []string{"network", "readonly", "tier", "timeout"},
+		Unknown:   []string{"owner"},
+		Conflicts: []AnnotationConflict{{Annotation: "tier", Field: "Container.Memory"}},
+	}
+	if !reflect.DeepEqual(report, wantReport) {
+		t.Errorf("expected %+v but found %+v", wantReport, report)
+	}
+	if explicit.NanoCPUs != 0 || len(explicit.Env) != 1 {
+		t.Errorf("expected the explicit options to be left as is but found %+v", explicit)
+	}
+
+	presets.Strict = true
+	_, _, _, err = presets.ApplyAnnotations(annotations, explicit, BuildOptions{})
+	unknownErr, ok := err.(*UnknownAnnotationsError)
+	if !ok || unknownErr.Unwrap() != ErrUnknownAnnotation || !reflect.DeepEqual(unknownErr.Annotations, []string{"owner"}) {
+		t.Errorf("expected the unknown annotation to fail in strict mode but found %v", err)
+	}
+}
+
+func TestApplyAnnotationsRegisteredPresets(t *testing.T) {
+	presets := NewPresets()
+	presets.Strict = true
+	presets.RegisterPreset("gpu=true", func(opts *ContainerOptions, build *BuildOptions) {
+		opts.Memory = 8 << 30
+		opts.Runtime = "nvidia"
+		opts.Env = []string{"GPU=1"}
+		opts.EnvTemplate = map[string]string{"HOST": "{{.Host}}", "TOKEN": "gpu"}
+		build.Dockerfile = "Dockerfile.gpu"
+	})
+	// a registered preset replaces the built-in one of the same name
+	presets.RegisterPreset("tier=small", func(opts *ContainerOptions, _ *BuildOptions) {
+		opts.Memory = 128 << 20
+		opts.Runtime = "nvidia"
+	})
+
+	explicit := ContainerOptions{
+		Image:       "gofn/app",
+		Env:         []string{"MODE=batch"},
+		EnvTemplate: map[string]string{"TOKEN": "explicit"},
+	}
+	container, build, report, err := presets.ApplyAnnotations(map[string]string{"gpu": "true", "tier": "small"}, explicit, BuildOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if container.Memory != 8<<30 || container.Runtime != "nvidia" || build.Dockerfile != "Dockerfile.gpu" {
+		t.Errorf("expected the options of the first annotation but found %+v, %+v", container, build)
+	}
+	if !reflect.DeepEqual(container.Env, []string{"MODE=batch", "GPU=1"}) {
+		t.Errorf("expected the environment to be appended to but found %v", container.Env)
+	}
+	if !reflect.DeepEqual(container.EnvTemplate, map[string]string{"HOST": "{{.Host}}", "TOKEN": "explicit"}) {
+		t.Errorf("expected the templates to be merged but found %v", container.EnvTemplate)
+	}
+	if len(explicit.EnvTemplate) != 1 {
+		t.Errorf("expected the explicit templates to be left as is but found %v", explicit.EnvTemplate)
+	}
+	wantConflicts := []AnnotationConflict{
+		{Annotation: "gpu", Field: "Container.EnvTemplate[TOKEN]"},
+		{Annotation: "tier", Field: "Container.Memory", With: "gpu"},
+	}
+	if !reflect.DeepEqual(report.Conflicts, wantConflicts) {
+		t.Errorf("expected %+v but found %+v", wantConflicts, report.Conflicts)
+	}
+}
+
+func TestApplyAnnotationsInvalid(t *testing.T) {
+	presets := NewPresets()
+	for _, annotations := range []map[string]string{
+		{"timeout": "soon"},
+		{"timeout": "-5s"},
+		{"readonly": "maybe"},
+	} {
+		_, _, _, err := presets.ApplyAnnotations(annotations, ContainerOptions{}, BuildOptions{})
+		if invalidErr, ok := err.(*InvalidAnnotationError); !ok || invalidErr.Unwrap() != ErrInvalidAnnotation {
+			t.Errorf("expected an invalid annotation for %v but found %v", annotations, err)
+		}
+	}
+
+	// an unknown tier is an unknown annotation, not a built-in one
+	_, _, report, err := presets.ApplyAnnotations(map[string]string{"tier": "huge", "network": "backend"}, ContainerOptions{}, BuildOptions{})
+	if err != nil || !reflect.DeepEqual(report.Unknown, []string{"tier"}) {
+		t.Errorf("expected the unknown tier to be reported but found %v, %+v", err, report)
+	}
+}
+
+func TestRunnerRunLimits(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 300*time.Millisecond)
+	hostConfigs := recordCreate(server)
+	client := NewTestClient(server.URL(), t)
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	r.Timeouts.Execution = time.Minute
+
+	opts := ContainerOptions{Memory: 256 << 20, NanoCPUs: 5e8, ReadOnlyRootfs: true, ExecutionTimeout: 20 * time.Millisecond}
+	_, err := r.Run(context.Background(), testBuildOptions(), opts)
+	timeoutErr, ok := err.(*PhaseTimeoutError)
+	if !ok || timeoutErr.Phase != PhaseExecution || timeoutErr.Timeout != opts.ExecutionTimeout {
+		t.Fatalf("expected the execution timeout of the container but found %v", err)
+	}
+	hostConfig := (*hostConfigs)[0]
+	for field, want := range map[string]string{"Memory": "268435456", "NanoCpus": "500000000", "ReadonlyRootfs": "true"} {
+		if string(hostConfig[field]) != want {
+			t.Errorf("expected %s %s but found %s", field, want, hostConfig[field])
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package provision
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// DefaultPrewarmPerHost is the number of pulls run at once on a host without PrewarmOptions.PerHost
+	DefaultPrewarmPerHost = 2
+	// DefaultPrewarmTotal is the number of pulls run at once without PrewarmOptions.Total
+	DefaultPrewarmTotal = 8
+)
+
+// PrewarmStatus is the outcome of the pre-warming of an image on a host
+type PrewarmStatus string
+
+const (
+	// PrewarmPulled is the status of an image pulled on the host
+	PrewarmPulled PrewarmStatus = "pulled"
+	// PrewarmSkipped is the status of an image already on the host, with the pinned digest if any
+	PrewarmSkipped PrewarmStatus = "skipped"
+	// PrewarmFailed is the status of an image that could not be pulled, including when the
+	// context ended before its pull
+	PrewarmFailed PrewarmStatus = "failed"
+)
+
+// PrewarmOptions bound the pulls of PrewarmImages
+type PrewarmOptions struct {
+	// PerHost is the number of pulls run at once on a host, DefaultPrewarmPerHost when zero
+	PerHost int
+	// Total is the number of pulls run at once on all the hosts, DefaultPrewarmTotal when zero
+	Total int
+	// Auth gives the credentials of each image, the images are pulled anonymously when nil
+	Auth AuthProvider
+}
+
+// PrewarmResult is the pre-warming of an image on a host
+type PrewarmResult struct {
+	Host     string
+	Ref      string
+	Status   PrewarmStatus
+	Digest   string
+	Duration time.Duration
+	Err      error
+}
+
+// PrewarmReport is the result of each image on each host, by host then by image
+type PrewarmReport map[string]map[string]PrewarmResult
+
+// Failed returns the results of the images that could not be pulled
+func (report PrewarmReport) Failed() (failed []PrewarmResult) {
+	for _, results := range report {
+		for _, result := range results {
+			if result.Status == PrewarmFailed {
+				failed = append(failed, result)
+			}
+		}
+	}
+	return
+}
+
+// PrewarmImages pulls each of refs on each of hosts ahead of their use, e.g. before a traffic
+// spike, skipping the images the hosts already have. The report has a result for every host and
+// every image: the failure of a pull does not stop the others, the end of ctx fails those not
+// started yet.
+func PrewarmImages(ctx context.Context, hosts HostSet, refs []string, opts PrewarmOptions) PrewarmReport {
+	perHost, total := opts.PerHost, opts.Total
+	if perHost <= 0 {
+		perHost = DefaultPrewarmPerHost
+	}
+	if total <= 0 {
+		total = DefaultPrewarmTotal
+	}
+	overall := make(chan struct{}, total)
+	report := make(PrewarmReport, len(hosts))
+	for name := range hosts {
+		report[name] = make(map[string]PrewarmResult, len(refs))
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, client := range hosts {
+		slots := make(chan struct{}, perHost)
+		for _, ref := range refs {
+			wg.Add(1)
+			name, client, ref := name, client, ref
+			var result PrewarmResult
+			goSafe("prewarm", func() error {
+				result = prewarm(ctx, client, ref, opts.Auth, slots, overall)
+				return nil
+			}, func(err error) {
+				defer wg.Done()
+				if err != nil {
+					// the pull panicked, e.g. in the AuthProvider
+					result = PrewarmResult{Status: PrewarmFailed, Err: err}
+				}
+				result.Host, result.Ref = name, ref
+				mu.Lock()
+				report[name][ref] = result
+				mu.Unlock()
+			})
+		}
+	}
+	wg.Wait()
+	return report
+}
+
+// prewarm pulls ref with client once it holds a slot of its host and an overall one
+func prewarm(ctx context.Context, client *docker.Client, ref string, auth AuthProvider, slots, overall chan struct{}) (result PrewarmResult) {
+	result.Status = PrewarmFailed
+	for _, sem := range []chan struct{}{slots, overall} {
+		select {
+		case sem <- struct{}{}:
+			defer func(sem chan struct{}) { <-sem }(sem)
+		case <-ctx.Done():
+			result.Err = ctx.Err()
+			return
+		}
+	}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+	present, err := hasImage(ctx, client, ref)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	if present {
+		result.Status = PrewarmSkipped
+		return
+	}
+	opts := &BuildOptions{ImageName: ref, DoNotUsePrefixImageName: true}
+	if auth != nil {
+		opts.Auth, err = auth.Auth(ctx, ref)
+		if err != nil {
+			result.Err = err
+			return
+		}
+	}
+	pulled, err := pullWithProgress(ctx, client, opts, nil)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	result.Status, result.Digest = PrewarmPulled, pulled.Digest
+	return
+}
+
+// hasImage reports whether the daemon of client has ref, with its digest when ref is pinned
+func hasImage(ctx context.Context, client *docker.Client, ref string) (present bool, err error) {
+	image, err := client.InspectImage(ref)
+	if err == docker.ErrNoSuchImage {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	i := strings.Index(ref, "@")
+	if i < 0 {
+		return true, nil
+	}
+	for _, repoDigest := range image.RepoDigests {
+		if strings.HasSuffix(repoDigest, ref[i:]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
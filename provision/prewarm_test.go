@@ -0,0 +1,172 @@
+package provision
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+var imageInspectRegexp = regexp.MustCompile(`/images/(.+)/json$`)
+
+// prewarmDaemon is a fake daemon holding images, given with their repo digests, and counting its pulls
+type prewarmDaemon struct {
+	mu      sync.Mutex
+	images  map[string][]string
+	pulls   []string
+	users   map[string]string
+	running int
+	maxRun  int
+}
+
+// overallPulls tracks the pulls running at once on all the daemons of a test
+type overallPulls struct {
+	running, max int32
+}
+
+func newPrewarmDaemon(server *fake.DockerServer, overall *overallPulls, images map[string][]string) *prewarmDaemon {
+	d := &prewarmDaemon{images: images, users: map[string]string{}}
+	server.CustomHandler("/images/.*/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := imageInspectRegexp.FindStringSubmatch(r.URL.Path)[1]
+		d.mu.Lock()
+		digests, ok := d.images[name]
+		d.mu.Unlock()
+		if !ok {
+			http.Error(w, "no such image", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"Id": "sha256:" + name, "RepoDigests": digests})
+	}))
+	server.CustomHandler("/images/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ref := r.URL.Query().Get("fromImage")
+		if tag := r.URL.Query().Get("tag"); tag != "" {
+			ref += ":" + tag
+		}
+		var auth docker.AuthConfiguration
+		data, _ := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+		_ = json.Unmarshal(data, &auth)
+		d.mu.Lock()
+		d.pulls = append(d.pulls, ref)
+		d.users[ref] = auth.Username
+		d.running++
+		if d.running > d.maxRun {
+			d.maxRun = d.running
+		}
+		d.mu.Unlock()
+		running := atomic.AddInt32(&overall.running, 1)
+		for max := atomic.LoadInt32(&overall.max); running > max && !atomic.CompareAndSwapInt32(&overall.max, max, running); max = atomic.LoadInt32(&overall.max) {
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&overall.running, -1)
+		d.mu.Lock()
+		d.running--
+		d.mu.Unlock()
+		if ref == "gofn/broken:latest" {
+			fmt.Fprintln(w, `{"error":"manifest unknown"}`)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"Digest: sha256:%x\"}\n", len(ref))
+	}))
+	return d
+}
+
+func TestPrewarmImages(t *testing.T) {
+	overall := &overallPulls{}
+	hosts := HostSet{}
+	daemons := map[string]*prewarmDaemon{}
+	pinned := "gofn/app@sha256:aaaa"
+	for i, images := range []map[string][]string{
+		// has every image, the pinned one with its digest
+		{"gofn/api:latest": nil, "gcr.io/gofn/worker:1.0": nil, pinned: {pinned}, "gofn/broken:latest": nil},
+		// has the pinned name with another digest
+		{pinned: {"gofn/app@sha256:bbbb"}},
+		{},
+	} {
+		server := createFakeDockerAPI(t)
+		defer server.Stop()
+		name := fmt.Sprintf("host-%d", i)
+		daemons[name] = newPrewarmDaemon(server, overall, images)
+		hosts[name] = NewTestClient(server.URL(), t)
+	}
+	refs := []string{"gofn/api:latest", "gcr.io/gofn/worker:1.0", pinned, "gofn/broken:latest"}
+	auth := RegistryAuth{
+		"docker.io": {Username: "hub"},
+		"gcr.io":    {Username: "_json_key"},
+	}
+
+	report := PrewarmImages(context.Background(), hosts, refs, PrewarmOptions{PerHost: 1, Total: 2, Auth: auth})
+	if len(report) != 3 {
+		t.Fatalf("expected a result per host but found %v", report)
+	}
+	for _, host := range hosts.Names() {
+		if len(report[host]) != len(refs) {
+			t.Fatalf("expected a result per image on %s but found %v", host, report[host])
+		}
+		for _, ref := range refs {
+			result := report[host][ref]
+			if result.Host != host || result.Ref != ref {
+				t.Errorf("unexpected result %+v for %s on %s", result, ref, host)
+			}
+			expected := PrewarmPulled
+			switch {
+			case host == "host-0":
+				expected = PrewarmSkipped
+			case ref == "gofn/broken:latest":
+				expected = PrewarmFailed
+			}
+			if result.Status != expected {
+				t.Errorf("expected %s to be %s on %s but found %+v", ref, expected, host, result)
+			}
+		}
+	}
+	if pulls := daemons["host-0"].pulls; len(pulls) != 0 {
+		t.Errorf("expected the images of host-0 to be skipped but found the pulls %v", pulls)
+	}
+	if result := report["host-1"][pinned]; result.Status != PrewarmPulled || result.Digest == "" {
+		t.Errorf("expected the stale pinned image to be pulled but found %+v", result)
+	}
+	if failed := report.Failed(); len(failed) != 2 || failed[0].Err == nil {
+		t.Errorf("expected the broken image to fail on 2 hosts but found %+v", failed)
+	}
+	users := daemons["host-2"].users
+	if users["gofn/api:latest"] != "hub" || users["gcr.io/gofn/worker:1.0"] != "_json_key" {
+		t.Errorf("expected the credentials of each registry but found %v", users)
+	}
+	for _, host := range hosts.Names() {
+		if max := daemons[host].maxRun; max > 1 {
+			t.Errorf("expected a single pull at once on %s but found %d", host, max)
+		}
+	}
+	if max := atomic.LoadInt32(&overall.max); max != 2 {
+		t.Errorf("expected 2 pulls at once overall but found %d", max)
+	}
+}
+
+func TestPrewarmImagesCanceled(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	daemon := newPrewarmDaemon(server, &overallPulls{}, map[string][]string{})
+	hosts := HostSet{"host": NewTestClient(server.URL(), t)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report := PrewarmImages(ctx, hosts, []string{"gofn/api", "gofn/worker"}, PrewarmOptions{})
+	for _, ref := range []string{"gofn/api", "gofn/worker"} {
+		if result := report["host"][ref]; result.Status != PrewarmFailed || result.Err != context.Canceled {
+			t.Errorf("expected %s to be canceled but found %+v", ref, result)
+		}
+	}
+	if len(daemon.pulls) != 0 {
+		t.Errorf("expected no pull but found %v", daemon.pulls)
+	}
+}
@@ -0,0 +1,250 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DefaultProgressInterval is the minimum interval between the lines written by LogPullProgress
+const DefaultProgressInterval = 5 * time.Second
+
+// ProgressUpdate is a message of the progress stream of a pull
+type ProgressUpdate struct {
+	// ID is the layer the message is about, empty for the messages about the whole image
+	ID      string `json:"id,omitempty"`
+	Status  string `json:"status"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+	// Percent is the overall progress of the pull, from 0 to 100
+	Percent float64 `json:"percent"`
+}
+
+// PullResult summarizes a pull
+type PullResult struct {
+	// Transferred is set when the daemon downloaded a newer image
+	Transferred bool `json:"transferred"`
+	// UpToDate is set when the local image already was the latest one
+	UpToDate bool   `json:"up_to_date"`
+	Digest   string `json:"digest,omitempty"`
+	Layers   int    `json:"layers"`
+	// Malformed counts the messages that could not be decoded
+	Malformed int `json:"malformed"`
+}
+
+// layerDone are the statuses of a layer already downloaded
+var layerDone = map[string]bool{
+	"Download complete":  true,
+	"Verifying Checksum": true,
+	"Extracting":         true,
+	"Pull complete":      true,
+	"Already exists":     true,
+}
+
+type progressMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+// PullProgress decodes the JSON progress stream written by the daemon during a pull,
+// it is the io.Writer given as the OutputStream of a raw JSON pull
+type PullProgress struct {
+	onUpdate func(ProgressUpdate)
+	pending  []byte
+	layers   map[string]float64
+	order    []string
+	result   PullResult
+	err      error
+}
+
+// NewPullProgress returns a decoder calling onUpdate, which may be nil, for each message
+func NewPullProgress(onUpdate func(ProgressUpdate)) *PullProgress {
+	return &PullProgress{onUpdate: onUpdate, layers: make(map[string]float64)}
+}
+
+// Write decodes the complete messages of p and keeps the partial last one,
+// a malformed message is counted and skipped
+func (p *PullProgress) Write(b []byte) (n int, err error) {
+	p.pending = append(p.pending, b...)
+	for {
+		i := bytes.IndexByte(p.pending, '\n')
+		if i < 0 {
+			break
+		}
+		p.decode(p.pending[:i])
+		p.pending = p.pending[i+1:]
+	}
+	return len(b), nil
+}
+
+// Result returns the summary of the messages decoded so far
+func (p *PullProgress) Result() PullResult {
+	if len(bytes.TrimSpace(p.pending)) > 0 {
+		p.decode(p.pending)
+		p.pending = nil
+	}
+	p.result.Layers = len(p.order)
+	return p.result
+}
+
+// Err returns the error reported by the daemon in the stream
+func (p *PullProgress) Err() error {
+	return p.err
+}
+
+func (p *PullProgress) decode(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	var msg progressMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		p.result.Malformed++
+		return
+	}
+	if msg.Error != "" {
+		p.err = errors.New(msg.Error)
+		return
+	}
+	update := ProgressUpdate{
+		ID:      msg.ID,
+		Status:  msg.Status,
+		Current: msg.ProgressDetail.Current,
+		Total:   msg.ProgressDetail.Total,
+	}
+	switch {
+	case strings.HasPrefix(msg.Status, "Status: Downloaded newer image"):
+		p.result.Transferred = true
+		p.completeAll()
+	case strings.HasPrefix(msg.Status, "Status: Image is up to date"):
+		p.result.UpToDate = true
+		p.completeAll()
+	case strings.HasPrefix(msg.Status, "Digest: "):
+		p.result.Digest = strings.TrimPrefix(msg.Status, "Digest: ")
+	case msg.ID != "" && isLayerStatus(msg.Status):
+		p.track(msg)
+	}
+	update.Percent = p.percent()
+	if p.onUpdate != nil {
+		p.onUpdate(update)
+	}
+}
+
+// isLayerStatus tells the layer messages from the ones naming the pulled tag, e.g. "Pulling from library/alpine"
+func isLayerStatus(status string) bool {
+	return !strings.HasPrefix(status, "Pulling from ")
+}
+
+func (p *PullProgress) track(msg progressMessage) {
+	done, seen := p.layers[msg.ID]
+	if !seen {
+		p.order = append(p.order, msg.ID)
+	}
+	switch {
+	case layerDone[msg.Status]:
+		done = 1
+	case msg.Status == "Downloading" && msg.ProgressDetail.Total > 0:
+		done = float64(msg.ProgressDetail.Current) / float64(msg.ProgressDetail.Total)
+	}
+	p.layers[msg.ID] = done
+}
+
+func (p *PullProgress) completeAll() {
+	for id := range p.layers {
+		p.layers[id] = 1
+	}
+}
+
+func (p *PullProgress) percent() float64 {
+	if p.result.Transferred || p.result.UpToDate {
+		return 100
+	}
+	if len(p.order) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, id := range p.order {
+		sum += p.layers[id]
+	}
+	return 100 * sum / float64(len(p.order))
+}
+
+// LogPullProgress returns a BuildOptions.OnPullProgress writing "pulling image: 43%" lines to w,
+// at most one per interval, DefaultProgressInterval when zero, and one once the pull completed
+func LogPullProgress(w io.Writer, image string, interval time.Duration) func(ProgressUpdate) {
+	if interval == 0 {
+		interval = DefaultProgressInterval
+	}
+	var (
+		mu       sync.Mutex
+		last     time.Time
+		complete bool
+	)
+	return func(update ProgressUpdate) {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		if complete || (update.Percent < 100 && now.Sub(last) < interval) {
+			return
+		}
+		last, complete = now, update.Percent >= 100
+		fmt.Fprintln(w, pullProgressLine(image, update.Percent))
+	}
+}
+
+// pullProgressLine describes the progress of the pull of image
+func pullProgressLine(image string, percent float64) string {
+	return fmt.Sprintf("pulling %s: %.0f%%", image, percent)
+}
+
+// FnPullWithProgress pulls the image of opts calling onUpdate, which may be nil, and
+// opts.OnPullProgress for each progress message
+func FnPullWithProgress(client *docker.Client, opts *BuildOptions, onUpdate func(ProgressUpdate)) (result PullResult, err error) {
+	result, err = pullWithProgress(context.Background(), client, opts, onUpdate)
+	err = ClassifyError(err)
+	return
+}
+
+func pullWithProgress(ctx context.Context, client *docker.Client, opts *BuildOptions, onUpdate func(ProgressUpdate)) (result PullResult, err error) {
+	credentials, err := registryAuth(ctx, opts)
+	if err != nil {
+		return
+	}
+	if opts.OnPullProgress != nil {
+		next := onUpdate
+		onUpdate = func(update ProgressUpdate) {
+			opts.OnPullProgress(update)
+			if next != nil {
+				next(update)
+			}
+		}
+	}
+	progress := NewPullProgress(onUpdate)
+	repo, tag := parseDockerImage(opts.GetImageName())
+	err = client.PullImage(docker.PullImageOptions{
+		Repository:    repo,
+		Tag:           tag,
+		Context:       ctx,
+		OutputStream:  progress,
+		RawJSONStream: true,
+	}, credentials)
+	result = progress.Result()
+	if err == nil {
+		// the raw stream carries the errors the client would otherwise detect
+		err = progress.Err()
+	}
+	return
+}
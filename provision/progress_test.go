@@ -0,0 +1,200 @@
+package provision
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+func readPullFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pull", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// decodePull writes the fixture to a decoder in small chunks, as the daemon flushes them
+func decodePull(t *testing.T, name string) (updates []ProgressUpdate, progress *PullProgress) {
+	progress = NewPullProgress(func(u ProgressUpdate) {
+		updates = append(updates, u)
+	})
+	data := readPullFixture(t, name)
+	for len(data) > 0 {
+		n := 7
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := progress.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	return
+}
+
+func TestPullProgressFresh(t *testing.T) {
+	updates, progress := decodePull(t, "fresh.jsonl")
+	result := progress.Result()
+	if !result.Transferred || result.UpToDate {
+		t.Errorf("expected a transferred image but found %+v", result)
+	}
+	if result.Layers != 2 || result.Malformed != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if !strings.HasPrefix(result.Digest, "sha256:621c2f39") {
+		t.Errorf("unexpected digest %q", result.Digest)
+	}
+	if len(updates) != 14 {
+		t.Fatalf("expected 14 updates but found %d", len(updates))
+	}
+	last := 0.0
+	for _, u := range updates {
+		if u.Percent < last {
+			t.Errorf("expected the percentage to grow but found %v after %v", u.Percent, last)
+		}
+		last = u.Percent
+	}
+	if last != 100 {
+		t.Errorf("expected the pull to end at 100%% but found %v", last)
+	}
+	downloading := updates[4]
+	if downloading.ID != "4fe2ade4980c" || downloading.Current != 1103465 || downloading.Total != 2206931 {
+		t.Errorf("unexpected update %+v", downloading)
+	}
+	if downloading.Percent < 24.9 || downloading.Percent > 25 {
+		t.Errorf("expected about 25%% but found %v", downloading.Percent)
+	}
+	if progress.Err() != nil {
+		t.Errorf("Expected no errors but %q found", progress.Err())
+	}
+}
+
+func TestPullProgressUpToDate(t *testing.T) {
+	updates, progress := decodePull(t, "uptodate.jsonl")
+	result := progress.Result()
+	if result.Transferred || !result.UpToDate {
+		t.Errorf("expected an up to date image but found %+v", result)
+	}
+	if result.Layers != 0 {
+		t.Errorf("expected no layers but found %d", result.Layers)
+	}
+	if percent := updates[len(updates)-1].Percent; percent != 100 {
+		t.Errorf("expected 100%% but found %v", percent)
+	}
+}
+
+func TestPullProgressPartial(t *testing.T) {
+	updates, progress := decodePull(t, "partial.jsonl")
+	result := progress.Result()
+	if result.Transferred || result.UpToDate {
+		t.Errorf("expected an unfinished pull but found %+v", result)
+	}
+	if result.Layers != 3 {
+		t.Errorf("expected 3 layers but found %d", result.Layers)
+	}
+	// two layers already exist and the third one is half downloaded
+	if percent := updates[len(updates)-1].Percent; percent < 83.3 || percent > 83.4 {
+		t.Errorf("expected 83.3%% but found %v", percent)
+	}
+}
+
+func TestPullProgressMalformed(t *testing.T) {
+	updates, progress := decodePull(t, "malformed.jsonl")
+	result := progress.Result()
+	if result.Malformed != 2 {
+		t.Errorf("expected 2 malformed lines but found %d", result.Malformed)
+	}
+	if !result.Transferred {
+		t.Errorf("expected the pull to be decoded to the end but found %+v", result)
+	}
+	if len(updates) != 5 {
+		t.Errorf("expected 5 updates but found %d", len(updates))
+	}
+}
+
+func TestPullProgressUnterminated(t *testing.T) {
+	progress := NewPullProgress(nil)
+	_, _ = progress.Write([]byte(`{"status":"Status: Image is up to date for alpine:3.8"}`))
+	if !progress.Result().UpToDate {
+		t.Error("expected the last line to be decoded without a newline")
+	}
+}
+
+func fakePull(server *fake.DockerServer, fixture []byte) {
+	server.CustomHandler("/images/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(fixture)
+	}))
+}
+
+func TestFnPullWithProgress(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakePull(server, readPullFixture(t, "fresh.jsonl"))
+	client := NewTestClient(server.URL(), t)
+
+	var updates int
+	result, err := FnPullWithProgress(client, &BuildOptions{ImageName: "alpine:3.8"}, func(ProgressUpdate) {
+		updates++
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !result.Transferred || updates != 14 {
+		t.Errorf("unexpected result %+v after %d updates", result, updates)
+	}
+}
+
+func TestFnPullWithProgressStreamError(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakePull(server, readPullFixture(t, "error.jsonl"))
+	client := NewTestClient(server.URL(), t)
+
+	_, err := FnPullWithProgress(client, &BuildOptions{ImageName: "gofn/private"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "authentication required") {
+		t.Errorf("expected the stream error but found %v", err)
+	}
+	// FnPull shares the decoder
+	err = FnPull(client, &BuildOptions{ImageName: "gofn/private"})
+	if err == nil || !strings.Contains(err.Error(), "authentication required") {
+		t.Errorf("expected the stream error but found %v", err)
+	}
+}
+
+func TestFnPullOnPullProgress(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakePull(server, readPullFixture(t, "fresh.jsonl"))
+	client := NewTestClient(server.URL(), t)
+
+	// the interval leaves the first line and the completion
+	var log bytes.Buffer
+	opts := &BuildOptions{ImageName: "alpine:3.8", DoNotUsePrefixImageName: true, OnPullProgress: LogPullProgress(&log, "alpine:3.8", time.Hour)}
+	if err := FnPull(client, opts); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if want := "pulling alpine:3.8: 0%\npulling alpine:3.8: 100%\n"; log.String() != want {
+		t.Errorf("expected %q but found %q", want, log.String())
+	}
+
+	// the pulls of FnImageBuild report their layers
+	var percents []float64
+	opts.ForcePull = true
+	opts.OnPullProgress = func(update ProgressUpdate) {
+		percents = append(percents, update.Percent)
+	}
+	if _, _, err := FnImageBuild(client, opts); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(percents) != 14 || percents[6] != 75 || percents[13] != 100 {
+		t.Errorf("unexpected progress %v", percents)
+	}
+}
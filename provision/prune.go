@@ -0,0 +1,188 @@
+package provision
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// PrunedImage is an image removed by FnPruneImages
+type PrunedImage struct {
+	ID   string   `json:"id"`
+	Tags []string `json:"tags,omitempty"`
+	// Size is in bytes
+	Size int64 `json:"size"`
+}
+
+// ImagePruneReport is the outcome of FnPruneImages
+type ImagePruneReport struct {
+	Removed []PrunedImage `json:"removed"`
+	// InUse are the IDs of the images outside the retention kept because a container uses them
+	InUse []string `json:"in_use,omitempty"`
+	// Reclaimed is the sum of the sizes of the removed images in bytes, the layers they shared
+	// with the kept images are counted although they are not freed
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+// FnRemoveImage removes the image name, a tag or an ID. A tagged image is untagged and only
+// removed with its last tag. force removes the image even when a stopped container uses it.
+func FnRemoveImage(client *docker.Client, name string, force bool) (err error) {
+	err = client.RemoveImageExtended(name, docker.RemoveImageOptions{Force: force})
+	if err == docker.ErrNoSuchImage {
+		err = ErrImageNotFound
+	}
+	return
+}
+
+// FnPruneImages removes the gofn images, labeled by their build or tagged with the gofn/ prefix,
+// outside the retention: the keepLast newest images of each repository are kept, and so are the
+// images younger than olderThan. The untagged images left by the builds replacing a tag are not
+// counted among the newest. The images used by a container, even a stopped one, are kept.
+func FnPruneImages(client *docker.Client, keepLast int, olderThan time.Duration) (report ImagePruneReport, err error) {
+	images, err := client.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return
+	}
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		return
+	}
+	used := make(map[string]bool)
+	for _, container := range containers {
+		// the image of a container is the name it was created with or the ID once retagged
+		used[container.Image] = true
+		used[normalizeImageRef(container.Image)] = true
+	}
+
+	var gofnImages []docker.APIImages
+	for _, image := range images {
+		if isGofnImage(image) {
+			gofnImages = append(gofnImages, image)
+		}
+	}
+	sort.Slice(gofnImages, func(i, j int) bool {
+		if gofnImages[i].Created != gofnImages[j].Created {
+			return gofnImages[i].Created > gofnImages[j].Created
+		}
+		return gofnImages[i].ID < gofnImages[j].ID
+	})
+	kept := make(map[string]int)
+	now := time.Now()
+	for _, image := range gofnImages {
+		tags := imageTags(image)
+		if len(tags) > 0 {
+			repository := imageRepository(tags[0])
+			kept[repository]++
+			if kept[repository] <= keepLast {
+				continue
+			}
+		}
+		if now.Sub(time.Unix(image.Created, 0)) < olderThan {
+			continue
+		}
+		if imageInUse(image, tags, used) {
+			report.InUse = append(report.InUse, image.ID)
+			continue
+		}
+		// removed by ID with all its tags
+		err = client.RemoveImageExtended(image.ID, docker.RemoveImageOptions{Force: len(tags) > 1})
+		if err == docker.ErrNoSuchImage {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		report.Removed = append(report.Removed, PrunedImage{ID: image.ID, Tags: tags, Size: image.Size})
+		report.Reclaimed += image.Size
+	}
+	return
+}
+
+// isGofnImage reports whether image was built by gofn: it is labeled by its build, or it is
+// tagged and all its tags have the gofn/ prefix
+func isGofnImage(image docker.APIImages) bool {
+	if image.Labels[LabelOwner] == ownerGofn {
+		return true
+	}
+	tags := imageTags(image)
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "gofn/") {
+			return false
+		}
+	}
+	return len(tags) > 0
+}
+
+// imageTags returns the tags of image, without the <none>:<none> of an untagged image
+func imageTags(image docker.APIImages) (tags []string) {
+	for _, tag := range image.RepoTags {
+		if tag != "<none>:<none>" {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// imageRepository returns the repository of tag, e.g. gofn/python for gofn/python:3
+func imageRepository(tag string) string {
+	repository, _ := parseDockerImage(tag)
+	return repository
+}
+
+func imageInUse(image docker.APIImages, tags []string, used map[string]bool) bool {
+	if used[image.ID] {
+		return true
+	}
+	for _, tag := range tags {
+		if used[normalizeImageRef(tag)] {
+			return true
+		}
+	}
+	return false
+}
+
+// FnPruneContainers removes with force the gofn containers exited or never started that were
+// created more than olderThan ago, it returns the IDs of the removed containers. The running
+// containers are never removed, nor the containers gofn never starts, e.g. the locks of a
+// DaemonFence, and a container gone before its removal is skipped.
+func FnPruneContainers(client *docker.Client, olderThan time.Duration) (removed []string, err error) {
+	containers, err := FnListContainers(client)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, container := range inStates(containers, []string{"exited", "created"}) {
+		if now.Sub(time.Unix(container.Created, 0)) < olderThan {
+			continue
+		}
+		if _, lock := container.Labels[LabelLock]; lock || container.Labels[LabelOwner] == ownerGofn {
+			continue
+		}
+		// the container may be started since it was listed, the force would kill it
+		var inspected *docker.Container
+		inspected, err = client.InspectContainer(container.ID)
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if inspected.State.Running {
+			continue
+		}
+		err = client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		removed = append(removed, container.ID)
+	}
+	return
+}
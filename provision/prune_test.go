@@ -0,0 +1,178 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestFnRemoveImage(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	if err := FnRemoveImage(client, image, false); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, err := client.InspectImage(image); err != docker.ErrNoSuchImage {
+		t.Errorf("expected the image to be removed but found %v", err)
+	}
+	if err := FnRemoveImage(client, image, true); err != ErrImageNotFound {
+		t.Errorf("expected %q but found %v", ErrImageNotFound, err)
+	}
+}
+
+func TestFnPruneImages(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	now := time.Now()
+	age := func(d time.Duration) int64 {
+		return now.Add(-d).Unix()
+	}
+	built := map[string]string{LabelOwner: ownerGofn}
+	images := []docker.APIImages{
+		{ID: "a1", RepoTags: []string{"gofn/a:latest"}, Created: age(3 * time.Hour), Size: 100},
+		// a build replaced by a1
+		{ID: "a0", RepoTags: []string{"<none>:<none>"}, Labels: built, Created: age(5 * time.Hour), Size: 50},
+		{ID: "fresh", RepoTags: []string{"<none>:<none>"}, Labels: built, Created: age(10 * time.Minute), Size: 10},
+		{ID: "used", RepoTags: []string{"gofn/a:old"}, Created: age(4 * time.Hour), Size: 70},
+		{ID: "b2", RepoTags: []string{"gofn/b:v2"}, Created: age(2 * time.Hour), Size: 40},
+		{ID: "b1", RepoTags: []string{"gofn/b:v1"}, Created: age(4 * time.Hour), Size: 30},
+		{ID: "gone", RepoTags: []string{"gofn/b:v0"}, Created: age(6 * time.Hour), Size: 20},
+		{ID: "d1", RepoTags: []string{"gofn/d:v1"}, Created: age(time.Hour), Size: 60},
+		{ID: "d0", RepoTags: []string{"gofn/d:latest"}, Created: age(5 * time.Hour), Size: 60},
+		{ID: "foreign", RepoTags: []string{"python:3"}, Created: age(9 * time.Hour), Size: 900},
+		{ID: "shared", RepoTags: []string{"gofn/e:1", "python:e"}, Created: age(9 * time.Hour), Size: 900},
+	}
+	var (
+		mu      sync.Mutex
+		removed []string
+	)
+	server.CustomHandler("/images/.*", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/images/json") {
+			_ = json.NewEncoder(w).Encode(images)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+			if id == "gone" {
+				http.Error(w, "No such image", http.StatusNotFound)
+				return
+			}
+			mu.Lock()
+			removed = append(removed, id)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	server.CustomHandler("/containers/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]docker.APIContainers{
+			// a container whose image was retagged since, and one of the image name
+			{ID: "c1", Image: "used"},
+			{ID: "c2", Image: "gofn/d"},
+		})
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	report, err := FnPruneImages(client, 1, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := ImagePruneReport{
+		Removed: []PrunedImage{
+			{ID: "b1", Tags: []string{"gofn/b:v1"}, Size: 30},
+			{ID: "a0", Size: 50},
+		},
+		InUse:     []string{"used", "d0"},
+		Reclaimed: 80,
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("expected %+v but found %+v", want, report)
+	}
+	if !reflect.DeepEqual(removed, []string{"b1", "a0"}) {
+		t.Errorf("expected the images b1 and a0 to be removed but found %v", removed)
+	}
+}
+
+func TestFnPruneContainers(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+	create := func() string {
+		container, err := FnContainer(client, ContainerOptions{Image: image})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return container.ID
+	}
+	exited, created, running, vanishing := create(), create(), create(), create()
+	for _, id := range []string{exited, running} {
+		runFakeContainer(client, id, t)
+	}
+	if err := client.StopContainer(exited, 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.PullImage(docker.PullImageOptions{Repository: "python"}, docker.AuthConfiguration{})
+	foreign, err := client.CreateContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: "python"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// vanishing is removed by another cleanup between the list and its removal
+	server.CustomHandler("/containers/"+vanishing+"/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "No such container", http.StatusNotFound)
+	}))
+
+	removed, err := FnPruneContainers(client, time.Hour)
+	if err != nil || len(removed) != 0 {
+		t.Errorf("expected the recent containers to be kept but found %v and %v", removed, err)
+	}
+	removed, err = FnPruneContainers(client, 0)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := map[string]bool{exited: true, created: true}
+	if len(removed) != len(want) || !want[removed[0]] || !want[removed[1]] {
+		t.Errorf("expected the exited and created containers to be removed but found %v", removed)
+	}
+	for _, id := range []string{running, foreign.ID} {
+		if _, err = client.InspectContainer(id); err != nil {
+			t.Errorf("expected the container %s to be kept but found %v", id, err)
+		}
+	}
+}
+
+func TestFnPruneContainersKeepsLocks(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	fence := &DaemonFence{Client: client}
+	// the lock of a run is a container of its image that is never started
+	release, err := fence.Acquire(context.Background(), "nightly", createFakeImage(client), ExclusiveFailFast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	legacy := createFakeContainer(client, t)
+
+	removed, err := FnPruneContainers(client, 0)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(removed) != 1 || removed[0] != legacy.ID {
+		t.Errorf("expected only the legacy container to be removed but found %v", removed)
+	}
+	if _, err = fence.Acquire(context.Background(), "nightly", createFakeImage(client), ExclusiveFailFast); err != ErrExclusiveKeyHeld {
+		t.Errorf("expected the lock to be kept but found %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package provision
+
+import "strings"
+
+// LabelImageReference holds the reference a container image was rewritten from, see
+// Runner.RewriteReference
+const LabelImageReference = "io.gofn.image.reference"
+
+// Reference is an image reference, e.g. python:3.12.4-alpine3.20 or gofn/test
+type Reference string
+
+// ReferenceRewriter returns the reference gofn uses instead of ref, e.g. the copy of a public
+// image in the mirror of an air-gapped site. It returns ref itself for the references it leaves
+// alone and it must be idempotent, a rewritten reference may be rewritten again.
+type ReferenceRewriter func(ref Reference) Reference
+
+// MirrorNamespace returns a ReferenceRewriter moving every reference under prefix, e.g.
+// mirror.internal turns python:3.12 into mirror.internal/python:3.12
+func MirrorNamespace(prefix string) ReferenceRewriter {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	return func(ref Reference) Reference {
+		if strings.HasPrefix(string(ref), prefix) {
+			return ref
+		}
+		return Reference(prefix + string(ref))
+	}
+}
+
+// rewrite returns the reference r uses for the image ref
+func (r *Runner) rewrite(ref string) string {
+	if r.RewriteReference == nil {
+		return ref
+	}
+	return string(r.RewriteReference(Reference(ref)))
+}
+
+// rewriteBuild returns opts naming the rewritten reference of its image, opts itself when the
+// reference is left alone
+func (r *Runner) rewriteBuild(opts *BuildOptions) *BuildOptions {
+	name := opts.GetImageName()
+	rewritten := r.rewrite(name)
+	if rewritten == name {
+		return opts
+	}
+	copied := *opts
+	copied.ImageName = rewritten
+	copied.DoNotUsePrefixImageName = true
+	return &copied
+}
+
+// rewriteContainer returns opts running the rewritten reference of its image, labeled with
+// the reference it was rewritten from
+func (r *Runner) rewriteContainer(opts ContainerOptions) ContainerOptions {
+	image := r.rewrite(opts.Image)
+	if image != opts.Image {
+		opts.labels = withLabel(opts.labels, LabelImageReference, opts.Image)
+		opts.Image = image
+	}
+	return opts
+}
+
+// withLabel returns a copy of labels with the label name set to value
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	copied := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		copied[k] = v
+	}
+	copied[name] = value
+	return copied
+}
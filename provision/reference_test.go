@@ -0,0 +1,259 @@
+package provision
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// countingRewriter moves the references under mirror.internal and counts the references it
+// was given
+type countingRewriter struct {
+	mu    sync.Mutex
+	calls map[Reference]int
+}
+
+func (c *countingRewriter) rewrite(ref Reference) Reference {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls == nil {
+		c.calls = make(map[Reference]int)
+	}
+	c.calls[ref]++
+	return MirrorNamespace("mirror.internal")(ref)
+}
+
+func (c *countingRewriter) counts() map[Reference]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	copied := make(map[Reference]int, len(c.calls))
+	for ref, n := range c.calls {
+		copied[ref] = n
+	}
+	return copied
+}
+
+func TestMirrorNamespace(t *testing.T) {
+	rewrite := MirrorNamespace("mirror.internal/")
+	for ref, want := range map[Reference]Reference{
+		"python:3.12":                 "mirror.internal/python:3.12",
+		"gcr.io/distroless/static":    "mirror.internal/gcr.io/distroless/static",
+		"mirror.internal/python:3.12": "mirror.internal/python:3.12",
+	} {
+		if got := rewrite(ref); got != want {
+			t.Errorf("expected %s to be rewritten to %s but found %s", ref, want, got)
+		}
+	}
+}
+
+func TestRunnerRewriteReference(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	networks := newFakeNetworks(server)
+	egress := newFakeEgress(server, networks)
+	fakeArchives(server, map[string]string{CACertsPath: "bundle"})
+	client := NewTestClient(server.URL(), t)
+	// the fake daemon ignores the filter of the image list, so the images are created upfront
+	built := testBuildOptions()
+	built.ImageName = "mirror.internal/gofn/test"
+	built.DoNotUsePrefixImageName = true
+	if _, _, err := FnImageBuild(client, built); err != nil {
+		t.Fatal(err)
+	}
+	for _, image := range []string{"mirror.internal/alpine:3.20", "mirror.internal/" + HostFilesImage} {
+		if err := client.PullImage(docker.PullImageOptions{Repository: image}, docker.AuthConfiguration{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rewriter := &countingRewriter{}
+	var policyImages []string
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	r.RewriteReference = rewriter.rewrite
+	r.BuildPolicy = func(opts BuildOptions) []ValidationError {
+		policyImages = append(policyImages, opts.GetImageName())
+		return nil
+	}
+	r.ContainerPolicy = func(opts ContainerOptions) []ValidationError {
+		policyImages = append(policyImages, opts.Image)
+		return nil
+	}
+
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{
+		InjectCACerts: true,
+		Egress:        EgressPolicy{Mode: EgressAllowList, Allow: []string{"example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := map[Reference]int{"gofn/test": 1, Reference(DefaultEgressProxy.Image): 1, Reference(HostFilesImage): 1}
+	if counts := rewriter.counts(); !reflect.DeepEqual(counts, want) {
+		t.Errorf("expected the rewrites %v but found %v", want, counts)
+	}
+	if result.Image != "mirror.internal/gofn/test" || result.ImageReference != "gofn/test" {
+		t.Errorf("expected the rewritten and the original references but found %q and %q", result.Image, result.ImageReference)
+	}
+	// the build, the egress allow list and the container creation are checked
+	if want := []string{"mirror.internal/gofn/test", "mirror.internal/gofn/test", "mirror.internal/gofn/test"}; !reflect.DeepEqual(policyImages, want) {
+		t.Errorf("expected the policies to see the rewritten references %v but found %v", want, policyImages)
+	}
+	if len(egress.created) != 3 {
+		t.Fatalf("expected the proxy, the function and the helper containers but found %d", len(egress.created))
+	}
+	for i, want := range [][2]string{
+		{"mirror.internal/" + DefaultEgressProxy.Image, DefaultEgressProxy.Image},
+		{"mirror.internal/gofn/test", "gofn/test"},
+		{"mirror.internal/" + HostFilesImage, ""},
+	} {
+		config := egress.created[i].Config
+		if config.Image != want[0] || config.Labels[LabelImageReference] != want[1] {
+			t.Errorf("expected the container %d to run %s labeled %q but found %s labeled %v", i, want[0], want[1], config.Image, config.Labels)
+		}
+	}
+
+	session, err := r.Prepare(context.Background(), testBuildOptions(), ContainerOptions{}, RemoveAlways)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if session.Image != "mirror.internal/gofn/test" || rewriter.counts()["gofn/test"] != 2 {
+		t.Errorf("expected the prepared container to run the rewritten image but found %s", session.Image)
+	}
+	if err = FnRemove(client, session.ContainerID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunScriptRewriteReference(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "hello\n", "")
+	fakeArchives(server, nil)
+	bodies := recordCreateBodies(server)
+	client := NewTestClient(server.URL(), t)
+	rewriter := &countingRewriter{}
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	r.RewriteReference = rewriter.rewrite
+
+	image := ScriptLanguages()["python"].Image
+	result, err := RunScript(context.Background(), client, "python", []byte("print('hello')"), nil, WithRunner(r))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if counts := rewriter.counts(); !reflect.DeepEqual(counts, map[Reference]int{Reference(image): 1}) {
+		t.Errorf("expected the script image to be rewritten once but found %v", counts)
+	}
+	if _, err = client.InspectImage("mirror.internal/" + image); err != nil {
+		t.Errorf("expected the rewritten image to be pulled but found %v", err)
+	}
+	var created struct{ Image string }
+	if len(*bodies) != 1 || json.Unmarshal([]byte((*bodies)[0]), &created) != nil || created.Image != "mirror.internal/"+image {
+		t.Errorf("expected the script container to run the rewritten image but found %v", *bodies)
+	}
+	if result.ImageReference != image {
+		t.Errorf("expected the original reference %s but found %s", image, result.ImageReference)
+	}
+}
+
+func TestContainerPoolRewriteReference(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	bodies := recordCreateBodies(server)
+	client := NewTestClient(server.URL(), t)
+	if err := client.PullImage(docker.PullImageOptions{Repository: "mirror.internal/gofn/python"}, docker.AuthConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	rewriter := &countingRewriter{}
+	r := NewRunner(client)
+	r.RewriteReference = rewriter.rewrite
+	pool := NewContainerPool(r, ContainerOptions{Image: "gofn/python"}, PoolOptions{Size: 1})
+	defer pool.Close()
+	if err := pool.Start(context.Background()); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err := pool.UpdateImage(context.Background(), "busybox:1.36"); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	// the update pulls and then creates the container of the new image
+	want := map[Reference]int{"gofn/python": 1, "busybox:1.36": 2}
+	if counts := rewriter.counts(); !reflect.DeepEqual(counts, want) {
+		t.Errorf("expected the rewrites %v but found %v", want, counts)
+	}
+	if pool.Image() != "busybox:1.36" {
+		t.Errorf("expected the pool to report the original reference but found %s", pool.Image())
+	}
+	if _, err := client.InspectImage("mirror.internal/busybox:1.36"); err != nil {
+		t.Errorf("expected the rewritten image to be pulled but found %v", err)
+	}
+	for i, want := range []string{"gofn/python", "busybox:1.36"} {
+		var created struct {
+			Image  string
+			Labels map[string]string
+		}
+		if len(*bodies) != 2 || json.Unmarshal([]byte((*bodies)[i]), &created) != nil ||
+			created.Image != "mirror.internal/"+want || created.Labels[LabelImageReference] != want {
+			t.Errorf("expected a warm container of mirror.internal/%s labeled %s but found %v", want, want, *bodies)
+		}
+	}
+}
+
+func TestSelfTestRewriteReference(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "hello gofn\n", "")
+	var dockerfiles []string
+	server.CustomHandler("/build", fakeBuildDockerfiles(server, &dockerfiles))
+	client := NewTestClient(server.URL(), t)
+	rewriter := &countingRewriter{}
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	r.RewriteReference = rewriter.rewrite
+
+	report := SelfTest(context.Background(), client, SelfTestOptions{Runner: r})
+	if !report.Healthy {
+		t.Fatalf("expected a healthy report but found %+v", report)
+	}
+	want := map[Reference]int{DefaultSelfTestBaseImage: 1, DefaultSelfTestImageName: 2}
+	if counts := rewriter.counts(); !reflect.DeepEqual(counts, want) {
+		t.Errorf("expected the rewrites %v but found %v", want, counts)
+	}
+	if len(dockerfiles) != 1 || !strings.HasPrefix(dockerfiles[0], "FROM mirror.internal/"+DefaultSelfTestBaseImage+"\n") {
+		t.Errorf("expected the base image to be rewritten but found %q", dockerfiles)
+	}
+	if _, err := client.InspectImage("mirror.internal/" + DefaultSelfTestImageName); err != nil {
+		t.Errorf("expected the rewritten image to be built but found %v", err)
+	}
+}
+
+// fakeBuildDockerfiles keeps the Dockerfile of the build contexts sent to the fake docker api
+func fakeBuildDockerfiles(server *fake.DockerServer, dockerfiles *[]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		tr := tar.NewReader(bytes.NewReader(body))
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if header.Name == "Dockerfile" {
+				content, _ := ioutil.ReadAll(tr)
+				*dockerfiles = append(*dockerfiles, string(content))
+			}
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		server.DefaultHandler().ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,250 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	// errRegistryUnsupported is raised when the registry does not serve the v2 manifest API
+	errRegistryUnsupported = errors.New("provision: registry does not support the manifest API")
+)
+
+const (
+	defaultRegistry = "registry-1.docker.io"
+
+	mediaTypeManifest      = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest   = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIImageIndex = "application/vnd.oci.image.index.v1+json"
+)
+
+// registryHTTPClient is used to talk with the registries
+var registryHTTPClient = http.DefaultClient
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *platform `json:"platform,omitempty"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// registryRef splits an image name into the registry host, the repository and the tag or digest
+func registryRef(image string) (host, repo, ref string) {
+	repo, ref = parseDockerImage(image)
+	if i := strings.IndexRune(repo, '@'); i > -1 {
+		repo, ref = repo[:i], repo[i+1:]
+	}
+	host = defaultRegistry
+	if i := strings.IndexRune(repo, '/'); i > -1 {
+		first := repo[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host, repo = first, repo[i+1:]
+		}
+	}
+	// docker.io and index.docker.io name the Docker Hub, its official images are under library/
+	if host == "docker.io" || host == "index.docker.io" {
+		host = defaultRegistry
+	}
+	if host == defaultRegistry && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	return
+}
+
+func registryURL(host string) string {
+	if strings.HasPrefix(host, "localhost") || strings.HasPrefix(host, "127.0.0.1") {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// manifestSize returns the compressed size and the number of layers of image, multi-platform
+// images are measured for target, e.g. linux/arm64, or for their first platform without target
+func manifestSize(ctx context.Context, image, target string, auth docker.AuthConfiguration) (size int64, layers int, err error) {
+	host, repo, ref := registryRef(image)
+	m, err := fetchManifest(ctx, host, repo, ref, auth)
+	if err != nil {
+		return
+	}
+	if len(m.Manifests) > 0 {
+		selected := m.Manifests[0]
+		for _, d := range m.Manifests {
+			if d.Platform != nil && strings.HasPrefix(target+"/", d.Platform.OS+"/"+d.Platform.Architecture+"/") {
+				selected = d
+				break
+			}
+		}
+		m, err = fetchManifest(ctx, host, repo, selected.Digest, auth)
+		if err != nil {
+			return
+		}
+	}
+	if len(m.Layers) == 0 {
+		// schema 1 manifests do not carry the layer sizes
+		err = errRegistryUnsupported
+		return
+	}
+	size = m.Config.Size
+	for _, layer := range m.Layers {
+		size += layer.Size
+	}
+	layers = len(m.Layers)
+	return
+}
+
+func fetchManifest(ctx context.Context, host, repo, ref string, auth docker.AuthConfiguration) (m manifest, err error) {
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", registryURL(host), repo, ref)
+	resp, err := registryGet(ctx, manifestURL, "")
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		var authorization string
+		authorization, err = registryAuthorization(ctx, resp.Header.Get("WWW-Authenticate"), auth)
+		if err != nil {
+			return
+		}
+		resp, err = registryGet(ctx, manifestURL, authorization)
+		if err != nil {
+			return
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errRegistryUnsupported
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		err = errRegistryUnsupported
+	}
+	return
+}
+
+func registryGet(ctx context.Context, url, authorization string) (resp *http.Response, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", strings.Join([]string{
+		mediaTypeManifest,
+		mediaTypeManifestList,
+		mediaTypeOCIManifest,
+		mediaTypeOCIImageIndex,
+	}, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err = registryHTTPClient.Do(req)
+	return
+}
+
+// registryAuthorization answers the registry challenge, requesting a bearer token when needed
+func registryAuthorization(ctx context.Context, challenge string, auth docker.AuthConfiguration) (authorization string, err error) {
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "basic":
+		if auth.Username == "" {
+			err = errRegistryUnsupported
+			return
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(auth.Username, auth.Password)
+		authorization = req.Header.Get("Authorization")
+	case "bearer":
+		var token string
+		token, err = registryToken(ctx, params, auth)
+		if err != nil {
+			return
+		}
+		authorization = "Bearer " + token
+	default:
+		err = errRegistryUnsupported
+	}
+	return
+}
+
+func registryToken(ctx context.Context, params map[string]string, auth docker.AuthConfiguration) (token string, err error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		err = errRegistryUnsupported
+		return
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := registryHTTPClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errRegistryUnsupported
+		return
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return
+	}
+	token = body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	return
+}
+
+// parseChallenge parses a WWW-Authenticate header like `Bearer realm="...",service="..."`
+func parseChallenge(challenge string) (scheme string, params map[string]string) {
+	params = make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	scheme = strings.ToLower(parts[0])
+	if len(parts) < 2 {
+		return
+	}
+	for _, param := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return
+}
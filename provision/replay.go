@@ -0,0 +1,457 @@
+package provision
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// FixtureVersion is the version of the fixtures written by Recorder
+const FixtureVersion = 1
+
+var (
+	// ErrReplayIncomplete is raised when a replay ends before all the recorded calls were made
+	ErrReplayIncomplete = errors.New("provision: recorded docker API calls were not replayed")
+
+	apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+	uuidPattern      = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+	// replayGrace is how long a replayed stream waits the stdin of the client once its output is written
+	replayGrace = 200 * time.Millisecond
+)
+
+// Fixture is the docker API calls captured by a Recorder
+type Fixture struct {
+	Version      int           `json:"version"`
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a docker API call. The request body is only kept for JSON documents,
+// with its credentials and the secret variables of a container redacted, as are the secret
+// variables of a JSON answer. A hijacked call has the raw HTTP answer in its chunks.
+type Interaction struct {
+	Method      string              `json:"method"`
+	URI         string              `json:"uri"`
+	RequestBody json.RawMessage     `json:"request_body,omitempty"`
+	Hijacked    bool                `json:"hijacked,omitempty"`
+	Status      int                 `json:"status,omitempty"`
+	Header      map[string][]string `json:"header,omitempty"`
+	Chunks      []Chunk             `json:"chunks"`
+	// Closed is when the daemon closed a hijacked connection, from the start of the call
+	Closed time.Duration `json:"closed,omitempty"`
+}
+
+// Chunk is a part of an answer with the time it was received, from the start of the call
+type Chunk struct {
+	At   time.Duration `json:"at"`
+	Data []byte        `json:"data"`
+}
+
+// key identifies the calls matching the interaction, invocation UUIDs and the API version are ignored
+func (i *Interaction) key() string {
+	return i.Method + " " + normalizeURI(i.URI)
+}
+
+func normalizeURI(uri string) string {
+	uri = apiVersionPrefix.ReplaceAllString(strings.TrimSuffix(uri, "?"), "/")
+	return uuidPattern.ReplaceAllString(uri, "{uuid}")
+}
+
+// Recorder captures the docker API calls of a client, see Record
+type Recorder struct {
+	mu           sync.Mutex
+	interactions []*Interaction
+}
+
+// Record makes client capture its docker API calls, answers and streamed payloads included,
+// the calls are kept in the order they were made. Hijacked calls of TLS clients are not recorded.
+func Record(client *docker.Client) *Recorder {
+	rec := &Recorder{}
+	interceptClient(client, func(next http.RoundTripper) http.RoundTripper {
+		return &recordTransport{recorder: rec, next: next}
+	}, func(next docker.Dialer) docker.Dialer {
+		return &recordDialer{recorder: rec, next: next}
+	})
+	return rec
+}
+
+func (r *Recorder) add(i *Interaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interactions = append(r.interactions, i)
+}
+
+// Fixture returns the calls recorded so far
+func (r *Recorder) Fixture() Fixture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := Fixture{Version: FixtureVersion}
+	for _, i := range r.interactions {
+		f.Interactions = append(f.Interactions, redactAnswer(*i))
+	}
+	return f
+}
+
+// redactAnswer returns i with the secret variables of its JSON answer redacted, e.g. those of
+// an inspected container. A redacted answer is kept as a single chunk.
+func redactAnswer(i Interaction) Interaction {
+	// the answer is parsed whatever its content type, a body that is not JSON is kept as is
+	if i.Hijacked || len(i.Chunks) == 0 {
+		return i
+	}
+	var body []byte
+	for _, chunk := range i.Chunks {
+		body = append(body, chunk.Data...)
+	}
+	if out := redactSecretsJSON(body); !bytes.Equal(out, body) {
+		i.Chunks = []Chunk{{At: i.Chunks[len(i.Chunks)-1].At, Data: out}}
+	}
+	return i
+}
+
+// Save writes the calls recorded so far to the fixture file path
+func (r *Recorder) Save(path string) (err error) {
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(r.Fixture()); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(path, data.Bytes(), 0644)
+	return
+}
+
+// requestBody returns the redacted JSON body of a request, nil for other bodies
+func requestBody(contentType string, body []byte) json.RawMessage {
+	if !isJSON(contentType) || len(bytes.TrimSpace(body)) == 0 || !json.Valid(body) {
+		return nil
+	}
+	return json.RawMessage(redactJSON(body))
+}
+
+type recordTransport struct {
+	recorder *Recorder
+	next     http.RoundTripper
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	i := &Interaction{Method: req.Method, URI: req.URL.RequestURI()}
+	t.recorder.add(i)
+	if req.Body != nil && req.Body != http.NoBody && isJSON(req.Header.Get("Content-Type")) {
+		var body []byte
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		i.RequestBody = requestBody(req.Header.Get("Content-Type"), body)
+	}
+	start := time.Now()
+	resp, err = t.next.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	t.recorder.mu.Lock()
+	i.Status = resp.StatusCode
+	i.Header = make(map[string][]string)
+	for k, v := range resp.Header {
+		if k != "Date" && k != "Content-Length" {
+			i.Header[k] = v
+		}
+	}
+	t.recorder.mu.Unlock()
+	resp.Body = &recordBody{ReadCloser: resp.Body, recorder: t.recorder, interaction: i, start: start}
+	return
+}
+
+// recordBody captures the chunks of an answer as they are read
+type recordBody struct {
+	io.ReadCloser
+	recorder    *Recorder
+	interaction *Interaction
+	start       time.Time
+}
+
+func (b *recordBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 {
+		b.recorder.mu.Lock()
+		b.interaction.Chunks = append(b.interaction.Chunks, Chunk{At: time.Since(b.start), Data: append([]byte(nil), p[:n]...)})
+		b.recorder.mu.Unlock()
+	}
+	return
+}
+
+type recordDialer struct {
+	recorder *Recorder
+	next     docker.Dialer
+}
+
+func (d *recordDialer) Dial(network, address string) (conn net.Conn, err error) {
+	conn, err = d.next.Dial(network, address)
+	if err != nil {
+		return
+	}
+	conn = &recordConn{Conn: conn, recorder: d.recorder, start: time.Now()}
+	return
+}
+
+// recordConn captures a hijacked call, the request is parsed from the bytes written
+// before the first answer and the raw answer is kept in chunks
+type recordConn struct {
+	net.Conn
+	recorder    *Recorder
+	start       time.Time
+	request     bytes.Buffer
+	interaction *Interaction
+	closed      sync.Once
+}
+
+func (c *recordConn) Write(p []byte) (n int, err error) {
+	c.recorder.mu.Lock()
+	if c.interaction == nil {
+		c.request.Write(p)
+	}
+	c.recorder.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *recordConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.recorder.mu.Lock()
+	defer c.recorder.mu.Unlock()
+	if c.interaction == nil {
+		c.interaction = &Interaction{Hijacked: true}
+		req, parseErr := http.ReadRequest(bufio.NewReader(bytes.NewReader(c.request.Bytes())))
+		if parseErr == nil {
+			c.interaction.Method, c.interaction.URI = req.Method, req.URL.RequestURI()
+			body, _ := ioutil.ReadAll(req.Body)
+			c.interaction.RequestBody = requestBody(req.Header.Get("Content-Type"), body)
+		}
+		c.recorder.interactions = append(c.recorder.interactions, c.interaction)
+	}
+	if n > 0 {
+		c.interaction.Chunks = append(c.interaction.Chunks, Chunk{At: time.Since(c.start), Data: append([]byte(nil), p[:n]...)})
+	}
+	return
+}
+
+// CloseWrite half closes the connection as the attach of stdin expects
+func (c *recordConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *recordConn) Close() error {
+	c.closed.Do(func() {
+		c.recorder.mu.Lock()
+		if c.interaction != nil {
+			c.interaction.Closed = time.Since(c.start)
+		}
+		c.recorder.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// ReplayDivergenceError is raised by a replay receiving a call that was not recorded,
+// Expected is the next recorded call not replayed yet, empty when all were replayed
+type ReplayDivergenceError struct {
+	Expected string
+	Got      string
+}
+
+func (e *ReplayDivergenceError) Error() string {
+	expected := e.Expected
+	if expected == "" {
+		expected = "(no more calls)"
+	}
+	return fmt.Sprintf("provision: unexpected docker API call\n- %s\n+ %s", expected, e.Got)
+}
+
+// Replayer serves the calls of a fixture to the clients it returns, see NewReplayer
+type Replayer struct {
+	// Speed scales the recorded timing of the streamed answers, 2 replays twice as fast
+	// and 0 writes them without delay
+	Speed float64
+
+	server       *httptest.Server
+	mu           sync.Mutex
+	interactions []Interaction
+	replayed     []bool
+	err          error
+}
+
+// NewReplayer loads the fixture file path written by Recorder.Save and serves it
+func NewReplayer(path string) (p *Replayer, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var f Fixture
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return
+	}
+	if f.Version != FixtureVersion {
+		err = fmt.Errorf("provision: unsupported fixture version %d", f.Version)
+		return
+	}
+	p = ReplayFixture(f)
+	return
+}
+
+// ReplayFixture serves the calls of f
+func ReplayFixture(f Fixture) *Replayer {
+	p := &Replayer{Speed: 1, interactions: f.Interactions, replayed: make([]bool, len(f.Interactions))}
+	p.server = httptest.NewServer(http.HandlerFunc(p.serveHTTP))
+	return p
+}
+
+// Client returns a client of the replayed daemon
+func (p *Replayer) Client() (*docker.Client, error) {
+	return docker.NewClient(p.server.URL)
+}
+
+// Err returns the first divergence of the replay
+func (p *Replayer) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Close stops the replay, it returns the first divergence or ErrReplayIncomplete
+// when recorded calls were not made
+func (p *Replayer) Close() error {
+	p.server.CloseClientConnections()
+	p.server.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	var missing []string
+	for n, done := range p.replayed {
+		if !done {
+			missing = append(missing, p.interactions[n].Method+" "+p.interactions[n].URI)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%v: %s", ErrReplayIncomplete, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// take returns the first recorded call matching method and uri not replayed yet
+func (p *Replayer) take(method, uri string, body []byte) (i *Interaction, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := method + " " + normalizeURI(uri)
+	next := -1
+	for n := range p.interactions {
+		if p.replayed[n] {
+			continue
+		}
+		if next < 0 {
+			next = n
+		}
+		if p.interactions[n].key() == key {
+			p.replayed[n] = true
+			i = &p.interactions[n]
+			return
+		}
+	}
+	divergence := &ReplayDivergenceError{Got: describeCall(method, uri, body)}
+	if next >= 0 {
+		expected := p.interactions[next]
+		divergence.Expected = describeCall(expected.Method, expected.URI, expected.RequestBody)
+	}
+	if p.err == nil {
+		p.err = divergence
+	}
+	err = divergence
+	return
+}
+
+func describeCall(method, uri string, body []byte) string {
+	call := method + " " + strings.TrimSuffix(uri, "?")
+	if len(body) > 0 {
+		call += " " + string(bytes.TrimSpace(body))
+	}
+	return call
+}
+
+// wait sleeps until at from start with the replay speed
+func (p *Replayer) wait(start time.Time, at time.Duration) {
+	if p.Speed <= 0 {
+		return
+	}
+	if d := time.Duration(float64(at)/p.Speed) - time.Since(start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (p *Replayer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	uri := r.URL.RequestURI()
+	var body []byte
+	if isJSON(r.Header.Get("Content-Type")) {
+		body, _ = ioutil.ReadAll(r.Body)
+		body = requestBody(r.Header.Get("Content-Type"), body)
+	}
+	i, err := p.take(r.Method, uri, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if i.Hijacked {
+		p.serveHijacked(w, i, start)
+		return
+	}
+	for k, v := range i.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(i.Status)
+	flusher, _ := w.(http.Flusher)
+	for _, chunk := range i.Chunks {
+		p.wait(start, chunk.At)
+		_, _ = w.Write(chunk.Data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func (p *Replayer) serveHijacked(w http.ResponseWriter, i *Interaction, start time.Time) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for _, chunk := range i.Chunks {
+		p.wait(start, chunk.At)
+		if _, err = conn.Write(chunk.Data); err != nil {
+			return
+		}
+	}
+	p.wait(start, i.Closed)
+	// leave the client the time to finish writing its stdin before closing
+	_ = conn.SetReadDeadline(time.Now().Add(replayGrace))
+	_, _ = io.Copy(ioutil.Discard, conn)
+}
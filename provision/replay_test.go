@@ -0,0 +1,163 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var replayFixture = filepath.Join("testdata", "replay", "run.json")
+
+// recordRun records a run of the fake docker api writing frames with strategy
+func recordRun(t *testing.T, strategy OutputStrategy, frames []frame) (*Recorder, RunResult) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeFrames(server, frames)
+
+	client := NewTestClient(server.URL(), t)
+	recorder := Record(client)
+	r := NewRunner(client)
+	r.OutputStrategy = strategy
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	return recorder, result
+}
+
+func TestRecordReplayRun(t *testing.T) {
+	frames := []frame{{StreamStdout, "hello\n"}, {StreamStderr, "warning\n"}, {StreamStdout, "bye\n"}}
+	for _, strategy := range []OutputStrategy{OutputLogs, OutputAttach} {
+		t.Run(string(strategy), func(t *testing.T) {
+			recorder, recorded := recordRun(t, strategy, frames)
+			dir, err := ioutil.TempDir("", "gofn-replay")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "run.json")
+			if err = recorder.Save(path); err != nil {
+				t.Fatal(err)
+			}
+
+			replayer, err := NewReplayer(path)
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			client, err := replayer.Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewRunner(client)
+			r.OutputStrategy = strategy
+			result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if result.ContainerID != recorded.ContainerID || result.Stdout.String() != recorded.Stdout.String() ||
+				result.Stderr.String() != recorded.Stderr.String() {
+				t.Errorf("expected the replay %+v to match the recorded run %+v", result, recorded)
+			}
+			if err = replayer.Close(); err != nil {
+				t.Errorf("expected every call to be replayed but found %v", err)
+			}
+		})
+	}
+}
+
+func TestRecordStreamChunks(t *testing.T) {
+	recorder, _ := recordRun(t, OutputAttach, []frame{{StreamStdout, "hello\n"}})
+	var attach *Interaction
+	fixture := recorder.Fixture()
+	for n := range fixture.Interactions {
+		if strings.Contains(fixture.Interactions[n].URI, "/attach") {
+			attach = &fixture.Interactions[n]
+		}
+	}
+	if attach == nil || !attach.Hijacked || attach.Closed == 0 {
+		t.Fatalf("expected the hijacked attach to be recorded but found %+v", attach)
+	}
+	var raw []byte
+	for _, chunk := range attach.Chunks {
+		raw = append(raw, chunk.Data...)
+	}
+	if !strings.HasPrefix(string(raw), "HTTP/1.1 200 OK") || !strings.HasSuffix(string(raw), "hello\n") {
+		t.Errorf("expected the raw answer of the attach but found %q", raw)
+	}
+}
+
+func TestReplayDivergence(t *testing.T) {
+	recorder, _ := recordRun(t, OutputLogs, []frame{{StreamStdout, "hello\n"}})
+	replayer := ReplayFixture(recorder.Fixture())
+	replayer.Speed = 0
+	client, err := replayer.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.InspectContainer("unexpected"); err == nil {
+		t.Error("expected the call missing from the fixture to fail")
+	}
+	divergence, ok := replayer.Close().(*ReplayDivergenceError)
+	if !ok {
+		t.Fatalf("expected a divergence but found %v", replayer.Err())
+	}
+	if divergence.Got != "GET /containers/unexpected/json" || divergence.Expected == "" {
+		t.Errorf("unexpected divergence %+v", divergence)
+	}
+	want := "- " + divergence.Expected + "\n+ GET /containers/unexpected/json"
+	if !strings.HasSuffix(divergence.Error(), want) {
+		t.Errorf("expected the diff %q in %q", want, divergence.Error())
+	}
+}
+
+func TestReplayIncomplete(t *testing.T) {
+	recorder, _ := recordRun(t, OutputLogs, []frame{{StreamStdout, "hello\n"}})
+	replayer := ReplayFixture(recorder.Fixture())
+	if err := replayer.Close(); err == nil || !strings.HasPrefix(err.Error(), ErrReplayIncomplete.Error()) {
+		t.Errorf("expected the calls not made to be reported but found %v", err)
+	}
+}
+
+func TestReplayFixture(t *testing.T) {
+	if *updateGolden {
+		recorder, _ := recordRun(t, OutputAttach, []frame{{StreamStdout, "hello from gofn\n"}})
+		if err := recorder.Save(replayFixture); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replayer, err := NewReplayer(replayFixture)
+	if err != nil {
+		t.Fatalf("expected the committed fixture to load but found %v", err)
+	}
+	_ = replayer.Close()
+}
+
+func ExampleReplayer() {
+	replayer, err := NewReplayer(replayFixture)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	client, err := replayer.Client()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	r := NewRunner(client)
+	r.OutputStrategy = OutputAttach
+	result, err := r.Run(context.Background(), &BuildOptions{ContextDir: "./testing_data", ImageName: "test"}, ContainerOptions{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Print(result.Stdout)
+	fmt.Println(replayer.Close())
+	// Output:
+	// hello from gofn
+	// <nil>
+}
@@ -0,0 +1,231 @@
+package provision
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ResolvedConfigVersion is the version of the snapshots taken by Runner.CaptureResolvedConfig
+const ResolvedConfigVersion = 1
+
+var (
+	// ErrResolvedConfigRedacted is raised when a replayed snapshot still has redacted values
+	ErrResolvedConfigRedacted = errors.New("provision: the resolved config has redacted values")
+
+	// secretNameParts mark the names of the environment variables and template variables
+	// whose values are redacted from the snapshots
+	secretNameParts = []string{"password", "passwd", "secret", "token", "credential", "api_key", "apikey", "private_key"}
+)
+
+// ResolvedBuild is the part of BuildOptions a snapshot keeps, the credentials are not kept
+type ResolvedBuild struct {
+	// ImageName is the full name of the image, BuildOptions.GetImageName
+	ImageName   string     `json:"image_name"`
+	ContextDir  string     `json:"context_dir,omitempty"`
+	Dockerfile  string     `json:"dockerfile,omitempty"`
+	RemoteURI   string     `json:"remote_uri,omitempty"`
+	Target      string     `json:"target,omitempty"`
+	Platform    string     `json:"platform,omitempty"`
+	NetworkMode string     `json:"network_mode,omitempty"`
+	ExtraHosts  []string   `json:"extra_hosts,omitempty"`
+	ForcePull   bool       `json:"force_pull,omitempty"`
+	PullPolicy  PullPolicy `json:"pull_policy,omitempty"`
+	NoCache     bool       `json:"no_cache,omitempty"`
+	CacheFrom   []string   `json:"cache_from,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	// BuildArgs are those of BuildOptions, their secret values redacted
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+	// Registry and Username are those of BuildOptions.Auth
+	Registry string `json:"registry,omitempty"`
+	Username string `json:"username,omitempty"`
+	StdIN    string `json:"stdin,omitempty"`
+}
+
+// ResolvedConfig is the snapshot of the options of a run once the image is resolved, see
+// Runner.CaptureResolvedConfig. The values of the secret environment and template variables
+// and of ContainerOptions.Secrets are redacted and must be given back before a Replay. The input read from a reader by
+// StartRun or RunScript and the files uploaded to the container are not part of it.
+type ResolvedConfig struct {
+	Version   int              `json:"version"`
+	Build     ResolvedBuild    `json:"build"`
+	Container ContainerOptions `json:"container"`
+	// ImageID and ImageDigest pin the image the container was created from, ImageDigest is
+	// empty for an image that was built rather than pulled
+	ImageID     string `json:"image_id"`
+	ImageDigest string `json:"image_digest,omitempty"`
+}
+
+// Digest returns the sha256 of the snapshot, the value of the LabelConfig of its container
+func (c ResolvedConfig) Digest() (digest string, err error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(raw)
+	digest = "sha256:" + hex.EncodeToString(sum[:])
+	return
+}
+
+// Redacted returns the redacted values the container of the snapshot needs, sorted, the build
+// arguments are not needed since Replay does not build
+func (c ResolvedConfig) Redacted() (fields []string) {
+	for _, env := range c.Container.Env {
+		if name := strings.SplitN(env, "=", 2)[0]; env == name+"="+redacted {
+			fields = append(fields, "Container.Env."+name)
+		}
+	}
+	for name, value := range c.Container.TemplateVars {
+		if value == redacted {
+			fields = append(fields, "Container.TemplateVars."+name)
+		}
+	}
+	for name, value := range c.Container.Secrets {
+		if value == redacted {
+			fields = append(fields, "Container.Secrets."+name)
+		}
+	}
+	sort.Strings(fields)
+	return
+}
+
+// isSecretName reports whether the value of the variable name is redacted from the snapshots
+func isSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range secretNameParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveConfig takes the snapshot of a run creating a container from containerOpts.Image
+func resolveConfig(client *docker.Client, buildOpts *BuildOptions, containerOpts ContainerOptions) (resolved *ResolvedConfig, err error) {
+	resolved = &ResolvedConfig{
+		Version: ResolvedConfigVersion,
+		Build: ResolvedBuild{
+			ImageName:   buildOpts.GetImageName(),
+			ContextDir:  buildOpts.ContextDir,
+			Dockerfile:  buildOpts.Dockerfile,
+			RemoteURI:   buildOpts.RemoteURI,
+			Target:      buildOpts.Target,
+			Platform:    buildOpts.Platform,
+			NetworkMode: buildOpts.NetworkMode,
+			ExtraHosts:  buildOpts.ExtraHosts,
+			ForcePull:   buildOpts.ForcePull,
+			PullPolicy:  buildOpts.PullPolicy,
+			NoCache:     buildOpts.NoCache,
+			CacheFrom:   buildOpts.CacheFrom,
+			Tags:        buildOpts.Tags,
+			BuildArgs:   buildOpts.BuildArgs,
+			Registry:    buildOpts.Auth.ServerAddress,
+			Username:    buildOpts.Auth.Username,
+			StdIN:       buildOpts.StdIN,
+		},
+	}
+	resolved.ImageID, resolved.ImageDigest, err = imageIdentity(client, containerOpts.Image)
+	if err != nil {
+		resolved = nil
+		return
+	}
+	resolved.Container = containerOpts
+	// the labels are those of the container, not options to replay
+	resolved.Container.labels = nil
+	resolved = resolved.redact()
+	return
+}
+
+// redact returns a copy of c with the values of the secret variables redacted
+func (c ResolvedConfig) redact() *ResolvedConfig {
+	c.Build.BuildArgs = redactVars(c.Build.BuildArgs)
+	c.Container.TemplateVars = redactVars(c.Container.TemplateVars)
+	if len(c.Container.Secrets) > 0 {
+		// every secret is redacted, whatever its name
+		secrets := make(map[string]string, len(c.Container.Secrets))
+		for name := range c.Container.Secrets {
+			secrets[name] = redacted
+		}
+		c.Container.Secrets = secrets
+	}
+	if len(c.Container.Env) > 0 {
+		env := make([]string, len(c.Container.Env))
+		for i, entry := range c.Container.Env {
+			env[i] = entry
+			if name := strings.SplitN(entry, "=", 2)[0]; isSecretName(name) {
+				env[i] = name + "=" + redacted
+			}
+		}
+		c.Container.Env = env
+	}
+	return &c
+}
+
+// redactVars returns a copy of vars with the values of the secret variables redacted
+func redactVars(vars map[string]string) map[string]string {
+	if len(vars) == 0 {
+		return vars
+	}
+	redactedVars := make(map[string]string, len(vars))
+	for name, value := range vars {
+		if isSecretName(name) {
+			value = redacted
+		}
+		redactedVars[name] = value
+	}
+	return redactedVars
+}
+
+// Replay runs again the run captured by resolved with a Runner using client, see Runner.Replay
+func Replay(client *docker.Client, resolved ResolvedConfig) (result RunResult, err error) {
+	result, err = NewRunner(client).Replay(context.Background(), resolved)
+	return
+}
+
+// Replay runs again the run captured by resolved, the container is created with the same
+// options from the same image: when the name of the image now designates another image, the
+// container is created from ImageID instead, the values given back are not kept in the
+// snapshot of the result. The image is neither built nor pulled, so the
+// replay fails with ErrImageNotFound once it was removed. The redacted values must be given
+// back first, ErrResolvedConfigRedacted is raised otherwise.
+func (r *Runner) Replay(ctx context.Context, resolved ResolvedConfig) (result RunResult, err error) {
+	if fields := resolved.Redacted(); len(fields) > 0 {
+		err = fmt.Errorf("%v: %s", ErrResolvedConfigRedacted, strings.Join(fields, ", "))
+		return
+	}
+	if resolved.Version != ResolvedConfigVersion {
+		err = fmt.Errorf("provision: unsupported resolved config version %d", resolved.Version)
+		return
+	}
+	// created before the copy so the runs of the copy are in the status of the runner
+	r.state()
+	replayer := *r
+	replayer.replay = &resolved
+	buildOpts := &BuildOptions{ImageName: resolved.Build.ImageName, DoNotUsePrefixImageName: true, StdIN: resolved.Build.StdIN}
+	result, err = replayer.run(ctx, buildOpts, resolved.Container, strings.NewReader(resolved.Build.StdIN), nil)
+	err = ClassifyError(err)
+	return
+}
+
+// replayImage returns the image of the replayed container, the image of the snapshot when
+// it still designates ImageID
+func replayImage(client *docker.Client, resolved *ResolvedConfig) (image string, err error) {
+	image = resolved.Container.Image
+	id, _, err := imageIdentity(client, image)
+	if err == nil && id == resolved.ImageID {
+		return
+	}
+	image = resolved.ImageID
+	_, _, err = imageIdentity(client, image)
+	if err == docker.ErrNoSuchImage {
+		err = ErrImageNotFound
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// recordCreateBodies keeps the bodies of the container creations of the fake docker api
+func recordCreateBodies(server *fake.DockerServer) *[]string {
+	var bodies []string
+	server.CustomHandler("/containers/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	return &bodies
+}
+
+func TestRunnerCaptureResolvedConfig(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeFrames(server, []frame{{StreamStdout, "hello\n"}})
+	bodies := recordCreateBodies(server)
+	client := NewTestClient(server.URL(), t)
+	history := NewMemoryRunHistory(0)
+	r := NewRunner(client)
+	r.CaptureResolvedConfig = true
+	r.History = history
+
+	buildOpts := testBuildOptions()
+	buildOpts.StdIN = "input"
+	containerOpts := ContainerOptions{
+		Cmd:          []string{"run", "--fast"},
+		Env:          []string{"MODE=batch", "API_TOKEN=s3cr3t"},
+		TemplateVars: map[string]string{"region": "eu", "db_password": "hunter2"},
+		Secrets:      map[string]string{"DSN": "postgres://fn:pw@db"},
+		Memory:       64 << 20,
+	}
+	result, err := r.Run(context.Background(), buildOpts, containerOpts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	resolved := result.ResolvedConfig
+	if resolved == nil {
+		t.Fatal("expected the resolved config to be captured")
+	}
+	if resolved.Build.ImageName != "gofn/test" || resolved.Build.StdIN != "input" || resolved.Container.Image != "gofn/test" || resolved.ImageID == "" {
+		t.Errorf("unexpected resolved config %+v", resolved)
+	}
+	if !reflect.DeepEqual(resolved.Container.Env, []string{"MODE=batch", "API_TOKEN=" + redacted}) || resolved.Container.TemplateVars["db_password"] != redacted || resolved.Container.TemplateVars["region"] != "eu" {
+		t.Errorf("expected the secrets to be redacted but found %v and %v", resolved.Container.Env, resolved.Container.TemplateVars)
+	}
+	if resolved.Container.Secrets["DSN"] != redacted || !reflect.DeepEqual(resolved.Redacted(), []string{"Container.Env.API_TOKEN", "Container.Secrets.DSN", "Container.TemplateVars.db_password"}) {
+		t.Errorf("expected every secret to be redacted but found %v", resolved.Redacted())
+	}
+	if containerOpts.Env[1] != "API_TOKEN=s3cr3t" || !strings.Contains((*bodies)[0], "API_TOKEN=s3cr3t") {
+		t.Error("expected the container to be created with the secret")
+	}
+	digest, err := resolved.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains((*bodies)[0], `"`+LabelConfig+`":"`+digest+`"`) {
+		t.Errorf("expected the container to be labeled with %s but found %s", digest, (*bodies)[0])
+	}
+	runs, err := history.Query(RunFilter{InvocationID: result.InvocationID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].ResolvedConfig != resolved {
+		t.Errorf("expected the resolved config in the history but found %+v", runs)
+	}
+
+	raw, err := json.Marshal(resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ResolvedConfig
+	if err = json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, *resolved) {
+		t.Errorf("expected the resolved config to round-trip but found\n%+v\n%+v", decoded, *resolved)
+	}
+	if decodedDigest, _ := decoded.Digest(); decodedDigest != digest {
+		t.Errorf("expected the digest %s but found %s", digest, decodedDigest)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeFrames(server, []frame{{StreamStdout, "hello\n"}})
+	bodies := recordCreateBodies(server)
+	client := NewTestClient(server.URL(), t)
+	r := NewRunner(client)
+	r.CaptureResolvedConfig = true
+
+	containerOpts := ContainerOptions{
+		Cmd:            []string{"run"},
+		Env:            []string{"MODE=batch", "API_TOKEN=s3cr3t"},
+		ReadOnlyRootfs: true,
+		NanoCPUs:       5e8,
+	}
+	result, err := r.Run(context.Background(), testBuildOptions(), containerOpts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	raw, err := json.Marshal(result.ResolvedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resolved ResolvedConfig
+	if err = json.Unmarshal(raw, &resolved); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Replay(client, resolved)
+	if err == nil || !strings.Contains(err.Error(), ErrResolvedConfigRedacted.Error()) || !strings.Contains(err.Error(), "Container.Env.API_TOKEN") {
+		t.Fatalf("expected the redacted API_TOKEN to be reported but found %v", err)
+	}
+	if len(*bodies) != 1 {
+		t.Fatal("expected no container to be created with redacted values")
+	}
+
+	resolved.Container.Env[1] = "API_TOKEN=s3cr3t"
+	replayed, err := Replay(client, resolved)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(*bodies) != 2 || (*bodies)[0] != (*bodies)[1] {
+		t.Fatalf("expected the replay to create the same container but found\n%s", strings.Join(*bodies, "\n"))
+	}
+	if replayed.Stdout.String() != "hello\n" || !reflect.DeepEqual(replayed.ResolvedConfig, result.ResolvedConfig) {
+		t.Errorf("unexpected replay %+v", replayed)
+	}
+}
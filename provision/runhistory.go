@@ -0,0 +1,166 @@
+package provision
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DefaultRunHistorySize is the number of runs kept by NewMemoryRunHistory without a size
+const DefaultRunHistorySize = 1000
+
+// RunStatus selects the runs by their exit code
+type RunStatus string
+
+const (
+	// RunAny selects every run
+	RunAny RunStatus = ""
+	// RunSucceeded selects the runs whose container exited with 0
+	RunSucceeded RunStatus = "succeeded"
+	// RunFailed selects the runs whose container exited with another code or did not exit
+	RunFailed RunStatus = "failed"
+)
+
+// RunFilter selects runs of a RunHistory, its zero value selects all of them
+type RunFilter struct {
+	Image        string
+	Status       RunStatus
+	InvocationID string
+	// Since and Until bound the start of the runs, Until excluded, they are ignored when zero
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of runs returned, the latest ones, they are all returned when zero
+	Limit int
+}
+
+// Match reports whether run is selected by f, regardless of Limit
+func (f RunFilter) Match(run RunResult) bool {
+	switch {
+	case f.Image != "" && run.Image != f.Image:
+		return false
+	case f.InvocationID != "" && run.InvocationID != f.InvocationID:
+		return false
+	case f.Status == RunSucceeded && run.ExitCode != 0:
+		return false
+	case f.Status == RunFailed && run.ExitCode == 0:
+		return false
+	case !f.Since.IsZero() && run.StartedAt.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !run.StartedAt.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// RunRetention bounds the runs kept by a RunHistory
+type RunRetention struct {
+	// MaxAge removes the runs started longer ago, it is ignored when zero
+	MaxAge time.Duration
+	// MaxRows removes the oldest runs beyond that number, it is ignored when zero
+	MaxRows int
+}
+
+// RunHistory keeps the runs of a Runner. The output of the runs is not kept.
+type RunHistory interface {
+	Append(run RunResult) error
+	// Query returns the runs selected by filter, the latest first
+	Query(filter RunFilter) ([]RunResult, error)
+	Prune(retention RunRetention) error
+}
+
+// MemoryRunHistory is a RunHistory keeping the latest runs in memory, see NewMemoryRunHistory
+type MemoryRunHistory struct {
+	mu   sync.RWMutex
+	runs []RunResult
+	// next is the position of the next run once runs is full
+	next int
+	size int
+}
+
+// NewMemoryRunHistory returns a RunHistory keeping the latest size runs, DefaultRunHistorySize when size is zero
+func NewMemoryRunHistory(size int) *MemoryRunHistory {
+	if size <= 0 {
+		size = DefaultRunHistorySize
+	}
+	return &MemoryRunHistory{size: size}
+}
+
+// historyEntry strips the output of run
+func historyEntry(run RunResult) RunResult {
+	run.Stdout, run.Stderr, run.Chunks = nil, nil, nil
+	return run
+}
+
+// Append implements RunHistory, the oldest run is dropped once the history is full
+func (h *MemoryRunHistory) Append(run RunResult) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.runs) < h.size {
+		h.runs = append(h.runs, historyEntry(run))
+		return nil
+	}
+	h.runs[h.next] = historyEntry(run)
+	h.next = (h.next + 1) % h.size
+	return nil
+}
+
+// ordered returns the runs from the oldest to the latest appended
+func (h *MemoryRunHistory) ordered() []RunResult {
+	runs := make([]RunResult, 0, len(h.runs))
+	runs = append(runs, h.runs[h.next:]...)
+	return append(runs, h.runs[:h.next]...)
+}
+
+// Query implements RunHistory
+func (h *MemoryRunHistory) Query(filter RunFilter) (runs []RunResult, err error) {
+	h.mu.RLock()
+	all := h.ordered()
+	h.mu.RUnlock()
+	for i := len(all) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(runs) == filter.Limit {
+			break
+		}
+		if filter.Match(all[i]) {
+			runs = append(runs, all[i])
+		}
+	}
+	return
+}
+
+// Prune implements RunHistory
+func (h *MemoryRunHistory) Prune(retention RunRetention) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	runs := h.ordered()
+	if retention.MaxAge > 0 {
+		cutoff := time.Now().Add(-retention.MaxAge)
+		kept := runs[:0]
+		for _, run := range runs {
+			if !run.StartedAt.Before(cutoff) {
+				kept = append(kept, run)
+			}
+		}
+		runs = kept
+	}
+	if retention.MaxRows > 0 && len(runs) > retention.MaxRows {
+		runs = runs[len(runs)-retention.MaxRows:]
+	}
+	// the oldest run is first, so it is the next one replaced once the history is full
+	h.runs = append([]RunResult(nil), runs...)
+	h.next = 0
+	return nil
+}
+
+// invocationID returns the invocation of a container named gofn-<uuid>
+func invocationID(container *docker.Container) string {
+	return strings.TrimPrefix(strings.TrimPrefix(container.Name, "/"), "gofn-")
+}
+
+// recordRun appends the run to r.History, a failure is reported as a warning
+func (r *Runner) recordRun(result *RunResult) {
+	if err := r.History.Append(*result); err != nil {
+		r.emit(EventWarning, result.ContainerID, "unable to record the run: "+err.Error())
+	}
+}
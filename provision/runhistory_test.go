@@ -0,0 +1,166 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// historyRuns are runs of two images started a minute apart from start, the last one of each image failed
+func historyRuns(start time.Time) []RunResult {
+	return []RunResult{
+		{InvocationID: "1", Image: "gofn/a", ExitCode: 0, StartedAt: start},
+		{InvocationID: "2", Image: "gofn/b", ExitCode: 0, StartedAt: start.Add(time.Minute)},
+		{InvocationID: "3", Image: "gofn/a", ExitCode: 0, StartedAt: start.Add(2 * time.Minute)},
+		{InvocationID: "4", Image: "gofn/a", ExitCode: 2, StartedAt: start.Add(3 * time.Minute)},
+		{InvocationID: "5", Image: "gofn/b", ExitCode: -1, StartedAt: start.Add(4 * time.Minute)},
+	}
+}
+
+func invocations(runs []RunResult) (ids string) {
+	for _, run := range runs {
+		ids += run.InvocationID
+	}
+	return
+}
+
+func TestMemoryRunHistoryQuery(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	h := NewMemoryRunHistory(0)
+	for _, run := range historyRuns(start) {
+		if err := h.Append(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		filter RunFilter
+		want   string
+	}{
+		{"all", RunFilter{}, "54321"},
+		{"image", RunFilter{Image: "gofn/a"}, "431"},
+		{"succeeded", RunFilter{Status: RunSucceeded}, "321"},
+		{"failed", RunFilter{Status: RunFailed}, "54"},
+		{"invocation", RunFilter{InvocationID: "3"}, "3"},
+		{"since", RunFilter{Since: start.Add(2 * time.Minute)}, "543"},
+		{"until", RunFilter{Until: start.Add(2 * time.Minute)}, "21"},
+		{"limit", RunFilter{Image: "gofn/a", Limit: 2}, "43"},
+		{"combined", RunFilter{Image: "gofn/b", Status: RunFailed, Since: start}, "5"},
+		{"none", RunFilter{Image: "gofn/c"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs, err := h.Query(tt.filter)
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if got := invocations(runs); got != tt.want {
+				t.Errorf("expected the runs %q but found %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMemoryRunHistoryRetention(t *testing.T) {
+	h := NewMemoryRunHistory(3)
+	start := time.Now().Add(-time.Hour)
+	for _, run := range historyRuns(start) {
+		_ = h.Append(run)
+	}
+	runs, _ := h.Query(RunFilter{})
+	if got := invocations(runs); got != "543" {
+		t.Errorf("expected the ring to keep the 3 latest runs but found %q", got)
+	}
+
+	if err := h.Prune(RunRetention{MaxRows: 2}); err != nil {
+		t.Fatal(err)
+	}
+	runs, _ = h.Query(RunFilter{})
+	if got := invocations(runs); got != "54" {
+		t.Errorf("expected the 2 latest runs but found %q", got)
+	}
+	_ = h.Append(RunResult{InvocationID: "6", StartedAt: time.Now()})
+	_ = h.Append(RunResult{InvocationID: "7", StartedAt: time.Now()})
+	runs, _ = h.Query(RunFilter{})
+	if got := invocations(runs); got != "765" {
+		t.Errorf("expected the pruned ring to drop its oldest run but found %q", got)
+	}
+
+	if err := h.Prune(RunRetention{MaxAge: 30 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	runs, _ = h.Query(RunFilter{})
+	if got := invocations(runs); got != "76" {
+		t.Errorf("expected the runs of the last 30 minutes but found %q", got)
+	}
+}
+
+func TestMemoryRunHistoryConcurrentAppend(t *testing.T) {
+	h := NewMemoryRunHistory(50)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = h.Append(RunResult{InvocationID: fmt.Sprintf("%d-%d", i, j), StartedAt: time.Now()})
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for queried := false; ; queried = true {
+		runs, err := h.Query(RunFilter{Limit: 10})
+		if err != nil || len(runs) > 10 {
+			t.Fatalf("unexpected query of %d runs, %v", len(runs), err)
+		}
+		select {
+		case <-done:
+			if !queried {
+				continue
+			}
+			runs, _ = h.Query(RunFilter{})
+			if len(runs) != 50 {
+				t.Errorf("expected the history to be full but found %d runs", len(runs))
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestRunnerHistory(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 3, 0)
+	fakeLogs(server, "out", "")
+	client := NewTestClient(server.URL(), t)
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	r.History = NewMemoryRunHistory(0)
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if err != ErrContainerExecutionFailed {
+		t.Fatalf("expected ErrContainerExecutionFailed but found %v", err)
+	}
+	runs, err := r.History.Query(RunFilter{Image: "gofn/test", Status: RunFailed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("expected the run in the history but found %+v", runs)
+	}
+	run := runs[0]
+	if run.ContainerID != result.ContainerID || run.ExitCode != 3 || run.InvocationID == "" ||
+		run.StartedAt.IsZero() || run.FinishedAt.Before(run.StartedAt) {
+		t.Errorf("unexpected run %+v", run)
+	}
+	if run.Stdout != nil || result.Stdout.String() != "out" {
+		t.Errorf("expected the output to be kept out of the history, found %q", run.Stdout)
+	}
+}
@@ -0,0 +1,695 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	// ErrUsernsModeNotAllowed is raised when a container opts out of the user namespace remapping without AllowPrivilegedEscape
+	ErrUsernsModeNotAllowed = errors.New("provision: userns mode host requires AllowPrivilegedEscape")
+
+	// ErrRuntimesNotSupported is raised when a container asks for a runtime on a daemon that does not list any,
+	// e.g. a daemon predating runtimes or Podman
+	ErrRuntimesNotSupported = errors.New("provision: the daemon does not support runtimes")
+
+	// ErrResourceLimitNotSupported is raised when a container sets a resource limit the daemon does not enforce
+	ErrResourceLimitNotSupported = errors.New("provision: the daemon does not enforce the resource limit")
+)
+
+// ResourceLimitError is raised when the daemon does not enforce Option, Memory or NanoCPUs
+type ResourceLimitError struct {
+	Option string
+}
+
+func (e *ResourceLimitError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrResourceLimitNotSupported, e.Option)
+}
+
+// Unwrap returns ErrResourceLimitNotSupported
+func (e *ResourceLimitError) Unwrap() error {
+	return ErrResourceLimitNotSupported
+}
+
+// UnknownRuntimeError is raised when a container asks for a runtime the daemon does not list
+type UnknownRuntimeError struct {
+	Runtime   string
+	Available []string
+}
+
+func (e *UnknownRuntimeError) Error() string {
+	return fmt.Sprintf("provision: unknown runtime %q, the daemon supports %s", e.Runtime, strings.Join(e.Available, ", "))
+}
+
+// Runner applies the daemon capabilities and the caller policies to the containers it creates
+type Runner struct {
+	Client *docker.Client
+	// AllowPrivilegedEscape permits containers to opt out of the daemon isolation, e.g. UsernsMode "host"
+	AllowPrivilegedEscape bool
+	// OnEvent receives the events emitted by the runner, it may be nil
+	OnEvent func(Event)
+	// Timeouts bounds each phase of Run
+	Timeouts Timeouts
+	// OutputStrategy selects how Run collects the container output
+	OutputStrategy OutputStrategy
+	// SkipSizeCheck disables the comparison of the image size against the daemon free disk before pulling
+	SkipSizeCheck bool
+	// SizeMargin is the disk space that must remain free after a pull, DefaultSizeMargin when zero
+	SizeMargin int64
+	// HostDiskSize is the daemon disk size, used to compute the free space when the storage driver does not report it
+	HostDiskSize int64
+	// Usage records the images and machines used by the containers the runner creates, it may be nil
+	Usage *UsageIndex
+	// CombinedOutput keeps the output frames of both streams in arrival order in RunResult.Chunks
+	CombinedOutput bool
+	// OnOutput receives each output frame as it arrives, it may be nil
+	OnOutput func(stream StreamKind, chunk []byte)
+	// CollectStats samples the resource usage of the containers while they run into
+	// RunResult.Resources, each sample is emitted as an EventStats
+	CollectStats bool
+	// EgressProxy is the sidecar of the containers with EgressAllowList, DefaultEgressProxy when its Image is empty
+	EgressProxy EgressProxy
+	// Fence serializes the runs sharing an ExclusiveKey, the runs of the process are fenced when nil
+	Fence Fence
+	// History receives the runs of Run once their container is removed, it may be nil
+	History RunHistory
+	// ValidateOptions refuses the options failing ValidateBuildOptions or ValidateContainerOptions
+	// with ValidationErrors before they reach the daemon. BuildPolicy and ContainerPolicy are the
+	// caller rules applied with them, a runner with a policy validates the options it checks
+	// even without ValidateOptions.
+	ValidateOptions bool
+	BuildPolicy     BuildPolicy
+	ContainerPolicy ContainerPolicy
+	// MetaSentinel enables the metadata trailer: a last line of stdout following a line equal to
+	// MetaSentinel, usually DefaultMetaSentinel, is moved from RunResult.Stdout to RunResult.Meta.
+	// The trailer is disabled when empty, and it is left in the output streamed by StartRun.
+	MetaSentinel string
+	// CaptureResolvedConfig keeps the snapshot of the options of each run in RunResult.ResolvedConfig,
+	// and so in History, its digest is set as the LabelConfig of the container, see Replay
+	CaptureResolvedConfig bool
+	// RewriteReference rewrites the image references of the runner before they reach the daemon:
+	// the images built or pulled for BuildOptions, the script images of RunScript included, the
+	// images of its pools, the egress proxy, the helper of the host files and the FROM of SelfTest.
+	// The gofn/ prefix of BuildOptions.ImageName is applied first, then the rewrite, then
+	// BuildPolicy and ContainerPolicy, which see the rewritten references. The reference a
+	// container image was rewritten from is kept in its LabelImageReference and in
+	// RunResult.ImageReference. The FROM of the caller Dockerfiles are not rewritten, pass the
+	// base image as a BuildArgs instead, and a Replay runs the reference of its snapshot as is.
+	RewriteReference ReferenceRewriter
+
+	// status is the state served by StatusHandler, see state
+	status *runnerStatus
+	// stdout and stderr receive the output instead of the buffers of RunResult when set, see StartRun
+	stdout, stderr io.Writer
+	// replay is the snapshot run again by Replay
+	replay *ResolvedConfig
+}
+
+// RunResult is the outcome of Runner.Run
+type RunResult struct {
+	ContainerID    string
+	Stdout         *bytes.Buffer
+	Stderr         *bytes.Buffer
+	OutputStrategy OutputStrategy
+	// Chunks is the combined output, only filled when Runner.CombinedOutput is set
+	Chunks []OutputChunk
+	// EgressViolations are the hosts the egress proxy refused, in the order of the requests
+	EgressViolations []string
+	// Image is the image of the container
+	Image string
+	// ImageReference is the reference of the image given by the caller, Image is the reference
+	// it was rewritten to by Runner.RewriteReference or the image ID with PinToImageID
+	ImageReference string
+	// InvocationID identifies the run, it is the uuid of the container name
+	InvocationID string
+	// ExitCode is the exit code of the container, -1 when it did not exit, e.g. it timed out
+	ExitCode int
+	// OOMKilled is set when the kernel killed the container for exceeding its memory limit,
+	// only by FnRunResult
+	OOMKilled bool
+	// Truncated is set when the beginning of the output was dropped to keep within
+	// RunOptions.MaxOutputBytes, only by FnRunResult
+	Truncated bool
+	// StartedAt and FinishedAt bound the execution of the container
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// State is the last stage reached by the container, Transitions all of them in order
+	State       RunState
+	Transitions []RunTransition
+	// Meta is the JSON metadata trailer of the output, see Runner.MetaSentinel and DecodeMeta
+	Meta json.RawMessage
+	// Warnings are the problems that did not fail the run, e.g. a malformed metadata trailer
+	Warnings []string
+	// ResolvedConfig is the snapshot of the options of the run, only taken when
+	// Runner.CaptureResolvedConfig is set
+	ResolvedConfig *ResolvedConfig
+	// Timings are the instants of the execution, e.g. to measure the first byte latency
+	Timings RunTimings
+	// Resources is the usage sampled while the container ran, only when Runner.CollectStats is set
+	Resources RunResources
+	// Artifacts are the contents of ContainerOptions.OutputPaths by path, a directory is the tar
+	// archive of its content. ArtifactErrors are the paths that could not be collected, e.g.
+	// ErrPathNotFound for a path the container did not write, they do not fail the run.
+	Artifacts      map[string][]byte
+	ArtifactErrors map[string]error
+}
+
+// NewRunner returns a Runner using client
+func NewRunner(client *docker.Client) *Runner {
+	return &Runner{Client: client}
+}
+
+func (r *Runner) emit(kind EventKind, containerID, message string) {
+	if r.OnEvent == nil {
+		return
+	}
+	r.OnEvent(Event{
+		Kind:        kind,
+		ContainerID: containerID,
+		Message:     message,
+		Time:        time.Now(),
+	})
+}
+
+// FnContainer checks opts against the daemon capabilities and the runner policies and creates the container
+func (r *Runner) FnContainer(opts ContainerOptions) (container *docker.Container, err error) {
+	container, err = r.createContainer(context.Background(), opts)
+	err = ClassifyError(err)
+	return
+}
+
+func (r *Runner) createContainer(ctx context.Context, opts ContainerOptions) (container *docker.Container, err error) {
+	if r.ValidateOptions || r.ContainerPolicy != nil {
+		if errs := ValidateContainerOptions(opts, r.ContainerPolicy); len(errs) > 0 {
+			err = ValidationErrors(errs)
+			return
+		}
+	}
+	if opts.UsernsMode == "host" && !r.AllowPrivilegedEscape {
+		err = ErrUsernsModeNotAllowed
+		return
+	}
+	checkRemap := len(opts.Volumes) > 0 && opts.UsernsMode != "host"
+	if checkRemap || opts.Runtime != "" || opts.Memory > 0 || opts.NanoCPUs > 0 {
+		var caps Capabilities
+		caps, err = hostCapabilities(ctx, r.Client)
+		if err != nil {
+			return
+		}
+		if checkRemap && caps.UsernsRemap {
+			r.emit(EventWarning, "", "daemon uses userns-remap, files in bind mounts are owned by the remapped uid/gid and may be inaccessible")
+		}
+		if opts.Runtime != "" {
+			err = checkRuntime(caps, opts.Runtime)
+			if err != nil {
+				return
+			}
+		}
+		err = checkResourceLimits(caps, opts)
+		if err != nil {
+			return
+		}
+	}
+	// the ownership of the bind mounts is only known when the daemon is local
+	if len(opts.Volumes) > 0 && opts.Machine == nil {
+		var user string
+		user, err = containerUser(r.Client, opts)
+		if err != nil {
+			return
+		}
+		if user != "" {
+			r.warnInaccessibleBinds(opts, user)
+		}
+	}
+	if r.RewriteReference != nil && injectsHostFiles(opts) {
+		opts.hostFilesImage = r.rewrite(HostFilesImage)
+	}
+	container, err = createContainer(ctx, r.Client, opts)
+	if err != nil {
+		return
+	}
+	r.emit(EventCreated, container.ID, opts.Image)
+	r.recordUsage(opts)
+	return
+}
+
+// checkRuntime fails when the daemon described by caps can not run runtime
+func checkRuntime(caps Capabilities, runtime string) error {
+	if len(caps.Runtimes) == 0 {
+		return ErrRuntimesNotSupported
+	}
+	for _, name := range caps.Runtimes {
+		if name == runtime {
+			return nil
+		}
+	}
+	return &UnknownRuntimeError{Runtime: runtime, Available: caps.Runtimes}
+}
+
+// checkResourceLimits fails when the daemon described by caps would silently ignore a limit of opts
+func checkResourceLimits(caps Capabilities, opts ContainerOptions) error {
+	if opts.Memory > 0 && !caps.MemoryLimit {
+		return &ResourceLimitError{Option: "Memory"}
+	}
+	if opts.NanoCPUs > 0 && !caps.CPUQuota {
+		return &ResourceLimitError{Option: "NanoCPUs"}
+	}
+	return nil
+}
+
+// recordUsage touches the image and the machine of opts in r.Usage, failures only emit a warning
+func (r *Runner) recordUsage(opts ContainerOptions) {
+	if r.Usage == nil {
+		return
+	}
+	image, err := r.Client.InspectImage(opts.Image)
+	if err == nil {
+		err = r.Usage.TouchImage(image.ID)
+	}
+	if err == nil && opts.Machine != nil {
+		err = r.Usage.TouchMachine(opts.Machine.ID)
+	}
+	if err != nil {
+		r.emit(EventWarning, "", "unable to record usage: "+err.Error())
+	}
+}
+
+// Run ensures the image described by buildOpts exists, runs it writing buildOpts.StdIN
+// to the container stdin and collects the output, the container is removed before returning.
+// Each phase is bounded by the matching field of r.Timeouts and all of them by ctx.
+func (r *Runner) Run(ctx context.Context, buildOpts *BuildOptions, containerOpts ContainerOptions) (result RunResult, err error) {
+	result, err = r.run(ctx, buildOpts, containerOpts, strings.NewReader(buildOpts.StdIN), nil)
+	err = ClassifyError(err)
+	return
+}
+
+// run implements Run reading the container stdin from input, prepare is called
+// with the created container before it is started
+func (r *Runner) run(ctx context.Context, buildOpts *BuildOptions, containerOpts ContainerOptions, input io.Reader, prepare func(ctx context.Context, containerID string) error) (result RunResult, err error) {
+	if r.draining() {
+		err = ErrHostDraining
+		return
+	}
+	err = withPhaseTimeout(ctx, PhaseEnsureImage, r.Timeouts.EnsureImage, func(ctx context.Context) (err error) {
+		if r.replay != nil {
+			containerOpts.Image, err = replayImage(r.Client, r.replay)
+			return
+		}
+		return r.containerImage(ctx, buildOpts, &containerOpts)
+	})
+	if err != nil {
+		return
+	}
+	// snapshot runs the container again on another host when its host is drained
+	var snapshot *ResolvedConfig
+	if r.CaptureResolvedConfig || r.replay != nil {
+		err = r.captureConfig(buildOpts, &containerOpts, &result)
+		if err != nil {
+			return
+		}
+		snapshot = drainSnapshot(result.ResolvedConfig, containerOpts)
+	}
+
+	if containerOpts.ExclusiveKey != "" {
+		// released after the removal of the container and its sidecar, panics included
+		var release func()
+		release, err = r.fence().Acquire(ctx, containerOpts.ExclusiveKey, containerOpts.Image, containerOpts.ExclusivePolicy)
+		if err != nil {
+			return
+		}
+		defer release()
+	}
+
+	if containerOpts.Egress.Mode == EgressAllowList {
+		// the allow list is validated before the sidecar is started whatever ValidateOptions
+		if errs := ValidateContainerOptions(containerOpts, r.ContainerPolicy); len(errs) > 0 {
+			err = ValidationErrors(errs)
+			return
+		}
+		var egress *egressSidecar
+		err = withPhaseTimeout(ctx, PhaseContainerCreate, r.Timeouts.ContainerCreate, func(ctx context.Context) (err error) {
+			egress, err = r.startEgress(ctx, containerOpts.Egress)
+			return
+		})
+		if err != nil {
+			return
+		}
+		// registered before the container removal so the network is removed once the container left it
+		defer func() {
+			violations, logsErr := egress.violations(context.Background())
+			result.EgressViolations = violations
+			removeErr := egress.remove()
+			if err == nil {
+				err = logsErr
+			}
+			if err == nil {
+				err = removeErr
+			}
+		}()
+		port := r.EgressProxy.Port
+		if r.EgressProxy.Image == "" {
+			port = DefaultEgressProxy.Port
+		}
+		containerOpts.Network = egress.network.Name
+		containerOpts.Env = append(append([]string{}, containerOpts.Env...), egress.env(port)...)
+	}
+
+	var container *docker.Container
+	err = withPhaseTimeout(ctx, PhaseContainerCreate, r.Timeouts.ContainerCreate, func(ctx context.Context) (err error) {
+		container, err = r.createContainer(ctx, containerOpts)
+		return
+	})
+	if err != nil {
+		return
+	}
+	result.ContainerID = container.ID
+	result.Image = containerOpts.Image
+	result.ImageReference = buildOpts.GetImageName()
+	result.InvocationID = invocationID(container)
+	defer r.trackDrainable(container.ID, drainableRun{
+		client:       r.Client,
+		invocationID: result.InvocationID,
+		image:        result.Image,
+		startedAt:    time.Now(),
+		snapshot:     snapshot,
+	})()
+	if r.History != nil {
+		defer r.recordRun(&result)
+	}
+	// the removal waits for the output collection whichever path returns, panics included
+	life := newRunLifecycle()
+	defer func() {
+		removeErr := life.remove(r.Client, container.ID, containerOpts.AutoRemove)
+		life.record(&result)
+		if err == nil {
+			err = removeErr
+		}
+	}()
+
+	if prepare != nil {
+		err = withPhaseTimeout(ctx, PhaseContainerCreate, r.Timeouts.ContainerCreate, func(ctx context.Context) error {
+			return prepare(ctx, container.ID)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	err = r.startAndCollect(ctx, life, container.ID, containerOpts.RunAsNonRoot && !containerOpts.AllowRoot, containerOpts.AutoRemove, containerOpts.ExecutionTimeout, shippingOf(containerOpts), input, &result)
+	r.collectArtifacts(ctx, container.ID, containerOpts.OutputPaths, &result)
+	if _, ok := err.(*docker.Error); ok && len(containerOpts.SeccompAllowlist) > 0 && result.ExitCode == -1 {
+		// the daemon refused to start the process under the profile
+		err = &SeccompError{Err: err}
+	}
+	return
+}
+
+// captureConfig keeps the snapshot of the run in result and labels its container with the
+// digest, a replay keeps the snapshot it runs so its container has the same label
+func (r *Runner) captureConfig(buildOpts *BuildOptions, containerOpts *ContainerOptions, result *RunResult) (err error) {
+	var resolved *ResolvedConfig
+	if r.replay != nil {
+		resolved = r.replay.redact()
+	} else {
+		resolved, err = resolveConfig(r.Client, buildOpts, *containerOpts)
+		if err != nil {
+			return
+		}
+	}
+	digest, err := resolved.Digest()
+	if err != nil {
+		return
+	}
+	containerOpts.labels = withLabel(containerOpts.labels, LabelConfig, digest)
+	result.ResolvedConfig = resolved
+	return
+}
+
+// startAndCollect starts the created container, writes input to its stdin, waits it to exit
+// and collects its output into result, checkNonRoot fails the containers running as root.
+// An auto removed container is gone once it exited, so its exit is subscribed to and its
+// output attached before it is started. The stages reached by the container are recorded by life.
+// The execution is bounded by executionTimeout when set, by r.Timeouts.Execution otherwise.
+// The output lines are shipped to the sinks of shipping when not nil.
+func (r *Runner) startAndCollect(ctx context.Context, life *runLifecycle, containerID string, checkNonRoot, autoRemove bool, executionTimeout time.Duration, shipping *logShipping, input io.Reader, result *RunResult) (err error) {
+	timings := &timingRecorder{}
+	start := func() error {
+		return withPhaseTimeout(ctx, PhaseStart, r.Timeouts.Start, func(ctx context.Context) (err error) {
+			err = r.Client.StartContainerWithContext(containerID, nil, ctx)
+			if err != nil {
+				return
+			}
+			timings.mark(&timings.timings.Started)
+			life.advance(RunStarted)
+			if !checkNonRoot {
+				return
+			}
+			return verifyNonRoot(ctx, r.Client, containerID)
+		})
+	}
+	result.ExitCode = -1
+	result.StartedAt = time.Now()
+	defer func() {
+		result.Timings = timings.result(result.FinishedAt.Sub(result.StartedAt))
+	}()
+	defer r.trackRun(result)()
+	defer func() {
+		result.FinishedAt = time.Now()
+	}()
+	var exit <-chan containerExit
+	if autoRemove {
+		waitCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		err = withPhaseTimeout(ctx, PhaseStart, r.Timeouts.Start, func(ctx context.Context) (err error) {
+			exit, err = waitNextExit(waitCtx, r.Client, containerID)
+			return
+		})
+	} else {
+		err = start()
+		start = nil
+	}
+	if err != nil {
+		return
+	}
+
+	strategy := r.outputStrategy()
+	if autoRemove {
+		strategy = OutputAttach
+	}
+	result.OutputStrategy = strategy
+	var outStream, errStream io.Writer = r.stdout, r.stderr
+	if outStream == nil {
+		result.Stdout = new(bytes.Buffer)
+		outStream = result.Stdout
+	}
+	if errStream == nil {
+		result.Stderr = new(bytes.Buffer)
+		errStream = result.Stderr
+	}
+	if r.CombinedOutput || r.OnOutput != nil {
+		recorder := &chunkRecorder{keep: r.CombinedOutput, onOutput: r.OnOutput}
+		outStream = recorder.writer(StreamStdout, outStream)
+		errStream = recorder.writer(StreamStderr, errStream)
+		defer func() {
+			result.Chunks = recorder.recorded()
+		}()
+	}
+	if shipping != nil {
+		shipper := shipping.start(func(message string) {
+			r.emit(EventWarning, containerID, message)
+		})
+		outStream = shipper.writer(StreamStdout, outStream)
+		errStream = shipper.writer(StreamStderr, errStream)
+		defer func() {
+			result.Warnings = append(result.Warnings, shipper.close()...)
+		}()
+	}
+	outStream, errStream = life.writer(outStream), life.writer(errStream)
+	var stdout, stderr io.Writer
+	if strategy == OutputAttach {
+		stdout = timings.writer(&timings.timings.FirstStdout, outStream)
+		stderr = timings.writer(&timings.timings.FirstStderr, errStream)
+	} else {
+		// the logs are read once the container exited
+		timings.unavailable(TimingFirstStdout, TimingFirstStderr)
+	}
+	var stream docker.CloseWaiter
+	if executionTimeout == 0 {
+		executionTimeout = r.Timeouts.Execution
+	}
+	var resources func() RunResources
+	if r.CollectStats {
+		resources = r.collectStats(ctx, containerID)
+	}
+	err = withPhaseTimeout(ctx, PhaseExecution, executionTimeout, func(ctx context.Context) (err error) {
+		stream, result.ExitCode, err = execute(ctx, r.Client, containerID, timings.reader(input), stdout, stderr, start, exit)
+		return
+	})
+	if resources != nil {
+		result.Resources = resources()
+	}
+	if result.ExitCode == -1 && (ctx.Err() != nil || isPhaseTimeout(err, PhaseExecution)) {
+		// the container still runs, it is given its stop timeout to flush its work before the
+		// removal kills it, its output until then is collected
+		_ = stopContainer(r.Client, containerID, containerStopGrace(r.Client, containerID))
+	}
+	if result.ExitCode != -1 {
+		life.advance(RunExited)
+		r.emit(EventExited, containerID, fmt.Sprintf("exit code %d", result.ExitCode))
+	}
+	if stream != nil {
+		defer stream.Close()
+	}
+
+	logsErr := life.collect(ctx, func() error {
+		return withPhaseTimeout(ctx, PhaseLogCollection, r.Timeouts.LogCollection, func(ctx context.Context) error {
+			if strategy == OutputAttach {
+				// the attached stream only ends with the container, keep the partial output otherwise
+				if stream == nil || (err != nil && err != ErrContainerExecutionFailed) {
+					return nil
+				}
+				return waitStream(ctx, stream)
+			}
+			return r.Client.Logs(docker.LogsOptions{
+				Context:      ctx,
+				Container:    containerID,
+				Stdout:       true,
+				Stderr:       true,
+				OutputStream: outStream,
+				ErrorStream:  errStream,
+			})
+		})
+	})
+	if logsErr == nil {
+		extractMeta(r.MetaSentinel, result)
+	}
+	// the execution error is more important than the logs one
+	if err == nil {
+		err = logsErr
+	}
+	return
+}
+
+// containerImage sets the image of containerOpts to the image described by buildOpts, labeled
+// with the reference it was rewritten from and pinned to its ID with PinToImageID
+func (r *Runner) containerImage(ctx context.Context, buildOpts *BuildOptions, containerOpts *ContainerOptions) (err error) {
+	containerOpts.Image, err = r.ensureImage(ctx, buildOpts)
+	if err != nil {
+		return
+	}
+	if reference := buildOpts.GetImageName(); containerOpts.Image != reference {
+		containerOpts.labels = withLabel(containerOpts.labels, LabelImageReference, reference)
+	}
+	if containerOpts.PinToImageID {
+		// resolved right away so a retag before the container creation is not picked up
+		containerOpts.Image, _, err = imageIdentity(r.Client, containerOpts.Image)
+	}
+	return
+}
+
+// ensureImage returns the name of the image described by opts once rewritten, building or
+// pulling it when missing or under PullAlways
+func (r *Runner) ensureImage(ctx context.Context, opts *BuildOptions) (image string, err error) {
+	opts = r.rewriteBuild(opts)
+	if r.ValidateOptions || r.BuildPolicy != nil {
+		if errs := ValidateBuildOptions(*opts, r.BuildPolicy); len(errs) > 0 {
+			err = ValidationErrors(errs)
+			return
+		}
+	}
+	if opts.PullPolicy != PullAlways {
+		var present bool
+		present, err = localImage(ctx, r.Client, opts.GetImageName(), opts.PullPolicy)
+		if err != nil {
+			return
+		}
+		if present {
+			image = opts.GetImageName()
+			return
+		}
+	}
+	if willPull(opts) {
+		err = r.checkImageSize(ctx, opts)
+		if err != nil {
+			return
+		}
+	}
+	if r.OnEvent != nil {
+		copied := *opts
+		onPullProgress := opts.OnPullProgress
+		copied.OnPullProgress = func(update ProgressUpdate) {
+			if onPullProgress != nil {
+				onPullProgress(update)
+			}
+			r.emit(EventPullProgress, "", pullProgressLine(copied.GetImageName(), update.Percent))
+		}
+		opts = &copied
+	}
+	image, _, err = imageBuild(ctx, r.Client, opts)
+	return
+}
+
+// execute writes input to the stdin of a started container, waits it to exit and returns its
+// exit code, -1 when it did not exit. When stdout
+// or stderr are set the container output is attached to them through the returned stream.
+// start is called once attached when the container is not started yet, its exit is then
+// received from exit.
+func execute(ctx context.Context, client *docker.Client, containerID string, input io.Reader, stdout, stderr io.Writer, start func() error, exit <-chan containerExit) (stream docker.CloseWaiter, code int, err error) {
+	code = -1
+	attachOutput := stdout != nil || stderr != nil
+	stream, err = attachStream(ctx, client, docker.AttachToContainerOptions{
+		Container:    containerID,
+		InputStream:  input,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Stdin:        true,
+		Stdout:       attachOutput,
+		Stderr:       attachOutput,
+		Logs:         attachOutput,
+		Stream:       true,
+	})
+	if err != nil {
+		return
+	}
+	if start != nil {
+		if err = start(); err != nil {
+			return
+		}
+	}
+	var exited int
+	if exit != nil {
+		exited, err = awaitExit(ctx, exit)
+	} else {
+		exited, err = exitCode(ctx, client, containerID)
+	}
+	if err != nil {
+		return
+	}
+	code = exited
+	if code != 0 {
+		err = ErrContainerExecutionFailed
+	}
+	return
+}
+
+// waitStream waits the attached stream to be drained
+func waitStream(ctx context.Context, stream docker.CloseWaiter) (err error) {
+	done := make(chan error, 1)
+	goSafe("stream wait", stream.Wait, func(err error) {
+		done <- err
+	})
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
@@ -0,0 +1,133 @@
+package provision
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+func TestRunnerFnContainerUsernsMode(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	r := NewRunner(client)
+	_, err := r.FnContainer(ContainerOptions{Image: image, UsernsMode: "host"})
+	if err != ErrUsernsModeNotAllowed {
+		t.Errorf("expected %q but found %q", ErrUsernsModeNotAllowed, err)
+	}
+
+	r.AllowPrivilegedEscape = true
+	container, err := r.FnContainer(ContainerOptions{Image: image, UsernsMode: "host"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if container.HostConfig.UsernsMode != "host" {
+		t.Errorf("expected userns mode %q but found %q", "host", container.HostConfig.UsernsMode)
+	}
+}
+
+func TestRunnerFnContainerBindMountWarning(t *testing.T) {
+	tests := []struct {
+		name            string
+		securityOptions []string
+		volumes         []string
+		wantWarning     bool
+	}{
+		{"remapped daemon with bind mount", []string{"name=userns"}, []string{"/tmp:/tmp"}, true},
+		{"remapped daemon without bind mount", []string{"name=userns"}, nil, false},
+		{"regular daemon with bind mount", []string{"name=seccomp,profile=default"}, []string{"/tmp:/tmp"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			fakeInfo(server, map[string]interface{}{"SecurityOptions": tt.securityOptions})
+
+			client := NewTestClient(server.URL(), t)
+			image := createFakeImage(client)
+
+			var events []Event
+			r := NewRunner(client)
+			r.OnEvent = func(e Event) {
+				if e.Kind != EventCreated {
+					events = append(events, e)
+				}
+			}
+			_, err := r.FnContainer(ContainerOptions{Image: image, Volumes: tt.volumes})
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			gotWarning := len(events) == 1 && events[0].Kind == EventWarning
+			if gotWarning != tt.wantWarning {
+				t.Errorf("expected warning %v but found events %v", tt.wantWarning, events)
+			}
+		})
+	}
+}
+
+// recordCreate keeps the raw HostConfig of the created containers
+func recordCreate(server *fake.DockerServer) *[]map[string]json.RawMessage {
+	var hostConfigs []map[string]json.RawMessage
+	server.CustomHandler("/containers/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var req struct {
+			HostConfig map[string]json.RawMessage
+		}
+		_ = json.Unmarshal(body, &req)
+		hostConfigs = append(hostConfigs, req.HostConfig)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	return &hostConfigs
+}
+
+func TestRunnerFnContainerRuntime(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	hostConfigs := recordCreate(server)
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+	r := NewRunner(client)
+
+	// a daemon predating runtimes
+	fakeInfo(server, map[string]interface{}{})
+	if _, err := r.FnContainer(ContainerOptions{Image: image}); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, err := r.FnContainer(ContainerOptions{Image: image, Runtime: "runsc"}); err != ErrRuntimesNotSupported {
+		t.Errorf("expected ErrRuntimesNotSupported but found %v", err)
+	}
+
+	fakeInfo(server, map[string]interface{}{
+		"DefaultRuntime": "runc",
+		"Runtimes":       map[string]interface{}{"runc": map[string]string{"path": "runc"}, "runsc": map[string]string{"path": "/usr/bin/runsc"}},
+	})
+	// the daemon was reconfigured
+	InvalidateCapabilities(client)
+	_, err := r.FnContainer(ContainerOptions{Image: image, Runtime: "kata"})
+	runtimeErr, ok := err.(*UnknownRuntimeError)
+	if !ok || runtimeErr.Runtime != "kata" || !reflect.DeepEqual(runtimeErr.Available, []string{"runc", "runsc"}) {
+		t.Errorf("expected an UnknownRuntimeError but found %v", err)
+	}
+	if _, err = r.FnContainer(ContainerOptions{Image: image, Runtime: "runsc"}); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+
+	if len(*hostConfigs) != 2 {
+		t.Fatalf("expected 2 containers but found %d", len(*hostConfigs))
+	}
+	if runtime, ok := (*hostConfigs)[0]["Runtime"]; ok {
+		t.Errorf("expected the runtime to be omitted but found %s", runtime)
+	}
+	if runtime := string((*hostConfigs)[1]["Runtime"]); runtime != `"runsc"` {
+		t.Errorf("expected the runtime runsc but found %s", runtime)
+	}
+}
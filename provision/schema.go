@@ -0,0 +1,330 @@
+package provision
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SchemaVersion is the version of the JSON documents of RunResult, BuildReport and Event, it is
+// bumped by any change of their field names or encodings, see Schemas
+const SchemaVersion = 1
+
+// ErrUnsupportedSchema is raised when decoding a document of a newer SchemaVersion
+var ErrUnsupportedSchema = errors.New("provision: unsupported schema version")
+
+// SchemaVersionError is raised when decoding a document of a newer SchemaVersion
+type SchemaVersionError struct {
+	Version int
+}
+
+func (e *SchemaVersionError) Error() string {
+	return fmt.Sprintf("%v: %d, the latest supported is %d", ErrUnsupportedSchema, e.Version, SchemaVersion)
+}
+
+// Unwrap returns ErrUnsupportedSchema
+func (e *SchemaVersionError) Unwrap() error {
+	return ErrUnsupportedSchema
+}
+
+func checkSchemaVersion(version int) error {
+	if version > SchemaVersion {
+		return &SchemaVersionError{Version: version}
+	}
+	return nil
+}
+
+// schemaTime formats t as RFC3339 in UTC, empty when t is zero
+func schemaTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseSchemaTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// bufferBytes returns the content of b, nil when b is nil
+func bufferBytes(b *bytes.Buffer) []byte {
+	if b == nil {
+		return nil
+	}
+	return b.Bytes()
+}
+
+// bytesBuffer returns a buffer of data, nil when data is nil
+func bytesBuffer(data []byte) *bytes.Buffer {
+	if data == nil {
+		return nil
+	}
+	return bytes.NewBuffer(data)
+}
+
+type outputChunkJSON struct {
+	Stream StreamKind `json:"stream"`
+	Time   string     `json:"time,omitempty"`
+	// Data is base64 encoded
+	Data []byte `json:"data"`
+}
+
+type runTransitionJSON struct {
+	State RunState `json:"state"`
+	At    string   `json:"at"`
+}
+
+type runResultJSON struct {
+	SchemaVersion    int                 `json:"schema_version"`
+	ContainerID      string              `json:"container_id"`
+	Image            string              `json:"image"`
+	InvocationID     string              `json:"invocation_id"`
+	OutputStrategy   OutputStrategy      `json:"output_strategy"`
+	Stdout           []byte              `json:"stdout"`
+	Stderr           []byte              `json:"stderr"`
+	Chunks           []outputChunkJSON   `json:"chunks,omitempty"`
+	EgressViolations []string            `json:"egress_violations,omitempty"`
+	ExitCode         int                 `json:"exit_code"`
+	StartedAt        string              `json:"started_at,omitempty"`
+	FinishedAt       string              `json:"finished_at,omitempty"`
+	State            RunState            `json:"state,omitempty"`
+	Transitions      []runTransitionJSON `json:"transitions,omitempty"`
+	Meta             json.RawMessage     `json:"meta,omitempty"`
+	Warnings         []string            `json:"warnings,omitempty"`
+}
+
+// MarshalJSON encodes the run as the RunResult document of Schemas, the output is base64 encoded
+func (result RunResult) MarshalJSON() ([]byte, error) {
+	doc := runResultJSON{
+		SchemaVersion:    SchemaVersion,
+		ContainerID:      result.ContainerID,
+		Image:            result.Image,
+		InvocationID:     result.InvocationID,
+		OutputStrategy:   result.OutputStrategy,
+		Stdout:           bufferBytes(result.Stdout),
+		Stderr:           bufferBytes(result.Stderr),
+		EgressViolations: result.EgressViolations,
+		ExitCode:         result.ExitCode,
+		StartedAt:        schemaTime(result.StartedAt),
+		FinishedAt:       schemaTime(result.FinishedAt),
+		State:            result.State,
+		Meta:             result.Meta,
+		Warnings:         result.Warnings,
+	}
+	for _, chunk := range result.Chunks {
+		doc.Chunks = append(doc.Chunks, outputChunkJSON{Stream: chunk.Stream, Time: schemaTime(chunk.Time), Data: chunk.Data})
+	}
+	for _, transition := range result.Transitions {
+		doc.Transitions = append(doc.Transitions, runTransitionJSON{State: transition.State, At: schemaTime(transition.At)})
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON decodes a RunResult document of SchemaVersion or older
+func (result *RunResult) UnmarshalJSON(data []byte) (err error) {
+	var doc runResultJSON
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+	if err = checkSchemaVersion(doc.SchemaVersion); err != nil {
+		return
+	}
+	decoded := RunResult{
+		ContainerID:      doc.ContainerID,
+		Image:            doc.Image,
+		InvocationID:     doc.InvocationID,
+		OutputStrategy:   doc.OutputStrategy,
+		Stdout:           bytesBuffer(doc.Stdout),
+		Stderr:           bytesBuffer(doc.Stderr),
+		EgressViolations: doc.EgressViolations,
+		ExitCode:         doc.ExitCode,
+		State:            doc.State,
+		Meta:             doc.Meta,
+		Warnings:         doc.Warnings,
+	}
+	if decoded.StartedAt, err = parseSchemaTime(doc.StartedAt); err != nil {
+		return
+	}
+	if decoded.FinishedAt, err = parseSchemaTime(doc.FinishedAt); err != nil {
+		return
+	}
+	for _, chunk := range doc.Chunks {
+		c := OutputChunk{Stream: chunk.Stream, Data: chunk.Data}
+		if c.Time, err = parseSchemaTime(chunk.Time); err != nil {
+			return
+		}
+		decoded.Chunks = append(decoded.Chunks, c)
+	}
+	for _, transition := range doc.Transitions {
+		t := RunTransition{State: transition.State}
+		if t.At, err = parseSchemaTime(transition.At); err != nil {
+			return
+		}
+		decoded.Transitions = append(decoded.Transitions, t)
+	}
+	*result = decoded
+	return
+}
+
+type buildReportJSON struct {
+	SchemaVersion int    `json:"schema_version"`
+	Name          string `json:"name"`
+	ID            string `json:"id"`
+	Digest        string `json:"digest,omitempty"`
+	Stdout        []byte `json:"stdout"`
+}
+
+// MarshalJSON encodes the report as the BuildReport document of Schemas, the output is base64 encoded
+func (report BuildReport) MarshalJSON() ([]byte, error) {
+	return json.Marshal(buildReportJSON{
+		SchemaVersion: SchemaVersion,
+		Name:          report.Name,
+		ID:            report.ID,
+		Digest:        report.Digest,
+		Stdout:        bufferBytes(report.Stdout),
+	})
+}
+
+// UnmarshalJSON decodes a BuildReport document of SchemaVersion or older
+func (report *BuildReport) UnmarshalJSON(data []byte) (err error) {
+	var doc buildReportJSON
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+	if err = checkSchemaVersion(doc.SchemaVersion); err != nil {
+		return
+	}
+	*report = BuildReport{Name: doc.Name, ID: doc.ID, Digest: doc.Digest, Stdout: bytesBuffer(doc.Stdout)}
+	return
+}
+
+type eventJSON struct {
+	SchemaVersion int       `json:"schema_version"`
+	Kind          EventKind `json:"kind"`
+	ContainerID   string    `json:"container_id,omitempty"`
+	Message       string    `json:"message"`
+	Time          string    `json:"time"`
+}
+
+// MarshalJSON encodes the event as the Event document of Schemas
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(eventJSON{
+		SchemaVersion: SchemaVersion,
+		Kind:          e.Kind,
+		ContainerID:   e.ContainerID,
+		Message:       e.Message,
+		Time:          schemaTime(e.Time),
+	})
+}
+
+// UnmarshalJSON decodes an Event document of SchemaVersion or older
+func (e *Event) UnmarshalJSON(data []byte) (err error) {
+	var doc eventJSON
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+	if err = checkSchemaVersion(doc.SchemaVersion); err != nil {
+		return
+	}
+	decoded := Event{Kind: doc.Kind, ContainerID: doc.ContainerID, Message: doc.Message}
+	if decoded.Time, err = parseSchemaTime(doc.Time); err != nil {
+		return
+	}
+	*e = decoded
+	return
+}
+
+// Schemas returns the JSON Schema documents of the JSON encodings of RunResult, BuildReport
+// and Event by type name, so the consumers written in other languages can validate them
+func Schemas() map[string][]byte {
+	schemas := make(map[string][]byte, len(jsonSchemas))
+	for name, schema := range jsonSchemas {
+		schemas[name] = []byte(schema)
+	}
+	return schemas
+}
+
+var jsonSchemas = map[string]string{
+	"RunResult": `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/gofn/gofn/schemas/v1/run_result.json",
+  "title": "RunResult",
+  "type": "object",
+  "required": ["schema_version", "container_id", "image", "invocation_id", "output_strategy", "stdout", "stderr", "exit_code"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "container_id": {"type": "string"},
+    "image": {"type": "string"},
+    "invocation_id": {"type": "string"},
+    "output_strategy": {"type": "string"},
+    "stdout": {"type": ["string", "null"], "contentEncoding": "base64"},
+    "stderr": {"type": ["string", "null"], "contentEncoding": "base64"},
+    "chunks": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["stream", "data"],
+        "properties": {
+          "stream": {"enum": ["stdout", "stderr"]},
+          "time": {"type": "string", "format": "date-time"},
+          "data": {"type": ["string", "null"], "contentEncoding": "base64"}
+        }
+      }
+    },
+    "egress_violations": {"type": "array", "items": {"type": "string"}},
+    "exit_code": {"type": "integer"},
+    "started_at": {"type": "string", "format": "date-time"},
+    "finished_at": {"type": "string", "format": "date-time"},
+    "state": {"enum": ["created", "started", "exited", "collected", "removed"]},
+    "transitions": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["state", "at"],
+        "properties": {
+          "state": {"enum": ["created", "started", "exited", "collected", "removed"]},
+          "at": {"type": "string", "format": "date-time"}
+        }
+      }
+    },
+    "meta": {},
+    "warnings": {"type": "array", "items": {"type": "string"}}
+  }
+}
+`,
+	"BuildReport": `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/gofn/gofn/schemas/v1/build_report.json",
+  "title": "BuildReport",
+  "type": "object",
+  "required": ["schema_version", "name", "id", "stdout"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "name": {"type": "string"},
+    "id": {"type": "string"},
+    "digest": {"type": "string"},
+    "stdout": {"type": ["string", "null"], "contentEncoding": "base64"}
+  }
+}
+`,
+	"Event": `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/gofn/gofn/schemas/v1/event.json",
+  "title": "Event",
+  "type": "object",
+  "required": ["schema_version", "kind", "message", "time"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "kind": {"type": "string"},
+    "container_id": {"type": "string"},
+    "message": {"type": "string"},
+    "time": {"type": "string", "format": "date-time"}
+  }
+}
+`,
+}
@@ -0,0 +1,146 @@
+package provision
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func schemaFixtures() map[string]interface{} {
+	started := time.Date(2020, 3, 14, 15, 9, 26, 535000000, time.FixedZone("BRT", -3*60*60))
+	finished := started.Add(1500 * time.Millisecond)
+	return map[string]interface{}{
+		"run_result": &RunResult{
+			ContainerID:    "a1b2c3",
+			Image:          "gofn/python:latest",
+			InvocationID:   "0f8fad5b-d9cb-469f-a165-70867728950e",
+			OutputStrategy: OutputLogs,
+			Stdout:         bytes.NewBufferString("hello\n"),
+			Stderr:         bytes.NewBuffer([]byte{0xff, 0x00, 'e', '\n'}),
+			Chunks: []OutputChunk{
+				{Stream: StreamStdout, Time: started, Data: []byte("hello\n")},
+				{Stream: StreamStderr, Time: finished, Data: []byte{0xff, 0x00, 'e', '\n'}},
+			},
+			EgressViolations: []string{"10.0.0.1:443"},
+			ExitCode:         3,
+			StartedAt:        started,
+			FinishedAt:       finished,
+			State:            RunRemoved,
+			Transitions: []RunTransition{
+				{State: RunCreated, At: started},
+				{State: RunRemoved, At: finished},
+			},
+			Meta:     json.RawMessage(`{"rows":3}`),
+			Warnings: []string{"output truncated"},
+		},
+		"build_report": &BuildReport{
+			Name:   "gofn/python:latest",
+			ID:     "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			Digest: "sha256:60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752",
+			Stdout: bytes.NewBufferString("Step 1/1 : FROM python\n"),
+		},
+		"event": &Event{Kind: EventWarning, ContainerID: "a1b2c3", Message: "memory limit ignored", Time: started},
+	}
+}
+
+func TestSchemaGolden(t *testing.T) {
+	for name, v := range schemaFixtures() {
+		t.Run(name, func(t *testing.T) {
+			got, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", "schema", name+".golden.json")
+			if *updateGolden {
+				if err = ioutil.WriteFile(path, append(got, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(want)) != string(got) {
+				t.Errorf("%s does not match the golden file, bump SchemaVersion when changing it\nwant:\n%s\ngot:\n%s", name, want, got)
+			}
+		})
+	}
+}
+
+func TestSchemaRoundTrip(t *testing.T) {
+	for name, v := range schemaFixtures() {
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+			if err = json.Unmarshal(data, decoded); err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			again, err := json.Marshal(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, again) {
+				t.Errorf("expected the round trip to keep\n%s\nbut found\n%s", data, again)
+			}
+		})
+	}
+
+	var result RunResult
+	if err := json.Unmarshal([]byte(`{"schema_version":1,"container_id":"a1b2c3","stdout":null,"stderr":"AP8=","started_at":"2020-03-14T18:09:26.535Z"}`), &result); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Stdout != nil || !bytes.Equal(result.Stderr.Bytes(), []byte{0x00, 0xff}) {
+		t.Errorf("unexpected output %v %v", result.Stdout, result.Stderr)
+	}
+	if !result.StartedAt.Equal(time.Date(2020, 3, 14, 18, 9, 26, 535000000, time.UTC)) || !result.FinishedAt.IsZero() {
+		t.Errorf("unexpected times %v %v", result.StartedAt, result.FinishedAt)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	for _, v := range []interface{}{&RunResult{}, &BuildReport{}, &Event{}} {
+		err := json.Unmarshal([]byte(`{"schema_version":2}`), v)
+		versionErr, ok := err.(*SchemaVersionError)
+		if !ok || versionErr.Unwrap() != ErrUnsupportedSchema || versionErr.Version != 2 {
+			t.Errorf("expected a SchemaVersionError decoding %T but found %v", v, err)
+		}
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(`{"kind":"warning","time":"yesterday"}`), &e); err == nil {
+		t.Errorf("expected the malformed time to be rejected")
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	schemas := Schemas()
+	for _, name := range []string{"RunResult", "BuildReport", "Event"} {
+		var doc struct {
+			Title      string                     `json:"title"`
+			Required   []string                   `json:"required"`
+			Properties map[string]json.RawMessage `json:"properties"`
+		}
+		if err := json.Unmarshal(schemas[name], &doc); err != nil {
+			t.Fatalf("%s schema: %s", name, err)
+		}
+		if doc.Title != name {
+			t.Errorf("expected the %s schema but found %q", name, doc.Title)
+		}
+		for _, field := range doc.Required {
+			if _, ok := doc.Properties[field]; !ok {
+				t.Errorf("%s schema requires the undeclared %q", name, field)
+			}
+		}
+	}
+	schemas["Event"][0] = 'x'
+	if Schemas()["Event"][0] != '{' {
+		t.Errorf("expected Schemas to return copies")
+	}
+}
@@ -0,0 +1,162 @@
+package provision
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	// ErrUnsupportedLanguage is raised when RunScript does not know how to run a language
+	ErrUnsupportedLanguage = errors.New("provision: unsupported script language")
+)
+
+// scriptDir is where RunScript uploads the source inside the container
+const scriptDir = "/gofn"
+
+// ScriptLanguage describes how RunScript runs the source of a language
+type ScriptLanguage struct {
+	// Image is the pinned image with the interpreter
+	Image string
+	// File is the name given to the uploaded source
+	File string
+	// Cmd is the interpreter command, the source path is appended to it
+	Cmd []string
+}
+
+// ScriptLanguages returns the languages known by RunScript, the map is a new copy at each call so
+// changing it has no effect, use WithLanguage to override them per call
+func ScriptLanguages() map[string]ScriptLanguage {
+	return map[string]ScriptLanguage{
+		"python": {Image: "python:3.12.4-alpine3.20", File: "main.py", Cmd: []string{"python", "-u"}},
+		"node":   {Image: "node:20.15.1-alpine3.20", File: "main.js", Cmd: []string{"node"}},
+		"bash":   {Image: "bash:5.2.26-alpine3.20", File: "main.sh", Cmd: []string{"bash"}},
+		"ruby":   {Image: "ruby:3.3.4-alpine3.20", File: "main.rb", Cmd: []string{"ruby"}},
+	}
+}
+
+// UnsupportedLanguageError reports a language RunScript can not run
+type UnsupportedLanguageError struct {
+	Language  string
+	Supported []string
+}
+
+func (e *UnsupportedLanguageError) Error() string {
+	return fmt.Sprintf("%v: %q, supported languages are %s", ErrUnsupportedLanguage, e.Language, strings.Join(e.Supported, ", "))
+}
+
+// Unwrap returns ErrUnsupportedLanguage
+func (e *UnsupportedLanguageError) Unwrap() error {
+	return ErrUnsupportedLanguage
+}
+
+type scriptConfig struct {
+	languages     map[string]ScriptLanguage
+	runner        *Runner
+	containerOpts ContainerOptions
+}
+
+// ScriptOption customizes RunScript
+type ScriptOption func(*scriptConfig)
+
+// WithLanguage adds or replaces the language name for a single call
+func WithLanguage(name string, lang ScriptLanguage) ScriptOption {
+	return func(c *scriptConfig) {
+		c.languages[name] = lang
+	}
+}
+
+// WithRunner runs the script through r instead of a default Runner
+func WithRunner(r *Runner) ScriptOption {
+	return func(c *scriptConfig) {
+		c.runner = r
+	}
+}
+
+// WithContainerOptions sets the options of the script container, Image and Cmd are replaced
+func WithContainerOptions(opts ContainerOptions) ScriptOption {
+	return func(c *scriptConfig) {
+		c.containerOpts = opts
+	}
+}
+
+// scriptCommand returns the command running the uploaded source of lang
+func scriptCommand(lang ScriptLanguage) []string {
+	cmd := make([]string, 0, len(lang.Cmd)+1)
+	cmd = append(cmd, lang.Cmd...)
+	return append(cmd, path.Join(scriptDir, lang.File))
+}
+
+// scriptArchive returns a tar with the source at scriptDir, rooted at /
+func scriptArchive(lang ScriptLanguage, source []byte) (archive *bytes.Buffer, err error) {
+	archive = new(bytes.Buffer)
+	tw := tar.NewWriter(archive)
+	dir := strings.TrimPrefix(scriptDir, "/")
+	err = tw.WriteHeader(&tar.Header{Name: dir + "/", Mode: 0755, Typeflag: tar.TypeDir})
+	if err != nil {
+		return
+	}
+	err = tw.WriteHeader(&tar.Header{Name: path.Join(dir, lang.File), Mode: 0644, Size: int64(len(source))})
+	if err != nil {
+		return
+	}
+	_, err = tw.Write(source)
+	if err != nil {
+		return
+	}
+	err = tw.Close()
+	return
+}
+
+// RunScript runs source with the interpreter of lang writing input to its stdin,
+// the image is pulled when missing and the container is removed before returning
+func RunScript(ctx context.Context, client *docker.Client, lang string, source []byte, input io.Reader, opts ...ScriptOption) (result RunResult, err error) {
+	cfg := scriptConfig{languages: ScriptLanguages()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	language, ok := cfg.languages[lang]
+	if !ok {
+		supported := make([]string, 0, len(cfg.languages))
+		for name := range cfg.languages {
+			supported = append(supported, name)
+		}
+		sort.Strings(supported)
+		err = &UnsupportedLanguageError{Language: lang, Supported: supported}
+		return
+	}
+	archive, err := scriptArchive(language, source)
+	if err != nil {
+		return
+	}
+	r := cfg.runner
+	if r == nil {
+		r = NewRunner(client)
+	}
+	if input == nil {
+		input = strings.NewReader("")
+	}
+	buildOpts := &BuildOptions{
+		ImageName:               language.Image,
+		DoNotUsePrefixImageName: true,
+		ForcePull:               true,
+	}
+	containerOpts := cfg.containerOpts
+	containerOpts.Cmd = scriptCommand(language)
+	result, err = r.run(ctx, buildOpts, containerOpts, input, func(ctx context.Context, containerID string) error {
+		return r.Client.UploadToContainer(containerID, docker.UploadToContainerOptions{
+			InputStream: archive,
+			Path:        "/",
+			Context:     ctx,
+		})
+	})
+	return
+}
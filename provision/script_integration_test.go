@@ -0,0 +1,34 @@
+package provision
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRunScriptIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	client, err := FnClient("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := map[string]string{
+		"python": "import sys\nprint(sys.stdin.read().upper())",
+		"node":   "let s='';process.stdin.on('data',d=>s+=d).on('end',()=>console.log(s.toUpperCase()))",
+		"bash":   "tr a-z A-Z",
+		"ruby":   "puts STDIN.read.upcase",
+	}
+	for lang, source := range sources {
+		t.Run(lang, func(t *testing.T) {
+			result, err := RunScript(context.Background(), client, lang, []byte(source), strings.NewReader("gofn"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(result.Stdout.String()); got != "GOFN" {
+				t.Errorf("expected %q but found %q, stderr %q", "GOFN", got, result.Stderr.String())
+			}
+		})
+	}
+}
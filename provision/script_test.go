@@ -0,0 +1,101 @@
+package provision
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScriptCommand(t *testing.T) {
+	tests := []struct {
+		lang string
+		want []string
+	}{
+		{"python", []string{"python", "-u", "/gofn/main.py"}},
+		{"node", []string{"node", "/gofn/main.js"}},
+		{"bash", []string{"bash", "/gofn/main.sh"}},
+		{"ruby", []string{"ruby", "/gofn/main.rb"}},
+	}
+	for _, tt := range tests {
+		lang := ScriptLanguages()[tt.lang]
+		if got := scriptCommand(lang); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scriptCommand(%s) = %v, want %v", tt.lang, got, tt.want)
+		}
+		// the language command must not be changed by appending the source
+		if len(lang.Cmd) == len(tt.want) {
+			t.Errorf("scriptCommand(%s) changed the language command", tt.lang)
+		}
+	}
+}
+
+func TestRunScriptUnsupportedLanguage(t *testing.T) {
+	_, err := RunScript(context.Background(), nil, "cobol", nil, nil, WithLanguage("lua", ScriptLanguage{Image: "lua", File: "main.lua", Cmd: []string{"lua"}}))
+	langErr, ok := err.(*UnsupportedLanguageError)
+	if !ok {
+		t.Fatalf("expected UnsupportedLanguageError but found %#v", err)
+	}
+	if langErr.Unwrap() != ErrUnsupportedLanguage {
+		t.Errorf("expected ErrUnsupportedLanguage but found %q", langErr.Unwrap())
+	}
+	want := []string{"bash", "lua", "node", "python", "ruby"}
+	if !reflect.DeepEqual(langErr.Supported, want) {
+		t.Errorf("expected supported languages %v but found %v", want, langErr.Supported)
+	}
+	if _, ok := ScriptLanguages()["lua"]; ok {
+		t.Error("WithLanguage must not change ScriptLanguages")
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "hello\n", "")
+	uploaded := map[string]string{}
+	server.CustomHandler("/containers/.*/archive", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr := tar.NewReader(r.Body)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			content, _ := ioutil.ReadAll(tr)
+			uploaded[r.URL.Query().Get("path")+header.Name] = string(content)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	var created struct{ Cmd []string }
+	server.CustomHandler("/containers/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &created)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+
+	client := NewTestClient(server.URL(), t)
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	source := "print('hello')"
+	result, err := RunScript(context.Background(), client, "python", []byte(source), strings.NewReader("input"), WithRunner(r))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Stdout.String() != "hello\n" {
+		t.Errorf("expected stdout %q but found %q", "hello\n", result.Stdout.String())
+	}
+	if uploaded["/gofn/main.py"] != source {
+		t.Errorf("expected the source to be uploaded to /gofn/main.py but found %v", uploaded)
+	}
+	if want := []string{"python", "-u", "/gofn/main.py"}; !reflect.DeepEqual(created.Cmd, want) {
+		t.Errorf("expected command %v but found %v", want, created.Cmd)
+	}
+	if _, err := FnFindContainerByID(client, result.ContainerID); err != ErrContainerNotFound {
+		t.Errorf("expected container to be removed but found %q", err)
+	}
+}
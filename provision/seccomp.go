@@ -0,0 +1,127 @@
+package provision
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+var (
+	// ErrSeccompStart is raised when a container with a SeccompAllowlist fails to start
+	ErrSeccompStart = errors.New("provision: container failed to start under its seccomp allowlist")
+)
+
+// syscallPattern matches the names of the syscalls
+var syscallPattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// SeccompError is returned by Runner.Run when the daemon fails to start a container with a
+// SeccompAllowlist, the list usually misses a syscall the runtime needs to start
+type SeccompError struct {
+	Err error
+}
+
+func (e *SeccompError) Error() string {
+	return fmt.Sprintf("%v, check that ContainerOptions.SeccompAllowlist has the syscalls the runtime needs: %v", ErrSeccompStart, e.Err)
+}
+
+// Unwrap returns ErrSeccompStart
+func (e *SeccompError) Unwrap() error {
+	return ErrSeccompStart
+}
+
+// seccompBaseline are the syscalls the runtime and the libc need to start a process, they are
+// allowed by every generated profile
+var seccompBaseline = []string{
+	"access", "arch_prctl", "brk", "capget", "capset", "chdir", "close", "close_range", "dup", "dup2",
+	"dup3", "execve", "exit", "exit_group", "faccessat", "faccessat2", "fchdir", "fchown", "fcntl",
+	"fstat", "fstatfs", "futex", "getcwd", "getdents64", "getegid", "geteuid", "getgid", "getpid",
+	"getppid", "getrandom", "getrlimit", "gettid", "getuid", "ioctl", "lseek", "lstat", "madvise",
+	"mmap", "mprotect", "munmap", "nanosleep", "newfstatat", "open", "openat", "pread64", "prctl",
+	"prlimit64", "read", "readlink", "readlinkat", "readv", "rseq", "rt_sigaction", "rt_sigprocmask",
+	"rt_sigreturn", "sched_getaffinity", "sched_yield", "set_robust_list", "set_tid_address",
+	"setgid", "setgroups", "setuid", "sigaltstack", "stat", "statfs", "statx", "sysinfo", "uname",
+	"write", "writev",
+}
+
+// seccompRuntimes are the syscalls the interpreters of RunScript use beyond the baseline
+var seccompRuntimes = map[string][]string{
+	"python": {
+		"clock_gettime", "epoll_create1", "epoll_ctl", "epoll_wait", "getdents", "gettimeofday",
+		"mremap", "pipe", "pipe2", "poll", "select", "socket", "connect", "unlink", "wait4",
+	},
+	"node": {
+		"clock_gettime", "clone", "clone3", "epoll_create1", "epoll_ctl", "epoll_pwait", "epoll_wait",
+		"eventfd2", "gettimeofday", "io_uring_setup", "membarrier", "mremap", "pipe2", "poll",
+		"socketpair", "statx", "timerfd_create", "timerfd_settime",
+	},
+	"bash": {
+		"clone", "clone3", "fork", "getpgrp", "pipe", "pipe2", "rt_sigsuspend", "setpgid", "umask",
+		"vfork", "wait4",
+	},
+	"ruby": {
+		"clock_gettime", "clone", "clone3", "eventfd2", "getdents", "gettimeofday", "mremap", "pipe2",
+		"poll", "ppoll", "timer_create", "timer_delete", "timer_settime", "wait4",
+	},
+}
+
+// SeccompRuntimeSyscalls returns the syscalls the interpreter of the RunScript language lang
+// uses beyond the baseline allowed by every profile, false for an unknown language
+func SeccompRuntimeSyscalls(lang string) (syscalls []string, ok bool) {
+	list, ok := seccompRuntimes[lang]
+	syscalls = append([]string(nil), list...)
+	return
+}
+
+type seccompSyscalls struct {
+	Names  []string `json:"names"`
+	Action string   `json:"action"`
+}
+
+type seccompProfile struct {
+	DefaultAction string            `json:"defaultAction"`
+	Architectures []string          `json:"architectures"`
+	Syscalls      []seccompSyscalls `json:"syscalls"`
+}
+
+// SeccompProfile returns the seccomp profile denying every syscall with EPERM but the ones of
+// allowlist and of the baseline the runtime and the libc need to start a process
+func SeccompProfile(allowlist []string) (profile []byte, err error) {
+	allowed := make(map[string]bool, len(seccompBaseline)+len(allowlist))
+	for _, name := range seccompBaseline {
+		allowed[name] = true
+	}
+	for _, name := range allowlist {
+		if !syscallPattern.MatchString(name) {
+			err = fmt.Errorf("provision: %q is not a syscall name", name)
+			return
+		}
+		allowed[name] = true
+	}
+	names := make([]string, 0, len(allowed))
+	for name := range allowed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	profile, err = json.Marshal(seccompProfile{
+		DefaultAction: "SCMP_ACT_ERRNO",
+		Architectures: []string{"SCMP_ARCH_X86_64", "SCMP_ARCH_X86", "SCMP_ARCH_X32", "SCMP_ARCH_AARCH64", "SCMP_ARCH_ARM"},
+		Syscalls:      []seccompSyscalls{{Names: names, Action: "SCMP_ACT_ALLOW"}},
+	})
+	return
+}
+
+// seccompSecurityOpt returns the security option applying the profile of allowlist, the profile
+// is given inline so there is no file to clean up after the run
+func seccompSecurityOpt(allowlist []string) (securityOpt []string, err error) {
+	if len(allowlist) == 0 {
+		return
+	}
+	profile, err := SeccompProfile(allowlist)
+	if err != nil {
+		return
+	}
+	securityOpt = []string{"seccomp=" + string(profile)}
+	return
+}
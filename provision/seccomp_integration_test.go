@@ -0,0 +1,34 @@
+package provision
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSeccompAllowlistIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	client, err := FnClient("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscalls, _ := SeccompRuntimeSyscalls("bash")
+	// mkdir is allowed by the second run only
+	for _, allowMkdir := range []bool{false, true} {
+		allowlist := syscalls
+		if allowMkdir {
+			allowlist = append(append([]string{}, syscalls...), "mkdir", "mkdirat")
+		}
+		opts := ContainerOptions{SeccompAllowlist: allowlist}
+		result, err := RunScript(context.Background(), client, "bash", []byte("mkdir /tmp/gofn && echo created"), nil, WithContainerOptions(opts))
+		created := strings.TrimSpace(result.Stdout.String()) == "created"
+		if allowMkdir && (err != nil || !created) {
+			t.Errorf("expected mkdir to be allowed but found %v, stderr %q", err, result.Stderr)
+		}
+		if !allowMkdir && (err == nil || created) {
+			t.Errorf("expected mkdir to be denied but found %v, stdout %q", err, result.Stdout)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSeccompProfile(t *testing.T) {
+	profile, err := SeccompProfile([]string{"mkdirat", "read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		DefaultAction string   `json:"defaultAction"`
+		Architectures []string `json:"architectures"`
+		Syscalls      []struct {
+			Names  []string `json:"names"`
+			Action string   `json:"action"`
+		} `json:"syscalls"`
+	}
+	if err = json.Unmarshal(profile, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.DefaultAction != "SCMP_ACT_ERRNO" || len(doc.Architectures) == 0 {
+		t.Errorf("expected a default-deny profile but found %s", profile)
+	}
+	if len(doc.Syscalls) != 1 || doc.Syscalls[0].Action != "SCMP_ACT_ALLOW" {
+		t.Fatalf("expected a single allow rule but found %s", profile)
+	}
+	names := doc.Syscalls[0].Names
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("expected the syscalls to be sorted but found %v", names)
+	}
+	allowed := make(map[string]int)
+	for _, name := range names {
+		allowed[name]++
+	}
+	for _, name := range []string{"mkdirat", "execve", "exit_group", "read"} {
+		if allowed[name] != 1 {
+			t.Errorf("expected %s to be allowed once but found %d", name, allowed[name])
+		}
+	}
+	if allowed["ptrace"] != 0 || allowed["mount"] != 0 {
+		t.Errorf("expected ptrace and mount to be denied but found %v", names)
+	}
+
+	if _, err = SeccompProfile([]string{"read; rm"}); err == nil {
+		t.Error("expected an invalid syscall name to be refused")
+	}
+	if errs := ValidateContainerOptions(ContainerOptions{Image: "app", SeccompAllowlist: []string{"Mount"}}); len(errs) != 1 || errs[0].Field != "SeccompAllowlist[0]" {
+		t.Errorf("expected an invalid syscall name to be reported but found %v", errs)
+	}
+}
+
+func TestSeccompRuntimeSyscalls(t *testing.T) {
+	for lang := range ScriptLanguages() {
+		syscalls, ok := SeccompRuntimeSyscalls(lang)
+		if !ok || len(syscalls) == 0 {
+			t.Errorf("expected the syscalls of %s", lang)
+		}
+		syscalls[0] = "changed"
+		if again, _ := SeccompRuntimeSyscalls(lang); again[0] == "changed" {
+			t.Errorf("expected SeccompRuntimeSyscalls to return copies")
+		}
+	}
+	if _, ok := SeccompRuntimeSyscalls("cobol"); ok {
+		t.Error("expected an unknown language")
+	}
+}
+
+func TestFnContainerSeccompAllowlist(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	hostConfigs := recordCreate(server)
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	if _, err := FnContainer(client, ContainerOptions{Image: image, SeccompAllowlist: []string{"mkdirat"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FnContainer(client, ContainerOptions{Image: image}); err != nil {
+		t.Fatal(err)
+	}
+	var securityOpt []string
+	if err := json.Unmarshal((*hostConfigs)[0]["SecurityOpt"], &securityOpt); err != nil {
+		t.Fatal(err)
+	}
+	profile, _ := SeccompProfile([]string{"mkdirat"})
+	if len(securityOpt) != 1 || securityOpt[0] != "seccomp="+string(profile) {
+		t.Errorf("expected the inline profile but found %v", securityOpt)
+	}
+	if raw, ok := (*hostConfigs)[1]["SecurityOpt"]; ok && string(raw) != "null" {
+		t.Errorf("expected no security option without allowlist but found %s", raw)
+	}
+}
+
+func TestRunnerSeccompStartError(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	server.CustomHandler("/containers/.*/start", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `OCI runtime start failed: exec: "python": operation not permitted`, http.StatusInternalServerError)
+	}))
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewRunner(client).Run(context.Background(), testBuildOptions(), ContainerOptions{SeccompAllowlist: []string{"mkdirat"}})
+	seccompErr, ok := err.(*SeccompError)
+	if !ok || seccompErr.Unwrap() != ErrSeccompStart || !strings.Contains(err.Error(), "SeccompAllowlist") {
+		t.Fatalf("expected a SeccompError but found %v", err)
+	}
+
+	// without allowlist the start error is a daemon error
+	_, err = NewRunner(client).Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if _, ok = err.(*SeccompError); ok || err == nil {
+		t.Errorf("expected the start error but found %v", err)
+	}
+}
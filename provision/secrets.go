@@ -0,0 +1,191 @@
+package provision
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// SecretsDir is the directory of the files of ContainerOptions.Secrets under SecretFile
+const SecretsDir = "/run/secrets"
+
+// LabelSecrets lists the names of the ContainerOptions.Secrets given as variables, separated
+// by spaces, so the API dump and the recordings redact their values from the container config
+const LabelSecrets = "io.gofn.secrets"
+
+// secretFileMode is the mode of the files of ContainerOptions.Secrets under SecretsDir, they
+// are only readable by their owner and group
+const secretFileMode = 0440
+
+// SecretMask replaces the secret values in the output masked by RunOptions.MaskSecrets and
+// LogsOptions.MaskSecrets
+const SecretMask = "****"
+
+// SecretMode selects how ContainerOptions.Secrets reach the container
+type SecretMode int
+
+const (
+	// SecretEnv gives each secret as the variable of its name, which replaces the one of Env
+	SecretEnv SecretMode = iota
+	// SecretFile writes each secret to the file of its name under SecretsDir once the container
+	// is created, so it does not show in the config of the container as a variable would
+	SecretFile
+)
+
+// SecretValues returns the values of secrets, e.g. the ContainerOptions.Secrets given to
+// RunOptions.MaskSecrets
+func SecretValues(secrets map[string]string) (values []string) {
+	for _, value := range secrets {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return
+}
+
+// secretNames returns the names of secrets, sorted
+func secretNames(secrets map[string]string) []string {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// withSecretsEnv returns env with the variables of secrets, replacing those of the same name
+func withSecretsEnv(env []string, secrets map[string]string) []string {
+	names := secretNames(secrets)
+	kept := make([]string, 0, len(env)+len(names))
+	for _, entry := range env {
+		if _, ok := secrets[envName(entry)]; !ok {
+			kept = append(kept, entry)
+		}
+	}
+	for _, name := range names {
+		kept = append(kept, name+"="+secrets[name])
+	}
+	return kept
+}
+
+// copySecrets writes the secrets to their files under SecretsDir in the created container, a
+// secret whose name is not a file name is refused before anything is written
+func copySecrets(ctx context.Context, client *docker.Client, containerID string, secrets map[string]string) (err error) {
+	names := secretNames(secrets)
+	for _, name := range names {
+		if !isSecretFileName(name) {
+			return fmt.Errorf("provision: %q is not a secret file name", name)
+		}
+	}
+	archive := new(bytes.Buffer)
+	tw := tar.NewWriter(archive)
+	dirs := map[string]bool{}
+	for _, name := range names {
+		err = addArchiveFile(tw, dirs, path.Join(SecretsDir, name), []byte(secrets[name]), secretFileMode)
+		if err != nil {
+			return
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return
+	}
+	return client.UploadToContainer(containerID, docker.UploadToContainerOptions{
+		InputStream: archive,
+		Path:        "/",
+		Context:     ctx,
+	})
+}
+
+// isSecretFileName reports whether name is the name of a file right under SecretsDir
+func isSecretFileName(name string) bool {
+	return name != "" && name != "." && !strings.Contains(name, "..") && !strings.ContainsAny(name, "/\\")
+}
+
+// maskWriter replaces the secrets written to it with SecretMask before writing to w. The end
+// of a write that may start a secret is held until the next write tells, so a secret split
+// across the reads of the output is masked too, Flush writes what is held once the output ended.
+type maskWriter struct {
+	w       io.Writer
+	secrets [][]byte
+	pending []byte
+}
+
+// maskSecrets returns w masking the non-empty secrets, w itself when there are none
+func maskSecrets(w io.Writer, secrets []string) io.Writer {
+	var values [][]byte
+	for _, secret := range secrets {
+		if secret != "" {
+			values = append(values, []byte(secret))
+		}
+	}
+	if w == nil || len(values) == 0 {
+		return w
+	}
+	// the longest secret is masked when several start at the same byte
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return &maskWriter{w: w, secrets: values}
+}
+
+func (m *maskWriter) Write(p []byte) (n int, err error) {
+	m.pending = append(m.pending, p...)
+	err = m.mask(false)
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+// Flush writes the output held for a secret that did not come
+func (m *maskWriter) Flush() error {
+	return m.mask(true)
+}
+
+// mask writes the pending output with its secrets masked, the tail that may start a secret is
+// kept pending unless final
+func (m *maskWriter) mask(final bool) (err error) {
+	var out bytes.Buffer
+	i, start := 0, 0
+scan:
+	for i < len(m.pending) {
+		rest := m.pending[i:]
+		for _, secret := range m.secrets {
+			if bytes.HasPrefix(rest, secret) {
+				out.Write(m.pending[start:i])
+				out.WriteString(SecretMask)
+				i += len(secret)
+				start = i
+				continue scan
+			}
+		}
+		if !final {
+			for _, secret := range m.secrets {
+				if len(rest) < len(secret) && bytes.HasPrefix(secret, rest) {
+					break scan
+				}
+			}
+		}
+		i++
+	}
+	out.Write(m.pending[start:i])
+	m.pending = append(m.pending[:0], m.pending[i:]...)
+	if out.Len() > 0 {
+		_, err = m.w.Write(out.Bytes())
+	}
+	return
+}
+
+// flushMasks flushes the writers that mask secrets
+func flushMasks(writers ...io.Writer) {
+	for _, w := range writers {
+		if m, ok := w.(*maskWriter); ok {
+			_ = m.Flush()
+		}
+	}
+}
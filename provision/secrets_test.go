@@ -0,0 +1,184 @@
+package provision
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestMaskWriter(t *testing.T) {
+	secrets := []string{"tok", "s3cr3t-token", ""}
+	output := "token=s3cr3t-token tok\ns3cr3t-tokens3cr3t-token ends with s3cr"
+	want := "****en=**** ****\n******** ends with s3cr"
+	for _, size := range []int{1, 2, 5, 7, len(output)} {
+		var out bytes.Buffer
+		w := maskSecrets(&out, secrets)
+		for i := 0; i < len(output); i += size {
+			end := i + size
+			if end > len(output) {
+				end = len(output)
+			}
+			if n, err := w.Write([]byte(output[i:end])); n != end-i || err != nil {
+				t.Fatalf("unexpected write of %d bytes: %d, %v", end-i, n, err)
+			}
+		}
+		flushMasks(w)
+		if out.String() != want {
+			t.Errorf("writes of %d bytes: expected %q but found %q", size, want, out.String())
+		}
+	}
+	var out bytes.Buffer
+	if w := maskSecrets(&out, []string{""}); w != &out {
+		t.Error("expected the writer to be kept without secrets")
+	}
+}
+
+func TestFnContainerSecrets(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	files := fakeFiles(server)
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+	secrets := map[string]string{"API_TOKEN": "s3cr3t", "DSN": "postgres://fn:pw@db?a=b"}
+
+	container, err := FnContainer(client, ContainerOptions{Image: image, Env: []string{"MODE=prod", "API_TOKEN=dummy"}, Secrets: secrets})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := []string{"MODE=prod", "API_TOKEN=s3cr3t", "DSN=postgres://fn:pw@db?a=b"}
+	if !reflect.DeepEqual(container.Config.Env, want) {
+		t.Errorf("expected %q but found %q", want, container.Config.Env)
+	}
+
+	container, err = FnContainer(client, ContainerOptions{Image: image, Env: []string{"MODE=prod"}, Secrets: secrets, SecretMode: SecretFile})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !reflect.DeepEqual(container.Config.Env, []string{"MODE=prod"}) {
+		t.Errorf("expected no secret in the environment but found %q", container.Config.Env)
+	}
+	if copied := files(); copied[SecretsDir+"/API_TOKEN"] != "s3cr3t" || copied[SecretsDir+"/DSN"] != secrets["DSN"] {
+		t.Errorf("expected the secret files to be written but found %v", copied)
+	}
+}
+
+func TestFnRunResultMaskSecrets(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	// the token is split across the frames of the output
+	server.CustomHandler("/containers/.*/logs", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		writeFrame(w, 1, "calling with s3c")
+		writeFrame(w, 2, "warn: s3")
+		writeFrame(w, 1, "r3t done\n")
+		writeFrame(w, 2, "cr3t\n")
+	}))
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	result, err := FnRunResult(context.Background(), client, container.ID, nil, RunOptions{MaskSecrets: []string{"s3cr3t"}})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Stdout.String() != "calling with **** done\n" || result.Stderr.String() != "warn: ****\n" {
+		t.Errorf("expected the secret to be masked but found %q and %q", result.Stdout, result.Stderr)
+	}
+
+	var stdout bytes.Buffer
+	err = FnLogsWithOptions(context.Background(), client, container.ID, &stdout, nil, LogsOptions{MaskSecrets: SecretValues(map[string]string{"TOKEN": "s3cr3t"})})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if strings.Contains(stdout.String(), "s3cr3t") || stdout.String() != "calling with **** done\n" {
+		t.Errorf("expected the secret to be masked but found %q", stdout.String())
+	}
+}
+
+func TestSecretsRedacted(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	var dump syncBuffer
+	DumpAPI(client, &dump)
+	recorder := Record(client)
+	opts := ContainerOptions{Image: createFakeImage(client), Env: []string{"MODE=prod"}, Secrets: map[string]string{"API_TOKEN": "s3cr3t"}}
+
+	container, err := FnContainer(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	inspected, err := client.InspectContainer(container.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspected.Config.Env[1] != "API_TOKEN=s3cr3t" || inspected.Config.Labels[LabelSecrets] != "API_TOKEN" {
+		t.Fatalf("expected the container to be given the secret but found %q", inspected.Config.Env)
+	}
+	if out := dump.String(); strings.Contains(out, "s3cr3t") || !strings.Contains(out, "API_TOKEN="+redacted) {
+		t.Errorf("expected the secret to be redacted from the dump\n%s", out)
+	}
+	for _, interaction := range recorder.Fixture().Interactions {
+		var answer []byte
+		for _, chunk := range interaction.Chunks {
+			answer = append(answer, chunk.Data...)
+		}
+		if bytes.Contains(interaction.RequestBody, []byte("s3cr3t")) || bytes.Contains(answer, []byte("s3cr3t")) {
+			t.Errorf("expected the secret to be redacted from the recording of %s %s", interaction.Method, interaction.URI)
+		}
+	}
+
+	transcript, err := DryRun(context.Background(), nil, func(ctx context.Context, client *docker.Client) error {
+		_, err := FnContainer(client, opts)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	for _, call := range transcript {
+		if bytes.Contains(call.Body, []byte("s3cr3t")) {
+			t.Errorf("expected the secret to be redacted from the dry run %s but found %s", call, call.Body)
+		}
+	}
+}
+
+func TestCopySecrets(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	var modes map[string]int64
+	server.CustomHandler("/containers/.*/archive", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		modes = map[string]int64{}
+		tr := tar.NewReader(r.Body)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			modes[header.Name] = header.Mode
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	client := NewTestClient(server.URL(), t)
+
+	for _, name := range []string{"../passwd", "a/b", "..", ".", "a..b", `a\b`, ""} {
+		modes = nil
+		err := copySecrets(context.Background(), client, "c1", map[string]string{"API_TOKEN": "t", name: "s3cr3t"})
+		if err == nil || modes != nil {
+			t.Errorf("expected the secret %q to be refused before the upload but found %v, %v", name, err, modes)
+		}
+	}
+
+	err := copySecrets(context.Background(), client, "c1", map[string]string{"API_TOKEN": "s3cr3t"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if mode := modes[strings.TrimPrefix(SecretsDir, "/")+"/API_TOKEN"]; mode != secretFileMode {
+		t.Errorf("expected the secret file of mode %o but found %o in %v", secretFileMode, mode, modes)
+	}
+}
@@ -0,0 +1,215 @@
+package provision
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Phases of SelfTest
+const (
+	SelfTestBuild   = "build"
+	SelfTestRun     = "run"
+	SelfTestVerify  = "verify"
+	SelfTestCleanup = "cleanup"
+)
+
+const (
+	// DefaultSelfTestBaseImage is the image the hello world of SelfTest is built from
+	DefaultSelfTestBaseImage = "busybox:1.36"
+	// DefaultSelfTestImageName is the name of the image built by SelfTest
+	DefaultSelfTestImageName = "gofn-selftest"
+	// DefaultSelfTestBudget bounds SelfTest when SelfTestOptions.Budget is zero
+	DefaultSelfTestBudget = 2 * time.Minute
+	// selfTestInput is written to the hello world stdin, it answers "hello " followed by it
+	selfTestInput = "gofn"
+)
+
+var (
+	// ErrSelfTestOutput is raised when the hello world of SelfTest does not answer the expected output
+	ErrSelfTestOutput = errors.New("provision: unexpected self test output")
+)
+
+// SelfTestOutputError reports the output of the hello world of SelfTest
+type SelfTestOutputError struct {
+	Want string
+	Got  string
+}
+
+func (e *SelfTestOutputError) Error() string {
+	return fmt.Sprintf("%v: expected %q but found %q", ErrSelfTestOutput, e.Want, e.Got)
+}
+
+// Unwrap returns ErrSelfTestOutput
+func (e *SelfTestOutputError) Unwrap() error {
+	return ErrSelfTestOutput
+}
+
+// SelfTestOptions customizes SelfTest
+type SelfTestOptions struct {
+	// BaseImage is pulled by the daemon to build the hello world, DefaultSelfTestBaseImage when empty
+	BaseImage string
+	// ImageName is the name of the built image, DefaultSelfTestImageName when empty
+	ImageName string
+	// RemoveImage removes the built image once the test is done, the base image is kept
+	RemoveImage bool
+	// Budget bounds the whole test, DefaultSelfTestBudget when zero
+	Budget time.Duration
+	// Runner runs the hello world, it applies its policies and timeouts, a new Runner when nil
+	Runner *Runner
+}
+
+// PhaseReport is the outcome of a phase of SelfTest
+type PhaseReport struct {
+	Phase    string        `json:"phase"`
+	Duration time.Duration `json:"duration"`
+	Err      error         `json:"-"`
+	// Error is the message of Err, for the JSON encoding
+	Error string `json:"error,omitempty"`
+}
+
+// HealthReport is the outcome of SelfTest
+type HealthReport struct {
+	Healthy  bool          `json:"healthy"`
+	Duration time.Duration `json:"duration"`
+	// ImageID is the ID of the built hello world
+	ImageID string        `json:"image_id,omitempty"`
+	Phases  []PhaseReport `json:"phases"`
+}
+
+// Err returns the error of the first failed phase, nil when healthy
+func (h HealthReport) Err() error {
+	for _, phase := range h.Phases {
+		if phase.Err != nil {
+			return phase.Err
+		}
+	}
+	return nil
+}
+
+func (h *HealthReport) phase(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	report := PhaseReport{Phase: name, Duration: time.Since(start), Err: err}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	h.Phases = append(h.Phases, report)
+	return err
+}
+
+// selfTestDockerfile is the hello world of SelfTest, it greets the name read from stdin
+func selfTestDockerfile(baseImage string) []byte {
+	return []byte(fmt.Sprintf("FROM %s\nCMD [\"sh\", \"-c\", \"read name; echo \\\"hello $name\\\"\"]\n", baseImage))
+}
+
+// memoryBuilder builds through the daemon from a context holding only dockerfile
+type memoryBuilder struct {
+	dockerfile []byte
+}
+
+// Build implements Builder
+func (b memoryBuilder) Build(ctx context.Context, client *docker.Client, name string, opts *BuildOptions, stdout io.Writer) (err error) {
+	archive := new(bytes.Buffer)
+	tw := tar.NewWriter(archive)
+	err = tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(b.dockerfile))})
+	if err != nil {
+		return
+	}
+	_, err = tw.Write(b.dockerfile)
+	if err != nil {
+		return
+	}
+	err = tw.Close()
+	if err != nil {
+		return
+	}
+	return client.BuildImage(docker.BuildImageOptions{
+		Name:           name,
+		Dockerfile:     "Dockerfile",
+		Platform:       opts.Platform,
+		Pull:           opts.ForcePull,
+		BuildArgs:      buildArgs(opts),
+		NoCache:        opts.NoCache,
+		CacheFrom:      opts.CacheFrom,
+		SuppressOutput: opts.OutputStream == nil,
+		OutputStream:   stdout,
+		InputStream:    archive,
+		Auth:           opts.Auth,
+		AuthConfigs:    opts.BuildAuthConfigs(),
+		Context:        ctx,
+	})
+}
+
+// SelfTest builds a hello world image through client, runs it with a known stdin through the
+// path of Runner.Run and verifies its output. The container is always removed and the image is
+// removed with SelfTestOptions.RemoveImage, the cleanup runs even when the budget is exhausted
+func SelfTest(ctx context.Context, client *docker.Client, opts SelfTestOptions) (report HealthReport) {
+	start := time.Now()
+	defer func() {
+		report.Duration = time.Since(start)
+		report.Healthy = report.Err() == nil
+	}()
+	budget := opts.Budget
+	if budget == 0 {
+		budget = DefaultSelfTestBudget
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	baseImage := opts.BaseImage
+	if baseImage == "" {
+		baseImage = DefaultSelfTestBaseImage
+	}
+	r := opts.Runner
+	if r == nil {
+		r = NewRunner(client)
+	}
+	baseImage = r.rewrite(baseImage)
+	buildOpts := &BuildOptions{
+		ImageName:               opts.ImageName,
+		DoNotUsePrefixImageName: true,
+		StdIN:                   selfTestInput + "\n",
+		Backend:                 memoryBuilder{dockerfile: selfTestDockerfile(baseImage)},
+	}
+	if buildOpts.ImageName == "" {
+		buildOpts.ImageName = DefaultSelfTestImageName
+	}
+
+	err := report.phase(SelfTestBuild, func() (err error) {
+		build, err := imageBuildReport(ctx, client, r.rewriteBuild(buildOpts))
+		report.ImageID = build.ID
+		return
+	})
+	if err == nil {
+		var result RunResult
+		err = report.phase(SelfTestRun, func() (err error) {
+			result, err = r.Run(ctx, buildOpts, ContainerOptions{PinToImageID: true})
+			return
+		})
+		if err == nil {
+			_ = report.phase(SelfTestVerify, func() error {
+				want, got := "hello "+selfTestInput, ""
+				if result.Stdout != nil {
+					got = strings.TrimSpace(result.Stdout.String())
+				}
+				if got != want {
+					return &SelfTestOutputError{Want: want, Got: got}
+				}
+				return nil
+			})
+		}
+	}
+	if opts.RemoveImage && report.ImageID != "" {
+		_ = report.phase(SelfTestCleanup, func() error {
+			return client.RemoveImageExtended(report.ImageID, docker.RemoveImageOptions{Force: true})
+		})
+	}
+	return
+}
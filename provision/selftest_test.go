@@ -0,0 +1,109 @@
+package provision
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestSelfTest(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "hello gofn\n", "")
+	client := NewTestClient(server.URL(), t)
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	report := SelfTest(context.Background(), client, SelfTestOptions{Runner: r, RemoveImage: true})
+	if !report.Healthy || report.Err() != nil {
+		t.Fatalf("expected a healthy report but found %+v", report)
+	}
+	var phases []string
+	for _, phase := range report.Phases {
+		phases = append(phases, phase.Phase)
+	}
+	if want := []string{SelfTestBuild, SelfTestRun, SelfTestVerify, SelfTestCleanup}; !reflect.DeepEqual(phases, want) {
+		t.Errorf("expected the phases %v but found %v", want, phases)
+	}
+	if report.ImageID == "" || report.Duration <= 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := client.ListImages(docker.ListImagesOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 0 || len(images) != 0 {
+		t.Errorf("expected no residue but found %d containers and %d images", len(containers), len(images))
+	}
+}
+
+func TestSelfTestUnexpectedOutput(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "sh: read: not found\n", "")
+	client := NewTestClient(server.URL(), t)
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	report := SelfTest(context.Background(), client, SelfTestOptions{Runner: r})
+	outputErr, ok := report.Err().(*SelfTestOutputError)
+	if report.Healthy || !ok || outputErr.Unwrap() != ErrSelfTestOutput || outputErr.Got != "sh: read: not found" {
+		t.Fatalf("expected an output error but found %v", report.Err())
+	}
+	if last := report.Phases[len(report.Phases)-1]; last.Phase != SelfTestVerify || last.Error == "" {
+		t.Errorf("expected the verify phase to fail last but found %+v", last)
+	}
+	// the image is kept without RemoveImage
+	if _, err := client.InspectImage(report.ImageID); err != nil {
+		t.Errorf("expected the image to be kept but found %v", err)
+	}
+}
+
+func TestSelfTestBudget(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, time.Second)
+	client := NewTestClient(server.URL(), t)
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	report := SelfTest(context.Background(), client, SelfTestOptions{Runner: r, RemoveImage: true, Budget: 100 * time.Millisecond})
+	if report.Healthy || report.Phases[1].Phase != SelfTestRun || report.Phases[1].Err == nil {
+		t.Fatalf("expected the run to exceed the budget but found %+v", report)
+	}
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 0 {
+		t.Errorf("expected the container to be removed but found %d", len(containers))
+	}
+	if last := report.Phases[len(report.Phases)-1]; last.Phase != SelfTestCleanup || last.Err != nil {
+		t.Errorf("expected the image to be removed despite the budget but found %+v", last)
+	}
+}
+
+// TestSelfTestIntegration runs SelfTest against the local daemon when GOFN_SELFTEST_INTEGRATION is set
+func TestSelfTestIntegration(t *testing.T) {
+	if testing.Short() || os.Getenv("GOFN_SELFTEST_INTEGRATION") == "" {
+		t.Skip("set GOFN_SELFTEST_INTEGRATION to run the self test against the local daemon")
+	}
+	client, err := FnClient("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := SelfTest(context.Background(), client, SelfTestOptions{RemoveImage: true})
+	if !report.Healthy {
+		t.Fatalf("expected a healthy daemon but found %+v", report)
+	}
+}
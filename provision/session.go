@@ -0,0 +1,249 @@
+package provision
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// SessionState is the stage reached by a RunSession
+type SessionState string
+
+const (
+	// SessionPrepared is a session whose container is created and not started
+	SessionPrepared SessionState = "prepared"
+	// SessionExecuted is a session whose container exited with success
+	SessionExecuted SessionState = "executed"
+	// SessionFailed is a session whose execution failed, RunSession.Error tells why
+	SessionFailed SessionState = "failed"
+	// SessionFinalized is a session whose container was handled by its RemovalPolicy
+	SessionFinalized SessionState = "finalized"
+)
+
+// RemovalPolicy selects whether Finalize removes the container of a session
+type RemovalPolicy string
+
+const (
+	// RemoveAlways, the zero value, removes the container
+	RemoveAlways RemovalPolicy = ""
+	// RemoveOnSuccess keeps the container of a failed session for inspection
+	RemoveOnSuccess RemovalPolicy = "on-success"
+	// RemoveNever keeps the container
+	RemoveNever RemovalPolicy = "never"
+)
+
+var (
+	// ErrInvalidSessionToken is raised when a session token can not be decoded
+	ErrInvalidSessionToken = errors.New("provision: invalid session token")
+
+	// ErrContainerAlreadyStarted is raised when a session adopts a container that was already started
+	ErrContainerAlreadyStarted = errors.New("provision: container already started")
+)
+
+// SessionStateError is raised when a stage is called on a session in the wrong state
+type SessionStateError struct {
+	Stage string
+	State SessionState
+}
+
+func (e *SessionStateError) Error() string {
+	return fmt.Sprintf("provision: can not %s a %s session", e.Stage, e.State)
+}
+
+// RunSession is a run split in the Prepare, Execute and Finalize stages of a Runner, it is
+// serialized with Token so a different process can resume it with ParseSessionToken
+type RunSession struct {
+	ContainerID string       `json:"container_id"`
+	Image       string       `json:"image,omitempty"`
+	State       SessionState `json:"state"`
+	// Error is the message of the error that failed the session
+	Error   string        `json:"error,omitempty"`
+	Removal RemovalPolicy `json:"removal,omitempty"`
+	// CheckNonRoot fails the execution of a container running as root
+	CheckNonRoot bool `json:"check_non_root,omitempty"`
+	// AutoRemove is set when the daemon removes the container once it exited
+	AutoRemove bool `json:"auto_remove,omitempty"`
+	// ExecutionTimeout is the ContainerOptions.ExecutionTimeout of the container
+	ExecutionTimeout time.Duration `json:"execution_timeout,omitempty"`
+	// OutputPaths are the ContainerOptions.OutputPaths of the container
+	OutputPaths []string `json:"output_paths,omitempty"`
+
+	// shipping are the ContainerOptions.LogSinks of the container, lost with the token
+	shipping *logShipping
+}
+
+// isNoSuchContainer reports whether err is the answer of the daemon about a missing container
+func isNoSuchContainer(err error) bool {
+	switch e := err.(type) {
+	case *docker.NoSuchContainer:
+		return true
+	case *docker.Error:
+		return e.Status == http.StatusNotFound
+	}
+	return false
+}
+
+// Token serializes the session
+func (s *RunSession) Token() (token string, err error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	token = base64.RawURLEncoding.EncodeToString(data)
+	return
+}
+
+// ParseSessionToken returns the session serialized by RunSession.Token
+func ParseSessionToken(token string) (session *RunSession, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		err = ErrInvalidSessionToken
+		return
+	}
+	session = &RunSession{}
+	if json.Unmarshal(data, session) != nil || session.ContainerID == "" || session.State == "" {
+		session, err = nil, ErrInvalidSessionToken
+	}
+	return
+}
+
+func (s *RunSession) fail(err error) error {
+	s.State = SessionFailed
+	s.Error = err.Error()
+	return err
+}
+
+// Prepare ensures the image described by buildOpts exists and creates the container, it is
+// started by Execute. The egress allow list is not available to sessions since its proxy
+// would outlive the process.
+func (r *Runner) Prepare(ctx context.Context, buildOpts *BuildOptions, containerOpts ContainerOptions, removal RemovalPolicy) (session *RunSession, err error) {
+	if r.draining() {
+		err = ErrHostDraining
+		return
+	}
+	err = withPhaseTimeout(ctx, PhaseEnsureImage, r.Timeouts.EnsureImage, func(ctx context.Context) (err error) {
+		return r.containerImage(ctx, buildOpts, &containerOpts)
+	})
+	if err != nil {
+		err = ClassifyError(err)
+		return
+	}
+	var container *docker.Container
+	err = withPhaseTimeout(ctx, PhaseContainerCreate, r.Timeouts.ContainerCreate, func(ctx context.Context) (err error) {
+		container, err = r.createContainer(ctx, containerOpts)
+		return
+	})
+	if err != nil {
+		err = ClassifyError(err)
+		return
+	}
+	session = &RunSession{
+		ContainerID:      container.ID,
+		Image:            containerOpts.Image,
+		State:            SessionPrepared,
+		Removal:          removal,
+		CheckNonRoot:     containerOpts.RunAsNonRoot && !containerOpts.AllowRoot,
+		AutoRemove:       containerOpts.AutoRemove,
+		ExecutionTimeout: containerOpts.ExecutionTimeout,
+		OutputPaths:      containerOpts.OutputPaths,
+		shipping:         shippingOf(containerOpts),
+	}
+	return
+}
+
+// Adopt returns a prepared session for a container created outside the runner, e.g. by a
+// scheduler reserving it ahead of time, the container must not have been started
+func (r *Runner) Adopt(ctx context.Context, containerID string, removal RemovalPolicy) (session *RunSession, err error) {
+	container, err := r.Client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: containerID, Context: ctx})
+	if isNoSuchContainer(err) {
+		err = ErrContainerNotFound
+	}
+	if err != nil {
+		err = ClassifyError(err)
+		return
+	}
+	if !container.State.StartedAt.IsZero() || container.State.Running {
+		err = ErrContainerAlreadyStarted
+		return
+	}
+	session = &RunSession{ContainerID: container.ID, Image: container.Image, State: SessionPrepared, Removal: removal}
+	if container.HostConfig != nil {
+		session.AutoRemove = container.HostConfig.AutoRemove
+	}
+	return
+}
+
+// Execute starts the container of a prepared session, writes input to its stdin, waits it to
+// exit and collects its output. The session is marked failed when the execution fails, with
+// ErrContainerNotFound when its container was removed since it was prepared.
+func (r *Runner) Execute(ctx context.Context, session *RunSession, input io.Reader) (result RunResult, err error) {
+	if session.State != SessionPrepared {
+		err = &SessionStateError{Stage: "execute", State: session.State}
+		return
+	}
+	result.ContainerID = session.ContainerID
+	result.Image = session.Image
+	_, err = r.Client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: session.ContainerID, Context: ctx})
+	if isNoSuchContainer(err) {
+		err = ErrContainerNotFound
+	}
+	if err == nil {
+		// the session is only removed by Finalize, once Execute collected the output
+		life := newRunLifecycle()
+		err = r.startAndCollect(ctx, life, session.ContainerID, session.CheckNonRoot, session.AutoRemove, session.ExecutionTimeout, session.shipping, input, &result)
+		r.collectArtifacts(ctx, session.ContainerID, session.OutputPaths, &result)
+		life.record(&result)
+	}
+	if err != nil {
+		err = session.fail(ClassifyError(err))
+		return
+	}
+	session.State = SessionExecuted
+	return
+}
+
+// Finalize copies the output of the container to logs when it is not nil and removes
+// the container according to the removal policy of the session
+func (r *Runner) Finalize(ctx context.Context, session *RunSession, logs io.Writer) (err error) {
+	if session.State == SessionFinalized {
+		err = &SessionStateError{Stage: "finalize", State: session.State}
+		return
+	}
+	if logs != nil && session.State != SessionPrepared {
+		err = r.Client.Logs(docker.LogsOptions{
+			Context:      ctx,
+			Container:    session.ContainerID,
+			Stdout:       true,
+			Stderr:       true,
+			OutputStream: logs,
+			ErrorStream:  logs,
+		})
+		if isNoSuchContainer(err) {
+			err = nil
+		}
+		if err != nil {
+			err = ClassifyError(err)
+			return
+		}
+	}
+	remove := session.Removal == RemoveAlways || (session.Removal == RemoveOnSuccess && session.State != SessionFailed)
+	if remove {
+		err = FnRemove(r.Client, session.ContainerID)
+		if isNoSuchContainer(err) {
+			err = nil
+		}
+		if err != nil {
+			err = ClassifyError(err)
+			return
+		}
+	}
+	session.State = SessionFinalized
+	return
+}
@@ -0,0 +1,223 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestRunSessionStages(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "ok\n", "")
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	session, err := r.Prepare(context.Background(), testBuildOptions(), ContainerOptions{}, RemoveAlways)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if session.State != SessionPrepared || session.Image != "gofn/test" {
+		t.Errorf("unexpected prepared session %+v", session)
+	}
+	container, err := client.InspectContainer(session.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.State.Running {
+		t.Error("expected Prepare to leave the container stopped")
+	}
+
+	result, err := r.Execute(context.Background(), session, strings.NewReader("input"))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if session.State != SessionExecuted || result.ContainerID != session.ContainerID || result.Stdout.String() != "ok\n" {
+		t.Errorf("unexpected execution %+v of the session %+v", result, session)
+	}
+	if _, err = r.Execute(context.Background(), session, nil); err == nil {
+		t.Error("expected an executed session to be refused")
+	}
+
+	logs := new(bytes.Buffer)
+	if err = r.Finalize(context.Background(), session, logs); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if session.State != SessionFinalized || logs.String() != "ok\n" {
+		t.Errorf("unexpected finalized session %+v with the logs %q", session, logs)
+	}
+	if _, err = client.InspectContainer(session.ContainerID); err == nil {
+		t.Error("expected the container to be removed")
+	}
+	stateErr, ok := r.Finalize(context.Background(), session, nil).(*SessionStateError)
+	if !ok || stateErr.Stage != "finalize" || stateErr.State != SessionFinalized {
+		t.Errorf("expected a finalized session to be refused but found %v", stateErr)
+	}
+}
+
+func TestRunSessionResumeFromToken(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "ok\n", "")
+
+	// each process has its own client and runner, only the token goes from one to the other
+	process := func() *Runner {
+		r := NewRunner(NewTestClient(server.URL(), t))
+		r.OutputStrategy = OutputLogs
+		return r
+	}
+	scheduler := process()
+	if _, _, err := FnImageBuild(scheduler.Client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+	session, err := scheduler.Prepare(context.Background(), testBuildOptions(), ContainerOptions{RunAsNonRoot: true, AllowRoot: true, OutputPaths: []string{"/out"}}, RemoveOnSuccess)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	token, err := session.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worker := process()
+	resumed, err := ParseSessionToken(token)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !reflect.DeepEqual(resumed, session) {
+		t.Errorf("expected the session %+v but found %+v", session, resumed)
+	}
+	result, err := worker.Execute(context.Background(), resumed, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Stdout.String() != "ok\n" {
+		t.Errorf("unexpected output %q", result.Stdout)
+	}
+	if result.ArtifactErrors["/out"] != ErrPathNotFound {
+		t.Errorf("expected the output paths to be collected by the worker but found %v", result.ArtifactErrors)
+	}
+	if token, err = resumed.Token(); err != nil {
+		t.Fatal(err)
+	}
+
+	if resumed, err = ParseSessionToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if err = process().Finalize(context.Background(), resumed, nil); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, err = scheduler.Client.InspectContainer(session.ContainerID); err == nil {
+		t.Error("expected the successful container to be removed")
+	}
+
+	for _, token := range []string{"", "not base64!", "bnVsbA", "e30"} {
+		if _, err = ParseSessionToken(token); err != ErrInvalidSessionToken {
+			t.Errorf("expected %q to be refused but found %v", token, err)
+		}
+	}
+}
+
+func TestRunSessionContainerRemovedExternally(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(client)
+	session, err := r.Prepare(context.Background(), testBuildOptions(), ContainerOptions{}, RemoveOnSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = FnRemove(client, session.ContainerID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Execute(context.Background(), session, nil); err != ErrContainerNotFound {
+		t.Errorf("expected ErrContainerNotFound but found %v", err)
+	}
+	if session.State != SessionFailed || session.Error != ErrContainerNotFound.Error() {
+		t.Errorf("expected a failed session but found %+v", session)
+	}
+	if err = r.Finalize(context.Background(), session, new(bytes.Buffer)); err != nil {
+		t.Errorf("expected the missing container to be finalized but found %v", err)
+	}
+}
+
+func TestRunSessionKeepsFailedContainer(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 1, 0)
+	fakeLogs(server, "", "boom\n")
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	session, err := r.Prepare(context.Background(), testBuildOptions(), ContainerOptions{}, RemoveOnSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Execute(context.Background(), session, nil); err != ErrContainerExecutionFailed {
+		t.Errorf("expected ErrContainerExecutionFailed but found %v", err)
+	}
+	if err = r.Finalize(context.Background(), session, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.InspectContainer(session.ContainerID); err != nil {
+		t.Errorf("expected the failed container to be kept but found %v", err)
+	}
+}
+
+func TestRunnerAdopt(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "ok\n", "")
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	session, err := r.Adopt(context.Background(), container.ID, RemoveNever)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, err = r.Execute(context.Background(), session, nil); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err = r.Finalize(context.Background(), session, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.InspectContainer(container.ID); err != nil {
+		t.Errorf("expected the container to be kept but found %v", err)
+	}
+
+	started, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name:   "gofn-started",
+		Config: &docker.Config{Image: container.Image},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runFakeContainer(client, started.ID, t)
+	if _, err = r.Adopt(context.Background(), started.ID, RemoveAlways); err != ErrContainerAlreadyStarted {
+		t.Errorf("expected ErrContainerAlreadyStarted but found %v", err)
+	}
+	if _, err = r.Adopt(context.Background(), "missing", RemoveAlways); err != ErrContainerNotFound {
+		t.Errorf("expected ErrContainerNotFound but found %v", err)
+	}
+}
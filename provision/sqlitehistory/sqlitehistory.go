@@ -0,0 +1,181 @@
+// Package sqlitehistory keeps the runs of a provision.Runner in a SQLite database
+package sqlitehistory
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofn/gofn/provision"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS gofn_runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	container_id TEXT NOT NULL,
+	invocation_id TEXT NOT NULL,
+	image TEXT NOT NULL,
+	exit_code INTEGER NOT NULL,
+	output_strategy TEXT NOT NULL,
+	egress_violations TEXT NOT NULL,
+	started_at INTEGER NOT NULL,
+	finished_at INTEGER NOT NULL,
+	peak_memory INTEGER NOT NULL DEFAULT 0,
+	cpu_time INTEGER NOT NULL DEFAULT 0,
+	stats_samples INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS gofn_runs_image ON gofn_runs (image);
+CREATE INDEX IF NOT EXISTS gofn_runs_invocation_id ON gofn_runs (invocation_id);
+CREATE INDEX IF NOT EXISTS gofn_runs_started_at ON gofn_runs (started_at);
+`
+
+// migrations add the columns missing from the tables created by earlier versions
+var migrations = []string{
+	"ALTER TABLE gofn_runs ADD COLUMN peak_memory INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE gofn_runs ADD COLUMN cpu_time INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE gofn_runs ADD COLUMN stats_samples INTEGER NOT NULL DEFAULT 0",
+}
+
+const columns = "container_id, invocation_id, image, exit_code, output_strategy, egress_violations, started_at, finished_at, peak_memory, cpu_time, stats_samples"
+
+// Store is a provision.RunHistory in a SQLite database, see New
+type Store struct {
+	db *sql.DB
+	// mu serializes the writes, SQLite refuses concurrent ones with a busy error
+	mu sync.Mutex
+}
+
+// New returns a Store keeping the runs in db, opened with a SQLite driver, e.g. sql.Open("sqlite3", path).
+// The table gofn_runs is created when missing and its missing columns are added.
+func New(db *sql.DB) (s *Store, err error) {
+	for _, statement := range strings.Split(strings.TrimSpace(schema), ";\n") {
+		if _, err = db.Exec(statement); err != nil {
+			return
+		}
+	}
+	for _, statement := range migrations {
+		if _, err = db.Exec(statement); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return
+		}
+	}
+	err = nil
+	s = &Store{db: db}
+	return
+}
+
+// the times are stored as unix nanoseconds, 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Append implements provision.RunHistory, the output of the run is not kept
+func (s *Store) Append(run provision.RunResult) (err error) {
+	violations, err := json.Marshal(run.EgressViolations)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.db.Exec("INSERT INTO gofn_runs ("+columns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		run.ContainerID, run.InvocationID, run.Image, run.ExitCode, string(run.OutputStrategy),
+		string(violations), unixNano(run.StartedAt), unixNano(run.FinishedAt),
+		run.Resources.PeakMemory, int64(run.Resources.CPUTime), run.Resources.Samples)
+	return
+}
+
+// where returns the condition selecting the runs of filter and its arguments
+func where(filter provision.RunFilter) (condition string, args []interface{}) {
+	var conditions []string
+	if filter.Image != "" {
+		conditions = append(conditions, "image = ?")
+		args = append(args, filter.Image)
+	}
+	if filter.InvocationID != "" {
+		conditions = append(conditions, "invocation_id = ?")
+		args = append(args, filter.InvocationID)
+	}
+	switch filter.Status {
+	case provision.RunSucceeded:
+		conditions = append(conditions, "exit_code = 0")
+	case provision.RunFailed:
+		conditions = append(conditions, "exit_code != 0")
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "started_at >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "started_at < ?")
+		args = append(args, filter.Until.UnixNano())
+	}
+	if len(conditions) > 0 {
+		condition = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return
+}
+
+// Query implements provision.RunHistory, the runs are returned in the reverse order of their append
+func (s *Store) Query(filter provision.RunFilter) (runs []provision.RunResult, err error) {
+	condition, args := where(filter)
+	query := "SELECT " + columns + " FROM gofn_runs" + condition + " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			run               provision.RunResult
+			strategy          string
+			violations        string
+			started, finished int64
+			cpuTime           int64
+		)
+		err = rows.Scan(&run.ContainerID, &run.InvocationID, &run.Image, &run.ExitCode, &strategy, &violations, &started, &finished,
+			&run.Resources.PeakMemory, &cpuTime, &run.Resources.Samples)
+		if err != nil {
+			return
+		}
+		run.OutputStrategy = provision.OutputStrategy(strategy)
+		if err = json.Unmarshal([]byte(violations), &run.EgressViolations); err != nil {
+			return
+		}
+		run.StartedAt, run.FinishedAt = fromUnixNano(started), fromUnixNano(finished)
+		run.Resources.CPUTime = time.Duration(cpuTime)
+		runs = append(runs, run)
+	}
+	err = rows.Err()
+	return
+}
+
+// Prune implements provision.RunHistory
+func (s *Store) Prune(retention provision.RunRetention) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if retention.MaxAge > 0 {
+		_, err = s.db.Exec("DELETE FROM gofn_runs WHERE started_at < ?", time.Now().Add(-retention.MaxAge).UnixNano())
+		if err != nil {
+			return
+		}
+	}
+	if retention.MaxRows > 0 {
+		_, err = s.db.Exec("DELETE FROM gofn_runs WHERE id NOT IN (SELECT id FROM gofn_runs ORDER BY id DESC LIMIT ?)", retention.MaxRows)
+	}
+	return
+}
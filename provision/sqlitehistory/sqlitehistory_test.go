@@ -0,0 +1,183 @@
+// +build sqlite
+
+package sqlitehistory
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofn/gofn/provision"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newStore returns a Store in a temporary database removed by cleanup
+func newStore(t *testing.T) (s *Store, cleanup func()) {
+	dir, err := ioutil.TempDir("", "gofn-sqlitehistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "runs.db")+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = New(db)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	return s, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func appendRuns(t *testing.T, s *Store, start time.Time) {
+	runs := []provision.RunResult{
+		{InvocationID: "1", Image: "gofn/a", ExitCode: 0, StartedAt: start},
+		{InvocationID: "2", Image: "gofn/b", ExitCode: 0, StartedAt: start.Add(time.Minute)},
+		{InvocationID: "3", Image: "gofn/a", ExitCode: 0, StartedAt: start.Add(2 * time.Minute)},
+		{InvocationID: "4", Image: "gofn/a", ExitCode: 2, StartedAt: start.Add(3 * time.Minute), EgressViolations: []string{"example.com"},
+			Resources: provision.RunResources{PeakMemory: 64 << 20, CPUTime: time.Second, Samples: 3}},
+		{InvocationID: "5", Image: "gofn/b", ExitCode: -1, StartedAt: start.Add(4 * time.Minute)},
+	}
+	for _, run := range runs {
+		if err := s.Append(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func invocations(runs []provision.RunResult) (ids string) {
+	for _, run := range runs {
+		ids += run.InvocationID
+	}
+	return
+}
+
+func TestStoreQuery(t *testing.T) {
+	s, cleanup := newStore(t)
+	defer cleanup()
+	start := time.Now().Add(-time.Hour)
+	appendRuns(t, s, start)
+
+	tests := []struct {
+		name   string
+		filter provision.RunFilter
+		want   string
+	}{
+		{"all", provision.RunFilter{}, "54321"},
+		{"image", provision.RunFilter{Image: "gofn/a"}, "431"},
+		{"succeeded", provision.RunFilter{Status: provision.RunSucceeded}, "321"},
+		{"failed", provision.RunFilter{Status: provision.RunFailed}, "54"},
+		{"invocation", provision.RunFilter{InvocationID: "3"}, "3"},
+		{"since", provision.RunFilter{Since: start.Add(2 * time.Minute)}, "543"},
+		{"until", provision.RunFilter{Until: start.Add(2 * time.Minute)}, "21"},
+		{"limit", provision.RunFilter{Image: "gofn/a", Limit: 2}, "43"},
+		{"combined", provision.RunFilter{Image: "gofn/b", Status: provision.RunFailed, Since: start}, "5"},
+		{"none", provision.RunFilter{Image: "gofn/c"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs, err := s.Query(tt.filter)
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if got := invocations(runs); got != tt.want {
+				t.Errorf("expected the runs %q but found %q", tt.want, got)
+			}
+		})
+	}
+
+	runs, _ := s.Query(provision.RunFilter{InvocationID: "4"})
+	if len(runs) != 1 || runs[0].ExitCode != 2 || !runs[0].StartedAt.Equal(start.Add(3*time.Minute)) ||
+		len(runs[0].EgressViolations) != 1 || runs[0].Resources != (provision.RunResources{PeakMemory: 64 << 20, CPUTime: time.Second, Samples: 3}) {
+		t.Errorf("expected the run to be kept as appended but found %+v", runs)
+	}
+}
+
+func TestStoreMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn-sqlitehistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "runs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the table of the versions without the resource usage
+	_, err = db.Exec(`CREATE TABLE gofn_runs (id INTEGER PRIMARY KEY AUTOINCREMENT, container_id TEXT NOT NULL,
+		invocation_id TEXT NOT NULL, image TEXT NOT NULL, exit_code INTEGER NOT NULL, output_strategy TEXT NOT NULL,
+		egress_violations TEXT NOT NULL, started_at INTEGER NOT NULL, finished_at INTEGER NOT NULL)`)
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO gofn_runs (container_id, invocation_id, image, exit_code, output_strategy,
+			egress_violations, started_at, finished_at) VALUES ('c', '1', 'gofn/a', 0, 'logs', 'null', 1, 2)`)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(db)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	_ = s.Append(provision.RunResult{InvocationID: "2", Resources: provision.RunResources{PeakMemory: 1, Samples: 1}})
+	runs, err := s.Query(provision.RunFilter{})
+	if err != nil || len(runs) != 2 || runs[0].Resources.PeakMemory != 1 || runs[1].Resources != (provision.RunResources{}) {
+		t.Errorf("expected the earlier run without usage but found %+v and %v", runs, err)
+	}
+}
+
+func TestStoreRetention(t *testing.T) {
+	s, cleanup := newStore(t)
+	defer cleanup()
+	appendRuns(t, s, time.Now().Add(-time.Hour))
+	_ = s.Append(provision.RunResult{InvocationID: "6", StartedAt: time.Now()})
+
+	if err := s.Prune(provision.RunRetention{MaxRows: 4}); err != nil {
+		t.Fatal(err)
+	}
+	runs, _ := s.Query(provision.RunFilter{})
+	if got := invocations(runs); got != "6543" {
+		t.Errorf("expected the 4 latest runs but found %q", got)
+	}
+	if err := s.Prune(provision.RunRetention{MaxAge: 30 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	runs, _ = s.Query(provision.RunFilter{})
+	if got := invocations(runs); got != "6" {
+		t.Errorf("expected the runs of the last 30 minutes but found %q", got)
+	}
+}
+
+func TestStoreConcurrentAppend(t *testing.T) {
+	s, cleanup := newStore(t)
+	defer cleanup()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if err := s.Append(provision.RunResult{InvocationID: fmt.Sprintf("%d-%d", i, j), StartedAt: time.Now()}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := s.Query(provision.RunFilter{Limit: 10}); err != nil {
+			t.Errorf("expected the queries to go on during the appends but found %v", err)
+		}
+	}
+	wg.Wait()
+	runs, _ := s.Query(provision.RunFilter{})
+	if len(runs) != 100 {
+		t.Errorf("expected every run but found %d", len(runs))
+	}
+}
@@ -0,0 +1,102 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	units "github.com/docker/go-units"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/iaas"
+)
+
+// RunResources is the resource usage of a container sampled while it ran, see Runner.CollectStats
+type RunResources struct {
+	// PeakMemory is the highest memory usage sampled, in bytes
+	PeakMemory int64 `json:"peak_memory"`
+	// CPUTime is the CPU time consumed by the container until its last sample
+	CPUTime time.Duration `json:"cpu_time"`
+	// Samples is the number of samples received, the usage is unknown without any
+	Samples int `json:"samples"`
+}
+
+// add folds the sample s into the usage
+func (u *RunResources) add(s *docker.Stats) {
+	u.Samples++
+	peak := s.MemoryStats.Usage
+	// max_usage is only reported by cgroup v1, it catches the peaks between the samples
+	if s.MemoryStats.MaxUsage > peak {
+		peak = s.MemoryStats.MaxUsage
+	}
+	if int64(peak) > u.PeakMemory {
+		u.PeakMemory = int64(peak)
+	}
+	if cpu := time.Duration(s.CPUStats.CPUUsage.TotalUsage); cpu > u.CPUTime {
+		u.CPUTime = cpu
+	}
+}
+
+func (u RunResources) String() string {
+	return fmt.Sprintf("memory %s, cpu %s", units.BytesSize(float64(u.PeakMemory)), u.CPUTime)
+}
+
+// collectStats samples the usage of the container until the returned function is called,
+// it returns the usage sampled. Each sample is emitted as an EventStats.
+func (r *Runner) collectStats(ctx context.Context, containerID string) func() RunResources {
+	var (
+		resources RunResources
+		samples   = make(chan *docker.Stats)
+		done      = make(chan bool)
+		collected = make(chan struct{})
+	)
+	goSafe("stats", func() error {
+		// the samples channel is closed by Stats, an unavailable endpoint only leaves the usage unknown
+		return r.Client.Stats(docker.StatsOptions{
+			ID:      containerID,
+			Stats:   samples,
+			Stream:  true,
+			Done:    done,
+			Context: ctx,
+		})
+	}, nil)
+	goSafe("stats collector", func() error {
+		for s := range samples {
+			resources.add(s)
+			r.emit(EventStats, containerID, resources.String())
+		}
+		return nil
+	}, func(error) {
+		// the samples left by a panic of OnEvent are drained so Stats does not block on them
+		for range samples {
+		}
+		close(collected)
+	})
+	return func() RunResources {
+		close(done)
+		<-collected
+		return resources
+	}
+}
+
+// HistoryUsage returns the usage recorded in the runs of history selected by filter, the runs
+// without a sample are skipped. It feeds iaas.RecommendSizes.
+func HistoryUsage(history RunHistory, filter RunFilter) iaas.UsageSource {
+	return iaas.UsageSourceFunc(func() (samples []iaas.UsageSample, err error) {
+		runs, err := history.Query(filter)
+		if err != nil {
+			return
+		}
+		for _, run := range runs {
+			if run.Resources.Samples == 0 {
+				continue
+			}
+			samples = append(samples, iaas.UsageSample{
+				Image:      run.Image,
+				PeakMemory: run.Resources.PeakMemory,
+				CPUTime:    run.Resources.CPUTime,
+				Duration:   run.FinishedAt.Sub(run.StartedAt),
+			})
+		}
+		return
+	})
+}
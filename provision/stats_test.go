@@ -0,0 +1,104 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeStats makes the fake docker api stream a sample of each memory usage, in bytes, with a
+// CPU usage growing by a second each
+func fakeStats(server *fake.DockerServer, usage ...int) {
+	server.CustomHandler("/containers/.*/stats", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for i, memory := range usage {
+			fmt.Fprintf(w, `{"memory_stats":{"usage":%d},"cpu_stats":{"cpu_usage":{"total_usage":%d}}}`+"\n", memory, (i+1)*int(time.Second))
+			w.(http.Flusher).Flush()
+		}
+	}))
+}
+
+func TestRunnerCollectStats(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 300*time.Millisecond)
+	fakeLogs(server, "ok", "")
+	fakeStats(server, 100<<20, 300<<20, 200<<20)
+	history := NewMemoryRunHistory(0)
+	r := NewRunner(NewTestClient(server.URL(), t))
+	r.History = history
+	var (
+		mu    sync.Mutex
+		stats []Event
+	)
+	r.OnEvent = func(e Event) {
+		if e.Kind == EventStats {
+			mu.Lock()
+			stats = append(stats, e)
+			mu.Unlock()
+		}
+	}
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Resources != (RunResources{}) || len(stats) != 0 {
+		t.Errorf("expected no usage without CollectStats but found %+v", result.Resources)
+	}
+
+	r.CollectStats = true
+	result, err = r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	want := RunResources{PeakMemory: 300 << 20, CPUTime: 3 * time.Second, Samples: 3}
+	if result.Resources != want {
+		t.Errorf("expected the usage %+v but found %+v", want, result.Resources)
+	}
+	mu.Lock()
+	if len(stats) != 3 || stats[2].ContainerID != result.ContainerID || stats[2].Message != "memory 300MiB, cpu 3s" {
+		t.Errorf("expected a stats event for each sample but found %+v", stats)
+	}
+	mu.Unlock()
+
+	samples, err := HistoryUsage(history, RunFilter{}).Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the run without samples is skipped
+	if len(samples) != 1 || samples[0].Image != result.Image || samples[0].PeakMemory != 300<<20 || samples[0].CPUTime != 3*time.Second || samples[0].Duration <= 0 {
+		t.Errorf("unexpected usage %+v", samples)
+	}
+}
+
+func TestRunnerCollectStatsPanic(t *testing.T) {
+	captured, restore := capturePanics()
+	defer restore()
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 300*time.Millisecond)
+	fakeLogs(server, "ok", "")
+	fakeStats(server, 100<<20, 300<<20, 200<<20)
+	r := NewRunner(NewTestClient(server.URL(), t))
+	r.CollectStats = true
+	r.OnEvent = func(e Event) {
+		if e.Kind == EventStats {
+			panic("stats consumer exploded")
+		}
+	}
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Resources.Samples != 1 {
+		t.Errorf("expected the usage up to the panic but found %+v", result.Resources)
+	}
+	if panics := captured(); len(panics) != 1 || panics[0].Goroutine != "stats collector" {
+		t.Errorf("expected the panic of the collector to be reported but found %v", panics)
+	}
+}
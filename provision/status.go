@@ -0,0 +1,352 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/iaas"
+)
+
+const (
+	// DefaultStatusMaxAge is the age of the host health served by StatusHandler beyond which
+	// it is marked stale and checked again in the background
+	DefaultStatusMaxAge = 30 * time.Second
+
+	// DefaultHostName is the name of the host of Runner.Client in the status
+	DefaultHostName = "default"
+
+	// statusFailures is the number of recent failures served by StatusHandler
+	statusFailures = 20
+)
+
+// RunningRun is a run whose container is executing
+type RunningRun struct {
+	ContainerID  string    `json:"container_id"`
+	Image        string    `json:"image,omitempty"`
+	InvocationID string    `json:"invocation_id,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+}
+
+// FailedRun is a failed run of the history of a Runner
+type FailedRun struct {
+	RunningRun
+	ExitCode   int       `json:"exit_code"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// PoolStatus is the state of a ContainerPool
+type PoolStatus struct {
+	Image    string `json:"image"`
+	Size     int    `json:"size"`
+	Idle     int    `json:"idle"`
+	Busy     int    `json:"busy"`
+	Retiring int    `json:"retiring"`
+	Updating bool   `json:"updating"`
+}
+
+// LeasedMachine is a machine kept alive by a LeaseManager
+type LeasedMachine struct {
+	ID          string    `json:"id"`
+	LeaseExpiry time.Time `json:"lease_expiry"`
+}
+
+// MachinePoolStatus is the state of a LeaseManager registered with RegisterMachinePool
+type MachinePoolStatus struct {
+	Name     string          `json:"name"`
+	Machines []LeasedMachine `json:"machines"`
+}
+
+// HostHealth is the outcome of the last check of a daemon, CheckedAt is zero until the first one
+type HostHealth struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	// Stale is set when the check is older than DefaultStatusMaxAge or was never made
+	Stale bool `json:"stale"`
+}
+
+// Status is the runtime state of a Runner served by StatusHandler
+type Status struct {
+	GeneratedAt  time.Time           `json:"generated_at"`
+	Runs         []RunningRun        `json:"runs"`
+	Pools        []PoolStatus        `json:"pools"`
+	MachinePools []MachinePoolStatus `json:"machine_pools"`
+	Failures     []FailedRun         `json:"failures"`
+	// FailuresError is the error of the run history query, Failures is empty then
+	FailuresError string       `json:"failures_error,omitempty"`
+	Hosts         []HostHealth `json:"hosts"`
+}
+
+// runnerStatusInit guards the creation of the status of the runners
+var runnerStatusInit sync.Mutex
+
+// runnerStatus is the state of a Runner kept for its status, shared by its copies
+type runnerStatus struct {
+	mu       sync.Mutex
+	runs     map[string]RunningRun
+	pools    map[*ContainerPool]struct{}
+	machines map[string]*iaas.LeaseManager
+	hosts    map[string]*docker.Client
+	health   map[string]HostHealth
+	checking bool
+	// drainable are the runs DrainHost can move, by container
+	drainable map[string]drainableRun
+	// draining are the hosts refusing the runs, see DrainHost
+	draining map[*docker.Client]bool
+}
+
+// state returns the status of r, created on first use
+func (r *Runner) state() *runnerStatus {
+	runnerStatusInit.Lock()
+	defer runnerStatusInit.Unlock()
+	if r.status == nil {
+		r.status = &runnerStatus{}
+	}
+	return r.status
+}
+
+// trackRun records the run as executing until the returned function is called
+func (r *Runner) trackRun(result *RunResult) (done func()) {
+	run := RunningRun{
+		ContainerID:  result.ContainerID,
+		Image:        result.Image,
+		InvocationID: result.InvocationID,
+		StartedAt:    result.StartedAt,
+	}
+	s := r.state()
+	s.mu.Lock()
+	if s.runs == nil {
+		s.runs = make(map[string]RunningRun)
+	}
+	s.runs[run.ContainerID] = run
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.runs, run.ContainerID)
+		s.mu.Unlock()
+	}
+}
+
+// trackPool adds p to the status of r until p is closed
+func (r *Runner) trackPool(p *ContainerPool, open bool) {
+	s := r.state()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pools == nil {
+		s.pools = make(map[*ContainerPool]struct{})
+	}
+	if open {
+		s.pools[p] = struct{}{}
+	} else {
+		delete(s.pools, p)
+	}
+}
+
+// RegisterMachinePool adds the machines leased by m to the status of r under name
+func (r *Runner) RegisterMachinePool(name string, m *iaas.LeaseManager) {
+	s := r.state()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.machines == nil {
+		s.machines = make(map[string]*iaas.LeaseManager)
+	}
+	s.machines[name] = m
+}
+
+// RegisterHost adds the daemon of client to the hosts checked by CheckHosts under name,
+// the daemon of r.Client is registered as DefaultHostName
+func (r *Runner) RegisterHost(name string, client *docker.Client) {
+	s := r.state()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts == nil {
+		s.hosts = make(map[string]*docker.Client)
+	}
+	s.hosts[name] = client
+}
+
+// hosts returns the registered hosts, s.mu must be held
+func (r *Runner) hosts(s *runnerStatus) map[string]*docker.Client {
+	hosts := make(map[string]*docker.Client, len(s.hosts)+1)
+	if r.Client != nil {
+		hosts[DefaultHostName] = r.Client
+	}
+	for name, client := range s.hosts {
+		hosts[name] = client
+	}
+	return hosts
+}
+
+// CheckHosts pings the registered hosts concurrently and caches their health for StatusHandler
+func (r *Runner) CheckHosts(ctx context.Context) {
+	s := r.state()
+	s.mu.Lock()
+	hosts := r.hosts(s)
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for name, client := range hosts {
+		wg.Add(1)
+		name, client := name, client
+		goSafe("host check", func() error {
+			return client.PingWithContext(ctx)
+		}, func(err error) {
+			defer wg.Done()
+			health := HostHealth{Name: name, Healthy: true}
+			if err != nil {
+				health.Healthy, health.Error = false, err.Error()
+			}
+			health.CheckedAt = time.Now()
+			s.mu.Lock()
+			if s.health == nil {
+				s.health = make(map[string]HostHealth)
+			}
+			s.health[name] = health
+			s.mu.Unlock()
+		})
+	}
+	wg.Wait()
+}
+
+// Status returns the runtime state of r, it does not call the daemons: the host health
+// is the one cached by CheckHosts and a stale one is checked again in the background
+func (r *Runner) Status() (status Status) {
+	now := time.Now()
+	status = Status{
+		GeneratedAt:  now,
+		Runs:         []RunningRun{},
+		Pools:        []PoolStatus{},
+		MachinePools: []MachinePoolStatus{},
+		Failures:     []FailedRun{},
+		Hosts:        []HostHealth{},
+	}
+	s := r.state()
+	s.mu.Lock()
+	for _, run := range s.runs {
+		status.Runs = append(status.Runs, run)
+	}
+	pools := make([]*ContainerPool, 0, len(s.pools))
+	for p := range s.pools {
+		pools = append(pools, p)
+	}
+	for name, m := range s.machines {
+		status.MachinePools = append(status.MachinePools, MachinePoolStatus{Name: name, Machines: leasedMachines(m)})
+	}
+	stale := false
+	for name := range r.hosts(s) {
+		health, checked := s.health[name]
+		if !checked {
+			health = HostHealth{Name: name}
+		}
+		health.Stale = !checked || now.Sub(health.CheckedAt) > DefaultStatusMaxAge
+		stale = stale || health.Stale
+		status.Hosts = append(status.Hosts, health)
+	}
+	refresh := stale && !s.checking
+	if refresh {
+		s.checking = true
+	}
+	s.mu.Unlock()
+
+	if refresh {
+		goSafe("host refresh", func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultStatusMaxAge)
+			defer cancel()
+			r.CheckHosts(ctx)
+			return nil
+		}, func(error) {
+			s.mu.Lock()
+			s.checking = false
+			s.mu.Unlock()
+		})
+	}
+	for _, p := range pools {
+		status.Pools = append(status.Pools, p.status())
+	}
+	if r.History != nil {
+		failures, err := r.History.Query(RunFilter{Status: RunFailed, Limit: statusFailures})
+		if err != nil {
+			status.FailuresError = err.Error()
+		}
+		for _, run := range failures {
+			status.Failures = append(status.Failures, FailedRun{
+				RunningRun: RunningRun{
+					ContainerID:  run.ContainerID,
+					Image:        run.Image,
+					InvocationID: run.InvocationID,
+					StartedAt:    run.StartedAt,
+				},
+				ExitCode:   run.ExitCode,
+				FinishedAt: run.FinishedAt,
+			})
+		}
+	}
+
+	sort.Slice(status.Runs, func(i, j int) bool { return status.Runs[i].StartedAt.Before(status.Runs[j].StartedAt) })
+	sort.Slice(status.Pools, func(i, j int) bool { return status.Pools[i].Image < status.Pools[j].Image })
+	sort.Slice(status.MachinePools, func(i, j int) bool { return status.MachinePools[i].Name < status.MachinePools[j].Name })
+	sort.Slice(status.Hosts, func(i, j int) bool { return status.Hosts[i].Name < status.Hosts[j].Name })
+	return
+}
+
+func leasedMachines(m *iaas.LeaseManager) []LeasedMachine {
+	machines := []LeasedMachine{}
+	for id, expiry := range m.Leased() {
+		machines = append(machines, LeasedMachine{ID: id, LeaseExpiry: expiry})
+	}
+	sort.Slice(machines, func(i, j int) bool { return machines[i].ID < machines[j].ID })
+	return machines
+}
+
+// status returns the state of the pool
+func (p *ContainerPool) status() PoolStatus {
+	stats := p.Stats()
+	return PoolStatus{
+		Image:    stats.Image,
+		Size:     stats.Target,
+		Idle:     stats.Available,
+		Busy:     stats.Busy,
+		Retiring: stats.Retiring,
+		Updating: stats.Updating,
+	}
+}
+
+// StatusHandler serves the Status of r as JSON, read-only and without calling the daemons so it
+// can be exposed on an internal port. The last element of the request path selects a section:
+// runs, pools, machines, failures or hosts, the whole status is served otherwise.
+func StatusHandler(r *Runner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := r.Status()
+		var body interface{} = status
+		switch path.Base(req.URL.Path) {
+		case "runs":
+			body = map[string]interface{}{"generated_at": status.GeneratedAt, "runs": status.Runs}
+		case "pools":
+			body = map[string]interface{}{"generated_at": status.GeneratedAt, "pools": status.Pools}
+		case "machines":
+			body = map[string]interface{}{"generated_at": status.GeneratedAt, "machine_pools": status.MachinePools}
+		case "failures":
+			failures := map[string]interface{}{"generated_at": status.GeneratedAt, "failures": status.Failures}
+			if status.FailuresError != "" {
+				failures["failures_error"] = status.FailuresError
+			}
+			body = failures
+		case "hosts":
+			body = map[string]interface{}{"generated_at": status.GeneratedAt, "hosts": status.Hosts}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(body)
+	})
+}
@@ -0,0 +1,214 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/iaas"
+)
+
+// statusLeaser keeps no lease, the status only reads the leases of the manager
+type statusLeaser struct{}
+
+func (statusLeaser) SetLease(machineID string, expiry time.Time) error { return nil }
+func (statusLeaser) Leases() (map[string]time.Time, error)             { return nil, nil }
+func (statusLeaser) DeleteLeased(machineID string) error               { return nil }
+
+type statusIaas struct{}
+
+func (statusIaas) CreateMachine() (*iaas.Machine, error) { return &iaas.Machine{ID: "droplet-1"}, nil }
+func (statusIaas) DeleteMachine() error                  { return nil }
+
+// getStatus requests path from the status handler of r and decodes the answer into body
+func getStatus(t *testing.T, handler http.Handler, path string, body interface{}) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected answer %d %q", rec.Code, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), body); err != nil {
+		t.Fatalf("expected a JSON status but found %v in %q", err, rec.Body.String())
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	exit := make(chan struct{})
+	// the containers exit with 1 once exit is closed
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-exit
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			_ = server.MutateContainer(m[1], docker.State{ExitCode: 1, StartedAt: time.Now()})
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	fakeLogs(server, "", "boom")
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a host whose daemon hangs, the handler must answer regardless
+	hung := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer hanging.Close()
+	defer close(hung)
+
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	r.History = NewMemoryRunHistory(0)
+	r.RegisterHost("hanging", NewTestClient(hanging.URL, t))
+	leases := iaas.NewLeaseManager(statusLeaser{}, time.Hour)
+	if _, err := leases.CreateMachine(statusIaas{}); err != nil {
+		t.Fatal(err)
+	}
+	r.RegisterMachinePool("digitalocean", leases)
+	pool := NewContainerPool(r, ContainerOptions{Image: createFakeImage(client)}, PoolOptions{Size: 2})
+	if err := pool.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	handler := StatusHandler(r)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+		done <- err
+	}()
+	var runs struct {
+		GeneratedAt time.Time    `json:"generated_at"`
+		Runs        []RunningRun `json:"runs"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(runs.Runs) == 0; {
+		select {
+		case err := <-done:
+			t.Fatalf("expected the run to be in flight but it returned %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			close(exit)
+			t.Fatal("expected the run in flight in the status")
+		}
+		time.Sleep(5 * time.Millisecond)
+		started := time.Now()
+		getStatus(t, handler, "/status/runs", &runs)
+		if elapsed := time.Since(started); elapsed > time.Second {
+			t.Fatalf("expected the handler not to wait for the daemons but it took %v", elapsed)
+		}
+	}
+	run := runs.Runs[0]
+	if run.ContainerID == "" || run.Image != "gofn/test" || run.InvocationID == "" || run.StartedAt.IsZero() || runs.GeneratedAt.IsZero() {
+		t.Errorf("unexpected run in flight %+v", runs)
+	}
+
+	var status map[string]json.RawMessage
+	getStatus(t, handler, "/", &status)
+	for _, key := range []string{"generated_at", "runs", "pools", "machine_pools", "failures", "hosts"} {
+		if _, ok := status[key]; !ok {
+			t.Errorf("expected %q in the status %v", key, status)
+		}
+	}
+	var pools struct {
+		Pools []PoolStatus `json:"pools"`
+	}
+	getStatus(t, handler, "/pools", &pools)
+	if len(pools.Pools) != 1 || pools.Pools[0] != (PoolStatus{Image: pool.Image(), Size: 2, Idle: 1, Busy: 1}) {
+		t.Errorf("unexpected pools %+v", pools.Pools)
+	}
+	var machines struct {
+		MachinePools []MachinePoolStatus `json:"machine_pools"`
+	}
+	getStatus(t, handler, "/machines", &machines)
+	if len(machines.MachinePools) != 1 || machines.MachinePools[0].Name != "digitalocean" ||
+		len(machines.MachinePools[0].Machines) != 1 || machines.MachinePools[0].Machines[0].ID != "droplet-1" {
+		t.Errorf("unexpected machine pools %+v", machines.MachinePools)
+	}
+
+	close(exit)
+	if err := <-done; err != ErrContainerExecutionFailed {
+		t.Fatalf("expected ErrContainerExecutionFailed but found %v", err)
+	}
+	var after Status
+	getStatus(t, handler, "/status", &after)
+	if len(after.Runs) != 0 {
+		t.Errorf("expected no run in flight but found %+v", after.Runs)
+	}
+	if len(after.Failures) != 1 || after.Failures[0].ContainerID != run.ContainerID || after.Failures[0].ExitCode != 1 {
+		t.Errorf("unexpected failures %+v", after.Failures)
+	}
+	_ = pool.Close()
+	getStatus(t, handler, "/status", &after)
+	if len(after.Pools) != 0 {
+		t.Errorf("expected the closed pool to leave the status but found %+v", after.Pools)
+	}
+}
+
+func TestStatusHandlerHosts(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	hung := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer hanging.Close()
+	defer close(hung)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	r := NewRunner(NewTestClient(server.URL(), t))
+	r.RegisterHost("hanging", NewTestClient(hanging.URL, t))
+	r.RegisterHost("down", NewTestClient(down.URL, t))
+	handler := StatusHandler(r)
+
+	var hosts struct {
+		Hosts []HostHealth `json:"hosts"`
+	}
+	getStatus(t, handler, "/hosts", &hosts)
+	if len(hosts.Hosts) != 3 {
+		t.Fatalf("expected the registered hosts and the default one but found %+v", hosts.Hosts)
+	}
+	for _, health := range hosts.Hosts {
+		if !health.Stale || !health.CheckedAt.IsZero() {
+			t.Errorf("expected the unchecked host to be stale but found %+v", health)
+		}
+	}
+
+	// the hanging host is still checked in the background, the others were
+	checked := map[string]HostHealth{}
+	for deadline := time.Now().Add(5 * time.Second); len(checked) < 2; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the hosts to be checked in the background but found %+v", hosts.Hosts)
+		}
+		getStatus(t, handler, "/hosts", &hosts)
+		for _, health := range hosts.Hosts {
+			if !health.CheckedAt.IsZero() {
+				checked[health.Name] = health
+			}
+		}
+	}
+	if health := checked[DefaultHostName]; !health.Healthy || health.Stale || health.Error != "" {
+		t.Errorf("expected the default host to be healthy but found %+v", health)
+	}
+	if health := checked["down"]; health.Healthy || health.Stale || health.Error == "" {
+		t.Errorf("expected the down host to be unhealthy but found %+v", health)
+	}
+	if _, ok := checked["hanging"]; ok {
+		t.Errorf("expected the hanging host not to be checked yet but found %+v", checked["hanging"])
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/hosts", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected the handler to be read-only but found %d", rec.Code)
+	}
+}
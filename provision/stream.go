@@ -0,0 +1,97 @@
+package provision
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// StreamOptions are the options of StartRun
+type StreamOptions struct {
+	Build     *BuildOptions
+	Container ContainerOptions
+	// StdoutOnly leaves stderr out of the reader, it is collected in the RunResult of the handle
+	StdoutOnly bool
+	// Runner runs the container, a new Runner of the client when nil, its output strategy is ignored
+	Runner *Runner
+}
+
+// RunHandle follows a run started by StartRun
+type RunHandle struct {
+	done   chan struct{}
+	result RunResult
+	err    error
+}
+
+// Done is closed when the run is over, before the reader reaches EOF
+func (h *RunHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait waits the run to be over and returns its result, the streamed output is not in
+// RunResult.Stdout, nor in RunResult.Stderr unless StreamOptions.StdoutOnly is set
+func (h *RunHandle) Wait() (RunResult, error) {
+	<-h.done
+	return h.result, h.err
+}
+
+// runReader cancels the run when it is closed
+type runReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (r *runReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
+
+// StartRun ensures the image and creates the container like Runner.Run, then starts it in the
+// background writing input to its stdin. Reading the returned reader streams the output as it is
+// produced, the attach stream is only read as fast as the reader is, and it reaches EOF once the
+// run is over. Closing the reader cancels the run. The egress allow list is not available.
+func StartRun(ctx context.Context, client *docker.Client, opts StreamOptions, input io.Reader) (reader io.ReadCloser, handle *RunHandle, err error) {
+	streamer := NewRunner(client)
+	if opts.Runner != nil {
+		// created before the copy so the runs of the copy are in the status of the runner
+		opts.Runner.state()
+		copied := *opts.Runner
+		streamer = &copied
+	}
+	streamer.OutputStrategy = OutputAttach
+	ctx, cancel := context.WithCancel(ctx)
+	session, err := streamer.Prepare(ctx, opts.Build, opts.Container, RemoveAlways)
+	if err != nil {
+		cancel()
+		return
+	}
+	pr, pw := io.Pipe()
+	streamer.stdout = pw
+	if !opts.StdoutOnly {
+		streamer.stderr = pw
+	}
+	if input == nil {
+		input = strings.NewReader(opts.Build.StdIN)
+	}
+	handle = &RunHandle{done: make(chan struct{})}
+	goSafe("streamed run", func() (err error) {
+		// finalized even when the execution panicked so the container is removed
+		defer func() {
+			if finalizeErr := streamer.Finalize(context.Background(), session, nil); err == nil {
+				err = finalizeErr
+			}
+		}()
+		handle.result, err = streamer.Execute(ctx, session, input)
+		return
+	}, func(err error) {
+		cancel()
+		handle.err = err
+		// the handle is done before EOF so Wait does not block once the reader is drained
+		close(handle.done)
+		_ = pw.Close()
+	})
+	reader = &runReader{PipeReader: pr, cancel: cancel}
+	return
+}
@@ -0,0 +1,187 @@
+package provision
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// slowContainer is a container of the fake docker api writing a frame each time next
+// receives one, it exits with code once next is closed
+type slowContainer struct {
+	next   chan frame
+	exited chan struct{}
+}
+
+func newSlowContainer(server *fake.DockerServer, code int) *slowContainer {
+	c := &slowContainer{next: make(chan frame), exited: make(chan struct{})}
+	server.CustomHandler("/containers/.*/attach", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n"))
+		for f := range c.next {
+			encodeFrames(conn, []frame{f})
+		}
+		close(c.exited)
+	}))
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-c.exited:
+		case <-r.Context().Done():
+			return
+		}
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			_ = server.MutateContainer(m[1], docker.State{ExitCode: code, StartedAt: time.Now()})
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	return c
+}
+
+// readChunk reads what is available from reader, failing after a second
+func readChunk(t *testing.T, reader io.Reader) string {
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, _ := reader.Read(buf)
+		got <- string(buf[:n])
+	}()
+	select {
+	case chunk := <-got:
+		return chunk
+	case <-time.After(time.Second):
+		t.Fatal("expected the output to be available")
+	}
+	return ""
+}
+
+func TestStartRunStreamsOutput(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	container := newSlowContainer(server, 3)
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, handle, err := StartRun(context.Background(), client, StreamOptions{Build: testBuildOptions()}, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer reader.Close()
+
+	container.next <- frame{StreamStdout, "first\n"}
+	if chunk := readChunk(t, reader); chunk != "first\n" {
+		t.Errorf("expected the first line but found %q", chunk)
+	}
+	container.next <- frame{StreamStderr, "warning\n"}
+	if chunk := readChunk(t, reader); chunk != "warning\n" {
+		t.Errorf("expected the combined stderr but found %q", chunk)
+	}
+	select {
+	case <-handle.Done():
+		t.Fatal("expected the run to go on while the container produces output")
+	default:
+	}
+
+	container.next <- frame{StreamStdout, "last\n"}
+	close(container.next)
+	rest, err := ioutil.ReadAll(reader)
+	if err != nil || string(rest) != "last\n" {
+		t.Errorf("expected the last line before EOF but found %q, %v", rest, err)
+	}
+	select {
+	case <-handle.Done():
+	default:
+		t.Fatal("expected the run to be over at EOF")
+	}
+	result, err := handle.Wait()
+	if err != ErrContainerExecutionFailed {
+		t.Errorf("expected the exit code to fail the run but found %v", err)
+	}
+	if result.ContainerID == "" || result.Stdout != nil {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if _, err = client.InspectContainer(result.ContainerID); err == nil {
+		t.Error("expected the container to be removed")
+	}
+}
+
+func TestStartRunStdoutOnly(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	container := newSlowContainer(server, 0)
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, handle, err := StartRun(context.Background(), client, StreamOptions{Build: testBuildOptions(), StdoutOnly: true}, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	go func() {
+		container.next <- frame{StreamStderr, "warning\n"}
+		container.next <- frame{StreamStdout, "out\n"}
+		close(container.next)
+	}()
+	out, err := ioutil.ReadAll(reader)
+	if err != nil || string(out) != "out\n" {
+		t.Errorf("expected only stdout but found %q, %v", out, err)
+	}
+	result, err := handle.Wait()
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Stderr.String() != "warning\n" {
+		t.Errorf("expected stderr in the result but found %q", result.Stderr)
+	}
+}
+
+func TestStartRunClose(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	container := newSlowContainer(server, 0)
+	client := NewTestClient(server.URL(), t)
+	if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, handle, err := StartRun(context.Background(), client, StreamOptions{Build: testBuildOptions()}, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	container.next <- frame{StreamStdout, "first\n"}
+	readChunk(t, reader)
+	if err = reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := handle.Wait()
+	if err == nil {
+		t.Error("expected the closed run to fail")
+	}
+	if _, err = client.InspectContainer(result.ContainerID); err == nil {
+		t.Error("expected the container to be removed")
+	}
+	close(container.next)
+}
+
+func TestStartRunPrepareError(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+
+	_, _, err := StartRun(context.Background(), client, StreamOptions{Build: &BuildOptions{ImageName: "Invalid"}, Runner: &Runner{Client: client, ValidateOptions: true}}, nil)
+	if _, ok := err.(ValidationErrors); !ok {
+		t.Errorf("expected the build options to be refused before streaming but found %v", err)
+	}
+}
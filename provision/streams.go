@@ -0,0 +1,170 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	// ErrTooManyStreams is raised when a client reached its MaxConcurrentStreams with the StreamFailFast policy
+	ErrTooManyStreams = errors.New("provision: too many concurrent streams")
+)
+
+// StreamPolicy selects what happens to a stream opened beyond MaxConcurrentStreams
+type StreamPolicy int
+
+const (
+	// StreamWait waits for another stream to be closed
+	StreamWait StreamPolicy = iota
+	// StreamFailFast fails with ErrTooManyStreams
+	StreamFailFast
+)
+
+// StreamLimits bounds the attached streams a client keeps open
+type StreamLimits struct {
+	// MaxConcurrentStreams is the number of open streams allowed, zero means no limit
+	MaxConcurrentStreams int
+	Policy               StreamPolicy
+}
+
+// StreamMetrics counts the attached streams of a client
+type StreamMetrics struct {
+	Open     int    `json:"open"`
+	Waiting  int    `json:"waiting"`
+	Opened   uint64 `json:"opened"`
+	Rejected uint64 `json:"rejected"`
+}
+
+type streamAccount struct {
+	mu      sync.Mutex
+	limits  StreamLimits
+	metrics StreamMetrics
+	// freed is closed and replaced each time a stream is released
+	freed chan struct{}
+}
+
+// the accounts live as long as the process, as the clients usually do
+var streamAccounts = struct {
+	sync.Mutex
+	m map[*docker.Client]*streamAccount
+}{m: make(map[*docker.Client]*streamAccount)}
+
+func accountOf(client *docker.Client) *streamAccount {
+	streamAccounts.Lock()
+	defer streamAccounts.Unlock()
+	account, ok := streamAccounts.m[client]
+	if !ok {
+		account = &streamAccount{freed: make(chan struct{})}
+		streamAccounts.m[client] = account
+	}
+	return account
+}
+
+// SetStreamLimits sets the limits applied to the streams client opens afterwards
+func SetStreamLimits(client *docker.Client, limits StreamLimits) {
+	account := accountOf(client)
+	account.mu.Lock()
+	defer account.mu.Unlock()
+	account.limits = limits
+	// the waiting streams check the new limit
+	close(account.freed)
+	account.freed = make(chan struct{})
+}
+
+// ClientStreamMetrics returns the stream counters of client
+func ClientStreamMetrics(client *docker.Client) StreamMetrics {
+	account := accountOf(client)
+	account.mu.Lock()
+	defer account.mu.Unlock()
+	return account.metrics
+}
+
+func (a *streamAccount) acquire(ctx context.Context) (err error) {
+	a.mu.Lock()
+	for a.limits.MaxConcurrentStreams > 0 && a.metrics.Open >= a.limits.MaxConcurrentStreams {
+		if a.limits.Policy == StreamFailFast {
+			a.metrics.Rejected++
+			a.mu.Unlock()
+			return ErrTooManyStreams
+		}
+		freed := a.freed
+		a.metrics.Waiting++
+		a.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		a.mu.Lock()
+		a.metrics.Waiting--
+		if err != nil {
+			a.mu.Unlock()
+			return
+		}
+	}
+	a.metrics.Open++
+	a.metrics.Opened++
+	a.mu.Unlock()
+	return
+}
+
+func (a *streamAccount) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.metrics.Open--
+	close(a.freed)
+	a.freed = make(chan struct{})
+}
+
+// attachStream attaches to a container counting the stream in the client account
+// until the stream ends, either closed by the caller or dropped by the daemon
+func attachStream(ctx context.Context, client *docker.Client, opts docker.AttachToContainerOptions) (stream docker.CloseWaiter, err error) {
+	account := accountOf(client)
+	err = account.acquire(ctx)
+	if err != nil {
+		return
+	}
+	stream, err = client.AttachToContainerNonBlocking(opts)
+	if err != nil {
+		account.release()
+		return
+	}
+	stream = newCountedStream(stream, account.release)
+	return
+}
+
+// countedStream releases its slot once the underlying stream ends, the end is
+// watched so the slot is released even if the caller never waits the stream
+type countedStream struct {
+	stream docker.CloseWaiter
+	done   chan struct{}
+	err    error
+	close  sync.Once
+}
+
+func newCountedStream(stream docker.CloseWaiter, release func()) *countedStream {
+	s := &countedStream{stream: stream, done: make(chan struct{})}
+	goSafe("stream watch", stream.Wait, func(err error) {
+		s.err = err
+		release()
+		close(s.done)
+	})
+	return s
+}
+
+// Wait waits the stream to end
+func (s *countedStream) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// Close stops the stream, it may be called more than once
+func (s *countedStream) Close() (err error) {
+	s.close.Do(func() {
+		err = s.stream.Close()
+	})
+	return
+}
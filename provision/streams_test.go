@@ -0,0 +1,168 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeHeldAttach makes each attach stream of the fake daemon stay open until the channel
+// returned by end is closed, it returns the highest number of streams open at once
+func fakeHeldAttach(server *fake.DockerServer, end func() <-chan struct{}) (peak func() int64) {
+	var open, max int64
+	server.CustomHandler("/containers/.*/attach", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := atomic.AddInt64(&open, 1)
+		defer atomic.AddInt64(&open, -1)
+		for {
+			m := atomic.LoadInt64(&max)
+			if n <= m || atomic.CompareAndSwapInt64(&max, m, n) {
+				break
+			}
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n"))
+		<-end()
+	}))
+	return func() int64 { return atomic.LoadInt64(&max) }
+}
+
+func until(hold chan struct{}) func() <-chan struct{} {
+	return func() <-chan struct{} { return hold }
+}
+
+// after ends each stream d after it is opened
+func after(d time.Duration) func() <-chan struct{} {
+	return func() <-chan struct{} {
+		end := make(chan struct{})
+		time.AfterFunc(d, func() { close(end) })
+		return end
+	}
+}
+
+func TestStreamLimitFailFast(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	hold := make(chan struct{})
+	fakeHeldAttach(server, until(hold))
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+	SetStreamLimits(client, StreamLimits{MaxConcurrentStreams: 3, Policy: StreamFailFast})
+
+	var (
+		mu       sync.Mutex
+		streams  []interface{ Wait() error }
+		rejected int
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := FnAttach(client, container.ID, nil, new(bytes.Buffer), new(bytes.Buffer))
+			mu.Lock()
+			defer mu.Unlock()
+			switch err {
+			case nil:
+				streams = append(streams, stream)
+			case ErrTooManyStreams:
+				rejected++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(streams) != 3 || rejected != 7 {
+		t.Fatalf("expected 3 streams and 7 rejections but found %d and %d", len(streams), rejected)
+	}
+	metrics := ClientStreamMetrics(client)
+	if metrics.Open != 3 || metrics.Rejected != 7 || metrics.Opened != 3 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+
+	// the daemon drops the streams without the client closing them
+	close(hold)
+	for _, stream := range streams {
+		_ = stream.Wait()
+	}
+	if metrics = ClientStreamMetrics(client); metrics.Open != 0 {
+		t.Errorf("expected no open stream but found %+v", metrics)
+	}
+	if _, err := FnAttach(client, container.ID, nil, new(bytes.Buffer), nil); err != nil {
+		t.Errorf("expected a stream to be accepted after the others ended but found %v", err)
+	}
+}
+
+func TestStreamLimitWait(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	peak := fakeHeldAttach(server, after(10*time.Millisecond))
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+	SetStreamLimits(client, StreamLimits{MaxConcurrentStreams: 2, Policy: StreamWait})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := FnAttach(client, container.ID, nil, new(bytes.Buffer), nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = stream.Wait()
+			// closing an ended stream, twice, is harmless
+			_ = stream.Close()
+			_ = stream.Close()
+		}()
+	}
+	wg.Wait()
+	if p := peak(); p > 2 {
+		t.Errorf("expected at most 2 streams at once but found %d", p)
+	}
+	metrics := ClientStreamMetrics(client)
+	if metrics.Open != 0 || metrics.Waiting != 0 || metrics.Opened != 6 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+}
+
+func TestStreamLimitWaitCanceled(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	hold := make(chan struct{})
+	defer close(hold)
+	fakeHeldAttach(server, until(hold))
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+	SetStreamLimits(client, StreamLimits{MaxConcurrentStreams: 1})
+
+	if _, err := FnAttach(client, container.ID, nil, new(bytes.Buffer), nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := attachStream(ctx, client, docker.AttachToContainerOptions{
+		Container:    container.ID,
+		OutputStream: new(bytes.Buffer),
+		Stdout:       true,
+		Stream:       true,
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to be canceled but found %v", err)
+	}
+	if metrics := ClientStreamMetrics(client); metrics.Waiting != 0 || metrics.Open != 1 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+}
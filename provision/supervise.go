@@ -0,0 +1,88 @@
+package provision
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrPanic is raised when a goroutine of the package panicked, see PanicError
+var ErrPanic = errors.New("provision: goroutine panicked")
+
+// PanicError is a panic recovered in a goroutine of the package, it is delivered as an error to
+// the caller waiting for the goroutine instead of killing the process
+type PanicError struct {
+	// Goroutine names the work of the goroutine, e.g. container wait
+	Goroutine string
+	// Value is the value given to panic
+	Value interface{}
+	// Stack is the stack of the goroutine when it panicked
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%v: %s: %v", ErrPanic, e.Goroutine, e.Value)
+}
+
+// Unwrap returns ErrPanic
+func (e *PanicError) Unwrap() error {
+	return ErrPanic
+}
+
+// PanicHandler receives the panics recovered in the goroutines of the package, e.g. to send
+// their stack to a crash reporting service. It is called before the waiting caller receives
+// the PanicError and must not block.
+type PanicHandler func(err *PanicError)
+
+var (
+	panicMu      sync.Mutex
+	panicHandler PanicHandler
+	// recoveredPanics counts the panics recovered since the process started
+	recoveredPanics int64
+)
+
+// SetPanicHandler makes the goroutines of the package report their panics to handler, nil removes it
+func SetPanicHandler(handler PanicHandler) {
+	panicMu.Lock()
+	defer panicMu.Unlock()
+	panicHandler = handler
+}
+
+// RecoveredPanics returns the number of panics recovered in the goroutines of the package
+func RecoveredPanics() int64 {
+	return atomic.LoadInt64(&recoveredPanics)
+}
+
+// safely calls fn, a panic of fn is recovered, reported to the panic handler and returned as a
+// PanicError named after goroutine
+func safely(goroutine string, fn func() error) (err error) {
+	defer func() {
+		value := recover()
+		if value == nil {
+			return
+		}
+		panicErr := &PanicError{Goroutine: goroutine, Value: value, Stack: debug.Stack()}
+		atomic.AddInt64(&recoveredPanics, 1)
+		panicMu.Lock()
+		handler := panicHandler
+		panicMu.Unlock()
+		if handler != nil {
+			handler(panicErr)
+		}
+		err = panicErr
+	}()
+	return fn()
+}
+
+// goSafe runs fn in a supervised goroutine: done receives the error of fn, or the PanicError of
+// its panic, so the caller waiting for the goroutine is not left blocked by a panic
+func goSafe(goroutine string, fn func() error, done func(err error)) {
+	go func() {
+		err := safely(goroutine, fn)
+		if done != nil {
+			done(err)
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package provision
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// panickingStream is an attach stream whose Wait panics
+type panickingStream struct{}
+
+func (panickingStream) Close() error { return nil }
+func (panickingStream) Wait() error  { panic("stream wait exploded") }
+
+// panickingAuth is an AuthProvider that panics
+type panickingAuth struct{}
+
+func (panickingAuth) Auth(ctx context.Context, ref string) (docker.AuthConfiguration, error) {
+	panic("auth exploded")
+}
+
+// capturePanics records the panics reported to the panic handler until the returned function is called
+func capturePanics() (captured func() []*PanicError, restore func()) {
+	var mu sync.Mutex
+	var panics []*PanicError
+	SetPanicHandler(func(err *PanicError) {
+		mu.Lock()
+		panics = append(panics, err)
+		mu.Unlock()
+	})
+	captured = func() []*PanicError {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*PanicError(nil), panics...)
+	}
+	return captured, func() { SetPanicHandler(nil) }
+}
+
+func TestSupervisedStreamPanic(t *testing.T) {
+	captured, restore := capturePanics()
+	defer restore()
+	before := RecoveredPanics()
+
+	released := make(chan struct{})
+	stream := newCountedStream(panickingStream{}, func() { close(released) })
+	err := stream.Wait()
+	panicErr, ok := err.(*PanicError)
+	if !ok || panicErr.Unwrap() != ErrPanic || panicErr.Goroutine != "stream watch" || panicErr.Value != "stream wait exploded" {
+		t.Fatalf("expected the panic of the stream as an error but found %v", err)
+	}
+	<-released
+
+	if err := waitStream(context.Background(), panickingStream{}); err == nil || !strings.Contains(err.Error(), "stream wait exploded") {
+		t.Errorf("expected the panic of the drained stream but found %v", err)
+	}
+
+	panics := captured()
+	if len(panics) != 2 || RecoveredPanics()-before != 2 {
+		t.Fatalf("expected the handler to receive both panics but found %d", len(panics))
+	}
+	if !strings.Contains(string(panics[0].Stack), "panickingStream.Wait") {
+		t.Errorf("expected the stack of the panic but found\n%s", panics[0].Stack)
+	}
+}
+
+func TestPrewarmImagesPanic(t *testing.T) {
+	captured, restore := capturePanics()
+	defer restore()
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+
+	report := PrewarmImages(context.Background(), HostSet{"a": client}, []string{"gofn/app:v1", "gofn/worker:v1"}, PrewarmOptions{Auth: panickingAuth{}})
+	for _, ref := range []string{"gofn/app:v1", "gofn/worker:v1"} {
+		result := report["a"][ref]
+		if _, ok := result.Err.(*PanicError); !ok || result.Status != PrewarmFailed || result.Host != "a" || result.Ref != ref {
+			t.Errorf("expected the panic of the auth provider for %s but found %+v", ref, result)
+		}
+	}
+	if panics := captured(); len(panics) != 2 || panics[0].Goroutine != "prewarm" {
+		t.Errorf("expected the handler to receive the panics but found %v", panics)
+	}
+}
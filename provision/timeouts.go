@@ -0,0 +1,71 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Phase names a step of Runner.Run
+type Phase string
+
+const (
+	// PhaseEnsureImage finds, builds or pulls the image
+	PhaseEnsureImage Phase = "ensure image"
+	// PhaseContainerCreate creates the container
+	PhaseContainerCreate Phase = "container create"
+	// PhaseStart starts the container
+	PhaseStart Phase = "start"
+	// PhaseExecution writes the input and waits for the container to exit
+	PhaseExecution Phase = "execution"
+	// PhaseLogCollection reads the container output
+	PhaseLogCollection Phase = "log collection"
+)
+
+// Timeouts bounds each phase of Runner.Run independently,
+// a zero value means that phase is only limited by the context given to Run
+type Timeouts struct {
+	EnsureImage     time.Duration
+	ContainerCreate time.Duration
+	Start           time.Duration
+	Execution       time.Duration
+	LogCollection   time.Duration
+}
+
+// PhaseTimeoutError is raised when a phase exceeds its own budget
+type PhaseTimeoutError struct {
+	Phase   Phase
+	Timeout time.Duration
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	return fmt.Sprintf("provision: %s timed out after %v", e.Phase, e.Timeout)
+}
+
+// withPhaseTimeout runs fn bounded by timeout, when the phase budget is what expired
+// the error is replaced by a PhaseTimeoutError, an expired ctx is reported as is
+func withPhaseTimeout(ctx context.Context, phase Phase, timeout time.Duration, fn func(context.Context) error) (err error) {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	phaseCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err = fn(phaseCtx)
+	if err == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+	if phaseCtx.Err() == context.DeadlineExceeded {
+		err = &PhaseTimeoutError{Phase: phase, Timeout: timeout}
+	}
+	return
+}
+
+// isPhaseTimeout reports whether err is the PhaseTimeoutError of phase
+func isPhaseTimeout(err error, phase Phase) bool {
+	timeout, ok := err.(*PhaseTimeoutError)
+	return ok && timeout.Phase == phase
+}
@@ -0,0 +1,161 @@
+package provision
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+var containerPathRegexp = regexp.MustCompile(`/containers/([^/]+)/`)
+
+// fakeLatency delays every request of the fake docker api whose path matches pathRegexp
+func fakeLatency(server *fake.DockerServer, pathRegexp string, delay time.Duration) {
+	server.CustomHandler(pathRegexp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+}
+
+// fakeExit makes containers of the fake docker api exit with code once waited, after delay
+func fakeExit(server *fake.DockerServer, code int, delay time.Duration) {
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if m := containerPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			_ = server.MutateContainer(m[1], docker.State{ExitCode: code, StartedAt: time.Now()})
+		}
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+}
+
+// writeFrame writes data using the docker multiplexed stream format
+func writeFrame(w http.ResponseWriter, stream byte, data string) {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	_, _ = w.Write(header)
+	_, _ = w.Write([]byte(data))
+}
+
+// fakeLogs makes the fake docker api answer the logs of every container with stdout and stderr
+func fakeLogs(server *fake.DockerServer, stdout, stderr string) {
+	server.CustomHandler("/containers/.*/logs", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		if stdout != "" {
+			writeFrame(w, 1, stdout)
+		}
+		if stderr != "" {
+			writeFrame(w, 2, stderr)
+		}
+	}))
+}
+
+func testBuildOptions() *BuildOptions {
+	return &BuildOptions{ContextDir: "./testing_data", ImageName: "test"}
+}
+
+func TestRunnerRun(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "out", "err")
+
+	client := NewTestClient(server.URL(), t)
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Stdout.String() != "out" {
+		t.Errorf("expected stdout %q but found %q", "out", result.Stdout.String())
+	}
+	if result.Stderr.String() != "err" {
+		t.Errorf("expected stderr %q but found %q", "err", result.Stderr.String())
+	}
+	if _, err := FnFindContainerByID(client, result.ContainerID); err != ErrContainerNotFound {
+		t.Errorf("expected container to be removed but found %q", err)
+	}
+}
+
+func TestRunnerRunExecutionFailed(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 1, 0)
+	fakeLogs(server, "", "boom")
+
+	client := NewTestClient(server.URL(), t)
+	r := NewRunner(client)
+	r.OutputStrategy = OutputLogs
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if err != ErrContainerExecutionFailed {
+		t.Errorf("expected %q but found %q", ErrContainerExecutionFailed, err)
+	}
+	if result.Stderr.String() != "boom" {
+		t.Errorf("expected stderr %q but found %q", "boom", result.Stderr.String())
+	}
+}
+
+func TestRunnerRunPhaseTimeouts(t *testing.T) {
+	const (
+		budget = 20 * time.Millisecond
+		delay  = 300 * time.Millisecond
+	)
+	tests := []struct {
+		phase    Phase
+		path     string
+		timeouts Timeouts
+	}{
+		{PhaseEnsureImage, "/build", Timeouts{EnsureImage: budget}},
+		{PhaseContainerCreate, "/containers/create", Timeouts{ContainerCreate: budget}},
+		{PhaseStart, "/containers/.*/start", Timeouts{Start: budget}},
+		{PhaseExecution, "", Timeouts{Execution: budget}},
+		{PhaseLogCollection, "/containers/.*/logs", Timeouts{LogCollection: budget}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.phase), func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			if tt.phase == PhaseExecution {
+				fakeExit(server, 0, delay)
+			} else {
+				fakeExit(server, 0, 0)
+				fakeLatency(server, tt.path, delay)
+			}
+
+			client := NewTestClient(server.URL(), t)
+			r := NewRunner(client)
+			r.Timeouts = tt.timeouts
+			r.OutputStrategy = OutputLogs
+			_, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+			timeoutErr, ok := err.(*PhaseTimeoutError)
+			if !ok {
+				t.Fatalf("expected a PhaseTimeoutError but found %q", err)
+			}
+			if timeoutErr.Phase != tt.phase {
+				t.Errorf("expected phase %q but found %q", tt.phase, timeoutErr.Phase)
+			}
+		})
+	}
+}
+
+func TestRunnerRunContextDeadline(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeLatency(server, "/build", 300*time.Millisecond)
+
+	client := NewTestClient(server.URL(), t)
+	r := NewRunner(client)
+	r.Timeouts = Timeouts{EnsureImage: time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := r.Run(ctx, testBuildOptions(), ContainerOptions{})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %q but found %q", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,116 @@
+package provision
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// TimingFirstStdout and TimingFirstStderr name the timings of RunTimings.Unavailable
+	TimingFirstStdout = "FirstStdout"
+	TimingFirstStderr = "FirstStderr"
+)
+
+// RunTimings are the instants of a run as seen by the runner, see RunResult.Timings. A zero
+// instant did not happen, e.g. a container writing nothing to stderr, unless its name is
+// listed in Unavailable.
+type RunTimings struct {
+	// Started is when the daemon acknowledged the start of the container
+	Started time.Time
+	// FirstStdout and FirstStderr are when the first byte of each stream arrived, only the
+	// OutputAttach strategy receives the output as it is written
+	FirstStdout time.Time
+	FirstStderr time.Time
+	// StdinWritten is when the input was fully written to the container stdin
+	StdinWritten time.Time
+	// Total is the duration of the execution, from the start request to the collected output
+	Total time.Duration
+	// Unavailable are the timings the output strategy can not measure
+	Unavailable []string
+}
+
+// FirstByteLatency returns the time from the start of the container to its first stdout byte,
+// ok is false when it is unavailable or the container wrote nothing to stdout
+func (t RunTimings) FirstByteLatency() (latency time.Duration, ok bool) {
+	if t.Started.IsZero() || t.FirstStdout.IsZero() {
+		return
+	}
+	return t.FirstStdout.Sub(t.Started), true
+}
+
+// timingRecorder records the RunTimings of a run, its instants are set from the goroutines
+// of the streams so they are only read through timings
+type timingRecorder struct {
+	mu      sync.Mutex
+	timings RunTimings
+}
+
+// mark sets the instant at to now unless it is already set
+func (t *timingRecorder) mark(at *time.Time) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at.IsZero() {
+		*at = now
+	}
+}
+
+// unavailable marks the timings names as not measured
+func (t *timingRecorder) unavailable(names ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timings.Unavailable = append(t.timings.Unavailable, names...)
+}
+
+// result returns the recorded timings of an execution lasting total
+func (t *timingRecorder) result(total time.Duration) RunTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timings := t.timings
+	timings.Total = total
+	timings.Unavailable = append([]string(nil), t.timings.Unavailable...)
+	return timings
+}
+
+// writer returns w marking the instant at on its first non-empty write
+func (t *timingRecorder) writer(at *time.Time, w io.Writer) io.Writer {
+	return &firstByteWriter{recorder: t, at: at, w: w}
+}
+
+// reader returns r marking StdinWritten once it is drained
+func (t *timingRecorder) reader(r io.Reader) io.Reader {
+	if r == nil {
+		return nil
+	}
+	return &drainedReader{recorder: t, r: r}
+}
+
+type firstByteWriter struct {
+	recorder *timingRecorder
+	at       *time.Time
+	w        io.Writer
+	once     sync.Once
+}
+
+func (fw *firstByteWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		fw.once.Do(func() {
+			fw.recorder.mark(fw.at)
+		})
+	}
+	return fw.w.Write(p)
+}
+
+type drainedReader struct {
+	recorder *timingRecorder
+	r        io.Reader
+}
+
+func (dr *drainedReader) Read(p []byte) (n int, err error) {
+	n, err = dr.r.Read(p)
+	if err == io.EOF {
+		dr.recorder.mark(&dr.recorder.timings.StdinWritten)
+	}
+	return
+}
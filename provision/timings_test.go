@@ -0,0 +1,113 @@
+package provision
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunnerTimingsAttach(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	const delay = 100 * time.Millisecond
+	started := make(chan struct{}, 1)
+	server.CustomHandler("/containers/.*/start", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.DefaultHandler().ServeHTTP(w, r)
+		started <- struct{}{}
+	}))
+	server.CustomHandler("/containers/.*/attach", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n"))
+		<-started
+		// the function is slow to write its first byte, and its first error even more
+		time.Sleep(delay)
+		encodeFrames(conn, []frame{{StreamStdout, "hello\n"}})
+		time.Sleep(delay)
+		encodeFrames(conn, []frame{{StreamStderr, "warning\n"}})
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}))
+	r := NewRunner(NewTestClient(server.URL(), t))
+	r.OutputStrategy = OutputAttach
+
+	buildOpts := testBuildOptions()
+	buildOpts.StdIN = "input"
+	result, err := r.Run(context.Background(), buildOpts, ContainerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Stdout.String() != "hello\n" || result.Stderr.String() != "warning\n" {
+		t.Fatalf("unexpected output %q %q", result.Stdout.String(), result.Stderr.String())
+	}
+	timings := result.Timings
+	const tolerance = 80 * time.Millisecond
+	latency, ok := timings.FirstByteLatency()
+	if !ok || latency < delay || latency > delay+tolerance {
+		t.Errorf("expected a first byte latency of %v but found %v", delay, latency)
+	}
+	if gap := timings.FirstStderr.Sub(timings.FirstStdout); gap < delay || gap > delay+tolerance {
+		t.Errorf("expected the first error %v after the first byte but found %v", delay, gap)
+	}
+	if timings.StdinWritten.IsZero() || timings.StdinWritten.Before(result.StartedAt) || len(timings.Unavailable) != 0 {
+		t.Errorf("unexpected timings %+v", timings)
+	}
+	if total := result.FinishedAt.Sub(result.StartedAt); timings.Total != total || total < 2*delay {
+		t.Errorf("expected the total duration %v but found %v", total, timings.Total)
+	}
+}
+
+func TestRunnerTimingsLogs(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 0, 0)
+	fakeLogs(server, "hello\n", "")
+	r := NewRunner(NewTestClient(server.URL(), t))
+	r.OutputStrategy = OutputLogs
+
+	result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	timings := result.Timings
+	if want := []string{TimingFirstStdout, TimingFirstStderr}; !reflect.DeepEqual(timings.Unavailable, want) {
+		t.Errorf("expected %v to be unavailable but found %v", want, timings.Unavailable)
+	}
+	if _, ok := timings.FirstByteLatency(); ok || !timings.FirstStdout.IsZero() {
+		t.Errorf("expected no first byte latency with the logs but found %+v", timings)
+	}
+	if timings.Started.IsZero() || timings.StdinWritten.IsZero() || timings.Total <= 0 {
+		t.Errorf("expected the start and the input to be measured but found %+v", timings)
+	}
+}
+
+func TestTimingRecorder(t *testing.T) {
+	timings := &timingRecorder{}
+	w := timings.writer(&timings.timings.FirstStdout, ioutil.Discard)
+	_, _ = w.Write(nil)
+	if !timings.result(0).FirstStdout.IsZero() {
+		t.Error("expected an empty write not to be the first byte")
+	}
+	_, _ = w.Write([]byte("a"))
+	first := timings.result(0).FirstStdout
+	_, _ = w.Write([]byte("b"))
+	if first.IsZero() || !timings.result(0).FirstStdout.Equal(first) {
+		t.Errorf("expected the first byte to be kept but found %v", timings.result(0).FirstStdout)
+	}
+
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(timings.reader(strings.NewReader("input")), 2))
+	if !timings.result(0).StdinWritten.IsZero() {
+		t.Error("expected a partially read input not to be written")
+	}
+	if timings.reader(nil) != nil {
+		t.Error("expected no input to stay nil")
+	}
+}
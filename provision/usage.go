@@ -0,0 +1,217 @@
+package provision
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// UsageEntry is the last time an image or a machine was used
+type UsageEntry struct {
+	ID       string    `json:"id"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+type usageFile struct {
+	Images   map[string]time.Time `json:"images"`
+	Machines map[string]time.Time `json:"machines"`
+}
+
+// UsageIndex records when images and machines were last used in a JSON file so
+// prune and eviction policies can pick the least recently used ones across restarts
+type UsageIndex struct {
+	path string
+	mu   sync.Mutex
+	data usageFile
+	now  func() time.Time
+}
+
+// OpenUsageIndex loads the index stored at path, a missing file is an empty index
+func OpenUsageIndex(path string) (index *UsageIndex, err error) {
+	index = &UsageIndex{path: path, now: time.Now}
+	index.data, err = readUsageFile(path)
+	if err != nil {
+		index = nil
+	}
+	return
+}
+
+func readUsageFile(path string) (data usageFile, err error) {
+	data = usageFile{Images: map[string]time.Time{}, Machines: map[string]time.Time{}}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(raw, &data)
+	if data.Images == nil {
+		data.Images = map[string]time.Time{}
+	}
+	if data.Machines == nil {
+		data.Machines = map[string]time.Time{}
+	}
+	return
+}
+
+// TouchImage records imageID as used now
+func (u *UsageIndex) TouchImage(imageID string) error {
+	return u.touch(func(data *usageFile, now time.Time) { data.Images[imageID] = now })
+}
+
+// TouchMachine records machineID as used now
+func (u *UsageIndex) TouchMachine(machineID string) error {
+	return u.touch(func(data *usageFile, now time.Time) { data.Machines[machineID] = now })
+}
+
+func (u *UsageIndex) touch(update func(data *usageFile, now time.Time)) (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	update(&u.data, u.now())
+	err = u.save()
+	return
+}
+
+// save merges the index with the file, keeping the newest timestamps written by
+// other processes, and replaces the file atomically
+func (u *UsageIndex) save() (err error) {
+	stored, err := readUsageFile(u.path)
+	if err != nil {
+		return
+	}
+	merge(u.data.Images, stored.Images)
+	merge(u.data.Machines, stored.Machines)
+	err = u.write()
+	return
+}
+
+// write replaces the index file atomically
+func (u *UsageIndex) write() (err error) {
+	raw, err := json.Marshal(u.data)
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(u.path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(u.path)+".tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(raw)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), u.path)
+	return
+}
+
+// merge copies to dst the entries of src newer than its own
+func merge(dst, src map[string]time.Time) {
+	for id, t := range src {
+		if t.After(dst[id]) {
+			dst[id] = t
+		}
+	}
+}
+
+// forget removes the given entries and persists the index, merging it with the file first
+// like save so the entries written by other processes are kept
+func (u *UsageIndex) forget(images, machines []string) (err error) {
+	if len(images) == 0 && len(machines) == 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	stored, err := readUsageFile(u.path)
+	if err != nil {
+		return
+	}
+	merge(u.data.Images, stored.Images)
+	merge(u.data.Machines, stored.Machines)
+	for _, id := range images {
+		delete(u.data.Images, id)
+	}
+	for _, id := range machines {
+		delete(u.data.Machines, id)
+	}
+	err = u.write()
+	return
+}
+
+func (u *UsageIndex) oldest(entries map[string]time.Time) (sorted []UsageEntry) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for id, t := range entries {
+		sorted = append(sorted, UsageEntry{ID: id, LastUsed: t})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].LastUsed.Equal(sorted[j].LastUsed) {
+			return sorted[i].ID < sorted[j].ID
+		}
+		return sorted[i].LastUsed.Before(sorted[j].LastUsed)
+	})
+	return
+}
+
+// leastRecentlyUsed returns up to n entries, oldest first, dropping the ones exists rejects
+func (u *UsageIndex) leastRecentlyUsed(entries map[string]time.Time, n int, exists func(id string) (bool, error)) (lru, stale []string, err error) {
+	for _, entry := range u.oldest(entries) {
+		if len(lru) == n {
+			break
+		}
+		var ok bool
+		ok, err = exists(entry.ID)
+		if err != nil {
+			return
+		}
+		if !ok {
+			stale = append(stale, entry.ID)
+			continue
+		}
+		lru = append(lru, entry.ID)
+	}
+	return
+}
+
+// LeastRecentlyUsedImages returns up to n image IDs known by the daemon, least recently used first,
+// images removed out-of-band are dropped from the index
+func (u *UsageIndex) LeastRecentlyUsedImages(client *docker.Client, n int) (images []string, err error) {
+	images, stale, err := u.leastRecentlyUsed(u.data.Images, n, func(id string) (bool, error) {
+		_, inspectErr := client.InspectImage(id)
+		if inspectErr == docker.ErrNoSuchImage {
+			return false, nil
+		}
+		return inspectErr == nil, inspectErr
+	})
+	if err != nil {
+		return
+	}
+	err = u.forget(stale, nil)
+	return
+}
+
+// LeastRecentlyUsedMachines returns up to n machine IDs, least recently used first,
+// machines for which exists reports false are dropped from the index
+func (u *UsageIndex) LeastRecentlyUsedMachines(n int, exists func(machineID string) (bool, error)) (machines []string, err error) {
+	machines, stale, err := u.leastRecentlyUsed(u.data.Machines, n, exists)
+	if err != nil {
+		return
+	}
+	err = u.forget(nil, stale)
+	return
+}
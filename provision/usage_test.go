@@ -0,0 +1,199 @@
+package provision
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofn/gofn/iaas"
+)
+
+func tempUsageIndex(t *testing.T) (index *UsageIndex, path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "gofn-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "usage.json")
+	index, err = OpenUsageIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index, path, func() { os.RemoveAll(dir) }
+}
+
+// fakeClock returns a clock advancing one minute at each call
+func fakeClock() func() time.Time {
+	var mu sync.Mutex
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Minute)
+		return now
+	}
+}
+
+func allExist(string) (bool, error) {
+	return true, nil
+}
+
+func TestUsageIndexConcurrentTouch(t *testing.T) {
+	index, _, cleanup := tempUsageIndex(t)
+	defer cleanup()
+	index.now = fakeClock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := index.TouchMachine(fmt.Sprintf("m%d", i%5)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	machines, err := index.LeastRecentlyUsedMachines(10, allExist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(machines) != 5 {
+		t.Errorf("expected 5 machines but found %v", machines)
+	}
+}
+
+func TestUsageIndexOrderAndPersistence(t *testing.T) {
+	index, path, cleanup := tempUsageIndex(t)
+	defer cleanup()
+	index.now = fakeClock()
+	for _, id := range []string{"a", "b", "c", "a"} {
+		if err := index.TouchMachine(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a new process opening the same file
+	restarted, err := OpenUsageIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machines, err := restarted.LeastRecentlyUsedMachines(2, allExist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(machines, want) {
+		t.Errorf("expected %v but found %v", want, machines)
+	}
+
+	// writes of both processes are merged
+	restarted.now = func() time.Time { return time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC) }
+	if err = restarted.TouchMachine("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.TouchMachine("d"); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenUsageIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machines, err = reopened.LeastRecentlyUsedMachines(10, allExist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"c", "a", "d", "b"}; !reflect.DeepEqual(machines, want) {
+		t.Errorf("expected %v but found %v", want, machines)
+	}
+}
+
+func TestUsageIndexStaleEntries(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	image, err := client.InspectImage(createFakeImage(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, path, cleanup := tempUsageIndex(t)
+	defer cleanup()
+	index.now = fakeClock()
+	for _, id := range []string{"deleted-out-of-band", image.ID} {
+		if err = index.TouchImage(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	images, err := index.LeastRecentlyUsedImages(client, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{image.ID}; !reflect.DeepEqual(images, want) {
+		t.Errorf("expected %v but found %v", want, images)
+	}
+	reopened, err := OpenUsageIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.data.Images["deleted-out-of-band"]; ok {
+		t.Error("expected the stale image to be removed from the index")
+	}
+
+	gone := map[string]bool{"m1": true}
+	for _, id := range []string{"m1", "m2"} {
+		if err = index.TouchMachine(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// touched by another process while the stale entries are looked up
+	if err = reopened.TouchMachine("m3"); err != nil {
+		t.Fatal(err)
+	}
+	machines, err := index.LeastRecentlyUsedMachines(10, func(id string) (bool, error) { return !gone[id], nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"m2"}; !reflect.DeepEqual(machines, want) {
+		t.Errorf("expected %v but found %v", want, machines)
+	}
+	reopened, err = OpenUsageIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.data.Machines["m3"]; !ok {
+		t.Error("expected forgetting the stale machine to keep the entries of the other process")
+	}
+	if _, ok := reopened.data.Machines["m1"]; ok {
+		t.Error("expected the stale machine to be removed from the index")
+	}
+}
+
+func TestRunnerRecordsUsage(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	client := NewTestClient(server.URL(), t)
+	imageName := createFakeImage(client)
+	image, err := client.InspectImage(imageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, _, cleanup := tempUsageIndex(t)
+	defer cleanup()
+
+	r := NewRunner(client)
+	r.Usage = index
+	_, err = r.FnContainer(ContainerOptions{Image: imageName, Machine: &iaas.Machine{ID: "42"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index.data.Images[image.ID]; !ok {
+		t.Errorf("expected image %s to be recorded", image.ID)
+	}
+	if _, ok := index.data.Machines["42"]; !ok {
+		t.Error("expected machine 42 to be recorded")
+	}
+}
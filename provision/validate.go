@@ -0,0 +1,290 @@
+package provision
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Codes of the validation errors
+const (
+	// CodeRequired is the code of a missing value
+	CodeRequired = "required"
+	// CodeInvalid is the code of a malformed value
+	CodeInvalid = "invalid"
+	// CodeConflict is the code of a value that can not be combined with another one
+	CodeConflict = "conflict"
+	// CodeIncomplete is the code of a value that needs another one
+	CodeIncomplete = "incomplete"
+	// CodePolicy is the code of a value rejected by a policy
+	CodePolicy = "policy"
+)
+
+// maxImageNameLength is the longest repository name accepted by the daemon
+const maxImageNameLength = 255
+
+var (
+	// imageNamePattern is the reference grammar of the docker distribution, the domain followed
+	// by lower case path components, an optional tag and an optional digest
+	imageNamePattern = regexp.MustCompile(`^` +
+		`(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+		`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+		`(?::[\w][\w.-]{0,127})?` +
+		`(?:@sha256:[a-f0-9]{64})?$`)
+	platformPattern = regexp.MustCompile(`^[a-z0-9_]+(?:/[a-z0-9_]+){0,2}$`)
+	stagePattern    = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]*$`)
+	envNamePattern  = regexp.MustCompile(`^[^=\s]+$`)
+	userPattern     = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]*)?$`)
+	networkPattern  = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	timezonePattern = regexp.MustCompile(`^[A-Za-z0-9_+-]+(?:/[A-Za-z0-9_+-]+)*$`)
+	hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+)
+
+// ValidationError is a problem of a field of the options, it is suitable for an API response
+type ValidationError struct {
+	// Field is the name of the field, e.g. ImageName or Auth.Password
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("provision: invalid %s: %s", e.Field, e.Message)
+}
+
+// ValidationErrors is returned by the Runner validating the options for options that do not
+// validate, see Runner.ValidateOptions
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, v := range e {
+		msgs[i] = fmt.Sprintf("%s: %s", v.Field, v.Message)
+	}
+	return "provision: invalid options: " + strings.Join(msgs, "; ")
+}
+
+// BuildPolicy returns the errors of build options rejected by the caller rules
+type BuildPolicy func(opts BuildOptions) []ValidationError
+
+// ContainerPolicy returns the errors of container options rejected by the caller rules
+type ContainerPolicy func(opts ContainerOptions) []ValidationError
+
+// ValidateBuildOptions returns the problems of opts followed by the ones of the policies
+func ValidateBuildOptions(opts BuildOptions, policies ...BuildPolicy) (errs []ValidationError) {
+	if opts.ImageName == "" {
+		errs = append(errs, ValidationError{"ImageName", CodeRequired, "the image name is required"})
+	} else if name := opts.GetImageName(); len(name) > maxImageNameLength || !imageNamePattern.MatchString(name) {
+		errs = append(errs, ValidationError{"ImageName", CodeInvalid,
+			fmt.Sprintf("%q is not a valid image reference, the repository must be lower case", name)})
+	}
+	if opts.ContextDir != "" && opts.RemoteURI != "" {
+		errs = append(errs, ValidationError{"RemoteURI", CodeConflict, "the remote URI and the context dir are exclusive"})
+	}
+	if opts.Dockerfile != "" {
+		dockerfile := path.Clean(strings.Replace(opts.Dockerfile, `\`, "/", -1))
+		if path.IsAbs(dockerfile) || dockerfile == ".." || strings.HasPrefix(dockerfile, "../") {
+			errs = append(errs, ValidationError{"Dockerfile", CodeInvalid, "the Dockerfile must be inside the build context"})
+		}
+	}
+	if opts.Target != "" && !stagePattern.MatchString(opts.Target) {
+		errs = append(errs, ValidationError{"Target", CodeInvalid, fmt.Sprintf("%q is not a valid stage name", opts.Target)})
+	}
+	if opts.Platform != "" && !platformPattern.MatchString(opts.Platform) {
+		errs = append(errs, ValidationError{"Platform", CodeInvalid,
+			fmt.Sprintf("%q is not a platform of the form os[/arch[/variant]]", opts.Platform)})
+	}
+	if opts.NetworkMode != "" && !networkPattern.MatchString(opts.NetworkMode) {
+		errs = append(errs, ValidationError{"NetworkMode", CodeInvalid, fmt.Sprintf("%q is not a valid network", opts.NetworkMode)})
+	}
+	for i, host := range opts.ExtraHosts {
+		if !validExtraHost(host) {
+			errs = append(errs, ValidationError{fmt.Sprintf("ExtraHosts[%d]", i), CodeInvalid,
+				fmt.Sprintf("%q is not a host of the form host:ip", host)})
+		}
+	}
+	switch opts.PullPolicy {
+	case PullDefault, PullAlways, PullIfNotPresent, PullNever:
+	default:
+		errs = append(errs, ValidationError{"PullPolicy", CodeInvalid,
+			fmt.Sprintf("unknown pull policy %q, expected always, if_not_present or never", opts.PullPolicy)})
+	}
+	errs = append(errs, validateAuth("Auth", opts.Auth)...)
+	hosts := make([]string, 0, len(opts.AuthConfigs))
+	for host := range opts.AuthConfigs {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		errs = append(errs, validateAuth(fmt.Sprintf("AuthConfigs[%s]", host), opts.AuthConfigs[host])...)
+	}
+	for _, policy := range policies {
+		if policy != nil {
+			errs = append(errs, policy(opts)...)
+		}
+	}
+	return
+}
+
+// validateAuth checks the registry credentials auth of the field
+func validateAuth(field string, auth docker.AuthConfiguration) (errs []ValidationError) {
+	hasUser := auth.Username != "" || auth.Email != ""
+	if hasUser && auth.Password == "" {
+		errs = append(errs, ValidationError{field + ".Password", CodeIncomplete, "the registry credentials need a password"})
+	}
+	if !hasUser && auth.Password != "" {
+		errs = append(errs, ValidationError{field + ".Username", CodeIncomplete, "the registry credentials need a username or an email"})
+	}
+	return
+}
+
+// ValidateContainerOptions returns the problems of opts followed by the ones of the policies
+func ValidateContainerOptions(opts ContainerOptions, policies ...ContainerPolicy) (errs []ValidationError) {
+	if opts.Image == "" {
+		errs = append(errs, ValidationError{"Image", CodeRequired, "the image is required"})
+	}
+	for i, env := range opts.Env {
+		if !envNamePattern.MatchString(strings.SplitN(env, "=", 2)[0]) {
+			errs = append(errs, ValidationError{fmt.Sprintf("Env[%d]", i), CodeInvalid,
+				fmt.Sprintf("%q is not a variable of the form KEY=VALUE", env)})
+		}
+	}
+	for i, name := range opts.EnvPassthrough {
+		if !envNamePattern.MatchString(name) {
+			errs = append(errs, ValidationError{fmt.Sprintf("EnvPassthrough[%d]", i), CodeInvalid, fmt.Sprintf("%q is not a valid variable name", name)})
+		}
+	}
+	secrets := make([]string, 0, len(opts.Secrets))
+	for name := range opts.Secrets {
+		secrets = append(secrets, name)
+	}
+	sort.Strings(secrets)
+	for _, name := range secrets {
+		field := fmt.Sprintf("Secrets[%s]", name)
+		switch {
+		case opts.SecretMode == SecretFile && !isSecretFileName(name):
+			errs = append(errs, ValidationError{field, CodeInvalid, fmt.Sprintf("%q is not a file name", name)})
+		case !envNamePattern.MatchString(name):
+			errs = append(errs, ValidationError{field, CodeInvalid, fmt.Sprintf("%q is not a valid secret name", name)})
+		}
+	}
+	if opts.SecretMode != SecretEnv && opts.SecretMode != SecretFile {
+		errs = append(errs, ValidationError{"SecretMode", CodeInvalid, fmt.Sprintf("unknown secret mode %d", opts.SecretMode)})
+	}
+	if len(opts.Secrets) > 0 && opts.SecretMode == SecretFile && opts.ReadOnlyRootfs {
+		errs = append(errs, ValidationError{"Secrets", CodeConflict, "the secret files can not be written to a read-only root filesystem"})
+	}
+	for key := range opts.EnvTemplate {
+		if !envNamePattern.MatchString(key) {
+			errs = append(errs, ValidationError{"EnvTemplate", CodeInvalid, fmt.Sprintf("%q is not a valid variable name", key)})
+		}
+	}
+	for i, volume := range opts.Volumes {
+		parts := strings.Split(volume, ":")
+		valid := len(parts) >= 2
+		for _, part := range parts {
+			valid = valid && part != ""
+		}
+		if !valid {
+			errs = append(errs, ValidationError{fmt.Sprintf("Volumes[%d]", i), CodeInvalid,
+				fmt.Sprintf("%q is not a bind of the form source:destination[:mode]", volume)})
+		}
+	}
+	if opts.UsernsMode != "" && opts.UsernsMode != "host" {
+		errs = append(errs, ValidationError{"UsernsMode", CodeInvalid, `the user namespace mode can only be "host"`})
+	}
+	if opts.NonRootUser != "" {
+		if !userPattern.MatchString(opts.NonRootUser) {
+			errs = append(errs, ValidationError{"NonRootUser", CodeInvalid,
+				fmt.Sprintf("%q is not a user of the form user[:group]", opts.NonRootUser)})
+		} else if isRootUser(opts.NonRootUser) {
+			errs = append(errs, ValidationError{"NonRootUser", CodeConflict, "the non-root user can not be root"})
+		}
+	}
+	if opts.User != "" {
+		if !userPattern.MatchString(opts.User) {
+			errs = append(errs, ValidationError{"User", CodeInvalid,
+				fmt.Sprintf("%q is not a user of the form user[:group]", opts.User)})
+		} else if isRootUser(opts.User) && opts.RunAsNonRoot && !opts.AllowRoot {
+			errs = append(errs, ValidationError{"User", CodeConflict, "a container run as non-root can not run as root without AllowRoot"})
+		}
+	}
+	if opts.WorkingDir != "" && !path.IsAbs(opts.WorkingDir) {
+		errs = append(errs, ValidationError{"WorkingDir", CodeInvalid, fmt.Sprintf("%q is not an absolute path", opts.WorkingDir)})
+	}
+	if opts.InjectTimezone != "" && !timezonePattern.MatchString(opts.InjectTimezone) {
+		errs = append(errs, ValidationError{"InjectTimezone", CodeInvalid,
+			fmt.Sprintf("%q is not a timezone of the form Area/Location", opts.InjectTimezone)})
+	}
+	if opts.Memory < 0 {
+		errs = append(errs, ValidationError{"Memory", CodeInvalid, "the memory limit can not be negative"})
+	}
+	if opts.NanoCPUs < 0 {
+		errs = append(errs, ValidationError{"NanoCPUs", CodeInvalid, "the CPU limit can not be negative"})
+	}
+	for i, name := range opts.SeccompAllowlist {
+		if !syscallPattern.MatchString(name) {
+			errs = append(errs, ValidationError{fmt.Sprintf("SeccompAllowlist[%d]", i), CodeInvalid,
+				fmt.Sprintf("%q is not a syscall name", name)})
+		}
+	}
+	if opts.ExecutionTimeout < 0 {
+		errs = append(errs, ValidationError{"ExecutionTimeout", CodeInvalid, "the execution timeout can not be negative"})
+	}
+	if opts.StopTimeout < 0 {
+		errs = append(errs, ValidationError{"StopTimeout", CodeInvalid, "the stop timeout can not be negative"})
+	}
+	for i, p := range opts.OutputPaths {
+		if !path.IsAbs(p) {
+			errs = append(errs, ValidationError{fmt.Sprintf("OutputPaths[%d]", i), CodeInvalid, fmt.Sprintf("%q is not an absolute path", p)})
+		}
+	}
+	if len(opts.OutputPaths) > 0 && opts.AutoRemove {
+		errs = append(errs, ValidationError{"OutputPaths", CodeConflict, "the output paths of an auto removed container are gone with it"})
+	}
+	if opts.ExclusivePolicy != ExclusiveWait && opts.ExclusivePolicy != ExclusiveFailFast {
+		errs = append(errs, ValidationError{"ExclusivePolicy", CodeInvalid, fmt.Sprintf("unknown exclusive policy %q", opts.ExclusivePolicy)})
+	}
+	switch opts.Egress.Mode {
+	case EgressUnrestricted:
+	case EgressNone:
+		if opts.Network != "" {
+			errs = append(errs, ValidationError{"Network", CodeConflict, "a container without network can not join a network"})
+		}
+		if opts.EnableHostCallback {
+			errs = append(errs, ValidationError{"EnableHostCallback", CodeConflict, "a container without network can not reach the host"})
+		}
+	case EgressAllowList:
+		if len(opts.Egress.Allow) == 0 {
+			errs = append(errs, ValidationError{"Egress.Allow", CodeRequired, "the allow list egress needs the allowed hosts"})
+		}
+		for i, entry := range opts.Egress.Allow {
+			if _, err := egressFilter(entry); err != nil {
+				errs = append(errs, ValidationError{fmt.Sprintf("Egress.Allow[%d]", i), CodeInvalid, err.Error()})
+			}
+		}
+	default:
+		errs = append(errs, ValidationError{"Egress.Mode", CodeInvalid, fmt.Sprintf("unknown egress mode %d", opts.Egress.Mode)})
+	}
+	for _, policy := range policies {
+		if policy != nil {
+			errs = append(errs, policy(opts)...)
+		}
+	}
+	return
+}
+
+// validExtraHost reports whether host is of the form host:ip, the ip may be an IPv6 one
+// or host-gateway, the address of the host in the daemon network
+func validExtraHost(host string) bool {
+	parts := strings.SplitN(host, ":", 2)
+	if len(parts) != 2 || !hostnamePattern.MatchString(parts[0]) {
+		return false
+	}
+	return parts[1] == "host-gateway" || net.ParseIP(parts[1]) != nil
+}
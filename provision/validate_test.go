@@ -0,0 +1,205 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestValidateBuildOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  BuildOptions
+		field string
+		code  string
+	}{
+		{"valid", BuildOptions{ImageName: "python"}, "", ""},
+		{"valid tag", BuildOptions{ImageName: "python:3.7-alpine"}, "", ""},
+		{"valid registry", BuildOptions{ImageName: "localhost:5000/team/app_1", DoNotUsePrefixImageName: true}, "", ""},
+		{"valid digest", BuildOptions{ImageName: "alpine@sha256:" + strings.Repeat("a", 64), DoNotUsePrefixImageName: true}, "", ""},
+		{"missing name", BuildOptions{}, "ImageName", CodeRequired},
+		{"upper case name", BuildOptions{ImageName: "Python"}, "ImageName", CodeInvalid},
+		{"invalid tag", BuildOptions{ImageName: "python:-3"}, "ImageName", CodeInvalid},
+		{"long name", BuildOptions{ImageName: strings.Repeat("a", 256), DoNotUsePrefixImageName: true}, "ImageName", CodeInvalid},
+		{"context dir", BuildOptions{ImageName: "app", ContextDir: "./app"}, "", ""},
+		{"remote", BuildOptions{ImageName: "app", RemoteURI: "https://github.com/gofn/gofn.git"}, "", ""},
+		{"context dir and remote", BuildOptions{ImageName: "app", ContextDir: "./app", RemoteURI: "https://github.com/gofn/gofn.git"}, "RemoteURI", CodeConflict},
+		{"nested dockerfile", BuildOptions{ImageName: "app", Dockerfile: "sub/Dockerfile"}, "", ""},
+		{"absolute dockerfile", BuildOptions{ImageName: "app", Dockerfile: "/etc/Dockerfile"}, "Dockerfile", CodeInvalid},
+		{"dockerfile outside the context", BuildOptions{ImageName: "app", Dockerfile: "sub/../../Dockerfile"}, "Dockerfile", CodeInvalid},
+		{"target", BuildOptions{ImageName: "app", Target: "build-env"}, "", ""},
+		{"invalid target", BuildOptions{ImageName: "app", Target: "-build"}, "Target", CodeInvalid},
+		{"platform", BuildOptions{ImageName: "app", Platform: "linux/arm64/v8"}, "", ""},
+		{"invalid platform", BuildOptions{ImageName: "app", Platform: "linux arm64"}, "Platform", CodeInvalid},
+		{"network mode", BuildOptions{ImageName: "app", NetworkMode: "host"}, "", ""},
+		{"invalid network mode", BuildOptions{ImageName: "app", NetworkMode: "host; rm"}, "NetworkMode", CodeInvalid},
+		{"extra hosts", BuildOptions{ImageName: "app", ExtraHosts: []string{"mirror.internal:10.0.0.5", "v6:fd00::1", "gw:host-gateway"}}, "", ""},
+		{"extra host without ip", BuildOptions{ImageName: "app", ExtraHosts: []string{"mirror"}}, "ExtraHosts[0]", CodeInvalid},
+		{"extra host with invalid ip", BuildOptions{ImageName: "app", ExtraHosts: []string{"mirror:10.0.0"}}, "ExtraHosts[0]", CodeInvalid},
+		{"extra host with invalid name", BuildOptions{ImageName: "app", ExtraHosts: []string{"-mirror:10.0.0.5"}}, "ExtraHosts[0]", CodeInvalid},
+		{"complete auth", BuildOptions{ImageName: "app", Auth: docker.AuthConfiguration{Username: "gofn", Password: "secret"}}, "", ""},
+		{"token auth", BuildOptions{ImageName: "app", Auth: docker.AuthConfiguration{IdentityToken: "token"}}, "", ""},
+		{"auth without password", BuildOptions{ImageName: "app", Auth: docker.AuthConfiguration{Email: "gofn@example.com"}}, "Auth.Password", CodeIncomplete},
+		{"auth without username", BuildOptions{ImageName: "app", Auth: docker.AuthConfiguration{Password: "secret"}}, "Auth.Username", CodeIncomplete},
+		{"registry auth without password", BuildOptions{ImageName: "app", AuthConfigs: RegistryAuth{"gcr.io": {Username: "_json_key"}}}, "AuthConfigs[gcr.io].Password", CodeIncomplete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateBuildOptions(tt.opts)
+			if tt.field == "" {
+				if len(errs) > 0 {
+					t.Errorf("Expected no errors but %v found", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Field != tt.field || errs[0].Code != tt.code {
+				t.Errorf("expected a %s error on %s but found %v", tt.code, tt.field, errs)
+			}
+		})
+	}
+}
+
+func TestValidateContainerOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  ContainerOptions
+		field string
+		code  string
+	}{
+		{"valid", ContainerOptions{Image: "gofn/python"}, "", ""},
+		{"missing image", ContainerOptions{}, "Image", CodeRequired},
+		{"env", ContainerOptions{Image: "gofn/python", Env: []string{"GO=fn", "EMPTY=", "UNSET"}}, "", ""},
+		{"env without name", ContainerOptions{Image: "gofn/python", Env: []string{"GO=fn", "=fn"}}, "Env[1]", CodeInvalid},
+		{"secrets", ContainerOptions{Image: "gofn/python", Secrets: map[string]string{"API_TOKEN": "t"}, SecretMode: SecretFile}, "", ""},
+		{"secret file name", ContainerOptions{Image: "gofn/python", Secrets: map[string]string{"../token": "t"}, SecretMode: SecretFile}, "Secrets[../token]", CodeInvalid},
+		{"secret files on read-only rootfs", ContainerOptions{Image: "gofn/python", Secrets: map[string]string{"token": "t"}, SecretMode: SecretFile, ReadOnlyRootfs: true}, "Secrets", CodeConflict},
+		{"user", ContainerOptions{Image: "gofn/python", User: "1000:1000", WorkingDir: "/app"}, "", ""},
+		{"invalid user", ContainerOptions{Image: "gofn/python", User: "app user"}, "User", CodeInvalid},
+		{"root user run as non-root", ContainerOptions{Image: "gofn/python", User: "0", RunAsNonRoot: true}, "User", CodeConflict},
+		{"relative working dir", ContainerOptions{Image: "gofn/python", WorkingDir: "app"}, "WorkingDir", CodeInvalid},
+		{"passthrough", ContainerOptions{Image: "gofn/python", EnvPassthrough: []string{"HOME", "AWS REGION"}}, "EnvPassthrough[1]", CodeInvalid},
+		{"template", ContainerOptions{Image: "gofn/python", EnvTemplate: map[string]string{"ID": "{{.InvocationID}}"}}, "", ""},
+		{"invalid template name", ContainerOptions{Image: "gofn/python", EnvTemplate: map[string]string{"MY ID": "{{.InvocationID}}"}}, "EnvTemplate", CodeInvalid},
+		{"bind", ContainerOptions{Image: "gofn/python", Volumes: []string{"/tmp:/tmp", "/data:/data:ro"}}, "", ""},
+		{"bind without destination", ContainerOptions{Image: "gofn/python", Volumes: []string{"/tmp"}}, "Volumes[0]", CodeInvalid},
+		{"bind with an empty source", ContainerOptions{Image: "gofn/python", Volumes: []string{":/tmp"}}, "Volumes[0]", CodeInvalid},
+		{"host callback without network", ContainerOptions{Image: "gofn/python", EnableHostCallback: true, Egress: EgressPolicy{Mode: EgressNone}}, "EnableHostCallback", CodeConflict},
+		{"timezone outside zoneinfo", ContainerOptions{Image: "gofn/python", InjectTimezone: "../../etc/passwd"}, "InjectTimezone", CodeInvalid},
+		{"host userns", ContainerOptions{Image: "gofn/python", UsernsMode: "host"}, "", ""},
+		{"invalid userns", ContainerOptions{Image: "gofn/python", UsernsMode: "private"}, "UsernsMode", CodeInvalid},
+		{"non-root user", ContainerOptions{Image: "gofn/python", RunAsNonRoot: true, NonRootUser: "1000:1000"}, "", ""},
+		{"named non-root user", ContainerOptions{Image: "gofn/python", RunAsNonRoot: true, NonRootUser: "nobody"}, "", ""},
+		{"malformed non-root user", ContainerOptions{Image: "gofn/python", RunAsNonRoot: true, NonRootUser: "1000:1000:1"}, "NonRootUser", CodeInvalid},
+		{"root non-root user", ContainerOptions{Image: "gofn/python", RunAsNonRoot: true, NonRootUser: "0:0"}, "NonRootUser", CodeConflict},
+		{"output paths", ContainerOptions{Image: "gofn/python", OutputPaths: []string{"/tmp/result.json"}}, "", ""},
+		{"relative output path", ContainerOptions{Image: "gofn/python", OutputPaths: []string{"result.json"}}, "OutputPaths[0]", CodeInvalid},
+		{"output paths auto removed", ContainerOptions{Image: "gofn/python", OutputPaths: []string{"/out"}, AutoRemove: true}, "OutputPaths", CodeConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateContainerOptions(tt.opts)
+			if tt.field == "" {
+				if len(errs) > 0 {
+					t.Errorf("Expected no errors but %v found", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Field != tt.field || errs[0].Code != tt.code {
+				t.Errorf("expected a %s error on %s but found %v", tt.code, tt.field, errs)
+			}
+		})
+	}
+}
+
+func TestValidationPolicies(t *testing.T) {
+	buildPolicy := func(opts BuildOptions) []ValidationError {
+		if !opts.DoNotUsePrefixImageName {
+			return nil
+		}
+		return []ValidationError{{Field: "DoNotUsePrefixImageName", Code: CodePolicy, Message: "only gofn images are allowed"}}
+	}
+	containerPolicy := func(opts ContainerOptions) []ValidationError {
+		if len(opts.Volumes) == 0 {
+			return nil
+		}
+		return []ValidationError{{Field: "Volumes", Code: CodePolicy, Message: "binds are not allowed"}}
+	}
+
+	if errs := ValidateBuildOptions(BuildOptions{ImageName: "app"}, buildPolicy); len(errs) > 0 {
+		t.Errorf("Expected no errors but %v found", errs)
+	}
+	errs := ValidateBuildOptions(BuildOptions{ImageName: "app", DoNotUsePrefixImageName: true}, buildPolicy)
+	if len(errs) != 1 || errs[0].Code != CodePolicy {
+		t.Errorf("expected a policy error but found %v", errs)
+	}
+	errs = ValidateContainerOptions(ContainerOptions{Image: "app", Volumes: []string{"/tmp:/tmp"}}, containerPolicy)
+	if len(errs) != 1 || errs[0].Code != CodePolicy {
+		t.Errorf("expected a policy error but found %v", errs)
+	}
+	if errs = ValidateContainerOptions(ContainerOptions{Image: "app", Volumes: []string{"/tmp:/tmp"}}); len(errs) > 0 {
+		t.Errorf("expected the policy to only apply when given but found %v", errs)
+	}
+}
+
+func TestValidationErrorJSON(t *testing.T) {
+	errs := ValidateBuildOptions(BuildOptions{ContextDir: "./app", RemoteURI: "https://github.com/gofn/gofn.git"})
+	out, err := json.Marshal(errs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"field":"ImageName","code":"required","message":"the image name is required"},` +
+		`{"field":"RemoteURI","code":"conflict","message":"the remote URI and the context dir are exclusive"}]`
+	if string(out) != want {
+		t.Errorf("expected %s but found %s", want, out)
+	}
+}
+
+func TestRunnerValidatesBeforeDocker(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	var calls int
+	server.CustomHandler("/.*", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	client := NewTestClient(server.URL(), t)
+	r := NewRunner(client)
+	r.ValidateOptions = true
+
+	_, err := r.Run(context.Background(), &BuildOptions{ImageName: "Test", ContextDir: "./testing_data"}, ContainerOptions{})
+	verr, ok := err.(ValidationErrors)
+	if !ok || len(verr) != 1 || verr[0].Field != "ImageName" {
+		t.Errorf("expected a validation error on ImageName but found %v", err)
+	}
+	_, err = r.FnContainer(ContainerOptions{Image: "gofn/python", UsernsMode: "private"})
+	verr, ok = err.(ValidationErrors)
+	if !ok || len(verr) != 1 || verr[0].Field != "UsernsMode" {
+		t.Errorf("expected a validation error on UsernsMode but found %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("expected no docker calls but found %d", calls)
+	}
+
+	// a policy validates without ValidateOptions
+	r = NewRunner(client)
+	r.ContainerPolicy = func(opts ContainerOptions) []ValidationError {
+		return []ValidationError{{Field: "Image", Code: CodePolicy, Message: "no image is allowed"}}
+	}
+	_, err = r.FnContainer(ContainerOptions{Image: "gofn/python"})
+	if verr, ok = err.(ValidationErrors); !ok || len(verr) != 1 || verr[0].Code != CodePolicy {
+		t.Errorf("expected a policy error but found %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("expected no docker calls but found %d", calls)
+	}
+
+	// the plain functions do not validate
+	_, err = FnContainer(client, ContainerOptions{Image: "gofn/python", UsernsMode: "private"})
+	if _, ok = err.(ValidationErrors); ok {
+		t.Errorf("expected FnContainer not to validate but found %v", err)
+	}
+}
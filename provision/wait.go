@@ -0,0 +1,129 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// waitConditionAPIVersion is the first docker API version with the wait conditions
+const waitConditionAPIVersion = "1.30"
+
+// containerExit is the answer of a container wait
+type containerExit struct {
+	code int
+	err  error
+}
+
+// exitCode waits the started container to exit and returns its exit code. A container
+// exiting before the wait and removed meanwhile is answered as missing by the daemon,
+// its exit code is then read from its state when it is still there.
+func exitCode(ctx context.Context, client *docker.Client, containerID string) (code int, err error) {
+	code, err = client.WaitContainerWithContext(containerID, ctx)
+	if !isNoSuchContainer(err) {
+		return
+	}
+	container, inspectErr := client.InspectContainerWithContext(containerID, ctx)
+	if inspectErr != nil || container.State.Running {
+		return
+	}
+	code, err = container.State.ExitCode, nil
+	return
+}
+
+// waitNextExit subscribes to the next exit of the created container, it must be called
+// before the container is started: an auto removed container is gone once it exited,
+// so waiting it afterwards can not tell its exit code. The daemon answers the headers
+// once the wait is registered, so the container can be started when waitNextExit returns.
+// Daemons older than the wait conditions refuse the call instead of answering right away.
+func waitNextExit(ctx context.Context, client *docker.Client, containerID string) (exit <-chan containerExit, err error) {
+	endpoint, err := url.Parse(client.Endpoint())
+	if err != nil {
+		return
+	}
+	switch endpoint.Scheme {
+	case "unix", "npipe":
+		endpoint = &url.URL{Scheme: "http", Host: "unix.sock"}
+	case "tcp":
+		endpoint.Scheme = "http"
+		if client.TLSConfig != nil {
+			endpoint.Scheme = "https"
+		}
+	}
+	endpoint.Path = fmt.Sprintf("/v%s/containers/%s/wait", waitConditionAPIVersion, containerID)
+	endpoint.RawQuery = "condition=next-exit"
+	req, err := http.NewRequest(http.MethodPost, endpoint.String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			err = &docker.NoSuchContainer{ID: containerID}
+			return
+		}
+		err = &docker.Error{Status: resp.StatusCode, Message: daemonMessage(resp)}
+		return
+	}
+	answer := make(chan containerExit, 1)
+	var code int
+	goSafe("container wait", func() (err error) {
+		defer resp.Body.Close()
+		var body struct {
+			StatusCode int
+			Error      *struct{ Message string }
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		code = body.StatusCode
+		if err == nil && body.Error != nil && body.Error.Message != "" {
+			err = errors.New(body.Error.Message)
+		}
+		return
+	}, func(err error) {
+		answer <- containerExit{code: code, err: err}
+	})
+	exit = answer
+	return
+}
+
+// daemonMessage returns the message of the error answered by the daemon, the status when the
+// body does not hold one
+func daemonMessage(resp *http.Response) string {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return resp.Status
+	}
+	var answer struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &answer) == nil && answer.Message != "" {
+		return answer.Message
+	}
+	if text := strings.TrimSpace(string(body)); text != "" {
+		return text
+	}
+	return resp.Status
+}
+
+// awaitExit returns the exit code sent to exit, bounded by ctx
+func awaitExit(ctx context.Context, exit <-chan containerExit) (code int, err error) {
+	select {
+	case e := <-exit:
+		code, err = e.code, e.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
@@ -0,0 +1,198 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+)
+
+// fakeFastExit makes the containers of the fake docker api exit with code as soon as they are
+// started, before any wait, removing them when autoRemove is set. The plain waits are answered
+// as the daemon does for a container it no longer has, only the waits for the next exit
+// subscribed to before the start see it.
+func fakeFastExit(t *testing.T, server *fake.DockerServer, code int, autoRemove bool) {
+	exited := make(chan struct{})
+	server.CustomHandler("/containers/.*/start", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.DefaultHandler().ServeHTTP(w, r)
+		m := containerPathRegexp.FindStringSubmatch(r.URL.Path)
+		_ = server.MutateContainer(m[1], docker.State{ExitCode: code, StartedAt: time.Now(), FinishedAt: time.Now()})
+		if autoRemove {
+			req, _ := http.NewRequest(http.MethodDelete, server.URL()+"containers/"+m[1]+"?force=1", nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}
+		close(exited)
+	}))
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("condition") != "next-exit" {
+			http.Error(w, "No such container", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-exited
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"StatusCode": code})
+	}))
+}
+
+func TestRunnerRunFastExit(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       int
+		autoRemove bool
+		wantErr    error
+	}{
+		{"kept container", 0, false, nil},
+		{"kept failed container", 3, false, ErrContainerExecutionFailed},
+		{"auto removed container", 0, true, nil},
+		{"auto removed failed container", 3, true, ErrContainerExecutionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := createFakeDockerAPI(t)
+			defer server.Stop()
+			fakeFrames(server, []frame{{StreamStdout, "fast\n"}})
+			fakeFastExit(t, server, tt.code, tt.autoRemove)
+			hostConfigs := recordCreate(server)
+			client := NewTestClient(server.URL(), t)
+			if _, _, err := FnImageBuild(client, testBuildOptions()); err != nil {
+				t.Fatal(err)
+			}
+
+			r := NewRunner(client)
+			r.OutputStrategy = OutputLogs
+			result, err := r.Run(context.Background(), testBuildOptions(), ContainerOptions{AutoRemove: tt.autoRemove})
+			if err != tt.wantErr {
+				t.Fatalf("expected %v but found %v", tt.wantErr, err)
+			}
+			if result.Stdout.String() != "fast\n" {
+				t.Errorf("expected the output of the fast container but found %q", result.Stdout)
+			}
+			wantStrategy := OutputLogs
+			if tt.autoRemove {
+				wantStrategy = OutputAttach
+			}
+			if result.OutputStrategy != wantStrategy {
+				t.Errorf("expected the %s strategy but found %s", wantStrategy, result.OutputStrategy)
+			}
+			if len(*hostConfigs) != 1 || (string((*hostConfigs)[0]["AutoRemove"]) == "true") != tt.autoRemove {
+				t.Errorf("expected AutoRemove %v to be sent but found %v", tt.autoRemove, *hostConfigs)
+			}
+		})
+	}
+}
+
+func TestFnWaitContainerFastExit(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeFastExit(t, server, 0, false)
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+	if err := FnStart(client, container.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-FnWaitContainer(client, container.ID); err != nil {
+		t.Errorf("expected the exit code of the exited container to be read but found %v", err)
+	}
+}
+
+func TestFnRunFastExit(t *testing.T) {
+	for _, autoRemove := range []bool{false, true} {
+		server := createFakeDockerAPI(t)
+		defer server.Stop()
+		fakeFrames(server, []frame{{StreamStdout, "fast\n"}})
+		fakeFastExit(t, server, 3, autoRemove)
+		client := NewTestClient(server.URL(), t)
+		container, err := client.CreateContainer(docker.CreateContainerOptions{
+			Config:     &docker.Config{Image: createFakeImage(client), OpenStdin: true, StdinOnce: true},
+			HostConfig: &docker.HostConfig{AutoRemove: autoRemove},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout, _, err := FnRun(client, container.ID, "input")
+		if execErr, ok := err.(*ExecutionError); !ok || execErr.ExitCode != 3 {
+			t.Errorf("autoRemove %v: expected the exit code of the fast container but found %v", autoRemove, err)
+		}
+		if stdout.String() != "fast\n" {
+			t.Errorf("autoRemove %v: expected the output of the fast container but found %q", autoRemove, stdout)
+		}
+	}
+}
+
+func TestWaitNextExitDaemonError(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	server.CustomHandler("/containers/.*/wait", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"message":"client version 1.30 is too old"}`))
+	}))
+	client := NewTestClient(server.URL(), t)
+	_, err := waitNextExit(context.Background(), client, "a1b2c3")
+	if apiErr, ok := err.(*docker.Error); !ok || apiErr.Status != http.StatusBadRequest || apiErr.Message != "client version 1.30 is too old" {
+		t.Errorf("expected the message of the daemon but found %#v", err)
+	}
+}
+
+func TestFnWaitExit(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 3, 0)
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+	runFakeContainer(client, container.ID, t)
+
+	if exit := <-FnWaitExit(context.Background(), client, container.ID); exit.ExitCode != 3 || exit.Err != nil {
+		t.Errorf("expected the exit code 3 but found %+v", exit)
+	}
+	if err := <-FnWaitContainer(client, container.ID); err != ErrContainerExecutionFailed {
+		t.Errorf("expected %q but found %v", ErrContainerExecutionFailed, err)
+	}
+	if exit := <-FnWaitExit(context.Background(), client, "missing"); exit.ExitCode != -1 || exit.Err == nil {
+		t.Errorf("expected the wait of a missing container to fail but found %+v", exit)
+	}
+}
+
+func TestFnWaitContainerUnreadNoLeak(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	fakeExit(server, 1, 0)
+	client := NewTestClient(server.URL(), t)
+	container := createFakeContainer(client, t)
+	runFakeContainer(client, container.ID, t)
+	idle := func() int {
+		if transport, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+		return runtime.NumGoroutine()
+	}
+	// the first wait opens the connections the next ones reuse
+	<-FnWaitContainer(client, container.ID)
+	before := idle()
+
+	// failed waits and failed executions whose channel is never read
+	for i := 0; i < 20; i++ {
+		FnWaitContainer(client, container.ID)
+		FnWaitContainer(client, "missing")
+		FnWaitExit(context.Background(), client, container.ID)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for idle() > before && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if after := idle(); after > before {
+		t.Errorf("expected the waits to end without being read but found %d goroutines instead of %d", after, before)
+	}
+}
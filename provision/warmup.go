@@ -0,0 +1,69 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultWarmupTimeout bounds the warm-up of a warm container, see PoolOptions.WarmupCmd
+	DefaultWarmupTimeout = 30 * time.Second
+	// DefaultWarmupBudget is the number of failed warm-ups a Start or an UpdateImage replaces
+	DefaultWarmupBudget = 3
+)
+
+// ErrWarmupFailed is raised when the warm-up of a warm container failed or timed out
+var ErrWarmupFailed = errors.New("provision: warm-up failed")
+
+// WarmupError is raised when the warm-up of the container ContainerID failed with Err, after
+// Duration, and the pool had no budget left to replace it
+type WarmupError struct {
+	ContainerID string
+	Duration    time.Duration
+	Err         error
+}
+
+func (e *WarmupError) Error() string {
+	return fmt.Sprintf("%v: container %s after %v: %v", ErrWarmupFailed, e.ContainerID, e.Duration, e.Err)
+}
+
+// Unwrap returns ErrWarmupFailed
+func (e *WarmupError) Unwrap() error {
+	return ErrWarmupFailed
+}
+
+// warmUp executes the WarmupCmd of the pool in the started container, a non-zero exit is an
+// ExecutionError and a warm-up running longer than WarmupTimeout fails with its context error
+func (p *ContainerPool) warmUp(ctx context.Context, containerID string) (duration time.Duration, err error) {
+	timeout := p.options.WarmupTimeout
+	if timeout == 0 {
+		timeout = DefaultWarmupTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		duration = time.Since(start)
+		if err != nil {
+			err = &WarmupError{ContainerID: containerID, Duration: duration, Err: err}
+		}
+	}()
+	var input io.Reader
+	if p.options.WarmupInput != "" {
+		input = strings.NewReader(p.options.WarmupInput)
+	}
+	stderr := new(bytes.Buffer)
+	exitCode, err := execCommand(ctx, p.Runner.Client, containerID, p.options.WarmupCmd, input, nil, stderr, ExecOptions{})
+	if err != nil {
+		return
+	}
+	if exitCode != 0 {
+		err = &ExecutionError{ExitCode: exitCode, Stderr: stderr.String()}
+	}
+	return
+}
@@ -4,7 +4,7 @@ set -e
 echo "" > coverage.txt
 
 for d in $(go list ./... | grep -v vendor | grep -v examples); do
-    go test -race -coverprofile=profile.out -covermode=atomic $d
+    go test -race -tags sqlite -coverprofile=profile.out -covermode=atomic $d
     if [ -f profile.out ]; then
         cat profile.out >> coverage.txt
         rm profile.out